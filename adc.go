@@ -0,0 +1,317 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Analog-to-Digital Converter registers
+// (Analog-to-Digital Converter (ADC), IMX6ULLRM).
+const (
+	ADC1_BASE = 0x02198000
+
+	ADCx_HC0 = 0x00
+	HC_AIEN  = 7
+	HC_ADCH  = 0
+
+	ADCx_HS  = 0x20
+	HS_COCO0 = 0
+
+	ADCx_R0 = 0x24
+
+	ADCx_CFG   = 0x44
+	CFG_OVWREN = 16
+	CFG_AVGS   = 14
+	CFG_ADTRG  = 13
+	CFG_ADHSC  = 10
+	CFG_ADSTS  = 8
+	CFG_ADLPC  = 7
+	CFG_ADIV   = 5
+	CFG_ADLSMP = 4
+	CFG_MODE   = 2
+	CFG_ADICLK = 0
+
+	ADCx_GC    = 0x48
+	GC_CAL     = 7
+	GC_ADCO    = 6
+	GC_AVGE    = 5
+	GC_ADACKEN = 0
+
+	ADCx_GS = 0x4c
+	GS_CALF = 1
+
+	// conversion disabled channel selection
+	ADC_CH_DISABLED = 0b11111
+	// external input channels (ADC1_IN0-ADC1_IN9 on pads GPIO1_IO00-09)
+	ADC_CHANNELS = 10
+
+	// 12-bit conversion mode
+	ADC_MODE_12 = 0b10
+	ADC_MAX     = 1<<12 - 1
+)
+
+var adcLog = newLogger("imx6_adc")
+
+// adc represents an ADC controller.
+type adc struct {
+	sync.Mutex
+
+	base uint32
+	init bool
+}
+
+// adcStats represents the conversion results of a channel.
+type adcStats struct {
+	Min   uint32
+	Max   uint32
+	Sum   uint64
+	Count int
+}
+
+func (s *adcStats) add(val uint32) {
+	if s.Count == 0 || val < s.Min {
+		s.Min = val
+	}
+
+	if val > s.Max {
+		s.Max = val
+	}
+
+	s.Sum += uint64(val)
+	s.Count += 1
+}
+
+func (s *adcStats) String() string {
+	if s.Count == 0 {
+		return "no samples"
+	}
+
+	return fmt.Sprintf("min:%4d avg:%7.2f max:%4d (%d samples)", s.Min, float64(s.Sum)/float64(s.Count), s.Max, s.Count)
+}
+
+var ADC1 = &adc{base: ADC1_BASE}
+
+// Init configures the controller for 12-bit conversions, averaging 4
+// samples, and runs the hardware calibration.
+func (hw *adc) Init() (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if hw.init {
+		return
+	}
+
+	reg.Write(hw.base+ADCx_HC0, ADC_CH_DISABLED)
+
+	// IPG clock / 2, input clock / 4, long sample time
+	reg.Write(hw.base+ADCx_CFG,
+		ADC_MODE_12<<CFG_MODE|
+			0b01<<CFG_ADICLK|
+			0b10<<CFG_ADIV|
+			1<<CFG_ADLSMP|
+			1<<CFG_OVWREN|
+			0b00<<CFG_AVGS)
+
+	reg.Write(hw.base+ADCx_GC, 1<<GC_AVGE)
+
+	// calibration must be performed with software triggers and
+	// hardware averaging enabled
+	reg.Write(hw.base+ADCx_GS, 1<<GS_CALF)
+	reg.Set(hw.base+ADCx_GC, GC_CAL)
+
+	if !reg.WaitFor(500*time.Millisecond, hw.base+ADCx_GC, GC_CAL, 1, 0) {
+		return errors.New("calibration timeout")
+	}
+
+	if reg.Get(hw.base+ADCx_GS, GS_CALF, 1) == 1 {
+		return errors.New("calibration failed")
+	}
+
+	// clear any pending conversion
+	reg.Read(hw.base + ADCx_R0)
+
+	hw.init = true
+
+	return
+}
+
+// Sample starts continuous conversions on the argument channel and collects
+// the requested number of results.
+//
+// Conversion completion is polled, as interrupt handling is not available.
+func (hw *adc) Sample(ch int, samples []uint32) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if !hw.init {
+		return errors.New("controller not initialized")
+	}
+
+	if ch < 0 || ch >= ADC_CHANNELS {
+		return fmt.Errorf("invalid channel %d", ch)
+	}
+
+	reg.Set(hw.base+ADCx_GC, GC_ADCO)
+	defer reg.Clear(hw.base+ADCx_GC, GC_ADCO)
+
+	// writing HC0 starts the conversion
+	reg.Write(hw.base+ADCx_HC0, uint32(ch))
+	defer reg.Write(hw.base+ADCx_HC0, ADC_CH_DISABLED)
+
+	for i := range samples {
+		if !reg.WaitFor(10*time.Millisecond, hw.base+ADCx_HS, HS_COCO0, 1, 1) {
+			return fmt.Errorf("channel %d conversion timeout", ch)
+		}
+
+		// reading R0 clears COCO0
+		samples[i] = reg.Read(hw.base+ADCx_R0) & ADC_MAX
+	}
+
+	return
+}
+
+func adcChannels() (channels []int, err error) {
+	for _, s := range conf.List("adc_channels", []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}) {
+		ch, err := strconv.Atoi(s)
+
+		if err != nil || ch < 0 || ch >= ADC_CHANNELS {
+			return nil, fmt.Errorf("invalid ADC channel %s", s)
+		}
+
+		channels = append(channels, ch)
+	}
+
+	return
+}
+
+// TestADC samples the configured ADC channels with continuous conversions
+// and reports their minimum, average and maximum values.
+func TestADC() (err error) {
+	channels, err := adcChannels()
+
+	if err != nil {
+		return
+	}
+
+	if err = ADC1.Init(); err != nil {
+		return
+	}
+
+	n := conf.Int("adc_samples", 1000)
+
+	if n <= 0 {
+		return fmt.Errorf("invalid sample count %d", n)
+	}
+
+	samples := make([]uint32, n)
+
+	for _, ch := range channels {
+		stats := &adcStats{}
+		start := time.Now()
+
+		if err = ADC1.Sample(ch, samples); err != nil {
+			return
+		}
+
+		elapsed := time.Since(start)
+
+		for _, val := range samples {
+			stats.add(val)
+		}
+
+		adcLog.Infof("ADC1_IN%d %s in %s (%.0f samples/s)", ch, stats, elapsed, float64(n)/elapsed.Seconds())
+	}
+
+	return
+}
+
+// startADCServer streams conversion results to TCP clients, each line holds
+// the milliseconds since connection and the average of 16 samples for each
+// configured channel, separated by commas.
+func startADCServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	var err error
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		adcLog.Fatalf("listener error, %v", err)
+	}
+
+	channels, err := adcChannels()
+
+	if err != nil {
+		adcLog.Warnf("ADC streaming disabled, %v", err)
+		return
+	}
+
+	if err = ADC1.Init(); err != nil {
+		adcLog.Warnf("ADC streaming disabled, %v", err)
+		return
+	}
+
+	interval := time.Duration(conf.Int("adc_interval", 100)) * time.Millisecond
+
+	adcLog.Infof("starting ADC streaming server at %s:%d", addr.String(), port)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			adcLog.Errorf("error accepting connection, %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			w := bufio.NewWriter(conn)
+			samples := make([]uint32, 16)
+			start := time.Now()
+
+			for {
+				fmt.Fprintf(w, "%d", time.Since(start).Milliseconds())
+
+				for _, ch := range channels {
+					stats := &adcStats{}
+
+					if err := ADC1.Sample(ch, samples); err != nil {
+						adcLog.Errorf("ADC streaming error, %v", err)
+						return
+					}
+
+					for _, val := range samples {
+						stats.add(val)
+					}
+
+					fmt.Fprintf(w, ",%d", stats.Sum/uint64(stats.Count))
+				}
+
+				fmt.Fprintln(w)
+
+				if err := w.Flush(); err != nil {
+					return
+				}
+
+				time.Sleep(interval)
+			}
+		}()
+	}
+}
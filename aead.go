@@ -0,0 +1,137 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var aeadLog = newLogger("aead")
+
+// DCP key slot used for benchmarking with a random key
+const AEAD_DCP_KEY_SLOT = 0
+
+// cipherBenchmark represents an encryption function benchmarked on
+// increasing payload sizes.
+type cipherBenchmark struct {
+	name string
+	// seal encrypts, and authenticates when supported, the argument buffer
+	seal func(buf []byte) error
+}
+
+func aeadBenchmark(aead cipher.AEAD) func(buf []byte) error {
+	nonce := make([]byte, aead.NonceSize())
+	dst := make([]byte, 0, 64*1024+aead.Overhead())
+
+	return func(buf []byte) error {
+		aead.Seal(dst[:0], nonce, buf, nil)
+		return nil
+	}
+}
+
+func aeadSizes() (sizes []int, err error) {
+	for _, s := range conf.List("aead_sizes", []string{"64", "1024", "16384"}) {
+		size, err := strconv.Atoi(s)
+
+		// DCP AES-CBC requires whole blocks
+		if err != nil || size <= 0 || size%aes.BlockSize != 0 || size > 64*1024 {
+			return nil, fmt.Errorf("invalid payload size %s", s)
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return
+}
+
+// TestAEAD compares the throughput of software ChaCha20-Poly1305 and
+// AES-128-GCM authenticated encryption with DCP assisted AES-128-CBC
+// encryption.
+func TestAEAD() (err error) {
+	sizes, err := aeadSizes()
+
+	if err != nil {
+		return
+	}
+
+	duration := time.Duration(conf.Int("aead_duration", 500)) * time.Millisecond
+	key := make([]byte, chacha20poly1305.KeySize)
+	rand.Read(key)
+
+	chacha, err := chacha20poly1305.New(key)
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(key[0:16])
+
+	if err != nil {
+		return
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return
+	}
+
+	benchmarks := []cipherBenchmark{
+		{"chacha20-poly1305", aeadBenchmark(chacha)},
+		{"aes-128-gcm", aeadBenchmark(gcm)},
+	}
+
+	if target.DCP() {
+		imx6.DCP.Init()
+
+		if err = imx6.DCP.SetKey(AEAD_DCP_KEY_SLOT, key[0:16]); err != nil {
+			return
+		}
+
+		iv := make([]byte, aes.BlockSize)
+
+		// the DCP does not provide authentication
+		benchmarks = append(benchmarks, cipherBenchmark{"aes-128-cbc (dcp)", func(buf []byte) error {
+			return imx6.DCP.Encrypt(buf, AEAD_DCP_KEY_SLOT, iv)
+		}})
+	}
+
+	for _, b := range benchmarks {
+		for _, size := range sizes {
+			buf := make([]byte, size)
+			n := 0
+
+			start := markCycles()
+
+			for time.Since(start.at) < duration {
+				if err = b.seal(buf); err != nil {
+					return fmt.Errorf("%s error, %v", b.name, err)
+				}
+
+				n++
+			}
+
+			cycles, elapsed := start.Since()
+			rate := float64(n*size) / elapsed.Seconds() / (1024 * 1024)
+
+			aeadLog.Infof("%-18s %6d bytes: %8d ops in %s (%.2f MiB/s, %.2f cycles/byte)", b.name, size, n, elapsed.Round(time.Millisecond), rate, float64(cycles)/float64(n*size))
+		}
+	}
+
+	return
+}
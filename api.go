@@ -0,0 +1,169 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The /api/ HTTP routes complement the measurement, attestation, reboot and
+// provisioning ones for host side control of the example (see
+// cmd/tamagoctl), responses are JSON documents unless noted:
+//
+//	GET  /api/tests                            test list and selection status
+//	POST /api/tests?include=<re>&exclude=<re>  run tests, returns results
+//	GET  /api/results                          boot test run results
+//	GET  /api/log                              recent log output (text)
+//	GET  /api/audit                            audit log (JSON lines, see audit.go)
+//	POST /api/firmware?sig=<base64>            verify and stage a firmware image (text, see firmware.go)
+const (
+	API_LOG_SIZE = 64 * 1024
+)
+
+// logRing retains the most recent log output.
+type logRing struct {
+	sync.Mutex
+
+	buf  []byte
+	size int
+}
+
+func (l *logRing) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	if n := len(l.buf) - l.size; n > 0 {
+		l.buf = append(l.buf[:0], l.buf[n:]...)
+	}
+
+	return len(p), nil
+}
+
+func (l *logRing) Bytes() []byte {
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]byte{}, l.buf...)
+}
+
+// logHistory records log output regardless of the `verbose` setting.
+var logHistory = &logRing{size: API_LOG_SIZE}
+
+// apiTests serializes test runs requested through the API.
+var apiTests sync.Mutex
+
+type apiTest struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// testList returns the example tests along with their selection status.
+func testList() (tests []apiTest) {
+	for _, t := range exampleTests(false) {
+		status := "selected"
+
+		if !t.supported {
+			status = "unsupported"
+		} else if !selection.selects(t) {
+			status = "skipped"
+		}
+
+		tests = append(tests, apiTest{t.name, status})
+	}
+
+	return
+}
+
+// runTestList runs the tests matching comma separated include and exclude
+// patterns, returning their results.
+func runTestList(include string, exclude string) (report *resultReport, err error) {
+	filter, err := newTestFilter(splitPatterns(include), splitPatterns(exclude))
+
+	if err != nil {
+		return
+	}
+
+	apiTests.Lock()
+	defer apiTests.Unlock()
+
+	start := time.Now()
+	results := runTests(exampleTests(false), filter)
+
+	return newResultReport(results, time.Since(start)), nil
+}
+
+func apiTestsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, testList())
+	case http.MethodPost:
+		q := r.URL.Query()
+		report, err := runTestList(q.Get("include"), q.Get("exclude"))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, report)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/tests":
+		apiTestsHandler(w, r)
+	case "/api/results":
+		if lastReport == nil {
+			http.Error(w, "no test results available", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, lastReport)
+	case "/api/log":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(logHistory.Bytes())
+	case "/api/log/stored":
+		logStoreHandler(w, r)
+	case "/api/audit":
+		auditHandler(w, r)
+	case "/api/firmware":
+		firmwareHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
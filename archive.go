@@ -0,0 +1,382 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Archives are stored as a raw gzip compressed tar stream on a memory card
+// region, the gzip header holds the archive name and the stream end is
+// self-delimiting so that the region remainder is ignored on extraction.
+const (
+	ARCHIVE_BUFFER = 64 * 1024
+
+	ARCHIVE_TEST_BLOCKS = 12288
+	ARCHIVE_TEST_SIZE   = 4 * 1024 * 1024
+)
+
+var archiveLog = newLogger("archive")
+
+// archiveFile represents a file to be added to an archive.
+type archiveFile struct {
+	name string
+	size int64
+	data io.Reader
+}
+
+// regionWriter implements sequential io.Writer access to a memory card
+// region.
+type regionWriter struct {
+	r   *cardRegion
+	off int64
+}
+
+// Write implements io.Writer.
+func (w *regionWriter) Write(p []byte) (n int, err error) {
+	if w.off+int64(len(p)) > w.r.Size() {
+		return 0, errors.New("archive exceeds region size")
+	}
+
+	n, err = w.r.WriteAt(p, w.off)
+	w.off += int64(n)
+
+	return
+}
+
+func archiveName(t time.Time) string {
+	return "results-" + t.UTC().Format("20060102T150405")
+}
+
+// packArchive writes a gzip compressed tar archive on a memory card region,
+// returning the compressed size.
+func packArchive(r *cardRegion, name string, files []archiveFile) (size int64, err error) {
+	w := &regionWriter{r: r}
+	buf := bufio.NewWriterSize(w, ARCHIVE_BUFFER)
+
+	if err = writeArchive(buf, name, files); err != nil {
+		return
+	}
+
+	if err = buf.Flush(); err != nil {
+		return
+	}
+
+	return w.off, nil
+}
+
+// writeArchive writes a gzip compressed tar archive, with all files placed
+// under a directory with the archive name.
+func writeArchive(w io.Writer, name string, files []archiveFile) (err error) {
+	modTime := Now()
+
+	zw, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+
+	if err != nil {
+		return
+	}
+
+	zw.Name = name + ".tar"
+	zw.ModTime = modTime
+
+	tw := tar.NewWriter(zw)
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    path.Join(name, f.name),
+			Mode:    0644,
+			Size:    f.size,
+			ModTime: modTime,
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return
+		}
+
+		if _, err = io.Copy(tw, f.data); err != nil {
+			return
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return
+	}
+
+	return zw.Close()
+}
+
+// unpackArchive extracts a gzip compressed tar archive, read from a memory
+// card region, to a directory of the in-memory filesystem.
+func unpackArchive(r *cardRegion, dir string) (files int, size int64, err error) {
+	buf := bufio.NewReaderSize(io.NewSectionReader(r, 0, r.Size()), ARCHIVE_BUFFER)
+	zr, err := gzip.NewReader(buf)
+
+	if err != nil {
+		return
+	}
+
+	// stop at the end of the first gzip stream, ignoring the region
+	// remainder
+	zr.Multistream(false)
+
+	tr := tar.NewReader(zr)
+
+	for {
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			return files, size, nil
+		}
+
+		if err != nil {
+			return files, size, err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+
+		if name == "/" {
+			continue
+		}
+
+		dst := path.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dst, 0700)
+		case tar.TypeReg:
+			if err = os.MkdirAll(path.Dir(dst), 0700); err != nil {
+				break
+			}
+
+			var f *os.File
+
+			if f, err = os.Create(dst); err != nil {
+				break
+			}
+
+			n, e := io.Copy(f, tr)
+			f.Close()
+
+			files += 1
+			size += n
+			err = e
+		default:
+			archiveLog.Infof("skipping %s (type %c)", hdr.Name, hdr.Typeflag)
+		}
+
+		if err != nil {
+			return files, size, err
+		}
+	}
+}
+
+// resultFiles returns the results of the most recent boot test run, as JSON
+// and JUnit documents and as a plain text log.
+func resultFiles() (files []archiveFile, err error) {
+	if lastReport == nil {
+		return nil, errors.New("no test results available")
+	}
+
+	j, err := json.MarshalIndent(lastReport, "", "  ")
+
+	if err != nil {
+		return
+	}
+
+	x, err := lastReport.JUnit()
+
+	if err != nil {
+		return
+	}
+
+	var l bytes.Buffer
+
+	fmt.Fprintf(&l, "%s\n\n", lastReport.Banner)
+
+	for _, e := range lastReport.Results {
+		status := "PASS"
+
+		if !e.Passed {
+			status = "FAIL"
+		}
+
+		fmt.Fprintf(&l, "%-16s %s %8.3fs %s\n", e.Name, status, e.Duration, e.Error)
+	}
+
+	fmt.Fprintf(&l, "\n%d passed, %d failed (%.3fs)\n", lastReport.Passed, lastReport.Failed, lastReport.Duration)
+
+	files = []archiveFile{
+		{name: "results.json", size: int64(len(j)), data: bytes.NewReader(j)},
+		{name: "results.xml", size: int64(len(x)), data: bytes.NewReader(x)},
+		{name: "tests.log", size: int64(l.Len()), data: &l},
+	}
+
+	return
+}
+
+func archiveCommand(op string, args []string) (res string) {
+	if len(args) < 2 {
+		return "invalid arguments"
+	}
+
+	n, err := strconv.Atoi(args[0])
+
+	if err != nil {
+		return fmt.Sprintf("invalid card: %v", err)
+	}
+
+	offset, err := strconv.ParseInt(args[1], 16, 64)
+
+	if err != nil {
+		return fmt.Sprintf("invalid offset: %v", err)
+	}
+
+	card, err := target.Card(n)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	r := &cardRegion{card: card, offset: offset, size: int64(card.Blocks())*int64(card.BlockSize()) - offset}
+
+	switch op {
+	case "pack":
+		if len(args) != 3 {
+			return "invalid arguments"
+		}
+
+		mib, err := strconv.ParseInt(args[2], 10, 64)
+
+		if err != nil || mib <= 0 || mib*1024*1024 > r.size {
+			return "invalid size"
+		}
+
+		r.size = mib * 1024 * 1024
+
+		files, err := resultFiles()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		name := archiveName(Now())
+		size, err := packArchive(r, name, files)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("wrote %s.tar.gz (%d bytes) at %#x", name, size, offset)
+	case "unpack":
+		dir := "/"
+
+		if len(args) > 2 {
+			dir = args[2]
+		}
+
+		files, size, err := unpackArchive(r, dir)
+
+		if err != nil {
+			return fmt.Sprintf("%v (%d files extracted)", err, files)
+		}
+
+		return fmt.Sprintf("extracted %d files (%d bytes) to %s", files, size, dir)
+	}
+
+	return
+}
+
+// TestArchive packs a large stream, along with the test results when
+// available, in an archive on a RAM backed block device and verifies its
+// extraction.
+func TestArchive() (err error) {
+	card := newRAMCard(ARCHIVE_TEST_BLOCKS)
+
+	// deliberately unaligned region
+	r := &cardRegion{card: card, offset: 1000, size: int64(card.Blocks()*card.BlockSize()) - 1000}
+
+	h := sha256.New()
+
+	files := []archiveFile{
+		{
+			name: "payload.bin",
+			size: ARCHIVE_TEST_SIZE,
+			data: io.TeeReader(io.LimitReader(rand.Reader, ARCHIVE_TEST_SIZE), h),
+		},
+	}
+
+	if res, err := resultFiles(); err == nil {
+		files = append(files, res...)
+	}
+
+	start := time.Now()
+	name := archiveName(Now())
+	size, err := packArchive(r, name, files)
+
+	if err != nil {
+		return fmt.Errorf("pack: %v", err)
+	}
+
+	archiveLog.Infof("packed %d files, %d bytes (%s)", len(files), size, time.Since(start))
+
+	dir, err := ioutil.TempDir("/", "archive")
+
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	start = time.Now()
+	n, total, err := unpackArchive(r, dir)
+
+	if err != nil {
+		return fmt.Errorf("unpack: %v", err)
+	}
+
+	archiveLog.Infof("extracted %d files, %d bytes (%s)", n, total, time.Since(start))
+
+	if n != len(files) {
+		return fmt.Errorf("extracted %d files, expected %d", n, len(files))
+	}
+
+	f, err := os.Open(path.Join(dir, name, "payload.bin"))
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	v := sha256.New()
+
+	if _, err = io.Copy(v, f); err != nil {
+		return
+	}
+
+	if !bytes.Equal(h.Sum(nil), v.Sum(nil)) {
+		return errors.New("payload hash mismatch")
+	}
+
+	archiveLog.Infof("payload verified (SHA-256 %x)", v.Sum(nil))
+
+	return
+}
@@ -0,0 +1,155 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Platform quotes sign the following message with the attestation key
+// (ECDSA P-256, SHA-256):
+//
+//	QUOTE_MAGIC || device unique ID (8) || PCR (32) || nonce
+//
+// (see internal/quote for the verification procedure).
+const (
+	QUOTE_MAGIC     = "tamago-quote-v1"
+	QUOTE_MAX_NONCE = 64
+)
+
+var attestLog = newLogger("attest")
+
+// quote represents a platform quote.
+type quote struct {
+	Device    string        `json:"device"`
+	Nonce     string        `json:"nonce"`
+	PCR       string        `json:"pcr"`
+	Events    []measurement `json:"events"`
+	PublicKey string        `json:"public_key"`
+	Signature string        `json:"signature"`
+}
+
+var attestationKey struct {
+	sync.Once
+
+	key *ecdsa.PrivateKey
+	pub string
+	err error
+}
+
+// attestKey returns the attestation key, which is generated on first use
+// and kept on the card as a DCP sealed blob.
+func attestKey() (*ecdsa.PrivateKey, string, error) {
+	attestationKey.Do(func() {
+		imx6.DCP.Init()
+
+		der, err := loadSealed("attest", func() ([]byte, error) {
+			attestLog.Infof("generating attestation key")
+
+			priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return x509.MarshalECPrivateKey(priv)
+		})
+
+		if err != nil {
+			attestationKey.err = err
+			return
+		}
+
+		if attestationKey.key, err = x509.ParseECPrivateKey(der); err != nil {
+			attestationKey.err = err
+			return
+		}
+
+		pub, err := x509.MarshalPKIXPublicKey(&attestationKey.key.PublicKey)
+
+		if err != nil {
+			attestationKey.err = err
+			return
+		}
+
+		attestationKey.pub = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	})
+
+	return attestationKey.key, attestationKey.pub, attestationKey.err
+}
+
+// Quote returns a signed quote of the current PCR value and measurement log.
+func Quote(nonce []byte) (q *quote, err error) {
+	if len(nonce) == 0 || len(nonce) > QUOTE_MAX_NONCE {
+		return nil, errors.New("invalid nonce size")
+	}
+
+	key, pub, err := attestKey()
+
+	if err != nil {
+		return
+	}
+
+	id := target.UniqueID()
+	value, events := PCR.Value()
+
+	msg := []byte(QUOTE_MAGIC)
+	msg = append(msg, id...)
+	msg = append(msg, value...)
+	msg = append(msg, nonce...)
+
+	digest := sha256.Sum256(msg)
+	sig, err := key.Sign(rand.Reader, digest[:], nil)
+
+	if err != nil {
+		return
+	}
+
+	return &quote{
+		Device:    hex.EncodeToString(id),
+		Nonce:     hex.EncodeToString(nonce),
+		PCR:       hex.EncodeToString(value),
+		Events:    events,
+		PublicKey: pub,
+		Signature: hex.EncodeToString(sig),
+	}, nil
+}
+
+// attestHandler serves a quote for the hex encoded nonce passed as
+// /attest?nonce=<hex>.
+func attestHandler(w http.ResponseWriter, r *http.Request) {
+	nonce, err := hex.DecodeString(r.URL.Query().Get("nonce"))
+
+	if err != nil {
+		http.Error(w, "invalid nonce", http.StatusBadRequest)
+		return
+	}
+
+	q, err := Quote(nonce)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
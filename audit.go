@@ -0,0 +1,342 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The audit log records security relevant operations (key usage, credential
+// and settings changes, authentication failures) in an append-only storage
+// region, as JSON lines forming a hash chain: each entry carries the SHA-256
+// of the previous line and ends with an HMAC-SHA256, keyed with the
+// `attestation/audit` key tree node, over the rest of the line. Entries can
+// therefore neither be altered, reordered nor forged without the device key.
+// Removal of the most recent entries can only be detected by comparing the
+// head (the hash of the last line) with one previously exported.
+//
+// Recording is best effort, operations are not refused when the log is full
+// or unavailable.
+const (
+	AUDIT_GENESIS   = "tamago-example audit log"
+	AUDIT_MAC_FIELD = `,"mac":"`
+)
+
+var auditLog = newLogger("audit")
+
+// auditEntry represents an audit log record.
+type auditEntry struct {
+	Sequence uint64     `json:"seq"`
+	Time     *time.Time `json:"time,omitempty"`
+	// milliseconds since boot
+	Uptime   int64  `json:"uptime"`
+	Event    string `json:"event"`
+	Detail   string `json:"detail,omitempty"`
+	Previous string `json:"prev"`
+}
+
+// auditTrail represents the audit log state.
+type auditTrail struct {
+	sync.Mutex
+
+	once sync.Once
+	err  error
+
+	key []byte
+	// log region and end offset
+	r   *cardRegion
+	end int64
+
+	entries uint64
+	head    []byte
+	// entries which could not be recorded
+	dropped uint64
+}
+
+// Audit is the audit log shared by all services.
+var Audit = &auditTrail{}
+
+func auditGenesis() []byte {
+	h := sha256.Sum256([]byte(AUDIT_GENESIS))
+	return h[:]
+}
+
+// Init opens the audit log on first use, verifying its content.
+func (a *auditTrail) Init() error {
+	a.once.Do(func() {
+		a.Lock()
+		defer a.Unlock()
+
+		a.err = a.load()
+	})
+
+	return a.err
+}
+
+func (a *auditTrail) load() (err error) {
+	n, err := hardwareKeyNode(KEY_ATTESTATION + "/audit")
+
+	if err != nil {
+		return
+	}
+
+	a.key = n.Key(nil, sha256.Size)
+
+	if a.r, err = openStorage("audit"); err != nil {
+		return
+	}
+
+	buf, err := a.read()
+
+	if err != nil {
+		return
+	}
+
+	// the log is a sequence of JSON lines terminated by unused (zero) space
+	a.end = int64(bytes.IndexByte(buf, 0))
+
+	if a.end < 0 {
+		a.end = a.r.Size()
+	}
+
+	a.entries, a.head, err = a.verify(buf[:a.end])
+
+	if err != nil {
+		// keep appending, the damaged entry remains as evidence
+		auditLog.Errorf("verification failed, %v", err)
+		err = nil
+	}
+
+	auditLog.Infof("%d entries, head %x", a.entries, a.head)
+
+	if err := a.append("boot", banner); err != nil {
+		auditLog.Errorf("cannot record events, %v", err)
+		a.dropped++
+	}
+
+	return
+}
+
+func (a *auditTrail) read() (buf []byte, err error) {
+	buf = make([]byte, a.r.Size())
+	_, err = a.r.ReadAt(buf, 0)
+	return
+}
+
+func (a *auditTrail) mac(body []byte) string {
+	m := hmac.New(sha256.New, a.key)
+	m.Write(body)
+
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// verify checks the hash chain and authenticity of the log entries,
+// returning their number and the head hash. On failure the returned values
+// reflect the last line, so that the chain can be extended.
+func (a *auditTrail) verify(buf []byte) (n uint64, head []byte, err error) {
+	head = auditGenesis()
+
+	for len(buf) > 0 {
+		var e auditEntry
+
+		i := bytes.IndexByte(buf, '\n')
+
+		if i < 0 {
+			return n, head, fmt.Errorf("entry %d truncated", n+1)
+		}
+
+		line := buf[:i]
+		buf = buf[i+1:]
+
+		prev := head
+		h := sha256.Sum256(line)
+		head = h[:]
+		n++
+
+		if err != nil {
+			continue
+		}
+
+		j := bytes.LastIndex(line, []byte(AUDIT_MAC_FIELD))
+
+		switch {
+		case j < 0 || !bytes.HasSuffix(line, []byte(`"}`)) || json.Unmarshal(line, &e) != nil:
+			err = fmt.Errorf("entry %d malformed", n)
+		case e.Sequence != n:
+			err = fmt.Errorf("entry %d out of sequence (%d)", n, e.Sequence)
+		case e.Previous != hex.EncodeToString(prev):
+			err = fmt.Errorf("entry %d breaks the hash chain", n)
+		case !hmac.Equal(line[j+len(AUDIT_MAC_FIELD):len(line)-2], []byte(a.mac(append(line[:j:j], '}')))):
+			err = fmt.Errorf("entry %d authentication failed", n)
+		}
+	}
+
+	return
+}
+
+// append records an entry at the end of the log, the caller must hold the
+// lock.
+func (a *auditTrail) append(event string, detail string) (err error) {
+	e := &auditEntry{
+		Sequence: a.entries + 1,
+		Uptime:   time.Now().UnixNano() / int64(time.Millisecond),
+		Event:    event,
+		Detail:   detail,
+		Previous: hex.EncodeToString(a.head),
+	}
+
+	if TimeSet() {
+		t := Now().UTC()
+		e.Time = &t
+	}
+
+	body, err := json.Marshal(e)
+
+	if err != nil {
+		return
+	}
+
+	line := append([]byte{}, body[:len(body)-1]...)
+	line = append(line, AUDIT_MAC_FIELD+a.mac(body)+`"}`...)
+
+	if a.end+int64(len(line))+1 > a.r.Size() {
+		return errors.New("audit log full")
+	}
+
+	if _, err = a.r.WriteAt(append(line, '\n'), a.end); err != nil {
+		return
+	}
+
+	h := sha256.Sum256(line)
+
+	a.end += int64(len(line)) + 1
+	a.entries++
+	a.head = h[:]
+
+	return
+}
+
+// Record adds an event to the audit log.
+func (a *auditTrail) Record(event string, detail string) {
+	auditLog.Debugf("%s %s", event, detail)
+
+	if err := a.Init(); err != nil {
+		a.Lock()
+		a.dropped++
+		a.Unlock()
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err := a.append(event, detail); err != nil {
+		if a.dropped == 0 {
+			auditLog.Errorf("cannot record events, %v", err)
+		}
+
+		a.dropped++
+	}
+}
+
+// Export returns the audit log content and head hash.
+func (a *auditTrail) Export() (buf []byte, head []byte, err error) {
+	if err = a.Init(); err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	buf = make([]byte, a.end)
+
+	if len(buf) > 0 {
+		_, err = a.r.ReadAt(buf, 0)
+	}
+
+	return buf, a.head, err
+}
+
+// Verify checks the audit log content on storage.
+func (a *auditTrail) Verify() (n uint64, err error) {
+	buf, head, err := a.Export()
+
+	if err != nil {
+		return
+	}
+
+	n, h, err := a.verify(buf)
+
+	if err == nil && !bytes.Equal(h, head) {
+		err = errors.New("head mismatch")
+	}
+
+	return
+}
+
+// auditf records an event in the audit log.
+func auditf(event string, format string, v ...interface{}) {
+	Audit.Record(event, fmt.Sprintf(format, v...))
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	buf, head, err := Audit.Export()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Audit-Head", hex.EncodeToString(head))
+	w.Write(buf)
+}
+
+func auditCommand(op string) (res string) {
+	switch op {
+	case "verify":
+		n, err := Audit.Verify()
+
+		if err != nil {
+			return fmt.Sprintf("verification failed, %v", err)
+		}
+
+		return fmt.Sprintf("%d entries verified", n)
+	case "dump":
+		buf, _, err := Audit.Export()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(bytes.TrimSpace(buf))
+	}
+
+	err := Audit.Init()
+
+	a := Audit
+	a.Lock()
+	defer a.Unlock()
+
+	if err != nil {
+		return fmt.Sprintf("unavailable, %v (%d events not recorded)", err, a.dropped)
+	}
+
+	return fmt.Sprintf("entries: %d, used: %d/%d bytes, not recorded: %d\nhead: %x",
+		a.entries, a.end, a.r.Size(), a.dropped, a.head)
+}
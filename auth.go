@@ -0,0 +1,791 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// When `auth` is set (the default) the web server and the SSH and telnet
+// consoles require a user name and password. Credentials are only ever stored
+// as bcrypt hashes, within a DCP sealed blob (see secrets.go) on the `auth`
+// storage region. On first boot the AUTH_DEFAULT_USER user is created, with
+// the admin role (see roles.go), and a random password which is only shown on
+// the serial console.
+//
+// Users can additionally authenticate to the SSH server with public keys,
+// and to the web server with an API token (`Authorization: Bearer <token>`),
+// only stored as its SHA-256 hash.
+//
+// Web clients authenticate either with HTTP Basic authentication, on each
+// request, or through the /login form which establishes a session cookie,
+// valid until `auth_session` seconds of inactivity.
+const (
+	AUTH_DEFAULT_USER   = "admin"
+	AUTH_BCRYPT_COST    = 10
+	AUTH_MIN_PASSWORD   = 8
+	AUTH_MAX_USERS      = 16
+	AUTH_MAX_SESSIONS   = 32
+	AUTH_PASSWORD_BYTES = 12
+	AUTH_TOKEN_BYTES    = 32
+	AUTH_MAX_KEYS       = 8
+	AUTH_FAIL_DELAY     = 1 * time.Second
+	AUTH_COOKIE         = "tamago_session"
+	AUTH_REALM          = "tamago-example"
+)
+
+var authUserPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+var authLog = newLogger("auth")
+
+// authUser represents a user's credentials.
+type authUser struct {
+	// bcrypt password hash
+	Hash string `json:"hash,omitempty"`
+	Role string `json:"role"`
+	// SSH public keys (authorized_keys format)
+	Keys []string `json:"keys,omitempty"`
+	// API token SHA-256 hash
+	Token []byte `json:"token,omitempty"`
+}
+
+// authSession represents a web session.
+type authSession struct {
+	user    string
+	remote  string
+	created time.Time
+	seen    time.Time
+}
+
+// authStore holds the credentials and web sessions.
+type authStore struct {
+	sync.Mutex
+
+	once sync.Once
+	err  error
+	// persistent is false when credentials could not be stored, and are
+	// therefore only valid until reboot
+	persistent bool
+
+	users    map[string]*authUser
+	sessions map[string]*authSession
+	// compared against when the user does not exist, to avoid revealing
+	// valid names through response timing
+	dummy []byte
+}
+
+// Auth is the credential store shared by all services.
+var Auth = &authStore{}
+
+// authEnabled returns whether services require authentication.
+func authEnabled() bool {
+	return conf.Bool("auth", true)
+}
+
+func authTimeout() time.Duration {
+	return time.Duration(conf.Int("auth_session", 900)) * time.Second
+}
+
+// Init loads the credentials from persistent storage on first use.
+func (a *authStore) Init() error {
+	a.once.Do(func() {
+		a.Lock()
+		defer a.Unlock()
+
+		a.err = a.load()
+	})
+
+	return a.err
+}
+
+func (a *authStore) load() (err error) {
+	payload, err := loadSealed("auth", a.provision)
+
+	if errors.Is(err, errUnseal) {
+		// stored credentials are never replaced with new ones
+		return
+	} else if err != nil {
+		authLog.Warnf("credentials are not persistent, %v", err)
+
+		if payload == nil {
+			if payload, err = a.provision(); err != nil {
+				return
+			}
+		}
+	} else {
+		a.persistent = true
+	}
+
+	if err = json.Unmarshal(payload, &a.users); err != nil {
+		return
+	}
+
+	a.sessions = make(map[string]*authSession)
+	a.dummy, err = bcrypt.GenerateFromPassword([]byte(AUTH_REALM), AUTH_BCRYPT_COST)
+
+	return
+}
+
+// provision creates the default user with a random password, shown on the
+// serial console only, so that first access requires physical presence.
+func (a *authStore) provision() ([]byte, error) {
+	buf := make([]byte, AUTH_PASSWORD_BYTES)
+
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	password := base64.RawURLEncoding.EncodeToString(buf)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), AUTH_BCRYPT_COST)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(consoleOutput, "\nauth: created user %s with password %s\n\n", AUTH_DEFAULT_USER, password)
+	authLog.Infof("created user %s, password shown on serial console", AUTH_DEFAULT_USER)
+
+	return json.Marshal(map[string]*authUser{
+		AUTH_DEFAULT_USER: {Hash: string(hash), Role: "admin"},
+	})
+}
+
+// save stores the credentials, the caller must hold the lock.
+func (a *authStore) save() (err error) {
+	if !a.persistent {
+		return
+	}
+
+	payload, err := json.Marshal(a.users)
+
+	if err != nil {
+		return
+	}
+
+	return storeSealed("auth", payload)
+}
+
+// Verify returns whether the password is valid for the user, failures are
+// delayed to slow down guessing.
+func (a *authStore) Verify(user string, password string) bool {
+	if err := a.Init(); err != nil {
+		authLog.Errorf("credentials unavailable, %v", err)
+		return false
+	}
+
+	hash := a.dummy
+
+	a.Lock()
+	u, ok := a.users[user]
+
+	if ok && u.Hash != "" {
+		hash = []byte(u.Hash)
+	} else {
+		ok = false
+	}
+	a.Unlock()
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && ok {
+		return true
+	}
+
+	time.Sleep(AUTH_FAIL_DELAY)
+
+	return false
+}
+
+// VerifyKey returns the user authorized to authenticate with an SSH public
+// key.
+func (a *authStore) VerifyKey(key ssh.PublicKey) (user string, ok bool) {
+	if err := a.Init(); err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	for name, u := range a.users {
+		for _, k := range u.Keys {
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err == nil && subtle.ConstantTimeCompare(pub.Marshal(), key.Marshal()) == 1 {
+				return name, true
+			}
+		}
+	}
+
+	return
+}
+
+// VerifyToken returns the user of an API token.
+func (a *authStore) VerifyToken(token string) (user string, ok bool) {
+	if err := a.Init(); err != nil {
+		return
+	}
+
+	h := sha256.Sum256([]byte(token))
+
+	a.Lock()
+	defer a.Unlock()
+
+	for name, u := range a.users {
+		if len(u.Token) > 0 && subtle.ConstantTimeCompare(u.Token, h[:]) == 1 {
+			return name, true
+		}
+	}
+
+	return
+}
+
+// Role returns the role of a user.
+func (a *authStore) Role(user string) authRole {
+	if !authEnabled() {
+		return ROLE_ADMIN
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if u, ok := a.users[user]; ok {
+		return authRoles[u.Role]
+	}
+
+	return 0
+}
+
+// update applies a change to an existing user and stores the credentials.
+func (a *authStore) update(user string, change func(u *authUser) error) (err error) {
+	if err = a.Init(); err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	u, ok := a.users[user]
+
+	if !ok {
+		return errors.New("user not found")
+	}
+
+	prev := *u
+
+	if err = change(u); err != nil {
+		return
+	}
+
+	if err = a.save(); err != nil {
+		*u = prev
+	}
+
+	return
+}
+
+// SetRole changes the role of a user, at least one administrator must remain.
+func (a *authStore) SetRole(user string, role authRole) error {
+	return a.update(user, func(u *authUser) error {
+		if u.Role == "admin" && role != ROLE_ADMIN && a.admins() == 1 {
+			return errors.New("cannot remove the last administrator")
+		}
+
+		u.Role = role.String()
+
+		return nil
+	})
+}
+
+// AddKey authorizes an SSH public key, in authorized_keys format, for a
+// user.
+func (a *authStore) AddKey(user string, key string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+
+	if err != nil {
+		return err
+	}
+
+	return a.update(user, func(u *authUser) error {
+		if len(u.Keys) >= AUTH_MAX_KEYS {
+			return errors.New("maximum number of keys reached")
+		}
+
+		u.Keys = append(u.Keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))))
+
+		return nil
+	})
+}
+
+// ClearKeys removes all SSH public keys of a user.
+func (a *authStore) ClearKeys(user string) error {
+	return a.update(user, func(u *authUser) error {
+		u.Keys = nil
+		return nil
+	})
+}
+
+// NewToken returns a new API token for a user, replacing any previous one.
+func (a *authStore) NewToken(user string) (token string, err error) {
+	buf := make([]byte, AUTH_TOKEN_BYTES)
+
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	token = hex.EncodeToString(buf)
+	h := sha256.Sum256([]byte(token))
+
+	err = a.update(user, func(u *authUser) error {
+		u.Token = h[:]
+		return nil
+	})
+
+	return
+}
+
+// ClearToken removes the API token of a user.
+func (a *authStore) ClearToken(user string) error {
+	return a.update(user, func(u *authUser) error {
+		u.Token = nil
+		return nil
+	})
+}
+
+// admins returns the number of administrators, the caller must hold the lock.
+func (a *authStore) admins() (n int) {
+	for _, u := range a.users {
+		if u.Role == "admin" {
+			n++
+		}
+	}
+
+	return
+}
+
+// SetPassword creates a user, with the viewer role, or changes its password,
+// revoking its sessions.
+func (a *authStore) SetPassword(user string, password string) (err error) {
+	if !authUserPattern.MatchString(user) {
+		return errors.New("invalid user name")
+	}
+
+	if len(password) < AUTH_MIN_PASSWORD {
+		return fmt.Errorf("password must be at least %d characters", AUTH_MIN_PASSWORD)
+	}
+
+	if err = a.Init(); err != nil {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), AUTH_BCRYPT_COST)
+
+	if err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	u, ok := a.users[user]
+
+	if !ok {
+		if len(a.users) >= AUTH_MAX_USERS {
+			return errors.New("maximum number of users reached")
+		}
+
+		u = &authUser{Role: "viewer"}
+		a.users[user] = u
+	}
+
+	u.Hash = string(hash)
+	a.revoke(user)
+
+	return a.save()
+}
+
+// Delete removes a user, and its sessions, the last user cannot be removed.
+func (a *authStore) Delete(user string) (err error) {
+	if err = a.Init(); err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	u, ok := a.users[user]
+
+	if !ok {
+		return errors.New("user not found")
+	}
+
+	if u.Role == "admin" && a.admins() == 1 {
+		return errors.New("cannot remove the last administrator")
+	}
+
+	delete(a.users, user)
+	a.revoke(user)
+
+	return a.save()
+}
+
+// revoke ends the sessions of a user, or all sessions when empty, the caller
+// must hold the lock.
+func (a *authStore) revoke(user string) (n int) {
+	for token, s := range a.sessions {
+		if user == "" || s.user == user {
+			delete(a.sessions, token)
+			n++
+		}
+	}
+
+	return
+}
+
+// Revoke ends the sessions of a user, or all sessions when empty.
+func (a *authStore) Revoke(user string) int {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.revoke(user)
+}
+
+// NewSession returns a new session token, the oldest session is ended when
+// the maximum number of sessions is reached.
+func (a *authStore) NewSession(user string, remote string) (token string, err error) {
+	buf := make([]byte, 32)
+
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	token = hex.EncodeToString(buf)
+	now := time.Now()
+
+	a.Lock()
+	defer a.Unlock()
+
+	var oldest string
+
+	for t, s := range a.sessions {
+		if now.Sub(s.seen) > authTimeout() {
+			delete(a.sessions, t)
+		} else if oldest == "" || s.seen.Before(a.sessions[oldest].seen) {
+			oldest = t
+		}
+	}
+
+	if len(a.sessions) >= AUTH_MAX_SESSIONS {
+		delete(a.sessions, oldest)
+	}
+
+	a.sessions[token] = &authSession{
+		user:    user,
+		remote:  remote,
+		created: now,
+		seen:    now,
+	}
+
+	return
+}
+
+// Session returns the user of a valid session, refreshing its activity.
+func (a *authStore) Session(token string) (user string, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	s, ok := a.sessions[token]
+
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	if now.Sub(s.seen) > authTimeout() {
+		delete(a.sessions, token)
+		return "", false
+	}
+
+	s.seen = now
+
+	return s.user, true
+}
+
+// EndSession ends a session.
+func (a *authStore) EndSession(token string) {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.sessions, token)
+}
+
+func (a *authStore) String() string {
+	var buf strings.Builder
+
+	if err := a.Init(); err != nil {
+		return fmt.Sprintf("credentials unavailable, %v", err)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	var users []string
+
+	for user := range a.users {
+		users = append(users, user)
+	}
+
+	sort.Strings(users)
+
+	fmt.Fprintf(&buf, "enabled: %v, persistent: %v, session timeout: %v\n", authEnabled(), a.persistent, authTimeout())
+
+	for _, user := range users {
+		u := a.users[user]
+		fmt.Fprintf(&buf, "  %-16s %-8s password: %v, keys: %d, token: %v\n", user, u.Role, u.Hash != "", len(u.Keys), len(u.Token) > 0)
+	}
+
+	fmt.Fprintf(&buf, "sessions: %d (max %d)", len(a.sessions), AUTH_MAX_SESSIONS)
+
+	now := time.Now()
+
+	for _, s := range a.sessions {
+		fmt.Fprintf(&buf, "\n  %-16s %-24s age %v, idle %v", s.user, s.remote,
+			now.Sub(s.created).Round(time.Second), now.Sub(s.seen).Round(time.Second))
+	}
+
+	return buf.String()
+}
+
+// authConsole prompts for credentials on a terminal, returning the user.
+func authConsole(term *terminal.Terminal) (user string, err error) {
+	var password string
+
+	for i := 0; i < 3; i++ {
+		term.SetPrompt("login: ")
+
+		if user, err = term.ReadLine(); err != nil {
+			return
+		}
+
+		if password, err = term.ReadPassword("password: "); err != nil {
+			return
+		}
+
+		if Auth.Verify(user, password) {
+			return user, nil
+		}
+
+		fmt.Fprintf(term, "invalid credentials\n")
+	}
+
+	return "", errors.New("authentication failed")
+}
+
+func authCommand(term *terminal.Terminal, op string, user string, arg string) (res string) {
+	var err error
+	var role authRole
+
+	switch op {
+	case "passwd":
+		password := arg
+
+		if password == "" {
+			if password, err = term.ReadPassword("new password: "); err != nil {
+				return "password required"
+			}
+
+			if confirm, err := term.ReadPassword("confirm password: "); err != nil || confirm != password {
+				return "passwords do not match"
+			}
+		}
+
+		err = Auth.SetPassword(user, password)
+	case "del":
+		err = Auth.Delete(user)
+	case "revoke":
+		return fmt.Sprintf("%d sessions ended", Auth.Revoke(user))
+	case "role":
+		if role, err = parseRole(arg); err == nil {
+			err = Auth.SetRole(user, role)
+		}
+	case "key":
+		if arg == "clear" {
+			err = Auth.ClearKeys(user)
+		} else {
+			err = Auth.AddKey(user, arg)
+		}
+	case "token":
+		if arg == "clear" {
+			err = Auth.ClearToken(user)
+		} else if res, err = Auth.NewToken(user); err == nil {
+			res = fmt.Sprintf("token (shown only once): %s", res)
+		}
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if op == "role" {
+		user += " " + role.String()
+	}
+
+	authLog.Infof("%s %s", op, user)
+	auditf("auth."+op, "%s", user)
+
+	return
+}
+
+// webUser returns the user authenticated by a session cookie, an API token
+// or HTTP Basic authentication.
+func webUser(r *http.Request) (user string, ok bool) {
+	if c, err := r.Cookie(AUTH_COOKIE); err == nil {
+		if user, ok = Auth.Session(c.Value); ok {
+			return
+		}
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if user, ok = Auth.VerifyToken(strings.TrimPrefix(auth, "Bearer ")); !ok {
+			auditf("auth.failure", "web token from %s", r.RemoteAddr)
+			time.Sleep(AUTH_FAIL_DELAY)
+		}
+
+		return
+	}
+
+	if name, password, basic := r.BasicAuth(); basic {
+		if ok = Auth.Verify(name, password); !ok {
+			auditf("auth.failure", "web basic %q from %s", name, r.RemoteAddr)
+		}
+
+		return name, ok
+	}
+
+	return
+}
+
+// authHandler requires authentication on all web server routes, except the
+// login form, and a role allowing the request (see roles.go).
+func authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			loginHandler(w, r)
+			return
+		case "/logout":
+			logoutHandler(w, r)
+			return
+		}
+
+		if user, ok := webUser(r); ok {
+			if role := Auth.Role(user); role < webRole(r) {
+				auditf("auth.denied", "%s %s for %s with %s role", r.Method, r.URL.Path, user, role)
+				http.Error(w, fmt.Sprintf("%s role required", webRole(r)), http.StatusForbidden)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if _, _, basic := r.BasicAuth(); !basic && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, AUTH_REALM))
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// loginNext returns the local path to redirect to after login.
+func loginNext(r *http.Request) string {
+	next := r.FormValue("next")
+
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+
+	return next
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		fmt.Fprintf(w, `<html><body><form method="post">`+
+			`<input type="hidden" name="next" value="%s">`+
+			`<p><input name="user" placeholder="user" autofocus></p>`+
+			`<p><input name="password" type="password" placeholder="password"></p>`+
+			`<p><input type="submit" value="login"></p>`+
+			`</form></body></html>`, html.EscapeString(loginNext(r)))
+	case http.MethodPost:
+		user := r.PostFormValue("user")
+
+		if !Auth.Verify(user, r.PostFormValue("password")) {
+			authLog.Warnf("failed web login for %q from %s", user, r.RemoteAddr)
+			auditf("auth.failure", "web login %q from %s", user, r.RemoteAddr)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := Auth.NewSession(user, r.RemoteAddr)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		authLog.Infof("web login for %s from %s", user, r.RemoteAddr)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     AUTH_COOKIE,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+
+		http.Redirect(w, r, loginNext(r), http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(AUTH_COOKIE); err == nil {
+		Auth.EndSession(c.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   AUTH_COOKIE,
+		Path:   "/",
+		MaxAge: -1,
+	})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
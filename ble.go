@@ -0,0 +1,214 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build usbarmory
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/f-secure-foundry/tamago/board/f-secure/usbarmory/mark-two"
+)
+
+// The ANNA-B112 module runs u-blox u-connectXpress software, which is
+// controlled with AT commands until data mode is entered, after which data
+// is exchanged with the connected Serial Port Service (SPS) peer.
+const (
+	BLE_AT_TIMEOUT = 2 * time.Second
+	BLE_NAME       = "USB armory Mk II"
+)
+
+var bleLog = newLogger("ble")
+
+var bleLock sync.Mutex
+
+// bleUART implements io.ReadWriter on the BLE module UART.
+type bleUART struct{}
+
+// Read blocks until at least one byte is received.
+func (u bleUART) Read(p []byte) (n int, err error) {
+	for n == 0 {
+		if n = usbarmory.BLE.UART.Read(p); n == 0 {
+			runtime.Gosched()
+		}
+	}
+
+	return
+}
+
+// Write implements io.Writer.
+func (u bleUART) Write(p []byte) (n int, err error) {
+	usbarmory.BLE.UART.Write(p)
+	return len(p), nil
+}
+
+// bleAT sends an AT command, returning its response lines once the final
+// result code is received.
+func bleAT(cmd string) (res []string, err error) {
+	if usbarmory.BLE.UART == nil {
+		return nil, errors.New("BLE module is not initialized")
+	}
+
+	// allow the module to send (β errata workaround)
+	usbarmory.BLE.CTS(true)
+	usbarmory.BLE.UART.Write([]byte(cmd + "\r"))
+
+	var line []byte
+	deadline := time.Now().Add(BLE_AT_TIMEOUT)
+
+	for time.Now().Before(deadline) {
+		c, valid := usbarmory.BLE.UART.Rx()
+
+		if !valid {
+			runtime.Gosched()
+			continue
+		}
+
+		if c != '\n' {
+			if c != '\r' {
+				line = append(line, c)
+			}
+			continue
+		}
+
+		s := string(line)
+		line = nil
+
+		switch {
+		case s == "" || s == cmd:
+			// blank line or command echo
+		case s == "OK":
+			return
+		case s == "ERROR":
+			return nil, fmt.Errorf("%s: error", cmd)
+		default:
+			res = append(res, s)
+		}
+	}
+
+	return nil, fmt.Errorf("%s: timeout", cmd)
+}
+
+// bleVersion returns the module software version and Bluetooth address.
+func bleVersion() (res string, err error) {
+	bleLock.Lock()
+	defer bleLock.Unlock()
+
+	version, err := bleAT("ATI9")
+
+	if err != nil {
+		return
+	}
+
+	addr, err := bleAT("AT+UMLA=1")
+
+	if err != nil {
+		return
+	}
+
+	return fmt.Sprintf("version: %s\naddress: %s", strings.Join(version, " "), strings.Join(addr, " ")), nil
+}
+
+// bleAdvertise sets the module local name and starts advertising it as
+// discoverable and connectable.
+func bleAdvertise(name string) (err error) {
+	bleLock.Lock()
+	defer bleLock.Unlock()
+
+	for _, cmd := range []string{
+		fmt.Sprintf("AT+UBTLN=%q", name),
+		"AT+UBTDM=3",
+		"AT+UBTCM=2",
+	} {
+		if _, err = bleAT(cmd); err != nil {
+			return
+		}
+	}
+
+	bleLog.Infof("advertising as %s", name)
+
+	return
+}
+
+// bleBridge enters data mode, serving the example console to the SPS peer
+// until the module is reset.
+func bleBridge(name string) (err error) {
+	if err = bleAdvertise(name); err != nil {
+		return
+	}
+
+	bleLock.Lock()
+
+	if _, err = bleAT("ATO1"); err != nil {
+		bleLock.Unlock()
+		return
+	}
+
+	bleLog.Infof("serving console over SPS")
+
+	go func() {
+		defer bleLock.Unlock()
+
+		term := terminal.NewTerminal(bleUART{}, "> ")
+		fmt.Fprintf(term, "%s\n", banner)
+
+		for {
+			cmd, err := term.ReadLine()
+
+			if err == io.EOF {
+				continue
+			}
+
+			if err != nil {
+				bleLog.Warnf("readline error: %v", err)
+				continue
+			}
+
+			if strings.HasPrefix(cmd, "ble") {
+				fmt.Fprintln(term, "not available over BLE")
+				continue
+			}
+
+			handleCommand(term, ROLE_ADMIN, cmd)
+		}
+	}()
+
+	return
+}
+
+func bleCommand(op string, arg string) (res string) {
+	var err error
+
+	if arg == "" {
+		arg = BLE_NAME
+	}
+
+	switch op {
+	case "version":
+		res, err = bleVersion()
+	case "advertise":
+		err = bleAdvertise(arg)
+	case "bridge":
+		err = bleBridge(arg)
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return
+}
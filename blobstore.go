@@ -0,0 +1,565 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/kv"
+)
+
+// The blob store holds content addressed blobs, split in fixed size chunks
+// which are stored once regardless of the number of blobs referencing them,
+// on a memory card region. The region starts with the index, a key-value
+// store (see kvstore.go) mapping chunk hashes to data slots and blob hashes
+// to their chunk lists, followed by the chunk data slots.
+const (
+	BLOB_CHUNK_SIZE = 64 * 1024
+	BLOB_INDEX_SIZE = 1024 * 1024
+
+	BLOB_CHUNK_PREFIX = "c/"
+	BLOB_PREFIX       = "b/"
+
+	BLOB_TEST_BLOCKS = 16384
+	BLOB_TEST_SIZE   = 1024 * 1024
+)
+
+var blobstoreLog = newLogger("blobstore")
+
+// blobStore represents a content addressed blob store.
+type blobStore struct {
+	sync.Mutex
+
+	index *kv.DB
+	data  *cardRegion
+	slots []bool
+}
+
+// Blobs is the currently open blob store.
+var Blobs *blobStore
+
+// openBlobStore opens, or creates, a blob store on a memory card region.
+func openBlobStore(r *cardRegion) (b *blobStore, err error) {
+	if r.size < BLOB_INDEX_SIZE+BLOB_CHUNK_SIZE {
+		return nil, errors.New("region too small")
+	}
+
+	index, err := kv.Open(&cardRegion{card: r.card, offset: r.offset, size: BLOB_INDEX_SIZE}, r.card.BlockSize())
+
+	if err != nil {
+		return
+	}
+
+	b = &blobStore{
+		index: index,
+		data: &cardRegion{
+			card:   r.card,
+			offset: r.offset + BLOB_INDEX_SIZE,
+			size:   r.size - BLOB_INDEX_SIZE,
+		},
+	}
+
+	b.slots = make([]bool, b.data.size/BLOB_CHUNK_SIZE)
+
+	for _, k := range index.Keys(BLOB_CHUNK_PREFIX) {
+		slot, _, err := b.chunk(k)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if slot >= len(b.slots) {
+			return nil, fmt.Errorf("invalid slot for chunk %s", k)
+		}
+
+		b.slots[slot] = true
+	}
+
+	return
+}
+
+// chunk returns the data slot and size of a chunk.
+func (b *blobStore) chunk(key string) (slot int, size int, err error) {
+	v, err := b.index.Get([]byte(key))
+
+	if err != nil {
+		return
+	}
+
+	if len(v) != 8 {
+		return 0, 0, errors.New("invalid chunk entry")
+	}
+
+	return int(binary.LittleEndian.Uint32(v[0:])), int(binary.LittleEndian.Uint32(v[4:])), nil
+}
+
+func (b *blobStore) allocate() (slot int, err error) {
+	for i, used := range b.slots {
+		if !used {
+			b.slots[i] = true
+			return i, nil
+		}
+	}
+
+	return 0, errors.New("blob store full")
+}
+
+// Put stores a blob, returning its SHA-256 hash and the number of chunks
+// which were not already present.
+func (b *blobStore) Put(r io.Reader) (id string, added int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	var batch kv.Batch
+	var manifest bytes.Buffer
+	var allocated []int
+
+	defer func() {
+		// release the slots of a failed put
+		if err != nil {
+			for _, slot := range allocated {
+				b.slots[slot] = false
+			}
+		}
+	}()
+
+	h := sha256.New()
+	buf := make([]byte, BLOB_CHUNK_SIZE)
+	size := uint64(0)
+	pending := make(map[string]bool)
+
+	for {
+		n, e := io.ReadFull(r, buf)
+
+		if n > 0 {
+			chunk := buf[:n]
+			sum := sha256.Sum256(chunk)
+			key := BLOB_CHUNK_PREFIX + hex.EncodeToString(sum[:])
+
+			h.Write(chunk)
+			manifest.Write(sum[:])
+			size += uint64(n)
+
+			if _, err = b.index.Get([]byte(key)); err == kv.ErrNotFound && !pending[key] {
+				slot, err := b.allocate()
+
+				if err != nil {
+					return "", 0, err
+				}
+
+				allocated = append(allocated, slot)
+
+				if _, err = b.data.WriteAt(chunk, int64(slot)*BLOB_CHUNK_SIZE); err != nil {
+					return "", 0, err
+				}
+
+				entry := make([]byte, 8)
+				binary.LittleEndian.PutUint32(entry[0:], uint32(slot))
+				binary.LittleEndian.PutUint32(entry[4:], uint32(n))
+
+				batch.Put([]byte(key), entry)
+				pending[key] = true
+				added += 1
+			} else if err != nil && err != kv.ErrNotFound {
+				return
+			}
+
+			err = nil
+		}
+
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if e != nil {
+			return "", 0, e
+		}
+	}
+
+	id = hex.EncodeToString(h.Sum(nil))
+
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint64(hdr, size)
+
+	// chunk data is written before the index is committed, so that an
+	// interruption only leaves unreferenced slots
+	batch.Put([]byte(BLOB_PREFIX+id), append(hdr, manifest.Bytes()...))
+	err = b.index.Commit(&batch)
+
+	return
+}
+
+// Get writes the content of a blob, verifying the hash of each chunk.
+func (b *blobStore) Get(id string, w io.Writer) (size int64, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	manifest, err := b.index.Get([]byte(BLOB_PREFIX + id))
+
+	if err == kv.ErrNotFound {
+		return 0, fmt.Errorf("blob %s not found", id)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(manifest) < 8 || (len(manifest)-8)%sha256.Size != 0 {
+		return 0, errors.New("invalid blob entry")
+	}
+
+	for off := 8; off < len(manifest); off += sha256.Size {
+		sum := manifest[off : off+sha256.Size]
+		slot, n, err := b.chunk(BLOB_CHUNK_PREFIX + hex.EncodeToString(sum))
+
+		if err != nil {
+			return size, err
+		}
+
+		chunk := make([]byte, n)
+
+		if _, err = b.data.ReadAt(chunk, int64(slot)*BLOB_CHUNK_SIZE); err != nil {
+			return size, err
+		}
+
+		if s := sha256.Sum256(chunk); !bytes.Equal(s[:], sum) {
+			return size, fmt.Errorf("chunk %x corrupted", sum)
+		}
+
+		if _, err = w.Write(chunk); err != nil {
+			return size, err
+		}
+
+		size += int64(n)
+	}
+
+	if size != int64(binary.LittleEndian.Uint64(manifest)) {
+		return size, errors.New("blob size mismatch")
+	}
+
+	return
+}
+
+// Delete removes a blob, its chunks are only released by garbage
+// collection.
+func (b *blobStore) Delete(id string) (err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	key := []byte(BLOB_PREFIX + id)
+
+	if _, err = b.index.Get(key); err == kv.ErrNotFound {
+		return fmt.Errorf("blob %s not found", id)
+	}
+
+	var batch kv.Batch
+	batch.Delete(key)
+
+	return b.index.Commit(&batch)
+}
+
+// GC releases all chunks which are not referenced by any blob, returning
+// their number.
+func (b *blobStore) GC() (freed int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	referenced := make(map[string]bool)
+
+	for _, k := range b.index.Keys(BLOB_PREFIX) {
+		manifest, err := b.index.Get([]byte(k))
+
+		if err != nil {
+			return 0, err
+		}
+
+		for off := 8; off+sha256.Size <= len(manifest); off += sha256.Size {
+			referenced[BLOB_CHUNK_PREFIX+hex.EncodeToString(manifest[off:off+sha256.Size])] = true
+		}
+	}
+
+	var batch kv.Batch
+	var slots []int
+
+	for _, k := range b.index.Keys(BLOB_CHUNK_PREFIX) {
+		if referenced[k] {
+			continue
+		}
+
+		slot, _, err := b.chunk(k)
+
+		if err != nil {
+			return 0, err
+		}
+
+		batch.Delete([]byte(k))
+		slots = append(slots, slot)
+	}
+
+	if err = b.index.Commit(&batch); err != nil {
+		return
+	}
+
+	for _, slot := range slots {
+		b.slots[slot] = false
+	}
+
+	return len(slots), nil
+}
+
+// Status returns the blob store usage.
+func (b *blobStore) Status() string {
+	b.Lock()
+	defer b.Unlock()
+
+	var buf bytes.Buffer
+
+	used := 0
+
+	for _, u := range b.slots {
+		if u {
+			used += 1
+		}
+	}
+
+	fmt.Fprintf(&buf, "blobs: %d chunks: %d slots: %d/%d (%d KiB chunks)\n",
+		len(b.index.Keys(BLOB_PREFIX)), len(b.index.Keys(BLOB_CHUNK_PREFIX)), used, len(b.slots), BLOB_CHUNK_SIZE/1024)
+
+	for _, k := range b.index.Keys(BLOB_PREFIX) {
+		if manifest, err := b.index.Get([]byte(k)); err == nil && len(manifest) >= 8 {
+			fmt.Fprintf(&buf, "%s %10d\n", strings.TrimPrefix(k, BLOB_PREFIX), binary.LittleEndian.Uint64(manifest))
+		}
+	}
+
+	return buf.String()
+}
+
+// openBlobs opens the blob store on a memory card region, registering it to
+// be reopened after card removal (see hotplug.go).
+func openBlobs(n int, offset int64, size int64) (err error) {
+	card, err := target.Card(n)
+
+	if err != nil {
+		return
+	}
+
+	if offset%int64(card.BlockSize()) != 0 {
+		return errors.New("offset must be block aligned")
+	}
+
+	b, err := openBlobStore(&cardRegion{card: card, offset: offset, size: size})
+
+	if err != nil {
+		return
+	}
+
+	Blobs = b
+
+	mountCard("blobs", n, func() error {
+		return openBlobs(n, offset, size)
+	}, func() {
+		Blobs = nil
+	})
+
+	return
+}
+
+func blobCommand(op string, args []string) (res string) {
+	if op == "open" {
+		if len(args) != 3 {
+			return "invalid arguments"
+		}
+
+		n, _ := strconv.Atoi(args[0])
+		offset, err := strconv.ParseInt(args[1], 16, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid offset: %v", err)
+		}
+
+		mib, _ := strconv.ParseInt(args[2], 10, 64)
+
+		if err = openBlobs(n, offset, mib*1024*1024); err != nil {
+			return err.Error()
+		}
+
+		return Blobs.Status()
+	}
+
+	if Blobs == nil {
+		return "no blob store open"
+	}
+
+	switch op {
+	case "status":
+		return Blobs.Status()
+	case "put":
+		if len(args) != 1 {
+			return "invalid arguments"
+		}
+
+		f, err := os.Open(args[0])
+
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+
+		id, added, err := Blobs.Put(f)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("%s (%d new chunks)", id, added)
+	case "get":
+		if len(args) != 2 {
+			return "invalid arguments"
+		}
+
+		f, err := os.Create(args[1])
+
+		if err != nil {
+			return err.Error()
+		}
+		defer f.Close()
+
+		size, err := Blobs.Get(args[0], f)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("wrote %s (%d bytes)", args[1], size)
+	case "rm":
+		if len(args) != 1 {
+			return "invalid arguments"
+		}
+
+		if err := Blobs.Delete(args[0]); err != nil {
+			return err.Error()
+		}
+	case "gc":
+		freed, err := Blobs.GC()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("released %d chunks", freed)
+	}
+
+	return
+}
+
+// TestBlobStore measures blob store throughput on a RAM backed block device,
+// verifying chunk deduplication and garbage collection.
+func TestBlobStore() (err error) {
+	card := newRAMCard(BLOB_TEST_BLOCKS)
+	r := &cardRegion{card: card, size: int64(card.Blocks() * card.BlockSize())}
+
+	b, err := openBlobStore(r)
+
+	if err != nil {
+		return
+	}
+
+	chunks := BLOB_TEST_SIZE / BLOB_CHUNK_SIZE
+
+	a := make([]byte, BLOB_TEST_SIZE)
+	rand.Read(a)
+
+	start := time.Now()
+	idA, added, err := b.Put(bytes.NewReader(a))
+
+	if err != nil {
+		return
+	}
+
+	blobstoreLog.Infof("put %d bytes, %d chunks (%s)", len(a), added, time.Since(start))
+
+	if added != chunks {
+		return fmt.Errorf("added %d chunks, expected %d", added, chunks)
+	}
+
+	// second blob differing only in its middle chunk
+	c := append([]byte{}, a...)
+	rand.Read(c[BLOB_TEST_SIZE/2 : BLOB_TEST_SIZE/2+BLOB_CHUNK_SIZE])
+
+	idC, added, err := b.Put(bytes.NewReader(c))
+
+	if err != nil {
+		return
+	}
+
+	if added != 1 {
+		return fmt.Errorf("added %d chunks for modified blob, expected 1", added)
+	}
+
+	blobstoreLog.Infof("modified blob deduplicated (%d of %d chunks added)", added, chunks)
+
+	var buf bytes.Buffer
+
+	start = time.Now()
+
+	if _, err = b.Get(idA, &buf); err != nil {
+		return
+	}
+
+	blobstoreLog.Infof("get %d bytes (%s)", buf.Len(), time.Since(start))
+
+	if !bytes.Equal(buf.Bytes(), a) {
+		return errors.New("blob data mismatch")
+	}
+
+	if err = b.Delete(idA); err != nil {
+		return
+	}
+
+	freed, err := b.GC()
+
+	if err != nil {
+		return
+	}
+
+	if freed != 1 {
+		return fmt.Errorf("released %d chunks, expected 1", freed)
+	}
+
+	// reopen to verify the persisted index
+	if b, err = openBlobStore(r); err != nil {
+		return
+	}
+
+	buf.Reset()
+
+	if _, err = b.Get(idC, &buf); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf.Bytes(), c) {
+		return errors.New("blob data mismatch after reopening")
+	}
+
+	blobstoreLog.Infof("garbage collection and reopening verified")
+
+	return
+}
@@ -0,0 +1,97 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Boot events are timestamped on the runtime clock, which counts from the
+// runtime start at boot (see clock.go), therefore excluding the boot ROM and
+// bootloader execution.
+
+var bootLog = newLogger("boot")
+
+// bootEvent represents a boot trace event.
+type bootEvent struct {
+	name string
+	at   time.Duration
+}
+
+var bootTrace struct {
+	sync.Mutex
+
+	events []bootEvent
+
+	usb    sync.Once
+	packet sync.Once
+}
+
+// package main variables are initialized after all imported packages,
+// including the SoC and board ones which initialize the hardware, and before
+// any package main init().
+var _ = bootMark("packages init")
+
+// bootMark records a boot event.
+func bootMark(name string) time.Duration {
+	at := time.Duration(time.Now().UnixNano())
+
+	bootTrace.Lock()
+	defer bootTrace.Unlock()
+
+	bootTrace.events = append(bootTrace.events, bootEvent{name, at})
+
+	return at
+}
+
+// bootEnumerated records the first USB transfer requested by the host, which
+// follows its enumeration of the device.
+func bootEnumerated() {
+	bootTrace.usb.Do(func() {
+		bootMark("usb enumeration")
+	})
+}
+
+// bootPacket records the first received network packet, on any interface,
+// and logs the boot time breakdown.
+func bootPacket() {
+	bootTrace.packet.Do(func() {
+		bootMark("first packet")
+
+		for _, l := range strings.Split(strings.TrimSpace(bootTraceCommand()), "\n") {
+			bootLog.Infof("%s", l)
+		}
+	})
+}
+
+func bootTraceCommand() string {
+	var buf bytes.Buffer
+
+	bootTrace.Lock()
+	events := append([]bootEvent{{"runtime start", 0}}, bootTrace.events...)
+	bootTrace.Unlock()
+
+	fmt.Fprintf(&buf, "%-20s %12s %12s\n", "event", "at (ms)", "delta (ms)")
+
+	for i, e := range events {
+		delta := time.Duration(0)
+
+		if i > 0 {
+			delta = e.at - events[i-1].at
+		}
+
+		fmt.Fprintf(&buf, "%-20s %12.3f %12.3f\n", e.name, float64(e.at)/1e6, float64(delta)/1e6)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,335 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb/ethernet"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+const (
+	// IEEE 802.1D default ageing time
+	BRIDGE_AGEING_TIME = 300 * time.Second
+	// USB high speed bulk endpoint maximum packet size
+	ECM_MAX_PACKET_SIZE = 512
+)
+
+// bridgePort represents a bridge interface.
+type bridgePort struct {
+	Name string
+	// frame transmission
+	Tx func(frame []byte) error
+
+	rxFrames uint64
+	rxBytes  uint64
+	txFrames uint64
+	txBytes  uint64
+	dropped  uint64
+}
+
+type fdbEntry struct {
+	port *bridgePort
+	seen time.Time
+}
+
+// bridge implements a transparent learning bridge, frames received on a
+// port are forwarded to the port where their destination address was last
+// seen or, if unknown, flooded to all other ports.
+type bridge struct {
+	sync.Mutex
+
+	// Filter, when set, is invoked on each received frame, which is
+	// dropped when false is returned.
+	Filter func(in *bridgePort, frame []byte) bool
+
+	ports []*bridgePort
+	fdb   map[tcpip.LinkAddress]*fdbEntry
+}
+
+// Bridge is the active bridge instance, if any.
+var Bridge *bridge
+
+// AddPort adds an interface to the bridge.
+func (br *bridge) AddPort(name string, tx func(frame []byte) error) (port *bridgePort) {
+	br.Lock()
+	defer br.Unlock()
+
+	if br.fdb == nil {
+		br.fdb = make(map[tcpip.LinkAddress]*fdbEntry)
+	}
+
+	port = &bridgePort{
+		Name: name,
+		Tx:   tx,
+	}
+
+	br.ports = append(br.ports, port)
+
+	return
+}
+
+// Input processes a frame received on a bridge port.
+func (br *bridge) Input(in *bridgePort, frame []byte) {
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+
+	br.Lock()
+	defer br.Unlock()
+
+	in.rxFrames += 1
+	in.rxBytes += uint64(len(frame))
+
+	if br.Filter != nil && !br.Filter(in, frame) {
+		in.dropped += 1
+		return
+	}
+
+	eth := header.Ethernet(frame)
+	now := time.Now()
+
+	if src := eth.SourceAddress(); src[0]&1 == 0 {
+		br.fdb[src] = &fdbEntry{port: in, seen: now}
+	}
+
+	dst := eth.DestinationAddress()
+
+	if e, ok := br.fdb[dst]; ok {
+		if now.Sub(e.seen) < BRIDGE_AGEING_TIME {
+			if e.port != in {
+				br.output(e.port, frame)
+			}
+
+			return
+		}
+
+		delete(br.fdb, dst)
+	}
+
+	for _, port := range br.ports {
+		if port != in {
+			br.output(port, frame)
+		}
+	}
+}
+
+func (br *bridge) output(port *bridgePort, frame []byte) {
+	if err := port.Tx(frame); err != nil {
+		port.dropped += 1
+		return
+	}
+
+	port.txFrames += 1
+	port.txBytes += uint64(len(frame))
+}
+
+// Status returns the bridge port counters and forwarding database.
+func (br *bridge) Status() string {
+	var buf bytes.Buffer
+
+	br.Lock()
+	defer br.Unlock()
+
+	fmt.Fprintf(&buf, "%-8s %10s %12s %10s %12s %8s\n", "port", "rx frames", "rx bytes", "tx frames", "tx bytes", "dropped")
+
+	for _, p := range br.ports {
+		fmt.Fprintf(&buf, "%-8s %10d %12d %10d %12d %8d\n", p.Name, p.rxFrames, p.rxBytes, p.txFrames, p.txBytes, p.dropped)
+	}
+
+	var addrs []string
+
+	for addr, e := range br.fdb {
+		if age := time.Since(e.seen); age < BRIDGE_AGEING_TIME {
+			addrs = append(addrs, fmt.Sprintf("%s %-8s %ds", addr, e.port.Name, int(age.Seconds())))
+		}
+	}
+
+	sort.Strings(addrs)
+
+	fmt.Fprintf(&buf, "\n%d learned addresses\n", len(addrs))
+
+	for _, a := range addrs {
+		fmt.Fprintln(&buf, a)
+	}
+
+	return buf.String()
+}
+
+// ecmPort implements the Ethernet over USB endpoint functions for a bridge
+// port, in place of the NIC link endpoint.
+type ecmPort struct {
+	br   *bridge
+	port *bridgePort
+
+	buf []byte
+	tx  chan []byte
+}
+
+func (p *ecmPort) Rx(out []byte, lastErr error) (_ []byte, err error) {
+	bootPacket()
+
+	if len(p.buf) == 0 && len(out) < header.EthernetMinimumSize {
+		return
+	}
+
+	p.buf = append(p.buf, out...)
+
+	// more data expected or zero length packet
+	if len(out) == ECM_MAX_PACKET_SIZE {
+		return
+	}
+
+	frame := p.buf
+	p.buf = nil
+
+	p.br.Input(p.port, frame)
+
+	return
+}
+
+func (p *ecmPort) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case in = <-p.tx:
+	default:
+	}
+
+	return
+}
+
+func (p *ecmPort) queue(frame []byte) error {
+	select {
+	case p.tx <- frame:
+		return nil
+	default:
+		return errors.New("queue full")
+	}
+}
+
+// StartBridge bridges the board wired Ethernet interface with Ethernet over
+// USB, the network services are started on a local bridge port with the
+// device IP address.
+func StartBridge() (err error) {
+	hw := ENET
+
+	if hw == nil {
+		return errors.New("no Ethernet controller on this board")
+	}
+
+	if hw.MAC, err = net.ParseMAC(ethMAC); err != nil {
+		return
+	}
+
+	hw.Promiscuous = true
+
+	if err = hw.Init(); err != nil {
+		return
+	}
+
+	br := &bridge{
+		// local port traffic is filtered by its link endpoint
+		Filter: func(in *bridgePort, frame []byte) bool {
+			return in.Name == "local" || Firewall.AllowFrame(FILTER_FWD, frame)
+		},
+	}
+
+	// local network stack
+	addr := tcpip.Address(net.ParseIP(IP)).To4()
+
+	s := newStack(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{
+			ipv4.NewProtocol(),
+			arp.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{
+			tcp.NewProtocol(),
+			icmp.NewProtocol4()},
+	})
+
+	link := addNIC(s, 1, deviceMAC, MTU)
+	link.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	subnet, _ := tcpip.NewSubnet("\x00\x00\x00\x00", "\x00\x00\x00\x00")
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: subnet,
+		NIC:         1,
+	}})
+
+	// IPv6 link-local and SLAAC addressing (see ipv6.go)
+	configureIPv6(s, 1, "")
+
+	local := br.AddPort("local", func(frame []byte) error {
+		ethernetRx(link, frame)
+		return nil
+	})
+
+	// wired Ethernet
+	enet := br.AddPort(fmt.Sprintf("enet%d", hw.Index), hw.Tx)
+
+	hw.Rx = func(frame []byte) {
+		bootPacket()
+		br.Input(enet, frame)
+	}
+
+	// Ethernet over USB
+	ecm := &ecmPort{
+		br: br,
+		tx: make(chan []byte, 256),
+	}
+
+	ecm.port = br.AddPort("usb", ecm.queue)
+
+	Bridge = br
+
+	go hw.Start()
+
+	go func() {
+		src := link.LinkAddress()
+
+		for {
+			if frame, valid := ethernetTx(context.Background(), link, src); valid {
+				br.Input(local, frame)
+			}
+		}
+	}()
+
+	enetLog.Infof("bridging ENET%d and USB, local address %s", hw.Index, addr)
+
+	startServices(s, addr, 1)
+
+	// the link endpoint is only required by Init(), as frames are
+	// exchanged through the bridge port functions
+	startUSBEthernet(&ethernet.NIC{
+		Link: channel.New(1, MTU, ""),
+		Rx:   ecm.Rx,
+		Tx:   ecm.Tx,
+	}, false)
+
+	return
+}
@@ -7,7 +7,6 @@ package main
 
 import (
 	"encoding/hex"
-	"log"
 
 	"github.com/btcsuite/btcd/btcec"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -20,7 +19,7 @@ import (
 // This example demonstrates creating a script which pays to a bitcoin address.
 // It also prints the created script hex and uses the DisasmString function to
 // display the disassembled script.
-func ExamplePayToAddrScript() {
+func ExamplePayToAddrScript() error {
 	// Parse the address to send the coins to into a btcutil.Address
 	// which is useful to ensure the accuracy of the address and determine
 	// the address type.  It is also required for the upcoming call to
@@ -28,75 +27,72 @@ func ExamplePayToAddrScript() {
 	addressStr := "12gpXQVcCL2qhTNQgyLVdCFG2Qs2px98nV"
 	address, err := btcutil.DecodeAddress(addressStr, &chaincfg.MainNetParams)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	// Create a public key script that pays to the address.
 	script, err := txscript.PayToAddrScript(address)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	log.Printf("Script Hex: %x\n", script)
+	btcLog.Infof("Script Hex: %x", script)
 
 	disasm, err := txscript.DisasmString(script)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	log.Println("Script Disassembly:", disasm)
+	btcLog.Infof("Script Disassembly: %v", disasm)
 
 	// Output:
 	// Script Hex: 76a914128004ff2fcaf13b2b91eb654b1dc2b674f7ec6188ac
 	// Script Disassembly: OP_DUP OP_HASH160 128004ff2fcaf13b2b91eb654b1dc2b674f7ec61 OP_EQUALVERIFY OP_CHECKSIG
+
+	return nil
 }
 
 // This example demonstrates extracting information from a standard public key
 // script.
-func ExampleExtractPkScriptAddrs() {
+func ExampleExtractPkScriptAddrs() error {
 	// Start with a standard pay-to-pubkey-hash script.
 	scriptHex := "76a914128004ff2fcaf13b2b91eb654b1dc2b674f7ec6188ac"
 	script, err := hex.DecodeString(scriptHex)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	// Extract and print details from the script.
 	scriptClass, addresses, reqSigs, err := txscript.ExtractPkScriptAddrs(
 		script, &chaincfg.MainNetParams)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	log.Println("Script Class:", scriptClass)
-	log.Println("Addresses:", addresses)
-	log.Println("Required Signatures:", reqSigs)
+	btcLog.Infof("Script Class: %v", scriptClass)
+	btcLog.Infof("Addresses: %v", addresses)
+	btcLog.Infof("Required Signatures: %v", reqSigs)
 
 	// Output:
 	// Script Class: pubkeyhash
 	// Addresses: [12gpXQVcCL2qhTNQgyLVdCFG2Qs2px98nV]
 	// Required Signatures: 1
+
+	return nil
 }
 
 // This example demonstrates manually creating and signing a redeem transaction.
-func ExampleSignTxOutput() {
+func ExampleSignTxOutput() error {
 	// Ordinarily the private key would come from whatever storage mechanism
 	// is being used, but for this example just hard code it.
 	privKeyBytes, err := hex.DecodeString("22a47fa09a223f2aa079edf85a7c2" +
 		"d4f8720ee63e502ee2869afab7de234b80c")
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	privKey, pubKey := btcec.PrivKeyFromBytes(btcec.S256(), privKeyBytes)
 	pubKeyHash := btcutil.Hash160(pubKey.SerializeCompressed())
 	addr, err := btcutil.NewAddressPubKeyHash(pubKeyHash,
 		&chaincfg.MainNetParams)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	// For this example, create a fake transaction that represents what
@@ -108,8 +104,7 @@ func ExampleSignTxOutput() {
 	originTx.AddTxIn(txIn)
 	pkScript, err := txscript.PayToAddrScript(addr)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	txOut := wire.NewTxOut(100000000, pkScript)
 	originTx.AddTxOut(txOut)
@@ -156,8 +151,7 @@ func ExampleSignTxOutput() {
 		redeemTx, 0, originTx.TxOut[0].PkScript, txscript.SigHashAll,
 		txscript.KeyClosure(lookupKey), nil, nil)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	redeemTx.TxIn[0].SignatureScript = sigScript
 
@@ -169,15 +163,15 @@ func ExampleSignTxOutput() {
 	vm, err := txscript.NewEngine(originTx.TxOut[0].PkScript, redeemTx, 0,
 		flags, nil, nil, -1)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	if err := vm.Execute(); err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	log.Println("Transaction successfully signed")
+	btcLog.Infof("Transaction successfully signed")
 
 	// Output:
 	// Transaction successfully signed
+
+	return nil
 }
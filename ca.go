@@ -0,0 +1,409 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var caLog = newLogger("ca")
+
+const CA_MAX_CSR_SIZE = 8192
+
+// certificateAuthority issues leaf certificates signed by a root key which is
+// only ever stored as a DCP sealed blob (see secrets.go). Every issued
+// certificate is recorded in an append-only log on the memory card.
+type certificateAuthority struct {
+	sync.Mutex
+
+	once sync.Once
+	err  error
+
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// root certificate PEM
+	pem []byte
+
+	// issuance log region and end offset
+	log    *cardRegion
+	logEnd int64
+	issued uint64
+}
+
+// caLogEntry represents an issuance log record, stored as a JSON line.
+type caLogEntry struct {
+	Sequence    uint64    `json:"seq"`
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"sha256"`
+}
+
+// CA is the certificate authority shared by the issuance API on all
+// interfaces.
+var CA = &certificateAuthority{}
+
+func generateRootCA() ([]byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := imx6.UniqueID()
+
+	validFrom, _ := time.Parse(time.RFC3339, "1981-01-07T00:00:00Z")
+	validUntil, _ := time.Parse(time.RFC3339, "2049-12-31T23:59:59Z")
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization:       []string{"F-Secure Foundry"},
+			OrganizationalUnit: []string{"TamaGo example CA"},
+			CommonName:         fmt.Sprintf("TamaGo Root CA %X", id),
+		},
+		NotBefore:             validFrom,
+		NotAfter:              validUntil,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.MarshalECPrivateKey(priv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+
+	return buf.Bytes(), nil
+}
+
+// Init unseals, or generates on first use, the root key and locates the end
+// of the issuance log.
+func (ca *certificateAuthority) Init() error {
+	ca.once.Do(func() {
+		ca.Lock()
+		defer ca.Unlock()
+
+		ca.err = ca.load()
+	})
+
+	return ca.err
+}
+
+func (ca *certificateAuthority) load() (err error) {
+	payload, err := loadSealed("ca", func() ([]byte, error) {
+		caLog.Infof("generating root key")
+		return generateRootCA()
+	})
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		for i := range payload {
+			payload[i] = 0
+		}
+	}()
+
+	certBlock, rest := pem.Decode(payload)
+	keyBlock, _ := pem.Decode(rest)
+
+	if certBlock == nil || keyBlock == nil {
+		return errors.New("invalid root CA payload")
+	}
+
+	if ca.cert, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return
+	}
+
+	if ca.key, err = x509.ParseECPrivateKey(keyBlock.Bytes); err != nil {
+		return
+	}
+
+	ca.pem = pem.EncodeToMemory(certBlock)
+
+	if ca.log, err = openStorage("ca_log"); err != nil {
+		return
+	}
+
+	buf := make([]byte, ca.log.Size())
+
+	if _, err = ca.log.ReadAt(buf, 0); err != nil {
+		return
+	}
+
+	// the log is a sequence of JSON lines terminated by unused (zero) space
+	ca.logEnd = int64(bytes.IndexByte(buf, 0))
+
+	if ca.logEnd < 0 {
+		ca.logEnd = ca.log.Size()
+	}
+
+	ca.issued = uint64(bytes.Count(buf[:ca.logEnd], []byte("\n")))
+
+	caLog.Infof("%s, %d certificates issued", ca.cert.Subject.CommonName, ca.issued)
+
+	return
+}
+
+// append records an entry at the end of the issuance log.
+func (ca *certificateAuthority) append(entry *caLogEntry) (err error) {
+	record, err := json.Marshal(entry)
+
+	if err != nil {
+		return
+	}
+
+	record = append(record, '\n')
+
+	if ca.logEnd+int64(len(record)) > ca.log.Size() {
+		return errors.New("issuance log full")
+	}
+
+	if _, err = ca.log.WriteAt(record, ca.logEnd); err != nil {
+		return
+	}
+
+	ca.logEnd += int64(len(record))
+
+	return
+}
+
+// Issue returns a leaf certificate for a PKCS#10 certificate request, the
+// certificate is only returned once recorded in the issuance log.
+func (ca *certificateAuthority) Issue(csrDER []byte, validity time.Duration) (der []byte, err error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+
+	if err != nil {
+		return
+	}
+
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid request signature, %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		EmailAddresses:        csr.EmailAddresses,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	ca.Lock()
+	defer ca.Unlock()
+
+	if der, err = x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key); err != nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(der)
+
+	entry := &caLogEntry{
+		Sequence:    ca.issued + 1,
+		Serial:      fmt.Sprintf("%X", serial),
+		Subject:     csr.Subject.String(),
+		NotBefore:   template.NotBefore,
+		NotAfter:    template.NotAfter,
+		Fingerprint: fmt.Sprintf("%x", fingerprint),
+	}
+
+	if err = ca.append(entry); err != nil {
+		return nil, err
+	}
+
+	ca.issued++
+
+	auditf("key.sign", "ca certificate %s, serial %s", entry.Subject, entry.Serial)
+
+	caLog.Infof("issued %s (serial %s)", entry.Subject, entry.Serial)
+
+	return
+}
+
+// Log returns the issuance log content.
+func (ca *certificateAuthority) Log() (buf []byte, err error) {
+	ca.Lock()
+	defer ca.Unlock()
+
+	buf = make([]byte, ca.logEnd)
+
+	if len(buf) > 0 {
+		_, err = ca.log.ReadAt(buf, 0)
+	}
+
+	return
+}
+
+// caHandler implements the certificate authority API:
+//
+//	GET  /ca.pem  root certificate
+//	GET  /log     issuance log (JSON lines)
+//	POST /issue   sign a PEM or DER certificate request, returns a PEM certificate
+func caHandler(ca *certificateAuthority, token string, validity time.Duration) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(ca.pem)
+	})
+
+	mux.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ca.Log()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Write(buf)
+	})
+
+	mux.HandleFunc("/issue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		auth := []byte(r.Header.Get("Authorization"))
+
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		csr, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CA_MAX_CSR_SIZE))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if block, _ := pem.Decode(csr); block != nil {
+			csr = block.Bytes
+		}
+
+		der, err := ca.Issue(csr, validity)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	})
+
+	return mux
+}
+
+// startCA serves the certificate authority API over TLS, issuance requests
+// are authenticated with the `ca_token` bearer token.
+func startCA(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	token := conf.String("ca_token", "")
+
+	if token == "" {
+		caLog.Warnf("disabled, ca_token not set")
+		return
+	}
+
+	imx6.DCP.Init()
+
+	if err := CA.Init(); err != nil {
+		caLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	certificate, err := sealedCertificate(addr)
+
+	if err != nil {
+		caLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		caLog.Fatalf("listener error, %v", err)
+	}
+
+	validity := time.Duration(conf.Int("ca_validity", 365)) * 24 * time.Hour
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", addr, port),
+		Handler: caHandler(CA, token, validity),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	caLog.Infof("starting certificate authority at %s:%d", addr, port)
+
+	err = srv.ServeTLS(listener, "", "")
+
+	caLog.Fatalf("server returned unexpectedly, %v", err)
+}
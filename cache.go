@@ -0,0 +1,188 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// The i.MX6UL/i.MX6ULL Cortex-A7 core integrates its L2 cache, unlike
+// earlier i.MX6 parts there is no separate PL310 controller and the L2 is
+// enabled together with the L1 data cache (SCTLR.C).
+
+var cacheLog = newLogger("cache")
+
+// defined in cache_arm.s
+func read_clidr() uint32
+func read_ccsidr(csselr uint32) uint32
+func read_l2ctlr() uint32
+func flush_data_cache()
+func cache_disable_flush()
+
+const (
+	// streaming copy working sets, respectively fitting the L1 data cache,
+	// the L2 cache and neither
+	CACHE_BENCH_L1   = 16 * 1024
+	CACHE_BENCH_L2   = 64 * 1024
+	CACHE_BENCH_DRAM = 8 * 1024 * 1024
+
+	// bytes transferred for each measurement
+	CACHE_BENCH_TOTAL = 64 * 1024 * 1024
+	// random accesses for each measurement
+	CACHE_BENCH_READS = 1 << 20
+)
+
+var cacheTypes = map[uint32]string{
+	0b010: "data",
+	0b011: "separate",
+	0b100: "unified",
+}
+
+// cacheInfo logs the geometry of all cache levels reported by the CPU.
+func cacheInfo() {
+	clidr := read_clidr()
+
+	for level := uint32(0); level < 7; level++ {
+		ctype := (clidr >> (level * 3)) & 0b111
+
+		if ctype == 0 {
+			break
+		}
+
+		desc, ok := cacheTypes[ctype]
+
+		if !ok {
+			cacheLog.Infof("L%d instruction", level+1)
+			continue
+		}
+
+		ccsidr := read_ccsidr(level << 1)
+
+		line := 1 << ((ccsidr & 0b111) + 4)
+		ways := int((ccsidr>>3)&0x3ff) + 1
+		sets := int((ccsidr>>13)&0x7fff) + 1
+
+		cacheLog.Infof("L%d %s, %d KiB (%d ways, %d sets, %d bytes lines)",
+			level+1, desc, line*ways*sets/1024, ways, sets, line)
+	}
+
+	cacheLog.Infof("L2CTLR %#x", read_l2ctlr())
+}
+
+// benchCopy returns the streaming copy bandwidth, in MB/s, between the
+// argument buffers, along with the CPU cycles per byte.
+func benchCopy(src []byte, dst []byte, total int) (rate float64, cpb float64) {
+	ops := total / len(src)
+	cpo, elapsed := CyclesPerOp(ops, func() {
+		copy(dst, src)
+	})
+
+	return float64(ops*len(src)) / elapsed.Seconds() / 1e6, cpo / float64(len(src))
+}
+
+// benchRandom returns the rate, in millions of reads per second, of random
+// word reads within the argument buffer, along with the CPU cycles per read,
+// its length must be a power of 2.
+func benchRandom(buf []uint32, reads int) (rate float64, cpr float64) {
+	mask := uint32(len(buf) - 1)
+	x := uint32(2463534242)
+	sum := uint32(0)
+
+	start := markCycles()
+
+	for i := 0; i < reads; i++ {
+		// xorshift32
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		sum += buf[x&mask]
+	}
+
+	cycles, elapsed := start.Since()
+	buf[0] = sum
+
+	return float64(reads) / elapsed.Seconds() / 1e6, float64(cycles) / float64(reads)
+}
+
+func benchCache(desc string) {
+	for _, size := range []int{CACHE_BENCH_L1, CACHE_BENCH_L2, CACHE_BENCH_DRAM} {
+		copyRate, cpb := benchCopy(make([]byte, size), make([]byte, size), CACHE_BENCH_TOTAL)
+		randRate, cpr := benchRandom(make([]uint32, size/4), CACHE_BENCH_READS)
+
+		cacheLog.Infof("%-8s %5d KiB copy %8.2f MB/s (%.2f cycles/byte), random read %6.2f M/s (%.1f cycles/read)",
+			desc, size/1024, copyRate, cpb, randRate, cpr)
+	}
+}
+
+func checksum(buf []uint32) (sum uint32) {
+	for i, v := range buf {
+		sum = sum*31 + v ^ uint32(i)
+	}
+
+	return
+}
+
+// TestCache reports the cache configuration and compares memory bandwidth
+// with and without caches, verifying that data cache maintenance preserves
+// memory content across the transition.
+func TestCache() (err error) {
+	cacheInfo()
+	benchCache("enabled")
+
+	buf := make([]uint32, CACHE_BENCH_L2/4)
+
+	for i := range buf {
+		buf[i] = uint32(i) * 0x9e3779b9
+	}
+
+	sum := checksum(buf)
+
+	// Logging, allocation and synchronization primitives are avoided
+	// while caches are disabled, as exclusive accesses might not be
+	// supported on non-cacheable memory.
+	cache_disable_flush()
+
+	uncachedSum := checksum(buf)
+
+	for i := range buf {
+		buf[i] = ^buf[i]
+	}
+
+	imx6.ARM.CacheEnable()
+
+	for i := range buf {
+		buf[i] = ^buf[i]
+	}
+
+	if checksum(buf) != sum || uncachedSum != sum {
+		return errors.New("memory content mismatch across cache maintenance")
+	}
+
+	cacheLog.Infof("content preserved across cache disable/enable")
+
+	src := make([]byte, CACHE_BENCH_L1)
+	dst := make([]byte, CACHE_BENCH_L1)
+	words := make([]uint32, CACHE_BENCH_L1/4)
+
+	// the uncached benchmark is scaled down as it is orders of magnitude
+	// slower
+	cache_disable_flush()
+
+	copyRate, cpb := benchCopy(src, dst, CACHE_BENCH_TOTAL/64)
+	randRate, cpr := benchRandom(words, CACHE_BENCH_READS/64)
+
+	imx6.ARM.CacheEnable()
+
+	cacheLog.Infof("%-8s %5d KiB copy %8.2f MB/s (%.2f cycles/byte), random read %6.2f M/s (%.1f cycles/read)",
+		"disabled", CACHE_BENCH_L1/1024, copyRate, cpb, randRate, cpr)
+
+	return
+}
@@ -0,0 +1,95 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func read_clidr() uint32
+TEXT ·read_clidr(SB),$0-4
+	MRC	15, 1, R0, C0, C0, 1
+	MOVW	R0, ret+0(FP)
+	RET
+
+// func read_ccsidr(csselr uint32) uint32
+TEXT ·read_ccsidr(SB),$0-8
+	MOVW	csselr+0(FP), R0
+	MCR	15, 2, R0, C0, C0, 0
+	WORD	$0xf57ff06f // isb sy
+	MRC	15, 1, R0, C0, C0, 0
+	MOVW	R0, ret+4(FP)
+	RET
+
+// func read_l2ctlr() uint32
+TEXT ·read_l2ctlr(SB),$0-4
+	// L2 Control Register, Cortex™-A7 MPCore® Technical Reference Manual
+	MRC	15, 1, R0, C9, C0, 2
+	MOVW	R0, ret+0(FP)
+	RET
+
+// flush_data_cache cleans and invalidates the data cache without performing
+// any memory access, it is meant to be called with BL from functions which
+// cannot tolerate stack accesses around cache maintenance and it clobbers
+// R0-R5, R7-R9 and R11.
+//
+// Taken from Linux /arch/arm/mm/cache-v7.S (see tamago arm/cache.s).
+TEXT ·flush_data_cache(SB),NOSPLIT|NOFRAME,$0
+	WORD	$0xf57ff05f			// DMB SY
+	MRC	15, 1, R0, C0, C0, 1		// read CLIDR
+	MOVW	R0>>23, R3			// move LoC into position
+	AND.S	$7<<1, R3, R3			// extract LoC*2 from clidr
+	BEQ	finished			// if loc is 0, then no need to clean
+	MOVW	$0x0, R8			// start clean at cache level 0
+flush_levels:
+	ADD	R8>>1, R8, R2			// work out 3x current cache level
+	MOVW	R0>>R2, R1			// extract cache type bits from clidr
+	AND	$0x7, R1			// mask of the bits for current cache only
+	CMP	$0x2, R1			// see what cache we have at this level
+	BLT	skip				// skip if no cache, or just i-cache
+	MCR	15, 2, R8, C0, C0, 0		// select current cache level in cssr
+	WORD	$0xf57ff06f			// isb to sych the new cssr&csidr
+	MRC	15, 1, R1, C0, C0, 0		// read the new csidr
+	AND	$0x7, R1, R2			// extract the length of the cache lines
+	ADD	$0x4, R2			// add 4 (line length offset)
+	MOVW	$0x3ff, R4
+	AND.S	R1>>3, R4, R4			// find maximum number on the way size
+	CLZ	R4, R5				// find bit position of way size increment
+	MOVW	$0x7fff, R7
+	AND.S	R1>>13, R7, R7			// extract max number of the index size
+loop1:
+	MOVW	R7, R9				// create working copy of max index
+loop2:
+	ORR	R4<<R5, R8, R11			// factor way and cache number into r11
+	ORR	R9<<R2, R11, R11		// factor way and cache number into r11
+	MCR	15, 0, R11, C7, C14, 2		// clean & invalidate by set/way
+	SUB.S	$1, R9, R9			// decrement the index
+	BGE	loop2
+	SUB.S	$1, R4, R4			// decrement the way
+	BGE	loop1
+skip:
+	ADD	$2, R8				// increment cache number
+	CMP	R8, R3
+	BGT	flush_levels
+finished:
+	MOVW	$0, R8				// switch back to cache level 0
+	MCR	15, 2, R8, C0, C0, 0		// select current cache level in cssr
+	WORD	$0xf57ff04f			// DSB SY
+	WORD	$0xf57ff06f			// ISB SY
+	RET
+
+// func cache_disable_flush()
+TEXT ·cache_disable_flush(SB),NOSPLIT|NOFRAME,$0
+	MOVW	R14, R12
+	MRC	15, 0, R1, C1, C0, 0
+	BIC	$0x1000, R1	// Disable I-cache
+	BIC	$0x4, R1	// Disable D-cache
+	MCR	15, 0, R1, C1, C0, 0
+	WORD	$0xf57ff06f	// isb sy
+	// Clean and invalidate only after caches are disabled, so that no
+	// line can be allocated after maintenance.
+	BL	·flush_data_cache(SB)
+	MOVW	R12, R14
+	RET
@@ -0,0 +1,135 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// card read size, transfers are split in ADMA descriptors by the driver
+	CARD_HASH_READ_SIZE = 1024 * 1024
+	// progress report interval (percentage of the hashed size)
+	CARD_HASH_PROGRESS = 10
+)
+
+var cardhashLog = newLogger("cardhash")
+
+type cardChunk struct {
+	buf []byte
+	err error
+}
+
+// hashCard computes the hash of a memory card area, the next read is issued
+// while the current one is hashed so that the card is kept busy.
+func hashCard(n int, p int, h hash.Hash) (res string, err error) {
+	card, err := target.Card(n)
+
+	if err != nil {
+		return
+	}
+
+	offset := int64(0)
+	size := int64(card.Blocks()) * int64(card.BlockSize())
+	name := fmt.Sprintf("card %d", n)
+
+	if p > 0 {
+		parts, err := partitions(card)
+
+		if err != nil {
+			return "", err
+		}
+
+		if p > len(parts) {
+			return "", fmt.Errorf("invalid partition, %d found", len(parts))
+		}
+
+		offset = parts[p-1].start
+		size = parts[p-1].size
+		name += fmt.Sprintf(" partition %d", p)
+	}
+
+	chunks := make(chan cardChunk, 1)
+
+	go func() {
+		defer close(chunks)
+
+		for off := int64(0); off < size; off += CARD_HASH_READ_SIZE {
+			length := int64(CARD_HASH_READ_SIZE)
+
+			if off+length > size {
+				length = size - off
+			}
+
+			buf, err := card.Read(offset+off, length)
+			chunks <- cardChunk{buf, err}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	cardhashLog.Infof("hashing %s (%d MiB)", name, size/(1024*1024))
+
+	start := time.Now()
+	done := int64(0)
+	next := int64(CARD_HASH_PROGRESS)
+
+	for c := range chunks {
+		if c.err != nil {
+			// drain the reader
+			for range chunks {
+			}
+
+			return "", fmt.Errorf("read error at %#x, %v", offset+done, c.err)
+		}
+
+		h.Write(c.buf)
+		done += int64(len(c.buf))
+
+		if pct := done * 100 / size; pct >= next {
+			elapsed := time.Since(start)
+			cardhashLog.Infof("%3d%% %d MiB (%.2f MB/s)", pct, done/(1024*1024), float64(done)/1e6/elapsed.Seconds())
+			next = pct - pct%CARD_HASH_PROGRESS + CARD_HASH_PROGRESS
+		}
+	}
+
+	elapsed := time.Since(start)
+
+	return fmt.Sprintf("%x  %s (%d bytes in %s, %.2f MB/s)", h.Sum(nil), name, done, elapsed, float64(done)/1e6/elapsed.Seconds()), nil
+}
+
+func cardHashCommand(arg1 string, arg2 string, alg string) (res string) {
+	var h hash.Hash
+
+	n, _ := strconv.Atoi(arg1)
+	p, _ := strconv.Atoi(arg2)
+
+	switch alg {
+	case "", "sha256":
+		h = sha256.New()
+	case "blake2b":
+		h, _ = blake2b.New256(nil)
+	}
+
+	res, err := hashCard(n, p, h)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return
+}
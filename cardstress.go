@@ -0,0 +1,186 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/board"
+)
+
+const (
+	// maximum access size in blocks
+	CARD_STRESS_MAX_BLOCKS = 256
+)
+
+var cardstressLog = newLogger("cardstress")
+
+// cardStress holds the counters of a memory card stress worker.
+type cardStress struct {
+	card   int
+	reads  int
+	writes int
+	bytes  int64
+	err    error
+}
+
+// stressCard performs random reads over the whole card and, when a write
+// region is given, writes verified by reading them back, until the deadline.
+func stressCard(s *cardStress, card board.BlockDevice, deadline time.Time, offset int64, size int64) {
+	blockSize := int64(card.BlockSize())
+	blocks := int64(card.Blocks())
+	rng := mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(s.card)))
+
+	for time.Now().Before(deadline) {
+		n := 1 + rng.Int63n(CARD_STRESS_MAX_BLOCKS)
+
+		if size > 0 && rng.Intn(2) == 0 {
+			if n*blockSize > size {
+				n = size / blockSize
+			}
+
+			off := offset + rng.Int63n(size/blockSize-n+1)*blockSize
+			buf := make([]byte, n*blockSize)
+			rand.Read(buf)
+
+			if err := card.Write(off, buf); err != nil {
+				s.err = fmt.Errorf("card %d write at %#x, %v", s.card, off, err)
+				return
+			}
+
+			res, err := card.Read(off, int64(len(buf)))
+
+			if err != nil {
+				s.err = fmt.Errorf("card %d read at %#x, %v", s.card, off, err)
+				return
+			}
+
+			if !bytes.Equal(res, buf) {
+				s.err = fmt.Errorf("card %d data mismatch at %#x", s.card, off)
+				return
+			}
+
+			s.writes += 1
+			s.bytes += 2 * int64(len(buf))
+
+			continue
+		}
+
+		off := rng.Int63n(blocks-n+1) * blockSize
+
+		if _, err := card.Read(off, n*blockSize); err != nil {
+			s.err = fmt.Errorf("card %d read at %#x, %v", s.card, off, err)
+			return
+		}
+
+		s.reads += 1
+		s.bytes += n * blockSize
+	}
+}
+
+// cardStressTest drives all memory cards concurrently, from separate
+// goroutines, with random read and (optionally) write workloads.
+func cardStressTest(duration time.Duration) (res string, err error) {
+	offset := int64(conf.Int("card_stress_offset", 0))
+	size := int64(conf.Int("card_stress_size", 16*1024*1024))
+
+	if offset == 0 {
+		size = 0
+	}
+
+	var wg sync.WaitGroup
+	var workers []*cardStress
+
+	deadline := time.Now().Add(duration)
+
+	for i := range cards {
+		card, err := target.Card(i)
+
+		if err != nil {
+			cardstressLog.Warnf("skipping card %d, %v", i, err)
+			continue
+		}
+
+		if size > 0 && (offset%int64(card.BlockSize()) != 0 || size < int64(card.BlockSize()) || offset+size > int64(card.Blocks())*int64(card.BlockSize())) {
+			return "", fmt.Errorf("invalid write region for card %d", i)
+		}
+
+		s := &cardStress{card: i}
+		workers = append(workers, s)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			stressCard(s, card, deadline, offset, size)
+		}()
+	}
+
+	if len(workers) == 0 {
+		return "", errors.New("no cards available")
+	}
+
+	mode := "read-only"
+
+	if size > 0 {
+		mode = fmt.Sprintf("read/write at %#x (%d MiB)", offset, size/(1024*1024))
+	}
+
+	cardstressLog.Infof("%d cards, %s, %s", len(workers), mode, duration)
+
+	wg.Wait()
+
+	var buf bytes.Buffer
+
+	for _, s := range workers {
+		fmt.Fprintf(&buf, "card %d: %d reads %d writes %.2f MB/s", s.card, s.reads, s.writes, float64(s.bytes)/1e6/duration.Seconds())
+
+		if s.err != nil {
+			fmt.Fprintf(&buf, " error: %v", s.err)
+			err = s.err
+		}
+
+		fmt.Fprintln(&buf)
+	}
+
+	return buf.String(), err
+}
+
+func cardStressCommand(arg string) (res string) {
+	sec, _ := strconv.Atoi(arg)
+
+	res, err := cardStressTest(time.Duration(sec) * time.Second)
+
+	if err != nil && res == "" {
+		return err.Error()
+	}
+
+	return
+}
+
+// TestCardStress runs the concurrent memory card stress test for the
+// configured duration.
+func TestCardStress() (err error) {
+	res, err := cardStressTest(time.Duration(conf.Int("card_stress_time", 10)) * time.Second)
+
+	for _, l := range bytes.Split(bytes.TrimSpace([]byte(res)), []byte("\n")) {
+		if len(l) > 0 {
+			cardstressLog.Infof("%s", l)
+		}
+	}
+
+	return
+}
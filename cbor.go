@@ -0,0 +1,262 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Minimal CBOR (RFC 7049) support for CTAP2 messages (see fido.go), limited
+// to integers, byte and text strings, arrays, maps, booleans and null. Maps
+// are decoded to map[interface{}]interface{} with int64 or string keys and
+// encoded in CTAP2 canonical form.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborSimple = 7
+
+	cborFalse = 20
+	cborTrue  = 21
+	cborNull  = 22
+
+	CBOR_MAX_DEPTH = 8
+)
+
+func cborHeader(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= 0xff:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborInt(buf *bytes.Buffer, n int64) {
+	if n < 0 {
+		cborHeader(buf, cborNegInt, uint64(-1-n))
+	} else {
+		cborHeader(buf, cborUint, uint64(n))
+	}
+}
+
+func cborEncodeTo(buf *bytes.Buffer, v interface{}) (err error) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple<<5 | cborNull)
+	case bool:
+		if v {
+			buf.WriteByte(cborSimple<<5 | cborTrue)
+		} else {
+			buf.WriteByte(cborSimple<<5 | cborFalse)
+		}
+	case int:
+		cborInt(buf, int64(v))
+	case int64:
+		cborInt(buf, v)
+	case uint64:
+		cborHeader(buf, cborUint, v)
+	case []byte:
+		cborHeader(buf, cborBytes, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		cborHeader(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHeader(buf, cborArray, uint64(len(v)))
+
+		for _, e := range v {
+			if err = cborEncodeTo(buf, e); err != nil {
+				return
+			}
+		}
+	case map[interface{}]interface{}:
+		type entry struct {
+			key []byte
+			val interface{}
+		}
+
+		var entries []entry
+
+		for k, e := range v {
+			var kb bytes.Buffer
+
+			if err = cborEncodeTo(&kb, k); err != nil {
+				return
+			}
+
+			entries = append(entries, entry{kb.Bytes(), e})
+		}
+
+		// CTAP2 canonical ordering: shorter keys first, then bytewise
+		sort.Slice(entries, func(i, j int) bool {
+			if len(entries[i].key) != len(entries[j].key) {
+				return len(entries[i].key) < len(entries[j].key)
+			}
+
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+
+		cborHeader(buf, cborMap, uint64(len(entries)))
+
+		for _, e := range entries {
+			buf.Write(e.key)
+
+			if err = cborEncodeTo(buf, e.val); err != nil {
+				return
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported CBOR type %T", v)
+	}
+
+	return
+}
+
+func cborEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := cborEncodeTo(&buf, v)
+	return buf.Bytes(), err
+}
+
+func cborDecodeFrom(buf []byte, depth int) (v interface{}, rest []byte, err error) {
+	if depth > CBOR_MAX_DEPTH {
+		return nil, nil, errors.New("CBOR nesting too deep")
+	}
+
+	if len(buf) < 1 {
+		return nil, nil, errors.New("truncated CBOR item")
+	}
+
+	major := buf[0] >> 5
+	info := buf[0] & 0x1f
+	buf = buf[1:]
+
+	var n uint64
+
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+
+		if len(buf) < size {
+			return nil, nil, errors.New("truncated CBOR header")
+		}
+
+		for i := 0; i < size; i++ {
+			n = n<<8 | uint64(buf[i])
+		}
+
+		buf = buf[size:]
+	default:
+		return nil, nil, errors.New("unsupported CBOR length encoding")
+	}
+
+	switch major {
+	case cborUint, cborNegInt:
+		if n > 1<<63-1 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+
+		if major == cborNegInt {
+			return -1 - int64(n), buf, nil
+		}
+
+		return int64(n), buf, nil
+	case cborBytes, cborText:
+		if n > uint64(len(buf)) {
+			return nil, nil, errors.New("truncated CBOR string")
+		}
+
+		if major == cborText {
+			return string(buf[:n]), buf[n:], nil
+		}
+
+		return append([]byte{}, buf[:n]...), buf[n:], nil
+	case cborArray:
+		if n > uint64(len(buf)) {
+			return nil, nil, errors.New("invalid CBOR array length")
+		}
+
+		a := make([]interface{}, n)
+
+		for i := range a {
+			if a[i], buf, err = cborDecodeFrom(buf, depth+1); err != nil {
+				return
+			}
+		}
+
+		return a, buf, nil
+	case cborMap:
+		if n > uint64(len(buf)) {
+			return nil, nil, errors.New("invalid CBOR map length")
+		}
+
+		m := make(map[interface{}]interface{}, n)
+
+		for i := uint64(0); i < n; i++ {
+			var key, val interface{}
+
+			if key, buf, err = cborDecodeFrom(buf, depth+1); err != nil {
+				return
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("unsupported CBOR map key")
+			}
+
+			if val, buf, err = cborDecodeFrom(buf, depth+1); err != nil {
+				return
+			}
+
+			m[key] = val
+		}
+
+		return m, buf, nil
+	case cborSimple:
+		switch {
+		case info == cborFalse:
+			return false, buf, nil
+		case info == cborTrue:
+			return true, buf, nil
+		case info == cborNull:
+			return nil, buf, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("unsupported CBOR item %#x", major)
+}
+
+// cborDecode decodes a single CBOR item.
+func cborDecode(buf []byte) (v interface{}, err error) {
+	v, _, err = cborDecodeFrom(buf, 0)
+	return
+}
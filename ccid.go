@@ -0,0 +1,234 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+)
+
+// CCID messages (p26, 6.1 Command Pipe, Bulk-OUT Messages and p47, 6.2
+// Response Pipe, Bulk-IN Messages, CCID Rev1.1)
+const (
+	CCID_HEADER_SIZE = 10
+
+	PC_TO_RDR_SET_PARAMETERS  = 0x61
+	PC_TO_RDR_ICC_POWER_ON    = 0x62
+	PC_TO_RDR_ICC_POWER_OFF   = 0x63
+	PC_TO_RDR_GET_SLOT_STATUS = 0x65
+	PC_TO_RDR_ESCAPE          = 0x6b
+	PC_TO_RDR_GET_PARAMETERS  = 0x6c
+	PC_TO_RDR_XFR_BLOCK       = 0x6f
+
+	RDR_TO_PC_DATA_BLOCK  = 0x80
+	RDR_TO_PC_SLOT_STATUS = 0x81
+	RDR_TO_PC_PARAMETERS  = 0x82
+	RDR_TO_PC_ESCAPE      = 0x83
+
+	// bStatus
+	CCID_ICC_ACTIVE   = 0x00
+	CCID_ICC_INACTIVE = 0x01
+	CCID_CMD_FAILED   = 0x40
+
+	// bError
+	CCID_CMD_NOT_SUPPORTED = 0x00
+
+	// class-specific requests
+	CCID_ABORT = 0x01
+
+	CCID_MAX_MESSAGE = 4096
+)
+
+var ccidLog = newLogger("ccid")
+
+// ccidATR is the Answer To Reset of the emulated card, its historical bytes
+// match an OpenPGP card.
+var ccidATR = []byte{
+	0x3b, 0xda, 0x11, 0xff, 0x81, 0xb1, 0xfe, 0x55, 0x1f, 0x03,
+	0x00, 0x31, 0x84, 0x73, 0x80, 0x01, 0x80, 0x00, 0x90, 0x00,
+	0xe4,
+}
+
+// T=1 protocol data structure (p36, Table 6.1-7, CCID Rev1.1)
+var ccidT1Parameters = []byte{0x11, 0x10, 0x00, 0x45, 0x00, 0xfe, 0x00}
+
+// ccidReader implements a CCID reader, with a single always inserted card,
+// exchanging APDUs with an applet.
+type ccidReader struct {
+	// applet processes command APDUs
+	applet func(capdu []byte) (rapdu []byte)
+
+	powered bool
+
+	// OUT message assembly
+	buf []byte
+
+	// IN messages queue
+	out chan []byte
+}
+
+// CCID is the smart card reader instance exposed over USB.
+var CCID *ccidReader
+
+func (r *ccidReader) reply(msgType byte, cmd []byte, data []byte, status byte, errCode byte, param byte) {
+	res := make([]byte, CCID_HEADER_SIZE, CCID_HEADER_SIZE+len(data))
+
+	res[0] = msgType
+	binary.LittleEndian.PutUint32(res[1:5], uint32(len(data)))
+	// bSlot, bSeq
+	res[5] = cmd[5]
+	res[6] = cmd[6]
+	res[7] = status
+	res[8] = errCode
+	res[9] = param
+
+	r.out <- append(res, data...)
+}
+
+func (r *ccidReader) status() byte {
+	if r.powered {
+		return CCID_ICC_ACTIVE
+	}
+
+	return CCID_ICC_INACTIVE
+}
+
+func (r *ccidReader) handle(cmd []byte, data []byte) {
+	switch cmd[0] {
+	case PC_TO_RDR_ICC_POWER_ON:
+		r.powered = true
+		r.reply(RDR_TO_PC_DATA_BLOCK, cmd, ccidATR, CCID_ICC_ACTIVE, 0, 0)
+	case PC_TO_RDR_ICC_POWER_OFF:
+		r.powered = false
+		r.reply(RDR_TO_PC_SLOT_STATUS, cmd, nil, r.status(), 0, 0)
+	case PC_TO_RDR_GET_SLOT_STATUS:
+		r.reply(RDR_TO_PC_SLOT_STATUS, cmd, nil, r.status(), 0, 0)
+	case PC_TO_RDR_GET_PARAMETERS, PC_TO_RDR_SET_PARAMETERS:
+		// only T=1 is supported, bProtocolNum 1
+		r.reply(RDR_TO_PC_PARAMETERS, cmd, ccidT1Parameters, r.status(), 0, 1)
+	case PC_TO_RDR_XFR_BLOCK:
+		if !r.powered {
+			r.reply(RDR_TO_PC_DATA_BLOCK, cmd, nil, CCID_CMD_FAILED|CCID_ICC_INACTIVE, 0, 0)
+			return
+		}
+
+		r.reply(RDR_TO_PC_DATA_BLOCK, cmd, r.applet(data), CCID_ICC_ACTIVE, 0, 0)
+	case PC_TO_RDR_ESCAPE:
+		r.reply(RDR_TO_PC_ESCAPE, cmd, nil, CCID_CMD_FAILED|r.status(), CCID_CMD_NOT_SUPPORTED, 0)
+	default:
+		r.reply(RDR_TO_PC_SLOT_STATUS, cmd, nil, CCID_CMD_FAILED|r.status(), CCID_CMD_NOT_SUPPORTED, 0)
+	}
+}
+
+// Rx implements the CCID bulk OUT endpoint function, messages larger than a
+// single transfer are assembled before processing.
+func (r *ccidReader) Rx(buf []byte, lastErr error) (res []byte, err error) {
+	r.buf = append(r.buf, buf...)
+
+	if len(r.buf) < CCID_HEADER_SIZE {
+		return
+	}
+
+	size := CCID_HEADER_SIZE + int(binary.LittleEndian.Uint32(r.buf[1:5]))
+
+	if size > CCID_MAX_MESSAGE {
+		ccidLog.Infof("discarding oversized message (%d bytes)", size)
+		r.buf = nil
+		return
+	}
+
+	if len(r.buf) < size {
+		return
+	}
+
+	msg := r.buf[:size]
+	r.buf = nil
+
+	r.handle(msg[:CCID_HEADER_SIZE], msg[CCID_HEADER_SIZE:])
+
+	return
+}
+
+// Tx implements the CCID bulk IN endpoint function.
+func (r *ccidReader) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case in = <-r.out:
+	default:
+	}
+
+	return
+}
+
+func ccidSetup(setup *usb.SetupData) (in []byte, err error) {
+	if setup.Request == CCID_ABORT {
+		return
+	}
+
+	return nil, fmt.Errorf("unsupported request code: %#x", setup.Request)
+}
+
+// addCCIDInterface adds a CCID interface, exposing the OpenPGP card applet
+// (see openpgp.go), to the USB device next to Ethernet over USB.
+func addCCIDInterface(device *usb.Device, configurationIndex int) {
+	imx6.DCP.Init()
+
+	card, err := newOpenPGPCard()
+
+	if err != nil {
+		ccidLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	CCID = &ccidReader{
+		applet: card.Handle,
+		out:    make(chan []byte, 1),
+	}
+
+	iface := &usb.InterfaceDescriptor{}
+	iface.SetDefaults()
+
+	iface.NumEndpoints = 2
+	// Smart Card Device Class
+	iface.InterfaceClass = 0x0b
+
+	iInterface, _ := device.AddString(`OpenPGP Smart Card`)
+	iface.Interface = iInterface
+
+	iface.IAD = &usb.InterfaceAssociationDescriptor{}
+	iface.IAD.SetDefaults()
+	iface.IAD.InterfaceCount = 1
+	iface.IAD.FunctionClass = iface.InterfaceClass
+	iface.IAD.Function = iInterface
+
+	ccid := &usb.CCIDDescriptor{}
+	ccid.SetDefaults()
+	ccid.MaxCCIDMessageLength = CCID_MAX_MESSAGE
+
+	iface.ClassDescriptors = append(iface.ClassDescriptors, ccid.Bytes())
+
+	ep4IN := &usb.EndpointDescriptor{}
+	ep4IN.SetDefaults()
+	ep4IN.EndpointAddress = 0x84
+	ep4IN.Attributes = 2
+	ep4IN.Function = CCID.Tx
+
+	ep4OUT := &usb.EndpointDescriptor{}
+	ep4OUT.SetDefaults()
+	ep4OUT.EndpointAddress = 0x04
+	ep4OUT.Attributes = 2
+	ep4OUT.Function = CCID.Rx
+
+	iface.Endpoints = append(iface.Endpoints, ep4IN, ep4OUT)
+
+	device.Configurations[configurationIndex].AddInterface(iface)
+	addInterfaceSetup(device, iface, ccidSetup)
+}
@@ -0,0 +1,92 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var clockLog = newLogger("clock")
+
+// The runtime clock counts from boot, wall clock time is therefore tracked
+// as an offset which is restored from the SNVS SRTC (see rtc.go), when set,
+// or must be set at each boot.
+var clock struct {
+	sync.Mutex
+
+	offset time.Duration
+	set    bool
+	// last time the clock was set, as wall clock time
+	updated time.Time
+}
+
+// Now returns the current wall clock time.
+func Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return time.Now().Add(clock.offset)
+}
+
+// SetTime sets the current wall clock time, which is also stored in the SRTC.
+func SetTime(t time.Time) {
+	clock.Lock()
+	clock.offset = t.Sub(time.Now())
+	clock.set = true
+	clock.updated = t
+	clock.Unlock()
+
+	if !target.Native() {
+		return
+	}
+
+	if err := rtcWrite(t); err != nil {
+		clockLog.Errorf("SRTC error, %v", err)
+	}
+}
+
+// LastSet returns the wall clock time at which the clock was last set.
+func LastSet() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.updated
+}
+
+// TimeSet returns whether the wall clock time has been set since boot.
+func TimeSet() bool {
+	clock.Lock()
+	defer clock.Unlock()
+
+	return clock.set
+}
+
+func dateCommand(arg string) (res string) {
+	if arg != "" {
+		sec, err := strconv.ParseInt(arg, 10, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid time: %v", err)
+		}
+
+		SetTime(time.Unix(sec, 0))
+		auditf("settings.date", "%d", sec)
+	}
+
+	res = Now().UTC().Format(time.RFC3339)
+
+	if !TimeSet() {
+		res += " (not set)"
+	}
+
+	return
+}
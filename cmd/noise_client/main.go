@@ -0,0 +1,186 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// The noise_client command connects to the example firmware Noise console,
+// authenticating the device static key either against its identity
+// certificate, issued by a trusted CA, or against a pinned key.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/f-secure-foundry/tamago-example/internal/noise"
+)
+
+const prologue = "tamago-example noise console v1"
+
+// loadKey loads the client static key, generating it on first use.
+func loadKey(path string) (*noise.KeyPair, error) {
+	buf, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		k, err := noise.GenerateKeyPair()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = ioutil.WriteFile(path, []byte(hex.EncodeToString(k.Private)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+
+		log.Printf("generated client key %s", path)
+
+		return k, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := hex.DecodeString(string(trimNewline(buf)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return noise.NewKeyPair(priv)
+}
+
+func trimNewline(buf []byte) []byte {
+	for len(buf) > 0 && (buf[len(buf)-1] == '\n' || buf[len(buf)-1] == '\r') {
+		buf = buf[:len(buf)-1]
+	}
+
+	return buf
+}
+
+func loadRoots(path string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+
+	for {
+		var block *pem.Block
+
+		if block, buf = pem.Decode(buf); block == nil {
+			break
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		roots.AddCert(cert)
+	}
+
+	return roots, nil
+}
+
+func main() {
+	var err error
+
+	addr := flag.String("addr", "10.0.0.1:9000", "device address")
+	keyPath := flag.String("key", "noise_client.key", "client static key (hex, created if missing)")
+	caPath := flag.String("ca", "", "trusted device identity CA (PEM)")
+	pin := flag.String("pin", "", "expected device static key (hex)")
+	flag.Parse()
+
+	log.SetFlags(0)
+
+	static, err := loadKey(*keyPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("client static key %x (add to noise_peers)", static.Public)
+
+	var roots *x509.CertPool
+
+	if *caPath != "" {
+		if roots, err = loadRoots(*caPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config := &noise.Config{
+		Static:   static,
+		Prologue: []byte(prologue),
+		VerifyPeer: func(remote []byte, payload []byte) error {
+			if *pin != "" && hex.EncodeToString(remote) != *pin {
+				return fmt.Errorf("device static key mismatch (%x != %s)", remote, *pin)
+			}
+
+			if roots == nil {
+				if *pin == "" {
+					log.Printf("WARNING: no trusted CA nor pinned key, device %x not authenticated", remote)
+				}
+
+				return nil
+			}
+
+			cert, err := noise.VerifyIdentity(payload, remote, roots)
+
+			if err != nil {
+				return err
+			}
+
+			log.Printf("device identity %s verified", cert.Subject)
+
+			return nil
+		},
+	}
+
+	conn, err := net.DialTimeout("tcp", *addr, 10*time.Second)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	c, err := noise.Client(conn, config)
+
+	if err != nil {
+		log.Fatalf("handshake failed, %v", err)
+	}
+
+	log.Printf("connected, handshake hash %x", c.HandshakeHash())
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer terminal.Restore(int(os.Stdin.Fd()), state)
+	}
+
+	go io.Copy(c, os.Stdin)
+	io.Copy(os.Stdout, c)
+}
@@ -0,0 +1,408 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// The tamagoctl command controls the example firmware from the host through
+// its HTTP API (see api.go), or its USB RPC interface (see rpc.go): it runs
+// tests, fetches results and logs, verifies platform quotes, provisions the
+// device identity, pushes signed firmware images and reboots the device.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/quote"
+	"github.com/f-secure-foundry/tamago-example/internal/usbrpc"
+)
+
+// must match results.go
+type resultReport struct {
+	Banner   string  `json:"banner"`
+	Duration float64 `json:"duration"`
+	Passed   int     `json:"passed"`
+	Failed   int     `json:"failed"`
+	Results  []struct {
+		Name     string  `json:"name"`
+		Passed   bool    `json:"passed"`
+		Duration float64 `json:"duration"`
+		Error    string  `json:"error,omitempty"`
+	} `json:"results"`
+}
+
+const usage = `usage: tamagoctl [flags] <command> [arguments]
+
+commands:
+  tests                         list tests and their selection status
+  run [<include> [<exclude>]]   run tests matching the patterns
+  results                       show the boot test run results
+  log                           fetch recent log output
+  audit [<head>]                fetch and verify the audit log hash chain
+  measurements                  fetch the measurement log
+  quote                         verify a platform quote
+  csr                           fetch the certificate request (provisioning mode)
+  cert <file>                   install a PEM or DER certificate (provisioning mode)
+  push <image> <sig>            push a signed firmware image, staged once verified
+  reboot                        warm reboot the device
+  console <command>             execute a console command (USB only)
+
+Over USB (-usb) only tests, run, results, log, reboot and console are
+available.
+
+flags:
+`
+
+var (
+	base    = flag.String("url", "http://10.0.0.1", "device base URL")
+	timeout = flag.Duration("timeout", 10*time.Minute, "request timeout")
+	keyPath = flag.String("key", "", "trusted attestation public key (PEM)")
+	refPath = flag.String("reference", "", "known good component digests (JSON)")
+	useUSB  = flag.Bool("usb", false, "use the USB RPC interface (Linux only)")
+	user    = flag.String("user", "admin", "web server user (password from $TAMAGOCTL_PASSWORD, or token from $TAMAGOCTL_TOKEN)")
+)
+
+func request(method string, path string, query url.Values, body io.Reader) (buf []byte, err error) {
+	u, err := url.Parse(*base + path)
+
+	if err != nil {
+		return
+	}
+
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+
+	if err != nil {
+		return
+	}
+
+	if token, ok := os.LookupEnv("TAMAGOCTL_TOKEN"); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if password, ok := os.LookupEnv("TAMAGOCTL_PASSWORD"); ok {
+		req.SetBasicAuth(*user, password)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	res, err := client.Do(req)
+
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if buf, err = ioutil.ReadAll(res.Body); err != nil {
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(buf))
+	}
+
+	return
+}
+
+func printReport(buf []byte) (failed int, err error) {
+	var r resultReport
+
+	if err = json.Unmarshal(buf, &r); err != nil {
+		return
+	}
+
+	fmt.Println(r.Banner)
+
+	for _, e := range r.Results {
+		status := "PASS"
+
+		if !e.Passed {
+			status = "FAIL"
+		}
+
+		fmt.Printf("%s %-16s %8.3fs %s\n", status, e.Name, e.Duration, e.Error)
+	}
+
+	fmt.Printf("%d passed, %d failed (%.3fs)\n", r.Passed, r.Failed, r.Duration)
+
+	return r.Failed, nil
+}
+
+func verifyQuote() (err error) {
+	nonce := make([]byte, 32)
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	q, err := quote.Fetch(*base+"/attest", nonce)
+
+	if err != nil {
+		return
+	}
+
+	pub := []byte(q.PublicKey)
+
+	if *keyPath != "" {
+		if pub, err = ioutil.ReadFile(*keyPath); err != nil {
+			return
+		}
+	} else {
+		log.Printf("WARNING: no trusted key, using the quoted one")
+	}
+
+	key, err := quote.ParsePublicKey(pub)
+
+	if err != nil {
+		return
+	}
+
+	if err = quote.Verify(q, key, nonce); err != nil {
+		return
+	}
+
+	if *refPath != "" {
+		unknown, err := quote.CheckReference(q, *refPath)
+
+		if err != nil {
+			return err
+		}
+
+		for _, c := range unknown {
+			log.Printf("unknown component %s", c)
+		}
+	}
+
+	log.Printf("device %s PCR %s verified", q.Device, q.PCR)
+
+	return
+}
+
+// must match audit.go
+const auditGenesis = "tamago-example audit log"
+
+// verifyAudit checks the audit log hash chain, and that it includes a
+// previously exported head, if any. Entry MACs can only be verified on the
+// device (see the `audit verify` console command).
+func verifyAudit(buf []byte, anchor string) (err error) {
+	var n uint64
+
+	h := sha256.Sum256([]byte(auditGenesis))
+	head := hex.EncodeToString(h[:])
+	found := anchor == "" || anchor == head
+
+	for _, line := range bytes.Split(bytes.TrimSuffix(buf, []byte("\n")), []byte("\n")) {
+		var e struct {
+			Sequence uint64 `json:"seq"`
+			Previous string `json:"prev"`
+		}
+
+		if len(line) == 0 {
+			break
+		}
+
+		n++
+
+		if err = json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("entry %d malformed, %v", n, err)
+		}
+
+		if e.Sequence != n || e.Previous != head {
+			return fmt.Errorf("entry %d breaks the hash chain", n)
+		}
+
+		h = sha256.Sum256(line)
+		head = hex.EncodeToString(h[:])
+
+		if head == anchor {
+			found = true
+		}
+	}
+
+	if !found {
+		return errors.New("previous head not found, entries were removed")
+	}
+
+	log.Printf("%d entries, head %s", n, head)
+
+	return
+}
+
+var errUsage = errors.New("invalid arguments")
+
+// httpCommand executes a command over the HTTP API.
+func httpCommand(args []string) (buf []byte, err error) {
+	switch args[0] {
+	case "tests":
+		return request(http.MethodGet, "/api/tests", nil, nil)
+	case "run":
+		q := url.Values{}
+
+		if len(args) > 1 {
+			q.Set("include", args[1])
+		}
+
+		if len(args) > 2 {
+			q.Set("exclude", args[2])
+		}
+
+		return request(http.MethodPost, "/api/tests", q, nil)
+	case "results":
+		return request(http.MethodGet, "/api/results", nil, nil)
+	case "log":
+		return request(http.MethodGet, "/api/log", nil, nil)
+	case "audit":
+		var anchor string
+
+		if len(args) > 1 {
+			anchor = args[1]
+		}
+
+		if buf, err = request(http.MethodGet, "/api/audit", nil, nil); err != nil {
+			return
+		}
+
+		return buf, verifyAudit(buf, anchor)
+	case "measurements":
+		return request(http.MethodGet, "/measurements", nil, nil)
+	case "quote":
+		return nil, verifyQuote()
+	case "csr":
+		return request(http.MethodGet, "/provision/csr", nil, nil)
+	case "cert":
+		if len(args) != 2 {
+			return nil, errUsage
+		}
+
+		cert, err := ioutil.ReadFile(args[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		return request(http.MethodPost, "/provision/cert", nil, bytes.NewReader(cert))
+	case "push":
+		if len(args) != 3 {
+			return nil, errUsage
+		}
+
+		image, err := ioutil.ReadFile(args[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := ioutil.ReadFile(args[2])
+
+		if err != nil {
+			return nil, err
+		}
+
+		q := url.Values{}
+		q.Set("sig", base64.StdEncoding.EncodeToString(sig))
+
+		return request(http.MethodPost, "/api/firmware", q, bytes.NewReader(image))
+	case "reboot":
+		return request(http.MethodPost, "/reboot", nil, nil)
+	case "console":
+		return nil, errors.New("only supported over USB")
+	}
+
+	return nil, errUsage
+}
+
+// usbCommand executes a command over the USB RPC interface.
+func usbCommand(args []string) (buf []byte, err error) {
+	switch args[0] {
+	case "tests", "run", "results", "log", "reboot", "console":
+	case "measurements", "quote", "csr", "cert", "audit", "push":
+		return nil, errors.New("not supported over USB")
+	default:
+		return nil, errUsage
+	}
+
+	dev, err := usbrpc.Open()
+
+	if err != nil {
+		return
+	}
+	defer dev.Close()
+
+	c := usbrpc.NewClient(dev)
+
+	switch args[0] {
+	case "run", "console":
+		return c.Call(args[0], []byte(strings.Join(args[1:], " ")))
+	case "reboot":
+		return c.Call("console", []byte("reboot"))
+	}
+
+	return c.Call(args[0], nil)
+}
+
+func main() {
+	var buf []byte
+	var err error
+
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	log.SetFlags(0)
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	args := flag.Args()
+
+	if *useUSB {
+		buf, err = usbCommand(args)
+	} else {
+		buf, err = httpCommand(args)
+	}
+
+	if err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+
+	switch args[0] {
+	case "run", "results":
+		failed, err := printReport(buf)
+
+		if err != nil {
+			log.Fatalf("%s: %v", args[0], err)
+		}
+
+		if failed > 0 {
+			os.Exit(1)
+		}
+	default:
+		os.Stdout.Write(buf)
+	}
+}
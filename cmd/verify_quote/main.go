@@ -0,0 +1,87 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// The verify_quote command requests a platform quote from the example
+// firmware, with a fresh nonce, and verifies its signature and measurement
+// log.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/f-secure-foundry/tamago-example/internal/quote"
+)
+
+func main() {
+	var err error
+
+	endpoint := flag.String("url", "http://10.0.0.1/attest", "attestation endpoint")
+	keyPath := flag.String("key", "", "trusted attestation public key (PEM)")
+	expected := flag.String("pcr", "", "expected PCR value (hex)")
+	refPath := flag.String("reference", "", "known good component digests (JSON)")
+	flag.Parse()
+
+	log.SetFlags(0)
+
+	nonce := make([]byte, 32)
+
+	if _, err = rand.Read(nonce); err != nil {
+		log.Fatal(err)
+	}
+
+	q, err := quote.Fetch(*endpoint, nonce)
+
+	if err != nil {
+		log.Fatalf("could not fetch quote, %v", err)
+	}
+
+	pub := []byte(q.PublicKey)
+
+	if *keyPath != "" {
+		if pub, err = ioutil.ReadFile(*keyPath); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Printf("WARNING: no trusted key, using the quoted one:\n%s", q.PublicKey)
+	}
+
+	key, err := quote.ParsePublicKey(pub)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = quote.Verify(q, key, nonce); err != nil {
+		log.Fatalf("verification failed, %v", err)
+	}
+
+	for i, e := range q.Events {
+		log.Printf("%3d %s %s", i, e.Digest, e.Component)
+	}
+
+	if *expected != "" && *expected != q.PCR {
+		log.Fatalf("PCR mismatch (%s != %s)", q.PCR, *expected)
+	}
+
+	if *refPath != "" {
+		unknown, err := quote.CheckReference(q, *refPath)
+
+		if err != nil {
+			log.Fatalf("reference check failed, %v", err)
+		}
+
+		for _, c := range unknown {
+			log.Printf("unknown component %s", c)
+		}
+	}
+
+	log.Printf("device %s PCR %s verified", q.Device, q.PCR)
+}
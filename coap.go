@@ -0,0 +1,457 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/f-secure-foundry/tamago-example/internal/coap"
+)
+
+// The CoAP server (RFC 7252) exposes device resources to constrained IoT
+// ecosystems, resources marked as observable accept Observe (RFC 7641)
+// registrations and notify their state every `coap_interval` seconds, or on
+// change:
+//
+//	/.well-known/core  resource discovery (CoRE Link Format)
+//	/status            device status (JSON, observable)
+//	/temp              SoC die temperature in °C (observable)
+//	/led               LED states (JSON, observable), set with PUT
+//	                   `<name>=<on|off>` when `coap_led` is set
+//
+// Notifications are non-confirmable, except one in COAP_CON_EVERY which is
+// confirmable to verify that the observer is still interested, observers
+// which do not acknowledge it, or reset a notification, are removed.
+const (
+	COAP_MAX_OBSERVERS = 16
+	COAP_CON_EVERY     = 10
+	COAP_MAX_MESSAGE   = 1152
+)
+
+var coapLEDs = []string{"white", "blue"}
+
+var coapLog = newLogger("coap")
+
+var coapInstance *coapServer
+
+// coapResource represents a CoAP resource.
+type coapResource struct {
+	path       string
+	attributes string
+	observable bool
+	get        func() (format uint32, payload []byte, code uint8)
+	put        func(payload []byte) (code uint8)
+}
+
+// coapObserver represents an Observe registration.
+type coapObserver struct {
+	peer  net.Addr
+	token []byte
+	path  string
+
+	notifications int
+	// last notification message ID
+	mid uint16
+	// unacknowledged confirmable notification message ID
+	con     uint16
+	pending bool
+}
+
+// coapServer represents the CoAP server state.
+type coapServer struct {
+	sync.Mutex
+
+	conn      *gonet.UDPConn
+	resources map[string]*coapResource
+	observers map[string]*coapObserver
+
+	mid uint16
+	seq uint32
+	led map[string]bool
+}
+
+func coapStatus() (uint32, []byte, uint8) {
+	var m runtime.MemStats
+
+	runtime.ReadMemStats(&m)
+
+	status := map[string]interface{}{
+		"revision": Revision,
+		"uptime":   int64(time.Duration(time.Now().UnixNano()) / time.Second),
+		"heap":     m.HeapAlloc,
+	}
+
+	if r := lastReport; r != nil {
+		status["passed"] = r.Passed
+		status["failed"] = r.Failed
+	}
+
+	buf, _ := json.Marshal(status)
+
+	return coap.ApplicationJSON, buf, coap.Content
+}
+
+func coapTemperature() (uint32, []byte, uint8) {
+	t, err := temperature()
+
+	if err != nil {
+		return coap.TextPlain, []byte(err.Error()), coap.InternalServerError
+	}
+
+	return coap.TextPlain, []byte(fmt.Sprintf("%.1f", t)), coap.Content
+}
+
+func (c *coapServer) getLED() (uint32, []byte, uint8) {
+	state := make(map[string]string)
+
+	c.Lock()
+	for _, name := range coapLEDs {
+		state[name] = "off"
+
+		if c.led[name] {
+			state[name] = "on"
+		}
+	}
+	c.Unlock()
+
+	buf, _ := json.Marshal(state)
+
+	return coap.ApplicationJSON, buf, coap.Content
+}
+
+func (c *coapServer) putLED(payload []byte) uint8 {
+	if !conf.Bool("coap_led", false) {
+		return coap.MethodNotAllowed
+	}
+
+	kv := strings.SplitN(string(payload), "=", 2)
+
+	if len(kv) != 2 || (kv[1] != "on" && kv[1] != "off") {
+		return coap.BadRequest
+	}
+
+	on := kv[1] == "on"
+
+	if err := target.LED(kv[0], on); err != nil {
+		return coap.BadRequest
+	}
+
+	c.Lock()
+	c.led[kv[0]] = on
+	c.Unlock()
+
+	go c.notify("/led")
+
+	return coap.Changed
+}
+
+func (c *coapServer) wellKnownCore() (uint32, []byte, uint8) {
+	var links []string
+
+	for _, r := range c.resources {
+		if r.attributes == "" {
+			continue
+		}
+
+		link := fmt.Sprintf("<%s>;%s", r.path, r.attributes)
+
+		if r.observable {
+			link += ";obs"
+		}
+
+		links = append(links, link)
+	}
+
+	sort.Strings(links)
+
+	return coap.LinkFormat, []byte(strings.Join(links, ",")), coap.Content
+}
+
+// nextMID returns a new message ID, the caller must hold the lock.
+func (c *coapServer) nextMID() uint16 {
+	c.mid++
+	return c.mid
+}
+
+func (c *coapServer) send(m *coap.Message, peer net.Addr) {
+	buf, err := m.Marshal()
+
+	if err != nil {
+		coapLog.Warnf("encoding error, %v", err)
+		return
+	}
+
+	if _, err = c.conn.WriteTo(buf, peer); err != nil {
+		coapLog.Debugf("write error, %v", err)
+	}
+}
+
+// represent fills a response with a resource representation.
+func represent(res *coap.Message, format uint32, payload []byte, code uint8) {
+	res.Code = code
+	res.AddUint(coap.ContentFormat, format)
+	res.Payload = payload
+
+	if len(payload) > COAP_MAX_MESSAGE {
+		res.Code = coap.InternalServerError
+		res.Payload = nil
+	}
+}
+
+// notify sends the current representation of a resource to its observers.
+func (c *coapServer) notify(path string) {
+	r, ok := c.resources[path]
+
+	if !ok {
+		return
+	}
+
+	format, payload, code := r.get()
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.seq = (c.seq + 1) & 0xffffff
+
+	for key, o := range c.observers {
+		if o.path != path {
+			continue
+		}
+
+		o.notifications++
+
+		typ := uint8(coap.NonConfirmable)
+
+		if o.notifications%COAP_CON_EVERY == 0 {
+			if o.pending {
+				coapLog.Infof("removing unresponsive observer %s", o.peer)
+				delete(c.observers, key)
+				continue
+			}
+
+			typ = coap.Confirmable
+			o.pending = true
+		}
+
+		o.mid = c.nextMID()
+
+		if typ == coap.Confirmable {
+			o.con = o.mid
+		}
+
+		res := &coap.Message{
+			Type:      typ,
+			MessageID: o.mid,
+			Token:     o.token,
+		}
+
+		res.AddUint(coap.Observe, c.seq)
+		represent(res, format, payload, code)
+		c.send(res, o.peer)
+	}
+}
+
+// observe handles the Observe option of a GET request, returning whether
+// the observer is registered.
+func (c *coapServer) observe(req *coap.Message, peer net.Addr, r *coapResource) bool {
+	action, ok := req.GetUint(coap.Observe)
+
+	if !ok || !r.observable {
+		return false
+	}
+
+	key := fmt.Sprintf("%s/%x", peer, req.Token)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if action == 1 {
+		delete(c.observers, key)
+		return false
+	}
+
+	if _, ok := c.observers[key]; !ok && len(c.observers) >= COAP_MAX_OBSERVERS {
+		return false
+	}
+
+	c.observers[key] = &coapObserver{
+		peer:  peer,
+		token: req.Token,
+		path:  r.path,
+	}
+
+	return true
+}
+
+// handleEmpty processes acknowledgements and resets of notifications.
+func (c *coapServer) handleEmpty(m *coap.Message, peer net.Addr) {
+	c.Lock()
+	defer c.Unlock()
+
+	for key, o := range c.observers {
+		if o.peer.String() != peer.String() {
+			continue
+		}
+
+		switch {
+		case m.Type == coap.Acknowledgement && o.pending && m.MessageID == o.con:
+			o.pending = false
+		case m.Type == coap.Reset && (m.MessageID == o.mid || m.MessageID == o.con):
+			delete(c.observers, key)
+		}
+	}
+}
+
+func (c *coapServer) handle(req *coap.Message, peer net.Addr) {
+	if req.Code == coap.Empty {
+		if req.Type == coap.Confirmable {
+			// CoAP ping
+			c.send(&coap.Message{Type: coap.Reset, MessageID: req.MessageID}, peer)
+		} else {
+			c.handleEmpty(req, peer)
+		}
+
+		return
+	}
+
+	if !req.IsRequest() || req.Type > coap.NonConfirmable {
+		return
+	}
+
+	res := &coap.Message{
+		Type:      coap.Acknowledgement,
+		MessageID: req.MessageID,
+		Token:     req.Token,
+	}
+
+	if req.Type == coap.NonConfirmable {
+		c.Lock()
+		res.Type = coap.NonConfirmable
+		res.MessageID = c.nextMID()
+		c.Unlock()
+	}
+
+	r, ok := c.resources[req.Path()]
+
+	switch {
+	case !ok:
+		res.Code = coap.NotFound
+	case req.Code == coap.GET:
+		if c.observe(req, peer, r) {
+			c.Lock()
+			res.AddUint(coap.Observe, c.seq)
+			c.Unlock()
+		}
+
+		format, payload, code := r.get()
+		represent(res, format, payload, code)
+	case req.Code == coap.PUT && r.put != nil:
+		res.Code = r.put(req.Payload)
+	default:
+		res.Code = coap.MethodNotAllowed
+	}
+
+	coapLog.Debugf("%s %s %s -> %s", peer, coap.CodeString(req.Code), req.Path(), coap.CodeString(res.Code))
+
+	c.send(res, peer)
+}
+
+func startCoAPServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	conn, err := gonet.DialUDP(s, &fullAddr, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		coapLog.Fatalf("CoAP endpoint error, %v", err)
+	}
+
+	interval := time.Duration(conf.Int("coap_interval", 10)) * time.Second
+
+	if interval <= 0 {
+		coapLog.Errorf("disabled, invalid coap_interval")
+		return
+	}
+
+	c := &coapServer{
+		conn:      conn,
+		observers: make(map[string]*coapObserver),
+		led:       make(map[string]bool),
+	}
+
+	c.resources = map[string]*coapResource{
+		"/.well-known/core": {path: "/.well-known/core", get: c.wellKnownCore},
+		"/status":           {path: "/status", attributes: `rt="status";ct=50`, observable: true, get: coapStatus},
+		"/temp":             {path: "/temp", attributes: `rt="temperature-c";ct=0`, observable: true, get: coapTemperature},
+		"/led":              {path: "/led", attributes: `rt="led";ct=50`, observable: true, get: c.getLED, put: c.putLED},
+	}
+
+	coapInstance = c
+
+	coapLog.Infof("starting CoAP server at %s:%d", addr.String(), port)
+
+	go func() {
+		for range time.Tick(interval) {
+			c.notify("/status")
+			c.notify("/temp")
+		}
+	}()
+
+	buf := make([]byte, MTU)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			coapLog.Warnf("read error, %v", err)
+			continue
+		}
+
+		req, err := coap.Unmarshal(buf[:n])
+
+		if err != nil {
+			coapLog.Debugf("invalid message from %s, %v", peer, err)
+			continue
+		}
+
+		c.handle(req, peer)
+	}
+}
+
+func coapCommand() string {
+	c := coapInstance
+
+	if c == nil {
+		return "disabled (coap_port not set)"
+	}
+
+	var buf strings.Builder
+
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(&buf, "port: %d, LED control: %v, observers: %d (max %d)",
+		conf.Int("coap_port", 0), conf.Bool("coap_led", false), len(c.observers), COAP_MAX_OBSERVERS)
+
+	for _, o := range c.observers {
+		fmt.Fprintf(&buf, "\n  %s %s (%d notifications)", o.peer, o.path, o.notifications)
+	}
+
+	return buf.String()
+}
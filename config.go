@@ -0,0 +1,200 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// The example configuration is a text file of `key=value` lines, blank lines
+// and lines starting with `#` are ignored. The first line must match
+// CONFIG_MAGIC to distinguish a valid configuration from random memory or
+// card contents.
+//
+// The configuration is first searched at CONFIG_ADDR, where it can be loaded
+// by the bootloader or QEMU, and then, on native runs only, at CONFIG_OFFSET
+// on the first memory card. CONFIG_ADDR lies below the executable (see
+// TEXT_START in the Makefile), in a region reserved to it so that it is never
+// part of the Go heap.
+const (
+	CONFIG_MAGIC    = "#tamago-example"
+	CONFIG_ADDR     = 0x80010000
+	CONFIG_OFFSET   = 0x400000
+	CONFIG_MAX_SIZE = 4096
+)
+
+// Config represents the example configuration settings.
+type Config map[string]string
+
+// example configuration, see loadConfig()
+var conf = Config{}
+
+var configLog = newLogger("config")
+
+// configuration source, for reporting purposes
+var confSource = "defaults"
+
+func parseConfig(buf []byte) (c Config, err error) {
+	if len(buf) > CONFIG_MAX_SIZE {
+		buf = buf[:CONFIG_MAX_SIZE]
+	}
+
+	// the configuration ends at the first NUL or erased (0xff) byte
+	if i := bytes.IndexAny(buf, "\x00\xff"); i >= 0 {
+		buf = buf[:i]
+	}
+
+	if !bytes.HasPrefix(buf, []byte(CONFIG_MAGIC)) {
+		return nil, errors.New("missing configuration magic")
+	}
+
+	c = Config{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid line %d (%s)", n, line)
+		}
+
+		c[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return c, scanner.Err()
+}
+
+func readConfigMemory() []byte {
+	buf := make([]byte, CONFIG_MAX_SIZE)
+
+	for i := range buf {
+		buf[i] = *(*byte)(unsafe.Pointer(uintptr(CONFIG_ADDR) + uintptr(i)))
+	}
+
+	return buf
+}
+
+func readConfigCard() (buf []byte, err error) {
+	if !imx6.Native || len(cards) == 0 {
+		return nil, errors.New("no card available")
+	}
+
+	card := cards[0]
+
+	if err = card.Detect(); err != nil {
+		return
+	}
+
+	return card.Read(CONFIG_OFFSET, CONFIG_MAX_SIZE)
+}
+
+// loadConfig searches and parses the example configuration, leaving defaults
+// in place when none is found.
+func loadConfig() {
+	if c, err := parseConfig(readConfigMemory()); err == nil {
+		conf = c
+		confSource = fmt.Sprintf("memory@%#x", uint32(CONFIG_ADDR))
+		return
+	}
+
+	buf, err := readConfigCard()
+
+	if err != nil {
+		return
+	}
+
+	c, err := parseConfig(buf)
+
+	if err != nil {
+		return
+	}
+
+	conf = c
+	confSource = fmt.Sprintf("card@%#x", CONFIG_OFFSET)
+}
+
+// String returns the value for the argument key, or def when not set.
+func (c Config) String(key string, def string) string {
+	if val, ok := c[key]; ok {
+		return val
+	}
+
+	return def
+}
+
+// Bool returns the boolean value for the argument key, or def when not set
+// or invalid.
+func (c Config) Bool(key string, def bool) bool {
+	val, ok := c[key]
+
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(val)
+
+	if err != nil {
+		configLog.Warnf("invalid %s value (%s), using %v", key, val, def)
+		return def
+	}
+
+	return b
+}
+
+// Int returns the integer value for the argument key, or def when not set or
+// invalid. Values can be expressed in any base accepted by
+// strconv.ParseInt().
+func (c Config) Int(key string, def int) int {
+	val, ok := c[key]
+
+	if !ok {
+		return def
+	}
+
+	i, err := strconv.ParseInt(val, 0, 64)
+
+	if err != nil {
+		configLog.Warnf("invalid %s value (%s), using %d", key, val, def)
+		return def
+	}
+
+	return int(i)
+}
+
+// List returns the comma separated values for the argument key, or def when
+// not set.
+func (c Config) List(key string, def []string) (list []string) {
+	val, ok := c[key]
+
+	if !ok {
+		return def
+	}
+
+	for _, s := range strings.Split(val, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			list = append(list, s)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,247 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The imx6 package drives the debug console UART by polling, waiting for the
+// transmitter to empty after each character: writers are stalled for the
+// time required to shift out their output (about 87us per character at
+// 115200 baud) and input received while the console is busy is lost once
+// the receive FIFO fills.
+//
+// The console UART is therefore serviced by a goroutine which, as interrupts
+// are not serviced (see sdma.go), stands in for the UART interrupt handler:
+// it checks the conditions signalled by the transmitter and receiver ready
+// interrupts, moving data between the FIFOs and ring buffers. Writers only
+// copy their output to the transmit buffer, output exceeding it is dropped
+// rather than stalling them, while input is buffered until read.
+//
+// Runtime output (e.g. panics) bypasses the buffers, pending output is
+// flushed on reboot.
+const (
+	CONSOLE_TX_BUFFER = 64 * 1024
+	CONSOLE_RX_BUFFER = 4 * 1024
+	// time allowed to flush pending output on reboot
+	CONSOLE_FLUSH_TIMEOUT = 2 * time.Second
+
+	UARTx_URXD   = 0x0000
+	URXD_CHARRDY = 15
+	URXD_ERR     = 14
+	URXD_OVRRUN  = 13
+
+	UARTx_UTXD = 0x0040
+
+	UARTx_USR2 = 0x0098
+	USR2_RDR   = 0
+
+	UARTx_UTS   = 0x00b4
+	UTS_TXEMPTY = 6
+	UTS_TXFULL  = 4
+)
+
+// ring is a byte ring buffer.
+type ring struct {
+	buf  []byte
+	head int
+	size int
+}
+
+// write copies as much data as fits, returning the number of bytes copied.
+func (r *ring) write(p []byte) (n int) {
+	for n < len(p) && r.size < len(r.buf) {
+		tail := (r.head + r.size) % len(r.buf)
+		end := len(r.buf)
+
+		if tail < r.head {
+			end = r.head
+		}
+
+		c := copy(r.buf[tail:end], p[n:])
+		n += c
+		r.size += c
+	}
+
+	return
+}
+
+// read moves up to len(p) bytes out of the buffer.
+func (r *ring) read(p []byte) (n int) {
+	for n < len(p) && r.size > 0 {
+		end := r.head + r.size
+
+		if end > len(r.buf) {
+			end = len(r.buf)
+		}
+
+		c := copy(p[n:], r.buf[r.head:end])
+		n += c
+		r.head = (r.head + c) % len(r.buf)
+		r.size -= c
+	}
+
+	return
+}
+
+// uartConsole implements buffered I/O on the debug console UART.
+type uartConsole struct {
+	sync.Mutex
+
+	base uint32
+
+	tx ring
+	rx ring
+
+	txBytes   uint64
+	txDropped uint64
+	rxBytes   uint64
+	rxDropped uint64
+	// receive FIFO overruns and framing/parity errors
+	rxOverruns uint64
+	rxErrors   uint64
+}
+
+// Console is the buffered debug console, when enabled.
+var Console *uartConsole
+
+// consoleOutput is the destination of console output (logs and results),
+// the buffered console when enabled.
+var consoleOutput io.Writer = os.Stdout
+
+// startConsole starts servicing the debug console UART with buffered I/O.
+func startConsole(uart *imx6.UART) *uartConsole {
+	var base uint32
+
+	switch uart {
+	case imx6.UART1:
+		base = imx6.UART1_BASE
+	case imx6.UART2:
+		base = imx6.UART2_BASE
+	default:
+		return nil
+	}
+
+	c := &uartConsole{
+		base: base,
+		tx:   ring{buf: make([]byte, CONSOLE_TX_BUFFER)},
+		rx:   ring{buf: make([]byte, CONSOLE_RX_BUFFER)},
+	}
+
+	go func() {
+		for {
+			c.service()
+			runtime.Gosched()
+		}
+	}()
+
+	return c
+}
+
+// service fills the transmit FIFO and drains the receive one.
+func (c *uartConsole) service() {
+	var b [1]byte
+
+	c.Lock()
+	defer c.Unlock()
+
+	for c.tx.size > 0 && reg.Get(c.base+UARTx_UTS, UTS_TXFULL, 1) == 0 {
+		c.tx.read(b[:])
+		reg.Write(c.base+UARTx_UTXD, uint32(b[0]))
+		c.txBytes += 1
+	}
+
+	for reg.Get(c.base+UARTx_USR2, USR2_RDR, 1) == 1 {
+		urxd := reg.Read(c.base + UARTx_URXD)
+
+		if (urxd>>URXD_OVRRUN)&1 == 1 {
+			c.rxOverruns += 1
+		}
+
+		if (urxd>>URXD_ERR)&1 == 1 {
+			c.rxErrors += 1
+			continue
+		}
+
+		b[0] = byte(urxd)
+
+		if c.rx.write(b[:]) == 0 {
+			c.rxDropped += 1
+			continue
+		}
+
+		c.rxBytes += 1
+	}
+}
+
+// Write implements io.Writer, it never blocks as output exceeding the
+// transmit buffer is dropped.
+func (c *uartConsole) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if n := c.tx.write(p); n < len(p) {
+		c.txDropped += uint64(len(p) - n)
+	}
+
+	return len(p), nil
+}
+
+// Read moves buffered input, without blocking, returning the number of bytes
+// read.
+func (c *uartConsole) Read(p []byte) (n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.rx.read(p)
+}
+
+// Flush waits for pending output to be transmitted, up to the argument
+// timeout.
+func (c *uartConsole) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		c.Lock()
+		pending := c.tx.size > 0 || reg.Get(c.base+UARTx_UTS, UTS_TXEMPTY, 1) == 0
+		c.Unlock()
+
+		if !pending {
+			return
+		}
+
+		runtime.Gosched()
+	}
+}
+
+func (c *uartConsole) String() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return fmt.Sprintf("tx: %d bytes, %d pending, %d dropped\nrx: %d bytes, %d pending, %d dropped, %d FIFO overruns, %d errors",
+		c.txBytes, c.tx.size, c.txDropped, c.rxBytes, c.rx.size, c.rxDropped, c.rxOverruns, c.rxErrors)
+}
+
+func consoleCommand() string {
+	if Console == nil {
+		return "buffered console not enabled"
+	}
+
+	return Console.String()
+}
@@ -0,0 +1,335 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// The constant time smoke test applies, in the fashion of dudect, Welch's
+// t-test to execution times of operations on two classes of crafted inputs
+// (e.g. equal buffers against buffers differing at the first byte), randomly
+// interleaved to cancel drift. A t statistic above CT_THRESHOLD flags gross
+// non-constant time behavior, it is not meant to prove its absence.
+//
+// Reference checks on operations which are known to leak (e.g. bytes.Equal)
+// are expected to be flagged, showing that the measurement is sensitive
+// enough on the current target.
+const (
+	// measurements above this percentile are discarded as interference
+	CT_CROP_PERCENTILE = 90
+	CT_THRESHOLD       = 10
+	// comparison buffers size, a difference at the first byte makes an
+	// early exit apparent
+	CT_COMPARE_SIZE = 4096
+
+	CT_DCP_KEY_SLOT = 3
+)
+
+var consttimeLog = newLogger("consttime")
+
+type ctCheck struct {
+	name      string
+	supported bool
+	// leaky reference operations are expected to be flagged
+	reference bool
+	// operations executed for each sample
+	batch int
+	// samples divisor for slow operations
+	slow int
+	// op returns the operation on the argument class inputs
+	op func() (func(class int), error)
+}
+
+func ctChecks() []ctCheck {
+	return []ctCheck{
+		{name: "bytes.Equal", supported: true, reference: true, batch: 16, slow: 1, op: ctBytesEqual},
+		{name: "subtle.ConstantTimeCompare", supported: true, batch: 16, slow: 1, op: ctSubtleCompare},
+		{name: "hmac.Equal", supported: true, batch: 16, slow: 1, op: ctHMACEqual},
+		{name: "AES-128-GCM open", supported: true, batch: 4, slow: 1, op: ctGCMOpen},
+		{name: "ECDSA P-256 sign", supported: true, batch: 1, slow: 20, op: ctECDSASign},
+		{name: "DCP AES-128-CBC", supported: target.DCP(), batch: 4, slow: 1, op: ctDCP},
+	}
+}
+
+// ctCompareInputs returns a buffer, an equal copy and a copy differing at the
+// first byte.
+func ctCompareInputs() (a []byte, b [2][]byte) {
+	a = make([]byte, CT_COMPARE_SIZE)
+	rand.Read(a)
+
+	b[0] = append([]byte{}, a...)
+	b[1] = append([]byte{}, a...)
+	b[1][0] ^= 0xff
+
+	return
+}
+
+func ctBytesEqual() (func(int), error) {
+	a, b := ctCompareInputs()
+
+	return func(class int) {
+		bytes.Equal(a, b[class])
+	}, nil
+}
+
+func ctSubtleCompare() (func(int), error) {
+	a, b := ctCompareInputs()
+
+	return func(class int) {
+		subtle.ConstantTimeCompare(a, b[class])
+	}, nil
+}
+
+func ctHMACEqual() (func(int), error) {
+	a, b := ctCompareInputs()
+
+	return func(class int) {
+		hmac.Equal(a, b[class])
+	}, nil
+}
+
+// ctGCMOpen compares the rejection of ciphertexts with a tag differing at the
+// first or last byte.
+func ctGCMOpen() (func(int), error) {
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	ct := aead.Seal(nil, nonce, make([]byte, 64), nil)
+
+	var tampered [2][]byte
+
+	for i, off := range []int{len(ct) - aead.Overhead(), len(ct) - 1} {
+		tampered[i] = append([]byte{}, ct...)
+		tampered[i][off] ^= 0xff
+	}
+
+	buf := make([]byte, 0, len(ct))
+
+	return func(class int) {
+		aead.Open(buf, nonce, tampered[class], nil)
+	}, nil
+}
+
+// ctECDSASign compares signing with a low Hamming weight private key
+// against a random one.
+func ctECDSASign() (func(int), error) {
+	curve := elliptic.P256()
+
+	random, err := ecdsa.GenerateKey(curve, rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	low := &ecdsa.PrivateKey{D: big.NewInt(3)}
+	low.PublicKey.Curve = curve
+	low.PublicKey.X, low.PublicKey.Y = curve.ScalarBaseMult(low.D.Bytes())
+
+	keys := [2]*ecdsa.PrivateKey{low, random}
+	digest := make([]byte, 32)
+
+	return func(class int) {
+		ecdsa.Sign(rand.Reader, keys[class], digest)
+	}, nil
+}
+
+// ctDCP compares hardware encryption of all zeros against random
+// plaintexts.
+func ctDCP() (func(int), error) {
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	imx6.DCP.Init()
+
+	if err := imx6.DCP.SetKey(CT_DCP_KEY_SLOT, key); err != nil {
+		return nil, err
+	}
+
+	var pt [2][]byte
+
+	pt[0] = make([]byte, 256)
+	pt[1] = make([]byte, 256)
+	rand.Read(pt[1])
+
+	iv := make([]byte, aes.BlockSize)
+	buf := make([]byte, 256)
+
+	return func(class int) {
+		copy(buf, pt[class])
+		imx6.DCP.Encrypt(buf, CT_DCP_KEY_SLOT, iv)
+	}, nil
+}
+
+// welch returns the t statistic between two sample sets.
+func welch(a []float64, b []float64) float64 {
+	moments := func(s []float64) (mean float64, variance float64) {
+		for _, x := range s {
+			mean += x
+		}
+
+		mean /= float64(len(s))
+
+		for _, x := range s {
+			variance += (x - mean) * (x - mean)
+		}
+
+		variance /= float64(len(s) - 1)
+
+		return
+	}
+
+	ma, va := moments(a)
+	mb, vb := moments(b)
+
+	return (ma - mb) / math.Sqrt(va/float64(len(a))+vb/float64(len(b)))
+}
+
+// measureCT returns the t statistic and mean sample durations for the two
+// input classes.
+func measureCT(op func(int), samples int, batch int) (t float64, mean [2]time.Duration, err error) {
+	type sample struct {
+		class int
+		d     time.Duration
+	}
+
+	all := make([]sample, samples)
+
+	// warm up caches and branch predictors
+	for i := 0; i < batch; i++ {
+		op(i % 2)
+	}
+
+	for i := range all {
+		class := mathrand.Intn(2)
+		start := time.Now()
+
+		for j := 0; j < batch; j++ {
+			op(class)
+		}
+
+		all[i] = sample{class, time.Since(start)}
+	}
+
+	sorted := make([]time.Duration, len(all))
+
+	for i, s := range all {
+		sorted[i] = s.d
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	crop := sorted[len(sorted)*CT_CROP_PERCENTILE/100]
+
+	var classes [2][]float64
+
+	for _, s := range all {
+		if s.d > crop {
+			continue
+		}
+
+		classes[s.class] = append(classes[s.class], float64(s.d))
+	}
+
+	for i, c := range classes {
+		if len(c) < 2 {
+			return 0, mean, fmt.Errorf("not enough samples for class %d", i)
+		}
+
+		var sum float64
+
+		for _, x := range c {
+			sum += x
+		}
+
+		mean[i] = time.Duration(sum / float64(len(c)))
+	}
+
+	t = welch(classes[0], classes[1])
+
+	return
+}
+
+// TestConstantTime measures execution time variance of comparisons, signing
+// and hardware encryption over crafted inputs, failing on gross
+// non-constant time behavior.
+func TestConstantTime() (err error) {
+	var leaky []string
+
+	samples := conf.Int("consttime_samples", 10000)
+
+	consttimeLog.Infof("%d samples per check, threshold |t| > %d", samples, CT_THRESHOLD)
+
+	for _, c := range ctChecks() {
+		if !c.supported {
+			continue
+		}
+
+		op, err := c.op()
+
+		if err != nil {
+			return fmt.Errorf("%s, %v", c.name, err)
+		}
+
+		t, mean, err := measureCT(op, samples/c.slow, c.batch)
+
+		if err != nil {
+			return fmt.Errorf("%s, %v", c.name, err)
+		}
+
+		flagged := math.Abs(t) > CT_THRESHOLD
+		status := "ok"
+
+		switch {
+		case c.reference && flagged:
+			status = "leak detected (reference)"
+		case c.reference:
+			status = "leak NOT detected (reference), low sensitivity"
+		case flagged:
+			status = "NON-CONSTANT TIME"
+			leaky = append(leaky, c.name)
+		}
+
+		consttimeLog.Infof("%-26s t %8.2f, means %v/%v per %d ops, %s", c.name, t, mean[0], mean[1], c.batch, status)
+	}
+
+	if len(leaky) > 0 {
+		return fmt.Errorf("non-constant time behavior (%s)", strings.Join(leaky, ", "))
+	}
+
+	return
+}
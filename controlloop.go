@@ -0,0 +1,118 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// The control loop example runs a fixed rate periodic task, toggling a board
+// LED GPIO, scheduled against absolute deadlines so that jitter does not
+// accumulate into drift.
+//
+// The guarantees which can be offered to such a task are limited, as tamago
+// runs goroutines on a single core without priorities nor asynchronous
+// preemption (IRQs are not serviced, see sdma.go): the loop goroutine is only
+// resumed once its timer expires and the running goroutine yields, at a
+// blocking operation or function call preemption point, and it is delayed by
+// garbage collection stop-the-world phases and assists. The deadline can
+// therefore be met on average, with jitter bounded only by the longest
+// non-yielding section of the other goroutines and by GC pauses, while a
+// missed deadline is recovered by skipping the overrun periods rather than
+// by running late ones back to back.
+
+var controlloopLog = newLogger("controlloop")
+
+// controlLoopStats holds the results of a control loop run.
+type controlLoopStats struct {
+	// lateness of each activation with respect to its deadline
+	jitter irqLatency
+	// skipped periods
+	overruns int
+}
+
+// controlLoop runs the argument task at a fixed period until the argument
+// duration has elapsed.
+func controlLoop(period time.Duration, duration time.Duration, task func()) (s *controlLoopStats) {
+	s = &controlLoopStats{}
+
+	start := time.Now()
+	deadline := start.Add(period)
+	end := start.Add(duration)
+
+	for deadline.Before(end) {
+		time.Sleep(time.Until(deadline))
+
+		now := time.Now()
+		task()
+
+		s.jitter = append(s.jitter, now.Sub(deadline))
+		deadline = deadline.Add(period)
+
+		// skip missed deadlines
+		if late := now.Sub(deadline); late >= 0 {
+			missed := int(late/period) + 1
+			s.overruns += missed
+			deadline = deadline.Add(time.Duration(missed) * period)
+		}
+	}
+
+	return
+}
+
+// TestControlLoop runs the control loop idle and under allocation and CPU
+// load (see irqlatency.go), reporting activation jitter.
+func TestControlLoop() (err error) {
+	rate := conf.Int("loop_rate", 1000)
+	duration := time.Duration(conf.Int("loop_duration", 5)) * time.Second
+	load := conf.Int("loop_load", 4)
+
+	if rate <= 0 {
+		return fmt.Errorf("invalid rate %d", rate)
+	}
+
+	period := time.Second / time.Duration(rate)
+	led := "white"
+	state := false
+
+	// the LED GPIO is toggled when available, to observe the output with
+	// an oscilloscope
+	toggle := func() {
+		state = !state
+		target.LED(led, state)
+	}
+
+	if target.LED(led, false) != nil {
+		toggle = func() {}
+	}
+
+	controlloopLog.Infof("%d Hz (%s period) for %s", rate, period, duration)
+
+	for _, n := range []int{0, load} {
+		stop := irqLoad(n)
+		s := controlLoop(period, duration, toggle)
+		stop()
+
+		target.LED(led, false)
+
+		name := fmt.Sprintf("jitter (%d load goroutines, %d activations, %d overruns)", n, len(s.jitter), s.overruns)
+
+		for _, l := range bytes.Split(bytes.TrimSpace([]byte(s.jitter.report(name))), []byte("\n")) {
+			controlloopLog.Infof("%s", l)
+		}
+
+		if load == 0 {
+			break
+		}
+	}
+
+	return
+}
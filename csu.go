@@ -0,0 +1,100 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Central Security Unit registers
+// (Central Security Unit (CSU), IMX6ULLRM).
+const (
+	CSU_BASE = 0x021c0000
+
+	CSU_CSL0   = CSU_BASE
+	CSU_SLAVES = 40
+
+	CSU_HP0 = CSU_BASE + 0x200
+	CSU_SA  = CSU_BASE + 0x218
+
+	// Each CSL register configures access permissions for two slaves, in
+	// the lower and upper half-words.
+	CSL_SLAVE0 = 0
+	CSL_SLAVE1 = 16
+
+	CSL_SUR  = 0
+	CSL_SSR  = 1
+	CSL_NUR  = 2
+	CSL_NSR  = 3
+	CSL_SUW  = 4
+	CSL_SSW  = 5
+	CSL_NUW  = 6
+	CSL_NSW  = 7
+	CSL_LOCK = 8
+
+	// secure and non-secure read/write access
+	CSL_ALL = 0xff
+	// secure only read/write access
+	CSL_SECURE = 1<<CSL_SUR | 1<<CSL_SSR | 1<<CSL_SUW | 1<<CSL_SSW
+)
+
+// csuGet returns the access policy of a CSL register slave.
+func csuGet(csl int, slave int) uint32 {
+	return reg.Get(CSU_CSL0+uint32(csl*4), slave, 0x1ff)
+}
+
+// csuSet configures the access policy for both slaves of a CSL register.
+func csuSet(csl int, policy uint32) {
+	addr := CSU_CSL0 + uint32(csl*4)
+
+	reg.SetN(addr, CSL_SLAVE0, 0xff, policy)
+	reg.SetN(addr, CSL_SLAVE1, 0xff, policy)
+}
+
+func cslAccess(policy uint32, read int, write int) string {
+	var access = []byte("--")
+
+	if policy>>read&1 == 1 {
+		access[0] = 'r'
+	}
+
+	if policy>>write&1 == 1 {
+		access[1] = 'w'
+	}
+
+	return string(access)
+}
+
+// csuDump returns the CSU access policy matrix for all CSL slaves, along
+// with the bus masters security configuration.
+func csuDump() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%-10s %-8s %-8s %-8s %-8s %s\n", "CSL/slave", "S user", "S super", "NS user", "NS super", "lock")
+
+	for i := 0; i < CSU_SLAVES; i++ {
+		for _, slave := range []int{CSL_SLAVE0, CSL_SLAVE1} {
+			p := csuGet(i, slave)
+
+			fmt.Fprintf(&buf, "%02d/%-7d %-8s %-8s %-8s %-8s %v\n", i, slave/CSL_SLAVE1,
+				cslAccess(p, CSL_SUR, CSL_SUW),
+				cslAccess(p, CSL_SSR, CSL_SSW),
+				cslAccess(p, CSL_NUR, CSL_NUW),
+				cslAccess(p, CSL_NSR, CSL_NSW),
+				p>>CSL_LOCK&1 == 1)
+		}
+	}
+
+	fmt.Fprintf(&buf, "HP0: %#08x SA: %#08x", reg.Read(CSU_HP0), reg.Read(CSU_SA))
+
+	return buf.String()
+}
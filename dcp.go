@@ -11,13 +11,14 @@ package main
 import (
 	"crypto/aes"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/f-secure-foundry/tamago/soc/imx6"
 )
 
+var dcpLog = newLogger("imx6_dcp")
+
 const testVector = "\x75\xf9\x02\x2d\x5a\x86\x7a\xd4\x30\x44\x0f\xee\xc6\x61\x1f\x0a"
 const zeroVector = "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
 const diversifier = "\xde\xad\xbe\xef"
@@ -38,7 +39,7 @@ func testKeyDerivation() (err error) {
 
 	// if the SoC is secure booted we can only print the result
 	if imx6.DCP.SNVS() {
-		log.Printf("imx6_dcp: derived SNVS key %x", key)
+		dcpLog.Infof("derived SNVS key %x", key)
 		return
 	}
 
@@ -55,7 +56,7 @@ func testKeyDerivation() (err error) {
 		return
 	}
 
-	log.Printf("imx6_dcp: derived test key %x", key)
+	dcpLog.Infof("derived test key %x", key)
 
 	return
 }
@@ -91,16 +92,25 @@ func testDecryption(size int, sec int) (n int, d time.Duration, err error) {
 	return n, time.Since(start), err
 }
 
-func TestDCP() {
+func TestDCP() (err error) {
 	imx6.DCP.Init()
 
 	// derive twice to ensure consistency across repeated operations
 
-	if err := testKeyDerivation(); err != nil {
-		log.Printf("imx6_dcp: error, %v", err)
+	if err = testKeyDerivation(); err != nil {
+		dcpLog.Errorf("error, %v", err)
+		return
 	}
 
-	if err := testKeyDerivation(); err != nil {
-		log.Printf("imx6_dcp: error, %v", err)
+	if err = testKeyDerivation(); err != nil {
+		dcpLog.Errorf("error, %v", err)
+		return
 	}
+
+	// seal/unseal a blob across reboots (see secrets.go)
+	if err = testSecrets(); err != nil {
+		dcpLog.Errorf("secrets error, %v", err)
+	}
+
+	return
 }
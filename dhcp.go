@@ -0,0 +1,447 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// DHCP client (RFC 2131, RFC 2132), as gVisor netstack does not provide
+// one, messages are exchanged directly as Ethernet frames.
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+
+	BOOTREQUEST = 1
+	BOOTREPLY   = 2
+
+	BOOTP_SIZE  = 236
+	DHCP_MAGIC  = 0x63825363
+	DHCP_FLAG_B = 0x8000
+
+	DHCPDISCOVER = 1
+	DHCPOFFER    = 2
+	DHCPREQUEST  = 3
+	DHCPACK      = 5
+	DHCPNAK      = 6
+
+	OPT_PAD          = 0
+	OPT_SUBNET_MASK  = 1
+	OPT_ROUTER       = 3
+	OPT_DNS          = 6
+	OPT_REQUESTED_IP = 50
+	OPT_LEASE_TIME   = 51
+	OPT_MESSAGE_TYPE = 53
+	OPT_SERVER_ID    = 54
+	OPT_PARAMS       = 55
+	OPT_END          = 255
+)
+
+var dhcpLog = newLogger("dhcp")
+
+// dhcpLease represents an IPv4 interface configuration.
+type dhcpLease struct {
+	Addr    tcpip.Address
+	Mask    tcpip.AddressMask
+	Gateway tcpip.Address
+	DNS     tcpip.Address
+	Server  tcpip.Address
+
+	Duration time.Duration
+}
+
+func (l *dhcpLease) String() string {
+	ones, _ := net.IPMask(l.Mask).Size()
+	s := fmt.Sprintf("%s/%d", l.Addr, ones)
+
+	if l.Gateway != "" {
+		s += fmt.Sprintf(" gw %s", l.Gateway)
+	}
+
+	if l.DNS != "" {
+		s += fmt.Sprintf(" dns %s", l.DNS)
+	}
+
+	if l.Duration > 0 {
+		s += fmt.Sprintf(" (server %s, lease %s)", l.Server, l.Duration)
+	}
+
+	return s
+}
+
+// Configure assigns the lease address to a NIC and sets the stack routes.
+func (l *dhcpLease) Configure(s *stack.Stack, nic tcpip.NICID) {
+	ones, _ := net.IPMask(l.Mask).Size()
+
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   l.Addr,
+			PrefixLen: ones,
+		},
+	}
+
+	if err := s.AddProtocolAddress(nic, protoAddr); err != nil && err != tcpip.ErrDuplicateAddress {
+		dhcpLog.Errorf("error adding address %s, %v", l.Addr, err)
+		return
+	}
+
+	network := tcpip.Address(net.IP(l.Addr).Mask(net.IPMask(l.Mask)))
+	subnet, _ := tcpip.NewSubnet(network, l.Mask)
+
+	routes := []tcpip.Route{{
+		Destination: subnet,
+		NIC:         nic,
+	}}
+
+	if l.Gateway != "" {
+		any, _ := tcpip.NewSubnet("\x00\x00\x00\x00", "\x00\x00\x00\x00")
+
+		routes = append(routes, tcpip.Route{
+			Destination: any,
+			Gateway:     l.Gateway,
+			NIC:         nic,
+		})
+	}
+
+	// preserve IPv6 routes (see ipv6.go)
+	for _, r := range s.GetRouteTable() {
+		if len(r.Destination.ID()) == header.IPv6AddressSize {
+			routes = append(routes, r)
+		}
+	}
+
+	s.SetRouteTable(routes)
+}
+
+// staticLease returns a lease for an address in CIDR notation.
+func staticLease(cidr string, gateway string) (l *dhcpLease, err error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid address %s", cidr)
+	}
+
+	l = &dhcpLease{
+		Addr: tcpip.Address(ip.To4()),
+		Mask: tcpip.AddressMask(ipnet.Mask),
+	}
+
+	if gateway != "" {
+		gw := net.ParseIP(gateway).To4()
+
+		if gw == nil {
+			return nil, fmt.Errorf("invalid gateway %s", gateway)
+		}
+
+		l.Gateway = tcpip.Address(gw)
+	}
+
+	return
+}
+
+// dhcpMessage represents a received DHCP message.
+type dhcpMessage struct {
+	xid     uint32
+	msgType byte
+	yiaddr  tcpip.Address
+	options map[byte][]byte
+}
+
+// dhcpClient implements a DHCP client, frames are transmitted with the Tx
+// function while received ones must be passed to Handle().
+type dhcpClient struct {
+	MAC net.HardwareAddr
+	Tx  func(frame []byte) error
+
+	xid     uint32
+	replies chan *dhcpMessage
+}
+
+// Handle processes an Ethernet frame, returning true if it is a DHCP
+// client message.
+func (c *dhcpClient) Handle(frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize+header.IPv4MinimumSize+header.UDPMinimumSize {
+		return false
+	}
+
+	if header.Ethernet(frame).Type() != header.IPv4ProtocolNumber {
+		return false
+	}
+
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+
+	if !ip.IsValid(len(ip)) || ip.Protocol() != uint8(header.UDPProtocolNumber) {
+		return false
+	}
+
+	udp := header.UDP(ip.Payload())
+
+	if len(udp) < header.UDPMinimumSize || udp.DestinationPort() != DHCP_CLIENT_PORT {
+		return false
+	}
+
+	if msg := c.parse(udp.Payload()); msg != nil && c.replies != nil {
+		select {
+		case c.replies <- msg:
+		default:
+		}
+	}
+
+	return true
+}
+
+func (c *dhcpClient) parse(buf []byte) (msg *dhcpMessage) {
+	if len(buf) < BOOTP_SIZE+4 || buf[0] != BOOTREPLY {
+		return
+	}
+
+	if !bytes.Equal(buf[28:34], c.MAC) || binary.BigEndian.Uint32(buf[BOOTP_SIZE:]) != DHCP_MAGIC {
+		return
+	}
+
+	msg = &dhcpMessage{
+		xid:     binary.BigEndian.Uint32(buf[4:8]),
+		yiaddr:  tcpip.Address(buf[16:20]),
+		options: make(map[byte][]byte),
+	}
+
+	opts := buf[BOOTP_SIZE+4:]
+
+	for len(opts) > 0 {
+		code := opts[0]
+
+		if code == OPT_END {
+			break
+		}
+
+		if code == OPT_PAD {
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil
+		}
+
+		msg.options[code] = opts[2 : 2+opts[1]]
+		opts = opts[2+opts[1]:]
+	}
+
+	if t := msg.options[OPT_MESSAGE_TYPE]; len(t) == 1 {
+		msg.msgType = t[0]
+	}
+
+	return
+}
+
+// frame returns a broadcast DHCP message with the argument options.
+func (c *dhcpClient) frame(ciaddr tcpip.Address, options []byte) []byte {
+	bootp := make([]byte, BOOTP_SIZE+4)
+
+	bootp[0] = BOOTREQUEST
+	// Ethernet hardware type and address length
+	bootp[1] = 1
+	bootp[2] = 6
+	binary.BigEndian.PutUint32(bootp[4:], c.xid)
+	binary.BigEndian.PutUint16(bootp[10:], DHCP_FLAG_B)
+	copy(bootp[12:16], ciaddr)
+	copy(bootp[28:34], c.MAC)
+	binary.BigEndian.PutUint32(bootp[BOOTP_SIZE:], DHCP_MAGIC)
+
+	bootp = append(bootp, options...)
+	bootp = append(bootp, OPT_END)
+
+	udpLen := header.UDPMinimumSize + len(bootp)
+	ipLen := header.IPv4MinimumSize + udpLen
+
+	frame := make([]byte, header.EthernetMinimumSize+ipLen)
+
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: tcpip.LinkAddress(c.MAC),
+		DstAddr: header.EthernetBroadcastAddress,
+		Type:    header.IPv4ProtocolNumber,
+	})
+
+	src := tcpip.Address("\x00\x00\x00\x00")
+
+	if ciaddr != "" {
+		src = ciaddr
+	}
+
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(ipLen),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     header.IPv4Broadcast,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	// the UDP checksum is optional over IPv4
+	udp := header.UDP(ip[header.IPv4MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: DHCP_CLIENT_PORT,
+		DstPort: DHCP_SERVER_PORT,
+		Length:  uint16(udpLen),
+	})
+
+	copy(udp[header.UDPMinimumSize:], bootp)
+
+	return frame
+}
+
+// exchange transmits a message until a reply of the expected types is
+// received, or the timeout expires.
+func (c *dhcpClient) exchange(frame []byte, timeout time.Duration, types ...byte) (msg *dhcpMessage, err error) {
+	deadline := time.After(timeout)
+
+	for {
+		if err = c.Tx(frame); err != nil {
+			return
+		}
+
+		retry := time.After(2 * time.Second)
+
+	wait:
+		for {
+			select {
+			case msg = <-c.replies:
+				if msg.xid != c.xid {
+					continue
+				}
+
+				for _, t := range types {
+					if msg.msgType == t {
+						return
+					}
+				}
+			case <-retry:
+				break wait
+			case <-deadline:
+				return nil, errors.New("DHCP timeout")
+			}
+		}
+	}
+}
+
+func (c *dhcpClient) request(lease *dhcpLease, timeout time.Duration) (l *dhcpLease, err error) {
+	var ciaddr tcpip.Address
+	var server tcpip.Address
+	var requested tcpip.Address
+
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	c.xid = binary.BigEndian.Uint32(xid)
+
+	if c.replies == nil {
+		c.replies = make(chan *dhcpMessage, 8)
+	}
+
+	params := []byte{OPT_PARAMS, 4, OPT_SUBNET_MASK, OPT_ROUTER, OPT_DNS, OPT_LEASE_TIME}
+
+	if lease != nil {
+		// renewal
+		ciaddr = lease.Addr
+	} else {
+		discover := append([]byte{OPT_MESSAGE_TYPE, 1, DHCPDISCOVER}, params...)
+		offer, err := c.exchange(c.frame("", discover), timeout, DHCPOFFER)
+
+		if err != nil {
+			return nil, err
+		}
+
+		server = tcpip.Address(offer.options[OPT_SERVER_ID])
+		requested = offer.yiaddr
+	}
+
+	req := append([]byte{OPT_MESSAGE_TYPE, 1, DHCPREQUEST}, params...)
+
+	if server != "" {
+		req = append(req, OPT_SERVER_ID, 4)
+		req = append(req, server...)
+		req = append(req, OPT_REQUESTED_IP, 4)
+		req = append(req, requested...)
+	}
+
+	ack, err := c.exchange(c.frame(ciaddr, req), timeout, DHCPACK, DHCPNAK)
+
+	if err != nil {
+		return
+	}
+
+	if ack.msgType == DHCPNAK {
+		return nil, errors.New("DHCP request rejected")
+	}
+
+	l = &dhcpLease{
+		Addr:   ack.yiaddr,
+		Mask:   "\xff\xff\xff\x00",
+		Server: tcpip.Address(ack.options[OPT_SERVER_ID]),
+	}
+
+	if m := ack.options[OPT_SUBNET_MASK]; len(m) == 4 {
+		l.Mask = tcpip.AddressMask(m)
+	}
+
+	if r := ack.options[OPT_ROUTER]; len(r) >= 4 {
+		l.Gateway = tcpip.Address(r[0:4])
+	}
+
+	if d := ack.options[OPT_DNS]; len(d) >= 4 {
+		l.DNS = tcpip.Address(d[0:4])
+	}
+
+	if t := ack.options[OPT_LEASE_TIME]; len(t) == 4 {
+		l.Duration = time.Duration(binary.BigEndian.Uint32(t)) * time.Second
+	}
+
+	return
+}
+
+// Request obtains a lease.
+func (c *dhcpClient) Request(timeout time.Duration) (*dhcpLease, error) {
+	return c.request(nil, timeout)
+}
+
+// Renew renews the argument lease at half of its duration, it never
+// returns.
+func (c *dhcpClient) Renew(lease *dhcpLease) {
+	for {
+		time.Sleep(lease.Duration / 2)
+
+		l, err := c.request(lease, 10*time.Second)
+
+		if err != nil {
+			dhcpLog.Errorf("DHCP renewal error, %v", err)
+			continue
+		}
+
+		if l.Addr != lease.Addr {
+			dhcpLog.Warnf("DHCP renewal changed address to %s, ignored", l.Addr)
+			continue
+		}
+
+		dhcpLog.Infof("DHCP lease renewed %s", l)
+		lease = l
+	}
+}
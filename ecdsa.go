@@ -10,36 +10,42 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"log"
+	"fmt"
 	"time"
 )
 
-func testSignAndVerify(c elliptic.Curve, tag string) {
+var ecdsaLog = newLogger("ecdsa")
+
+func testSignAndVerify(c elliptic.Curve, tag string) error {
 	start := time.Now()
-	log.Printf("ECDSA sign and verify with p%d ... ", c.Params().BitSize)
+	ecdsaLog.Infof("ECDSA sign and verify with p%d ... ", c.Params().BitSize)
 
 	priv, _ := ecdsa.GenerateKey(c, rand.Reader)
 
 	hashed := []byte("testing")
 	r, s, err := ecdsa.Sign(rand.Reader, priv, hashed)
 	if err != nil {
-		log.Printf("%s: error signing: %s", tag, err)
-		return
+		return fmt.Errorf("%s: error signing: %s", tag, err)
 	}
 
 	if !ecdsa.Verify(&priv.PublicKey, hashed, r, s) {
-		log.Printf("%s: Verify failed", tag)
+		return fmt.Errorf("%s: Verify failed", tag)
 	}
 
 	hashed[0] ^= 0xff
 	if ecdsa.Verify(&priv.PublicKey, hashed, r, s) {
-		log.Printf("%s: Verify always works!", tag)
+		return fmt.Errorf("%s: Verify always works!", tag)
 	}
 
-	log.Printf("ECDSA sign and verify with p%d took %s", c.Params().BitSize, time.Since(start))
+	ecdsaLog.Infof("ECDSA sign and verify with p%d took %s", c.Params().BitSize, time.Since(start))
+
+	return nil
 }
 
-func TestSignAndVerify() {
-	testSignAndVerify(elliptic.P224(), "p224")
-	testSignAndVerify(elliptic.P256(), "p256")
+func TestSignAndVerify() (err error) {
+	if err = testSignAndVerify(elliptic.P224(), "p224"); err != nil {
+		return
+	}
+
+	return testSignAndVerify(elliptic.P256(), "p256")
 }
@@ -11,18 +11,14 @@
 package main
 
 import (
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
-	"math/big"
 	mathrand "math/rand"
-	"os"
 	"runtime"
 	"time"
 
-	"github.com/f-secure-foundry/tamago/soc/imx6"
+	"github.com/f-secure-foundry/tamago-example/internal/board"
 )
 
 var Build string
@@ -31,7 +27,18 @@ var banner string
 
 var verbose = true
 
-var exit chan bool
+// hardware target, set by the board files (e.g. usbarmory.go)
+var target board.Board
+
+// Deterministic mode, enabled by the `seed` configuration setting, seeds
+// math/rand with a fixed value and runs all tests sequentially so that logs
+// from different runs, or boards, can be compared.
+var deterministic = false
+
+var boardLog = newLogger("board")
+
+// configured test selection, see tests.go
+var selection = &testFilter{}
 
 func init() {
 	banner = fmt.Sprintf("%s/%s (%s) • %s %s",
@@ -39,181 +46,267 @@ func init() {
 		Revision, Build)
 
 	log.SetFlags(0)
+}
+
+// configure loads the example configuration (see config.go) and applies it to
+// logging and SoC settings.
+func configure() {
+	loadConfig()
+
+	verbose = conf.Bool("verbose", verbose)
+
+	// buffered console I/O (see console.go)
+	if consoleUART != nil && conf.Bool("console_async", true) {
+		if Console = startConsole(consoleUART); Console != nil {
+			consoleOutput = Console
+		}
+	}
+
+	// leveled loggers (see logger.go)
+	levelErr := configureLogLevels(conf.String("log_level", "info"), conf.List("log_modules", nil))
+	output := consoleOutput
+
+	if conf.Bool("log_color", false) {
+		output = colorWriter{consoleOutput}
+	}
+
+	var writers []io.Writer
 
 	// imx6 package debugging
 	if verbose {
-		log.SetOutput(os.Stdout)
+		writers = append(writers, output)
+	}
+
+	writers = append(writers, logHistory)
+
+	// persistent log (see logstore.go)
+	var storeErr error
+
+	if conf.Bool("log_store", false) {
+		if LogStore, storeErr = startLogStore(); storeErr == nil {
+			writers = append(writers, LogStore)
+		}
+	}
+
+	log.SetOutput(io.MultiWriter(writers...))
+
+	if levelErr != nil {
+		configLog.Warnf("%v, using defaults", levelErr)
+	}
+
+	if storeErr != nil {
+		configLog.Warnf("log store not available, %v", storeErr)
+	}
+
+	configLog.Infof("loaded from %s (%d settings)", confSource, len(conf))
+
+	filter, err := newTestFilter(conf.List("tests", nil), conf.List("skip", nil))
+
+	if err != nil {
+		configLog.Warnf("invalid test selection, running all tests: %v", err)
 	} else {
-		log.SetOutput(ioutil.Discard)
+		selection = filter
+	}
+
+	if _, ok := conf["seed"]; ok {
+		deterministic = true
+		mathrand.Seed(int64(conf.Int("seed", 0)))
+		configLog.Infof("deterministic mode (seed %d)", conf.Int("seed", 0))
+	}
+
+	IP = conf.String("ip", IP)
+	hostMAC = conf.String("host_mac", hostMAC)
+	deviceMAC = conf.String("device_mac", deviceMAC)
+	ethMAC = conf.String("eth_mac", ethMAC)
+
+	if err := Firewall.Load(conf.List("filter_rules", nil), conf.String("filter_policy", "allow")); err != nil {
+		configLog.Warnf("invalid packet filter configuration: %v", err)
 	}
 
-	model := imx6.Model()
-	_, family, revMajor, revMinor := imx6.SiliconVersion()
+	model := target.Model()
 
-	if !imx6.Native {
-		banner += fmt.Sprintf(" • %s %d MHz (emulated)", model, imx6.ARMFreq()/1000000)
+	if !target.Native() {
+		banner += fmt.Sprintf(" • %s %d MHz (emulated)", model, target.Freq()/1000000)
 		return
 	}
 
-	if err := imx6.SetARMFreq(900); err != nil {
-		log.Printf("WARNING: error setting ARM frequency: %v", err)
+	if err := target.SetFreq(uint32(conf.Int("arm_freq", 900))); err != nil {
+		boardLog.Warnf("error setting ARM frequency: %v", err)
 	}
 
-	banner += fmt.Sprintf(" • %s %d MHz", model, imx6.ARMFreq()/1000000)
+	// reset cause (see resetcause.go)
+	cause, srsr := readResetCause()
 
-	log.Printf("imx6_soc: %s (%#x, %d.%d) @ %d MHz - native:%v",
-		model, family, revMajor, revMinor, imx6.ARMFreq()/1000000, imx6.Native)
+	banner += fmt.Sprintf(" • %s %d MHz • reset: %s", model, target.Freq()/1000000, cause)
+
+	boardLog.Infof("%s, %s @ %d MHz - native:%v",
+		target.Name(), model, target.Freq()/1000000, target.Native())
+	boardLog.Infof("reset cause %s (SRSR %#x)", cause, srsr)
 }
 
 func example(init bool) {
 	start := time.Now()
-	exit = make(chan bool)
-	n := 0
+	results := runTests(exampleTests(init), selection)
 
-	log.Println("-- begin tests -------------------------------------------------------")
+	reportResults(results, time.Since(start))
+}
 
-	n += 1
-	go func() {
-		log.Println("-- fs ----------------------------------------------------------------")
-		TestFile()
-		TestDir()
+func runTest(t exampleTest) (res testResult) {
+	start := time.Now()
 
-		exit <- true
-	}()
+	res.name = t.name
+	res.err = t.fn()
+	res.duration = time.Since(start)
 
-	sleep := 100 * time.Millisecond
+	if res.err != nil {
+		testLog.Errorf("%s: test failed, %v", t.name, res.err)
+	}
 
-	n += 1
-	go func() {
-		log.Println("-- timer -------------------------------------------------------------")
+	return
+}
 
-		t := time.NewTimer(sleep)
-		log.Printf("waking up timer after %v", sleep)
+// runTests executes all supported tests matched by the filter, concurrent
+// tests are launched on separate goroutines before sequential ones.
+func runTests(tests []exampleTest, filter *testFilter) (results []testResult) {
+	start := time.Now()
+	done := make(chan testResult)
+	n := 0
 
-		start := time.Now()
+	testLog.Infof("-- begin tests -------------------------------------------------------")
 
-		for now := range t.C {
-			log.Printf("woke up at %d (%v)", now.Nanosecond(), now.Sub(start))
-			break
+	for _, t := range tests {
+		if t.sequential || !filter.selects(t) {
+			continue
 		}
 
-		exit <- true
-	}()
-
-	n += 1
-	go func() {
-		log.Println("-- sleep -------------------------------------------------------------")
+		if deterministic {
+			results = append(results, runTest(t))
+			continue
+		}
 
-		log.Printf("sleeping %s", sleep)
-		start := time.Now()
-		time.Sleep(sleep)
-		log.Printf("slept %s (%v)", sleep, time.Since(start))
+		n += 1
+		go func(t exampleTest) {
+			done <- runTest(t)
+		}(t)
+	}
 
-		exit <- true
-	}()
+	testLog.Infof("launched %d test goroutines", n)
 
-	n += 1
-	go func() {
-		log.Println("-- rng ---------------------------------------------------------------")
+	for i := 1; i <= n; i++ {
+		results = append(results, <-done)
+	}
 
-		size := 32
+	testLog.Infof("----------------------------------------------------------------------")
+	testLog.Infof("completed %d goroutines (%s)", n, time.Since(start))
 
-		for i := 0; i < 10; i++ {
-			rng := make([]byte, size)
-			rand.Read(rng)
-			log.Printf("%x", rng)
+	for _, t := range tests {
+		if !t.sequential || !filter.selects(t) {
+			continue
 		}
 
-		count := 1000
-		start := time.Now()
+		results = append(results, runTest(t))
+	}
+
+	return
+}
 
-		for i := 0; i < count; i++ {
-			rng := make([]byte, size)
-			rand.Read(rng)
-		}
+func main() {
+	start := time.Now()
 
-		log.Printf("retrieved %d random bytes in %s", size*count, time.Since(start))
+	// boot time breakdown (see boottrace.go)
+	bootMark("main")
 
-		seed, _ := rand.Int(rand.Reader, big.NewInt(int64(math.MaxInt64)))
-		mathrand.Seed(seed.Int64())
+	configure()
 
-		exit <- true
-	}()
+	// restore wall clock time (see rtc.go)
+	loadRTC()
 
-	n += 1
-	go func() {
-		log.Println("-- ecdsa -------------------------------------------------------------")
-		TestSignAndVerify()
-		exit <- true
-	}()
+	boardLog.Infof("%s", banner)
 
-	n += 1
-	go func() {
-		log.Println("-- btc ---------------------------------------------------------------")
+	measureBoot()
 
-		ExamplePayToAddrScript()
-		ExampleExtractPkScriptAddrs()
-		ExampleSignTxOutput()
+	// crypto self-tests (see kat.go)
+	_, katErr := runKATs()
 
-		exit <- true
-	}()
+	// memory card removal and insertion (see hotplug.go)
+	startHotplug()
 
-	if imx6.Native && imx6.Family == imx6.IMX6ULL {
-		n += 1
-		go func() {
-			log.Println("-- i.mx6 dcp ---------------------------------------------------------")
-			TestDCP()
-			exit <- true
-		}()
-	}
+	// regulators brown-out and USB VBUS (see power.go)
+	startPowerMonitor()
 
-	log.Printf("launched %d test goroutines", n)
+	iterations := conf.Int("soak_iterations", 0)
+	duration := time.Duration(conf.Int("soak_duration", 0)) * time.Second
 
-	for i := 1; i <= n; i++ {
-		<-exit
+	switch {
+	case conf.Bool("post", false):
+		// power-on self-test only (see post.go)
+		runPOST()
+	case iterations > 0 || duration > 0:
+		soak(true, iterations, duration)
+	default:
+		example(true)
 	}
 
-	log.Printf("----------------------------------------------------------------------")
-	log.Printf("completed %d goroutines (%s)", n, time.Since(start))
+	bootMark("tests")
 
-	runs := 9
-	chunksMax := 50
-	chunks := mathrand.Intn(chunksMax) + 1
-	fillSize := 160 * 1024 * 1024
-	chunkSize := fillSize / chunks
+	// console shell and file transfers on the debug UART (see serial.go)
+	if conf.Bool("serial_console", false) {
+		go startSerialConsole()
+	}
 
-	log.Printf("-- memory allocation (%d runs) ----------------------------------------", runs)
-	testAlloc(runs, chunks, chunkSize)
+	if katErr != nil && conf.Bool("kat_enforce", true) {
+		katLog.Errorf("network services disabled, %v", katErr)
+		select {}
+	}
 
-	if imx6.Native {
-		count := 10 * 1024 * 1024
-		readSize := 0x7fff
+	if conf.Bool("bridge", false) && target.Ethernet() {
+		boardLog.Infof("-- i.mx6 bridge ------------------------------------------------------")
 
-		if init {
-			// Pre-USB use the entire iRAM, accounting for required
-			// alignments which take additional space.
-			readSize = 0x20000 - 512
+		if err := StartBridge(); err != nil {
+			enetLog.Fatalf("%v", err)
 		}
+	}
 
-		log.Println("-- memory cards -------------------------------------------------------")
+	signer := false
 
-		for _, card := range cards {
-			TestUSDHC(card, count, readSize)
+	if n := conf.Int("signer_uart", 0); n != 0 && target.Native() {
+		boardLog.Infof("-- i.mx6 signer ------------------------------------------------------")
+
+		if err := StartSigner(n); err != nil {
+			signerLog.Errorf("%v", err)
+		} else {
+			signer = true
 		}
 	}
-}
 
-func main() {
-	start := time.Now()
+	ethernet := false
+
+	if conf.Bool("ethernet", true) && target.Ethernet() {
+		boardLog.Infof("-- i.mx6 enet --------------------------------------------------------")
+
+		if err := StartEthernet(); err != nil {
+			enetLog.Errorf("%v", err)
+		} else {
+			ethernet = true
+			bootMark("ethernet")
+		}
+	}
 
-	log.Println(banner)
+	if conf.Bool("usb", true) && target.USB() {
+		boardLog.Infof("-- i.mx6 usb ---------------------------------------------------------")
 
-	example(true)
+		if usbcHost() {
+			// tamago only provides a USB device stack
+			usbLog.Infof("partner requires host role, device mode not started")
+		} else {
+			StartUSB()
+		}
+	}
 
-	if imx6.Native && (imx6.Family == imx6.IMX6UL || imx6.Family == imx6.IMX6ULL) {
-		log.Println("-- i.mx6 usb ---------------------------------------------------------")
-		StartUSB()
+	if ethernet || signer {
+		// wired network and signer services run until reset
+		select {}
 	}
 
-	log.Printf("Goodbye from tamago/arm (%s)", time.Since(start))
+	boardLog.Infof("Goodbye from tamago/arm (%s)", time.Since(start))
 }
@@ -0,0 +1,240 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Go execution traces, for `go tool trace` analysis, are written on a raw
+// memory card area or streamed to a TCP client, from an on-demand start until
+// stopped.
+const (
+	// card writes are buffered in chunks of this size
+	TRACE_CARD_CHUNK = 64 * 1024
+)
+
+var traceLog = newLogger("trace")
+
+// traceWriter passes trace data to its destination, discarding it once the
+// destination is full or fails, as the runtime ignores write errors.
+type traceWriter struct {
+	w     io.Writer
+	limit int64
+	size  int64
+	err   error
+}
+
+// Write implements io.Writer.
+func (t *traceWriter) Write(p []byte) (int, error) {
+	if t.err != nil {
+		return len(p), nil
+	}
+
+	if t.limit > 0 && atomic.LoadInt64(&t.size)+int64(len(p)) > t.limit {
+		t.err = errors.New("trace area full")
+	} else {
+		n, err := t.w.Write(p)
+		atomic.AddInt64(&t.size, int64(n))
+		t.err = err
+	}
+
+	if t.err != nil {
+		// trace.Stop() waits for this writer to return
+		go stopTrace(t)
+	}
+
+	return len(p), nil
+}
+
+var execTrace struct {
+	sync.Mutex
+
+	w     *traceWriter
+	dest  string
+	start time.Time
+	// flush and release the destination
+	close func() error
+}
+
+// startTrace starts Go execution tracing to the argument destination.
+func startTrace(w io.Writer, limit int64, dest string, close func() error) (err error) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+
+	if execTrace.w != nil {
+		return fmt.Errorf("trace already active (%s)", execTrace.dest)
+	}
+
+	tw := &traceWriter{w: w, limit: limit}
+
+	if err = trace.Start(tw); err != nil {
+		return
+	}
+
+	execTrace.w = tw
+	execTrace.dest = dest
+	execTrace.start = time.Now()
+	execTrace.close = close
+
+	traceLog.Infof("started (%s)", dest)
+
+	return
+}
+
+// stopTrace stops Go execution tracing, returning a summary of the written
+// trace. The argument writer, when not nil, restricts stopping to the trace
+// using it.
+func stopTrace(w *traceWriter) (res string, err error) {
+	execTrace.Lock()
+	defer execTrace.Unlock()
+
+	tw := execTrace.w
+
+	if tw == nil || (w != nil && w != tw) {
+		return "", errors.New("no active trace")
+	}
+
+	trace.Stop()
+
+	if execTrace.close != nil {
+		err = execTrace.close()
+	}
+
+	res = fmt.Sprintf("%d bytes in %s (%s)", tw.size, time.Since(execTrace.start).Round(time.Millisecond), execTrace.dest)
+
+	if tw.err != nil {
+		res += fmt.Sprintf(", truncated: %v", tw.err)
+	}
+
+	execTrace.w = nil
+
+	traceLog.Infof("stopped, %s", res)
+
+	return
+}
+
+func startCardTrace(n int, offset int64, size int64) (err error) {
+	card, err := target.Card(n)
+
+	if err != nil {
+		return
+	}
+
+	if offset%int64(card.BlockSize()) != 0 {
+		return errors.New("offset must be block aligned")
+	}
+
+	if size <= 0 || offset+size > int64(card.Blocks())*int64(card.BlockSize()) {
+		return errors.New("invalid size")
+	}
+
+	buf := bufio.NewWriterSize(&regionWriter{r: &cardRegion{card: card, offset: offset, size: size}}, TRACE_CARD_CHUNK)
+
+	return startTrace(buf, size, fmt.Sprintf("card %d at %#x", n, offset), buf.Flush)
+}
+
+func startTraceServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		traceLog.Fatalf("listener error, %v", err)
+	}
+
+	traceLog.Infof("starting trace server at %s:%d", addr.String(), port)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			traceLog.Errorf("error accepting connection, %v", err)
+			continue
+		}
+
+		// the connection is closed once the trace is stopped, either on
+		// request or when the client disconnects
+		if err = startTrace(conn, 0, "tcp "+conn.RemoteAddr().String(), conn.Close); err != nil {
+			traceLog.Errorf("%v", err)
+			conn.Close()
+		}
+	}
+}
+
+func traceCommand(op string, args []string) (res string) {
+	var err error
+
+	switch {
+	case op == "start" && len(args) == 3:
+		n, _ := strconv.Atoi(args[0])
+		offset, err := strconv.ParseInt(args[1], 16, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid offset: %v", err)
+		}
+
+		mib, _ := strconv.ParseInt(args[2], 10, 64)
+
+		if err = startCardTrace(n, offset, mib*1024*1024); err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("tracing to card %d at %#x", n, offset)
+	case op == "stop" && len(args) == 0:
+		res, err = stopTrace(nil)
+	case op == "status" && len(args) == 0:
+		execTrace.Lock()
+		defer execTrace.Unlock()
+
+		if execTrace.w == nil {
+			return "no active trace"
+		}
+
+		return fmt.Sprintf("%d bytes in %s (%s)", atomic.LoadInt64(&execTrace.w.size), time.Since(execTrace.start).Round(time.Millisecond), execTrace.dest)
+	default:
+		return "invalid arguments"
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return
+}
+
+// traceHandler serves the trace commands as /trace/<op>, with command
+// arguments passed as `card`, `offset` and `size` query parameters.
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	var args []string
+
+	op := strings.TrimPrefix(r.URL.Path, "/trace/")
+	q := r.URL.Query()
+
+	for _, k := range []string{"card", "offset", "size"} {
+		if v := q.Get(k); v != "" {
+			args = append(args, v)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, traceCommand(op, args))
+}
@@ -0,0 +1,249 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/f-secure-foundry/tamago-example/internal/board"
+	"github.com/f-secure-foundry/tamago-example/internal/ext4"
+)
+
+const (
+	PARTITION_SECTOR = 512
+
+	MBR_ENTRIES   = 446
+	MBR_SIGNATURE = 0xaa55
+	MBR_GPT       = 0xee
+
+	GPT_SIGNATURE = "EFI PART"
+
+	// maximum output size for `ext4 cat`
+	EXT4_CAT_LIMIT   = 64 * 1024
+	EXT4_COPY_BUFFER = 1024 * 1024
+)
+
+// partition represents a memory card partition.
+type partition struct {
+	start int64
+	size  int64
+}
+
+// gptPartitions parses a GUID Partition Table.
+func gptPartitions(card board.BlockDevice) (parts []partition, err error) {
+	hdr, err := card.Read(PARTITION_SECTOR, PARTITION_SECTOR)
+
+	if err != nil {
+		return
+	}
+
+	if string(hdr[0:8]) != GPT_SIGNATURE {
+		return nil, errors.New("invalid GPT header")
+	}
+
+	lba := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	count := int64(binary.LittleEndian.Uint32(hdr[80:]))
+	size := int64(binary.LittleEndian.Uint32(hdr[84:]))
+
+	if size < 128 || count > 256 {
+		return nil, errors.New("invalid GPT entries")
+	}
+
+	entries, err := card.Read(lba*PARTITION_SECTOR, count*size)
+
+	if err != nil {
+		return
+	}
+
+	for i := int64(0); i < count; i++ {
+		e := entries[i*size:]
+
+		// unused entries have a zero type GUID
+		if bytes.Equal(e[0:16], make([]byte, 16)) {
+			continue
+		}
+
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+
+		parts = append(parts, partition{
+			start: first * PARTITION_SECTOR,
+			size:  (last - first + 1) * PARTITION_SECTOR,
+		})
+	}
+
+	return
+}
+
+// partitions returns the primary MBR, or GPT, partitions of a memory card.
+func partitions(card board.BlockDevice) (parts []partition, err error) {
+	mbr, err := card.Read(0, PARTITION_SECTOR)
+
+	if err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint16(mbr[510:]) != MBR_SIGNATURE {
+		return nil, errors.New("no partition table")
+	}
+
+	for i := 0; i < 4; i++ {
+		e := mbr[MBR_ENTRIES+i*16:]
+
+		switch e[4] {
+		case 0:
+			continue
+		case MBR_GPT:
+			return gptPartitions(card)
+		}
+
+		parts = append(parts, partition{
+			start: int64(binary.LittleEndian.Uint32(e[8:])) * PARTITION_SECTOR,
+			size:  int64(binary.LittleEndian.Uint32(e[12:])) * PARTITION_SECTOR,
+		})
+	}
+
+	return
+}
+
+// cardPartition returns the region of a memory card partition (numbered
+// from 1, 0 for the whole card).
+func cardPartition(n int, p int) (r *cardRegion, err error) {
+	card, err := target.Card(n)
+
+	if err != nil {
+		return
+	}
+
+	r = &cardRegion{
+		card: card,
+		size: int64(card.Blocks()) * int64(card.BlockSize()),
+	}
+
+	if p > 0 {
+		parts, err := partitions(card)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if p > len(parts) {
+			return nil, fmt.Errorf("invalid partition, %d found", len(parts))
+		}
+
+		r.offset = parts[p-1].start
+		r.size = parts[p-1].size
+	}
+
+	return
+}
+
+// openExt4 opens the ext4 filesystem held on a memory card partition
+// (numbered from 1, 0 for an unpartitioned card).
+func openExt4(n int, p int) (fs *ext4.FS, err error) {
+	r, err := cardPartition(n, p)
+
+	if err != nil {
+		return
+	}
+
+	return ext4.Open(r)
+}
+
+func ext4Command(op string, arg1 string, arg2 string, path string, dst string) (res string) {
+	n, _ := strconv.Atoi(arg1)
+	p, _ := strconv.Atoi(arg2)
+
+	fs, err := openExt4(n, p)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if op == "ls" {
+		list, err := fs.ReadDir(path)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		var buf bytes.Buffer
+
+		for _, fi := range list {
+			fmt.Fprintf(&buf, "%v %10d %s %s", fi.Mode, fi.Size, fi.ModTime.UTC().Format("2006-01-02 15:04"), fi.Name)
+
+			if fi.Mode&os.ModeSymlink != 0 {
+				if link, err := fs.Readlink(path + "/" + fi.Name); err == nil {
+					fmt.Fprintf(&buf, " -> %s", link)
+				}
+			}
+
+			fmt.Fprintln(&buf)
+		}
+
+		return buf.String()
+	}
+
+	f, err := fs.Open(path)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	switch op {
+	case "cat":
+		if f.Size() > EXT4_CAT_LIMIT {
+			return fmt.Sprintf("please only use files <= %d bytes", EXT4_CAT_LIMIT)
+		}
+
+		buf := make([]byte, f.Size())
+
+		if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+			return err.Error()
+		}
+
+		return string(buf)
+	case "sha256":
+		h := sha256.New()
+
+		if _, err = io.CopyBuffer(h, f, make([]byte, EXT4_COPY_BUFFER)); err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("%x  %s", h.Sum(nil), path)
+	case "cp":
+		if dst == "" {
+			return "missing destination"
+		}
+
+		out, err := os.Create(dst)
+
+		if err != nil {
+			return err.Error()
+		}
+		defer out.Close()
+
+		written, err := io.CopyBuffer(out, f, make([]byte, EXT4_COPY_BUFFER))
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("copied %s to %s (%d bytes)", path, dst, written)
+	}
+
+	return
+}
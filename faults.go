@@ -0,0 +1,365 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/board"
+	"github.com/f-secure-foundry/tamago-example/internal/kv"
+)
+
+// Storage faults are injected on block device accesses to exercise error
+// handling of the layers above the card drivers.
+const (
+	// simulated data transfer timeout
+	FAULT_TIMEOUT = 100 * time.Millisecond
+
+	FAULT_TEST_BLOCKS = 8192
+)
+
+var faultsLog = newLogger("faults")
+
+var faultKinds = []string{"crc", "timeout", "short", "corrupt", "torn"}
+
+// blockFault represents a fault injected on accesses overlapping a block.
+type blockFault struct {
+	op    string
+	kind  string
+	block int64
+	// remaining injections, negative for no limit
+	count int
+}
+
+// faultyCard wraps a block device to inject read and write faults. Failed
+// accesses are simulated data CRC errors (crc) or timeouts (timeout), while
+// faulty reads can also return fewer bytes than requested (short) or data with
+// a flipped bit (corrupt), without error. Interrupted writes (torn) only
+// transfer their first half before failing.
+type faultyCard struct {
+	sync.Mutex
+	board.BlockDevice
+
+	faults []*blockFault
+	// Injected counts injected faults.
+	Injected int
+}
+
+// cardFaults holds the fault injectors of memory cards.
+var cardFaults = make(map[int]*faultyCard)
+
+// injectFaults returns the memory card, wrapped by its fault injector when
+// faults are configured.
+func injectFaults(n int, card board.BlockDevice) board.BlockDevice {
+	if f, ok := cardFaults[n]; ok {
+		f.BlockDevice = card
+		return f
+	}
+
+	return card
+}
+
+// Inject adds a fault on read or write accesses overlapping a block (-1 for
+// any), for the argument number of accesses (negative for no limit).
+func (c *faultyCard) Inject(op string, kind string, block int64, count int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.faults = append(c.faults, &blockFault{op: op, kind: kind, block: block, count: count})
+}
+
+// Clear removes all faults.
+func (c *faultyCard) Clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.faults = nil
+}
+
+// match returns the fault, if any, triggered by an access.
+func (c *faultyCard) match(op string, offset int64, size int64) *blockFault {
+	c.Lock()
+	defer c.Unlock()
+
+	blockSize := int64(c.BlockSize())
+	first := offset / blockSize
+	last := (offset + size - 1) / blockSize
+
+	for _, f := range c.faults {
+		if f.op != op || f.count == 0 {
+			continue
+		}
+
+		if f.block >= 0 && (f.block < first || f.block > last) {
+			continue
+		}
+
+		if f.count > 0 {
+			f.count -= 1
+		}
+
+		c.Injected += 1
+
+		return f
+	}
+
+	return nil
+}
+
+// Read implements board.BlockDevice.Read with fault injection.
+func (c *faultyCard) Read(offset int64, size int64) (buf []byte, err error) {
+	f := c.match("read", offset, size)
+
+	if f == nil {
+		return c.BlockDevice.Read(offset, size)
+	}
+
+	switch f.kind {
+	case "crc":
+		return nil, fmt.Errorf("data CRC error at %#x (injected)", offset)
+	case "timeout":
+		time.Sleep(FAULT_TIMEOUT)
+		return nil, fmt.Errorf("data timeout at %#x (injected)", offset)
+	}
+
+	if buf, err = c.BlockDevice.Read(offset, size); err != nil {
+		return
+	}
+
+	switch f.kind {
+	case "short":
+		buf = buf[:len(buf)/2]
+	case "corrupt":
+		b := make([]byte, 2)
+		rand.Read(b)
+
+		if len(buf) > 0 {
+			i := (int(b[0])<<8 | int(b[1])) % len(buf)
+			buf[i] ^= 1 << (b[0] % 8)
+		}
+	}
+
+	return
+}
+
+// Write implements board.BlockDevice.Write with fault injection.
+func (c *faultyCard) Write(offset int64, buf []byte) (err error) {
+	f := c.match("write", offset, int64(len(buf)))
+
+	if f == nil {
+		return c.BlockDevice.Write(offset, buf)
+	}
+
+	switch f.kind {
+	case "timeout":
+		time.Sleep(FAULT_TIMEOUT)
+		return fmt.Errorf("data timeout at %#x (injected)", offset)
+	case "torn":
+		blockSize := c.BlockSize()
+
+		if half := len(buf) / 2 / blockSize * blockSize; half > 0 {
+			if err = c.BlockDevice.Write(offset, buf[:half]); err != nil {
+				return
+			}
+		}
+
+		return fmt.Errorf("write interrupted at %#x (injected)", offset)
+	default:
+		return fmt.Errorf("data CRC error at %#x (injected)", offset)
+	}
+}
+
+func (c *faultyCard) Status() string {
+	c.Lock()
+	defer c.Unlock()
+
+	var buf bytes.Buffer
+
+	for _, f := range c.faults {
+		fmt.Fprintf(&buf, "%-5s %-7s block:%d remaining:%d\n", f.op, f.kind, f.block, f.count)
+	}
+
+	fmt.Fprintf(&buf, "injected: %d", c.Injected)
+
+	return buf.String()
+}
+
+func faultCommand(arg1 string, args []string) (res string) {
+	n, _ := strconv.Atoi(arg1)
+
+	if len(args) == 0 {
+		if f, ok := cardFaults[n]; ok {
+			return f.Status()
+		}
+
+		return "no faults configured"
+	}
+
+	if args[0] == "clear" {
+		delete(cardFaults, n)
+		return
+	}
+
+	if len(args) != 4 || (args[0] != "read" && args[0] != "write") {
+		return "invalid arguments"
+	}
+
+	valid := false
+
+	for _, k := range faultKinds {
+		valid = valid || k == args[1]
+	}
+
+	if !valid {
+		return fmt.Sprintf("invalid fault, supported: %v", faultKinds)
+	}
+
+	block, err := strconv.ParseInt(args[2], 10, 64)
+
+	if err != nil {
+		return fmt.Sprintf("invalid block: %v", err)
+	}
+
+	count, err := strconv.Atoi(args[3])
+
+	if err != nil {
+		return fmt.Sprintf("invalid count: %v", err)
+	}
+
+	f, ok := cardFaults[n]
+
+	if !ok {
+		f = &faultyCard{}
+		cardFaults[n] = f
+	}
+
+	f.Inject(args[0], args[1], block, count)
+
+	return
+}
+
+// TestStorageFaults verifies that the card region, key-value store and blob
+// store layers report injected faults, or recover from them, without
+// returning invalid data.
+func TestStorageFaults() (err error) {
+	card := &faultyCard{BlockDevice: newRAMCard(FAULT_TEST_BLOCKS)}
+	size := int64(card.Blocks() * card.BlockSize())
+
+	// card region
+	r := &cardRegion{card: card, offset: 0, size: 1024 * 1024}
+	buf := make([]byte, 4096)
+
+	for _, kind := range []string{"crc", "timeout", "short"} {
+		card.Inject("read", kind, -1, 1)
+
+		if _, err = r.ReadAt(buf, 0); err == nil {
+			return fmt.Errorf("region read did not fail on %s fault", kind)
+		}
+
+		faultsLog.Infof("region read %s fault reported (%v)", kind, err)
+	}
+
+	// key-value store
+	r = &cardRegion{card: card, offset: 0, size: 2 * 1024 * 1024}
+
+	db, err := kv.Open(r, card.BlockSize())
+
+	if err != nil {
+		return
+	}
+
+	var b kv.Batch
+	b.Put([]byte("committed"), []byte("value"))
+
+	if err = db.Commit(&b); err != nil {
+		return
+	}
+
+	card.Inject("write", "torn", -1, 1)
+
+	b = kv.Batch{}
+	b.Put([]byte("torn"), bytes.Repeat([]byte{0xaa}, 4096))
+
+	if err = db.Commit(&b); err == nil {
+		return errors.New("store commit did not fail on torn write")
+	}
+
+	if db, err = kv.Open(r, card.BlockSize()); err != nil {
+		return
+	}
+
+	if _, err = db.Get([]byte("torn")); err != kv.ErrNotFound {
+		return errors.New("torn commit found after reopening")
+	}
+
+	if v, err := db.Get([]byte("committed")); err != nil || string(v) != "value" {
+		return errors.New("committed value lost after torn write")
+	}
+
+	b = kv.Batch{}
+	b.Put([]byte("after"), []byte("value"))
+
+	if err = db.Commit(&b); err != nil {
+		return fmt.Errorf("store commit after torn write, %v", err)
+	}
+
+	faultsLog.Infof("store recovered from torn write")
+
+	// blob store
+	bs, err := openBlobStore(&cardRegion{card: card, offset: 2 * 1024 * 1024, size: size - 2*1024*1024})
+
+	if err != nil {
+		return
+	}
+
+	data := make([]byte, 4*BLOB_CHUNK_SIZE)
+	rand.Read(data)
+
+	id, _, err := bs.Put(bytes.NewReader(data))
+
+	if err != nil {
+		return
+	}
+
+	dataStart := (2*1024*1024 + BLOB_INDEX_SIZE) / int64(card.BlockSize())
+
+	for _, kind := range []string{"crc", "corrupt", "short"} {
+		card.Inject("read", kind, dataStart, 1)
+
+		var out bytes.Buffer
+
+		if _, err = bs.Get(id, &out); err == nil {
+			return fmt.Errorf("blob read did not fail on %s fault", kind)
+		}
+
+		faultsLog.Infof("blob read %s fault reported (%v)", kind, err)
+	}
+
+	card.Inject("write", "crc", -1, 1)
+
+	if _, _, err = bs.Put(bytes.NewReader(data[:BLOB_CHUNK_SIZE-1])); err == nil {
+		return errors.New("blob put did not fail on write fault")
+	}
+
+	var out bytes.Buffer
+
+	if _, err = bs.Get(id, &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		return fmt.Errorf("blob unreadable after faults, %v", err)
+	}
+
+	faultsLog.Infof("%d faults injected and handled", card.Injected)
+
+	return nil
+}
@@ -0,0 +1,349 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/xts"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Encrypted volumes are laid out, dm-crypt style, as a header followed by
+// AES-XTS encrypted sectors, the sector number relative to the data area is
+// used as tweak. The header holds the volume key as a DCP sealed blob (see
+// secrets.go), binding the volume to the device:
+//
+//	| magic (8) | data sectors (8, BE) | blob size (2, BE) | sealed key |
+const (
+	FDE_MAGIC       = "TGCRYPT1"
+	FDE_HEADER_SIZE = 4096
+	FDE_SECTOR_SIZE = 512
+	FDE_KEY_SIZE    = 2 * aes.BlockSize
+
+	FDE_BENCH_CHUNK = 64 * 1024
+)
+
+var fdeLog = newLogger("fde")
+
+// cryptVolume implements a block translation layer, on a memory card region,
+// presenting plaintext sectors to its users while only ciphertext is
+// stored.
+type cryptVolume struct {
+	sync.Mutex
+
+	cipher *xts.Cipher
+	// ciphertext data area
+	data *cardRegion
+}
+
+// FDE is the currently open encrypted volume.
+var FDE *cryptVolume
+
+func fdeRegion(n int, offset int64, size int64) (r *cardRegion, err error) {
+	card, err := target.Card(n)
+
+	if err != nil {
+		return
+	}
+
+	if card.BlockSize() != FDE_SECTOR_SIZE {
+		return nil, errors.New("unsupported card block size")
+	}
+
+	if offset%FDE_SECTOR_SIZE != 0 {
+		return nil, errors.New("offset must be sector aligned")
+	}
+
+	return &cardRegion{card: card, offset: offset, size: size}, nil
+}
+
+// formatVolume creates an encrypted volume, with a new random key, on a card
+// region.
+func formatVolume(n int, offset int64, size int64) (err error) {
+	sectors := (size - FDE_HEADER_SIZE) / FDE_SECTOR_SIZE
+
+	if sectors <= 0 {
+		return errors.New("volume too small")
+	}
+
+	r, err := fdeRegion(n, offset, FDE_HEADER_SIZE)
+
+	if err != nil {
+		return
+	}
+
+	imx6.DCP.Init()
+
+	key := make([]byte, FDE_KEY_SIZE)
+
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	blob, err := sealBlob(key)
+
+	for i := range key {
+		key[i] = 0
+	}
+
+	if err != nil {
+		return
+	}
+
+	header := make([]byte, FDE_HEADER_SIZE)
+	copy(header, FDE_MAGIC)
+	binary.BigEndian.PutUint64(header[8:], uint64(sectors))
+	binary.BigEndian.PutUint16(header[16:], uint16(len(blob)))
+	copy(header[18:], blob)
+
+	if _, err = r.WriteAt(header, 0); err != nil {
+		return
+	}
+
+	fdeLog.Infof("formatted %d sectors on card %d at %#x", sectors, n, offset)
+
+	return
+}
+
+// openVolume unseals the key of an encrypted volume.
+func openVolume(n int, offset int64) (v *cryptVolume, err error) {
+	r, err := fdeRegion(n, offset, FDE_HEADER_SIZE)
+
+	if err != nil {
+		return
+	}
+
+	header := make([]byte, FDE_HEADER_SIZE)
+
+	if _, err = r.ReadAt(header, 0); err != nil {
+		return
+	}
+
+	if !bytes.HasPrefix(header, []byte(FDE_MAGIC)) {
+		return nil, errors.New("invalid volume header")
+	}
+
+	sectors := int64(binary.BigEndian.Uint64(header[8:]))
+	blobSize := int(binary.BigEndian.Uint16(header[16:]))
+
+	if 18+blobSize > FDE_HEADER_SIZE {
+		return nil, errors.New("invalid volume header")
+	}
+
+	imx6.DCP.Init()
+
+	key, err := unsealBlob(header[18 : 18+blobSize])
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot unseal volume key, %v", err)
+	}
+
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	return newCryptVolume(key, &cardRegion{
+		card:   r.card,
+		offset: offset + FDE_HEADER_SIZE,
+		size:   sectors * FDE_SECTOR_SIZE,
+	})
+}
+
+func newCryptVolume(key []byte, data *cardRegion) (v *cryptVolume, err error) {
+	c, err := xts.NewCipher(aes.NewCipher, key)
+
+	if err != nil {
+		return
+	}
+
+	return &cryptVolume{cipher: c, data: data}, nil
+}
+
+// Size returns the volume plaintext size.
+func (v *cryptVolume) Size() int64 {
+	return v.data.Size()
+}
+
+func (v *cryptVolume) check(p []byte, off int64) error {
+	if off%FDE_SECTOR_SIZE != 0 || len(p)%FDE_SECTOR_SIZE != 0 {
+		return errors.New("access must be sector aligned")
+	}
+
+	if off < 0 || off+int64(len(p)) > v.data.Size() {
+		return errors.New("access exceeds volume size")
+	}
+
+	return nil
+}
+
+// ReadAt implements io.ReaderAt for sector aligned accesses.
+func (v *cryptVolume) ReadAt(p []byte, off int64) (n int, err error) {
+	if err = v.check(p, off); err != nil {
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	buf := make([]byte, len(p))
+
+	if _, err = v.data.ReadAt(buf, off); err != nil {
+		return
+	}
+
+	for i := 0; i < len(p); i += FDE_SECTOR_SIZE {
+		sector := uint64(off+int64(i)) / FDE_SECTOR_SIZE
+		v.cipher.Decrypt(p[i:i+FDE_SECTOR_SIZE], buf[i:i+FDE_SECTOR_SIZE], sector)
+	}
+
+	return len(p), nil
+}
+
+// WriteAt implements io.WriterAt for sector aligned accesses.
+func (v *cryptVolume) WriteAt(p []byte, off int64) (n int, err error) {
+	if err = v.check(p, off); err != nil {
+		return
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	buf := make([]byte, len(p))
+
+	for i := 0; i < len(p); i += FDE_SECTOR_SIZE {
+		sector := uint64(off+int64(i)) / FDE_SECTOR_SIZE
+		v.cipher.Encrypt(buf[i:i+FDE_SECTOR_SIZE], p[i:i+FDE_SECTOR_SIZE], sector)
+	}
+
+	return v.data.WriteAt(buf, off)
+}
+
+func throughput(f func(off int64) error, size int64) (float64, error) {
+	start := time.Now()
+
+	for off := int64(0); off < size; off += FDE_BENCH_CHUNK {
+		if err := f(off); err != nil {
+			return 0, err
+		}
+	}
+
+	return float64(size) / (1024 * 1024) / time.Since(start).Seconds(), nil
+}
+
+// Benchmark compares encrypted and raw sequential throughput over the start
+// of the volume, overwriting its content.
+func (v *cryptVolume) Benchmark(size int64) (res string, err error) {
+	size -= size % FDE_BENCH_CHUNK
+
+	if size <= 0 || size > v.Size() {
+		return "", errors.New("invalid benchmark size")
+	}
+
+	buf := make([]byte, FDE_BENCH_CHUNK)
+	out := make([]byte, FDE_BENCH_CHUNK)
+
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	var results []float64
+
+	for _, rw := range []func(off int64) error{
+		func(off int64) (err error) { _, err = v.data.WriteAt(buf, off); return },
+		func(off int64) (err error) { _, err = v.data.ReadAt(out, off); return },
+		func(off int64) (err error) { _, err = v.WriteAt(buf, off); return },
+		func(off int64) (err error) {
+			if _, err = v.ReadAt(out, off); err == nil && !bytes.Equal(buf, out) {
+				err = fmt.Errorf("data mismatch at %#x", off)
+			}
+			return
+		},
+	} {
+		t, err := throughput(rw, size)
+
+		if err != nil {
+			return "", err
+		}
+
+		results = append(results, t)
+	}
+
+	return fmt.Sprintf("raw write %.2f MiB/s read %.2f MiB/s\nfde write %.2f MiB/s read %.2f MiB/s",
+		results[0], results[1], results[2], results[3]), nil
+}
+
+func fdeCommand(op string, args []string) (res string) {
+	var err error
+	var arg []int64
+
+	for i, a := range args {
+		base := 10
+
+		// offsets are hexadecimal
+		if (op == "format" || op == "open") && i == 1 {
+			base = 16
+		}
+
+		n, err := strconv.ParseInt(a, base, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid argument: %v", err)
+		}
+
+		arg = append(arg, n)
+	}
+
+	switch {
+	case op == "format" && len(arg) == 3:
+		err = formatVolume(int(arg[0]), arg[1], arg[2]*1024*1024)
+	case op == "open" && len(arg) == 2:
+		n, offset := int(arg[0]), arg[1]
+
+		if FDE, err = openVolume(n, offset); err == nil {
+			res = fmt.Sprintf("opened %d MiB volume", FDE.Size()/(1024*1024))
+
+			// reopen the volume after card removal (see hotplug.go)
+			mountCard("fde", n, func() (err error) {
+				FDE, err = openVolume(n, offset)
+				return
+			}, func() {
+				FDE = nil
+			})
+		}
+	case op == "close" && len(arg) == 0:
+		FDE = nil
+		unmountCard("fde")
+	case op == "bench" && len(arg) == 1:
+		if FDE == nil {
+			return "no open volume"
+		}
+
+		res, err = FDE.Benchmark(arg[0] * 1024 * 1024)
+	default:
+		return "invalid arguments"
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return
+}
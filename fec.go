@@ -0,0 +1,809 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/dma"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Ethernet MAC registers
+// (10/100-Mbps Ethernet MAC (ENET), IMX6ULLRM).
+const (
+	ENET1_BASE = 0x02188000
+	ENET2_BASE = 0x020b4000
+
+	ENETx_EIR = 0x004
+	EIR_MII   = 23
+
+	ENETx_EIMR = 0x008
+
+	ENETx_RDAR = 0x010
+	ENETx_TDAR = 0x014
+	RDAR_RDAR  = 24
+	TDAR_TDAR  = 24
+
+	ENETx_ECR   = 0x024
+	ECR_DBSWP   = 8
+	ECR_ETHEREN = 1
+	ECR_RESET   = 0
+
+	ENETx_MMFR = 0x040
+	MMFR_ST    = 30
+	MMFR_OP    = 28
+	MMFR_PA    = 23
+	MMFR_RA    = 18
+	MMFR_TA    = 16
+
+	ENETx_MSCR    = 0x044
+	MSCR_HOLDTIME = 8
+	MSCR_MII      = 1
+
+	ENETx_RCR     = 0x084
+	RCR_MAX_FL    = 16
+	RCR_RMII_10T  = 9
+	RCR_RMII_MODE = 8
+	RCR_FCE       = 5
+	RCR_PROM      = 3
+	RCR_MII_MODE  = 2
+
+	ENETx_TCR = 0x0c4
+	TCR_FDEN  = 2
+
+	ENETx_PALR = 0x0e4
+	ENETx_PAUR = 0x0e8
+	ENETx_IAUR = 0x118
+	ENETx_IALR = 0x11c
+	ENETx_GAUR = 0x120
+	ENETx_GALR = 0x124
+
+	ENETx_TFWR  = 0x144
+	TFWR_STRFWD = 8
+
+	ENETx_RDSR = 0x180
+	ENETx_TDSR = 0x184
+	ENETx_MRBR = 0x188
+
+	// MDC = ipg_clk / ((MII_SPEED + 1) * 2), 2.36 MHz with a 66 MHz
+	// ipg_clk
+	ENET_MII_SPEED = 13
+
+	// ENET PLL (PLL6)
+	CCM_ANALOG_PLL_ENET    = 0x020c80e0
+	PLL_ENET_LOCK          = 31
+	PLL_ENET_ENET_25M_EN   = 21
+	PLL_ENET_ENET2_125M_EN = 20
+	PLL_ENET_BYPASS        = 16
+	PLL_ENET_ENET1_125M_EN = 13
+	PLL_ENET_POWERDOWN     = 12
+	PLL_ENET_ENET2_DIV     = 2
+	PLL_ENET_ENET1_DIV     = 0
+	// 50 MHz RMII reference clock
+	PLL_ENET_DIV_50MHZ = 0b01
+
+	CCM_CCGR1 = 0x020c406c
+	CCGR1_CG5 = 10
+
+	IOMUXC_GPR_GPR1       = 0x020e4004
+	GPR1_ENET2_TX_CLK_DIR = 18
+	GPR1_ENET1_TX_CLK_DIR = 17
+	GPR1_ENET2_CLK_SEL    = 14
+	GPR1_ENET1_CLK_SEL    = 13
+
+	// buffer descriptor status
+	BD_RX_E = 0x8000
+	BD_RX_W = 0x2000
+	BD_RX_L = 0x0800
+	// frame length violation, non-octet, CRC, overrun, truncated
+	BD_RX_ERR = 0x0020 | 0x0010 | 0x0004 | 0x0002 | 0x0001
+
+	BD_TX_R  = 0x8000
+	BD_TX_W  = 0x2000
+	BD_TX_L  = 0x0800
+	BD_TX_TC = 0x0400
+
+	ENET_BD_SIZE  = 8
+	ENET_RX_RING  = 16
+	ENET_TX_RING  = 8
+	ENET_BUF_SIZE = 1536
+	// minimum frame size, excluding FCS
+	ENET_MIN_FRAME = 60
+	ENET_MAX_FRAME = 1518
+
+	// IEEE 802.3 clause 22 PHY registers
+	MII_BMCR          = 0x00
+	BMCR_RESET        = 15
+	BMCR_ANENABLE     = 12
+	BMCR_ANRESTART    = 9
+	MII_BMSR          = 0x01
+	BMSR_ANEGCOMPLETE = 5
+	BMSR_LSTATUS      = 2
+	MII_PHYSID1       = 0x02
+	MII_PHYSID2       = 0x03
+	MII_ADVERTISE     = 0x04
+	MII_LPA           = 0x05
+	LPA_100FULL       = 8
+	LPA_100HALF       = 7
+	LPA_10FULL        = 6
+)
+
+var enetLog = newLogger("imx6_enet")
+
+// ENET represents the wired Ethernet controller of the board, if any.
+var ENET *fec
+
+// fec represents an Ethernet MAC controller in RMII mode, attached to a
+// clause 22 PHY.
+//
+// Interrupts are not serviced, therefore frame reception and transmission
+// completion are polled on the buffer descriptor rings.
+type fec struct {
+	sync.Mutex
+
+	// controller index (1-2)
+	Index int
+	// PHY address on the controller MDIO bus
+	PHY int
+	// board specific pad configuration
+	Pads func()
+	// board specific PHY configuration, applied after its reset
+	Fixup func(hw *fec) error
+
+	MAC net.HardwareAddr
+	// receive all frames, regardless of their destination
+	Promiscuous bool
+
+	// receive handler
+	Rx func(buf []byte)
+
+	base uint32
+
+	rxRing uint32
+	txRing uint32
+	rxBufs uint32
+	txBufs uint32
+	rxNext int
+	txNext int
+
+	link     bool
+	speed    int
+	duplex   bool
+	linkWait chan bool
+}
+
+func (hw *fec) mdio(op uint32, ra int, data uint16) (val uint16, err error) {
+	reg.Write(hw.base+ENETx_EIR, 1<<EIR_MII)
+
+	reg.Write(hw.base+ENETx_MMFR,
+		0b01<<MMFR_ST|
+			op<<MMFR_OP|
+			uint32(hw.PHY)<<MMFR_PA|
+			uint32(ra)<<MMFR_RA|
+			0b10<<MMFR_TA|
+			uint32(data))
+
+	if !reg.WaitFor(10*time.Millisecond, hw.base+ENETx_EIR, EIR_MII, 1, 1) {
+		return 0, errors.New("MDIO timeout")
+	}
+
+	reg.Write(hw.base+ENETx_EIR, 1<<EIR_MII)
+
+	return uint16(reg.Read(hw.base + ENETx_MMFR)), nil
+}
+
+// PHYRead reads a PHY register through the MDIO interface.
+func (hw *fec) PHYRead(ra int) (uint16, error) {
+	return hw.mdio(0b10, ra, 0)
+}
+
+// PHYWrite writes a PHY register through the MDIO interface.
+func (hw *fec) PHYWrite(ra int, data uint16) (err error) {
+	_, err = hw.mdio(0b01, ra, data)
+	return
+}
+
+func (hw *fec) clock() (err error) {
+	div := PLL_ENET_ENET1_DIV
+	en := PLL_ENET_ENET1_125M_EN
+	dir := GPR1_ENET1_TX_CLK_DIR
+	sel := GPR1_ENET1_CLK_SEL
+
+	if hw.Index == 2 {
+		div = PLL_ENET_ENET2_DIV
+		en = PLL_ENET_ENET2_125M_EN
+		dir = GPR1_ENET2_TX_CLK_DIR
+		sel = GPR1_ENET2_CLK_SEL
+	}
+
+	reg.SetN(CCM_ANALOG_PLL_ENET, div, 0b11, PLL_ENET_DIV_50MHZ)
+	reg.Clear(CCM_ANALOG_PLL_ENET, PLL_ENET_POWERDOWN)
+
+	if !reg.WaitFor(10*time.Millisecond, CCM_ANALOG_PLL_ENET, PLL_ENET_LOCK, 1, 1) {
+		return errors.New("ENET PLL lock timeout")
+	}
+
+	reg.Clear(CCM_ANALOG_PLL_ENET, PLL_ENET_BYPASS)
+	reg.Set(CCM_ANALOG_PLL_ENET, en)
+
+	// the reference clock is generated internally and driven on the
+	// ENETx_TX_CLK pad towards the PHY
+	reg.Set(IOMUXC_GPR_GPR1, dir)
+	reg.Clear(IOMUXC_GPR_GPR1, sel)
+
+	reg.SetN(CCM_CCGR1, CCGR1_CG5, 0b11, 0b11)
+
+	return
+}
+
+func (hw *fec) initRings() {
+	if hw.rxRing == 0 {
+		hw.rxRing, _ = dma.Reserve(ENET_RX_RING*ENET_BD_SIZE, 64)
+		hw.txRing, _ = dma.Reserve(ENET_TX_RING*ENET_BD_SIZE, 64)
+		hw.rxBufs, _ = dma.Reserve(ENET_RX_RING*ENET_BUF_SIZE, 64)
+		hw.txBufs, _ = dma.Reserve(ENET_TX_RING*ENET_BUF_SIZE, 64)
+	}
+
+	bd := make([]byte, ENET_BD_SIZE)
+
+	for i := 0; i < ENET_RX_RING; i++ {
+		status := uint16(BD_RX_E)
+
+		if i == ENET_RX_RING-1 {
+			status |= BD_RX_W
+		}
+
+		binary.LittleEndian.PutUint16(bd[0:], 0)
+		binary.LittleEndian.PutUint16(bd[2:], status)
+		binary.LittleEndian.PutUint32(bd[4:], hw.rxBufs+uint32(i*ENET_BUF_SIZE))
+
+		dma.Write(hw.rxRing, bd, i*ENET_BD_SIZE)
+	}
+
+	for i := 0; i < ENET_TX_RING; i++ {
+		var status uint16
+
+		if i == ENET_TX_RING-1 {
+			status |= BD_TX_W
+		}
+
+		binary.LittleEndian.PutUint16(bd[0:], 0)
+		binary.LittleEndian.PutUint16(bd[2:], status)
+		binary.LittleEndian.PutUint32(bd[4:], hw.txBufs+uint32(i*ENET_BUF_SIZE))
+
+		dma.Write(hw.txRing, bd, i*ENET_BD_SIZE)
+	}
+
+	hw.rxNext = 0
+	hw.txNext = 0
+}
+
+// Init initializes the controller and its PHY, link status is monitored in
+// a separate goroutine.
+func (hw *fec) Init() (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	switch hw.Index {
+	case 1:
+		hw.base = ENET1_BASE
+	case 2:
+		hw.base = ENET2_BASE
+	default:
+		return fmt.Errorf("invalid ENET%d", hw.Index)
+	}
+
+	if len(hw.MAC) != 6 {
+		return errors.New("invalid MAC address")
+	}
+
+	if err = hw.clock(); err != nil {
+		return
+	}
+
+	reg.Set(hw.base+ENETx_ECR, ECR_RESET)
+
+	if !reg.WaitFor(10*time.Millisecond, hw.base+ENETx_ECR, ECR_RESET, 1, 0) {
+		return errors.New("reset timeout")
+	}
+
+	// interrupts are not used
+	reg.Write(hw.base+ENETx_EIMR, 0)
+	reg.Write(hw.base+ENETx_EIR, 0xffffffff)
+
+	reg.Write(hw.base+ENETx_MSCR, ENET_MII_SPEED<<MSCR_MII)
+
+	if hw.Pads != nil {
+		hw.Pads()
+	}
+
+	if err = hw.PHYWrite(MII_BMCR, 1<<BMCR_RESET); err != nil {
+		return
+	}
+
+	for start := time.Now(); ; {
+		bmcr, err := hw.PHYRead(MII_BMCR)
+
+		if err != nil {
+			return err
+		}
+
+		if bmcr&(1<<BMCR_RESET) == 0 {
+			break
+		}
+
+		if time.Since(start) > 500*time.Millisecond {
+			return errors.New("PHY reset timeout")
+		}
+	}
+
+	if hw.Fixup != nil {
+		if err = hw.Fixup(hw); err != nil {
+			return
+		}
+	}
+
+	id1, _ := hw.PHYRead(MII_PHYSID1)
+	id2, _ := hw.PHYRead(MII_PHYSID2)
+
+	enetLog.Infof("ENET%d PHY %d, id %#04x:%#04x", hw.Index, hw.PHY, id1, id2)
+
+	if err = hw.PHYWrite(MII_BMCR, 1<<BMCR_ANENABLE|1<<BMCR_ANRESTART); err != nil {
+		return
+	}
+
+	reg.Write(hw.base+ENETx_PALR, binary.BigEndian.Uint32(hw.MAC[0:4]))
+	reg.Write(hw.base+ENETx_PAUR, uint32(binary.BigEndian.Uint16(hw.MAC[4:6]))<<16|0x8808)
+
+	// no hash filtering
+	reg.Write(hw.base+ENETx_IAUR, 0)
+	reg.Write(hw.base+ENETx_IALR, 0)
+	reg.Write(hw.base+ENETx_GAUR, 0)
+	reg.Write(hw.base+ENETx_GALR, 0)
+
+	hw.initRings()
+
+	reg.Write(hw.base+ENETx_RDSR, hw.rxRing)
+	reg.Write(hw.base+ENETx_TDSR, hw.txRing)
+	reg.Write(hw.base+ENETx_MRBR, ENET_BUF_SIZE)
+
+	reg.Write(hw.base+ENETx_RCR, ENET_MAX_FRAME<<RCR_MAX_FL|1<<RCR_RMII_MODE|1<<RCR_MII_MODE)
+
+	if hw.Promiscuous {
+		reg.Set(hw.base+ENETx_RCR, RCR_PROM)
+	}
+	reg.Write(hw.base+ENETx_TCR, 0)
+	reg.Write(hw.base+ENETx_TFWR, 1<<TFWR_STRFWD)
+
+	// little-endian buffer descriptors
+	reg.Write(hw.base+ENETx_ECR, 1<<ECR_DBSWP|1<<ECR_ETHEREN)
+	reg.Write(hw.base+ENETx_RDAR, 1<<RDAR_RDAR)
+
+	hw.linkWait = make(chan bool, 1)
+
+	go hw.monitor()
+
+	return
+}
+
+// adjust reconfigures the MAC according to the negotiated link speed and
+// duplex mode.
+func (hw *fec) adjust() {
+	rcr := hw.base + ENETx_RCR
+
+	if hw.speed == 10 {
+		reg.Set(rcr, RCR_RMII_10T)
+	} else {
+		reg.Clear(rcr, RCR_RMII_10T)
+	}
+
+	// TCR can only be changed with the transmitter stopped
+	reg.Clear(hw.base+ENETx_ECR, ECR_ETHEREN)
+
+	if hw.duplex {
+		reg.Set(hw.base+ENETx_TCR, TCR_FDEN)
+	} else {
+		reg.Clear(hw.base+ENETx_TCR, TCR_FDEN)
+	}
+
+	// disabling the controller resets the ring pointers
+	hw.initRings()
+	reg.Set(hw.base+ENETx_ECR, ECR_ETHEREN)
+	reg.Write(hw.base+ENETx_RDAR, 1<<RDAR_RDAR)
+}
+
+// monitor polls the PHY link status and logs its changes.
+func (hw *fec) monitor() {
+	for {
+		time.Sleep(500 * time.Millisecond)
+
+		hw.Lock()
+
+		// the latched low link status requires a double read
+		hw.PHYRead(MII_BMSR)
+		bmsr, err := hw.PHYRead(MII_BMSR)
+
+		if err != nil {
+			hw.Unlock()
+			continue
+		}
+
+		link := bmsr&(1<<BMSR_LSTATUS) != 0 && bmsr&(1<<BMSR_ANEGCOMPLETE) != 0
+
+		if link == hw.link {
+			hw.Unlock()
+			continue
+		}
+
+		hw.link = link
+
+		if !link {
+			enetLog.Infof("ENET%d link down", hw.Index)
+			hw.Unlock()
+			continue
+		}
+
+		adv, _ := hw.PHYRead(MII_ADVERTISE)
+		lpa, _ := hw.PHYRead(MII_LPA)
+		common := adv & lpa
+
+		switch {
+		case common&(1<<LPA_100FULL) != 0:
+			hw.speed, hw.duplex = 100, true
+		case common&(1<<LPA_100HALF) != 0:
+			hw.speed, hw.duplex = 100, false
+		case common&(1<<LPA_10FULL) != 0:
+			hw.speed, hw.duplex = 10, true
+		default:
+			hw.speed, hw.duplex = 10, false
+		}
+
+		hw.adjust()
+
+		duplex := "half"
+
+		if hw.duplex {
+			duplex = "full"
+		}
+
+		enetLog.Infof("ENET%d link up, %d Mbps %s duplex", hw.Index, hw.speed, duplex)
+
+		hw.Unlock()
+
+		select {
+		case hw.linkWait <- true:
+		default:
+		}
+	}
+}
+
+// Link returns the current link status.
+func (hw *fec) Link() bool {
+	hw.Lock()
+	defer hw.Unlock()
+
+	return hw.link
+}
+
+// WaitLink waits for the link to be established.
+func (hw *fec) WaitLink(timeout time.Duration) bool {
+	if hw.Link() {
+		return true
+	}
+
+	select {
+	case <-hw.linkWait:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Tx transmits an Ethernet frame, excluding FCS.
+func (hw *fec) Tx(frame []byte) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if len(frame) > ENET_MAX_FRAME-4 {
+		return errors.New("frame too large")
+	}
+
+	if len(frame) < ENET_MIN_FRAME {
+		frame = append(frame, make([]byte, ENET_MIN_FRAME-len(frame))...)
+	}
+
+	bd := make([]byte, ENET_BD_SIZE)
+	off := hw.txNext * ENET_BD_SIZE
+
+	for start := time.Now(); ; {
+		dma.Read(hw.txRing, off, bd)
+
+		if binary.LittleEndian.Uint16(bd[2:])&BD_TX_R == 0 {
+			break
+		}
+
+		if time.Since(start) > 100*time.Millisecond {
+			return errors.New("transmit timeout")
+		}
+
+		runtime.Gosched()
+	}
+
+	dma.Write(hw.txBufs, frame, hw.txNext*ENET_BUF_SIZE)
+
+	status := uint16(BD_TX_R | BD_TX_L | BD_TX_TC)
+
+	if hw.txNext == ENET_TX_RING-1 {
+		status |= BD_TX_W
+	}
+
+	binary.LittleEndian.PutUint16(bd[0:], uint16(len(frame)))
+	binary.LittleEndian.PutUint16(bd[2:], status)
+	dma.Write(hw.txRing, bd, off)
+
+	reg.Write(hw.base+ENETx_TDAR, 1<<TDAR_TDAR)
+
+	hw.txNext = (hw.txNext + 1) % ENET_TX_RING
+
+	return
+}
+
+// rx returns the next received frame, if any, excluding FCS.
+func (hw *fec) rx() (frame []byte) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	bd := make([]byte, ENET_BD_SIZE)
+	off := hw.rxNext * ENET_BD_SIZE
+
+	dma.Read(hw.rxRing, off, bd)
+
+	status := binary.LittleEndian.Uint16(bd[2:])
+
+	if status&BD_RX_E != 0 {
+		return
+	}
+
+	length := int(binary.LittleEndian.Uint16(bd[0:]))
+
+	if status&BD_RX_ERR == 0 && status&BD_RX_L != 0 && length > 4 && length <= ENET_BUF_SIZE {
+		frame = make([]byte, length-4)
+		dma.Read(hw.rxBufs, hw.rxNext*ENET_BUF_SIZE, frame)
+	}
+
+	status = BD_RX_E
+
+	if hw.rxNext == ENET_RX_RING-1 {
+		status |= BD_RX_W
+	}
+
+	binary.LittleEndian.PutUint16(bd[0:], 0)
+	binary.LittleEndian.PutUint16(bd[2:], status)
+	dma.Write(hw.rxRing, bd, off)
+
+	reg.Write(hw.base+ENETx_RDAR, 1<<RDAR_RDAR)
+
+	hw.rxNext = (hw.rxNext + 1) % ENET_RX_RING
+
+	return
+}
+
+// Start polls the receive ring, passing valid frames to the receive handler.
+func (hw *fec) Start() {
+	for {
+		frame := hw.rx()
+
+		if frame == nil {
+			runtime.Gosched()
+			continue
+		}
+
+		if hw.Rx != nil {
+			hw.Rx(frame)
+		}
+	}
+}
+
+// ethernetRx injects an Ethernet frame into a link endpoint, the frame is
+// copied once as the network stack retains its payload (e.g. in TCP receive
+// queues) beyond the caller buffer reuse.
+func ethernetRx(link *channel.Endpoint, frame []byte) {
+	if len(frame) < header.EthernetMinimumSize {
+		return
+	}
+
+	eth := header.Ethernet(frame)
+	v := buffer.NewViewFromBytes(frame)
+
+	pkt := &stack.PacketBuffer{
+		LinkHeader: v[0:header.EthernetMinimumSize],
+		Data:       v[header.EthernetMinimumSize:].ToVectorisedView(),
+	}
+
+	link.InjectLinkAddr(eth.Type(), eth.SourceAddress(), pkt)
+}
+
+// ethernetTx returns the next Ethernet frame from a link endpoint, waiting
+// until one is available or the context is done.
+func ethernetTx(ctx context.Context, link *channel.Endpoint, src tcpip.LinkAddress) (frame []byte, valid bool) {
+	info, valid := link.ReadContext(ctx)
+
+	if !valid {
+		return
+	}
+
+	return ethernetFrame(info, src), true
+}
+
+// ethernetFrame encodes an outbound packet as Ethernet frame.
+func ethernetFrame(info channel.PacketInfo, src tcpip.LinkAddress) (frame []byte) {
+	frame = make([]byte, ethernetFrameSize(info))
+	ethernetEncode(frame, info, src, info.Route.RemoteLinkAddress)
+
+	return
+}
+
+// ethernetFrameSize returns the Ethernet frame size of an outbound packet.
+func ethernetFrameSize(info channel.PacketInfo) int {
+	return header.EthernetMinimumSize + info.Pkt.Header.UsedLength() + info.Pkt.Data.Size()
+}
+
+// ethernetEncode encodes an outbound packet as Ethernet frame in a buffer,
+// which must fit it (see ethernetFrameSize), returning the frame size.
+func ethernetEncode(buf []byte, info channel.PacketInfo, src tcpip.LinkAddress, dst tcpip.LinkAddress) (n int) {
+	if dst == "" {
+		dst = header.EthernetBroadcastAddress
+	}
+
+	header.Ethernet(buf).Encode(&header.EthernetFields{
+		SrcAddr: src,
+		DstAddr: dst,
+		Type:    info.Proto,
+	})
+
+	n = header.EthernetMinimumSize
+	n += copy(buf[n:], info.Pkt.Header.View())
+
+	for _, v := range info.Pkt.Data.Views() {
+		n += copy(buf[n:], v)
+	}
+
+	return
+}
+
+// StartEthernet brings up the board wired Ethernet interface, configures it
+// with DHCP (or the `eth_ip` setting) and starts the network services on it.
+func StartEthernet() (err error) {
+	hw := ENET
+
+	if hw == nil {
+		return errors.New("no Ethernet controller on this board")
+	}
+
+	if hw.MAC, err = net.ParseMAC(ethMAC); err != nil {
+		return
+	}
+
+	if err = hw.Init(); err != nil {
+		return
+	}
+
+	s := newStack(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{
+			ipv4.NewProtocol(),
+			arp.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{
+			tcp.NewProtocol(),
+			icmp.NewProtocol4()},
+	})
+
+	link := addNIC(s, 1, ethMAC, MTU)
+	link.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+
+	// IPv6 link-local and SLAAC addressing (see ipv6.go)
+	configureIPv6(s, 1, "")
+
+	client := &dhcpClient{
+		MAC: hw.MAC,
+		Tx:  hw.Tx,
+	}
+
+	if conf.Bool("nat", false) {
+		NAT = &natTable{
+			Tx:  hw.Tx,
+			MAC: tcpip.LinkAddress(hw.MAC),
+			Local: func(addr tcpip.Address) bool {
+				return s.CheckLocalAddress(1, ipv4.ProtocolNumber, addr) != 0
+			},
+		}
+	}
+
+	hw.Rx = func(frame []byte) {
+		bootPacket()
+
+		if client.Handle(frame) {
+			return
+		}
+
+		if NAT != nil && NAT.Outbound(frame) {
+			return
+		}
+
+		ethernetRx(link, frame)
+	}
+
+	go hw.Start()
+
+	go func() {
+		src := tcpip.LinkAddress(hw.MAC)
+
+		for {
+			frame, valid := ethernetTx(context.Background(), link, src)
+
+			if !valid {
+				continue
+			}
+
+			hw.Tx(frame)
+		}
+	}()
+
+	go func() {
+		timeout := time.Duration(conf.Int("eth_link_timeout", 10)) * time.Second
+
+		if !hw.WaitLink(timeout) {
+			enetLog.Infof("ENET%d no link, services not started", hw.Index)
+			return
+		}
+
+		var lease *dhcpLease
+
+		if ip := conf.String("eth_ip", ""); ip != "" {
+			lease, err = staticLease(ip, conf.String("eth_gateway", ""))
+		} else {
+			lease, err = client.Request(10 * time.Second)
+		}
+
+		if err != nil {
+			enetLog.Errorf("ENET%d configuration error, %v", hw.Index, err)
+			return
+		}
+
+		lease.Configure(s, 1)
+
+		enetLog.Infof("ENET%d configured %s", hw.Index, lease)
+
+		startServices(s, lease.Addr, 1)
+
+		if lease.Duration > 0 {
+			client.Renew(lease)
+		}
+	}()
+
+	return
+}
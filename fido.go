@@ -0,0 +1,612 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+)
+
+// CTAPHID (FIDO CTAP 2.0, 8.1 USB Human Interface Device) transport
+const (
+	CTAPHID_PACKET_SIZE = 64
+	CTAPHID_INIT_DATA   = CTAPHID_PACKET_SIZE - 7
+	CTAPHID_CONT_DATA   = CTAPHID_PACKET_SIZE - 5
+	CTAPHID_MAX_MSG     = CTAPHID_INIT_DATA + 128*CTAPHID_CONT_DATA
+	CTAPHID_BROADCAST   = 0xffffffff
+
+	CTAPHID_PING  = 0x81
+	CTAPHID_MSG   = 0x83
+	CTAPHID_INIT  = 0x86
+	CTAPHID_WINK  = 0x88
+	CTAPHID_CBOR  = 0x90
+	CTAPHID_ERROR = 0xbf
+
+	CTAPHID_ERR_INVALID_CMD     = 0x01
+	CTAPHID_ERR_INVALID_LEN     = 0x03
+	CTAPHID_ERR_INVALID_SEQ     = 0x04
+	CTAPHID_ERR_CHANNEL_BUSY    = 0x06
+	CTAPHID_ERR_INVALID_CHANNEL = 0x0b
+
+	CTAPHID_CAPABILITY_WINK = 0x01
+	CTAPHID_CAPABILITY_CBOR = 0x04
+	CTAPHID_CAPABILITY_NMSG = 0x08
+)
+
+var fidoLog = newLogger("fido")
+
+// CTAP2 commands and status codes
+const (
+	CTAP2_MAKE_CREDENTIAL = 0x01
+	CTAP2_GET_ASSERTION   = 0x02
+	CTAP2_GET_INFO        = 0x04
+	CTAP2_RESET           = 0x07
+
+	CTAP2_OK                        = 0x00
+	CTAP1_ERR_INVALID_COMMAND       = 0x01
+	CTAP2_ERR_INVALID_CBOR          = 0x12
+	CTAP2_ERR_MISSING_PARAMETER     = 0x14
+	CTAP2_ERR_CREDENTIAL_EXCLUDED   = 0x19
+	CTAP2_ERR_UNSUPPORTED_ALGORITHM = 0x26
+	CTAP2_ERR_NO_CREDENTIALS        = 0x2e
+	CTAP2_ERR_INVALID_OPTION        = 0x2c
+	CTAP2_ERR_UNSUPPORTED_OPTION    = 0x2b
+	CTAP1_ERR_OTHER                 = 0x7f
+)
+
+const (
+	COSE_ALG_ES256 = -7
+
+	FIDO_FLAG_USER_PRESENT             = 0x01
+	FIDO_FLAG_ATTESTED_CREDENTIAL_DATA = 0x40
+
+	// HID class requests (HID 1.11, 7.2 Class-Specific Requests)
+	HID_SET_IDLE = 0x0a
+)
+
+// FIDO HID report descriptor (FIDO Alliance usage page, 64 bytes reports)
+var fidoReportDescriptor = []byte{
+	0x06, 0xd0, 0xf1, // Usage Page (FIDO Alliance)
+	0x09, 0x01, // Usage (CTAPHID)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x20, //   Usage (Input Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, CTAPHID_PACKET_SIZE, //   Report Count (64)
+	0x81, 0x02, //   Input (Data, Var, Abs)
+	0x09, 0x21, //   Usage (Output Report Data)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x00, //   Logical Maximum (255)
+	0x75, 0x08, //   Report Size (8)
+	0x95, CTAPHID_PACKET_SIZE, //   Report Count (64)
+	0x91, 0x02, //   Output (Data, Var, Abs)
+	0xc0, // End Collection
+}
+
+// fidoAAGUID identifies the authenticator model
+var fidoAAGUID = []byte("TamaGo-FIDO2-dev")
+
+// fidoAuthenticator implements a CTAP2 authenticator without resident
+// credentials, credential private keys are wrapped in credential IDs sealed
+// with the DCP device unique key (see secrets.go) and therefore only usable
+// on the device which created them.
+//
+// User presence is assumed as the target boards lack a dedicated button,
+// signature counters are not implemented (always zero).
+type fidoAuthenticator struct {
+	sync.Mutex
+
+	// CTAPHID channel allocation and message assembly
+	nextCID uint32
+	cid     uint32
+	cmd     byte
+	msg     []byte
+	size    int
+	seq     int
+
+	// IN reports queue
+	out chan []byte
+}
+
+// FIDO is the authenticator instance exposed over USB HID.
+var FIDO *fidoAuthenticator
+
+func fidoError(code byte) []byte {
+	return []byte{code}
+}
+
+// sealCredential wraps a credential private key, bound to its relying party
+// ID hash, in a credential ID.
+func sealCredential(priv *ecdsa.PrivateKey, rpIDHash []byte) ([]byte, error) {
+	payload := make([]byte, 32)
+	priv.D.FillBytes(payload)
+	payload = append(payload, rpIDHash...)
+
+	return sealBlob(payload)
+}
+
+// unsealCredential returns the private key wrapped in a credential ID, if
+// valid for the relying party ID hash.
+func unsealCredential(id []byte, rpIDHash []byte) (priv *ecdsa.PrivateKey, err error) {
+	payload, err := unsealBlob(id)
+
+	if err != nil {
+		return
+	}
+
+	if len(payload) != 64 || !bytes.Equal(payload[32:], rpIDHash) {
+		return nil, errors.New("invalid credential")
+	}
+
+	priv = &ecdsa.PrivateKey{D: new(big.Int).SetBytes(payload[0:32])}
+	priv.PublicKey.Curve = elliptic.P256()
+	priv.PublicKey.X, priv.PublicKey.Y = priv.PublicKey.Curve.ScalarBaseMult(payload[0:32])
+
+	return
+}
+
+// coseKey returns the COSE_Key representation of a P-256 public key.
+func coseKey(pub *ecdsa.PublicKey) map[interface{}]interface{} {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+
+	return map[interface{}]interface{}{
+		1:  2,              // kty: EC2
+		3:  COSE_ALG_ES256, // alg: ES256
+		-1: 1,              // crv: P-256
+		-2: x,
+		-3: y,
+	}
+}
+
+func fidoAuthData(rpIDHash []byte, flags byte, attested []byte) []byte {
+	authData := append([]byte{}, rpIDHash...)
+	authData = append(authData, flags)
+	// signature counter
+	authData = append(authData, 0, 0, 0, 0)
+
+	return append(authData, attested...)
+}
+
+func fidoSign(priv *ecdsa.PrivateKey, authData []byte, clientDataHash []byte) ([]byte, error) {
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+	return priv.Sign(rand.Reader, digest[:], nil)
+}
+
+func fidoResponse(res map[interface{}]interface{}) []byte {
+	buf, err := cborEncode(res)
+
+	if err != nil {
+		return fidoError(CTAP1_ERR_OTHER)
+	}
+
+	return append([]byte{CTAP2_OK}, buf...)
+}
+
+func (f *fidoAuthenticator) getInfo() []byte {
+	return fidoResponse(map[interface{}]interface{}{
+		1: []interface{}{"FIDO_2_0"},
+		3: fidoAAGUID,
+		4: map[interface{}]interface{}{
+			"rk":   false,
+			"up":   true,
+			"plat": false,
+		},
+		5: CTAPHID_MAX_MSG,
+	})
+}
+
+func (f *fidoAuthenticator) makeCredential(req map[interface{}]interface{}) []byte {
+	clientDataHash, ok1 := req[int64(1)].([]byte)
+	rp, ok2 := req[int64(2)].(map[interface{}]interface{})
+	params, ok3 := req[int64(4)].([]interface{})
+
+	if !ok1 || !ok2 || !ok3 {
+		return fidoError(CTAP2_ERR_MISSING_PARAMETER)
+	}
+
+	rpID, ok := rp["id"].(string)
+
+	if !ok {
+		return fidoError(CTAP2_ERR_MISSING_PARAMETER)
+	}
+
+	if options, ok := req[int64(7)].(map[interface{}]interface{}); ok {
+		if rk, _ := options["rk"].(bool); rk {
+			return fidoError(CTAP2_ERR_UNSUPPORTED_OPTION)
+		}
+
+		if uv, _ := options["uv"].(bool); uv {
+			return fidoError(CTAP2_ERR_INVALID_OPTION)
+		}
+	}
+
+	supported := false
+
+	for _, p := range params {
+		if p, ok := p.(map[interface{}]interface{}); ok && p["alg"] == int64(COSE_ALG_ES256) && p["type"] == "public-key" {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return fidoError(CTAP2_ERR_UNSUPPORTED_ALGORITHM)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	if excludeList, ok := req[int64(5)].([]interface{}); ok {
+		for _, c := range excludeList {
+			if c, ok := c.(map[interface{}]interface{}); ok {
+				if id, ok := c["id"].([]byte); ok {
+					if _, err := unsealCredential(id, rpIDHash[:]); err == nil {
+						return fidoError(CTAP2_ERR_CREDENTIAL_EXCLUDED)
+					}
+				}
+			}
+		}
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return fidoError(CTAP1_ERR_OTHER)
+	}
+
+	id, err := sealCredential(priv, rpIDHash[:])
+
+	if err != nil {
+		fidoLog.Errorf("credential sealing error, %v", err)
+		return fidoError(CTAP1_ERR_OTHER)
+	}
+
+	pub, err := cborEncode(coseKey(&priv.PublicKey))
+
+	if err != nil {
+		return fidoError(CTAP1_ERR_OTHER)
+	}
+
+	// attested credential data
+	attested := append([]byte{}, fidoAAGUID...)
+	attested = append(attested, byte(len(id)>>8), byte(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, pub...)
+
+	authData := fidoAuthData(rpIDHash[:], FIDO_FLAG_USER_PRESENT|FIDO_FLAG_ATTESTED_CREDENTIAL_DATA, attested)
+
+	// self attestation, signed with the credential private key
+	sig, err := fidoSign(priv, authData, clientDataHash)
+
+	if err != nil {
+		return fidoError(CTAP1_ERR_OTHER)
+	}
+
+	fidoLog.Infof("created credential for %s", rpID)
+
+	return fidoResponse(map[interface{}]interface{}{
+		1: "packed",
+		2: authData,
+		3: map[interface{}]interface{}{
+			"alg": COSE_ALG_ES256,
+			"sig": sig,
+		},
+	})
+}
+
+func (f *fidoAuthenticator) getAssertion(req map[interface{}]interface{}) []byte {
+	rpID, ok1 := req[int64(1)].(string)
+	clientDataHash, ok2 := req[int64(2)].([]byte)
+
+	if !ok1 || !ok2 {
+		return fidoError(CTAP2_ERR_MISSING_PARAMETER)
+	}
+
+	allowList, _ := req[int64(3)].([]interface{})
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	// without resident credentials only allowed ones can be used
+	for _, c := range allowList {
+		c, ok := c.(map[interface{}]interface{})
+
+		if !ok {
+			continue
+		}
+
+		id, ok := c["id"].([]byte)
+
+		if !ok {
+			continue
+		}
+
+		priv, err := unsealCredential(id, rpIDHash[:])
+
+		if err != nil {
+			continue
+		}
+
+		authData := fidoAuthData(rpIDHash[:], FIDO_FLAG_USER_PRESENT, nil)
+		sig, err := fidoSign(priv, authData, clientDataHash)
+
+		if err != nil {
+			return fidoError(CTAP1_ERR_OTHER)
+		}
+
+		fidoLog.Infof("signed assertion for %s", rpID)
+
+		return fidoResponse(map[interface{}]interface{}{
+			1: map[interface{}]interface{}{
+				"id":   id,
+				"type": "public-key",
+			},
+			2: authData,
+			3: sig,
+		})
+	}
+
+	return fidoError(CTAP2_ERR_NO_CREDENTIALS)
+}
+
+// handleCBOR processes a CTAP2 request.
+func (f *fidoAuthenticator) handleCBOR(msg []byte) []byte {
+	if len(msg) < 1 {
+		return fidoError(CTAP1_ERR_INVALID_COMMAND)
+	}
+
+	if msg[0] == CTAP2_GET_INFO {
+		return f.getInfo()
+	}
+
+	if msg[0] == CTAP2_RESET {
+		// credentials are not stored, nothing to reset
+		return []byte{CTAP2_OK}
+	}
+
+	v, err := cborDecode(msg[1:])
+
+	if err != nil {
+		return fidoError(CTAP2_ERR_INVALID_CBOR)
+	}
+
+	req, ok := v.(map[interface{}]interface{})
+
+	if !ok {
+		return fidoError(CTAP2_ERR_INVALID_CBOR)
+	}
+
+	switch msg[0] {
+	case CTAP2_MAKE_CREDENTIAL:
+		return f.makeCredential(req)
+	case CTAP2_GET_ASSERTION:
+		return f.getAssertion(req)
+	}
+
+	return fidoError(CTAP1_ERR_INVALID_COMMAND)
+}
+
+// send fragments a CTAPHID response in IN reports.
+func (f *fidoAuthenticator) send(cid uint32, cmd byte, data []byte) {
+	pkt := make([]byte, CTAPHID_PACKET_SIZE)
+	binary.BigEndian.PutUint32(pkt[0:4], cid)
+	pkt[4] = cmd
+	binary.BigEndian.PutUint16(pkt[5:7], uint16(len(data)))
+	n := copy(pkt[7:], data)
+	f.out <- pkt
+
+	for seq := 0; n < len(data); seq++ {
+		pkt = make([]byte, CTAPHID_PACKET_SIZE)
+		binary.BigEndian.PutUint32(pkt[0:4], cid)
+		pkt[4] = byte(seq)
+		n += copy(pkt[5:], data[n:])
+		f.out <- pkt
+	}
+}
+
+func (f *fidoAuthenticator) sendError(cid uint32, code byte) {
+	f.send(cid, CTAPHID_ERROR, []byte{code})
+}
+
+func (f *fidoAuthenticator) handle(cid uint32, cmd byte, msg []byte) {
+	switch cmd {
+	case CTAPHID_INIT:
+		if len(msg) != 8 {
+			f.sendError(cid, CTAPHID_ERR_INVALID_LEN)
+			return
+		}
+
+		newCID := cid
+
+		if cid == CTAPHID_BROADCAST {
+			f.nextCID += 1
+			newCID = f.nextCID
+		}
+
+		res := append([]byte{}, msg...)
+		res = append(res, byte(newCID>>24), byte(newCID>>16), byte(newCID>>8), byte(newCID))
+		// protocol version, device version (major, minor, build)
+		res = append(res, 2, 0, 1, 0)
+		res = append(res, CTAPHID_CAPABILITY_WINK|CTAPHID_CAPABILITY_CBOR|CTAPHID_CAPABILITY_NMSG)
+
+		f.send(cid, cmd, res)
+	case CTAPHID_PING:
+		f.send(cid, cmd, msg)
+	case CTAPHID_WINK:
+		fidoLog.Infof("wink")
+		f.send(cid, cmd, nil)
+	case CTAPHID_CBOR:
+		f.send(cid, cmd, f.handleCBOR(msg))
+	default:
+		// CTAPHID_MSG (U2F) is not supported
+		f.sendError(cid, CTAPHID_ERR_INVALID_CMD)
+	}
+}
+
+// Rx implements the FIDO HID interface OUT endpoint function.
+func (f *fidoAuthenticator) Rx(buf []byte, lastErr error) (res []byte, err error) {
+	if len(buf) < CTAPHID_PACKET_SIZE {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	cid := binary.BigEndian.Uint32(buf[0:4])
+
+	if cid == 0 || (cid > f.nextCID && cid != CTAPHID_BROADCAST) {
+		f.sendError(cid, CTAPHID_ERR_INVALID_CHANNEL)
+		return
+	}
+
+	if buf[4]&0x80 != 0 {
+		// initialization packet
+		if f.msg != nil && cid != f.cid {
+			f.sendError(cid, CTAPHID_ERR_CHANNEL_BUSY)
+			return
+		}
+
+		if cid == CTAPHID_BROADCAST && buf[4] != CTAPHID_INIT {
+			f.sendError(cid, CTAPHID_ERR_INVALID_CHANNEL)
+			return
+		}
+
+		f.cid = cid
+		f.cmd = buf[4]
+		f.size = int(binary.BigEndian.Uint16(buf[5:7]))
+		f.seq = 0
+
+		if f.size > CTAPHID_MAX_MSG {
+			f.msg = nil
+			f.sendError(cid, CTAPHID_ERR_INVALID_LEN)
+			return
+		}
+
+		f.msg = append([]byte{}, buf[7:]...)
+	} else {
+		// continuation packet
+		if f.msg == nil || cid != f.cid {
+			return
+		}
+
+		if int(buf[4]) != f.seq {
+			f.msg = nil
+			f.sendError(cid, CTAPHID_ERR_INVALID_SEQ)
+			return
+		}
+
+		f.seq += 1
+		f.msg = append(f.msg, buf[5:]...)
+	}
+
+	if len(f.msg) < f.size {
+		return
+	}
+
+	msg := f.msg[:f.size]
+	f.msg = nil
+
+	f.handle(cid, f.cmd, msg)
+
+	return
+}
+
+// Tx implements the FIDO HID interface IN endpoint function.
+func (f *fidoAuthenticator) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case in = <-f.out:
+	default:
+	}
+
+	return
+}
+
+func fidoSetup(setup *usb.SetupData) (in []byte, err error) {
+	if setup.Request == HID_SET_IDLE {
+		return
+	}
+
+	return nil, fmt.Errorf("unsupported request code: %#x", setup.Request)
+}
+
+// addFIDOInterface adds a FIDO HID interface to the USB device, next to
+// Ethernet over USB.
+func addFIDOInterface(device *usb.Device, configurationIndex int) {
+	imx6.DCP.Init()
+
+	FIDO = &fidoAuthenticator{
+		out: make(chan []byte, CTAPHID_MAX_MSG/CTAPHID_CONT_DATA+1),
+	}
+
+	iface := &usb.InterfaceDescriptor{}
+	iface.SetDefaults()
+
+	iface.NumEndpoints = 2
+	// HID class, no subclass or protocol
+	iface.InterfaceClass = 3
+
+	iInterface, _ := device.AddString(`FIDO2 Authenticator`)
+	iface.Interface = iInterface
+
+	iface.IAD = &usb.InterfaceAssociationDescriptor{}
+	iface.IAD.SetDefaults()
+	iface.IAD.InterfaceCount = 1
+	iface.IAD.FunctionClass = iface.InterfaceClass
+	iface.IAD.Function = iInterface
+
+	// HID descriptor (HID 1.11, 6.2.1 HID Descriptor), the report
+	// descriptor is requested with a standard GET_DESCRIPTOR request which
+	// the USB driver currently does not pass to class handlers.
+	hid := []byte{
+		9,          // bLength
+		0x21,       // bDescriptorType: HID
+		0x11, 0x01, // bcdHID: 1.11
+		0,    // bCountryCode
+		1,    // bNumDescriptors
+		0x22, // bDescriptorType: Report
+		byte(len(fidoReportDescriptor)), 0,
+	}
+
+	iface.ClassDescriptors = append(iface.ClassDescriptors, hid)
+
+	ep3IN := &usb.EndpointDescriptor{}
+	ep3IN.SetDefaults()
+	ep3IN.EndpointAddress = 0x83
+	ep3IN.Attributes = 3
+	ep3IN.MaxPacketSize = CTAPHID_PACKET_SIZE
+	ep3IN.Interval = 4
+	ep3IN.Zero = false
+	ep3IN.Function = FIDO.Tx
+
+	ep3OUT := &usb.EndpointDescriptor{}
+	ep3OUT.SetDefaults()
+	ep3OUT.EndpointAddress = 0x03
+	ep3OUT.Attributes = 3
+	ep3OUT.MaxPacketSize = CTAPHID_PACKET_SIZE
+	ep3OUT.Interval = 4
+	ep3OUT.Zero = false
+	ep3OUT.Function = FIDO.Rx
+
+	iface.Endpoints = append(iface.Endpoints, ep3IN, ep3OUT)
+
+	device.Configurations[configurationIndex].AddInterface(iface)
+	addInterfaceSetup(device, iface, fidoSetup)
+}
@@ -9,8 +9,8 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,28 +19,31 @@ import (
 	"github.com/f-secure-foundry/tamago/soc/imx6/usdhc"
 )
 
+var usdhcLog = newLogger("imx6_usdhc")
+var fsLog = newLogger("fs")
+
 var cards []*usdhc.USDHC
 
-func TestUSDHC(card *usdhc.USDHC, count int, readSize int) {
-	err := card.Detect()
+func TestUSDHC(card *usdhc.USDHC, count int, readSize int) (err error) {
+	err = card.Detect()
 
 	if err != nil {
-		log.Printf("imx6_usdhc: card error, %v", err)
+		usdhcLog.Errorf("card error, %v", err)
 	} else {
 		info := card.Info()
 		capacity := int64(info.BlockSize) * int64(info.Blocks)
 		giga := capacity / (1000 * 1000 * 1000)
 		gibi := capacity / (1024 * 1024 * 1024)
 
-		log.Printf("imx6_usdhc: %d GB/%d GiB card detected %+v", giga, gibi, info)
+		usdhcLog.Infof("%d GB/%d GiB card detected %+v", giga, gibi, info)
 
 		start := time.Now()
 
 		for i := 0; i < count; i += readSize {
-			_, err := card.Read(int64(i), int64(readSize))
+			_, err = card.Read(int64(i), int64(readSize))
 
 			if err != nil {
-				log.Printf("imx6_usdhc: card read error, %v", err)
+				usdhcLog.Errorf("card read error, %v", err)
 				return
 			}
 		}
@@ -49,16 +52,16 @@ func TestUSDHC(card *usdhc.USDHC, count int, readSize int) {
 		megaps := (float64(count) / (1000 * 1000)) / elapsed.Seconds()
 		mebips := (float64(count) / (1024 * 1024)) / elapsed.Seconds()
 
-		log.Printf("imx6_usdhc: read %d MiB in %s (%.2f MB/s | %.2f MiB/s)", count/(1024*1024), elapsed, megaps, mebips)
+		usdhcLog.Infof("read %d MiB in %s (%.2f MB/s | %.2f MiB/s)", count/(1024*1024), elapsed, megaps, mebips)
 	}
-}
 
-func TestFile() {
-	var err error
+	return
+}
 
+func TestFile() (err error) {
 	defer func() {
 		if err != nil {
-			log.Printf("TestFile error: %v", err)
+			fsLog.Errorf("TestFile error: %v", err)
 		}
 	}()
 
@@ -66,7 +69,7 @@ func TestFile() {
 	fileName := "tamago.txt"
 	path := filepath.Join(dirPath, fileName)
 
-	log.Printf("writing %d bytes to %s", len(banner), path)
+	fsLog.Infof("writing %d bytes to %s", len(banner), path)
 
 	err = os.MkdirAll(dirPath, 0700)
 
@@ -77,57 +80,62 @@ func TestFile() {
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	_, err = file.WriteString(banner)
 
 	if err != nil {
-		panic(err)
+		return
 	}
 	file.Close()
 
 	read, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	if strings.Compare(banner, string(read)) != 0 {
-		log.Println("TestFile: comparison fail")
+		err = errors.New("comparison fail")
 	} else {
-		log.Printf("read %s (%d bytes)", path, len(read))
+		fsLog.Infof("read %s (%d bytes)", path, len(read))
 	}
+
+	return
 }
 
-func TestDir() {
+func TestDir() (err error) {
 	dirPath := "/dir"
 
-	log.Printf("listing directory %s", dirPath)
+	fsLog.Infof("listing directory %s", dirPath)
 
 	f, err := os.Open(dirPath)
 
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer f.Close()
 
 	d, err := f.Stat()
 
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	if !d.IsDir() {
-		panic("expected directory")
+		return errors.New("expected directory")
 	}
 
 	files, err := f.Readdir(-1)
 
 	if err != nil {
-		panic(err)
+		return
 	}
 
 	for _, i := range files {
-		log.Printf("%s/%s (%d bytes)", dirPath, i.Name(), i.Size())
+		fsLog.Infof("%s/%s (%d bytes)", dirPath, i.Name(), i.Size())
 	}
+
+	return
 }
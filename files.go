@@ -0,0 +1,234 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/fat"
+)
+
+// The file server exposes, under /files/, the FAT filesystem of a memory card
+// partition (`files_card`, `files_partition`), with range requests support.
+// When `files_upload` is set new files can be created, over HTTPS only, with
+// PUT requests or multipart form uploads on directories. Existing files are
+// never overwritten. Responses are sandboxed and files served as attachments,
+// so that uploaded content never runs within the device origin.
+const (
+	FILES_PREFIX     = "/files"
+	FILES_MAX_UPLOAD = 64 * 1024 * 1024
+	FILES_FORM_FIELD = "file"
+	// in-memory multipart form data limit
+	FILES_FORM_MEMORY = 1024 * 1024
+)
+
+var filesLog = newLogger("files")
+
+// filesLock serializes uploads with respect to reads.
+var filesLock sync.RWMutex
+
+// openFiles opens the FAT filesystem served by the file server.
+func openFiles() (fs *fat.FS, err error) {
+	r, err := cardPartition(conf.Int("files_card", 0), conf.Int("files_partition", 1))
+
+	if err != nil {
+		return
+	}
+
+	return fat.Open(r)
+}
+
+func filesPath(r *http.Request) string {
+	return path.Clean("/" + strings.TrimPrefix(r.URL.Path, FILES_PREFIX))
+}
+
+func listFiles(w http.ResponseWriter, r *http.Request, fs *fat.FS, dir string) {
+	list, err := fs.ReadDir(dir)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	fmt.Fprintf(w, "<html><body><h1>%s</h1><pre>\n", html.EscapeString(dir))
+
+	if dir != "/" {
+		fmt.Fprintf(w, "<a href=\"../\">../</a>\n")
+	}
+
+	for _, fi := range list {
+		name := fi.Name
+
+		if fi.Mode.IsDir() {
+			name += "/"
+		}
+
+		link := url.URL{Path: name}
+
+		fmt.Fprintf(w, "%s %10d <a href=\"%s\">%s</a>\n",
+			fi.ModTime.Format("2006-01-02 15:04"), fi.Size, link.String(), html.EscapeString(name))
+	}
+
+	fmt.Fprintf(w, "</pre>")
+
+	if conf.Bool("files_upload", false) && r.TLS != nil {
+		fmt.Fprintf(w, `<form method="post" enctype="multipart/form-data"><input type="file" name="%s"> <input type="submit" value="upload"></form>`, FILES_FORM_FIELD)
+	}
+
+	fmt.Fprintf(w, "</body></html>")
+}
+
+func serveFiles(w http.ResponseWriter, r *http.Request) {
+	filesLock.RLock()
+	defer filesLock.RUnlock()
+
+	fs, err := openFiles()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	p := filesPath(r)
+	fi, err := fs.Stat(p)
+
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if fi.Mode.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+
+		listFiles(w, r, fs, p)
+		return
+	}
+
+	f, err := fs.Open(p)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// uploaded files are never rendered within the device origin
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name})
+
+	if disposition == "" {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Disposition", disposition)
+
+	// ServeContent handles range and conditional requests
+	http.ServeContent(w, r, fi.Name, fi.ModTime, io.NewSectionReader(f, 0, f.Size()))
+}
+
+func createFile(name string, body io.Reader) (size int64, err error) {
+	filesLock.Lock()
+	defer filesLock.Unlock()
+
+	fs, err := openFiles()
+
+	if err != nil {
+		return
+	}
+
+	mtime := time.Time{}
+
+	if TimeSet() {
+		mtime = Now()
+	}
+
+	return fs.Create(name, body, mtime)
+}
+
+func uploadFiles(w http.ResponseWriter, r *http.Request) {
+	if !conf.Bool("files_upload", false) {
+		http.Error(w, "uploads disabled", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.TLS == nil {
+		http.Error(w, "uploads are only accepted over HTTPS", http.StatusForbidden)
+		return
+	}
+
+	name := filesPath(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(conf.Int("files_max_upload", FILES_MAX_UPLOAD)))
+	body := io.Reader(r.Body)
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseMultipartForm(FILES_FORM_MEMORY); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		f, hdr, err := r.FormFile(FILES_FORM_FIELD)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+
+		name = path.Join(name, path.Base(hdr.Filename))
+		body = f
+	}
+
+	size, err := createFile(name, body)
+
+	switch {
+	case errors.Is(err, os.ErrExist):
+		http.Error(w, "file exists", http.StatusConflict)
+	case errors.Is(err, os.ErrNotExist):
+		http.NotFound(w, r)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		filesLog.Infof("created %s (%d bytes) from %s", name, size, r.RemoteAddr)
+		w.Header().Set("Location", FILES_PREFIX+name)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %d\n", name, size)
+	}
+}
+
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		serveFiles(w, r)
+	case http.MethodPut, http.MethodPost:
+		uploadFiles(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
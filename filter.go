@@ -0,0 +1,386 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// packet directions
+const (
+	FILTER_IN  = "in"
+	FILTER_OUT = "out"
+	FILTER_FWD = "fwd"
+	FILTER_ANY = "any"
+)
+
+// filterRule represents a stateless packet filter rule, in the form
+// `<allow|drop> <in|out|fwd|any> <tcp|udp|icmp|any> <cidr|any> [port]`.
+//
+// The address matches either the source or the destination address, the
+// port either the source or the destination TCP/UDP port.
+type filterRule struct {
+	allow bool
+	dir   string
+	proto string
+	net   *net.IPNet
+	port  int
+
+	hits uint64
+}
+
+func parseFilterRule(s string) (r *filterRule, err error) {
+	f := strings.Fields(s)
+
+	if len(f) < 4 || len(f) > 5 {
+		return nil, fmt.Errorf("invalid rule %q", s)
+	}
+
+	r = &filterRule{}
+
+	switch f[0] {
+	case "allow":
+		r.allow = true
+	case "drop":
+	default:
+		return nil, fmt.Errorf("invalid action %q", f[0])
+	}
+
+	switch f[1] {
+	case FILTER_IN, FILTER_OUT, FILTER_FWD, FILTER_ANY:
+		r.dir = f[1]
+	default:
+		return nil, fmt.Errorf("invalid direction %q", f[1])
+	}
+
+	switch f[2] {
+	case "tcp", "udp", "icmp", "any":
+		r.proto = f[2]
+	default:
+		return nil, fmt.Errorf("invalid protocol %q", f[2])
+	}
+
+	if f[3] != "any" {
+		if _, r.net, err = net.ParseCIDR(f[3]); err != nil || r.net.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid address %q", f[3])
+		}
+	}
+
+	if len(f) == 5 {
+		if r.proto != "tcp" && r.proto != "udp" {
+			return nil, errors.New("port requires tcp or udp protocol")
+		}
+
+		if r.port, err = strconv.Atoi(f[4]); err != nil || r.port <= 0 || r.port > 0xffff {
+			return nil, fmt.Errorf("invalid port %q", f[4])
+		}
+	}
+
+	return
+}
+
+func (r *filterRule) String() string {
+	action := "drop"
+
+	if r.allow {
+		action = "allow"
+	}
+
+	addr := "any"
+
+	if r.net != nil {
+		addr = r.net.String()
+	}
+
+	s := fmt.Sprintf("%s %s %s %s", action, r.dir, r.proto, addr)
+
+	if r.port != 0 {
+		s += fmt.Sprintf(" %d", r.port)
+	}
+
+	return s
+}
+
+func (r *filterRule) match(dir string, ip header.IPv4) bool {
+	if r.dir != FILTER_ANY && r.dir != dir {
+		return false
+	}
+
+	proto := ip.TransportProtocol()
+
+	switch r.proto {
+	case "tcp":
+		if proto != header.TCPProtocolNumber {
+			return false
+		}
+	case "udp":
+		if proto != header.UDPProtocolNumber {
+			return false
+		}
+	case "icmp":
+		if proto != header.ICMPv4ProtocolNumber {
+			return false
+		}
+	}
+
+	if r.net != nil && !r.net.Contains(net.IP(ip.SourceAddress())) && !r.net.Contains(net.IP(ip.DestinationAddress())) {
+		return false
+	}
+
+	if r.port != 0 {
+		payload := ip.Payload()
+
+		// ports are only present in the first fragment
+		if ip.FragmentOffset() != 0 || len(payload) < 4 {
+			return false
+		}
+
+		// TCP and UDP share the port fields layout
+		udp := header.UDP(payload)
+
+		if int(udp.SourcePort()) != r.port && int(udp.DestinationPort()) != r.port {
+			return false
+		}
+	}
+
+	return true
+}
+
+// packetFilter implements a stateless IPv4 packet filter, rules are
+// evaluated in order and the first matching one applies, otherwise the
+// default policy is used.
+type packetFilter struct {
+	sync.Mutex
+
+	rules   []*filterRule
+	policy  bool
+	dropped uint64
+}
+
+// Firewall is the packet filter applied to all network interfaces.
+var Firewall = &packetFilter{policy: true}
+
+// Load replaces the filter rules and default policy.
+func (f *packetFilter) Load(rules []string, policy string) (err error) {
+	var parsed []*filterRule
+
+	for _, s := range rules {
+		r, err := parseFilterRule(s)
+
+		if err != nil {
+			return err
+		}
+
+		parsed = append(parsed, r)
+	}
+
+	if err = f.SetPolicy(policy); err != nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.rules = parsed
+
+	return
+}
+
+// Add appends a rule.
+func (f *packetFilter) Add(s string) (err error) {
+	r, err := parseFilterRule(s)
+
+	if err != nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.rules = append(f.rules, r)
+
+	return
+}
+
+// Delete removes a rule by its index.
+func (f *packetFilter) Delete(n int) (err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if n < 0 || n >= len(f.rules) {
+		return fmt.Errorf("invalid rule %d", n)
+	}
+
+	f.rules = append(f.rules[:n], f.rules[n+1:]...)
+
+	return
+}
+
+// SetPolicy sets the default policy.
+func (f *packetFilter) SetPolicy(policy string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	switch policy {
+	case "allow":
+		f.policy = true
+	case "drop":
+		f.policy = false
+	default:
+		return fmt.Errorf("invalid policy %q", policy)
+	}
+
+	return nil
+}
+
+// Allow evaluates the rules on an IPv4 packet.
+func (f *packetFilter) Allow(dir string, pkt []byte) bool {
+	ip := header.IPv4(pkt)
+
+	// malformed packets are left to the network stack
+	if len(pkt) < header.IPv4MinimumSize || !ip.IsValid(len(pkt)) {
+		return true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for _, r := range f.rules {
+		if r.match(dir, ip) {
+			r.hits += 1
+
+			if !r.allow {
+				f.dropped += 1
+			}
+
+			return r.allow
+		}
+	}
+
+	if !f.policy {
+		f.dropped += 1
+	}
+
+	return f.policy
+}
+
+// AllowFrame evaluates the rules on an Ethernet frame, only IPv4 frames are
+// filtered.
+func (f *packetFilter) AllowFrame(dir string, frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize || header.Ethernet(frame).Type() != header.IPv4ProtocolNumber {
+		return true
+	}
+
+	return f.Allow(dir, frame[header.EthernetMinimumSize:])
+}
+
+// Status returns the filter rules and counters.
+func (f *packetFilter) Status() string {
+	var buf bytes.Buffer
+
+	f.Lock()
+	defer f.Unlock()
+
+	for i, r := range f.rules {
+		fmt.Fprintf(&buf, "%3d %-48s %d hits\n", i, r, r.hits)
+	}
+
+	policy := "drop"
+
+	if f.policy {
+		policy = "allow"
+	}
+
+	fmt.Fprintf(&buf, "default policy: %s, %d packets dropped", policy, f.dropped)
+
+	return buf.String()
+}
+
+// filterEndpoint wraps a link endpoint to apply the packet filter on inbound
+// and outbound IPv4 packets, inbound packets are first passed to network
+// address translation (see nat.go).
+type filterEndpoint struct {
+	nested.Endpoint
+
+	lower stack.LinkEndpoint
+}
+
+func newFilterEndpoint(lower stack.LinkEndpoint) *filterEndpoint {
+	e := &filterEndpoint{lower: lower}
+	e.Endpoint.Init(lower, e)
+
+	return e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (e *filterEndpoint) DeliverNetworkPacket(remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if protocol == header.IPv4ProtocolNumber {
+		buf := pkt.Data.ToView()
+
+		if NAT != nil && NAT.Inbound(e.lower, buf) {
+			return
+		}
+
+		if !Firewall.Allow(FILTER_IN, buf) {
+			return
+		}
+	}
+
+	e.Endpoint.DeliverNetworkPacket(remote, local, protocol, pkt)
+}
+
+// WritePacket implements stack.LinkEndpoint.
+func (e *filterEndpoint) WritePacket(r *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) *tcpip.Error {
+	if protocol == header.IPv4ProtocolNumber {
+		buf := append(pkt.Header.View(), pkt.Data.ToView()...)
+
+		// dropped packets are silently discarded
+		if !Firewall.Allow(FILTER_OUT, buf) {
+			return nil
+		}
+	}
+
+	return e.Endpoint.WritePacket(r, gso, protocol, pkt)
+}
+
+func filterCommand(op string, arg string) (res string) {
+	var err error
+
+	switch op {
+	case "add":
+		err = Firewall.Add(arg)
+	case "del":
+		var n int
+
+		if n, err = strconv.Atoi(arg); err == nil {
+			err = Firewall.Delete(n)
+		}
+	case "policy":
+		err = Firewall.SetPolicy(arg)
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	auditf("settings.filter", "%s %s", op, arg)
+
+	return Firewall.Status()
+}
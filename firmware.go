@@ -0,0 +1,268 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// UpdateKey is the firmware update signing public key, a base64 encoded PKIX
+// DER Ed25519 or ECDSA P-256 key, set at build time (see UPDATE_KEY in the
+// Makefile).
+var UpdateKey string
+
+// FirmwareVersion is the running firmware version, a decimal number set at
+// build time (see FIRMWARE_VERSION in the Makefile).
+var FirmwareVersion string
+
+// Firmware images start with a `tamago-example firmware <version>` header
+// line, followed by the boot image, and must carry a detached signature of
+// both, by the UpdateKey private key, to be accepted:
+//
+//	Ed25519      signature over the image (RFC 8032, pure)
+//	ECDSA P-256  ASN.1 signature over the image SHA-256
+//
+// Images older than the running firmware version are refused, to prevent
+// rollback to older validly signed images.
+//
+// Images received on the /api/firmware route (see `tamagoctl push`) are
+// staged in memory once verified, so that they cannot be altered before use,
+// unsigned or invalid ones are refused, while the `firmware verify` command
+// verifies images on the in-memory filesystem. The example does not write
+// staged images to boot media. Images are not checked against the HAB SRK
+// hash, which the boot ROM verifies on secure booted devices.
+const (
+	FIRMWARE_MAX_SIZE   = 32 * 1024 * 1024
+	FIRMWARE_HEADER     = "tamago-example firmware "
+	FIRMWARE_HEADER_MAX = 64
+)
+
+var firmwareLog = newLogger("firmware")
+
+// stagedFirmware holds the last verified image, only in memory.
+var stagedFirmware struct {
+	sync.Mutex
+
+	image   []byte
+	version uint64
+	digest  [32]byte
+}
+
+// runningVersion returns the build time firmware version.
+func runningVersion() (uint64, error) {
+	if FirmwareVersion == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(FirmwareVersion, 10, 32)
+}
+
+// imageVersion returns the version of a firmware image header.
+func imageVersion(image []byte) (version uint64, err error) {
+	n := bytes.IndexByte(image, '\n')
+
+	if n < 0 || n > FIRMWARE_HEADER_MAX || !bytes.HasPrefix(image, []byte(FIRMWARE_HEADER)) {
+		return 0, errors.New("invalid header")
+	}
+
+	if version, err = strconv.ParseUint(string(image[len(FIRMWARE_HEADER):n]), 10, 32); err != nil {
+		return 0, errors.New("invalid header version")
+	}
+
+	return
+}
+
+// updateKey returns the build time firmware update public key.
+func updateKey() (pub interface{}, err error) {
+	if UpdateKey == "" {
+		return nil, errors.New("no update key, set UPDATE_KEY at build time")
+	}
+
+	der, err := base64.StdEncoding.DecodeString(UpdateKey)
+
+	if err != nil {
+		return
+	}
+
+	if pub, err = x509.ParsePKIXPublicKey(der); err != nil {
+		return
+	}
+
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported update key curve")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported update key type %T", pub)
+	}
+
+	return
+}
+
+// verifyFirmware verifies the signature of a firmware image against the build
+// time update key, and its version against the running one.
+func verifyFirmware(image []byte, sig []byte) (version uint64, err error) {
+	pub, err := updateKey()
+
+	if err != nil {
+		return
+	}
+
+	if len(sig) == 0 {
+		return 0, errors.New("unsigned image")
+	}
+
+	if len(image) > FIRMWARE_MAX_SIZE {
+		return 0, errors.New("image too large")
+	}
+
+	valid := false
+
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, image, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(image)
+		valid = ecdsa.VerifyASN1(k, digest[:], sig)
+	}
+
+	if !valid {
+		return 0, errors.New("invalid signature")
+	}
+
+	// the header is only parsed once authenticated
+	if version, err = imageVersion(image); err != nil {
+		return
+	}
+
+	current, err := runningVersion()
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid running version, %v", err)
+	}
+
+	if version < current {
+		return 0, fmt.Errorf("version %d older than running version %d", version, current)
+	}
+
+	return
+}
+
+// checkFirmware verifies a firmware image, recording the result in the audit
+// log.
+func checkFirmware(name string, image []byte, sig []byte) (version uint64, digest [32]byte, err error) {
+	digest = sha256.Sum256(image)
+
+	if version, err = verifyFirmware(image, sig); err != nil {
+		firmwareLog.Warnf("refused %s (SHA-256 %x), %v", name, digest, err)
+		auditf("firmware.refused", "%s, SHA-256 %x, %v", name, digest, err)
+		return
+	}
+
+	firmwareLog.Infof("verified %s version %d (SHA-256 %x)", name, version, digest)
+	auditf("firmware.verified", "%s, version %d, SHA-256 %x", name, version, digest)
+
+	return
+}
+
+// firmwareHandler receives a firmware image, with its base64 encoded detached
+// signature in the `sig` query parameter, and stages it only once verified.
+func firmwareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("sig"))
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid signature encoding, %v", err), http.StatusBadRequest)
+		return
+	}
+
+	image, err := ioutil.ReadAll(io.LimitReader(r.Body, FIRMWARE_MAX_SIZE+1))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, digest, err := checkFirmware("upload", image, sig)
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("refused, %v", err), http.StatusForbidden)
+		return
+	}
+
+	stagedFirmware.Lock()
+	defer stagedFirmware.Unlock()
+
+	stagedFirmware.image = image
+	stagedFirmware.version = version
+	stagedFirmware.digest = digest
+
+	fmt.Fprintf(w, "staged version %d, %d bytes, SHA-256 %x\n", version, len(image), digest)
+}
+
+func firmwareCommand(imagePath string, sigPath string) (res string) {
+	if imagePath == "" {
+		pub, err := updateKey()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		res = fmt.Sprintf("update key: %T, SHA-256 %x\nrunning version: %s", pub, sha256.Sum256(der), FirmwareVersion)
+
+		stagedFirmware.Lock()
+		defer stagedFirmware.Unlock()
+
+		if stagedFirmware.image != nil {
+			res += fmt.Sprintf("\nstaged version: %d, %d bytes, SHA-256 %x", stagedFirmware.version, len(stagedFirmware.image), stagedFirmware.digest)
+		}
+
+		return
+	}
+
+	image, err := ioutil.ReadFile(imagePath)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	sig, err := ioutil.ReadFile(sigPath)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	version, digest, err := checkFirmware(imagePath, image, sig)
+
+	if err != nil {
+		return fmt.Sprintf("refused, %v", err)
+	}
+
+	return fmt.Sprintf("verified version %d, %d bytes, SHA-256 %x", version, len(image), digest)
+}
@@ -0,0 +1,408 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// FlexCAN registers
+// (Flexible Controller Area Network (FLEXCAN), IMX6ULLRM).
+const (
+	CAN1_BASE = 0x02090000
+	CAN2_BASE = 0x02094000
+
+	CAN_MCR     = 0x00
+	MCR_MDIS    = 31
+	MCR_FRZ     = 30
+	MCR_HALT    = 28
+	MCR_NOTRDY  = 27
+	MCR_SOFTRST = 25
+	MCR_FRZACK  = 24
+	MCR_LPMACK  = 20
+	MCR_SRXDIS  = 17
+	MCR_IRMQ    = 16
+	MCR_MAXMB   = 0
+
+	CAN_CTRL1     = 0x04
+	CTRL1_PRESDIV = 24
+	CTRL1_RJW     = 22
+	CTRL1_PSEG1   = 19
+	CTRL1_PSEG2   = 16
+	CTRL1_CLKSRC  = 13
+	CTRL1_LPB     = 12
+	CTRL1_PROPSEG = 0
+
+	CAN_TIMER  = 0x08
+	CAN_ECR    = 0x1c
+	CAN_ESR1   = 0x20
+	CAN_IMASK1 = 0x28
+	CAN_IFLAG1 = 0x30
+
+	CAN_MB     = 0x80
+	CAN_RXIMR  = 0x880
+	MB_SIZE    = 16
+	MB_COUNT   = 16
+	MB_CS_CODE = 24
+	MB_CS_SRR  = 22
+	MB_CS_IDE  = 21
+	MB_CS_DLC  = 16
+	MB_ID_STD  = 18
+
+	CODE_RX_EMPTY    = 0b0100
+	CODE_RX_FULL     = 0b0010
+	CODE_RX_OVERRUN  = 0b0110
+	CODE_TX_INACTIVE = 0b1000
+	CODE_TX_DATA     = 0b1100
+
+	// message buffer assignments
+	CAN_RX_MB = 0
+	CAN_TX_MB = 8
+
+	CCM_CSCMR2      = 0x020c4020
+	CSCMR2_CAN_PODF = 2
+	CSCMR2_CAN_SEL  = 8
+)
+
+var canLog = newLogger("imx6_can")
+
+// canFrame represents a CAN 2.0 data frame.
+type canFrame struct {
+	ID       uint32
+	Extended bool
+	Data     []byte
+}
+
+func (f *canFrame) String() string {
+	if f.Extended {
+		return fmt.Sprintf("%08x [%d] % x", f.ID, len(f.Data), f.Data)
+	}
+
+	return fmt.Sprintf("%03x [%d] % x", f.ID, len(f.Data), f.Data)
+}
+
+// flexCAN represents a FlexCAN controller instance.
+type flexCAN struct {
+	base uint32
+
+	// bus speed in bit/s
+	Bitrate uint32
+	// internal loopback
+	Loopback bool
+
+	// receive acceptance filter
+	FilterID   uint32
+	FilterMask uint32
+}
+
+// canClock returns the CAN serial clock root frequency.
+func canClock() uint32 {
+	var freq uint32
+
+	switch reg.Get(CCM_CSCMR2, CSCMR2_CAN_SEL, 0b11) {
+	case 0b00:
+		// pll3_sw_clk / 8
+		freq = 60000000
+	case 0b01:
+		freq = 24000000
+	case 0b10:
+		// pll3_sw_clk / 6
+		freq = 80000000
+	default:
+		return 0
+	}
+
+	return freq / (reg.Get(CCM_CSCMR2, CSCMR2_CAN_PODF, 0b111111) + 1)
+}
+
+// timing returns the CTRL1 bit timing fields for the configured bit rate,
+// using between 8 and 25 time quanta per bit and a sample point around 75%.
+func (hw *flexCAN) timing() (ctrl1 uint32, err error) {
+	clk := canClock()
+
+	for tq := uint32(25); tq >= 8; tq-- {
+		if clk%(hw.Bitrate*tq) != 0 {
+			continue
+		}
+
+		presdiv := clk/(hw.Bitrate*tq) - 1
+
+		if presdiv > 0xff {
+			break
+		}
+
+		pseg2 := tq / 4
+
+		if pseg2 < 2 {
+			pseg2 = 2
+		}
+
+		pseg1 := (tq - 1 - pseg2) / 2
+
+		if pseg1 > 8 {
+			pseg1 = 8
+		}
+
+		propseg := tq - 1 - pseg2 - pseg1
+
+		if propseg > 8 {
+			continue
+		}
+
+		// resynchronization jump width, up to 4 time quanta
+		rjw := pseg2 - 1
+
+		if rjw > 3 {
+			rjw = 3
+		}
+
+		ctrl1 = presdiv<<CTRL1_PRESDIV |
+			rjw<<CTRL1_RJW |
+			(pseg1-1)<<CTRL1_PSEG1 |
+			(pseg2-1)<<CTRL1_PSEG2 |
+			(propseg-1)<<CTRL1_PROPSEG
+
+		return
+	}
+
+	return 0, fmt.Errorf("unsupported bit rate %d (clock %d Hz)", hw.Bitrate, clk)
+}
+
+func (hw *flexCAN) mb(n int) uint32 {
+	return hw.base + CAN_MB + uint32(n*MB_SIZE)
+}
+
+func (hw *flexCAN) freeze(enable bool) bool {
+	mcr := hw.base + CAN_MCR
+
+	if enable {
+		reg.Set(mcr, MCR_FRZ)
+		reg.Set(mcr, MCR_HALT)
+
+		return reg.WaitFor(100*time.Millisecond, mcr, MCR_FRZACK, 1, 1)
+	}
+
+	reg.Clear(mcr, MCR_HALT)
+	reg.Clear(mcr, MCR_FRZ)
+
+	return reg.WaitFor(100*time.Millisecond, mcr, MCR_FRZACK, 1, 0)
+}
+
+// Init initializes the controller, configures bit timing and the receive
+// message buffer filter.
+func (hw *flexCAN) Init() (err error) {
+	mcr := hw.base + CAN_MCR
+
+	ctrl1, err := hw.timing()
+
+	if err != nil {
+		return
+	}
+
+	// the clock source can only be selected while disabled
+	reg.Set(mcr, MCR_MDIS)
+
+	if !reg.WaitFor(100*time.Millisecond, mcr, MCR_LPMACK, 1, 1) {
+		return errors.New("disable timeout")
+	}
+
+	reg.Set(hw.base+CAN_CTRL1, CTRL1_CLKSRC)
+	reg.Clear(mcr, MCR_MDIS)
+
+	reg.Set(mcr, MCR_SOFTRST)
+
+	if !reg.WaitFor(100*time.Millisecond, mcr, MCR_SOFTRST, 1, 0) {
+		return errors.New("reset timeout")
+	}
+
+	if !hw.freeze(true) {
+		return errors.New("freeze timeout")
+	}
+
+	// individual masking, self reception (for loopback)
+	reg.Set(mcr, MCR_IRMQ)
+	reg.Clear(mcr, MCR_SRXDIS)
+	reg.SetN(mcr, MCR_MAXMB, 0x7f, MB_COUNT-1)
+
+	ctrl1 |= 1 << CTRL1_CLKSRC
+
+	if hw.Loopback {
+		ctrl1 |= 1 << CTRL1_LPB
+	}
+
+	reg.Write(hw.base+CAN_CTRL1, ctrl1)
+
+	for i := 0; i < MB_COUNT; i++ {
+		reg.Write(hw.mb(i), 0)
+		reg.Write(hw.mb(i)+4, 0)
+		reg.Write(hw.base+CAN_RXIMR+uint32(i*4), 0)
+	}
+
+	// standard identifier filter
+	reg.Write(hw.base+CAN_RXIMR+CAN_RX_MB*4, hw.FilterMask<<MB_ID_STD)
+	reg.Write(hw.mb(CAN_RX_MB)+4, hw.FilterID<<MB_ID_STD)
+	reg.Write(hw.mb(CAN_RX_MB), CODE_RX_EMPTY<<MB_CS_CODE)
+
+	reg.Write(hw.mb(CAN_TX_MB), CODE_TX_INACTIVE<<MB_CS_CODE)
+
+	// flags are polled, interrupts are not used
+	reg.Write(hw.base+CAN_IMASK1, 0)
+	reg.Write(hw.base+CAN_IFLAG1, 0xffffffff)
+
+	if !hw.freeze(false) {
+		return errors.New("unfreeze timeout")
+	}
+
+	if !reg.WaitFor(100*time.Millisecond, mcr, MCR_NOTRDY, 1, 0) {
+		return errors.New("controller not ready")
+	}
+
+	return
+}
+
+// Tx transmits a standard identifier frame.
+func (hw *flexCAN) Tx(f *canFrame, timeout time.Duration) (err error) {
+	if len(f.Data) > 8 || f.Extended {
+		return errors.New("unsupported frame")
+	}
+
+	mb := hw.mb(CAN_TX_MB)
+	data := make([]byte, 8)
+	copy(data, f.Data)
+
+	reg.Write(mb, CODE_TX_INACTIVE<<MB_CS_CODE)
+	reg.Write(mb+4, f.ID<<MB_ID_STD)
+	reg.Write(mb+8, binary.BigEndian.Uint32(data[0:4]))
+	reg.Write(mb+12, binary.BigEndian.Uint32(data[4:8]))
+	reg.Write(mb, CODE_TX_DATA<<MB_CS_CODE|uint32(len(f.Data))<<MB_CS_DLC)
+
+	if !reg.WaitFor(timeout, hw.base+CAN_IFLAG1, CAN_TX_MB, 1, 1) {
+		reg.Write(mb, CODE_TX_INACTIVE<<MB_CS_CODE)
+		return fmt.Errorf("transmit timeout (ESR1:%#x ECR:%#x)", reg.Read(hw.base+CAN_ESR1), reg.Read(hw.base+CAN_ECR))
+	}
+
+	reg.Write(hw.base+CAN_IFLAG1, 1<<CAN_TX_MB)
+
+	return
+}
+
+// Rx returns a frame accepted by the receive filter, if available.
+func (hw *flexCAN) Rx() (f *canFrame, overrun bool) {
+	if reg.Get(hw.base+CAN_IFLAG1, CAN_RX_MB, 1) == 0 {
+		return
+	}
+
+	mb := hw.mb(CAN_RX_MB)
+
+	// reading the control word locks the message buffer
+	cs := reg.Read(mb)
+	id := reg.Read(mb + 4)
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], reg.Read(mb+8))
+	binary.BigEndian.PutUint32(data[4:8], reg.Read(mb+12))
+
+	dlc := (cs >> MB_CS_DLC) & 0xf
+
+	if dlc > 8 {
+		dlc = 8
+	}
+
+	f = &canFrame{
+		ID:       (id >> MB_ID_STD) & 0x7ff,
+		Extended: (cs>>MB_CS_IDE)&1 == 1,
+		Data:     data[0:dlc],
+	}
+
+	if f.Extended {
+		f.ID = id & 0x1fffffff
+	}
+
+	overrun = (cs>>MB_CS_CODE)&0xf == CODE_RX_OVERRUN
+
+	reg.Write(hw.base+CAN_IFLAG1, 1<<CAN_RX_MB)
+	reg.Write(mb, CODE_RX_EMPTY<<MB_CS_CODE)
+
+	// reading the free running timer unlocks the message buffer
+	reg.Read(hw.base + CAN_TIMER)
+
+	return
+}
+
+// TestFlexCAN sends periodic frames, and a frame which does not match the
+// receive filter, logging all received frames.
+func TestFlexCAN() (err error) {
+	base := uint32(CAN1_BASE)
+
+	if conf.Int("can_port", 1) == 2 {
+		base = CAN2_BASE
+	}
+
+	id := uint32(conf.Int("can_id", 0x123)) & 0x7ff
+
+	hw := &flexCAN{
+		base:       base,
+		Bitrate:    uint32(conf.Int("can_bitrate", 500000)),
+		Loopback:   !conf.Bool("can_external", false),
+		FilterID:   uint32(conf.Int("can_filter", int(id))) & 0x7ff,
+		FilterMask: uint32(conf.Int("can_mask", 0x7ff)) & 0x7ff,
+	}
+
+	if err = hw.Init(); err != nil {
+		return
+	}
+
+	count := conf.Int("can_frames", 10)
+	period := time.Duration(conf.Int("can_period", 100)) * time.Millisecond
+	received := 0
+
+	canLog.Infof("%d bit/s, filter %03x/%03x, loopback:%v", hw.Bitrate, hw.FilterID, hw.FilterMask, hw.Loopback)
+
+	for i := 0; i <= count; i++ {
+		f := &canFrame{
+			ID:   id,
+			Data: []byte{byte(i >> 8), byte(i), 0xca, 0xfe},
+		}
+
+		// the last frame is not expected to pass the filter
+		if i == count {
+			f.ID = ^hw.FilterID & 0x7ff
+		}
+
+		if err = hw.Tx(f, 100*time.Millisecond); err != nil {
+			return
+		}
+
+		time.Sleep(period)
+
+		for {
+			rx, overrun := hw.Rx()
+
+			if rx == nil {
+				break
+			}
+
+			received += 1
+			canLog.Infof("received %s (overrun:%v)", rx, overrun)
+		}
+	}
+
+	canLog.Infof("sent %d frames, received %d", count+1, received)
+
+	if hw.Loopback && received != count && hw.FilterID == id && hw.FilterMask == 0x7ff {
+		return fmt.Errorf("expected %d frames", count)
+	}
+
+	return
+}
@@ -0,0 +1,202 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"runtime"
+	"time"
+)
+
+const (
+	FP_MATRIX_SIZE = 64
+	FP_FFT_SIZE    = 4096
+	// concurrent workers, each yielding the processor periodically to
+	// exercise floating point context switching
+	FP_WORKERS = 4
+)
+
+var fpLog = newLogger("fp")
+
+type matrix [][]float64
+
+func newMatrix(n int, fn func(i, j int) float64) (m matrix) {
+	m = make(matrix, n)
+
+	for i := range m {
+		m[i] = make([]float64, n)
+
+		for j := range m[i] {
+			m[i][j] = fn(i, j)
+		}
+	}
+
+	return
+}
+
+func (a matrix) mul(b matrix) (c matrix) {
+	n := len(a)
+	c = newMatrix(n, func(i, j int) float64 { return 0 })
+
+	for i := 0; i < n; i++ {
+		for k := 0; k < n; k++ {
+			aik := a[i][k]
+
+			for j := 0; j < n; j++ {
+				c[i][j] += aik * b[k][j]
+			}
+		}
+
+		// yield within the computation, rather than only between
+		// iterations, to switch context with live FP registers
+		runtime.Gosched()
+	}
+
+	return
+}
+
+// fft computes an in-place iterative radix-2 FFT, len(x) must be a power of
+// 2, the inverse transform is unscaled.
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+
+		j ^= bit
+
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+
+	if inverse {
+		sign = 1.0
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+
+		for start := 0; start < n; start += size {
+			wn := complex(1, 0)
+
+			for k := 0; k < size/2; k++ {
+				u := x[start+k]
+				v := x[start+k+size/2] * wn
+
+				x[start+k] = u + v
+				x[start+k+size/2] = u - v
+
+				wn *= w
+			}
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// fpWork performs one matrix multiplication and one FFT round trip,
+// returning a checksum of the results and the round trip maximum error.
+func fpWork(seed int) (sum float64, fftErr float64) {
+	a := newMatrix(FP_MATRIX_SIZE, func(i, j int) float64 {
+		return math.Sin(float64(seed + i*FP_MATRIX_SIZE + j))
+	})
+
+	b := newMatrix(FP_MATRIX_SIZE, func(i, j int) float64 {
+		return math.Cos(float64(seed + j*FP_MATRIX_SIZE + i))
+	})
+
+	for _, row := range a.mul(b) {
+		for _, v := range row {
+			sum += v
+		}
+	}
+
+	x := make([]complex128, FP_FFT_SIZE)
+	orig := make([]complex128, FP_FFT_SIZE)
+
+	for i := range x {
+		x[i] = complex(math.Sin(float64(seed+i)/7), math.Cos(float64(seed+i)/3))
+		orig[i] = x[i]
+	}
+
+	fft(x, false)
+
+	for _, v := range x {
+		sum += real(v) + imag(v)
+	}
+
+	fft(x, true)
+
+	for i := range x {
+		if e := cmplx.Abs(x[i]/complex(FP_FFT_SIZE, 0) - orig[i]); e > fftErr {
+			fftErr = e
+		}
+	}
+
+	return
+}
+
+// fpFlops returns the floating point operations performed by fpWork, using
+// the conventional 5 N log2(N) estimate for the FFT.
+func fpFlops() float64 {
+	n := float64(FP_MATRIX_SIZE)
+	mul := 2 * n * n * n
+	fft := 5 * FP_FFT_SIZE * math.Log2(FP_FFT_SIZE)
+
+	return mul + 2*fft
+}
+
+// TestFP benchmarks floating point performance and verifies that concurrent
+// goroutines, switching context while computing, obtain results identical
+// to a reference run.
+func TestFP() (err error) {
+	start := time.Now()
+	ref, fftErr := fpWork(0)
+	elapsed := time.Since(start)
+
+	fpLog.Infof("single run %s, %.2f MFLOPS (FFT round trip error %g)",
+		elapsed, fpFlops()/elapsed.Seconds()/1e6, fftErr)
+
+	if fftErr > 1e-9 {
+		return fmt.Errorf("FFT round trip error too large (%g)", fftErr)
+	}
+
+	res := make(chan float64, FP_WORKERS)
+	start = time.Now()
+
+	for i := 0; i < FP_WORKERS; i++ {
+		go func() {
+			sum, _ := fpWork(0)
+			res <- sum
+		}()
+	}
+
+	for i := 0; i < FP_WORKERS; i++ {
+		if sum := <-res; sum != ref {
+			err = errors.New("floating point state corrupted across goroutines")
+		}
+	}
+
+	elapsed = time.Since(start)
+
+	fpLog.Infof("%d concurrent runs %s, %.2f MFLOPS",
+		FP_WORKERS, elapsed, FP_WORKERS*fpFlops()/elapsed.Seconds()/1e6)
+
+	return
+}
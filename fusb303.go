@@ -0,0 +1,210 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build usbarmory
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// On the USB armory Mk II the USB-C receptacle is managed by a FUSB303 port
+// controller on I2C1 (UART4_TX_DATA/UART4_RX_DATA pads).
+const (
+	IOMUXC_SW_MUX_CTL_PAD_UART4_TX_DATA = 0x020e00b4
+	IOMUXC_SW_MUX_CTL_PAD_UART4_RX_DATA = 0x020e00b8
+	IOMUXC_I2C1_SCL_SELECT_INPUT        = 0x020e05a4
+	IOMUXC_I2C1_SDA_SELECT_INPUT        = 0x020e05a8
+
+	I2C1_MODE  = 2
+	I2C1_DAISY = 0b10
+
+	FUSB303_ADDR = 0x31
+
+	FUSB303_CONTROL  = 0x04
+	CONTROL_HOST_CUR = 1
+
+	FUSB303_CONTROL1 = 0x05
+	CONTROL1_ENABLE  = 3
+
+	FUSB303_STATUS = 0x11
+	STATUS_ATTACH  = 0
+	STATUS_BC_LVL  = 1
+	STATUS_VBUSOK  = 3
+	STATUS_ORIENT  = 4
+
+	FUSB303_TYPE   = 0x13
+	TYPE_AUDIO     = 0
+	TYPE_AUDIOVBUS = 1
+	TYPE_ACTIVECBL = 2
+	TYPE_SOURCE    = 3
+	TYPE_SINK      = 4
+	TYPE_DEBUGSNK  = 5
+	TYPE_DEBUGSRC  = 6
+)
+
+var usbcCurrent = []string{"none", "default", "1.5A", "3.0A"}
+var usbcOrientation = []string{"none", "CC1", "CC2", "fault"}
+
+// partner types, indexed by TYPE register bit
+var usbcPartner = []string{"audio", "audio (VBUS)", "active cable", "source", "sink", "debug sink", "debug source"}
+
+var usbc struct {
+	sync.Once
+
+	bus *i2cBus
+	err error
+}
+
+// usbcState represents the USB-C receptacle state.
+type usbcState struct {
+	Attached    bool
+	VBUS        bool
+	Orientation string
+	// partner type
+	Partner string
+	// Host is true when the partner is a sink, requiring the host role
+	Host bool
+	// partner current advertisement, when attached to a source
+	Current string
+	// current advertised to sinks
+	HostCurrent string
+}
+
+func usbcPads() {
+	ctl := uint32((1 << imx6.SW_PAD_CTL_ODE) | (1 << imx6.SW_PAD_CTL_PUE) | (1 << imx6.SW_PAD_CTL_PKE) |
+		(imx6.SW_PAD_CTL_PUS_PULL_UP_22K << imx6.SW_PAD_CTL_PUS) |
+		(imx6.SW_PAD_CTL_SPEED_100MHZ << imx6.SW_PAD_CTL_SPEED) |
+		(imx6.SW_PAD_CTL_DSE_2_R0_6 << imx6.SW_PAD_CTL_DSE))
+
+	for _, mux := range []uint32{IOMUXC_SW_MUX_CTL_PAD_UART4_TX_DATA, IOMUXC_SW_MUX_CTL_PAD_UART4_RX_DATA} {
+		reg.Write(mux, 1<<imx6.SW_MUX_CTL_SION|I2C1_MODE)
+		reg.Write(mux+IOMUXC_SW_PAD_CTL_OFFSET, ctl)
+	}
+
+	reg.Write(IOMUXC_I2C1_SCL_SELECT_INPUT, I2C1_DAISY)
+	reg.Write(IOMUXC_I2C1_SDA_SELECT_INPUT, I2C1_DAISY)
+}
+
+// usbcController returns the I2C bus of the port controller, enabling the
+// latter on first use.
+func usbcController() (*i2cBus, error) {
+	usbc.Do(func() {
+		usbcPads()
+
+		if usbc.bus, usbc.err = newI2C(1); usbc.err != nil {
+			return
+		}
+
+		ctl, err := usbc.bus.Read(FUSB303_ADDR, FUSB303_CONTROL1, 1)
+
+		if err != nil {
+			usbc.err = err
+			return
+		}
+
+		usbc.err = usbc.bus.Write(FUSB303_ADDR, FUSB303_CONTROL1, []byte{ctl[0] | 1<<CONTROL1_ENABLE})
+	})
+
+	return usbc.bus, usbc.err
+}
+
+func usbcStatus() (s *usbcState, err error) {
+	if !imx6.Native {
+		return nil, fmt.Errorf("unsupported under emulation")
+	}
+
+	bus, err := usbcController()
+
+	if err != nil {
+		return
+	}
+
+	ctl, err := bus.Read(FUSB303_ADDR, FUSB303_CONTROL, 1)
+
+	if err != nil {
+		return
+	}
+
+	status, err := bus.Read(FUSB303_ADDR, FUSB303_STATUS, 1)
+
+	if err != nil {
+		return
+	}
+
+	t, err := bus.Read(FUSB303_ADDR, FUSB303_TYPE, 1)
+
+	if err != nil {
+		return
+	}
+
+	s = &usbcState{
+		Attached:    status[0]&(1<<STATUS_ATTACH) != 0,
+		VBUS:        status[0]&(1<<STATUS_VBUSOK) != 0,
+		Orientation: usbcOrientation[(status[0]>>STATUS_ORIENT)&0b11],
+		HostCurrent: usbcCurrent[(ctl[0]>>CONTROL_HOST_CUR)&0b11],
+	}
+
+	var partner []string
+
+	for bit, name := range usbcPartner {
+		if t[0]&(1<<bit) != 0 {
+			partner = append(partner, name)
+		}
+	}
+
+	s.Partner = strings.Join(partner, ", ")
+	s.Host = t[0]&(1<<TYPE_SINK|1<<TYPE_DEBUGSNK) != 0
+
+	if t[0]&(1<<TYPE_SOURCE|1<<TYPE_DEBUGSRC) != 0 {
+		s.Current = usbcCurrent[(status[0]>>STATUS_BC_LVL)&0b11]
+	}
+
+	return
+}
+
+// usbcHost returns whether the attached partner requires the host role.
+func usbcHost() bool {
+	s, err := usbcStatus()
+	return err == nil && s.Host
+}
+
+func usbcCommand() (res string) {
+	s, err := usbcStatus()
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if !s.Attached {
+		return "detached"
+	}
+
+	role := "device"
+
+	if s.Host {
+		role = "host"
+	}
+
+	res = fmt.Sprintf("attached: %s (orientation %s, VBUS %v)\nrole: %s", s.Partner, s.Orientation, s.VBUS, role)
+
+	if s.Current != "" {
+		res += fmt.Sprintf("\ncurrent: %s", s.Current)
+	} else {
+		res += fmt.Sprintf("\nadvertised current: %s", s.HostCurrent)
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/f-secure-foundry/tamago-example/internal/blake3"
+)
+
+var hashLog = newLogger("hash")
+
+// hashBenchmark represents a hash function benchmarked on increasing input
+// sizes.
+type hashBenchmark struct {
+	name string
+	new  func() hash.Hash
+}
+
+func hashBenchmarks() []hashBenchmark {
+	return []hashBenchmark{
+		{"sha-256", sha256.New},
+		{"sha-512", sha512.New},
+		{"sha3-256", sha3.New256},
+		{"sha3-512", sha3.New512},
+		{"keccak-256", sha3.NewLegacyKeccak256},
+		{"blake2s-256", func() hash.Hash {
+			h, _ := blake2s.New256(nil)
+			return h
+		}},
+		{"blake2b-256", func() hash.Hash {
+			h, _ := blake2b.New256(nil)
+			return h
+		}},
+		{"blake3", blake3.New},
+	}
+}
+
+func hashSizes() (sizes []int, err error) {
+	for _, s := range conf.List("hash_sizes", []string{"64", "1024", "16384", "1048576"}) {
+		size, err := strconv.Atoi(s)
+
+		if err != nil || size <= 0 || size > 16*1024*1024 {
+			return nil, fmt.Errorf("invalid input size %s", s)
+		}
+
+		sizes = append(sizes, size)
+	}
+
+	return
+}
+
+// TestHash compares the throughput of SHA-2, SHA-3 (and legacy Keccak),
+// BLAKE2 and BLAKE3 hashing at each input size.
+func TestHash() (err error) {
+	sizes, err := hashSizes()
+
+	if err != nil {
+		return
+	}
+
+	duration := time.Duration(conf.Int("hash_duration", 500)) * time.Millisecond
+
+	for _, b := range hashBenchmarks() {
+		h := b.new()
+		sum := make([]byte, 0, h.Size())
+
+		for _, size := range sizes {
+			buf := make([]byte, size)
+			n := 0
+
+			start := markCycles()
+
+			// each iteration hashes a whole input, as content
+			// addressing does
+			for time.Since(start.at) < duration {
+				h.Reset()
+				h.Write(buf)
+				h.Sum(sum[:0])
+
+				n++
+			}
+
+			cycles, elapsed := start.Since()
+			rate := float64(n*size) / elapsed.Seconds() / (1024 * 1024)
+
+			hashLog.Infof("%-12s %8d bytes: %8d ops in %s (%.2f MiB/s, %.2f cycles/byte)", b.name, size, n, elapsed.Round(time.Millisecond), rate, float64(cycles)/float64(n*size))
+		}
+	}
+
+	return
+}
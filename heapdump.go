@@ -0,0 +1,257 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The runtime does not track live objects by type, they are therefore
+// estimated by size class, while the heap profile attributes them to their
+// allocation sites.
+const (
+	// size classes reported by the heap command
+	HEAP_TOP_CLASSES = 8
+)
+
+// heapClass represents the live objects of a size class.
+type heapClass struct {
+	size    uint32
+	objects int64
+	// live objects change since the previous snapshot
+	delta int64
+}
+
+// heapSnapshot represents the heap state after a forced garbage collection.
+type heapSnapshot struct {
+	at      time.Time
+	stats   runtime.MemStats
+	classes []heapClass
+}
+
+// lastHeap holds the previous snapshot, to report changes across soak test
+// iterations.
+var lastHeap struct {
+	sync.Mutex
+	*heapSnapshot
+}
+
+// takeHeapSnapshot collects garbage, so that only live objects are reported,
+// and reads the memory statistics.
+func takeHeapSnapshot() (s *heapSnapshot, prev *heapSnapshot) {
+	s = &heapSnapshot{at: time.Now()}
+
+	runtime.GC()
+	runtime.ReadMemStats(&s.stats)
+
+	lastHeap.Lock()
+	prev = lastHeap.heapSnapshot
+	lastHeap.heapSnapshot = s
+	lastHeap.Unlock()
+
+	for i, c := range s.stats.BySize {
+		hc := heapClass{size: c.Size, objects: int64(c.Mallocs) - int64(c.Frees)}
+
+		if prev != nil {
+			hc.delta = hc.objects - prev.classes[i].objects
+		}
+
+		s.classes = append(s.classes, hc)
+	}
+
+	return
+}
+
+// top returns the size classes sorted by live bytes.
+func (s *heapSnapshot) top() (classes []heapClass) {
+	for _, c := range s.classes {
+		if c.objects != 0 || c.delta != 0 {
+			classes = append(classes, c)
+		}
+	}
+
+	sort.SliceStable(classes, func(i, j int) bool {
+		return int64(classes[i].size)*classes[i].objects > int64(classes[j].size)*classes[j].objects
+	})
+
+	return
+}
+
+func (s *heapSnapshot) summary(prev *heapSnapshot) string {
+	var buf bytes.Buffer
+
+	m := &s.stats
+
+	fmt.Fprintf(&buf, "heap: %d KiB in %d objects (in use %d KiB, idle %d KiB, released %d KiB)\n",
+		m.HeapAlloc/1024, m.HeapObjects, m.HeapInuse/1024, m.HeapIdle/1024, m.HeapReleased/1024)
+	fmt.Fprintf(&buf, "sys: %d KiB, GC cycles: %d, goroutines: %d\n", m.Sys/1024, m.NumGC, runtime.NumGoroutine())
+
+	if prev != nil {
+		fmt.Fprintf(&buf, "since previous (%s ago): %+d KiB, %+d objects\n",
+			s.at.Sub(prev.at).Round(time.Second),
+			(int64(m.HeapAlloc)-int64(prev.stats.HeapAlloc))/1024,
+			int64(m.HeapObjects)-int64(prev.stats.HeapObjects))
+	}
+
+	return buf.String()
+}
+
+func (s *heapSnapshot) sizeClasses(limit int) string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%8s %10s %12s %10s\n", "size", "objects", "bytes", "delta")
+
+	for i, c := range s.top() {
+		if limit > 0 && i >= limit {
+			break
+		}
+
+		fmt.Fprintf(&buf, "%8d %10d %12d %+10d\n", c.size, c.objects, int64(c.size)*c.objects, c.delta)
+	}
+
+	return buf.String()
+}
+
+func (s *heapSnapshot) memStats() string {
+	var buf bytes.Buffer
+
+	m := &s.stats
+
+	fields := []struct {
+		name string
+		val  uint64
+	}{
+		{"Alloc", m.Alloc},
+		{"TotalAlloc", m.TotalAlloc},
+		{"Sys", m.Sys},
+		{"Lookups", m.Lookups},
+		{"Mallocs", m.Mallocs},
+		{"Frees", m.Frees},
+		{"HeapAlloc", m.HeapAlloc},
+		{"HeapSys", m.HeapSys},
+		{"HeapIdle", m.HeapIdle},
+		{"HeapInuse", m.HeapInuse},
+		{"HeapReleased", m.HeapReleased},
+		{"HeapObjects", m.HeapObjects},
+		{"StackInuse", m.StackInuse},
+		{"StackSys", m.StackSys},
+		{"MSpanInuse", m.MSpanInuse},
+		{"MSpanSys", m.MSpanSys},
+		{"MCacheInuse", m.MCacheInuse},
+		{"MCacheSys", m.MCacheSys},
+		{"BuckHashSys", m.BuckHashSys},
+		{"GCSys", m.GCSys},
+		{"OtherSys", m.OtherSys},
+		{"NextGC", m.NextGC},
+		{"LastGC", m.LastGC},
+		{"PauseTotalNs", m.PauseTotalNs},
+		{"NumGC", uint64(m.NumGC)},
+		{"NumForcedGC", uint64(m.NumForcedGC)},
+	}
+
+	for _, f := range fields {
+		fmt.Fprintf(&buf, "%-14s %d\n", f.name, f.val)
+	}
+
+	fmt.Fprintf(&buf, "%-14s %f\n", "GCCPUFraction", m.GCCPUFraction)
+
+	// PauseNs is a circular buffer of the most recent 256 pauses (see
+	// soak.go).
+	fmt.Fprintf(&buf, "\nrecent GC pauses (ns):")
+
+	for n := m.NumGC; n > 0 && n+256 > m.NumGC; n-- {
+		fmt.Fprintf(&buf, " %d", m.PauseNs[(n+255)%256])
+	}
+
+	fmt.Fprintln(&buf)
+
+	return buf.String()
+}
+
+// heapFiles returns the heap dump files: memory statistics, live objects by
+// size class, the heap profile (for `go tool pprof`) and goroutine stacks.
+func heapFiles(s *heapSnapshot, prev *heapSnapshot) (files []archiveFile, err error) {
+	add := func(name string, data []byte) {
+		files = append(files, archiveFile{name: name, size: int64(len(data)), data: bytes.NewReader(data)})
+	}
+
+	add("memstats.txt", []byte(s.summary(prev)+"\n"+s.memStats()))
+	add("sizeclasses.txt", []byte(s.sizeClasses(0)))
+
+	for _, p := range []struct {
+		name    string
+		profile string
+		debug   int
+	}{
+		{"heap.pprof", "heap", 0},
+		{"goroutines.txt", "goroutine", 1},
+	} {
+		var buf bytes.Buffer
+
+		if err = pprof.Lookup(p.profile).WriteTo(&buf, p.debug); err != nil {
+			return
+		}
+
+		add(p.name, buf.Bytes())
+	}
+
+	return
+}
+
+func heapCommand(args []string) (res string) {
+	s, prev := takeHeapSnapshot()
+
+	if len(args) == 0 {
+		return s.summary(prev) + s.sizeClasses(HEAP_TOP_CLASSES)
+	}
+
+	if len(args) != 3 {
+		return "invalid arguments"
+	}
+
+	n, _ := strconv.Atoi(args[0])
+	offset, err := strconv.ParseInt(args[1], 16, 64)
+
+	if err != nil {
+		return fmt.Sprintf("invalid offset: %v", err)
+	}
+
+	mib, _ := strconv.ParseInt(args[2], 10, 64)
+	card, err := target.Card(n)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if mib <= 0 || offset+mib*1024*1024 > int64(card.Blocks())*int64(card.BlockSize()) {
+		return "invalid size"
+	}
+
+	files, err := heapFiles(s, prev)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	name := "heap-" + Now().UTC().Format("20060102T150405")
+	size, err := packArchive(&cardRegion{card: card, offset: offset, size: mib * 1024 * 1024}, name, files)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return s.summary(prev) + fmt.Sprintf("wrote %s.tar.gz (%d bytes) at %#x", name, size, offset)
+}
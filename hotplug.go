@@ -0,0 +1,218 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory card presence is polled, rather than relying on the controller card
+// detect signal which is not routed on all target slots. Present cards are
+// probed with a single block read, which fails once a card is removed (or
+// replaced, as a newly inserted card is not initialized), while absent cards
+// are probed by attempting their detection.
+
+var hotplugLog = newLogger("hotplug")
+
+// cardSlot represents the hotplug state of a memory card slot.
+type cardSlot struct {
+	present  bool
+	blocks   int
+	inserted int
+	removed  int
+}
+
+// cardMount represents a subsystem using a memory card, which is closed on
+// card removal and reopened on its reinsertion.
+type cardMount struct {
+	card  int
+	open  func() error
+	close func()
+}
+
+var hotplug struct {
+	sync.Mutex
+
+	slots  []cardSlot
+	mounts map[string]*cardMount
+}
+
+// mountCard registers a subsystem using a memory card, replacing any previous
+// registration under the same name.
+func mountCard(name string, n int, open func() error, close func()) {
+	hotplug.Lock()
+	defer hotplug.Unlock()
+
+	if hotplug.mounts == nil {
+		hotplug.mounts = make(map[string]*cardMount)
+	}
+
+	hotplug.mounts[name] = &cardMount{card: n, open: open, close: close}
+}
+
+// unmountCard removes a subsystem registration.
+func unmountCard(name string) {
+	hotplug.Lock()
+	defer hotplug.Unlock()
+
+	delete(hotplug.mounts, name)
+}
+
+// cardMounts returns, sorted by name, the subsystems using a memory card.
+func cardMounts(n int) (names []string, mounts []*cardMount) {
+	hotplug.Lock()
+	defer hotplug.Unlock()
+
+	for name, m := range hotplug.mounts {
+		if m.card == n {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		mounts = append(mounts, hotplug.mounts[name])
+	}
+
+	return
+}
+
+// probeCard returns whether a memory card is present, re-enumerating it when
+// it was not.
+func probeCard(n int, present bool) bool {
+	card := cards[n]
+
+	if present && card.Info().BlockSize != 0 {
+		if _, err := card.Read(0, int64(card.Info().BlockSize)); err == nil {
+			return true
+		}
+	}
+
+	return negotiateCard(card, 0, nil) == nil
+}
+
+func cardRemoved(n int) {
+	names, mounts := cardMounts(n)
+
+	hotplugLog.Infof("card %d removed", n)
+
+	for i, m := range mounts {
+		m.close()
+		hotplugLog.Infof("card %d %s closed", n, names[i])
+	}
+}
+
+func cardInserted(n int) {
+	names, mounts := cardMounts(n)
+
+	info := cards[n].Info()
+	hotplugLog.Infof("card %d inserted (%d MiB)", n, int64(info.Blocks)*int64(info.BlockSize)/(1024*1024))
+
+	for i, m := range mounts {
+		if err := m.open(); err != nil {
+			hotplugLog.Errorf("card %d %s reopening failed, %v", n, names[i], err)
+			continue
+		}
+
+		hotplugLog.Infof("card %d %s reopened", n, names[i])
+	}
+}
+
+// pollCards tracks memory card removal and insertion, closing and reopening
+// the subsystems using them.
+func pollCards(interval time.Duration) {
+	hotplug.Lock()
+	hotplug.slots = make([]cardSlot, len(cards))
+	hotplug.Unlock()
+
+	for i := range cards {
+		present := probeCard(i, false)
+
+		hotplug.Lock()
+		hotplug.slots[i].present = present
+		hotplug.slots[i].blocks = cards[i].Info().Blocks
+		hotplug.Unlock()
+	}
+
+	for {
+		time.Sleep(interval)
+
+		for i := range cards {
+			hotplug.Lock()
+			wasPresent := hotplug.slots[i].present
+			hotplug.Unlock()
+
+			present := probeCard(i, wasPresent)
+
+			if present == wasPresent {
+				continue
+			}
+
+			hotplug.Lock()
+			s := &hotplug.slots[i]
+			s.present = present
+			s.blocks = cards[i].Info().Blocks
+
+			if present {
+				s.inserted += 1
+			} else {
+				s.removed += 1
+			}
+			hotplug.Unlock()
+
+			if present {
+				cardInserted(i)
+			} else {
+				cardRemoved(i)
+			}
+		}
+	}
+}
+
+// startHotplug starts memory card presence polling, when enabled.
+func startHotplug() {
+	interval := conf.Int("card_poll_interval", 1000)
+
+	if interval <= 0 || !target.Native() || len(cards) == 0 {
+		return
+	}
+
+	go pollCards(time.Duration(interval) * time.Millisecond)
+}
+
+func cardStatusCommand() string {
+	var buf bytes.Buffer
+
+	hotplug.Lock()
+	slots := append([]cardSlot{}, hotplug.slots...)
+	hotplug.Unlock()
+
+	if len(slots) == 0 {
+		return "card polling disabled"
+	}
+
+	for i, s := range slots {
+		state := "absent"
+
+		if s.present {
+			state = fmt.Sprintf("present (%d blocks, %s)", s.blocks, cardMode(cards[i]))
+		}
+
+		names, _ := cardMounts(i)
+
+		fmt.Fprintf(&buf, "card %d: %s inserted:%d removed:%d mounts:%v\n", i, state, s.inserted, s.removed, names)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,361 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var hsmLog = newLogger("hsm")
+
+const HSM_MAX_KEYS = 32
+
+var hsmLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// hsmKeyring holds the signing keys, which are only ever stored as a DCP
+// sealed blob (see secrets.go) and never leave the device in plaintext.
+type hsmKeyring struct {
+	sync.Mutex
+
+	once sync.Once
+	err  error
+	keys map[string]*ecdsa.PrivateKey
+}
+
+// HSM is the keyring shared by the signing service on all interfaces.
+var HSM = &hsmKeyring{}
+
+// hsmKey represents the public information of a keyring key.
+type hsmKey struct {
+	Label     string `json:"label"`
+	PublicKey string `json:"public_key"`
+}
+
+// Init loads the keyring from persistent storage on first use.
+func (k *hsmKeyring) Init() error {
+	k.once.Do(func() {
+		k.Lock()
+		defer k.Unlock()
+
+		k.err = k.load()
+	})
+
+	return k.err
+}
+
+func (k *hsmKeyring) load() (err error) {
+	payload, err := loadSealed("hsm", func() ([]byte, error) {
+		return json.Marshal(map[string][]byte{})
+	})
+
+	if err != nil {
+		return
+	}
+
+	var der map[string][]byte
+
+	if err = json.Unmarshal(payload, &der); err != nil {
+		return
+	}
+
+	k.keys = make(map[string]*ecdsa.PrivateKey)
+
+	for label, b := range der {
+		if k.keys[label], err = x509.ParseECPrivateKey(b); err != nil {
+			return fmt.Errorf("invalid key %s, %v", label, err)
+		}
+	}
+
+	return
+}
+
+func (k *hsmKeyring) save() (err error) {
+	der := make(map[string][]byte)
+
+	for label, priv := range k.keys {
+		if der[label], err = x509.MarshalECPrivateKey(priv); err != nil {
+			return
+		}
+	}
+
+	payload, err := json.Marshal(der)
+
+	if err != nil {
+		return
+	}
+
+	return storeSealed("hsm", payload)
+}
+
+// List returns the keyring public keys.
+func (k *hsmKeyring) List() (keys []hsmKey, err error) {
+	k.Lock()
+	defer k.Unlock()
+
+	keys = []hsmKey{}
+
+	for label, priv := range k.keys {
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, hsmKey{
+			Label:     label,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		})
+	}
+
+	return
+}
+
+// Generate creates a new P-256 key.
+func (k *hsmKeyring) Generate(label string) (err error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[label]; ok {
+		return errors.New("key already exists")
+	}
+
+	if len(k.keys) >= HSM_MAX_KEYS {
+		return errors.New("keyring full")
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	k.keys[label] = priv
+
+	if err = k.save(); err != nil {
+		delete(k.keys, label)
+		return
+	}
+
+	auditf("key.generate", "hsm %s", label)
+
+	return
+}
+
+// Delete removes a key.
+func (k *hsmKeyring) Delete(label string) (err error) {
+	k.Lock()
+	defer k.Unlock()
+
+	priv, ok := k.keys[label]
+
+	if !ok {
+		return errors.New("key not found")
+	}
+
+	delete(k.keys, label)
+
+	if err = k.save(); err != nil {
+		k.keys[label] = priv
+		return
+	}
+
+	auditf("key.delete", "hsm %s", label)
+
+	return
+}
+
+// PublicKey returns the PKIX DER encoded public key of a key.
+func (k *hsmKeyring) PublicKey(label string) (der []byte, err error) {
+	k.Lock()
+	priv, ok := k.keys[label]
+	k.Unlock()
+
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+
+	return x509.MarshalPKIXPublicKey(&priv.PublicKey)
+}
+
+// Sign returns the ASN.1 ECDSA signature of a SHA-256 digest.
+func (k *hsmKeyring) Sign(label string, digest []byte) (sig []byte, err error) {
+	k.Lock()
+	priv, ok := k.keys[label]
+	k.Unlock()
+
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+
+	if len(digest) != sha256.Size {
+		return nil, errors.New("invalid digest size")
+	}
+
+	auditf("key.sign", "hsm %s, digest %x", label, digest)
+
+	return priv.Sign(rand.Reader, digest, nil)
+}
+
+func hsmError(w http.ResponseWriter, code int, err error) {
+	http.Error(w, err.Error(), code)
+}
+
+// hsmHandler implements the signing API:
+//
+//	GET    /keys          list public keys (JSON)
+//	POST   /keys/<label>  generate a P-256 key
+//	DELETE /keys/<label>  delete a key
+//	POST   /sign/<label>  sign a raw SHA-256 digest, returns an ASN.1 signature
+func hsmHandler(keyring *hsmKeyring, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		keys, err := keyring.List()
+
+		if err != nil {
+			hsmError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	})
+
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		label := strings.TrimPrefix(r.URL.Path, "/keys/")
+
+		if !hsmLabelPattern.MatchString(label) {
+			hsmError(w, http.StatusBadRequest, errors.New("invalid label"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			err = keyring.Generate(label)
+		case http.MethodDelete:
+			err = keyring.Delete(label)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			hsmError(w, http.StatusConflict, err)
+			return
+		}
+
+		hsmLog.Infof("%s key %s from %s", r.Method, label, r.RemoteAddr)
+	})
+
+	mux.HandleFunc("/sign/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		label := strings.TrimPrefix(r.URL.Path, "/sign/")
+		digest, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sha256.Size))
+
+		if err != nil {
+			hsmError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		sig, err := keyring.Sign(label, digest)
+
+		if err != nil {
+			hsmError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(sig)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// startHSM serves the signing API over TLS, requests are authenticated with
+// the `hsm_token` bearer token.
+func startHSM(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	token := conf.String("hsm_token", "")
+
+	if token == "" {
+		hsmLog.Warnf("disabled, hsm_token not set")
+		return
+	}
+
+	if err := HSM.Init(); err != nil {
+		hsmLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	certificate, err := sealedCertificate(addr)
+
+	if err != nil {
+		hsmLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		hsmLog.Fatalf("listener error, %v", err)
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", addr, port),
+		Handler: hsmHandler(HSM, token),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	hsmLog.Infof("starting HSM signing service at %s:%d", addr, port)
+
+	err = srv.ServeTLS(listener, "", "")
+
+	hsmLog.Fatalf("server returned unexpectedly, %v", err)
+}
@@ -0,0 +1,243 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// I2C registers, all 16-bit wide
+// (I2C Controller (I2C), IMX6ULLRM).
+const (
+	I2C1_BASE = 0x021a0000
+	I2C2_BASE = 0x021a4000
+
+	I2Cx_IADR = 0x00
+	I2Cx_IFDR = 0x04
+
+	I2Cx_I2CR = 0x08
+	I2CR_IEN  = 7
+	I2CR_MSTA = 5
+	I2CR_MTX  = 4
+	I2CR_TXAK = 3
+	I2CR_RSTA = 2
+
+	I2Cx_I2SR = 0x0c
+	I2SR_IBB  = 5
+	I2SR_IAL  = 4
+	I2SR_IIF  = 1
+	I2SR_RXAK = 0
+
+	I2Cx_I2DR = 0x10
+
+	// IPG clock (66 MHz) / 768, ~86 kHz
+	I2C_IFDR_DIV = 0x39
+
+	// I2C1-I2C2 clock gates are CCGR2 CG3-CG4
+	CCM_CCGR2 = 0x020c4070
+	CCGR2_CG3 = 6
+
+	I2C_TIMEOUT = 100 * time.Millisecond
+)
+
+// i2cBus represents an I2C controller instance in master mode, transfers
+// are polled.
+type i2cBus struct {
+	sync.Mutex
+
+	n    int
+	base uint32
+}
+
+func newI2C(n int) (hw *i2cBus, err error) {
+	switch n {
+	case 1:
+		hw = &i2cBus{n: n, base: I2C1_BASE}
+	case 2:
+		hw = &i2cBus{n: n, base: I2C2_BASE}
+	default:
+		return nil, fmt.Errorf("invalid I2C controller %d", n)
+	}
+
+	reg.SetN(CCM_CCGR2, CCGR2_CG3+(n-1)*2, 0b11, 0b11)
+
+	reg.Write16(hw.base+I2Cx_I2CR, 0)
+	reg.Write16(hw.base+I2Cx_IFDR, I2C_IFDR_DIV)
+	reg.Write16(hw.base+I2Cx_I2SR, 0)
+	reg.Write16(hw.base+I2Cx_I2CR, 1<<I2CR_IEN)
+
+	return
+}
+
+func (hw *i2cBus) set(pos int) {
+	addr := hw.base + I2Cx_I2CR
+	reg.Write16(addr, reg.Read16(addr)|1<<pos)
+}
+
+func (hw *i2cBus) clear(pos int) {
+	addr := hw.base + I2Cx_I2CR
+	reg.Write16(addr, reg.Read16(addr)&^(1<<pos))
+}
+
+func (hw *i2cBus) status(pos int) bool {
+	return reg.Read16(hw.base+I2Cx_I2SR)&(1<<pos) != 0
+}
+
+func (hw *i2cBus) waitBus(busy bool) error {
+	start := time.Now()
+
+	for hw.status(I2SR_IBB) != busy {
+		runtime.Gosched()
+
+		if time.Since(start) >= I2C_TIMEOUT {
+			return errors.New("bus timeout")
+		}
+	}
+
+	return nil
+}
+
+// wait waits for the completion of a byte transfer.
+func (hw *i2cBus) wait() error {
+	start := time.Now()
+
+	for !hw.status(I2SR_IIF) {
+		runtime.Gosched()
+
+		if time.Since(start) >= I2C_TIMEOUT {
+			return errors.New("transfer timeout")
+		}
+	}
+
+	reg.Write16(hw.base+I2Cx_I2SR, 0)
+
+	if hw.status(I2SR_IAL) {
+		return errors.New("arbitration lost")
+	}
+
+	return nil
+}
+
+func (hw *i2cBus) tx(b byte) (err error) {
+	reg.Write16(hw.base+I2Cx_I2DR, uint16(b))
+
+	if err = hw.wait(); err != nil {
+		return
+	}
+
+	if hw.status(I2SR_RXAK) {
+		return errors.New("no acknowledgment")
+	}
+
+	return
+}
+
+func (hw *i2cBus) start(addr uint8, register uint8) (err error) {
+	if err = hw.waitBus(false); err != nil {
+		return
+	}
+
+	hw.set(I2CR_MSTA)
+	hw.set(I2CR_MTX)
+
+	if err = hw.waitBus(true); err != nil {
+		return
+	}
+
+	if err = hw.tx(addr << 1); err != nil {
+		return
+	}
+
+	return hw.tx(register)
+}
+
+func (hw *i2cBus) stop() {
+	hw.clear(I2CR_MSTA)
+	hw.clear(I2CR_MTX)
+	hw.clear(I2CR_TXAK)
+
+	hw.waitBus(false)
+}
+
+// Write writes data to a target device register.
+func (hw *i2cBus) Write(addr uint8, register uint8, buf []byte) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	defer hw.stop()
+
+	if err = hw.start(addr, register); err != nil {
+		return
+	}
+
+	for _, b := range buf {
+		if err = hw.tx(b); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Read reads data from a target device register.
+func (hw *i2cBus) Read(addr uint8, register uint8, size int) (buf []byte, err error) {
+	if size <= 0 {
+		return
+	}
+
+	hw.Lock()
+	defer hw.Unlock()
+
+	defer hw.stop()
+
+	if err = hw.start(addr, register); err != nil {
+		return
+	}
+
+	// repeated start
+	hw.set(I2CR_RSTA)
+
+	if err = hw.tx(addr<<1 | 1); err != nil {
+		return
+	}
+
+	hw.clear(I2CR_MTX)
+
+	if size == 1 {
+		hw.set(I2CR_TXAK)
+	}
+
+	// dummy read to initiate reception
+	reg.Read16(hw.base + I2Cx_I2DR)
+
+	for i := 0; i < size; i++ {
+		if err = hw.wait(); err != nil {
+			return
+		}
+
+		switch {
+		case i == size-1:
+			// generate stop before reading the last byte
+			hw.clear(I2CR_MSTA)
+		case i == size-2:
+			// do not acknowledge the last byte
+			hw.set(I2CR_TXAK)
+		}
+
+		buf = append(buf, byte(reg.Read16(hw.base+I2Cx_I2DR)))
+	}
+
+	return
+}
@@ -0,0 +1,307 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// The device identity is provisioned, typically on the manufacturing line,
+// by generating a device key pair, whose private key is only stored as a DCP
+// sealed blob (see secrets.go), and emitting a certificate request which is
+// signed by the manufacturer CA. The returned certificate is installed once
+// verified against the device key.
+//
+// Provisioning mode is only entered with the `provision start` console
+// command, the HTTP provisioning routes are otherwise disabled.
+const (
+	IDENTITY_MAX_CERT_SIZE = 4096
+)
+
+var identityLog = newLogger("identity")
+
+var identity struct {
+	sync.Mutex
+
+	// provisioning mode
+	active bool
+
+	key *ecdsa.PrivateKey
+	csr []byte
+	// installed certificate
+	cert *x509.Certificate
+}
+
+// identityKey returns the device key, generating it on first use.
+func identityKey() (priv *ecdsa.PrivateKey, err error) {
+	imx6.DCP.Init()
+
+	der, err := loadSealed("devkey", func() ([]byte, error) {
+		identityLog.Infof("generating device key")
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return x509.MarshalECPrivateKey(priv)
+	})
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		for i := range der {
+			der[i] = 0
+		}
+	}()
+
+	return x509.ParseECPrivateKey(der)
+}
+
+// loadIdentityCertificate returns the installed device certificate.
+func loadIdentityCertificate() (cert *x509.Certificate, err error) {
+	r, err := openStorage("devcert")
+
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, r.Size())
+
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(buf)
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no device certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// startProvisioning enters provisioning mode, generating the device key if
+// needed, and returns a PEM certificate request.
+func startProvisioning(cn string) (csr []byte, err error) {
+	identity.Lock()
+	defer identity.Unlock()
+
+	if identity.key == nil {
+		if identity.key, err = identityKey(); err != nil {
+			return
+		}
+	}
+
+	if cn == "" {
+		cn = hex.EncodeToString(target.UniqueID())
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   cn,
+			SerialNumber: hex.EncodeToString(target.UniqueID()),
+			Organization: []string{"TamaGo Example"},
+		},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, identity.key)
+
+	if err != nil {
+		return
+	}
+
+	identity.active = true
+	identity.csr = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	identityLog.Infof("provisioning mode, certificate request for %s", cn)
+
+	return identity.csr, nil
+}
+
+// installCertificate verifies a certificate against the device key and
+// stores it, leaving provisioning mode.
+func installCertificate(buf []byte) (cert *x509.Certificate, err error) {
+	identity.Lock()
+	defer identity.Unlock()
+
+	if !identity.active {
+		return nil, errors.New("not in provisioning mode")
+	}
+
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+
+	if cert, err = x509.ParseCertificate(buf); err != nil {
+		return
+	}
+
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+
+	if !ok || pub.X.Cmp(identity.key.X) != 0 || pub.Y.Cmp(identity.key.Y) != 0 {
+		return nil, errors.New("certificate does not match device key")
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+
+	r, err := openStorage("devcert")
+
+	if err != nil {
+		return
+	}
+
+	p := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	if int64(len(p)) > r.Size() {
+		return nil, errors.New("certificate exceeds storage region")
+	}
+
+	data := make([]byte, r.Size())
+	copy(data, p)
+
+	if _, err = r.WriteAt(data, 0); err != nil {
+		return
+	}
+
+	identity.active = false
+	identity.cert = cert
+
+	identityLog.Infof("installed certificate for %s issued by %s", cert.Subject.CommonName, cert.Issuer.CommonName)
+
+	auditf("identity.install", "certificate for %s issued by %s", cert.Subject.CommonName, cert.Issuer.CommonName)
+
+	return
+}
+
+func identityStatus() string {
+	var buf bytes.Buffer
+
+	identity.Lock()
+	defer identity.Unlock()
+
+	fmt.Fprintf(&buf, "provisioning mode: %v\n", identity.active)
+
+	if identity.key != nil {
+		pub, _ := x509.MarshalPKIXPublicKey(&identity.key.PublicKey)
+		fmt.Fprintf(&buf, "device key: %x\n", sha256.Sum256(pub))
+	}
+
+	cert := identity.cert
+
+	if cert == nil {
+		var err error
+
+		if cert, err = loadIdentityCertificate(); err != nil {
+			fmt.Fprintf(&buf, "certificate: %v\n", err)
+			return buf.String()
+		}
+	}
+
+	fmt.Fprintf(&buf, "certificate: %s (issuer %s, serial %x, expires %s)\n",
+		cert.Subject.CommonName, cert.Issuer.CommonName, cert.SerialNumber, cert.NotAfter.Format(time.RFC3339))
+
+	return buf.String()
+}
+
+func provisionCommand(op string, arg string) (res string) {
+	switch op {
+	case "start":
+		csr, err := startProvisioning(arg)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return string(csr)
+	case "install":
+		// the console reads single lines, certificates are passed as
+		// base64 encoded DER
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(arg))
+
+		if err != nil {
+			return fmt.Sprintf("invalid certificate encoding, %v", err)
+		}
+
+		cert, err := installCertificate(der)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("installed certificate for %s", cert.Subject.CommonName)
+	case "status":
+		return identityStatus()
+	}
+
+	return "invalid arguments"
+}
+
+// provisionHandler serves, only in provisioning mode, the certificate
+// request as GET /provision/csr and certificate installation, of a PEM or DER
+// certificate, as POST /provision/cert.
+func provisionHandler(w http.ResponseWriter, r *http.Request) {
+	identity.Lock()
+	active := identity.active
+	csr := identity.csr
+	identity.Unlock()
+
+	if !active {
+		http.Error(w, "not in provisioning mode", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/provision/csr" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(csr)
+	case r.URL.Path == "/provision/cert" && r.Method == http.MethodPost:
+		buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, IDENTITY_MAX_CERT_SIZE))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cert, err := installCertificate(buf)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "installed certificate for %s\n", cert.Subject.CommonName)
+	default:
+		http.NotFound(w, r)
+	}
+}
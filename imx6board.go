@@ -0,0 +1,138 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build usbarmory mx6ullevk
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usdhc"
+
+	"github.com/f-secure-foundry/tamago-example/internal/board"
+)
+
+// imx6Board implements board.Board for NXP i.MX6 targets, board specific
+// features are set by the board files (e.g. usbarmory.go).
+type imx6Board struct {
+	name string
+	led  func(string, bool) error
+}
+
+// imx6Card adapts tamago uSDHC controllers to board.BlockDevice.
+type imx6Card struct {
+	*usdhc.USDHC
+}
+
+func (c imx6Card) BlockSize() int {
+	return c.Info().BlockSize
+}
+
+func (c imx6Card) Blocks() int {
+	return c.Info().Blocks
+}
+
+// Read and Write fail, rather than reaching the controller, when the card has
+// been removed since the device was returned (see hotplug.go).
+
+func (c imx6Card) Read(offset int64, size int64) ([]byte, error) {
+	if c.BlockSize() == 0 {
+		return nil, errors.New("card not present")
+	}
+
+	return c.USDHC.Read(offset, size)
+}
+
+func (c imx6Card) Write(offset int64, buf []byte) error {
+	if c.BlockSize() == 0 {
+		return errors.New("card not present")
+	}
+
+	return c.USDHC.Write(offset, buf)
+}
+
+func detectCard(card *usdhc.USDHC) (err error) {
+	if card.Info().BlockSize != 0 {
+		return
+	}
+
+	return negotiateCard(card, 0, nil)
+}
+
+func (b *imx6Board) Name() string {
+	return b.name
+}
+
+func (b *imx6Board) Model() string {
+	return imx6.Model()
+}
+
+func (b *imx6Board) Native() bool {
+	return imx6.Native
+}
+
+func (b *imx6Board) Freq() uint32 {
+	return imx6.ARMFreq()
+}
+
+func (b *imx6Board) SetFreq(mhz uint32) error {
+	return imx6.SetARMFreq(mhz)
+}
+
+func (b *imx6Board) LED(name string, on bool) error {
+	if b.led == nil {
+		return errors.New("no user LEDs")
+	}
+
+	return b.led(name, on)
+}
+
+func (b *imx6Board) Card(n int) (card board.BlockDevice, err error) {
+	if !imx6.Native {
+		return nil, errors.New("unsupported under emulation")
+	}
+
+	if n < 0 || n >= len(cards) {
+		return nil, fmt.Errorf("invalid card %d", n)
+	}
+
+	if err = detectCard(cards[n]); err != nil {
+		return
+	}
+
+	return injectFaults(n, imx6Card{cards[n]}), nil
+}
+
+func (b *imx6Board) Ethernet() bool {
+	return imx6.Native && ENET != nil
+}
+
+func (b *imx6Board) USB() bool {
+	return imx6.Native && (imx6.Family == imx6.IMX6UL || imx6.Family == imx6.IMX6ULL)
+}
+
+func (b *imx6Board) UniqueID() []byte {
+	id := imx6.UniqueID()
+	return id[:]
+}
+
+func (b *imx6Board) DCP() bool {
+	return imx6.Native && imx6.Family == imx6.IMX6ULL
+}
+
+func (b *imx6Board) HardwareKey() bool {
+	return imx6.Native && imx6.DCP.SNVS()
+}
+
+func (b *imx6Board) DeriveKey(diversifier []byte, iv []byte) ([]byte, error) {
+	imx6.DCP.Init()
+	return imx6.DCP.DeriveKey(diversifier, iv, -1)
+}
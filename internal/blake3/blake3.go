@@ -0,0 +1,278 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package blake3 implements the BLAKE3 hash function, in its default hashing
+// mode, as a portable port of the reference implementation.
+//
+// Input is split in 1 KiB chunks, each compressed in 64 byte blocks, whose
+// chaining values are merged in a binary tree. Only the tree structure is
+// implemented, without SIMD parallelism, as the target is a single core
+// without NEON assembly support in this package.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the default digest size in bytes.
+const Size = 32
+
+// BlockSize is the compression function block size in bytes.
+const BlockSize = 64
+
+const (
+	chunkLen = 1024
+
+	chunkStart = 1 << 0
+	chunkEnd   = 1 << 1
+	parent     = 1 << 2
+	root       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(s *[16]uint32, a, b, c, d int, x, y uint32) {
+	s[a] = s[a] + s[b] + x
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + y
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func compress(cv *[8]uint32, m *[16]uint32, counter uint64, blockLen uint32, flags uint32) (s [16]uint32) {
+	copy(s[0:8], cv[:])
+	copy(s[8:12], iv[0:4])
+	s[12] = uint32(counter)
+	s[13] = uint32(counter >> 32)
+	s[14] = blockLen
+	s[15] = flags
+
+	msg := *m
+
+	for r := 0; r < 7; r++ {
+		g(&s, 0, 4, 8, 12, msg[0], msg[1])
+		g(&s, 1, 5, 9, 13, msg[2], msg[3])
+		g(&s, 2, 6, 10, 14, msg[4], msg[5])
+		g(&s, 3, 7, 11, 15, msg[6], msg[7])
+		g(&s, 0, 5, 10, 15, msg[8], msg[9])
+		g(&s, 1, 6, 11, 12, msg[10], msg[11])
+		g(&s, 2, 7, 8, 13, msg[12], msg[13])
+		g(&s, 3, 4, 9, 14, msg[14], msg[15])
+
+		var permuted [16]uint32
+
+		for i, p := range permutation {
+			permuted[i] = msg[p]
+		}
+
+		msg = permuted
+	}
+
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+
+	return
+}
+
+func words(block []byte) (m [16]uint32) {
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+
+	return
+}
+
+// output represents the inputs of a compression, which are retained to
+// produce either a chaining value or the root output.
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() (cv [8]uint32) {
+	s := compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[0:8])
+	return
+}
+
+func (o *output) root(out []byte) {
+	var buf [BlockSize]byte
+
+	for counter := uint64(0); len(out) > 0; counter++ {
+		s := compress(&o.cv, &o.block, counter, o.blockLen, o.flags|root)
+
+		for i, w := range s {
+			binary.LittleEndian.PutUint32(buf[i*4:], w)
+		}
+
+		out = out[copy(out, buf[:]):]
+	}
+}
+
+func parentOutput(left [8]uint32, right [8]uint32) *output {
+	o := &output{cv: iv, blockLen: BlockSize, flags: parent}
+
+	copy(o.block[0:8], left[:])
+	copy(o.block[8:16], right[:])
+
+	return o
+}
+
+type chunkState struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [BlockSize]byte
+	blockLen   int
+	compressed int
+}
+
+func (c *chunkState) len() int {
+	return c.compressed*BlockSize + c.blockLen
+}
+
+func (c *chunkState) flags() uint32 {
+	if c.compressed == 0 {
+		return chunkStart
+	}
+
+	return 0
+}
+
+func (c *chunkState) update(p []byte) {
+	for len(p) > 0 {
+		// the last block is only compressed on finalization
+		if c.blockLen == BlockSize {
+			m := words(c.block[:])
+			s := compress(&c.cv, &m, c.counter, BlockSize, c.flags())
+			copy(c.cv[:], s[0:8])
+
+			c.compressed++
+			c.blockLen = 0
+			c.block = [BlockSize]byte{}
+		}
+
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *chunkState) output() *output {
+	return &output{
+		cv:       c.cv,
+		block:    words(c.block[:]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.flags() | chunkEnd,
+	}
+}
+
+// Hasher implements hash.Hash for BLAKE3.
+type Hasher struct {
+	chunk chunkState
+	stack [][8]uint32
+}
+
+// New returns a BLAKE3 hash.Hash with a 32 byte digest.
+func New() hash.Hash {
+	h := &Hasher{}
+	h.Reset()
+
+	return h
+}
+
+// Sum256 returns the 32 byte BLAKE3 digest of the data.
+func Sum256(data []byte) (sum [Size]byte) {
+	h := New()
+	h.Write(data)
+	h.Sum(sum[:0])
+
+	return
+}
+
+func (h *Hasher) Reset() {
+	h.chunk = chunkState{cv: iv}
+	h.stack = h.stack[:0]
+}
+
+func (h *Hasher) Size() int {
+	return Size
+}
+
+func (h *Hasher) BlockSize() int {
+	return BlockSize
+}
+
+// addChunk pushes a completed chunk chaining value, merging completed
+// subtrees as indicated by the trailing zero bits of the chunks count.
+func (h *Hasher) addChunk(cv [8]uint32, total uint64) {
+	for total&1 == 0 {
+		n := len(h.stack) - 1
+		cv = parentOutput(h.stack[n], cv).chainingValue()
+		h.stack = h.stack[:n]
+		total >>= 1
+	}
+
+	h.stack = append(h.stack, cv)
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		// a full chunk is only finalized once more input follows
+		if h.chunk.len() == chunkLen {
+			cv := h.chunk.output().chainingValue()
+			total := h.chunk.counter + 1
+
+			h.addChunk(cv, total)
+			h.chunk = chunkState{cv: iv, counter: total}
+		}
+
+		want := chunkLen - h.chunk.len()
+
+		if want > len(p) {
+			want = len(p)
+		}
+
+		h.chunk.update(p[:want])
+		p = p[want:]
+	}
+
+	return n, nil
+}
+
+// Sum appends the 32 byte digest to b, without changing the hash state.
+func (h *Hasher) Sum(b []byte) []byte {
+	var out [Size]byte
+
+	o := h.chunk.output()
+
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = parentOutput(h.stack[i], o.chainingValue())
+	}
+
+	o.root(out[:])
+
+	return append(b, out[:]...)
+}
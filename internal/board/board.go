@@ -0,0 +1,84 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package board defines the hardware services required by the example
+// application, so that its test suite and network services can be built for
+// different tamago targets.
+//
+// Each target provides, in a file selected by its build tag, an
+// implementation of the Board interface. The example application then only
+// relies on SoC specific packages for the tests of SoC specific peripherals.
+package board
+
+// BlockDevice represents a memory card, or any device with the same block
+// access semantics.
+type BlockDevice interface {
+	// BlockSize returns the device block size.
+	BlockSize() int
+	// Blocks returns the device size in blocks.
+	Blocks() int
+	// Read returns data from the device, accesses are not required to be
+	// aligned.
+	Read(offset int64, size int64) ([]byte, error)
+	// Write transfers data to the device, accesses must be aligned to the
+	// block size.
+	Write(offset int64, buf []byte) error
+}
+
+// LEDs represents the board user LEDs.
+type LEDs interface {
+	// LED turns on or off the named LED.
+	LED(name string, on bool) error
+}
+
+// Storage represents the board persistent storage.
+type Storage interface {
+	// Card returns the nth memory card, once detected.
+	Card(n int) (BlockDevice, error)
+}
+
+// Network represents the board network interfaces.
+type Network interface {
+	// Ethernet returns whether a native Ethernet MAC is available.
+	Ethernet() bool
+	// USB returns whether Ethernet over USB device mode is available.
+	USB() bool
+}
+
+// Crypto represents the board hardware security features.
+type Crypto interface {
+	// UniqueID returns the SoC unique identifier.
+	UniqueID() []byte
+	// DCP returns whether the Data Co-Processor is available.
+	DCP() bool
+	// HardwareKey returns whether DeriveKey is backed by a device unique
+	// hardware key.
+	HardwareKey() bool
+	// DeriveKey derives a key from the device unique hardware key, the
+	// result size matches the diversifier one.
+	DeriveKey(diversifier []byte, iv []byte) ([]byte, error)
+}
+
+// Board represents a tamago target.
+type Board interface {
+	// Name returns the board name.
+	Name() string
+	// Model returns the SoC model.
+	Model() string
+	// Native returns false on emulated runs.
+	Native() bool
+	// Freq returns the core frequency in Hz.
+	Freq() uint32
+	// SetFreq changes the core frequency, expressed in MHz.
+	SetFreq(mhz uint32) error
+
+	LEDs
+	Storage
+	Network
+	Crypto
+}
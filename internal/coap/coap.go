@@ -0,0 +1,295 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package coap implements encoding and decoding of Constrained Application
+// Protocol (RFC 7252) messages, including the Observe option (RFC 7641).
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Version is the CoAP protocol version.
+const Version = 1
+
+// Message types.
+const (
+	Confirmable     = 0
+	NonConfirmable  = 1
+	Acknowledgement = 2
+	Reset           = 3
+)
+
+// Message codes, expressed as class*32 + detail.
+const (
+	Empty = 0x00
+
+	GET    = 0x01
+	POST   = 0x02
+	PUT    = 0x03
+	DELETE = 0x04
+
+	Changed = 0x44
+	Content = 0x45
+
+	BadRequest          = 0x80
+	NotFound            = 0x84
+	MethodNotAllowed    = 0x85
+	RequestEntityTooBig = 0x8d
+	InternalServerError = 0xa0
+)
+
+// Option numbers.
+const (
+	Observe       = 6
+	URIPath       = 11
+	ContentFormat = 12
+	URIQuery      = 15
+	Accept        = 17
+)
+
+// Content formats.
+const (
+	TextPlain       = 0
+	LinkFormat      = 40
+	ApplicationJSON = 50
+)
+
+const payloadMarker = 0xff
+
+// MaxTokenSize is the maximum token length.
+const MaxTokenSize = 8
+
+// Option represents a message option.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message represents a CoAP message.
+type Message struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// CodeString returns the code in dotted class.detail notation.
+func CodeString(code uint8) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+}
+
+// IsRequest returns whether the message carries a request method code.
+func (m *Message) IsRequest() bool {
+	return m.Code >= GET && m.Code < 0x20
+}
+
+// Add appends an option.
+func (m *Message) Add(number uint16, value []byte) {
+	m.Options = append(m.Options, Option{number, value})
+}
+
+// AddUint appends an option with an unsigned integer value, in its shortest
+// representation.
+func (m *Message) AddUint(number uint16, v uint32) {
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], v)
+	value := b[:]
+
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+
+	m.Add(number, value)
+}
+
+// Get returns the first value of an option.
+func (m *Message) Get(number uint16) (value []byte, ok bool) {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value, true
+		}
+	}
+
+	return
+}
+
+// GetUint returns the first value of an unsigned integer option.
+func (m *Message) GetUint(number uint16) (v uint32, ok bool) {
+	value, ok := m.Get(number)
+
+	if !ok || len(value) > 4 {
+		return 0, false
+	}
+
+	for _, b := range value {
+		v = v<<8 | uint32(b)
+	}
+
+	return
+}
+
+// Path returns the request URI path.
+func (m *Message) Path() string {
+	var segments []string
+
+	for _, o := range m.Options {
+		if o.Number == URIPath {
+			segments = append(segments, string(o.Value))
+		}
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+func optionNibble(v int) (nibble byte, ext []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		v -= 269
+		return 14, []byte{byte(v >> 8), byte(v)}
+	}
+}
+
+// Marshal returns the message encoding.
+func (m *Message) Marshal() (buf []byte, err error) {
+	if len(m.Token) > MaxTokenSize {
+		return nil, errors.New("invalid token length")
+	}
+
+	buf = []byte{Version<<6 | m.Type<<4 | byte(len(m.Token)), m.Code, byte(m.MessageID >> 8), byte(m.MessageID)}
+	buf = append(buf, m.Token...)
+
+	// options are encoded in ascending order as deltas
+	options := append([]Option{}, m.Options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].Number < options[j].Number })
+
+	var last uint16
+
+	for _, o := range options {
+		if len(o.Value) > 0xffff-269 {
+			return nil, errors.New("option too large")
+		}
+
+		delta, deltaExt := optionNibble(int(o.Number - last))
+		length, lengthExt := optionNibble(len(o.Value))
+
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, o.Value...)
+
+		last = o.Number
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, payloadMarker)
+		buf = append(buf, m.Payload...)
+	}
+
+	return
+}
+
+func readNibble(nibble byte, buf []byte) (v int, rest []byte, err error) {
+	switch nibble {
+	case 13:
+		if len(buf) < 1 {
+			return 0, nil, errors.New("truncated option")
+		}
+
+		return int(buf[0]) + 13, buf[1:], nil
+	case 14:
+		if len(buf) < 2 {
+			return 0, nil, errors.New("truncated option")
+		}
+
+		return int(binary.BigEndian.Uint16(buf)) + 269, buf[2:], nil
+	case 15:
+		return 0, nil, errors.New("invalid option nibble")
+	default:
+		return int(nibble), buf, nil
+	}
+}
+
+// Unmarshal decodes a message.
+func Unmarshal(buf []byte) (m *Message, err error) {
+	if len(buf) < 4 {
+		return nil, errors.New("message too short")
+	}
+
+	if buf[0]>>6 != Version {
+		return nil, errors.New("invalid version")
+	}
+
+	tkl := int(buf[0] & 0x0f)
+
+	if tkl > MaxTokenSize || len(buf) < 4+tkl {
+		return nil, errors.New("invalid token length")
+	}
+
+	m = &Message{
+		Type:      (buf[0] >> 4) & 0b11,
+		Code:      buf[1],
+		MessageID: binary.BigEndian.Uint16(buf[2:]),
+		Token:     append([]byte{}, buf[4:4+tkl]...),
+	}
+
+	buf = buf[4+tkl:]
+
+	var number int
+
+	for len(buf) > 0 {
+		if buf[0] == payloadMarker {
+			if len(buf) == 1 {
+				return nil, errors.New("empty payload after marker")
+			}
+
+			m.Payload = append([]byte{}, buf[1:]...)
+			break
+		}
+
+		var delta, length int
+
+		header := buf[0]
+
+		if delta, buf, err = readNibble(header>>4, buf[1:]); err != nil {
+			return nil, err
+		}
+
+		if length, buf, err = readNibble(header&0x0f, buf); err != nil {
+			return nil, err
+		}
+
+		if len(buf) < length {
+			return nil, errors.New("truncated option value")
+		}
+
+		if number += delta; number > 0xffff {
+			return nil, errors.New("invalid option number")
+		}
+
+		m.Add(uint16(number), append([]byte{}, buf[:length]...))
+		buf = buf[length:]
+	}
+
+	if m.Code == Empty && (tkl > 0 || len(m.Options) > 0 || len(m.Payload) > 0) {
+		return nil, errors.New("invalid empty message")
+	}
+
+	return
+}
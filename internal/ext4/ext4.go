@@ -0,0 +1,687 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package ext4 implements a minimal read-only reader for ext2, ext3 and ext4
+// filesystems, supporting directory listing and file reads through extent
+// trees or legacy block maps.
+//
+// Journals are not replayed, metadata checksums are not verified and inline
+// data, encryption and compression are not supported.
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	superblockMagic  = 0xef53
+
+	rootInode = 2
+
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompat64Bit       = 0x80
+	incompatDirData     = 0x1000
+	incompatEncrypt     = 0x10000
+
+	unsupportedIncompat = incompatCompression | incompatJournalDev | incompatMetaBG | incompatDirData | incompatEncrypt
+
+	inodeExtentsFlag    = 0x80000
+	inodeInlineDataFlag = 0x10000000
+
+	extentMagic    = 0xf30a
+	extentMaxDepth = 5
+	// extent lengths above this value denote uninitialized extents
+	extentInitMax = 32768
+
+	modeTypeMask = 0xf000
+	modeDir      = 0x4000
+	modeFile     = 0x8000
+	modeSymlink  = 0xa000
+
+	maxSymlinks = 40
+)
+
+// FS represents an ext2/3/4 filesystem.
+type FS struct {
+	r io.ReaderAt
+
+	blockSize      int64
+	inodeSize      int64
+	inodesCount    uint32
+	inodesPerGroup uint32
+	descSize       int64
+	descOffset     int64
+	is64Bit        bool
+	filetype       bool
+}
+
+// FileInfo describes a file.
+type FileInfo struct {
+	Name    string
+	Inode   uint32
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// File represents an open regular file.
+type File struct {
+	fs      *FS
+	ino     *inode
+	extents []extent
+	off     int64
+}
+
+type inode struct {
+	num   uint32
+	mode  uint16
+	size  int64
+	flags uint32
+	mtime uint32
+	block []byte
+}
+
+type extent struct {
+	logical  uint32
+	physical uint64
+	length   uint32
+	uninit   bool
+}
+
+// Open opens the filesystem held by the argument reader.
+func Open(r io.ReaderAt) (fs *FS, err error) {
+	fs = &FS{r: r}
+
+	sb, err := fs.read(superblockOffset, superblockSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint16(sb[0x38:]) != superblockMagic {
+		return nil, errors.New("invalid superblock magic")
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+
+	if logBlockSize > 6 {
+		return nil, errors.New("invalid block size")
+	}
+
+	fs.blockSize = 1024 << logBlockSize
+	fs.inodesCount = binary.LittleEndian.Uint32(sb[0x00:])
+	fs.inodesPerGroup = binary.LittleEndian.Uint32(sb[0x28:])
+	firstDataBlock := int64(binary.LittleEndian.Uint32(sb[0x14:]))
+
+	if fs.inodesPerGroup == 0 {
+		return nil, errors.New("invalid inodes per group")
+	}
+
+	fs.inodeSize = 128
+
+	if binary.LittleEndian.Uint32(sb[0x4c:]) > 0 {
+		fs.inodeSize = int64(binary.LittleEndian.Uint16(sb[0x58:]))
+	}
+
+	if fs.inodeSize < 128 || fs.inodeSize > fs.blockSize {
+		return nil, errors.New("invalid inode size")
+	}
+
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+
+	if f := incompat & unsupportedIncompat; f != 0 {
+		return nil, fmt.Errorf("unsupported features (%#x)", f)
+	}
+
+	fs.filetype = incompat&incompatFiletype != 0
+	fs.is64Bit = incompat&incompat64Bit != 0
+	fs.descSize = 32
+
+	if fs.is64Bit {
+		if size := int64(binary.LittleEndian.Uint16(sb[0xfe:])); size >= 64 {
+			fs.descSize = size
+		}
+	}
+
+	fs.descOffset = (firstDataBlock + 1) * fs.blockSize
+
+	return
+}
+
+func (fs *FS) read(off int64, size int64) (buf []byte, err error) {
+	buf = make([]byte, size)
+
+	n, err := fs.r.ReadAt(buf, off)
+
+	if int64(n) == size {
+		err = nil
+	}
+
+	return
+}
+
+// BlockSize returns the filesystem block size.
+func (fs *FS) BlockSize() int64 {
+	return fs.blockSize
+}
+
+func (fs *FS) inode(num uint32) (ino *inode, err error) {
+	if num == 0 || num > fs.inodesCount {
+		return nil, fmt.Errorf("invalid inode %d", num)
+	}
+
+	group := int64((num - 1) / fs.inodesPerGroup)
+	index := int64((num - 1) % fs.inodesPerGroup)
+
+	desc, err := fs.read(fs.descOffset+group*fs.descSize, fs.descSize)
+
+	if err != nil {
+		return
+	}
+
+	table := int64(binary.LittleEndian.Uint32(desc[0x08:]))
+
+	if fs.is64Bit && fs.descSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+
+	buf, err := fs.read(table*fs.blockSize+index*fs.inodeSize, 128)
+
+	if err != nil {
+		return
+	}
+
+	ino = &inode{
+		num:   num,
+		mode:  binary.LittleEndian.Uint16(buf[0x00:]),
+		size:  int64(binary.LittleEndian.Uint32(buf[0x04:])) | int64(binary.LittleEndian.Uint32(buf[0x6c:]))<<32,
+		mtime: binary.LittleEndian.Uint32(buf[0x10:]),
+		flags: binary.LittleEndian.Uint32(buf[0x20:]),
+		block: buf[0x28 : 0x28+60],
+	}
+
+	return
+}
+
+func (ino *inode) isDir() bool {
+	return ino.mode&modeTypeMask == modeDir
+}
+
+func (ino *inode) isSymlink() bool {
+	return ino.mode&modeTypeMask == modeSymlink
+}
+
+func (ino *inode) fileMode() (mode os.FileMode) {
+	mode = os.FileMode(ino.mode & 0777)
+
+	switch ino.mode & modeTypeMask {
+	case modeDir:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeFile:
+	default:
+		mode |= os.ModeIrregular
+	}
+
+	return
+}
+
+// extentTree returns the extents of an extent tree node.
+func (fs *FS) extentTree(node []byte, depth int) (extents []extent, err error) {
+	if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != extentMagic {
+		return nil, errors.New("invalid extent header")
+	}
+
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	level := int(binary.LittleEndian.Uint16(node[6:]))
+
+	if 12+entries*12 > len(node) || depth+level > extentMaxDepth {
+		return nil, errors.New("invalid extent node")
+	}
+
+	for i := 0; i < entries; i++ {
+		e := node[12+i*12:]
+
+		if level == 0 {
+			length := uint32(binary.LittleEndian.Uint16(e[4:]))
+			uninit := length > extentInitMax
+
+			if uninit {
+				length -= extentInitMax
+			}
+
+			extents = append(extents, extent{
+				logical:  binary.LittleEndian.Uint32(e[0:]),
+				physical: uint64(binary.LittleEndian.Uint16(e[6:]))<<32 | uint64(binary.LittleEndian.Uint32(e[8:])),
+				length:   length,
+				uninit:   uninit,
+			})
+
+			continue
+		}
+
+		leaf := int64(binary.LittleEndian.Uint16(e[8:]))<<32 | int64(binary.LittleEndian.Uint32(e[4:]))
+		child, err := fs.read(leaf*fs.blockSize, fs.blockSize)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sub, err := fs.extentTree(child, depth+1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, sub...)
+	}
+
+	return
+}
+
+// blockMap returns the extents described by a legacy (ext2/3) block map.
+func (fs *FS) blockMap(ino *inode) (extents []extent, err error) {
+	perBlock := fs.blockSize / 4
+	blocks := (ino.size + fs.blockSize - 1) / fs.blockSize
+	logical := int64(0)
+
+	add := func(physical uint32) {
+		if physical != 0 {
+			if n := len(extents); n > 0 && extents[n-1].logical+extents[n-1].length == uint32(logical) &&
+				extents[n-1].physical+uint64(extents[n-1].length) == uint64(physical) {
+				extents[n-1].length += 1
+			} else {
+				extents = append(extents, extent{logical: uint32(logical), physical: uint64(physical), length: 1})
+			}
+		}
+
+		logical += 1
+	}
+
+	var indirect func(block uint32, level int) error
+
+	indirect = func(block uint32, level int) error {
+		if block == 0 {
+			// hole, skip the blocks it would map
+			span := int64(1)
+
+			for i := 0; i < level; i++ {
+				span *= perBlock
+			}
+
+			logical += span
+			return nil
+		}
+
+		buf, err := fs.read(int64(block)*fs.blockSize, fs.blockSize)
+
+		if err != nil {
+			return err
+		}
+
+		for i := int64(0); i < perBlock && logical < blocks; i++ {
+			ptr := binary.LittleEndian.Uint32(buf[i*4:])
+
+			if level == 1 {
+				add(ptr)
+			} else if err = indirect(ptr, level-1); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for i := 0; i < 12 && logical < blocks; i++ {
+		add(binary.LittleEndian.Uint32(ino.block[i*4:]))
+	}
+
+	for level := 1; level <= 3 && logical < blocks; level++ {
+		if err = indirect(binary.LittleEndian.Uint32(ino.block[(11+level)*4:]), level); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (fs *FS) open(ino *inode) (f *File, err error) {
+	if ino.flags&inodeInlineDataFlag != 0 {
+		return nil, errors.New("inline data not supported")
+	}
+
+	f = &File{fs: fs, ino: ino}
+
+	if ino.flags&inodeExtentsFlag != 0 {
+		f.extents, err = fs.extentTree(ino.block, 0)
+	} else {
+		f.extents, err = fs.blockMap(ino)
+	}
+
+	sort.Slice(f.extents, func(i, j int) bool {
+		return f.extents[i].logical < f.extents[j].logical
+	})
+
+	return
+}
+
+func (fs *FS) readlink(ino *inode) (string, error) {
+	// fast symlinks are stored in the inode block pointers
+	if ino.size < 60 && ino.flags&inodeExtentsFlag == 0 {
+		return string(ino.block[:ino.size]), nil
+	}
+
+	f, err := fs.open(ino)
+
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, ino.size)
+
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// entries returns the directory entries of an inode.
+func (fs *FS) entries(ino *inode) (entries []FileInfo, err error) {
+	if !ino.isDir() {
+		return nil, errors.New("not a directory")
+	}
+
+	f, err := fs.open(ino)
+
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, fs.blockSize)
+
+	for off := int64(0); off < ino.size; off += fs.blockSize {
+		if _, err = f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return
+		}
+
+		for pos := 0; pos+8 <= len(buf); {
+			num := binary.LittleEndian.Uint32(buf[pos:])
+			recLen := int(binary.LittleEndian.Uint16(buf[pos+4:]))
+			nameLen := int(buf[pos+6])
+
+			if !fs.filetype {
+				nameLen = int(binary.LittleEndian.Uint16(buf[pos+6:]))
+			}
+
+			if recLen < 8 || pos+recLen > len(buf) || 8+nameLen > recLen {
+				break
+			}
+
+			if num != 0 && nameLen > 0 {
+				entries = append(entries, FileInfo{
+					Name:  string(buf[pos+8 : pos+8+nameLen]),
+					Inode: num,
+				})
+			}
+
+			pos += recLen
+		}
+	}
+
+	return entries, nil
+}
+
+func split(name string) (components []string) {
+	for _, c := range strings.Split(name, "/") {
+		if c != "" && c != "." {
+			components = append(components, c)
+		}
+	}
+
+	return
+}
+
+// lookup resolves a path, following symbolic links in all components but,
+// unless required, the last one.
+func (fs *FS) lookup(name string, followLast bool) (ino *inode, err error) {
+	if ino, err = fs.inode(rootInode); err != nil {
+		return
+	}
+
+	components := split(name)
+	links := 0
+
+	for len(components) > 0 {
+		c := components[0]
+		components = components[1:]
+
+		entries, err := fs.entries(ino)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var next *inode
+
+		for _, e := range entries {
+			if e.Name == c {
+				if next, err = fs.inode(e.Inode); err != nil {
+					return nil, err
+				}
+
+				break
+			}
+		}
+
+		if next == nil {
+			return nil, fmt.Errorf("%s: %v", name, os.ErrNotExist)
+		}
+
+		if next.isSymlink() && (len(components) > 0 || followLast) {
+			if links += 1; links > maxSymlinks {
+				return nil, fmt.Errorf("%s: too many symbolic links", name)
+			}
+
+			target, err := fs.readlink(next)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if path.IsAbs(target) {
+				if ino, err = fs.inode(rootInode); err != nil {
+					return nil, err
+				}
+			}
+
+			// resolved relative to the directory holding the link
+			components = append(split(target), components...)
+
+			continue
+		}
+
+		ino = next
+	}
+
+	return
+}
+
+func (fs *FS) info(name string, ino *inode) FileInfo {
+	return FileInfo{
+		Name:    name,
+		Inode:   ino.num,
+		Size:    ino.size,
+		Mode:    ino.fileMode(),
+		ModTime: time.Unix(int64(ino.mtime), 0),
+	}
+}
+
+// Stat returns the file information of a path, without following a final
+// symbolic link.
+func (fs *FS) Stat(name string) (fi FileInfo, err error) {
+	ino, err := fs.lookup(name, false)
+
+	if err != nil {
+		return
+	}
+
+	return fs.info(path.Base(name), ino), nil
+}
+
+// ReadDir returns the entries of a directory, sorted by name.
+func (fs *FS) ReadDir(name string) (list []FileInfo, err error) {
+	dir, err := fs.lookup(name, true)
+
+	if err != nil {
+		return
+	}
+
+	entries, err := fs.entries(dir)
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+
+		ino, err := fs.inode(e.Inode)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, fs.info(e.Name, ino))
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return
+}
+
+// Readlink returns the target of a symbolic link.
+func (fs *FS) Readlink(name string) (string, error) {
+	ino, err := fs.lookup(name, false)
+
+	if err != nil {
+		return "", err
+	}
+
+	if !ino.isSymlink() {
+		return "", errors.New("not a symbolic link")
+	}
+
+	return fs.readlink(ino)
+}
+
+// Open opens a regular file for reading.
+func (fs *FS) Open(name string) (f *File, err error) {
+	ino, err := fs.lookup(name, true)
+
+	if err != nil {
+		return
+	}
+
+	if ino.mode&modeTypeMask != modeFile {
+		return nil, fmt.Errorf("%s: not a regular file", name)
+	}
+
+	return fs.open(ino)
+}
+
+// Size returns the file size.
+func (f *File) Size() int64 {
+	return f.ino.size
+}
+
+// ReadAt implements io.ReaderAt, holes and uninitialized extents read as
+// zeroes.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	bs := f.fs.blockSize
+
+	for n < len(p) {
+		pos := off + int64(n)
+
+		if pos >= f.ino.size {
+			return n, io.EOF
+		}
+
+		block := pos / bs
+		size := bs - pos%bs
+
+		if rem := f.ino.size - pos; size > rem {
+			size = rem
+		}
+
+		if rem := int64(len(p) - n); size > rem {
+			size = rem
+		}
+
+		i := sort.Search(len(f.extents), func(i int) bool {
+			return int64(f.extents[i].logical)+int64(f.extents[i].length) > block
+		})
+
+		if i < len(f.extents) && int64(f.extents[i].logical) <= block && !f.extents[i].uninit {
+			e := f.extents[i]
+
+			// extend the read to the contiguous blocks of the extent
+			if end := (int64(e.logical)+int64(e.length))*bs - pos; end > size {
+				size = end
+
+				if rem := f.ino.size - pos; size > rem {
+					size = rem
+				}
+
+				if rem := int64(len(p) - n); size > rem {
+					size = rem
+				}
+			}
+
+			phys := (int64(e.physical)+block-int64(e.logical))*bs + pos%bs
+
+			if _, err = f.fs.r.ReadAt(p[n:int64(n)+size], phys); err != nil && err != io.EOF {
+				return
+			}
+		} else {
+			for j := int64(0); j < size; j++ {
+				p[int64(n)+j] = 0
+			}
+		}
+
+		n += int(size)
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.off)
+	f.off += int64(n)
+
+	return
+}
@@ -0,0 +1,716 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package fat implements a minimal FAT16 and FAT32 filesystem driver,
+// supporting directory listing, file reads, long file names (VFAT) and the
+// creation of new files.
+//
+// FAT12, file deletion or truncation and directory creation are not
+// supported, existing files are never modified.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	bootSignature = 0xaa55
+
+	dirEntrySize = 32
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+
+	// NTRes lower case flags
+	lowerBase = 0x08
+	lowerExt  = 0x10
+
+	entryFree    = 0xe5
+	entryEnd     = 0x00
+	lfnLast      = 0x40
+	lfnChars     = 13
+	maxNameChars = 255
+
+	fat16Min = 4085
+	fat32Min = 65525
+
+	fsInfoLeadSig   = 0x41615252
+	fsInfoStructSig = 0x61417272
+	fsInfoFreeCount = 488
+
+	// MaxFileSize is the largest file size.
+	MaxFileSize = 1<<32 - 1
+)
+
+// FS represents a FAT16 or FAT32 filesystem.
+type FS struct {
+	sync.Mutex
+
+	r io.ReaderAt
+
+	fat32       bool
+	sectorSize  int64
+	clusterSize int64
+	clusters    uint32
+
+	fatOffset int64
+	fatSize   int64
+	numFATs   int
+	activeFAT int
+	mirror    bool
+
+	// FAT16 fixed root directory
+	rootOffset int64
+	rootSize   int64
+	// FAT32 root directory cluster
+	rootCluster uint32
+
+	dataOffset int64
+	fsInfo     int64
+
+	// FAT sectors cache and pending writes
+	cache map[int64][]byte
+	dirty map[int64]bool
+	next  uint32
+}
+
+// FileInfo describes a file.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// File represents an open regular file.
+type File struct {
+	fs    *FS
+	size  int64
+	chain []uint32
+	off   int64
+}
+
+// span represents a contiguous byte range of directory data.
+type span struct {
+	off  int64
+	size int64
+}
+
+// entry represents a parsed directory entry.
+type entry struct {
+	FileInfo
+
+	short   string
+	cluster uint32
+	// index of the first slot (long name or short entry)
+	slot int
+}
+
+// Open opens the filesystem held by the argument reader, which must also
+// implement io.WriterAt for files to be created.
+func Open(r io.ReaderAt) (fs *FS, err error) {
+	bs := make([]byte, 512)
+
+	if _, err = r.ReadAt(bs, 0); err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint16(bs[510:]) != bootSignature {
+		return nil, errors.New("invalid boot sector signature")
+	}
+
+	sectorSize := int64(binary.LittleEndian.Uint16(bs[11:]))
+	sectorsPerCluster := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:]))
+	numFATs := int(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(bs[19:]))
+	fatSectors := int64(binary.LittleEndian.Uint16(bs[22:]))
+
+	switch sectorSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid sector size %d", sectorSize)
+	}
+
+	if sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 || reserved == 0 || numFATs == 0 {
+		return nil, errors.New("invalid BIOS parameter block")
+	}
+
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+
+	rootSectors := (rootEntries*dirEntrySize + sectorSize - 1) / sectorSize
+	dataSectors := totalSectors - reserved - int64(numFATs)*fatSectors - rootSectors
+
+	if fatSectors == 0 || dataSectors <= 0 {
+		return nil, errors.New("invalid BIOS parameter block")
+	}
+
+	fs = &FS{
+		r:           r,
+		sectorSize:  sectorSize,
+		clusterSize: sectorSize * sectorsPerCluster,
+		clusters:    uint32(dataSectors / sectorsPerCluster),
+		fatOffset:   reserved * sectorSize,
+		fatSize:     fatSectors * sectorSize,
+		numFATs:     numFATs,
+		mirror:      true,
+		rootOffset:  (reserved + int64(numFATs)*fatSectors) * sectorSize,
+		rootSize:    rootSectors * sectorSize,
+		next:        2,
+	}
+
+	fs.dataOffset = fs.rootOffset + fs.rootSize
+
+	switch {
+	case fs.clusters < fat16Min:
+		return nil, errors.New("FAT12 is not supported")
+	case fs.clusters >= fat32Min:
+		if rootEntries != 0 {
+			return nil, errors.New("invalid FAT32 root directory entries")
+		}
+
+		fs.fat32 = true
+		fs.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+
+		if flags := binary.LittleEndian.Uint16(bs[40:]); flags&0x80 != 0 {
+			fs.mirror = false
+			fs.activeFAT = int(flags & 0x0f)
+		}
+
+		if fs.activeFAT >= numFATs {
+			return nil, errors.New("invalid active FAT")
+		}
+
+		if info := int64(binary.LittleEndian.Uint16(bs[48:])); info != 0 && info != 0xffff {
+			fs.fsInfo = info * sectorSize
+		}
+	}
+
+	entrySize := int64(2)
+
+	if fs.fat32 {
+		entrySize = 4
+	}
+
+	if int64(fs.clusters+2)*entrySize > fs.fatSize {
+		return nil, errors.New("FAT too small for volume")
+	}
+
+	return
+}
+
+// Type returns the FAT type.
+func (fs *FS) Type() string {
+	if fs.fat32 {
+		return "FAT32"
+	}
+
+	return "FAT16"
+}
+
+// ClusterSize returns the cluster size in bytes.
+func (fs *FS) ClusterSize() int64 {
+	return fs.clusterSize
+}
+
+func (fs *FS) read(off int64, size int64) (buf []byte, err error) {
+	buf = make([]byte, size)
+
+	if _, err = fs.r.ReadAt(buf, off); err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (fs *FS) clusterOffset(c uint32) int64 {
+	return fs.dataOffset + int64(c-2)*fs.clusterSize
+}
+
+func (fs *FS) validCluster(c uint32) bool {
+	return c >= 2 && c < fs.clusters+2
+}
+
+// fatSector returns a cached sector of the active FAT.
+func (fs *FS) fatSector(n int64) (buf []byte, err error) {
+	if buf, ok := fs.cache[n]; ok {
+		return buf, nil
+	}
+
+	if fs.cache == nil {
+		fs.cache = make(map[int64][]byte)
+		fs.dirty = make(map[int64]bool)
+	}
+
+	off := fs.fatOffset + int64(fs.activeFAT)*fs.fatSize + n*fs.sectorSize
+
+	if buf, err = fs.read(off, fs.sectorSize); err != nil {
+		return
+	}
+
+	fs.cache[n] = buf
+
+	return
+}
+
+func (fs *FS) entryPosition(c uint32) (sector int64, off int64) {
+	pos := int64(c) * 2
+
+	if fs.fat32 {
+		pos = int64(c) * 4
+	}
+
+	return pos / fs.sectorSize, pos % fs.sectorSize
+}
+
+// get returns the FAT entry of a cluster.
+func (fs *FS) get(c uint32) (next uint32, err error) {
+	sector, off := fs.entryPosition(c)
+	buf, err := fs.fatSector(sector)
+
+	if err != nil {
+		return
+	}
+
+	if fs.fat32 {
+		return binary.LittleEndian.Uint32(buf[off:]) & 0x0fffffff, nil
+	}
+
+	return uint32(binary.LittleEndian.Uint16(buf[off:])), nil
+}
+
+func (fs *FS) isEOC(v uint32) bool {
+	if fs.fat32 {
+		return v >= 0x0ffffff8
+	}
+
+	return v >= 0xfff8
+}
+
+// chain returns the cluster chain starting at the argument cluster.
+func (fs *FS) chain(first uint32) (chain []uint32, err error) {
+	for c := first; ; {
+		if !fs.validCluster(c) {
+			return nil, fmt.Errorf("invalid cluster %d", c)
+		}
+
+		if uint32(len(chain)) >= fs.clusters {
+			return nil, errors.New("cluster chain loop")
+		}
+
+		chain = append(chain, c)
+
+		if c, err = fs.get(c); err != nil {
+			return
+		}
+
+		if fs.isEOC(c) {
+			return
+		}
+	}
+}
+
+// dirSpans returns the data ranges of a directory, a zero cluster denotes
+// the root directory.
+func (fs *FS) dirSpans(cluster uint32) (spans []span, err error) {
+	if cluster == 0 {
+		if !fs.fat32 {
+			return []span{{fs.rootOffset, fs.rootSize}}, nil
+		}
+
+		cluster = fs.rootCluster
+	}
+
+	chain, err := fs.chain(cluster)
+
+	if err != nil {
+		return
+	}
+
+	for _, c := range chain {
+		spans = append(spans, span{fs.clusterOffset(c), fs.clusterSize})
+	}
+
+	return
+}
+
+func (fs *FS) readSpans(spans []span) (buf []byte, err error) {
+	for _, s := range spans {
+		b, err := fs.read(s.off, s.size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, b...)
+	}
+
+	return
+}
+
+func decodeTime(d uint16, t uint16) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(1980+int(d>>9), time.Month(d>>5&0x0f), int(d&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
+
+func shortName(e []byte) (name string) {
+	base := []byte(strings.TrimRight(string(e[0:8]), " "))
+	ext := strings.TrimRight(string(e[8:11]), " ")
+
+	if len(base) > 0 && base[0] == 0x05 {
+		base[0] = entryFree
+	}
+
+	name = string(base)
+
+	if e[12]&lowerBase != 0 {
+		name = strings.ToLower(name)
+	}
+
+	if e[12]&lowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	if ext != "" {
+		name += "." + ext
+	}
+
+	return
+}
+
+func checksum(short []byte) (sum byte) {
+	for _, b := range short[0:11] {
+		sum = (sum&1)<<7 + sum>>1 + b
+	}
+
+	return
+}
+
+// entries parses the directory data.
+func (fs *FS) entries(buf []byte) (entries []entry) {
+	var lfn []uint16
+	var lfnSum byte
+	var lfnSlot int
+	var lfnNext int
+
+	for i := 0; i+dirEntrySize <= len(buf); i += dirEntrySize {
+		e := buf[i : i+dirEntrySize]
+		slot := i / dirEntrySize
+
+		if e[0] == entryEnd {
+			break
+		}
+
+		if e[0] == entryFree {
+			lfn = nil
+			continue
+		}
+
+		if e[11]&0x3f == attrLongName {
+			ord := int(e[0] & 0x1f)
+
+			if e[0]&lfnLast != 0 {
+				lfn = make([]uint16, ord*lfnChars)
+				lfnSum = e[13]
+				lfnSlot = slot
+				lfnNext = ord
+			}
+
+			if lfn == nil || ord != lfnNext || ord == 0 || e[13] != lfnSum {
+				lfn = nil
+				continue
+			}
+
+			pos := (ord - 1) * lfnChars
+
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for j := r[0]; j < r[1]; j += 2 {
+					lfn[pos] = binary.LittleEndian.Uint16(e[j:])
+					pos++
+				}
+			}
+
+			lfnNext--
+
+			continue
+		}
+
+		if e[11]&attrVolumeID != 0 {
+			lfn = nil
+			continue
+		}
+
+		ent := entry{
+			short:   string(e[0:11]),
+			cluster: uint32(binary.LittleEndian.Uint16(e[26:])),
+			slot:    slot,
+		}
+
+		if fs.fat32 {
+			ent.cluster |= uint32(binary.LittleEndian.Uint16(e[20:])) << 16
+		}
+
+		ent.Name = shortName(e)
+
+		if lfn != nil && lfnNext == 0 && checksum(e) == lfnSum {
+			for j, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:j]
+					break
+				}
+			}
+
+			ent.Name = string(utf16.Decode(lfn))
+			ent.slot = lfnSlot
+		}
+
+		lfn = nil
+
+		ent.Size = int64(binary.LittleEndian.Uint32(e[28:]))
+		ent.ModTime = decodeTime(binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]))
+		ent.Mode = 0644
+
+		if e[11]&attrReadOnly != 0 {
+			ent.Mode = 0444
+		}
+
+		if e[11]&attrDirectory != 0 {
+			ent.Mode |= os.ModeDir | 0111
+			ent.Size = 0
+		}
+
+		entries = append(entries, ent)
+	}
+
+	return
+}
+
+// readDir returns the entries of the directory starting at the argument
+// cluster.
+func (fs *FS) readDir(cluster uint32) (entries []entry, err error) {
+	spans, err := fs.dirSpans(cluster)
+
+	if err != nil {
+		return
+	}
+
+	buf, err := fs.readSpans(spans)
+
+	if err != nil {
+		return
+	}
+
+	return fs.entries(buf), nil
+}
+
+// lookup resolves a slash separated path, names are matched case
+// insensitively, the root directory is returned as a zero entry.
+func (fs *FS) lookup(name string) (e entry, err error) {
+	e.Mode = os.ModeDir | 0755
+
+	for _, c := range strings.Split(path.Clean("/"+name), "/") {
+		if c == "" {
+			continue
+		}
+
+		if !e.Mode.IsDir() {
+			return e, fmt.Errorf("%s: not a directory", e.Name)
+		}
+
+		entries, err := fs.readDir(e.cluster)
+
+		if err != nil {
+			return e, err
+		}
+
+		found := false
+
+		for _, ent := range entries {
+			if ent.Name != "." && ent.Name != ".." && strings.EqualFold(ent.Name, c) {
+				e = ent
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return e, os.ErrNotExist
+		}
+	}
+
+	return
+}
+
+// Stat returns the file information of a path.
+func (fs *FS) Stat(name string) (fi FileInfo, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	e, err := fs.lookup(name)
+
+	if err != nil {
+		return
+	}
+
+	fi = e.FileInfo
+
+	if fi.Name == "" {
+		fi.Name = "/"
+	}
+
+	return
+}
+
+// ReadDir returns the entries of a directory, sorted by name.
+func (fs *FS) ReadDir(name string) (list []FileInfo, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	dir, err := fs.lookup(name)
+
+	if err != nil {
+		return
+	}
+
+	if !dir.Mode.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", name)
+	}
+
+	entries, err := fs.readDir(dir.cluster)
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+
+		list = append(list, e.FileInfo)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return
+}
+
+// Open opens a regular file for reading.
+func (fs *FS) Open(name string) (f *File, err error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	e, err := fs.lookup(name)
+
+	if err != nil {
+		return
+	}
+
+	if e.Mode.IsDir() {
+		return nil, fmt.Errorf("%s: not a regular file", name)
+	}
+
+	f = &File{
+		fs:   fs,
+		size: e.Size,
+	}
+
+	if e.Size == 0 {
+		return
+	}
+
+	if f.chain, err = fs.chain(e.cluster); err != nil {
+		return nil, err
+	}
+
+	if int64(len(f.chain))*fs.clusterSize < e.Size {
+		return nil, fmt.Errorf("%s: cluster chain shorter than file", name)
+	}
+
+	return
+}
+
+// Size returns the file size.
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	cs := f.fs.clusterSize
+
+	for n < len(p) {
+		pos := off + int64(n)
+
+		if pos >= f.size {
+			return n, io.EOF
+		}
+
+		i := pos / cs
+		size := cs - pos%cs
+
+		// extend the read to contiguous clusters
+		for j := i + 1; j < int64(len(f.chain)) && f.chain[j] == f.chain[j-1]+1 && size < int64(len(p)-n); j++ {
+			size += cs
+		}
+
+		if rem := f.size - pos; size > rem {
+			size = rem
+		}
+
+		if rem := int64(len(p) - n); size > rem {
+			size = rem
+		}
+
+		phys := f.fs.clusterOffset(f.chain[i]) + pos%cs
+
+		if _, err = f.fs.r.ReadAt(p[n:int64(n)+size], phys); err != nil && err != io.EOF {
+			return
+		}
+
+		n += int(size)
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.off)
+	f.off += int64(n)
+
+	return
+}
@@ -0,0 +1,546 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ErrReadOnly is returned when creating files on a read-only device.
+var ErrReadOnly = errors.New("read-only filesystem")
+
+const invalidNameChars = "\"*/:<>?\\|"
+
+// valid characters, besides letters and digits, in short names
+const shortNameChars = "$%'-_@~`!(){}^#&"
+
+func (fs *FS) writer() (w io.WriterAt, err error) {
+	w, ok := fs.r.(io.WriterAt)
+
+	if !ok {
+		return nil, ErrReadOnly
+	}
+
+	return
+}
+
+// set updates the FAT entry of a cluster.
+func (fs *FS) set(c uint32, v uint32) (err error) {
+	sector, off := fs.entryPosition(c)
+	buf, err := fs.fatSector(sector)
+
+	if err != nil {
+		return
+	}
+
+	if fs.fat32 {
+		// the upper 4 bits are reserved and preserved
+		v |= binary.LittleEndian.Uint32(buf[off:]) & 0xf0000000
+		binary.LittleEndian.PutUint32(buf[off:], v)
+	} else {
+		binary.LittleEndian.PutUint16(buf[off:], uint16(v))
+	}
+
+	fs.dirty[sector] = true
+
+	return
+}
+
+func (fs *FS) eoc() uint32 {
+	if fs.fat32 {
+		return 0x0fffffff
+	}
+
+	return 0xffff
+}
+
+// allocate returns a free cluster, marked as end of chain and linked to the
+// argument previous cluster, if any.
+func (fs *FS) allocate(prev uint32) (c uint32, err error) {
+	for i := uint32(0); i < fs.clusters; i++ {
+		c = 2 + (fs.next-2+i)%fs.clusters
+
+		v, err := fs.get(c)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if v != 0 {
+			continue
+		}
+
+		if err = fs.set(c, fs.eoc()); err != nil {
+			return 0, err
+		}
+
+		if prev != 0 {
+			if err = fs.set(prev, c); err != nil {
+				return 0, err
+			}
+		}
+
+		fs.next = c + 1
+
+		return c, nil
+	}
+
+	return 0, errors.New("no space left on device")
+}
+
+// flush writes the modified FAT sectors to all FAT copies, invalidating
+// the FAT32 free cluster count.
+func (fs *FS) flush(w io.WriterAt) (err error) {
+	if len(fs.dirty) == 0 {
+		return
+	}
+
+	for sector := range fs.dirty {
+		for i := 0; i < fs.numFATs; i++ {
+			if !fs.mirror && i != fs.activeFAT {
+				continue
+			}
+
+			off := fs.fatOffset + int64(i)*fs.fatSize + sector*fs.sectorSize
+
+			if _, err = w.WriteAt(fs.cache[sector], off); err != nil {
+				return
+			}
+		}
+
+		delete(fs.dirty, sector)
+	}
+
+	if fs.fsInfo == 0 {
+		return
+	}
+
+	info, err := fs.read(fs.fsInfo, fs.sectorSize)
+
+	if err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint32(info[0:]) != fsInfoLeadSig || binary.LittleEndian.Uint32(info[484:]) != fsInfoStructSig {
+		return
+	}
+
+	binary.LittleEndian.PutUint32(info[fsInfoFreeCount:], 0xffffffff)
+	_, err = w.WriteAt(info, fs.fsInfo)
+
+	return
+}
+
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(utf16.Encode([]rune(name))) > maxNameChars {
+		return false
+	}
+
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(invalidNameChars, r) {
+			return false
+		}
+	}
+
+	return !strings.HasSuffix(name, ".") && !strings.HasSuffix(name, " ")
+}
+
+func shortChar(r rune) (byte, bool) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return byte(r) - 'a' + 'A', true
+	case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r < 0x80 && strings.ContainsRune(shortNameChars, r):
+		return byte(r), true
+	default:
+		return '_', false
+	}
+}
+
+// shortBasis returns the 8.3 basis name of a long name, and whether the
+// long name is exactly represented by it.
+func shortBasis(name string) (short []byte, exact bool) {
+	short = []byte("           ")
+	exact = true
+
+	base := name
+	ext := ""
+
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+
+	pack := func(dst []byte, s string) {
+		n := 0
+
+		for _, r := range s {
+			if r == ' ' || r == '.' {
+				exact = false
+				continue
+			}
+
+			c, ok := shortChar(r)
+
+			if !ok || rune(c) != r {
+				exact = false
+			}
+
+			if n == len(dst) {
+				exact = false
+				continue
+			}
+
+			dst[n] = c
+			n++
+		}
+	}
+
+	if trimmed := strings.TrimLeft(base, "."); trimmed != base {
+		base = trimmed
+		exact = false
+	}
+
+	pack(short[0:8], base)
+	pack(short[8:11], ext)
+
+	if short[0] == ' ' {
+		short[0] = '_'
+		exact = false
+	}
+
+	return
+}
+
+// uniqueShort returns a numeric tail short name not used in the directory.
+func uniqueShort(basis []byte, entries []entry) ([]byte, error) {
+	used := make(map[string]bool)
+
+	for _, e := range entries {
+		used[e.short] = true
+	}
+
+	baseLen := strings.IndexByte(string(basis[0:8]), ' ')
+
+	if baseLen < 0 {
+		baseLen = 8
+	}
+
+	for n := 1; n < 1000000; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		short := append([]byte{}, basis...)
+
+		l := baseLen
+
+		if l > 8-len(tail) {
+			l = 8 - len(tail)
+		}
+
+		copy(short[l:8], tail+"        ")
+
+		if !used[string(short)] {
+			return short, nil
+		}
+	}
+
+	return nil, errors.New("no short name available")
+}
+
+func encodeTime(t time.Time) (d uint16, tm uint16) {
+	if t.Year() < 1980 {
+		return 0x21, 0
+	}
+
+	d = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+
+	return
+}
+
+// dirSlots returns the directory entries encoding a file.
+func dirSlots(name string, short []byte, lfn bool, cluster uint32, size int64, mtime time.Time) (slots []byte) {
+	e := make([]byte, dirEntrySize)
+
+	copy(e[0:11], short)
+	e[11] = attrArchive
+
+	d, t := encodeTime(mtime)
+	binary.LittleEndian.PutUint16(e[14:], t)
+	binary.LittleEndian.PutUint16(e[16:], d)
+	binary.LittleEndian.PutUint16(e[18:], d)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], t)
+	binary.LittleEndian.PutUint16(e[24:], d)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+
+	if !lfn {
+		return e
+	}
+
+	chars := utf16.Encode([]rune(name))
+	n := (len(chars) + lfnChars - 1) / lfnChars
+	sum := checksum(short)
+
+	// terminate and pad the last long name entry
+	if len(chars)%lfnChars != 0 {
+		chars = append(chars, 0)
+	}
+
+	for len(chars)%lfnChars != 0 {
+		chars = append(chars, 0xffff)
+	}
+
+	for ord := n; ord > 0; ord-- {
+		l := make([]byte, dirEntrySize)
+		l[0] = byte(ord)
+
+		if ord == n {
+			l[0] |= lfnLast
+		}
+
+		l[11] = attrLongName
+		l[13] = sum
+
+		pos := (ord - 1) * lfnChars
+
+		for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+			for j := r[0]; j < r[1]; j += 2 {
+				binary.LittleEndian.PutUint16(l[j:], chars[pos])
+				pos++
+			}
+		}
+
+		slots = append(slots, l...)
+	}
+
+	return append(slots, e...)
+}
+
+// freeSlots returns the index of the first run of n free directory slots.
+func freeSlots(buf []byte, n int) int {
+	run := 0
+
+	for i := 0; i+dirEntrySize <= len(buf); i += dirEntrySize {
+		if buf[i] == entryEnd || buf[i] == entryFree {
+			if run++; run == n {
+				return i/dirEntrySize - n + 1
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	return -1
+}
+
+// writeSlots writes directory data at the argument slot index.
+func writeSlots(w io.WriterAt, spans []span, slot int, data []byte) (err error) {
+	pos := int64(slot) * dirEntrySize
+
+	for _, s := range spans {
+		if len(data) == 0 {
+			break
+		}
+
+		if pos >= s.size {
+			pos -= s.size
+			continue
+		}
+
+		n := s.size - pos
+
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+
+		if _, err = w.WriteAt(data[:n], s.off+pos); err != nil {
+			return
+		}
+
+		data = data[n:]
+		pos = 0
+	}
+
+	return
+}
+
+// release frees a cluster chain, on failed file creations.
+func (fs *FS) release(chain []uint32) {
+	for _, c := range chain {
+		fs.set(c, 0)
+	}
+}
+
+// Create creates a new file, with the data read from the argument reader,
+// returning its size. Existing files are not overwritten.
+func (fs *FS) Create(name string, r io.Reader, mtime time.Time) (size int64, err error) {
+	w, err := fs.writer()
+
+	if err != nil {
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	name = path.Clean("/" + name)
+	dirName, base := path.Split(name)
+
+	if !validName(base) {
+		return 0, fmt.Errorf("invalid file name %q", base)
+	}
+
+	dir, err := fs.lookup(dirName)
+
+	if err != nil {
+		return
+	}
+
+	if !dir.Mode.IsDir() {
+		return 0, fmt.Errorf("%s: not a directory", dirName)
+	}
+
+	entries, err := fs.readDir(dir.cluster)
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if strings.EqualFold(e.Name, base) {
+			return 0, os.ErrExist
+		}
+	}
+
+	short, exact := shortBasis(base)
+
+	if !exact {
+		if short, err = uniqueShort(short, entries); err != nil {
+			return
+		}
+	}
+
+	var chain []uint32
+
+	defer func() {
+		if err != nil {
+			fs.release(chain)
+			fs.flush(w)
+		}
+	}()
+
+	buf := make([]byte, fs.clusterSize)
+
+	for {
+		n, rerr := io.ReadFull(r, buf)
+
+		if n > 0 {
+			if size += int64(n); size > MaxFileSize {
+				return 0, errors.New("file too large")
+			}
+
+			var prev uint32
+
+			if len(chain) > 0 {
+				prev = chain[len(chain)-1]
+			}
+
+			c, err := fs.allocate(prev)
+
+			if err != nil {
+				return 0, err
+			}
+
+			chain = append(chain, c)
+
+			if _, err = w.WriteAt(buf[:n], fs.clusterOffset(c)); err != nil {
+				return 0, err
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if rerr != nil {
+			return 0, rerr
+		}
+	}
+
+	var first uint32
+
+	if len(chain) > 0 {
+		first = chain[0]
+	}
+
+	slots := dirSlots(base, short, !exact, first, size, mtime)
+
+	if err = fs.addEntry(w, dir.cluster, slots); err != nil {
+		return 0, err
+	}
+
+	return
+}
+
+// addEntry writes the directory slots in the first free run, extending the
+// directory if required.
+func (fs *FS) addEntry(w io.WriterAt, cluster uint32, slots []byte) (err error) {
+	n := len(slots) / dirEntrySize
+
+	for {
+		spans, err := fs.dirSpans(cluster)
+
+		if err != nil {
+			return err
+		}
+
+		buf, err := fs.readSpans(spans)
+
+		if err != nil {
+			return err
+		}
+
+		if slot := freeSlots(buf, n); slot >= 0 {
+			// the file data chain is committed before its entry
+			if err = fs.flush(w); err != nil {
+				return err
+			}
+
+			return writeSlots(w, spans, slot, slots)
+		}
+
+		if cluster == 0 && !fs.fat32 {
+			return errors.New("root directory full")
+		}
+
+		last := spans[len(spans)-1]
+		prev := uint32((last.off-fs.dataOffset)/fs.clusterSize) + 2
+
+		c, err := fs.allocate(prev)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.WriteAt(make([]byte, fs.clusterSize), fs.clusterOffset(c)); err != nil {
+			return err
+		}
+
+		if err = fs.flush(w); err != nil {
+			return err
+		}
+	}
+}
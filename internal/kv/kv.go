@@ -0,0 +1,425 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package kv implements a minimal log-structured key-value store, with atomic
+// batch commits, on a fixed size storage region such as a raw memory card
+// area.
+//
+// The region is divided in two halves, only one of which is active at any
+// time. Each commit appends a checksummed, block aligned, record to the
+// active half log, which is replayed when opening the store. When the log is
+// full the live data is compacted in the other half, whose header is written
+// last so that an interrupted compaction leaves the active half in use.
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	headerMagic = 0x4b564442 // KVDB
+	recordMagic = 0x4b565243 // KVRC
+
+	recordHeaderSize = 20
+
+	opPut    = 1
+	opDelete = 2
+
+	// maximum record payload written during compaction
+	compactRecordSize = 64 * 1024
+)
+
+var (
+	// ErrNotFound is returned when a key is not present in the store.
+	ErrNotFound = errors.New("key not found")
+	// ErrFull is returned when live data exceeds the store capacity.
+	ErrFull = errors.New("store full")
+)
+
+// Storage represents the region backing a store.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+}
+
+type entry struct {
+	off  int64
+	size int
+}
+
+// DB represents a key-value store.
+type DB struct {
+	s         Storage
+	blockSize int64
+	half      int64
+
+	active int
+	gen    uint32
+	seq    uint32
+	off    int64
+
+	index map[string]entry
+
+	// Compactions counts log compactions since the store was opened.
+	Compactions int
+}
+
+// Batch represents a set of changes applied atomically on commit.
+type Batch struct {
+	buf bytes.Buffer
+	ops int
+}
+
+func align(n int64, blockSize int64) int64 {
+	return (n + blockSize - 1) / blockSize * blockSize
+}
+
+// Open opens the store held on the argument storage, accesses are aligned to
+// the argument block size. A new store is created if no valid one is found.
+func Open(s Storage, blockSize int) (db *DB, err error) {
+	db = &DB{
+		s:         s,
+		blockSize: int64(blockSize),
+		half:      s.Size() / 2 / int64(blockSize) * int64(blockSize),
+	}
+
+	if db.half < 4*db.blockSize {
+		return nil, errors.New("storage too small")
+	}
+
+	valid := false
+
+	for i := 0; i < 2; i++ {
+		if gen, ok := db.readHeader(i); ok && (!valid || gen > db.gen) {
+			db.active = i
+			db.gen = gen
+			valid = true
+		}
+	}
+
+	if !valid {
+		db.active = 0
+		db.gen = 1
+
+		if err = db.writeHeader(0, db.gen); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = db.replay(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (db *DB) base(half int) int64 {
+	return int64(half) * db.half
+}
+
+func (db *DB) readHeader(half int) (gen uint32, ok bool) {
+	buf := make([]byte, 12)
+
+	if _, err := db.s.ReadAt(buf, db.base(half)); err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint32(buf[0:]) != headerMagic ||
+		binary.LittleEndian.Uint32(buf[8:]) != crc32.ChecksumIEEE(buf[0:8]) {
+		return
+	}
+
+	return binary.LittleEndian.Uint32(buf[4:]), true
+}
+
+func (db *DB) writeHeader(half int, gen uint32) (err error) {
+	buf := make([]byte, db.blockSize)
+
+	if gen != 0 {
+		binary.LittleEndian.PutUint32(buf[0:], headerMagic)
+		binary.LittleEndian.PutUint32(buf[4:], gen)
+		binary.LittleEndian.PutUint32(buf[8:], crc32.ChecksumIEEE(buf[0:8]))
+	}
+
+	_, err = db.s.WriteAt(buf, db.base(half))
+
+	return
+}
+
+// replay rebuilds the index from the active half log, which ends at the
+// first record with invalid header, generation, sequence or checksum.
+func (db *DB) replay() (err error) {
+	db.index = make(map[string]entry)
+	db.seq = 0
+	db.off = db.blockSize
+
+	base := db.base(db.active)
+	hdr := make([]byte, recordHeaderSize)
+
+	for db.off+recordHeaderSize <= db.half {
+		if _, err = db.s.ReadAt(hdr, base+db.off); err != nil {
+			return
+		}
+
+		length := int64(binary.LittleEndian.Uint32(hdr[12:]))
+
+		if binary.LittleEndian.Uint32(hdr[0:]) != recordMagic ||
+			binary.LittleEndian.Uint32(hdr[4:]) != db.gen ||
+			binary.LittleEndian.Uint32(hdr[8:]) != db.seq ||
+			db.off+recordHeaderSize+length > db.half {
+			break
+		}
+
+		payload := make([]byte, length)
+
+		if _, err = db.s.ReadAt(payload, base+db.off+recordHeaderSize); err != nil {
+			return
+		}
+
+		if binary.LittleEndian.Uint32(hdr[16:]) != checksum(hdr, payload) {
+			break
+		}
+
+		if err = db.apply(payload, base+db.off+recordHeaderSize); err != nil {
+			break
+		}
+
+		db.off += align(recordHeaderSize+length, db.blockSize)
+		db.seq += 1
+	}
+
+	return nil
+}
+
+func checksum(hdr []byte, payload []byte) uint32 {
+	crc := crc32.ChecksumIEEE(hdr[4:16])
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+// apply updates the index with the operations of a record payload, stored at
+// the argument offset.
+func (db *DB) apply(payload []byte, off int64) error {
+	for pos := 0; pos < len(payload); {
+		op := payload[pos]
+		pos += 1
+
+		klen, n := binary.Uvarint(payload[pos:])
+
+		if n <= 0 || pos+n+int(klen) > len(payload) {
+			return errors.New("invalid record")
+		}
+
+		pos += n
+		key := string(payload[pos : pos+int(klen)])
+		pos += int(klen)
+
+		switch op {
+		case opPut:
+			vlen, n := binary.Uvarint(payload[pos:])
+
+			if n <= 0 || pos+n+int(vlen) > len(payload) {
+				return errors.New("invalid record")
+			}
+
+			pos += n
+			db.index[key] = entry{off: off + int64(pos), size: int(vlen)}
+			pos += int(vlen)
+		case opDelete:
+			delete(db.index, key)
+		default:
+			return errors.New("invalid operation")
+		}
+	}
+
+	return nil
+}
+
+// write appends a record to a half log.
+func (db *DB) write(half int, gen uint32, seq uint32, off int64, payload []byte) (err error) {
+	buf := make([]byte, align(recordHeaderSize+int64(len(payload)), db.blockSize))
+
+	binary.LittleEndian.PutUint32(buf[0:], recordMagic)
+	binary.LittleEndian.PutUint32(buf[4:], gen)
+	binary.LittleEndian.PutUint32(buf[8:], seq)
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(payload)))
+	copy(buf[recordHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(buf[16:], checksum(buf, payload))
+
+	_, err = db.s.WriteAt(buf, db.base(half)+off)
+
+	return
+}
+
+// compact writes the live data in the inactive half, which then becomes the
+// active one.
+func (db *DB) compact() (err error) {
+	next := 1 - db.active
+	gen := db.gen + 1
+
+	keys := db.Keys("")
+
+	// invalidate the stale header before overwriting its log
+	if err = db.writeHeader(next, 0); err != nil {
+		return
+	}
+
+	var b Batch
+
+	seq := uint32(0)
+	off := db.blockSize
+
+	flush := func() error {
+		if b.ops == 0 {
+			return nil
+		}
+
+		size := align(recordHeaderSize+int64(b.buf.Len()), db.blockSize)
+
+		if off+size > db.half {
+			return ErrFull
+		}
+
+		if err := db.write(next, gen, seq, off, b.buf.Bytes()); err != nil {
+			return err
+		}
+
+		seq += 1
+		off += size
+		b = Batch{}
+
+		return nil
+	}
+
+	for _, k := range keys {
+		v, err := db.Get([]byte(k))
+
+		if err != nil {
+			return err
+		}
+
+		b.Put([]byte(k), v)
+
+		if b.buf.Len() >= compactRecordSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = flush(); err != nil {
+		return
+	}
+
+	if err = db.writeHeader(next, gen); err != nil {
+		return
+	}
+
+	db.active = next
+	db.gen = gen
+	db.Compactions += 1
+
+	return db.replay()
+}
+
+// Put adds a key-value pair to the batch.
+func (b *Batch) Put(key []byte, value []byte) {
+	var n [binary.MaxVarintLen64]byte
+
+	b.buf.WriteByte(opPut)
+	b.buf.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	b.buf.Write(key)
+	b.buf.Write(n[:binary.PutUvarint(n[:], uint64(len(value)))])
+	b.buf.Write(value)
+	b.ops += 1
+}
+
+// Delete adds a key removal to the batch.
+func (b *Batch) Delete(key []byte) {
+	var n [binary.MaxVarintLen64]byte
+
+	b.buf.WriteByte(opDelete)
+	b.buf.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+	b.buf.Write(key)
+	b.ops += 1
+}
+
+// Commit atomically applies the batch to the store.
+func (db *DB) Commit(b *Batch) (err error) {
+	if b.ops == 0 {
+		return
+	}
+
+	size := align(recordHeaderSize+int64(b.buf.Len()), db.blockSize)
+
+	if db.off+size > db.half {
+		if err = db.compact(); err != nil {
+			return
+		}
+
+		if db.off+size > db.half {
+			return ErrFull
+		}
+	}
+
+	if err = db.write(db.active, db.gen, db.seq, db.off, b.buf.Bytes()); err != nil {
+		return
+	}
+
+	if err = db.apply(b.buf.Bytes(), db.base(db.active)+db.off+recordHeaderSize); err != nil {
+		return
+	}
+
+	db.off += size
+	db.seq += 1
+
+	return
+}
+
+// Get returns the value of a key.
+func (db *DB) Get(key []byte) (value []byte, err error) {
+	e, ok := db.index[string(key)]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value = make([]byte, e.size)
+	_, err = db.s.ReadAt(value, e.off)
+
+	return
+}
+
+// Keys returns the sorted keys starting with the argument prefix.
+func (db *DB) Keys(prefix string) (keys []string) {
+	for k := range db.index {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return
+}
+
+// Len returns the number of keys in the store.
+func (db *DB) Len() int {
+	return len(db.index)
+}
+
+// Used returns the size of the active log, and the capacity of each half.
+func (db *DB) Used() (used int64, capacity int64) {
+	return db.off, db.half
+}
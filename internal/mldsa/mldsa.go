@@ -0,0 +1,831 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package mldsa implements the ML-DSA-65 digital signature algorithm
+// specified in FIPS 204, in its pure (non pre-hash) variant.
+//
+// The implementation follows the specification algorithms closely, with plain
+// modular arithmetic rather than Montgomery reductions, and is meant for
+// benchmarking rather than production use as it is not hardened against side
+// channels.
+package mldsa
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	n = 256
+	q = 8380417
+	d = 13
+
+	k      = 6
+	l      = 5
+	eta    = 4
+	tau    = 49
+	lambda = 192
+	gamma1 = 1 << 19
+	gamma2 = (q - 1) / 32
+	beta   = tau * eta
+	omega  = 55
+
+	// 256^-1 mod q
+	invN = 8347681
+
+	// encoded coefficient sizes in bits
+	t1Bits = 10
+	w1Bits = 4
+	zBits  = 20
+	sBits  = 4
+	t0Bits = 13
+
+	ctildeSize = lambda / 4
+)
+
+const (
+	// SeedSize is the private key seed size in bytes.
+	SeedSize = 32
+	// PublicKeySize is the encoded public key size in bytes.
+	PublicKeySize = 32 + k*n*t1Bits/8
+	// PrivateKeySize is the encoded private key size in bytes.
+	PrivateKeySize = 32 + 32 + 64 + (l+k)*n*sBits/8 + k*n*t0Bits/8
+	// SignatureSize is the encoded signature size in bytes.
+	SignatureSize = ctildeSize + l*n*zBits/8 + omega + k
+)
+
+type poly [n]uint32
+
+func add(a, b uint32) uint32 {
+	return (a + b) % q
+}
+
+func sub(a, b uint32) uint32 {
+	return (a + q - b) % q
+}
+
+func mul(a, b uint32) uint32 {
+	return uint32(uint64(a) * uint64(b) % q)
+}
+
+// zetas holds 1753^BitRev8(i) mod q.
+var zetas [n]uint32
+
+func init() {
+	for i := range zetas {
+		rev := 0
+
+		for b := 0; b < 8; b++ {
+			rev |= (i >> b & 1) << (7 - b)
+		}
+
+		z := uint32(1)
+
+		for j := 0; j < rev; j++ {
+			z = mul(z, 1753)
+		}
+
+		zetas[i] = z
+	}
+}
+
+// ntt implements Algorithm 41.
+func (w *poly) ntt() {
+	m := 0
+
+	for ln := 128; ln >= 1; ln /= 2 {
+		for start := 0; start < n; start += 2 * ln {
+			m++
+			z := zetas[m]
+
+			for j := start; j < start+ln; j++ {
+				t := mul(z, w[j+ln])
+				w[j+ln] = sub(w[j], t)
+				w[j] = add(w[j], t)
+			}
+		}
+	}
+}
+
+// invNTT implements Algorithm 42.
+func (w *poly) invNTT() {
+	m := n
+
+	for ln := 1; ln < n; ln *= 2 {
+		for start := 0; start < n; start += 2 * ln {
+			m--
+			z := q - zetas[m]
+
+			for j := start; j < start+ln; j++ {
+				t := w[j]
+				w[j] = add(t, w[j+ln])
+				w[j+ln] = mul(z, sub(t, w[j+ln]))
+			}
+		}
+	}
+
+	for j := range w {
+		w[j] = mul(w[j], invN)
+	}
+}
+
+func (w *poly) add(v *poly) {
+	for i := range w {
+		w[i] = add(w[i], v[i])
+	}
+}
+
+func (w *poly) sub(v *poly) {
+	for i := range w {
+		w[i] = sub(w[i], v[i])
+	}
+}
+
+// mulAdd adds the NTT domain product of a and b to w.
+func mulAdd(w *poly, a *poly, b *poly) {
+	for i := range w {
+		w[i] = add(w[i], mul(a[i], b[i]))
+	}
+}
+
+// infNorm returns the infinity norm of the centered coefficients.
+func (w *poly) infNorm() (max uint32) {
+	for _, c := range w {
+		if c > (q-1)/2 {
+			c = q - c
+		}
+
+		if c > max {
+			max = c
+		}
+	}
+
+	return
+}
+
+func shake256(size int, inputs ...[]byte) []byte {
+	h := sha3.NewShake256()
+
+	for _, in := range inputs {
+		h.Write(in)
+	}
+
+	out := make([]byte, size)
+	h.Read(out)
+
+	return out
+}
+
+// rejNTTPoly implements Algorithm 30.
+func rejNTTPoly(rho []byte, s byte, r byte) (a poly) {
+	var buf [168]byte
+
+	xof := sha3.NewShake128()
+	xof.Write(rho)
+	xof.Write([]byte{s, r})
+
+	for j := 0; j < n; {
+		xof.Read(buf[:])
+
+		for b := 0; b < len(buf) && j < n; b += 3 {
+			z := uint32(buf[b]) | uint32(buf[b+1])<<8 | uint32(buf[b+2]&0x7f)<<16
+
+			if z < q {
+				a[j] = z
+				j++
+			}
+		}
+	}
+
+	return
+}
+
+// rejBoundedPoly implements Algorithm 31 for eta = 4.
+func rejBoundedPoly(rho []byte, r uint16) (a poly) {
+	var buf [136]byte
+
+	xof := sha3.NewShake256()
+	xof.Write(rho)
+	xof.Write([]byte{byte(r), byte(r >> 8)})
+
+	for j := 0; j < n; {
+		xof.Read(buf[:])
+
+		for _, z := range buf {
+			for _, b := range []byte{z & 0x0f, z >> 4} {
+				if b < 9 && j < n {
+					a[j] = sub(eta, uint32(b))
+					j++
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// expandMask implements Algorithm 34 for a single polynomial.
+func expandMask(rho []byte, mu uint16) (y poly) {
+	v := shake256(n*zBits/8, rho, []byte{byte(mu), byte(mu >> 8)})
+	return bitUnpack(v, gamma1, zBits)
+}
+
+// sampleInBall implements Algorithm 29.
+func sampleInBall(rho []byte) (c poly) {
+	var buf [136]byte
+
+	xof := sha3.NewShake256()
+	xof.Write(rho)
+	xof.Read(buf[:])
+
+	var signs uint64
+
+	for i := 0; i < 8; i++ {
+		signs |= uint64(buf[i]) << (8 * i)
+	}
+
+	pos := 8
+
+	for i := n - tau; i < n; i++ {
+		var j int
+
+		for {
+			if pos == len(buf) {
+				xof.Read(buf[:])
+				pos = 0
+			}
+
+			j = int(buf[pos])
+			pos++
+
+			if j <= i {
+				break
+			}
+		}
+
+		c[i] = c[j]
+		c[j] = 1
+
+		if signs&1 == 1 {
+			c[j] = q - 1
+		}
+
+		signs >>= 1
+	}
+
+	return
+}
+
+func packBits(out []byte, w *poly, bits int, f func(uint32) uint32) []byte {
+	var acc uint64
+	var nb int
+
+	for _, c := range w {
+		acc |= uint64(f(c)) << nb
+		nb += bits
+
+		for nb >= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+			nb -= 8
+		}
+	}
+
+	return out
+}
+
+func unpackBits(v []byte, bits int, f func(uint32) uint32) (w poly) {
+	var acc uint64
+	var nb int
+
+	for i := range w {
+		for nb < bits {
+			acc |= uint64(v[0]) << nb
+			v = v[1:]
+			nb += 8
+		}
+
+		w[i] = f(uint32(acc & (1<<bits - 1)))
+		acc >>= bits
+		nb -= bits
+	}
+
+	return
+}
+
+// bitPack implements Algorithm 17, coefficients are encoded as b - w.
+func bitPack(out []byte, w *poly, b uint32, bits int) []byte {
+	return packBits(out, w, bits, func(c uint32) uint32 { return sub(b, c) })
+}
+
+// bitUnpack implements Algorithm 19.
+func bitUnpack(v []byte, b uint32, bits int) poly {
+	return unpackBits(v, bits, func(c uint32) uint32 { return sub(b, c) })
+}
+
+// simpleBitPack implements Algorithm 16.
+func simpleBitPack(out []byte, w *poly, bits int) []byte {
+	return packBits(out, w, bits, func(c uint32) uint32 { return c })
+}
+
+// simpleBitUnpack implements Algorithm 18.
+func simpleBitUnpack(v []byte, bits int) poly {
+	return unpackBits(v, bits, func(c uint32) uint32 { return c })
+}
+
+// power2Round implements Algorithm 35.
+func power2Round(r uint32) (r1 uint32, r0 uint32) {
+	r0 = r & (1<<d - 1)
+
+	if r0 > 1<<(d-1) {
+		r0 = sub(r0, 1<<d)
+	}
+
+	r1 = sub(r, r0) >> d
+
+	return
+}
+
+// decompose implements Algorithm 36, r0 is returned mod q.
+func decompose(r uint32) (r1 uint32, r0 uint32) {
+	r0 = r % (2 * gamma2)
+
+	if r0 > gamma2 {
+		r0 = sub(r0, 2*gamma2)
+	}
+
+	if sub(r, r0) == q-1 {
+		return 0, sub(r0, 1)
+	}
+
+	return sub(r, r0) / (2 * gamma2), r0
+}
+
+func highBits(r uint32) uint32 {
+	r1, _ := decompose(r)
+	return r1
+}
+
+// useHint implements Algorithm 40.
+func useHint(h bool, r uint32) uint32 {
+	const m = (q - 1) / (2 * gamma2)
+
+	r1, r0 := decompose(r)
+
+	if !h {
+		return r1
+	}
+
+	if r0 != 0 && r0 <= (q-1)/2 {
+		return (r1 + 1) % m
+	}
+
+	return (r1 + m - 1) % m
+}
+
+func expandA(rho []byte) (a [k][l]poly) {
+	for r := 0; r < k; r++ {
+		for s := 0; s < l; s++ {
+			a[r][s] = rejNTTPoly(rho, byte(s), byte(r))
+		}
+	}
+
+	return
+}
+
+// PrivateKey represents an ML-DSA-65 private key, in expanded form.
+type PrivateKey struct {
+	seed [SeedSize]byte
+
+	rho [32]byte
+	key [32]byte
+	tr  [64]byte
+
+	s1 [l]poly
+	s2 [k]poly
+	t0 [k]poly
+
+	// NTT domain
+	a   [k][l]poly
+	s1h [l]poly
+	s2h [k]poly
+	t0h [k]poly
+
+	pk *PublicKey
+}
+
+// PublicKey represents an ML-DSA-65 public key.
+type PublicKey struct {
+	rho [32]byte
+	t1  [k]poly
+	a   [k][l]poly
+
+	encoded []byte
+	tr      [64]byte
+}
+
+// GenerateKey returns a new random private key.
+func GenerateKey() (*PrivateKey, error) {
+	seed := make([]byte, SeedSize)
+
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+
+	return NewPrivateKey(seed)
+}
+
+// NewPrivateKey derives a private key from its seed (Algorithm 6).
+func NewPrivateKey(seed []byte) (sk *PrivateKey, err error) {
+	if len(seed) != SeedSize {
+		return nil, errors.New("invalid seed size")
+	}
+
+	sk = &PrivateKey{pk: &PublicKey{}}
+	copy(sk.seed[:], seed)
+
+	h := shake256(128, seed, []byte{k, l})
+	copy(sk.rho[:], h[0:32])
+	rhoPrime := h[32:96]
+	copy(sk.key[:], h[96:128])
+
+	sk.a = expandA(sk.rho[:])
+
+	for r := range sk.s1 {
+		sk.s1[r] = rejBoundedPoly(rhoPrime, uint16(r))
+		sk.s1h[r] = sk.s1[r]
+		sk.s1h[r].ntt()
+	}
+
+	for r := range sk.s2 {
+		sk.s2[r] = rejBoundedPoly(rhoPrime, uint16(r+l))
+		sk.s2h[r] = sk.s2[r]
+		sk.s2h[r].ntt()
+	}
+
+	pk := sk.pk
+	pk.rho = sk.rho
+	pk.a = sk.a
+
+	for r := 0; r < k; r++ {
+		var t poly
+
+		for s := 0; s < l; s++ {
+			mulAdd(&t, &sk.a[r][s], &sk.s1h[s])
+		}
+
+		t.invNTT()
+		t.add(&sk.s2[r])
+
+		for j, c := range t {
+			pk.t1[r][j], sk.t0[r][j] = power2Round(c)
+		}
+
+		sk.t0h[r] = sk.t0[r]
+		sk.t0h[r].ntt()
+	}
+
+	pk.encode()
+	sk.tr = pk.tr
+
+	return
+}
+
+func (pk *PublicKey) encode() {
+	pk.encoded = make([]byte, 0, PublicKeySize)
+	pk.encoded = append(pk.encoded, pk.rho[:]...)
+
+	for i := range pk.t1 {
+		pk.encoded = simpleBitPack(pk.encoded, &pk.t1[i], t1Bits)
+	}
+
+	copy(pk.tr[:], shake256(64, pk.encoded))
+}
+
+// NewPublicKey parses an encoded public key.
+func NewPublicKey(b []byte) (pk *PublicKey, err error) {
+	if len(b) != PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+
+	pk = &PublicKey{}
+	copy(pk.rho[:], b)
+
+	for i := range pk.t1 {
+		pk.t1[i] = simpleBitUnpack(b[32+i*n*t1Bits/8:], t1Bits)
+	}
+
+	pk.a = expandA(pk.rho[:])
+	pk.encode()
+
+	return
+}
+
+// Bytes returns the encoded public key.
+func (pk *PublicKey) Bytes() []byte {
+	return append([]byte{}, pk.encoded...)
+}
+
+// PublicKey returns the matching public key.
+func (sk *PrivateKey) PublicKey() *PublicKey {
+	return sk.pk
+}
+
+// Seed returns the private key seed.
+func (sk *PrivateKey) Seed() []byte {
+	return append([]byte{}, sk.seed[:]...)
+}
+
+// Bytes returns the encoded private key (Algorithm 24).
+func (sk *PrivateKey) Bytes() []byte {
+	b := make([]byte, 0, PrivateKeySize)
+
+	b = append(b, sk.rho[:]...)
+	b = append(b, sk.key[:]...)
+	b = append(b, sk.tr[:]...)
+
+	for i := range sk.s1 {
+		b = bitPack(b, &sk.s1[i], eta, sBits)
+	}
+
+	for i := range sk.s2 {
+		b = bitPack(b, &sk.s2[i], eta, sBits)
+	}
+
+	for i := range sk.t0 {
+		b = bitPack(b, &sk.t0[i], 1<<(d-1), t0Bits)
+	}
+
+	return b
+}
+
+// messageRepresentative returns mu for the pure ML-DSA message encoding
+// (Algorithms 2, 3 and 7).
+func messageRepresentative(tr []byte, msg []byte, context []byte) []byte {
+	return shake256(64, tr, []byte{0, byte(len(context))}, context, msg)
+}
+
+func w1Encode(w1 *[k]poly) (b []byte) {
+	b = make([]byte, 0, k*n*w1Bits/8)
+
+	for i := range w1 {
+		b = simpleBitPack(b, &w1[i], w1Bits)
+	}
+
+	return
+}
+
+// Sign returns a hedged signature of the message with the argument context.
+func (sk *PrivateKey) Sign(msg []byte, context []byte) ([]byte, error) {
+	rnd := make([]byte, 32)
+
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, err
+	}
+
+	return sk.sign(msg, context, rnd)
+}
+
+// SignDeterministic returns a deterministic signature of the message with
+// the argument context.
+func (sk *PrivateKey) SignDeterministic(msg []byte, context []byte) ([]byte, error) {
+	return sk.sign(msg, context, make([]byte, 32))
+}
+
+// sign implements Algorithm 7.
+func (sk *PrivateKey) sign(msg []byte, context []byte, rnd []byte) (sig []byte, err error) {
+	if len(context) > 255 {
+		return nil, errors.New("context too long")
+	}
+
+	mu := messageRepresentative(sk.tr[:], msg, context)
+	rhoPrime := shake256(64, sk.key[:], rnd, mu)
+
+	for kappa := 0; kappa < 0xffff; kappa += l {
+		var y, yh, z [l]poly
+		var w, w1, r0 [k]poly
+		var h [k][n]bool
+
+		for r := range y {
+			y[r] = expandMask(rhoPrime, uint16(kappa+r))
+			yh[r] = y[r]
+			yh[r].ntt()
+		}
+
+		for r := 0; r < k; r++ {
+			for s := 0; s < l; s++ {
+				mulAdd(&w[r], &sk.a[r][s], &yh[s])
+			}
+
+			w[r].invNTT()
+
+			for j, c := range w[r] {
+				w1[r][j] = highBits(c)
+			}
+		}
+
+		ctilde := shake256(ctildeSize, mu, w1Encode(&w1))
+		ch := sampleInBall(ctilde)
+		ch.ntt()
+
+		valid := true
+
+		for r := range z {
+			var cs1 poly
+
+			mulAdd(&cs1, &ch, &sk.s1h[r])
+			cs1.invNTT()
+
+			z[r] = y[r]
+			z[r].add(&cs1)
+
+			if z[r].infNorm() >= gamma1-beta {
+				valid = false
+			}
+		}
+
+		hints := 0
+
+		for r := 0; r < k && valid; r++ {
+			var cs2, ct0 poly
+
+			mulAdd(&cs2, &ch, &sk.s2h[r])
+			cs2.invNTT()
+
+			r0[r] = w[r]
+			r0[r].sub(&cs2)
+
+			mulAdd(&ct0, &ch, &sk.t0h[r])
+			ct0.invNTT()
+
+			if ct0.infNorm() >= gamma2 {
+				valid = false
+				break
+			}
+
+			for j, c := range r0[r] {
+				_, low := decompose(c)
+
+				if low > (q-1)/2 {
+					low = q - low
+				}
+
+				if low >= gamma2-beta {
+					valid = false
+					break
+				}
+
+				// MakeHint(-ct0, w - cs2 + ct0)
+				if highBits(add(c, ct0[j])) != highBits(c) {
+					h[r][j] = true
+					hints++
+				}
+			}
+		}
+
+		if !valid || hints > omega {
+			continue
+		}
+
+		return sigEncode(ctilde, &z, &h), nil
+	}
+
+	return nil, errors.New("signing failed")
+}
+
+// sigEncode implements Algorithms 26 and 20.
+func sigEncode(ctilde []byte, z *[l]poly, h *[k][n]bool) []byte {
+	sig := make([]byte, 0, SignatureSize)
+	sig = append(sig, ctilde...)
+
+	for i := range z {
+		sig = bitPack(sig, &z[i], gamma1, zBits)
+	}
+
+	hints := make([]byte, omega+k)
+	index := 0
+
+	for i := range h {
+		for j, set := range h[i] {
+			if set {
+				hints[index] = byte(j)
+				index++
+			}
+		}
+
+		hints[omega+i] = byte(index)
+	}
+
+	return append(sig, hints...)
+}
+
+// sigDecode implements Algorithms 27 and 21.
+func sigDecode(sig []byte) (ctilde []byte, z [l]poly, h [k][n]bool, err error) {
+	if len(sig) != SignatureSize {
+		err = errors.New("invalid signature size")
+		return
+	}
+
+	ctilde = sig[:ctildeSize]
+	sig = sig[ctildeSize:]
+
+	for i := range z {
+		z[i] = bitUnpack(sig[i*n*zBits/8:], gamma1, zBits)
+	}
+
+	y := sig[l*n*zBits/8:]
+	index := 0
+
+	for i := range h {
+		end := int(y[omega+i])
+
+		if end < index || end > omega {
+			err = errors.New("invalid hint")
+			return
+		}
+
+		for first := index; index < end; index++ {
+			if index > first && y[index-1] >= y[index] {
+				err = errors.New("invalid hint")
+				return
+			}
+
+			h[i][y[index]] = true
+		}
+	}
+
+	for ; index < omega; index++ {
+		if y[index] != 0 {
+			err = errors.New("invalid hint")
+			return
+		}
+	}
+
+	return
+}
+
+// Verify verifies the signature of the message with the argument context
+// (Algorithm 8).
+func Verify(pk *PublicKey, msg []byte, context []byte, sig []byte) error {
+	if len(context) > 255 {
+		return errors.New("context too long")
+	}
+
+	ctilde, z, h, err := sigDecode(sig)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range z {
+		if z[i].infNorm() >= gamma1-beta {
+			return errors.New("invalid signature")
+		}
+
+		z[i].ntt()
+	}
+
+	mu := messageRepresentative(pk.tr[:], msg, context)
+
+	ch := sampleInBall(ctilde)
+	ch.ntt()
+
+	var w1 [k]poly
+
+	for r := 0; r < k; r++ {
+		var w, ct1 poly
+
+		for s := 0; s < l; s++ {
+			mulAdd(&w, &pk.a[r][s], &z[s])
+		}
+
+		t1 := pk.t1[r]
+
+		for j := range t1 {
+			t1[j] <<= d
+		}
+
+		t1.ntt()
+		mulAdd(&ct1, &ch, &t1)
+		w.sub(&ct1)
+		w.invNTT()
+
+		for j, c := range w {
+			w1[r][j] = useHint(h[r][j], c)
+		}
+	}
+
+	if subtle.ConstantTimeCompare(ctilde, shake256(ctildeSize, mu, w1Encode(&w1))) != 1 {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
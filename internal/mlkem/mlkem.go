@@ -0,0 +1,546 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package mlkem implements the ML-KEM-768 key encapsulation mechanism
+// specified in FIPS 203.
+//
+// The implementation follows the specification algorithms closely, with plain
+// modular arithmetic rather than Montgomery or Barrett reductions, and is
+// meant for benchmarking rather than production use: while it has no secret
+// dependent branches, besides the final implicit rejection selection which
+// is constant time, it is not hardened against other side channels.
+package mlkem
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	n = 256
+	q = 3329
+
+	k    = 3
+	eta1 = 2
+	eta2 = 2
+	du   = 10
+	dv   = 4
+
+	// 128^-1 mod q
+	invN = 3303
+
+	encodedPolySize = n * 12 / 8
+)
+
+const (
+	// SharedKeySize is the shared secret size in bytes.
+	SharedKeySize = 32
+	// SeedSize is the decapsulation key seed (d || z) size in bytes.
+	SeedSize = 64
+	// EncapsulationKeySize is the encoded encapsulation key size in bytes.
+	EncapsulationKeySize = k*encodedPolySize + 32
+	// CiphertextSize is the ciphertext size in bytes.
+	CiphertextSize = k*n*du/8 + n*dv/8
+	// DecapsulationKeySize is the encoded decapsulation key size in bytes.
+	DecapsulationKeySize = k*encodedPolySize + EncapsulationKeySize + 32 + 32
+)
+
+type fe uint16
+
+type poly [n]fe
+
+func add(a, b fe) fe {
+	return fe((uint32(a) + uint32(b)) % q)
+}
+
+func sub(a, b fe) fe {
+	return fe((uint32(a) + q - uint32(b)) % q)
+}
+
+func mul(a, b fe) fe {
+	return fe(uint32(a) * uint32(b) % q)
+}
+
+// zetas holds 17^BitRev7(i) and gammas 17^(2*BitRev7(i)+1), mod q.
+var zetas, gammas [128]fe
+
+func init() {
+	pow := func(e int) fe {
+		r := fe(1)
+
+		for i := 0; i < e; i++ {
+			r = mul(r, 17)
+		}
+
+		return r
+	}
+
+	for i := 0; i < 128; i++ {
+		rev := 0
+
+		for b := 0; b < 7; b++ {
+			rev |= (i >> b & 1) << (6 - b)
+		}
+
+		zetas[i] = pow(rev)
+		gammas[i] = pow(2*rev + 1)
+	}
+}
+
+func (f *poly) add(g *poly) {
+	for i := range f {
+		f[i] = add(f[i], g[i])
+	}
+}
+
+func (f *poly) sub(g *poly) {
+	for i := range f {
+		f[i] = sub(f[i], g[i])
+	}
+}
+
+// ntt implements Algorithm 9.
+func (f *poly) ntt() {
+	i := 1
+
+	for l := 128; l >= 2; l /= 2 {
+		for start := 0; start < n; start += 2 * l {
+			zeta := zetas[i]
+			i++
+
+			for j := start; j < start+l; j++ {
+				t := mul(zeta, f[j+l])
+				f[j+l] = sub(f[j], t)
+				f[j] = add(f[j], t)
+			}
+		}
+	}
+}
+
+// invNTT implements Algorithm 10.
+func (f *poly) invNTT() {
+	i := 127
+
+	for l := 2; l <= 128; l *= 2 {
+		for start := 0; start < n; start += 2 * l {
+			zeta := zetas[i]
+			i--
+
+			for j := start; j < start+l; j++ {
+				t := f[j]
+				f[j] = add(t, f[j+l])
+				f[j+l] = mul(zeta, sub(f[j+l], t))
+			}
+		}
+	}
+
+	for i := range f {
+		f[i] = mul(f[i], invN)
+	}
+}
+
+// mulAdd adds the NTT domain product of f and g to h (Algorithm 11).
+func mulAdd(h *poly, f *poly, g *poly) {
+	for i := 0; i < 128; i++ {
+		a0, a1 := f[2*i], f[2*i+1]
+		b0, b1 := g[2*i], g[2*i+1]
+
+		c0 := add(mul(a0, b0), mul(mul(a1, b1), gammas[i]))
+		c1 := add(mul(a0, b1), mul(a1, b0))
+
+		h[2*i] = add(h[2*i], c0)
+		h[2*i+1] = add(h[2*i+1], c1)
+	}
+}
+
+// sampleNTT implements Algorithm 7.
+func sampleNTT(rho []byte, j byte, i byte) (f poly) {
+	var buf [168]byte
+
+	xof := sha3.NewShake128()
+	xof.Write(rho)
+	xof.Write([]byte{j, i})
+
+	for c := 0; c < n; {
+		xof.Read(buf[:])
+
+		for b := 0; b < len(buf) && c < n; b += 3 {
+			d1 := uint16(buf[b]) | uint16(buf[b+1]&0x0f)<<8
+			d2 := uint16(buf[b+1])>>4 | uint16(buf[b+2])<<4
+
+			if d1 < q {
+				f[c] = fe(d1)
+				c++
+			}
+
+			if d2 < q && c < n {
+				f[c] = fe(d2)
+				c++
+			}
+		}
+	}
+
+	return
+}
+
+// samplePolyCBD implements Algorithm 8 on PRF_eta(s, b) output.
+func samplePolyCBD(s []byte, b byte, eta int) (f poly) {
+	buf := make([]byte, 64*eta)
+
+	prf := sha3.NewShake256()
+	prf.Write(s)
+	prf.Write([]byte{b})
+	prf.Read(buf)
+
+	bit := func(i int) fe {
+		return fe(buf[i/8] >> (i % 8) & 1)
+	}
+
+	for i := range f {
+		var x, y fe
+
+		for j := 0; j < eta; j++ {
+			x += bit(2*i*eta + j)
+			y += bit(2*i*eta + eta + j)
+		}
+
+		f[i] = sub(x, y)
+	}
+
+	return
+}
+
+// byteEncode implements Algorithm 5.
+func byteEncode(b []byte, f *poly, d int) []byte {
+	var acc uint32
+	var bits int
+
+	for _, c := range f {
+		acc |= uint32(c) << bits
+		bits += d
+
+		for bits >= 8 {
+			b = append(b, byte(acc))
+			acc >>= 8
+			bits -= 8
+		}
+	}
+
+	return b
+}
+
+// byteDecode implements Algorithm 6, returning false when a 12-bit
+// coefficient is not reduced.
+func byteDecode(b []byte, d int) (f poly, ok bool) {
+	var acc uint32
+	var bits int
+
+	ok = true
+
+	for i := range f {
+		for bits < d {
+			acc |= uint32(b[0]) << bits
+			b = b[1:]
+			bits += 8
+		}
+
+		c := acc & (1<<d - 1)
+		acc >>= d
+		bits -= d
+
+		if d == 12 && c >= q {
+			ok = false
+			c %= q
+		}
+
+		f[i] = fe(c)
+	}
+
+	return
+}
+
+func compress(f *poly, d int) {
+	for i, x := range f {
+		f[i] = fe((uint32(x)<<d + q/2) / q & (1<<d - 1))
+	}
+}
+
+func decompress(f *poly, d int) {
+	for i, y := range f {
+		f[i] = fe((uint32(y)*q + 1<<(d-1)) >> d)
+	}
+}
+
+func g(inputs ...[]byte) (a []byte, b []byte) {
+	h := sha3.New512()
+
+	for _, in := range inputs {
+		h.Write(in)
+	}
+
+	sum := h.Sum(nil)
+
+	return sum[:32], sum[32:]
+}
+
+// DecapsulationKey represents an ML-KEM-768 decapsulation key.
+type DecapsulationKey struct {
+	seed [SeedSize]byte
+
+	s  [k]poly
+	ek *EncapsulationKey
+}
+
+// EncapsulationKey represents an ML-KEM-768 encapsulation key.
+type EncapsulationKey struct {
+	t   [k]poly
+	rho [32]byte
+	a   [k][k]poly
+
+	encoded []byte
+	h       [32]byte
+}
+
+// GenerateKey returns a new random decapsulation key.
+func GenerateKey() (*DecapsulationKey, error) {
+	seed := make([]byte, SeedSize)
+
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+
+	return NewDecapsulationKey(seed)
+}
+
+// NewDecapsulationKey derives a decapsulation key from its d || z seed
+// (Algorithms 16 and 13).
+func NewDecapsulationKey(seed []byte) (dk *DecapsulationKey, err error) {
+	if len(seed) != SeedSize {
+		return nil, errors.New("invalid seed size")
+	}
+
+	dk = &DecapsulationKey{ek: &EncapsulationKey{}}
+	copy(dk.seed[:], seed)
+
+	rho, sigma := g(seed[:32], []byte{k})
+	copy(dk.ek.rho[:], rho)
+	dk.ek.expandA()
+
+	var e [k]poly
+	var nonce byte
+
+	for i := range dk.s {
+		dk.s[i] = samplePolyCBD(sigma, nonce, eta1)
+		dk.s[i].ntt()
+		nonce++
+	}
+
+	for i := range e {
+		e[i] = samplePolyCBD(sigma, nonce, eta1)
+		e[i].ntt()
+		nonce++
+	}
+
+	for i := range dk.ek.t {
+		dk.ek.t[i] = e[i]
+
+		for j := range dk.s {
+			mulAdd(&dk.ek.t[i], &dk.ek.a[i][j], &dk.s[j])
+		}
+	}
+
+	dk.ek.encode()
+
+	return
+}
+
+func (ek *EncapsulationKey) expandA() {
+	for i := 0; i < k; i++ {
+		for j := 0; j < k; j++ {
+			ek.a[i][j] = sampleNTT(ek.rho[:], byte(j), byte(i))
+		}
+	}
+}
+
+func (ek *EncapsulationKey) encode() {
+	ek.encoded = make([]byte, 0, EncapsulationKeySize)
+
+	for i := range ek.t {
+		ek.encoded = byteEncode(ek.encoded, &ek.t[i], 12)
+	}
+
+	ek.encoded = append(ek.encoded, ek.rho[:]...)
+	ek.h = sha3.Sum256(ek.encoded)
+}
+
+// Bytes returns the encoded decapsulation key.
+func (dk *DecapsulationKey) Bytes() []byte {
+	b := make([]byte, 0, DecapsulationKeySize)
+
+	for i := range dk.s {
+		b = byteEncode(b, &dk.s[i], 12)
+	}
+
+	b = append(b, dk.ek.encoded...)
+	b = append(b, dk.ek.h[:]...)
+
+	return append(b, dk.seed[32:]...)
+}
+
+// Seed returns the d || z seed.
+func (dk *DecapsulationKey) Seed() []byte {
+	return append([]byte{}, dk.seed[:]...)
+}
+
+// EncapsulationKey returns the matching encapsulation key.
+func (dk *DecapsulationKey) EncapsulationKey() *EncapsulationKey {
+	return dk.ek
+}
+
+// NewEncapsulationKey parses an encoded encapsulation key, performing the
+// modulus check.
+func NewEncapsulationKey(b []byte) (ek *EncapsulationKey, err error) {
+	if len(b) != EncapsulationKeySize {
+		return nil, errors.New("invalid encapsulation key size")
+	}
+
+	ek = &EncapsulationKey{}
+
+	for i := range ek.t {
+		var ok bool
+
+		if ek.t[i], ok = byteDecode(b[i*encodedPolySize:], 12); !ok {
+			return nil, errors.New("invalid encapsulation key")
+		}
+	}
+
+	copy(ek.rho[:], b[k*encodedPolySize:])
+	ek.expandA()
+	ek.encode()
+
+	return
+}
+
+// Bytes returns the encoded encapsulation key.
+func (ek *EncapsulationKey) Bytes() []byte {
+	return append([]byte{}, ek.encoded...)
+}
+
+// encrypt implements Algorithm 14.
+func (ek *EncapsulationKey) encrypt(m []byte, r []byte) []byte {
+	var y, u [k]poly
+	var mu, v poly
+	var nonce byte
+
+	for i := range y {
+		y[i] = samplePolyCBD(r, nonce, eta1)
+		y[i].ntt()
+		nonce++
+	}
+
+	for i := range u {
+		e1 := samplePolyCBD(r, nonce, eta2)
+		nonce++
+
+		for j := range y {
+			mulAdd(&u[i], &ek.a[j][i], &y[j])
+		}
+
+		u[i].invNTT()
+		u[i].add(&e1)
+	}
+
+	e2 := samplePolyCBD(r, nonce, eta2)
+
+	for i := range y {
+		mulAdd(&v, &ek.t[i], &y[i])
+	}
+
+	v.invNTT()
+	v.add(&e2)
+
+	mu, _ = byteDecode(m, 1)
+	decompress(&mu, 1)
+	v.add(&mu)
+
+	c := make([]byte, 0, CiphertextSize)
+
+	for i := range u {
+		compress(&u[i], du)
+		c = byteEncode(c, &u[i], du)
+	}
+
+	compress(&v, dv)
+
+	return byteEncode(c, &v, dv)
+}
+
+// decrypt implements Algorithm 15.
+func (dk *DecapsulationKey) decrypt(c []byte) []byte {
+	var w poly
+
+	for i := range dk.s {
+		u, _ := byteDecode(c[i*n*du/8:], du)
+		decompress(&u, du)
+		u.ntt()
+		mulAdd(&w, &dk.s[i], &u)
+	}
+
+	w.invNTT()
+
+	v, _ := byteDecode(c[k*n*du/8:], dv)
+	decompress(&v, dv)
+	v.sub(&w)
+	compress(&v, 1)
+
+	return byteEncode(make([]byte, 0, 32), &v, 1)
+}
+
+// Encapsulate returns a shared key and the ciphertext encapsulating it.
+func (ek *EncapsulationKey) Encapsulate() (sharedKey []byte, ciphertext []byte, err error) {
+	m := make([]byte, 32)
+
+	if _, err = rand.Read(m); err != nil {
+		return
+	}
+
+	sharedKey, ciphertext = ek.encapsulate(m)
+
+	return
+}
+
+// encapsulate implements Algorithm 17.
+func (ek *EncapsulationKey) encapsulate(m []byte) (sharedKey []byte, ciphertext []byte) {
+	sharedKey, r := g(m, ek.h[:])
+	return sharedKey, ek.encrypt(m, r)
+}
+
+// Decapsulate returns the shared key encapsulated in the ciphertext, a
+// pseudorandom key is returned on invalid ciphertexts (Algorithm 18).
+func (dk *DecapsulationKey) Decapsulate(ciphertext []byte) (sharedKey []byte, err error) {
+	if len(ciphertext) != CiphertextSize {
+		return nil, errors.New("invalid ciphertext size")
+	}
+
+	m := dk.decrypt(ciphertext)
+	sharedKey, r := g(m, dk.ek.h[:])
+
+	rejected := make([]byte, SharedKeySize)
+	j := sha3.NewShake256()
+	j.Write(dk.seed[32:])
+	j.Write(ciphertext)
+	j.Read(rejected)
+
+	valid := subtle.ConstantTimeCompare(ciphertext, dk.ek.encrypt(m, r))
+	subtle.ConstantTimeCopy(1-valid, sharedKey, rejected)
+
+	return
+}
@@ -0,0 +1,360 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package mqtt implements a minimal MQTT 3.1.1 client, supporting QoS 0
+// publishing, subscriptions, keep alive and last will messages, over a stream
+// connection.
+//
+// Incoming QoS 1 messages are acknowledged on receipt, QoS 2 is not
+// supported.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MQTT control packet types.
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// MQTT 3.1.1 protocol level.
+const protocolLevel = 4
+
+// MaxPacketSize is the largest accepted incoming packet.
+const MaxPacketSize = 64 * 1024
+
+// CONNECT flags.
+const (
+	flagCleanSession = 1 << 1
+	flagWill         = 1 << 2
+	flagWillRetain   = 1 << 5
+	flagPassword     = 1 << 6
+	flagUsername     = 1 << 7
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Options represents the connection options.
+type Options struct {
+	ClientID string
+	Username string
+	Password string
+
+	// KeepAlive is the maximum interval between client packets, it is
+	// the caller responsibility to Ping when no other packet is sent.
+	KeepAlive time.Duration
+
+	CleanSession bool
+
+	// WillTopic, when not empty, is published by the broker with
+	// WillMessage if the connection is lost without disconnecting.
+	WillTopic   string
+	WillMessage []byte
+	WillRetain  bool
+}
+
+// Message represents a received application message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Client represents an MQTT client connection.
+type Client struct {
+	conn io.ReadWriter
+	r    *bufio.Reader
+
+	mu     sync.Mutex
+	nextID uint16
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+func appendBytes(b []byte, s []byte) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func appendLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+
+		if n /= 128; n > 0 {
+			d |= 0x80
+		}
+
+		b = append(b, d)
+
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func (c *Client) write(header byte, body []byte) (err error) {
+	pkt := appendLength([]byte{header}, len(body))
+	pkt = append(pkt, body...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err = c.conn.Write(pkt)
+
+	return
+}
+
+func (c *Client) read() (header byte, body []byte, err error) {
+	if header, err = c.r.ReadByte(); err != nil {
+		return
+	}
+
+	var n, shift int
+
+	for i := 0; ; i++ {
+		d, err := c.r.ReadByte()
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if i == 4 {
+			return 0, nil, errors.New("invalid remaining length")
+		}
+
+		n |= int(d&0x7f) << shift
+		shift += 7
+
+		if d&0x80 == 0 {
+			break
+		}
+	}
+
+	if n > MaxPacketSize {
+		return 0, nil, fmt.Errorf("packet too large (%d bytes)", n)
+	}
+
+	body = make([]byte, n)
+	_, err = io.ReadFull(c.r, body)
+
+	return
+}
+
+func (c *Client) packetID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.nextID++; c.nextID == 0 {
+		c.nextID = 1
+	}
+
+	return c.nextID
+}
+
+// Connect sends the CONNECT packet and waits for the broker acknowledgment.
+func Connect(conn io.ReadWriter, opts *Options) (c *Client, err error) {
+	c = &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	var flags byte
+
+	keepAlive := uint16(opts.KeepAlive / time.Second)
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, 0)
+	body = append(body, byte(keepAlive>>8), byte(keepAlive))
+	body = appendString(body, opts.ClientID)
+
+	if opts.CleanSession {
+		flags |= flagCleanSession
+	}
+
+	if opts.WillTopic != "" {
+		flags |= flagWill
+		body = appendString(body, opts.WillTopic)
+		body = appendBytes(body, opts.WillMessage)
+
+		if opts.WillRetain {
+			flags |= flagWillRetain
+		}
+	}
+
+	if opts.Username != "" {
+		flags |= flagUsername
+		body = appendString(body, opts.Username)
+	}
+
+	if opts.Password != "" {
+		flags |= flagPassword
+		body = appendString(body, opts.Password)
+	}
+
+	// connect flags follow the protocol name and level
+	body[7] = flags
+
+	if err = c.write(CONNECT<<4, body); err != nil {
+		return nil, err
+	}
+
+	header, body, err := c.read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header>>4 != CONNACK || len(body) != 2 {
+		return nil, errors.New("invalid CONNACK")
+	}
+
+	if rc := body[1]; rc != 0 {
+		if msg, ok := connackErrors[rc]; ok {
+			return nil, fmt.Errorf("connection refused, %s", msg)
+		}
+
+		return nil, fmt.Errorf("connection refused (%d)", rc)
+	}
+
+	return
+}
+
+// Publish sends an application message with QoS 0.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(PUBLISH << 4)
+
+	if retain {
+		header |= 1
+	}
+
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+
+	return c.write(header, body)
+}
+
+// Subscribe requests a subscription, with maximum QoS 1, to the argument
+// topic filters. The acknowledgment is processed by Receive.
+func (c *Client) Subscribe(filters ...string) error {
+	id := c.packetID()
+	body := []byte{byte(id >> 8), byte(id)}
+
+	for _, f := range filters {
+		body = appendString(body, f)
+		body = append(body, 1)
+	}
+
+	return c.write(SUBSCRIBE<<4|0b0010, body)
+}
+
+// Ping sends a keep alive request.
+func (c *Client) Ping() error {
+	return c.write(PINGREQ<<4, nil)
+}
+
+// Disconnect notifies the broker of a clean disconnection, the last will
+// message is discarded.
+func (c *Client) Disconnect() error {
+	return c.write(DISCONNECT<<4, nil)
+}
+
+// Receive waits for the next application message, control packets received
+// meanwhile are processed.
+func (c *Client) Receive() (m *Message, err error) {
+	for {
+		header, body, err := c.read()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch header >> 4 {
+		case PUBLISH:
+			return c.handlePublish(header, body)
+		case SUBACK:
+			if len(body) < 3 {
+				return nil, errors.New("invalid SUBACK")
+			}
+
+			for _, rc := range body[2:] {
+				if rc == 0x80 {
+					return nil, errors.New("subscription refused")
+				}
+			}
+		case PUBACK, UNSUBACK, PINGRESP:
+		default:
+			return nil, fmt.Errorf("unexpected packet type %d", header>>4)
+		}
+	}
+}
+
+func (c *Client) handlePublish(header byte, body []byte) (m *Message, err error) {
+	qos := (header >> 1) & 0b11
+
+	if len(body) < 2 {
+		return nil, errors.New("invalid PUBLISH")
+	}
+
+	n := int(binary.BigEndian.Uint16(body))
+
+	if len(body) < 2+n {
+		return nil, errors.New("invalid PUBLISH")
+	}
+
+	m = &Message{
+		Topic:  string(body[2 : 2+n]),
+		Retain: header&1 != 0,
+	}
+
+	body = body[2+n:]
+
+	switch qos {
+	case 0:
+	case 1:
+		if len(body) < 2 {
+			return nil, errors.New("invalid PUBLISH")
+		}
+
+		if err = c.write(PUBACK<<4, body[:2]); err != nil {
+			return
+		}
+
+		body = body[2:]
+	default:
+		return nil, fmt.Errorf("unsupported QoS %d", qos)
+	}
+
+	m.Payload = body
+
+	return
+}
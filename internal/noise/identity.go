@@ -0,0 +1,89 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package noise
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+)
+
+// IdentityContext is the domain separation prefix of static key bindings.
+const IdentityContext = "noise-static\x00"
+
+func bindingDigest(static []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(IdentityContext))
+	h.Write(static)
+
+	return h.Sum(nil)
+}
+
+// BindIdentity returns a handshake payload binding the static public key to
+// an X.509 identity, the payload is the certificate length (2 bytes,
+// big-endian), the DER certificate and an ECDSA signature, by the certificate
+// key, of SHA-256(IdentityContext || static).
+func BindIdentity(key *ecdsa.PrivateKey, cert []byte, static []byte) (payload []byte, err error) {
+	if len(cert) > 0xffff {
+		return nil, errors.New("certificate too large")
+	}
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, bindingDigest(static))
+
+	if err != nil {
+		return
+	}
+
+	payload = make([]byte, 2, 2+len(cert)+len(sig))
+	binary.BigEndian.PutUint16(payload, uint16(len(cert)))
+	payload = append(payload, cert...)
+	payload = append(payload, sig...)
+
+	return
+}
+
+// VerifyIdentity verifies a handshake payload created with BindIdentity,
+// returning the certificate the static key is bound to. The certificate
+// chain is verified against the argument roots when not nil.
+func VerifyIdentity(payload []byte, static []byte, roots *x509.CertPool) (cert *x509.Certificate, err error) {
+	if len(payload) < 2 {
+		return nil, errors.New("missing identity")
+	}
+
+	n := int(binary.BigEndian.Uint16(payload))
+
+	if len(payload) < 2+n {
+		return nil, errors.New("invalid identity")
+	}
+
+	if cert, err = x509.ParseCertificate(payload[2 : 2+n]); err != nil {
+		return
+	}
+
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+
+	if !ok {
+		return nil, errors.New("unsupported identity key")
+	}
+
+	if !ecdsa.VerifyASN1(pub, bindingDigest(static), payload[2+n:]) {
+		return nil, errors.New("invalid static key binding")
+	}
+
+	if roots != nil {
+		if _, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			return
+		}
+	}
+
+	return
+}
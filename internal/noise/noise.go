@@ -0,0 +1,532 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package noise implements the Noise_XX_25519_ChaChaPoly_SHA256 handshake
+// (Noise Protocol Framework, revision 34) and the resulting transport
+// channel, over a stream connection.
+//
+// The XX pattern mutually authenticates both parties static keys, which are
+// transmitted encrypted during the handshake:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Each handshake and transport message is framed with a 2 byte big-endian
+// length, as customary for Noise over TCP. Handshake payloads can carry
+// application data, such as a certificate binding the static key to an
+// identity, the responder payload being encrypted to an anonymous initiator
+// while the initiator one is encrypted and authenticated to the responder.
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Protocol is the Noise protocol name.
+const Protocol = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+const (
+	// KeySize is the Curve25519 key size in bytes.
+	KeySize = curve25519.ScalarSize
+	// TagSize is the ChaChaPoly authentication tag size in bytes.
+	TagSize = 16
+	// MaxMessageSize is the maximum Noise message size.
+	MaxMessageSize = 65535
+	// MaxPayloadSize is the maximum transport message plaintext size.
+	MaxPayloadSize = MaxMessageSize - TagSize
+)
+
+// KeyPair represents a Curve25519 key pair.
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+// NewKeyPair returns the key pair for the argument private key.
+func NewKeyPair(private []byte) (k *KeyPair, err error) {
+	if len(private) != KeySize {
+		return nil, errors.New("invalid private key size")
+	}
+
+	k = &KeyPair{Private: append([]byte{}, private...)}
+	k.Public, err = curve25519.X25519(k.Private, curve25519.Basepoint)
+
+	return
+}
+
+// GenerateKeyPair returns a new random key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	private := make([]byte, KeySize)
+
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+
+	return NewKeyPair(private)
+}
+
+// cipherState implements the Noise CipherState object.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func (c *cipherState) init(key []byte) {
+	c.aead, _ = chacha20poly1305.New(key)
+	c.nonce = 0
+}
+
+func (c *cipherState) nonceBytes() []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(n[4:], c.nonce)
+	return n
+}
+
+func (c *cipherState) encrypt(ad []byte, plaintext []byte) []byte {
+	if c.aead == nil {
+		return append([]byte{}, plaintext...)
+	}
+
+	out := c.aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+
+	return out
+}
+
+func (c *cipherState) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	if c.aead == nil {
+		return append([]byte{}, ciphertext...), nil
+	}
+
+	out, err := c.aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+
+	if err != nil {
+		return nil, errors.New("decryption failure")
+	}
+
+	c.nonce++
+
+	return out, nil
+}
+
+// symmetricState implements the Noise SymmetricState object.
+type symmetricState struct {
+	cipherState
+
+	ck []byte
+	h  []byte
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	for _, d := range data {
+		mac.Write(d)
+	}
+
+	return mac.Sum(nil)
+}
+
+// hkdf implements the Noise HKDF function with two outputs.
+func hkdf(ck []byte, ikm []byte) ([]byte, []byte) {
+	temp := hmacSHA256(ck, ikm)
+	out1 := hmacSHA256(temp, []byte{1})
+	out2 := hmacSHA256(temp, out1, []byte{2})
+
+	return out1, out2
+}
+
+func (s *symmetricState) init(prologue []byte) {
+	// the protocol name is exactly HASHLEN bytes long
+	s.h = []byte(Protocol)
+	s.ck = append([]byte{}, s.h...)
+	s.mixHash(prologue)
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var key []byte
+
+	s.ck, key = hkdf(s.ck, ikm)
+	s.cipherState.init(key)
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	c := s.encrypt(s.h, plaintext)
+	s.mixHash(c)
+
+	return c
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	p, err := s.decrypt(s.h, ciphertext)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mixHash(ciphertext)
+
+	return p, nil
+}
+
+func (s *symmetricState) split() (c1 *cipherState, c2 *cipherState) {
+	k1, k2 := hkdf(s.ck, nil)
+
+	c1 = &cipherState{}
+	c1.init(k1)
+
+	c2 = &cipherState{}
+	c2.init(k2)
+
+	return
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	// X25519 rejects low order points
+	return curve25519.X25519(private, public)
+}
+
+// Config represents a handshake configuration.
+type Config struct {
+	// Static is the local static key pair.
+	Static *KeyPair
+	// Prologue is data which both parties must agree on.
+	Prologue []byte
+	// Payload is sent with the local static key.
+	Payload []byte
+	// VerifyPeer, when set, is invoked with the remote static key and
+	// payload, the handshake fails if it returns an error.
+	VerifyPeer func(static []byte, payload []byte) error
+}
+
+// Conn represents a Noise transport channel.
+type Conn struct {
+	rw io.ReadWriter
+
+	rmu  sync.Mutex
+	recv *cipherState
+	buf  []byte
+
+	wmu  sync.Mutex
+	send *cipherState
+
+	remoteStatic  []byte
+	remotePayload []byte
+	hash          []byte
+}
+
+func writeMessage(w io.Writer, msg []byte) (err error) {
+	if len(msg) > MaxMessageSize {
+		return errors.New("message too large")
+	}
+
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	_, err = w.Write(frame)
+
+	return
+}
+
+func readMessage(r io.Reader) (msg []byte, err error) {
+	var hdr [2]byte
+
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+
+	msg = make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	_, err = io.ReadFull(r, msg)
+
+	return
+}
+
+// handshake holds the HandshakeState variables.
+type handshake struct {
+	symmetricState
+
+	s  *KeyPair
+	e  *KeyPair
+	rs []byte
+	re []byte
+}
+
+func (hs *handshake) readKey(msg []byte, encrypted bool) (key []byte, rest []byte, err error) {
+	size := KeySize
+
+	if encrypted {
+		size += TagSize
+	}
+
+	if len(msg) < size {
+		return nil, nil, errors.New("short handshake message")
+	}
+
+	if encrypted {
+		key, err = hs.decryptAndHash(msg[:size])
+	} else {
+		key = append([]byte{}, msg[:size]...)
+		hs.mixHash(key)
+	}
+
+	return key, msg[size:], err
+}
+
+func (hs *handshake) mixDH(private []byte, public []byte) error {
+	shared, err := dh(private, public)
+
+	if err != nil {
+		return err
+	}
+
+	hs.mixKey(shared)
+
+	return nil
+}
+
+// Client performs the handshake as initiator.
+func Client(rw io.ReadWriter, config *Config) (c *Conn, err error) {
+	hs := &handshake{s: config.Static}
+	hs.init(config.Prologue)
+
+	if hs.e, err = GenerateKeyPair(); err != nil {
+		return
+	}
+
+	// -> e
+	hs.mixHash(hs.e.Public)
+	msg := append(append([]byte{}, hs.e.Public...), hs.encryptAndHash(nil)...)
+
+	if err = writeMessage(rw, msg); err != nil {
+		return
+	}
+
+	// <- e, ee, s, es
+	if msg, err = readMessage(rw); err != nil {
+		return
+	}
+
+	if hs.re, msg, err = hs.readKey(msg, false); err != nil {
+		return
+	}
+
+	if err = hs.mixDH(hs.e.Private, hs.re); err != nil {
+		return
+	}
+
+	if hs.rs, msg, err = hs.readKey(msg, true); err != nil {
+		return
+	}
+
+	if err = hs.mixDH(hs.e.Private, hs.rs); err != nil {
+		return
+	}
+
+	payload, err := hs.decryptAndHash(msg)
+
+	if err != nil {
+		return
+	}
+
+	if config.VerifyPeer != nil {
+		if err = config.VerifyPeer(hs.rs, payload); err != nil {
+			return
+		}
+	}
+
+	// -> s, se
+	msg = hs.encryptAndHash(hs.s.Public)
+
+	if err = hs.mixDH(hs.s.Private, hs.re); err != nil {
+		return
+	}
+
+	msg = append(msg, hs.encryptAndHash(config.Payload)...)
+
+	if err = writeMessage(rw, msg); err != nil {
+		return
+	}
+
+	send, recv := hs.split()
+
+	return hs.conn(rw, send, recv, payload), nil
+}
+
+// Server performs the handshake as responder.
+func Server(rw io.ReadWriter, config *Config) (c *Conn, err error) {
+	hs := &handshake{s: config.Static}
+	hs.init(config.Prologue)
+
+	// -> e
+	msg, err := readMessage(rw)
+
+	if err != nil {
+		return
+	}
+
+	if hs.re, msg, err = hs.readKey(msg, false); err != nil {
+		return
+	}
+
+	if _, err = hs.decryptAndHash(msg); err != nil {
+		return
+	}
+
+	// <- e, ee, s, es
+	if hs.e, err = GenerateKeyPair(); err != nil {
+		return
+	}
+
+	hs.mixHash(hs.e.Public)
+	msg = append([]byte{}, hs.e.Public...)
+
+	if err = hs.mixDH(hs.e.Private, hs.re); err != nil {
+		return
+	}
+
+	msg = append(msg, hs.encryptAndHash(hs.s.Public)...)
+
+	if err = hs.mixDH(hs.s.Private, hs.re); err != nil {
+		return
+	}
+
+	msg = append(msg, hs.encryptAndHash(config.Payload)...)
+
+	if err = writeMessage(rw, msg); err != nil {
+		return
+	}
+
+	// -> s, se
+	if msg, err = readMessage(rw); err != nil {
+		return
+	}
+
+	if hs.rs, msg, err = hs.readKey(msg, true); err != nil {
+		return
+	}
+
+	if err = hs.mixDH(hs.e.Private, hs.rs); err != nil {
+		return
+	}
+
+	payload, err := hs.decryptAndHash(msg)
+
+	if err != nil {
+		return
+	}
+
+	if config.VerifyPeer != nil {
+		if err = config.VerifyPeer(hs.rs, payload); err != nil {
+			return
+		}
+	}
+
+	recv, send := hs.split()
+
+	return hs.conn(rw, send, recv, payload), nil
+}
+
+func (hs *handshake) conn(rw io.ReadWriter, send *cipherState, recv *cipherState, payload []byte) *Conn {
+	return &Conn{
+		rw:            rw,
+		send:          send,
+		recv:          recv,
+		remoteStatic:  hs.rs,
+		remotePayload: payload,
+		hash:          hs.h,
+	}
+}
+
+// RemoteStatic returns the authenticated remote static public key.
+func (c *Conn) RemoteStatic() []byte {
+	return c.remoteStatic
+}
+
+// RemotePayload returns the remote static key handshake payload.
+func (c *Conn) RemotePayload() []byte {
+	return c.remotePayload
+}
+
+// HandshakeHash returns the handshake hash, which uniquely identifies the
+// session and can be used for channel binding.
+func (c *Conn) HandshakeHash() []byte {
+	return c.hash
+}
+
+// Read reads decrypted transport data.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		msg, err := readMessage(c.rw)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if c.buf, err = c.recv.decrypt(nil, msg); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return
+}
+
+// Write encrypts and writes transport data, split in as many messages as
+// required.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for len(p) > 0 {
+		size := len(p)
+
+		if size > MaxPayloadSize {
+			size = MaxPayloadSize
+		}
+
+		if err = writeMessage(c.rw, c.send.encrypt(nil, p[:size])); err != nil {
+			return
+		}
+
+		n += size
+		p = p[size:]
+	}
+
+	return
+}
+
+// Fingerprint returns a printable representation of a static public key.
+func Fingerprint(static []byte) string {
+	sum := sha256.Sum256(static)
+	return fmt.Sprintf("%x", sum[:16])
+}
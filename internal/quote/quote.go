@@ -0,0 +1,187 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package quote implements the host side retrieval and verification of
+// platform quotes issued by the example firmware (see attest.go), it is
+// shared by the host tools under cmd.
+package quote
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// must match attest.go
+const Magic = "tamago-quote-v1"
+
+// Measurement represents a measurement log entry.
+type Measurement struct {
+	Component string `json:"component"`
+	Digest    string `json:"sha256"`
+}
+
+// Quote represents a platform quote.
+type Quote struct {
+	Device    string        `json:"device"`
+	Nonce     string        `json:"nonce"`
+	PCR       string        `json:"pcr"`
+	Events    []Measurement `json:"events"`
+	PublicKey string        `json:"public_key"`
+	Signature string        `json:"signature"`
+}
+
+// ParsePublicKey parses a PEM encoded ECDSA public key.
+func ParsePublicKey(buf []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(buf)
+
+	if block == nil {
+		return nil, errors.New("invalid PEM public key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*ecdsa.PublicKey)
+
+	if !ok {
+		return nil, errors.New("invalid public key type")
+	}
+
+	return key, nil
+}
+
+// Fetch requests a quote, over the given nonce, from the attestation
+// endpoint.
+func Fetch(endpoint string, nonce []byte) (q *Quote, err error) {
+	u, err := url.Parse(endpoint)
+
+	if err != nil {
+		return
+	}
+
+	v := u.Query()
+	v.Set("nonce", hex.EncodeToString(nonce))
+	u.RawQuery = v.Encode()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(u.String())
+
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(body))
+	}
+
+	q = &Quote{}
+	err = json.NewDecoder(res.Body).Decode(q)
+
+	return
+}
+
+// Verify checks the quote signature and nonce and replays the measurement
+// log against the quoted PCR.
+func Verify(q *Quote, key *ecdsa.PublicKey, nonce []byte) (err error) {
+	if q.Nonce != hex.EncodeToString(nonce) {
+		return errors.New("nonce mismatch")
+	}
+
+	id, err := hex.DecodeString(q.Device)
+
+	if err != nil || len(id) != 8 {
+		return errors.New("invalid device ID")
+	}
+
+	value, err := hex.DecodeString(q.PCR)
+
+	if err != nil || len(value) != sha256.Size {
+		return errors.New("invalid PCR")
+	}
+
+	sig, err := hex.DecodeString(q.Signature)
+
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+
+	msg := []byte(Magic)
+	msg = append(msg, id...)
+	msg = append(msg, value...)
+	msg = append(msg, nonce...)
+
+	digest := sha256.Sum256(msg)
+
+	if !ecdsa.VerifyASN1(key, digest[:], sig) {
+		return errors.New("invalid signature")
+	}
+
+	pcr := make([]byte, sha256.Size)
+
+	for _, e := range q.Events {
+		d, err := hex.DecodeString(e.Digest)
+
+		if err != nil || len(d) != sha256.Size {
+			return fmt.Errorf("invalid digest for %s", e.Component)
+		}
+
+		sum := sha256.Sum256(append(pcr, d...))
+		pcr = sum[:]
+	}
+
+	if !bytes.Equal(pcr, value) {
+		return errors.New("measurement log does not match PCR")
+	}
+
+	return
+}
+
+// CheckReference compares measurements with known good digests, components
+// missing from the reference are returned but not considered a failure.
+func CheckReference(q *Quote, path string) (unknown []string, err error) {
+	buf, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return
+	}
+
+	reference := make(map[string]string)
+
+	if err = json.Unmarshal(buf, &reference); err != nil {
+		return
+	}
+
+	for _, e := range q.Events {
+		digest, ok := reference[e.Component]
+
+		switch {
+		case !ok:
+			unknown = append(unknown, e.Component)
+		case digest != e.Digest:
+			return nil, fmt.Errorf("%s digest mismatch (%s != %s)", e.Component, e.Digest, digest)
+		}
+	}
+
+	return
+}
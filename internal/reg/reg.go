@@ -0,0 +1,105 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package reg provides primitives for retrieving and modifying hardware
+// registers of peripherals not covered by the tamago drivers, it mirrors the
+// tamago internal/reg package which cannot be imported by applications.
+package reg
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Get returns the register bits at the given position and mask.
+func Get(addr uint32, pos int, mask int) uint32 {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+	r := atomic.LoadUint32(reg)
+
+	return uint32((int(r) >> pos) & mask)
+}
+
+// Set sets the register bit at the given position.
+func Set(addr uint32, pos int) {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+
+	r := atomic.LoadUint32(reg)
+	r |= (1 << pos)
+
+	atomic.StoreUint32(reg, r)
+}
+
+// Clear clears the register bit at the given position.
+func Clear(addr uint32, pos int) {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+
+	r := atomic.LoadUint32(reg)
+	r &= ^(1 << pos)
+
+	atomic.StoreUint32(reg, r)
+}
+
+// SetN sets the register bits at the given position and mask to a value.
+func SetN(addr uint32, pos int, mask int, val uint32) {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+
+	r := atomic.LoadUint32(reg)
+	r = (r & (^(uint32(mask) << pos))) | (val << pos)
+
+	atomic.StoreUint32(reg, r)
+}
+
+// Read returns the register value.
+func Read(addr uint32) uint32 {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+	return atomic.LoadUint32(reg)
+}
+
+// Write sets the register value.
+func Write(addr uint32, val uint32) {
+	reg := (*uint32)(unsafe.Pointer(uintptr(addr)))
+	atomic.StoreUint32(reg, val)
+}
+
+// Read16 returns the value of a 16-bit register.
+func Read16(addr uint32) uint16 {
+	return *(*uint16)(unsafe.Pointer(uintptr(addr)))
+}
+
+// Write16 sets the value of a 16-bit register.
+func Write16(addr uint32, val uint16) {
+	*(*uint16)(unsafe.Pointer(uintptr(addr))) = val
+}
+
+// Wait waits for a specific register bit to match a value.
+func Wait(addr uint32, pos int, mask int, val uint32) {
+	for Get(addr, pos, mask) != val {
+		// tamago is single-threaded, give other goroutines a chance
+		runtime.Gosched()
+	}
+}
+
+// WaitFor waits, until a timeout expires, for a specific register bit to match
+// a value. The return boolean indicates whether the wait condition was checked
+// (true) or if it timed out (false).
+func WaitFor(timeout time.Duration, addr uint32, pos int, mask int, val uint32) bool {
+	start := time.Now()
+
+	for Get(addr, pos, mask) != val {
+		// tamago is single-threaded, give other goroutines a chance
+		runtime.Gosched()
+
+		if time.Since(start) >= timeout {
+			return false
+		}
+	}
+
+	return true
+}
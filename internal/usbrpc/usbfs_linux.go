@@ -0,0 +1,176 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package usbrpc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Linux usbfs bulk transfers (see linux/usbdevice_fs.h), the RPC interface
+// has no kernel driver and therefore only requires to be claimed.
+const (
+	// must match usb.go
+	vendorID  = "1209"
+	productID = "2702"
+
+	usbfsClaimInterface = 0x8004550f
+	usbfsTimeout        = 10000
+	usbfsChunk          = 16384
+	usbfsPacketSize     = 512
+)
+
+// struct usbdevfs_bulktransfer
+type usbfsBulk struct {
+	ep      uint32
+	len     uint32
+	timeout uint32
+	data    unsafe.Pointer
+}
+
+// _IOWR('U', 2, struct usbdevfs_bulktransfer)
+var usbfsBulkRequest = 3<<30 | unsafe.Sizeof(usbfsBulk{})<<16 | 'U'<<8 | 2
+
+// Device represents the RPC interface of a device opened through usbfs.
+type Device struct {
+	f *os.File
+	// pending IN data
+	buf []byte
+}
+
+func sysfsAttr(dir string, name string) string {
+	buf, _ := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(buf))
+}
+
+// Open finds the first device exposing the RPC interface and claims it.
+func Open() (d *Device, err error) {
+	ifaces, _ := filepath.Glob("/sys/bus/usb/devices/*:*")
+
+	for _, iface := range ifaces {
+		if sysfsAttr(iface, "bInterfaceClass") != "ff" {
+			continue
+		}
+
+		// interfaces are named <device>:<configuration>.<interface>
+		dev := iface[:strings.LastIndex(iface, ":")]
+
+		if sysfsAttr(dev, "idVendor") != vendorID || sysfsAttr(dev, "idProduct") != productID {
+			continue
+		}
+
+		bus, _ := strconv.Atoi(sysfsAttr(dev, "busnum"))
+		num, _ := strconv.Atoi(sysfsAttr(dev, "devnum"))
+		n, _ := strconv.ParseUint(sysfsAttr(iface, "bInterfaceNumber"), 16, 32)
+
+		return open(fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, num), uint32(n))
+	}
+
+	return nil, errors.New("RPC interface not found")
+}
+
+func open(path string, iface uint32) (d *Device, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	if err = ioctl(f, usbfsClaimInterface, unsafe.Pointer(&iface)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not claim interface, %v", err)
+	}
+
+	return &Device{f: f}, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (d *Device) bulk(ep uint32, buf []byte) (n int, err error) {
+	t := usbfsBulk{
+		ep:      ep,
+		len:     uint32(len(buf)),
+		timeout: usbfsTimeout,
+	}
+
+	if len(buf) > 0 {
+		t.data = unsafe.Pointer(&buf[0])
+	}
+
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.f.Fd(), usbfsBulkRequest, uintptr(unsafe.Pointer(&t)))
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(r), nil
+}
+
+// Read implements io.Reader, IN transfers are buffered as they might exceed
+// the requested size.
+func (d *Device) Read(p []byte) (n int, err error) {
+	if len(d.buf) == 0 {
+		buf := make([]byte, usbfsChunk)
+
+		if n, err = d.bulk(EndpointIN, buf); err != nil {
+			return
+		}
+
+		d.buf = buf[:n]
+	}
+
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return
+}
+
+// Write implements io.Writer, each write is a single transfer terminated by
+// a short or zero length packet.
+func (d *Device) Write(p []byte) (n int, err error) {
+	for off := 0; off < len(p); off += usbfsChunk {
+		end := off + usbfsChunk
+
+		if end > len(p) {
+			end = len(p)
+		}
+
+		if _, err = d.bulk(EndpointOUT, p[off:end]); err != nil {
+			return
+		}
+
+		n = end
+	}
+
+	if len(p)%usbfsPacketSize == 0 {
+		_, err = d.bulk(EndpointOUT, nil)
+	}
+
+	return
+}
+
+// Close releases the device.
+func (d *Device) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,36 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build !linux
+
+package usbrpc
+
+import (
+	"errors"
+)
+
+// Device represents the RPC interface of a device.
+type Device struct{}
+
+// Open is only supported on Linux, other hosts can implement the framing
+// over WinUSB or libusb bulk transfers.
+func Open() (*Device, error) {
+	return nil, errors.New("unsupported on this host")
+}
+
+func (d *Device) Read(p []byte) (int, error) {
+	return 0, errors.New("unsupported on this host")
+}
+
+func (d *Device) Write(p []byte) (int, error) {
+	return 0, errors.New("unsupported on this host")
+}
+
+func (d *Device) Close() error {
+	return nil
+}
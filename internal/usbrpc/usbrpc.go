@@ -0,0 +1,321 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package usbrpc implements the RPC protocol carried over the example
+// firmware vendor-class USB interface (see rpc.go), it is shared by the
+// device and host tools.
+//
+// Each message is framed with a 32-bit little-endian length prefix and
+// encoded in protocol buffers wire format according to the following schema:
+//
+//	syntax = "proto3";
+//
+//	message Request {
+//		uint32 id      = 1;
+//		string method  = 2;
+//		bytes  payload = 3;
+//	}
+//
+//	message Response {
+//		uint32 id      = 1;
+//		bytes  payload = 2;
+//		string error   = 3;
+//	}
+//
+// Only the wire types required by the schema are encoded, unknown fields are
+// skipped on decoding.
+package usbrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// maximum encoded message size
+	MaxMessage = 128 * 1024
+	// frame header size
+	HeaderSize = 4
+
+	// vendor-class interface bulk endpoints
+	EndpointIN  = 0x85
+	EndpointOUT = 0x05
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Request represents an RPC request.
+type Request struct {
+	ID      uint32
+	Method  string
+	Payload []byte
+}
+
+// Response represents an RPC response, a non empty Error indicates a failed
+// request.
+type Response struct {
+	ID      uint32
+	Payload []byte
+	Error   string
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(buf, byte(v))
+}
+
+func appendTag(buf []byte, field int, wire int) []byte {
+	return appendVarint(buf, uint64(field<<3|wire))
+}
+
+func appendUint(buf []byte, field int, v uint64) []byte {
+	// proto3 default values are not encoded
+	if v == 0 {
+		return buf
+	}
+
+	buf = appendTag(buf, field, wireVarint)
+	return appendVarint(buf, v)
+}
+
+func appendBytes(buf []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return buf
+	}
+
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+
+	return append(buf, v...)
+}
+
+func readVarint(buf []byte) (v uint64, n int, err error) {
+	for shift := uint(0); shift < 64; shift += 7 {
+		if n >= len(buf) {
+			return 0, 0, errors.New("truncated varint")
+		}
+
+		b := buf[n]
+		n += 1
+
+		v |= uint64(b&0x7f) << shift
+
+		if b < 0x80 {
+			return
+		}
+	}
+
+	return 0, 0, errors.New("invalid varint")
+}
+
+// fields parses a message invoking fn for each varint or length delimited
+// field, other wire types are skipped.
+func fields(buf []byte, fn func(field int, v uint64, data []byte)) error {
+	for len(buf) > 0 {
+		tag, n, err := readVarint(buf)
+
+		if err != nil {
+			return err
+		}
+
+		buf = buf[n:]
+		field := int(tag >> 3)
+
+		switch int(tag & 0b111) {
+		case wireVarint:
+			v, n, err := readVarint(buf)
+
+			if err != nil {
+				return err
+			}
+
+			buf = buf[n:]
+			fn(field, v, nil)
+		case wireBytes:
+			size, n, err := readVarint(buf)
+
+			if err != nil {
+				return err
+			}
+
+			buf = buf[n:]
+
+			if size > uint64(len(buf)) {
+				return errors.New("truncated field")
+			}
+
+			fn(field, 0, buf[:size])
+			buf = buf[size:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return errors.New("truncated field")
+			}
+
+			buf = buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return errors.New("truncated field")
+			}
+
+			buf = buf[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", tag&0b111)
+		}
+	}
+
+	return nil
+}
+
+// Marshal encodes the request.
+func (r *Request) Marshal() (buf []byte) {
+	buf = appendUint(buf, 1, uint64(r.ID))
+	buf = appendBytes(buf, 2, []byte(r.Method))
+	buf = appendBytes(buf, 3, r.Payload)
+
+	return
+}
+
+// Unmarshal decodes the request.
+func (r *Request) Unmarshal(buf []byte) error {
+	return fields(buf, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			r.ID = uint32(v)
+		case 2:
+			r.Method = string(data)
+		case 3:
+			r.Payload = append([]byte{}, data...)
+		}
+	})
+}
+
+// Marshal encodes the response.
+func (r *Response) Marshal() (buf []byte) {
+	buf = appendUint(buf, 1, uint64(r.ID))
+	buf = appendBytes(buf, 2, r.Payload)
+	buf = appendBytes(buf, 3, []byte(r.Error))
+
+	return
+}
+
+// Unmarshal decodes the response.
+func (r *Response) Unmarshal(buf []byte) error {
+	return fields(buf, func(field int, v uint64, data []byte) {
+		switch field {
+		case 1:
+			r.ID = uint32(v)
+		case 2:
+			r.Payload = append([]byte{}, data...)
+		case 3:
+			r.Error = string(data)
+		}
+	})
+}
+
+// Frame prepends the length prefix to an encoded message.
+func Frame(msg []byte) []byte {
+	buf := make([]byte, HeaderSize, HeaderSize+len(msg))
+	binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+
+	return append(buf, msg...)
+}
+
+// FrameSize returns the total size of a frame from its header.
+func FrameSize(hdr []byte) (size int, err error) {
+	if len(hdr) < HeaderSize {
+		return 0, errors.New("truncated header")
+	}
+
+	n := binary.LittleEndian.Uint32(hdr)
+
+	if n > MaxMessage {
+		return 0, fmt.Errorf("oversized message (%d bytes)", n)
+	}
+
+	return HeaderSize + int(n), nil
+}
+
+// ReadFrame reads a framed message.
+func ReadFrame(r io.Reader) (msg []byte, err error) {
+	hdr := make([]byte, HeaderSize)
+
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+
+	size, err := FrameSize(hdr)
+
+	if err != nil {
+		return
+	}
+
+	msg = make([]byte, size-HeaderSize)
+	_, err = io.ReadFull(r, msg)
+
+	return
+}
+
+// Client issues requests over a transport.
+type Client struct {
+	rw io.ReadWriter
+	id uint32
+}
+
+// NewClient returns a client for the given transport.
+func NewClient(rw io.ReadWriter) *Client {
+	return &Client{rw: rw}
+}
+
+// Call invokes a method and returns its response payload.
+func (c *Client) Call(method string, payload []byte) (res []byte, err error) {
+	c.id += 1
+
+	req := &Request{
+		ID:      c.id,
+		Method:  method,
+		Payload: payload,
+	}
+
+	if _, err = c.rw.Write(Frame(req.Marshal())); err != nil {
+		return
+	}
+
+	for {
+		msg, err := ReadFrame(c.rw)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r := &Response{}
+
+		if err = r.Unmarshal(msg); err != nil {
+			return nil, err
+		}
+
+		// discard responses to abandoned requests
+		if r.ID != c.id {
+			continue
+		}
+
+		if r.Error != "" {
+			return r.Payload, errors.New(r.Error)
+		}
+
+		return r.Payload, nil
+	}
+}
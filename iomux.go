@@ -0,0 +1,120 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// i.MX6UL/i.MX6ULL IOMUXC pad registers, pads are listed in register order
+// (IOMUX Controller (IOMUXC), IMX6ULLRM).
+const (
+	IOMUXC_SW_MUX_CTL_PAD_JTAG_MOD = 0x020e0044
+	// offset between each SW_MUX_CTL_PAD and SW_PAD_CTL_PAD register
+	IOMUXC_SW_PAD_CTL_OFFSET = 0x28c
+)
+
+// pad groups in register order, names are formatted with the index within
+// the group when a count is given
+var padGroups = []struct {
+	names []string
+	count int
+}{
+	{[]string{"JTAG_MOD", "JTAG_TMS", "JTAG_TDO", "JTAG_TDI", "JTAG_TCK", "JTAG_TRST_B"}, 0},
+	{[]string{"GPIO1_IO%02d"}, 10},
+	{[]string{"UART1_TX_DATA", "UART1_RX_DATA", "UART1_CTS_B", "UART1_RTS_B"}, 0},
+	{[]string{"UART2_TX_DATA", "UART2_RX_DATA", "UART2_CTS_B", "UART2_RTS_B"}, 0},
+	{[]string{"UART3_TX_DATA", "UART3_RX_DATA", "UART3_CTS_B", "UART3_RTS_B"}, 0},
+	{[]string{"UART4_TX_DATA", "UART4_RX_DATA", "UART5_TX_DATA", "UART5_RX_DATA"}, 0},
+	{[]string{"ENET1_RX_DATA0", "ENET1_RX_DATA1", "ENET1_RX_EN", "ENET1_TX_DATA0", "ENET1_TX_DATA1", "ENET1_TX_EN", "ENET1_TX_CLK", "ENET1_RX_ER"}, 0},
+	{[]string{"ENET2_RX_DATA0", "ENET2_RX_DATA1", "ENET2_RX_EN", "ENET2_TX_DATA0", "ENET2_TX_DATA1", "ENET2_TX_EN", "ENET2_TX_CLK", "ENET2_RX_ER"}, 0},
+	{[]string{"LCD_CLK", "LCD_ENABLE", "LCD_HSYNC", "LCD_VSYNC", "LCD_RESET"}, 0},
+	{[]string{"LCD_DATA%02d"}, 24},
+	{[]string{"NAND_RE_B", "NAND_WE_B"}, 0},
+	{[]string{"NAND_DATA%02d"}, 8},
+	{[]string{"NAND_ALE", "NAND_WP_B", "NAND_READY_B", "NAND_CE0_B", "NAND_CE1_B", "NAND_CLE", "NAND_DQS"}, 0},
+	{[]string{"SD1_CMD", "SD1_CLK", "SD1_DATA0", "SD1_DATA1", "SD1_DATA2", "SD1_DATA3"}, 0},
+	{[]string{"CSI_MCLK", "CSI_PIXCLK", "CSI_VSYNC", "CSI_HSYNC"}, 0},
+	{[]string{"CSI_DATA%02d"}, 8},
+}
+
+var padPulls = []string{"100K down", "47K up", "100K up", "22K up"}
+var padSpeeds = []string{"50MHz", "100MHz", "100MHz", "200MHz"}
+
+func padNames() (names []string) {
+	for _, g := range padGroups {
+		if g.count == 0 {
+			names = append(names, g.names...)
+			continue
+		}
+
+		for i := 0; i < g.count; i++ {
+			names = append(names, fmt.Sprintf(g.names[0], i))
+		}
+	}
+
+	return
+}
+
+// padConfig returns a readable description of a SW_PAD_CTL_PAD register.
+func padConfig(ctl uint32) string {
+	var keeper string
+
+	switch {
+	case ctl>>imx6.SW_PAD_CTL_PKE&1 == 0:
+		keeper = "-"
+	case ctl>>imx6.SW_PAD_CTL_PUE&1 == 0:
+		keeper = "keeper"
+	default:
+		keeper = padPulls[ctl>>imx6.SW_PAD_CTL_PUS&0b11]
+	}
+
+	dse := ctl >> imx6.SW_PAD_CTL_DSE & 0b111
+	drive := "off"
+
+	if dse != 0 {
+		drive = fmt.Sprintf("R0/%d", dse)
+	}
+
+	return fmt.Sprintf("%-4s %-6s %-9s hys:%d ode:%d sre:%d",
+		drive,
+		padSpeeds[ctl>>imx6.SW_PAD_CTL_SPEED&0b11],
+		keeper,
+		ctl>>imx6.SW_PAD_CTL_HYS&1,
+		ctl>>imx6.SW_PAD_CTL_ODE&1,
+		ctl>>imx6.SW_PAD_CTL_SRE&1)
+}
+
+// iomuxDump returns the mux mode and pad configuration of all pads.
+func iomuxDump() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%-16s %-10s %-6s %-4s %-6s %-9s\n", "pad", "register", "mode", "dse", "speed", "pull/keep")
+
+	for i, name := range padNames() {
+		mux := uint32(IOMUXC_SW_MUX_CTL_PAD_JTAG_MOD + i*4)
+		ctl := reg.Read(mux + IOMUXC_SW_PAD_CTL_OFFSET)
+		mode := reg.Read(mux)
+
+		sion := ""
+
+		if mode>>imx6.SW_MUX_CTL_SION&1 == 1 {
+			sion = "+s"
+		}
+
+		fmt.Fprintf(&buf, "%-16s %#08x ALT%d%-2s %s\n", name, mux, mode&0b1111, sion, padConfig(ctl))
+	}
+
+	return buf.String()
+}
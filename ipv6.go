@@ -0,0 +1,178 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+)
+
+var ipv6Log = newLogger("ipv6")
+
+// ipv6Enabled returns whether IPv6 is added to the network stacks, with a
+// link-local address, stateless address autoconfiguration (SLAAC) from router
+// advertisements and an optional static address (see config.go).
+func ipv6Enabled() bool {
+	return conf.Bool("ipv6", false)
+}
+
+// ndpDispatcher handles NDP events, adding and removing routes for
+// discovered routers and on-link prefixes.
+type ndpDispatcher struct {
+	s *stack.Stack
+}
+
+func (d *ndpDispatcher) removeRoute(route tcpip.Route) {
+	var routes []tcpip.Route
+
+	for _, r := range d.s.GetRouteTable() {
+		if r != route {
+			routes = append(routes, r)
+		}
+	}
+
+	d.s.SetRouteTable(routes)
+}
+
+func (d *ndpDispatcher) OnDuplicateAddressDetectionStatus(nic tcpip.NICID, addr tcpip.Address, resolved bool, err *tcpip.Error) {
+	if !resolved || err != nil {
+		ipv6Log.Errorf("duplicate address detection failed for %s (%v)", addr, err)
+	}
+}
+
+func (d *ndpDispatcher) OnDefaultRouterDiscovered(nic tcpip.NICID, addr tcpip.Address) bool {
+	ipv6Log.Infof("default router %s", addr)
+	d.s.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, Gateway: addr, NIC: nic})
+	return true
+}
+
+func (d *ndpDispatcher) OnDefaultRouterInvalidated(nic tcpip.NICID, addr tcpip.Address) {
+	d.removeRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, Gateway: addr, NIC: nic})
+}
+
+func (d *ndpDispatcher) OnOnLinkPrefixDiscovered(nic tcpip.NICID, prefix tcpip.Subnet) bool {
+	d.s.AddRoute(tcpip.Route{Destination: prefix, NIC: nic})
+	return true
+}
+
+func (d *ndpDispatcher) OnOnLinkPrefixInvalidated(nic tcpip.NICID, prefix tcpip.Subnet) {
+	d.removeRoute(tcpip.Route{Destination: prefix, NIC: nic})
+}
+
+func (d *ndpDispatcher) OnAutoGenAddress(nic tcpip.NICID, addr tcpip.AddressWithPrefix) bool {
+	ipv6Log.Infof("address %s", addr)
+	return true
+}
+
+func (d *ndpDispatcher) OnAutoGenAddressDeprecated(tcpip.NICID, tcpip.AddressWithPrefix) {}
+
+func (d *ndpDispatcher) OnAutoGenAddressInvalidated(nic tcpip.NICID, addr tcpip.AddressWithPrefix) {
+	ipv6Log.Warnf("address %s invalidated", addr)
+}
+
+func (d *ndpDispatcher) OnRecursiveDNSServerOption(nic tcpip.NICID, addrs []tcpip.Address, lifetime time.Duration) {
+	ipv6Log.Infof("DNS servers %v", addrs)
+}
+
+func (d *ndpDispatcher) OnDNSSearchListOption(tcpip.NICID, []string, time.Duration) {}
+
+func (d *ndpDispatcher) OnDHCPv6Configuration(tcpip.NICID, stack.DHCPv6ConfigurationFromNDPRA) {}
+
+// newStack creates a network stack, adding IPv6 support when enabled.
+func newStack(opts stack.Options) (s *stack.Stack) {
+	if !ipv6Enabled() {
+		return stack.New(opts)
+	}
+
+	ndp := &ndpDispatcher{}
+
+	opts.NetworkProtocols = append(opts.NetworkProtocols, ipv6.NewProtocol())
+	opts.TransportProtocols = append(opts.TransportProtocols, icmp.NewProtocol6())
+	opts.AutoGenIPv6LinkLocal = true
+	opts.NDPDisp = ndp
+	opts.NDPConfigs = stack.DefaultNDPConfigurations()
+	opts.NDPConfigs.HandleRAs = true
+	opts.NDPConfigs.DiscoverDefaultRouters = true
+	opts.NDPConfigs.DiscoverOnLinkPrefixes = true
+	opts.NDPConfigs.AutoGenGlobalAddresses = true
+
+	s = stack.New(opts)
+	ndp.s = s
+
+	return
+}
+
+// configureIPv6 adds the link-local route and, if passed, a static address
+// in CIDR notation to a NIC.
+func configureIPv6(s *stack.Stack, nic tcpip.NICID, cidr string) (err error) {
+	if s.NetworkProtocolInstance(ipv6.ProtocolNumber) == nil {
+		return
+	}
+
+	s.AddRoute(tcpip.Route{Destination: header.IPv6LinkLocalPrefix.Subnet(), NIC: nic})
+
+	if cidr == "" {
+		return
+	}
+
+	ip, ipnet, err := net.ParseCIDR(cidr)
+
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("invalid IPv6 address %s", cidr)
+	}
+
+	ones, _ := ipnet.Mask.Size()
+
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol: ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.Address(ip.To16()),
+			PrefixLen: ones,
+		},
+	}
+
+	if err := s.AddProtocolAddress(nic, protoAddr); err != nil {
+		return fmt.Errorf("error adding address %s, %v", cidr, err)
+	}
+
+	s.AddRoute(tcpip.Route{Destination: protoAddr.AddressWithPrefix.Subnet(), NIC: nic})
+
+	return
+}
+
+// listenTCP listens on the argument address, on stacks with IPv6 support a
+// dual-stack endpoint is used to also accept IPv6 connections on the NIC.
+func listenTCP(s *stack.Stack, addr tcpip.FullAddress) (*gonet.TCPListener, error) {
+	if s.NetworkProtocolInstance(ipv6.ProtocolNumber) == nil {
+		return gonet.ListenTCP(s, addr, ipv4.ProtocolNumber)
+	}
+
+	// IPv4 connections are accepted as IPv4-mapped addresses
+	addr.Addr = ""
+
+	return gonet.ListenTCP(s, addr, ipv6.ProtocolNumber)
+}
+
+// networkProtocol returns the network protocol of an address.
+func networkProtocol(addr tcpip.Address) tcpip.NetworkProtocolNumber {
+	if len(addr) == header.IPv6AddressSize {
+		return ipv6.ProtocolNumber
+	}
+
+	return ipv4.ProtocolNumber
+}
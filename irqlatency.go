@@ -0,0 +1,282 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	mathrand "math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// GPT registers
+// (General Purpose Timer Memory Map/Register Definition, IMX6ULLRM).
+const (
+	GPT1_BASE = 0x02098000
+
+	GPTx_CR      = 0x00
+	CR_SWR       = 15
+	CR_FRR       = 9
+	CR_CLKSRC    = 6
+	CR_ENMOD     = 1
+	CR_EN        = 0
+	CLKSRC_IPG   = 0b001
+	GPTx_PR      = 0x04
+	GPTx_SR      = 0x08
+	SR_OF1       = 0
+	SR_ALL       = 0x3f
+	GPTx_IR      = 0x0c
+	GPTx_OCR1    = 0x10
+	GPTx_CNT     = 0x24
+	GPT_IPG_FREQ = 66000000
+
+	// GPT1 clock gates are CCGR1 CG10 (bus) and CG11 (serial)
+	CCGR1_CG10 = 20
+	CCGR1_CG11 = 22
+)
+
+var irqlatencyLog = newLogger("irqlatency")
+
+// Interrupt latency is measured against GPT output compare events, the
+// counter value at the compare match being the event hardware timestamp. As
+// IRQs are not serviced (see sdma.go), the interrupt handler is stood in by a
+// goroutine polling the compare status flag, which wakes a second goroutine
+// as an interrupt driven driver would.
+const (
+	// compare events are scheduled at random intervals within this range
+	IRQ_MIN_INTERVAL = 100 * time.Microsecond
+	IRQ_MAX_INTERVAL = 1 * time.Millisecond
+)
+
+// latency histogram bucket upper bounds
+var irqBuckets = []time.Duration{
+	1 * time.Microsecond,
+	2 * time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+}
+
+// gpt represents a General Purpose Timer, free running on the peripheral
+// clock.
+type gpt struct {
+	base uint32
+}
+
+func (hw *gpt) Init() {
+	reg.SetN(CCM_CCGR1, CCGR1_CG10, 0b11, 0b11)
+	reg.SetN(CCM_CCGR1, CCGR1_CG11, 0b11, 0b11)
+
+	reg.Write(hw.base+GPTx_CR, 0)
+	// the interrupt line is left disabled, as IRQs are not serviced
+	reg.Write(hw.base+GPTx_IR, 0)
+
+	reg.Set(hw.base+GPTx_CR, CR_SWR)
+	reg.Wait(hw.base+GPTx_CR, CR_SWR, 1, 0)
+
+	reg.Write(hw.base+GPTx_PR, 0)
+	reg.Write(hw.base+GPTx_SR, SR_ALL)
+	reg.Write(hw.base+GPTx_CR, CLKSRC_IPG<<CR_CLKSRC|1<<CR_FRR|1<<CR_ENMOD)
+	reg.Set(hw.base+GPTx_CR, CR_EN)
+}
+
+func (hw *gpt) Stop() {
+	reg.Write(hw.base+GPTx_CR, 0)
+}
+
+func (hw *gpt) Counter() uint32 {
+	return reg.Read(hw.base + GPTx_CNT)
+}
+
+// Schedule arms a compare event at the argument counter value.
+func (hw *gpt) Schedule(at uint32) {
+	reg.Write(hw.base+GPTx_SR, 1<<SR_OF1)
+	reg.Write(hw.base+GPTx_OCR1, at)
+}
+
+func (hw *gpt) Fired() bool {
+	return reg.Get(hw.base+GPTx_SR, SR_OF1, 1) == 1
+}
+
+func gptTicks(d time.Duration) uint32 {
+	return uint32(d.Nanoseconds() * GPT_IPG_FREQ / 1e9)
+}
+
+func gptDuration(ticks uint32) time.Duration {
+	return time.Duration(int64(ticks) * 1e9 / GPT_IPG_FREQ)
+}
+
+// irqLatency holds latency samples.
+type irqLatency []time.Duration
+
+func (l irqLatency) report(name string) string {
+	var buf bytes.Buffer
+	var sum time.Duration
+
+	if len(l) == 0 {
+		return name + ": no samples\n"
+	}
+
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+
+	for _, d := range l {
+		sum += d
+	}
+
+	fmt.Fprintf(&buf, "%s: min %s avg %s p99 %s max %s\n", name, l[0], sum/time.Duration(len(l)), l[len(l)*99/100], l[len(l)-1])
+
+	counts := make([]int, len(irqBuckets)+1)
+
+	for _, d := range l {
+		i := sort.Search(len(irqBuckets), func(i int) bool { return d < irqBuckets[i] })
+		counts[i] += 1
+	}
+
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+
+		bound := "  >= " + irqBuckets[len(irqBuckets)-1].String()
+
+		if i < len(irqBuckets) {
+			bound = "  <  " + irqBuckets[i].String()
+		}
+
+		fmt.Fprintf(&buf, "%-10s %6d %s\n", bound, n, bytes.Repeat([]byte("#"), (n*50+len(l)-1)/len(l)))
+	}
+
+	return buf.String()
+}
+
+// irqLoad keeps the scheduler and garbage collector busy with CPU bound and
+// allocating goroutines until stopped.
+func irqLoad(n int) (stop func()) {
+	var wg sync.WaitGroup
+
+	exit := make(chan bool)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var garbage [][]byte
+
+			for {
+				select {
+				case <-exit:
+					return
+				default:
+				}
+
+				if i%2 == 0 {
+					garbage = append(garbage, make([]byte, 4096))
+
+					if len(garbage) > 256 {
+						garbage = nil
+					}
+				} else {
+					for j := 0; j < 10000; j++ {
+						runtime.KeepAlive(j)
+					}
+				}
+
+				runtime.Gosched()
+			}
+		}(i)
+	}
+
+	return func() {
+		close(exit)
+		wg.Wait()
+	}
+}
+
+// measureIRQLatency samples the latency from compare events to the polling
+// handler and to the goroutine it wakes.
+func measureIRQLatency(hw *gpt, samples int) (handler irqLatency, wakeup irqLatency) {
+	wake := make(chan uint32)
+	done := make(chan bool)
+
+	go func() {
+		for at := range wake {
+			wakeup = append(wakeup, gptDuration(hw.Counter()-at))
+		}
+
+		done <- true
+	}()
+
+	min := gptTicks(IRQ_MIN_INTERVAL)
+	span := int64(gptTicks(IRQ_MAX_INTERVAL) - min)
+
+	for i := 0; i < samples; i++ {
+		at := hw.Counter() + min + uint32(mathrand.Int63n(span))
+		hw.Schedule(at)
+
+		for !hw.Fired() {
+			runtime.Gosched()
+		}
+
+		handler = append(handler, gptDuration(hw.Counter()-at))
+		wake <- at
+	}
+
+	close(wake)
+	<-done
+
+	return
+}
+
+// TestIRQLatency measures, idle and under load, the latency of timer compare
+// events handling.
+func TestIRQLatency() (err error) {
+	samples := conf.Int("irq_samples", 1000)
+	load := conf.Int("irq_load", 4)
+
+	hw := &gpt{base: GPT1_BASE}
+	hw.Init()
+	defer hw.Stop()
+
+	irqlatencyLog.Infof("GPT1 @ %d Hz, %d samples, events every %s-%s", GPT_IPG_FREQ, samples, IRQ_MIN_INTERVAL, IRQ_MAX_INTERVAL)
+
+	for _, n := range []int{0, load} {
+		stop := irqLoad(n)
+		handler, wakeup := measureIRQLatency(hw, samples)
+		stop()
+
+		for _, r := range []string{
+			handler.report(fmt.Sprintf("event to handler (%d load goroutines)", n)),
+			wakeup.report(fmt.Sprintf("event to goroutine (%d load goroutines)", n)),
+		} {
+			for _, l := range bytes.Split(bytes.TrimSpace([]byte(r)), []byte("\n")) {
+				irqlatencyLog.Infof("%s", l)
+			}
+		}
+
+		if load == 0 {
+			break
+		}
+	}
+
+	return
+}
@@ -0,0 +1,306 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Known answer tests (KATs) verify each cryptographic primitive against
+// published test vectors, rather than for internal consistency only, and are
+// executed on every boot before any other test in the fashion of FIPS 140
+// power-up self-tests. On failure, when `kat_enforce` is set (the default),
+// the example enters an error state in which no network services, and
+// therefore no cryptographic services, are started.
+const KAT_DCP_KEY_SLOT = 2
+
+var katLog = newLogger("kat")
+
+type katVector struct {
+	name      string
+	supported bool
+	fn        func() error
+}
+
+func unhex(s string) []byte {
+	buf, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+func katCompare(res []byte, expected string) error {
+	if !bytes.Equal(res, unhex(expected)) {
+		return fmt.Errorf("%x != %s", res, expected)
+	}
+
+	return nil
+}
+
+func katVectors() []katVector {
+	return []katVector{
+		{"AES-128", true, katAES128},
+		{"AES-256", true, katAES256},
+		{"AES-128-GCM", true, katAESGCM},
+		{"SHA-256", true, katSHA256},
+		{"SHA-384", true, katSHA384},
+		{"SHA-512", true, katSHA512},
+		{"HMAC-SHA-256", true, katHMAC},
+		{"ECDSA P-256", true, katECDSA},
+		{"Ed25519", true, katEd25519},
+		{"DCP AES-128-CBC", target.DCP(), katDCP},
+	}
+}
+
+// FIPS 197 C.1
+func katAES128() error {
+	block, err := aes.NewCipher(unhex("000102030405060708090a0b0c0d0e0f"))
+
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, aes.BlockSize)
+	block.Encrypt(buf, unhex("00112233445566778899aabbccddeeff"))
+
+	if err = katCompare(buf, "69c4e0d86a7b0430d8cdb78070b4c55a"); err != nil {
+		return err
+	}
+
+	block.Decrypt(buf, buf)
+
+	return katCompare(buf, "00112233445566778899aabbccddeeff")
+}
+
+// FIPS 197 C.3
+func katAES256() error {
+	block, err := aes.NewCipher(unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"))
+
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, aes.BlockSize)
+	block.Encrypt(buf, unhex("00112233445566778899aabbccddeeff"))
+
+	return katCompare(buf, "8ea2b7ca516745bfeafc49904b496089")
+}
+
+// The Galois/Counter Mode of Operation (GCM), test case 2
+func katAESGCM() error {
+	block, err := aes.NewCipher(make([]byte, 16))
+
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	ct := aead.Seal(nil, nonce, make([]byte, 16), nil)
+
+	if err = katCompare(ct, "0388dace60b6a392f328c2b971b2fe78ab6e47d42cec13bdf53a67b21257bddf"); err != nil {
+		return err
+	}
+
+	// tampered ciphertext must be rejected
+	ct[0] ^= 1
+
+	if _, err = aead.Open(nil, nonce, ct, nil); err == nil {
+		return errors.New("tampered ciphertext authenticated")
+	}
+
+	return nil
+}
+
+// FIPS 180-2 B.1
+func katSHA256() error {
+	sum := sha256.Sum256([]byte("abc"))
+	return katCompare(sum[:], "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+}
+
+// FIPS 180-2 D.1
+func katSHA384() error {
+	sum := sha512.Sum384([]byte("abc"))
+	return katCompare(sum[:], "cb00753f45a35e8bb5a03d699ac65007272c32ab0eded1631a8b605a43ff5bed8086072ba1e7cc2358baeca134c825a7")
+}
+
+// FIPS 180-2 C.1
+func katSHA512() error {
+	sum := sha512.Sum512([]byte("abc"))
+	return katCompare(sum[:], "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f")
+}
+
+// RFC 4231 4.3
+func katHMAC() error {
+	mac := hmac.New(sha256.New, []byte("Jefe"))
+	mac.Write([]byte("what do ya want for nothing?"))
+
+	return katCompare(mac.Sum(nil), "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843")
+}
+
+// RFC 6979 A.2.5, as signatures use a random nonce the known signature is
+// verified and a pairwise consistency test is performed.
+func katECDSA() error {
+	curve := elliptic.P256()
+	d := unhex("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721")
+
+	x, y := curve.ScalarBaseMult(d)
+
+	if err := katCompare(append(x.Bytes(), y.Bytes()...), "60fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6"+
+		"7903fe1008b8bc99a41ae9e95628bc64f2f1b20c2d7e9f5177a3c294d4462299"); err != nil {
+		return fmt.Errorf("public key, %v", err)
+	}
+
+	priv := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         new(big.Int).SetBytes(d),
+	}
+
+	digest := sha256.Sum256([]byte("sample"))
+	r := new(big.Int).SetBytes(unhex("efd48b2aacb6a8fd1140dd9cd45e81d69d2c877b56aaf991c34d0ea84eaf3716"))
+	s := new(big.Int).SetBytes(unhex("f7cb1c942d657c41d436c7a1b6e29f65f3e900dbb9aff4064dc4ab2f843acda8"))
+
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		return errors.New("known signature not verified")
+	}
+
+	if ecdsa.Verify(&priv.PublicKey, digest[:], s, r) {
+		return errors.New("invalid signature verified")
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+
+	if err != nil {
+		return err
+	}
+
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		return errors.New("pairwise consistency test failure")
+	}
+
+	return nil
+}
+
+// RFC 8032 7.1 test 1
+func katEd25519() error {
+	priv := ed25519.NewKeyFromSeed(unhex("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"))
+	pub := priv.Public().(ed25519.PublicKey)
+
+	if err := katCompare(pub, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"); err != nil {
+		return fmt.Errorf("public key, %v", err)
+	}
+
+	sig := ed25519.Sign(priv, nil)
+
+	if err := katCompare(sig, "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"); err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, nil, sig) {
+		return errors.New("known signature not verified")
+	}
+
+	return nil
+}
+
+// NIST SP 800-38A F.2.1 and F.2.2, on the DCP.
+func katDCP() (err error) {
+	pt := unhex("6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51")
+	iv := "000102030405060708090a0b0c0d0e0f"
+
+	imx6.DCP.Init()
+
+	if err = imx6.DCP.SetKey(KAT_DCP_KEY_SLOT, unhex("2b7e151628aed2a6abf7158809cf4f3c")); err != nil {
+		return
+	}
+
+	buf := append([]byte{}, pt...)
+
+	if err = imx6.DCP.Encrypt(buf, KAT_DCP_KEY_SLOT, unhex(iv)); err != nil {
+		return
+	}
+
+	if err = katCompare(buf, "7649abac8119b246cee98e9b12e9197d5086cb9b507219ee95db113a917678b2"); err != nil {
+		return fmt.Errorf("encryption, %v", err)
+	}
+
+	if err = imx6.DCP.Decrypt(buf, KAT_DCP_KEY_SLOT, unhex(iv)); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf, pt) {
+		return fmt.Errorf("decryption, %x != %x", buf, pt)
+	}
+
+	return
+}
+
+// runKATs executes all supported known answer tests, returning the number of
+// tests and an error listing the failed ones.
+func runKATs() (n int, err error) {
+	var failed []string
+
+	start := time.Now()
+
+	for _, v := range katVectors() {
+		if !v.supported {
+			continue
+		}
+
+		n += 1
+
+		if e := v.fn(); e != nil {
+			katLog.Errorf("%s FAIL, %v", v.name, e)
+			failed = append(failed, v.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		err = fmt.Errorf("known answer test failure (%s)", strings.Join(failed, ", "))
+	}
+
+	katLog.Infof("%d known answer tests, %d failed (%v)", n, len(failed), time.Since(start))
+
+	return
+}
+
+func katCommand() string {
+	n, err := runKATs()
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return fmt.Sprintf("%d known answer tests passed", n)
+}
@@ -0,0 +1,165 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var kdfLog = newLogger("kdf")
+
+// interval for heap usage sampling during key derivation
+const KDF_SAMPLE_INTERVAL = 10 * time.Millisecond
+
+// kdfBenchmark represents a key derivation function parameter set.
+type kdfBenchmark struct {
+	name string
+	// memory is the expected memory cost in bytes
+	memory uint64
+	derive func(password []byte, salt []byte) error
+}
+
+func argon2Benchmark(t uint32, m uint32, p uint8) kdfBenchmark {
+	return kdfBenchmark{
+		name:   fmt.Sprintf("argon2id t=%d m=%dM p=%d", t, m/1024, p),
+		memory: uint64(m) * 1024,
+		derive: func(password []byte, salt []byte) error {
+			argon2.IDKey(password, salt, t, m, p, 32)
+			return nil
+		},
+	}
+}
+
+func scryptBenchmark(logN uint, r int, p int) kdfBenchmark {
+	N := 1 << logN
+
+	return kdfBenchmark{
+		name:   fmt.Sprintf("scrypt N=2^%d r=%d p=%d", logN, r, p),
+		memory: uint64(128 * N * r),
+		derive: func(password []byte, salt []byte) (err error) {
+			_, err = scrypt.Key(password, salt, N, r, p, 32)
+			return
+		},
+	}
+}
+
+func bcryptBenchmark(cost int) kdfBenchmark {
+	return kdfBenchmark{
+		name:   fmt.Sprintf("bcrypt cost=%d", cost),
+		memory: 4 * 1024,
+		derive: func(password []byte, _ []byte) (err error) {
+			_, err = bcrypt.GenerateFromPassword(password, cost)
+			return
+		},
+	}
+}
+
+// heapPeak samples the heap in use until the returned function is invoked,
+// which returns the observed high-water mark.
+func heapPeak() func() uint64 {
+	var m runtime.MemStats
+	var peak uint64
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(KDF_SAMPLE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			runtime.ReadMemStats(&m)
+
+			if m.HeapInuse > peak {
+				peak = m.HeapInuse
+			}
+
+			select {
+			case <-done:
+				close(stopped)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() uint64 {
+		close(done)
+		<-stopped
+
+		return peak
+	}
+}
+
+// TestKDF benchmarks memory-hard key derivation functions, reporting the
+// heap high-water mark for each parameter set.
+func TestKDF() (err error) {
+	var m runtime.MemStats
+
+	maxMemory := uint64(conf.Int("kdf_max_memory", 256)) * 1024 * 1024
+
+	password := []byte("correct horse battery staple")
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	benchmarks := []kdfBenchmark{
+		argon2Benchmark(1, 64*1024, 4),
+		argon2Benchmark(3, 64*1024, 4),
+		argon2Benchmark(1, 256*1024, 4),
+		scryptBenchmark(15, 8, 1),
+		scryptBenchmark(17, 8, 1),
+		scryptBenchmark(18, 8, 1),
+		bcryptBenchmark(10),
+		bcryptBenchmark(12),
+	}
+
+	for _, b := range benchmarks {
+		if b.memory > maxMemory {
+			kdfLog.Warnf("%-28s skipped (%d MiB exceeds kdf_max_memory)", b.name, b.memory/(1024*1024))
+			continue
+		}
+
+		// start from a collected heap to measure only this run
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		base := m.HeapInuse
+
+		stop := heapPeak()
+		start := time.Now()
+
+		err = b.derive(password, salt)
+
+		elapsed := time.Since(start)
+		peak := stop()
+
+		if err != nil {
+			return fmt.Errorf("%s error, %v", b.name, err)
+		}
+
+		if peak < base {
+			peak = base
+		}
+
+		runtime.ReadMemStats(&m)
+
+		kdfLog.Infof("%-28s %10s heap peak %4d MiB (+%d MiB) HeapSys %d MiB",
+			b.name, elapsed.Round(time.Millisecond), peak/(1024*1024), (peak-base)/(1024*1024), m.HeapSys/(1024*1024))
+	}
+
+	runtime.GC()
+
+	return
+}
@@ -0,0 +1,143 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The SNVS low power domain Zeroizable Master Key register file retains its
+// content across warm resets, and across power cycles when the SNVS is
+// battery backed, while it is cleared by hardware on tamper and other LP
+// security violations (see snvs.go). A key encryption key derived from it
+// binds sealed blobs, when `zmk_kek` is set, to the tamper state in addition
+// to the device: once the ZMK is zeroized, such blobs (e.g. encrypted volume
+// keys) can no longer be unsealed.
+const (
+	kekDiversifier = "zmk-kek"
+)
+
+var kekLog = newLogger("kek")
+
+// zmkValid returns whether the ZMK has been programmed and not zeroized.
+func zmkValid() bool {
+	return reg.Get(SNVS_LPMKCR, LPMKCR_ZMK_VAL, 1) == 1 && reg.Get(SNVS_HPSR, HPSR_ZMK_ZERO, 1) == 0
+}
+
+// zmkKEK returns the key encryption key derived from the ZMK, which is
+// programmed with a random key, when not valid, only if provisioning is
+// allowed.
+func zmkKEK(provision bool) (kek []byte, err error) {
+	if !imx6.Native {
+		return nil, errors.New("unsupported under emulation")
+	}
+
+	if !zmkValid() {
+		if !provision {
+			return nil, errors.New("ZMK not valid (zeroized by security violation?)")
+		}
+
+		zmk := make([]byte, ZMK_SIZE)
+
+		if _, err = rand.Read(zmk); err != nil {
+			return
+		}
+
+		if err = zmkProgram(zmk); err != nil {
+			return
+		}
+	}
+
+	mac := hmac.New(sha256.New, zmkRead())
+	mac.Write([]byte(kekDiversifier))
+
+	return mac.Sum(nil), nil
+}
+
+func kekCipher(provision bool) (aead cipher.AEAD, err error) {
+	kek, err := zmkKEK(provision)
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(kek)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// kekWrap encrypts and authenticates a payload with the ZMK derived key,
+// provisioning the ZMK if needed.
+func kekWrap(payload []byte) (wrapped []byte, err error) {
+	aead, err := kekCipher(true)
+
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	return aead.Seal(nonce, nonce, payload, nil), nil
+}
+
+// kekUnwrap authenticates and decrypts a payload wrapped with kekWrap(),
+// failures, which follow ZMK zeroization on security violations or SNVS power
+// loss, are recorded in the audit log.
+func kekUnwrap(wrapped []byte) (payload []byte, err error) {
+	if payload, err = kekOpen(wrapped); err != nil {
+		kekLog.Errorf("cannot unwrap sealed blob, %v", err)
+		auditf("kek.unwrap", "failed, %v", err)
+	}
+
+	return
+}
+
+func kekOpen(wrapped []byte) (payload []byte, err error) {
+	aead, err := kekCipher(false)
+
+	if err != nil {
+		return
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+
+	nonce := wrapped[:aead.NonceSize()]
+
+	if payload, err = aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil); err != nil {
+		return nil, errors.New("invalid wrapped key (ZMK changed?)")
+	}
+
+	return
+}
+
+// isKEKBlob returns whether a sealed blob payload is wrapped with the ZMK
+// derived key.
+func isKEKBlob(blob []byte) bool {
+	return bytes.HasPrefix(blob, []byte(BLOB_MAGIC_KEK))
+}
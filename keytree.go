@@ -0,0 +1,252 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The key tree derives a labeled hierarchy of application keys from a single
+// root, itself derived with the DCP from the SoC unique OTPMK, so that
+// modules never handle the hardware key, nor define their own diversifiers,
+// and keys of different purposes are cryptographically separated:
+//
+//	root = HKDF-Extract(salt: unique ID, DCP(KEYTREE_DIVERSIFIER))
+//	node = HKDF-Expand(parent, "node" || 0x00 || label, 32)
+//	key  = HKDF-Expand(node, "key" || 0x00 || context, size)
+//
+// Nodes are addressed by slash separated paths (e.g. `storage/ramdisk`),
+// first level labels being the purposes listed in keyTreeBranches. On targets
+// without a hardware key the root is random at each boot (ephemeral) and
+// consumers requiring keys which persist across reboots must refuse it.
+const (
+	KEYTREE_DIVERSIFIER = "keytree-root"
+	KEYTREE_NODE_SIZE   = sha256.Size
+
+	KEY_STORAGE     = "storage"
+	KEY_TLS         = "tls"
+	KEY_ATTESTATION = "attestation"
+	KEY_AUTH        = "auth"
+)
+
+// keyTreeBranches lists the first level nodes and their purpose.
+var keyTreeBranches = []struct {
+	label   string
+	purpose string
+}{
+	{KEY_STORAGE, "data at rest encryption (e.g. RAM disk)"},
+	{KEY_TLS, "TLS server and client keys"},
+	{KEY_ATTESTATION, "attestation and identity keys"},
+	{KEY_AUTH, "authentication secrets (e.g. TOTP)"},
+}
+
+var keyTreeLabel = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// keyNode represents a node of the key tree.
+type keyNode struct {
+	path      string
+	prk       []byte
+	ephemeral bool
+}
+
+var keyTreeRoot struct {
+	sync.Once
+
+	root *keyNode
+	err  error
+}
+
+// KeyTree returns the key tree root.
+func KeyTree() (*keyNode, error) {
+	keyTreeRoot.Do(func() {
+		var ikm []byte
+		var err error
+
+		root := &keyNode{}
+
+		if target.HardwareKey() {
+			ikm, err = target.DeriveKey([]byte(KEYTREE_DIVERSIFIER), make([]byte, aes.BlockSize))
+		} else {
+			root.ephemeral = true
+			ikm = make([]byte, KEYTREE_NODE_SIZE)
+			_, err = rand.Read(ikm)
+		}
+
+		if err != nil {
+			keyTreeRoot.err = fmt.Errorf("cannot derive key tree root, %v", err)
+			return
+		}
+
+		root.prk = hkdf.Extract(sha256.New, ikm, target.UniqueID())
+
+		for i := range ikm {
+			ikm[i] = 0
+		}
+
+		keyTreeRoot.root = root
+	})
+
+	return keyTreeRoot.root, keyTreeRoot.err
+}
+
+func (k *keyNode) expand(prefix string, info []byte, size int) []byte {
+	buf := make([]byte, size)
+	r := hkdf.Expand(sha256.New, k.prk, append([]byte(prefix+"\x00"), info...))
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		// only reached when exceeding 255 hash lengths
+		panic(err)
+	}
+
+	return buf
+}
+
+// Child returns the child node with the argument label.
+func (k *keyNode) Child(label string) (*keyNode, error) {
+	if !keyTreeLabel.MatchString(label) {
+		return nil, fmt.Errorf("invalid key label %q", label)
+	}
+
+	path := label
+
+	if k.path != "" {
+		path = k.path + "/" + label
+	}
+
+	return &keyNode{
+		path:      path,
+		prk:       k.expand("node", []byte(label), KEYTREE_NODE_SIZE),
+		ephemeral: k.ephemeral,
+	}, nil
+}
+
+// Node returns the descendant node at the argument slash separated path.
+func (k *keyNode) Node(path string) (n *keyNode, err error) {
+	n = k
+
+	for _, label := range strings.Split(path, "/") {
+		if n, err = n.Child(label); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Path returns the node path.
+func (k *keyNode) Path() string {
+	return k.path
+}
+
+// Ephemeral returns whether the node is derived from a random root, rather
+// than from the hardware key.
+func (k *keyNode) Ephemeral() bool {
+	return k.ephemeral
+}
+
+// Key returns a key of the argument size, distinct keys can be derived from
+// the same node with different contexts.
+func (k *keyNode) Key(context []byte, size int) []byte {
+	return k.expand("key", context, size)
+}
+
+// ECDSAKey returns a deterministic P-256 private key, the scalar is derived
+// with 64 extra bits to make its bias negligible (FIPS 186-4 B.4.1).
+func (k *keyNode) ECDSAKey() (priv *ecdsa.PrivateKey, err error) {
+	curve := elliptic.P256()
+	params := curve.Params()
+
+	c := new(big.Int).SetBytes(k.expand("ecdsa-p256", nil, params.BitSize/8+8))
+	n := new(big.Int).Sub(params.N, big.NewInt(1))
+
+	priv = &ecdsa.PrivateKey{D: c.Mod(c, n).Add(c, big.NewInt(1))}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(priv.D.Bytes())
+
+	return
+}
+
+// appKey returns a key of the argument size derived at the argument key tree
+// path.
+func appKey(path string, size int) (key []byte, err error) {
+	root, err := KeyTree()
+
+	if err != nil {
+		return
+	}
+
+	n, err := root.Node(path)
+
+	if err != nil {
+		return
+	}
+
+	return n.Key(nil, size), nil
+}
+
+// hardwareKeyNode returns the node at the argument key tree path, failing
+// when the root is ephemeral.
+func hardwareKeyNode(path string) (n *keyNode, err error) {
+	root, err := KeyTree()
+
+	if err != nil {
+		return
+	}
+
+	if root.Ephemeral() {
+		return nil, errors.New("hardware key unavailable")
+	}
+
+	return root.Node(path)
+}
+
+func keyTreeCommand() string {
+	var buf strings.Builder
+
+	root, err := KeyTree()
+
+	if err != nil {
+		return err.Error()
+	}
+
+	source := "hardware (DCP OTPMK)"
+
+	if root.Ephemeral() {
+		source = "ephemeral (random at boot)"
+	}
+
+	fmt.Fprintf(&buf, "root: %s\n", source)
+
+	// fingerprints are derived as keys with a dedicated context, so that
+	// they can be compared without revealing any key
+	for _, b := range keyTreeBranches {
+		n, err := root.Child(b.label)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		fmt.Fprintf(&buf, "%-12s %x  %s\n", b.label, n.Key([]byte("fingerprint"), 8), b.purpose)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
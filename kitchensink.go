@@ -0,0 +1,317 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+// The kitchen sink stress scenario runs crypto, memory card and network
+// workloads simultaneously, each verifying the integrity of its data, to
+// reproduce races between subsystems (e.g. DMA, cache maintenance and
+// scheduling) which do not surface when they are exercised in isolation.
+const (
+	// crypto and network payload size
+	KITCHENSINK_CHUNK = 64 * 1024
+	// network stress echo port, on the loopback stacks (see netloop.go)
+	KITCHENSINK_PORT = 9
+)
+
+var kitchensinkLog = newLogger("kitchensink")
+
+// stressWorker holds the counters of a stress scenario workload.
+type stressWorker struct {
+	name  string
+	ops   int
+	bytes int64
+	err   error
+}
+
+// stressAES seals and opens random payloads with software AES-128-GCM.
+func stressAES(w *stressWorker, deadline time.Time) {
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	buf := make([]byte, KITCHENSINK_CHUNK)
+
+	for time.Now().Before(deadline) {
+		rand.Read(nonce)
+		rand.Read(buf)
+
+		sealed := gcm.Seal(nil, nonce, buf, nil)
+		res, err := gcm.Open(nil, nonce, sealed, nil)
+
+		if err != nil {
+			w.err = fmt.Errorf("open, %v", err)
+			return
+		}
+
+		if !bytes.Equal(res, buf) {
+			w.err = errors.New("data mismatch")
+			return
+		}
+
+		w.ops += 1
+		w.bytes += 2 * int64(len(buf))
+	}
+}
+
+// stressDCP encrypts random payloads with DCP AES-128-CBC, comparing the
+// result with software encryption, and decrypts them back.
+func stressDCP(w *stressWorker, deadline time.Time) {
+	key := make([]byte, 16)
+	rand.Read(key)
+
+	imx6.DCP.Init()
+
+	if err := imx6.DCP.SetKey(AEAD_DCP_KEY_SLOT, key); err != nil {
+		w.err = err
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	buf := make([]byte, KITCHENSINK_CHUNK)
+	ref := make([]byte, KITCHENSINK_CHUNK)
+
+	for time.Now().Before(deadline) {
+		rand.Read(iv)
+		rand.Read(buf)
+
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ref, buf)
+		res := append([]byte{}, buf...)
+
+		if err := imx6.DCP.Encrypt(res, AEAD_DCP_KEY_SLOT, iv); err != nil {
+			w.err = fmt.Errorf("encrypt, %v", err)
+			return
+		}
+
+		if !bytes.Equal(res, ref) {
+			w.err = errors.New("ciphertext mismatch")
+			return
+		}
+
+		if err := imx6.DCP.Decrypt(res, AEAD_DCP_KEY_SLOT, iv); err != nil {
+			w.err = fmt.Errorf("decrypt, %v", err)
+			return
+		}
+
+		if !bytes.Equal(res, buf) {
+			w.err = errors.New("plaintext mismatch")
+			return
+		}
+
+		w.ops += 1
+		w.bytes += 2 * int64(len(buf))
+	}
+}
+
+// stressNetwork echoes random payloads over TCP between the loopback device
+// and host stacks.
+func stressNetwork(w *stressWorker, deadline time.Time) {
+	deviceAddr := tcpip.Address(net.ParseIP(NETLOOP_DEVICE_IP)).To4()
+	hostAddr := tcpip.Address(net.ParseIP(NETLOOP_HOST_IP)).To4()
+
+	device, deviceLink := configureNetworkStack(deviceAddr, 1, MTU)
+	host, hostLink := netloopHostStack(hostAddr, MTU)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go forwardFrames(ctx, deviceLink, hostLink)
+	go forwardFrames(ctx, hostLink, deviceLink)
+
+	defer device.Close()
+	defer host.Close()
+
+	fullAddr := tcpip.FullAddress{Addr: deviceAddr, Port: KITCHENSINK_PORT, NIC: 1}
+	listener, err := gonet.ListenTCP(device, fullAddr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		w.err = err
+		return
+	}
+	defer listener.Close()
+
+	go func() {
+		c, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		io.Copy(c, c)
+	}()
+
+	conn, err := gonet.DialTCP(host, fullAddr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		w.err = err
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, KITCHENSINK_CHUNK)
+	echo := make([]byte, KITCHENSINK_CHUNK)
+
+	for time.Now().Before(deadline) {
+		rand.Read(buf)
+
+		conn.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+		go conn.Write(buf)
+
+		if _, err = io.ReadFull(conn, echo); err != nil {
+			w.err = fmt.Errorf("TCP echo, %v", err)
+			return
+		}
+
+		if !bytes.Equal(buf, echo) {
+			w.err = errors.New("TCP echo data mismatch")
+			return
+		}
+
+		w.ops += 1
+		w.bytes += 2 * int64(len(buf))
+	}
+}
+
+// kitchenSink runs all stress workloads concurrently, memory card ones
+// honoring the card stress test settings (see cardstress.go).
+func kitchenSink(duration time.Duration) (res string, err error) {
+	var wg sync.WaitGroup
+	var workers []*stressWorker
+	var cardRes string
+	var cardErr error
+
+	deadline := time.Now().Add(duration)
+
+	run := func(name string, fn func(*stressWorker, time.Time)) {
+		w := &stressWorker{name: name}
+		workers = append(workers, w)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			fn(w, deadline)
+		}()
+	}
+
+	run("aes-128-gcm", stressAES)
+
+	if target.DCP() {
+		run("aes-128-cbc (dcp)", stressDCP)
+	}
+
+	run("tcp echo", stressNetwork)
+
+	if target.Native() {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			cardRes, cardErr = cardStressTest(duration)
+		}()
+	}
+
+	kitchensinkLog.Infof("%d workloads, memory cards: %v, %s", len(workers), target.Native(), duration)
+
+	wg.Wait()
+
+	var buf bytes.Buffer
+
+	for _, w := range workers {
+		fmt.Fprintf(&buf, "%s: %d ops %.2f MB/s", w.name, w.ops, float64(w.bytes)/1e6/duration.Seconds())
+
+		if w.err != nil {
+			fmt.Fprintf(&buf, " error: %v", w.err)
+			err = fmt.Errorf("%s, %v", w.name, w.err)
+		}
+
+		fmt.Fprintln(&buf)
+	}
+
+	buf.WriteString(cardRes)
+
+	if cardErr != nil {
+		if cardRes == "" {
+			fmt.Fprintf(&buf, "cards: %v\n", cardErr)
+		}
+
+		err = cardErr
+	}
+
+	return buf.String(), err
+}
+
+func kitchenSinkCommand(arg string) (res string) {
+	sec, _ := strconv.Atoi(arg)
+
+	res, err := kitchenSink(time.Duration(sec) * time.Second)
+
+	if err != nil && res == "" {
+		return err.Error()
+	}
+
+	return
+}
+
+// TestKitchenSink runs the combined stress scenario for the configured
+// duration.
+func TestKitchenSink() (err error) {
+	res, err := kitchenSink(time.Duration(conf.Int("kitchensink_time", 30)) * time.Second)
+
+	for _, l := range bytes.Split(bytes.TrimSpace([]byte(res)), []byte("\n")) {
+		if len(l) > 0 {
+			kitchensinkLog.Infof("%s", l)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,221 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	mathrand "math/rand"
+	"strconv"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/kv"
+)
+
+const (
+	KV_TEST_BLOCKS = 8192
+
+	KV_BENCH_KEYS       = 1000
+	KV_BENCH_VALUE_SIZE = 128
+	KV_BENCH_BATCH      = 100
+)
+
+var kvstoreLog = newLogger("kvstore")
+
+func kvKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%06d", i))
+}
+
+func kvValue(i int, round int) (v []byte) {
+	v = make([]byte, KV_BENCH_VALUE_SIZE)
+	mathrand.New(mathrand.NewSource(int64(i)<<16 | int64(round))).Read(v)
+	return
+}
+
+func kvLatency(d time.Duration, n int) string {
+	return fmt.Sprintf("%d µs/op", d.Microseconds()/int64(n))
+}
+
+// benchKV measures commit, put and get latency of a key-value store on a card
+// region, and verifies its content after reopening and log compaction.
+func benchKV(r *cardRegion) (res []string, err error) {
+	blockSize := r.card.BlockSize()
+
+	if r.offset%int64(blockSize) != 0 {
+		return nil, fmt.Errorf("region must be %d bytes aligned", blockSize)
+	}
+
+	// start from an empty store
+	if err = r.Erase(); err != nil {
+		return
+	}
+
+	db, err := kv.Open(r, blockSize)
+
+	if err != nil {
+		return
+	}
+
+	// generated in advance to exclude them from measurements
+	var values [2][][]byte
+
+	for round := range values {
+		for i := 0; i < KV_BENCH_KEYS; i++ {
+			values[round] = append(values[round], kvValue(i, round))
+		}
+	}
+
+	start := time.Now()
+
+	for i := 0; i < KV_BENCH_KEYS; i++ {
+		var b kv.Batch
+		b.Put(kvKey(i), values[0][i])
+
+		if err = db.Commit(&b); err != nil {
+			return
+		}
+	}
+
+	res = append(res, fmt.Sprintf("commit (1 put)     %s", kvLatency(time.Since(start), KV_BENCH_KEYS)))
+
+	start = time.Now()
+
+	for i := 0; i < KV_BENCH_KEYS; i += KV_BENCH_BATCH {
+		var b kv.Batch
+
+		for j := i; j < i+KV_BENCH_BATCH; j++ {
+			b.Put(kvKey(j), values[1][j])
+		}
+
+		if err = db.Commit(&b); err != nil {
+			return
+		}
+	}
+
+	res = append(res, fmt.Sprintf("put (batch of %d) %s", KV_BENCH_BATCH, kvLatency(time.Since(start), KV_BENCH_KEYS)))
+
+	start = time.Now()
+
+	for n := 0; n < KV_BENCH_KEYS; n++ {
+		i := mathrand.Intn(KV_BENCH_KEYS)
+		v, err := db.Get(kvKey(i))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(v, values[1][i]) {
+			return nil, fmt.Errorf("value mismatch for %s", kvKey(i))
+		}
+	}
+
+	res = append(res, fmt.Sprintf("get                %s", kvLatency(time.Since(start), KV_BENCH_KEYS)))
+
+	// overwrite until the log is compacted
+	round := 2
+
+	for start = time.Now(); db.Compactions == 0; round++ {
+		var b kv.Batch
+
+		for i := 0; i < KV_BENCH_BATCH; i++ {
+			b.Put(kvKey(i), kvValue(i, round))
+		}
+
+		if err = db.Commit(&b); err != nil {
+			return
+		}
+	}
+
+	res = append(res, fmt.Sprintf("compaction after %d batches (%s)", round-2, time.Since(start)))
+
+	if db, err = kv.Open(r, blockSize); err != nil {
+		return
+	}
+
+	if db.Len() != KV_BENCH_KEYS {
+		return nil, fmt.Errorf("reopened store has %d keys, expected %d", db.Len(), KV_BENCH_KEYS)
+	}
+
+	for i := 0; i < KV_BENCH_KEYS; i++ {
+		expected := values[1][i]
+
+		if i < KV_BENCH_BATCH {
+			expected = kvValue(i, round-1)
+		}
+
+		v, err := db.Get(kvKey(i))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(v, expected) {
+			return nil, fmt.Errorf("value mismatch for %s after reopening", kvKey(i))
+		}
+	}
+
+	used, capacity := db.Used()
+	res = append(res, fmt.Sprintf("reopened and verified %d keys (log %d/%d bytes)", db.Len(), used, capacity))
+
+	return
+}
+
+func kvCommand(arg1 string, arg2 string, arg3 string) (res string) {
+	n, _ := strconv.Atoi(arg1)
+
+	offset, err := strconv.ParseInt(arg2, 16, 64)
+
+	if err != nil {
+		return fmt.Sprintf("invalid offset: %v", err)
+	}
+
+	mib, _ := strconv.ParseInt(arg3, 10, 64)
+
+	card, err := target.Card(n)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if mib <= 0 || offset+mib*1024*1024 > int64(card.Blocks())*int64(card.BlockSize()) {
+		return "invalid size"
+	}
+
+	lines, err := benchKV(&cardRegion{card: card, offset: offset, size: mib * 1024 * 1024})
+
+	if err != nil {
+		return err.Error()
+	}
+
+	var buf bytes.Buffer
+
+	for _, l := range lines {
+		fmt.Fprintln(&buf, l)
+	}
+
+	return buf.String()
+}
+
+// TestKVStore benchmarks the key-value store on a RAM backed block device.
+func TestKVStore() (err error) {
+	card := newRAMCard(KV_TEST_BLOCKS)
+	r := &cardRegion{card: card, offset: 0, size: int64(card.Blocks() * card.BlockSize())}
+
+	res, err := benchKV(r)
+
+	if err != nil {
+		return
+	}
+
+	for _, l := range res {
+		kvstoreLog.Infof("%s", l)
+	}
+
+	return
+}
@@ -0,0 +1,193 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Modules log through leveled loggers, prefixing each line with the module
+// name and, for levels other than info, the level (e.g. `WARNING: usb: ...`).
+// Output still goes through the standard logger, so that it reaches the
+// console, the log history and interactive sessions alike.
+//
+// The `log_level` setting selects the minimum level logged by all modules,
+// `log_modules` overrides it for specific ones (e.g. `usb:debug,mtu:warn`).
+// When `log_color` is set levels are highlighted, on the debug console only,
+// with ANSI escape sequences.
+
+type logLevel int
+
+const (
+	LOG_DEBUG logLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevels = map[string]logLevel{
+	"debug": LOG_DEBUG,
+	"info":  LOG_INFO,
+	"warn":  LOG_WARN,
+	"error": LOG_ERROR,
+}
+
+// level prefixes, info lines have none
+var logTags = map[logLevel]string{
+	LOG_DEBUG: "DEBUG: ",
+	LOG_WARN:  "WARNING: ",
+	LOG_ERROR: "ERROR: ",
+}
+
+// ANSI Select Graphic Rendition sequences for each level prefix
+var logColors = map[string]string{
+	"DEBUG: ":   "\x1b[2m",
+	"WARNING: ": "\x1b[33m",
+	"ERROR: ":   "\x1b[31m",
+}
+
+const logColorReset = "\x1b[0m"
+
+// logConfig holds the configured minimum levels.
+var logConfig = struct {
+	sync.RWMutex
+
+	level   logLevel
+	modules map[string]logLevel
+}{
+	level:   LOG_INFO,
+	modules: make(map[string]logLevel),
+}
+
+// logger is a leveled logger for a module.
+type logger struct {
+	module string
+}
+
+func newLogger(module string) *logger {
+	return &logger{module: module}
+}
+
+// Level returns the minimum level logged by the module.
+func (l *logger) Level() logLevel {
+	logConfig.RLock()
+	defer logConfig.RUnlock()
+
+	if level, ok := logConfig.modules[l.module]; ok {
+		return level
+	}
+
+	return logConfig.level
+}
+
+func (l *logger) output(level logLevel, format string, v ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+
+	log.Output(3, logTags[level]+l.module+": "+fmt.Sprintf(format, v...))
+}
+
+func (l *logger) Debugf(format string, v ...interface{}) {
+	l.output(LOG_DEBUG, format, v...)
+}
+
+func (l *logger) Infof(format string, v ...interface{}) {
+	l.output(LOG_INFO, format, v...)
+}
+
+func (l *logger) Warnf(format string, v ...interface{}) {
+	l.output(LOG_WARN, format, v...)
+}
+
+func (l *logger) Errorf(format string, v ...interface{}) {
+	l.output(LOG_ERROR, format, v...)
+}
+
+// Fatalf logs an error, regardless of the configured levels, and exits.
+func (l *logger) Fatalf(format string, v ...interface{}) {
+	log.Output(2, logTags[LOG_ERROR]+l.module+": "+fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func parseLogLevel(s string) (level logLevel, err error) {
+	level, ok := logLevels[strings.ToLower(s)]
+
+	if !ok {
+		err = fmt.Errorf("invalid log level %s", s)
+	}
+
+	return
+}
+
+// configureLogLevels applies the `log_level` and `log_modules` settings.
+func configureLogLevels(def string, modules []string) (err error) {
+	level, err := parseLogLevel(def)
+
+	if err != nil {
+		return
+	}
+
+	levels := make(map[string]logLevel)
+
+	for _, m := range modules {
+		kv := strings.SplitN(m, ":", 2)
+
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid module log level %s", m)
+		}
+
+		if levels[kv[0]], err = parseLogLevel(kv[1]); err != nil {
+			return
+		}
+	}
+
+	logConfig.Lock()
+	logConfig.level = level
+	logConfig.modules = levels
+	logConfig.Unlock()
+
+	return
+}
+
+// colorWriter highlights log lines level prefixes with ANSI colors, it relies
+// on the standard logger writing each line with a single call.
+type colorWriter struct {
+	io.Writer
+}
+
+func (w colorWriter) Write(p []byte) (n int, err error) {
+	for tag, color := range logColors {
+		if !bytes.HasPrefix(p, []byte(tag)) {
+			continue
+		}
+
+		line := bytes.TrimSuffix(p, []byte("\n"))
+		buf := make([]byte, 0, len(p)+len(color)+len(logColorReset))
+
+		buf = append(buf, color...)
+		buf = append(buf, line...)
+		buf = append(buf, logColorReset...)
+		buf = append(buf, p[len(line):]...)
+
+		if _, err = w.Writer.Write(buf); err != nil {
+			return
+		}
+
+		return len(p), nil
+	}
+
+	return w.Writer.Write(p)
+}
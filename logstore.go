@@ -0,0 +1,503 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log store persists log output, across reboots, on the `log` storage
+// region which is used as a circular buffer of fixed size pages:
+//
+//	LOG_STORE_MAGIC || sequence (8) || length (4) || CRC32 (4) || data
+//
+// Pages are written in turn, wrapping around to overwrite the oldest ones,
+// and there is no metadata at a fixed location: the most recent page is
+// found, when opening the store, as the valid page with the highest sequence
+// number. Writes are therefore spread evenly across the region, the page
+// being filled is only rewritten on each flush interval (and on reboot) until
+// full. Pages torn by a power loss fail the CRC check and are skipped.
+const (
+	LOG_STORE_MAGIC  = "TLOG"
+	LOG_STORE_HEADER = 20
+	LOG_STORE_PAGE   = 4096
+	// log output retained while pages are being written, exceeding output
+	// is dropped
+	LOG_STORE_PENDING = 64 * 1024
+	// default flush interval in seconds
+	LOG_STORE_INTERVAL = 60
+
+	LOG_STORE_TEST_PAGES = 16
+)
+
+var logstoreLog = newLogger("logstore")
+
+// logStore represents a circular log on a memory card region.
+type logStore struct {
+	sync.Mutex
+
+	r     *cardRegion
+	pages int
+
+	// output not yet copied to the current page
+	pending []byte
+	dropped uint64
+	flush   chan struct{}
+
+	// serializes page writes
+	io sync.Mutex
+
+	// current page index, sequence number and data
+	page  int
+	seq   uint64
+	data  []byte
+	dirty bool
+
+	written uint64
+	errors  uint64
+	lastErr error
+}
+
+// LogStore is the persistent log, when enabled.
+var LogStore *logStore
+
+// openLogStore opens the log store on a memory card region, the first write
+// starts a new page after the most recent one.
+func openLogStore(r *cardRegion) (s *logStore, err error) {
+	s = &logStore{
+		r:     r,
+		pages: int(r.Size() / LOG_STORE_PAGE),
+		flush: make(chan struct{}, 1),
+	}
+
+	if s.pages < 2 {
+		return nil, errors.New("log store region too small")
+	}
+
+	pages, err := s.read()
+
+	if err != nil {
+		return
+	}
+
+	s.seq = 1
+
+	if n := len(pages); n > 0 {
+		s.page = (pages[n-1].index + 1) % s.pages
+		s.seq = pages[n-1].seq + 1
+	}
+
+	return
+}
+
+type logPage struct {
+	index int
+	seq   uint64
+	data  []byte
+}
+
+// logPageCRC returns the checksum of the page sequence number, length and
+// data.
+func logPageCRC(page []byte, data []byte) uint32 {
+	crc := crc32.ChecksumIEEE(page[4:16])
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+// read returns all valid pages sorted by sequence number.
+func (s *logStore) read() (pages []logPage, err error) {
+	buf := make([]byte, s.pages*LOG_STORE_PAGE)
+
+	if _, err = s.r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return
+	}
+
+	err = nil
+
+	for i := 0; i < s.pages; i++ {
+		p := buf[i*LOG_STORE_PAGE : (i+1)*LOG_STORE_PAGE]
+
+		if !bytes.HasPrefix(p, []byte(LOG_STORE_MAGIC)) {
+			continue
+		}
+
+		seq := binary.LittleEndian.Uint64(p[4:])
+		size := int(binary.LittleEndian.Uint32(p[12:]))
+
+		if size > LOG_STORE_PAGE-LOG_STORE_HEADER {
+			continue
+		}
+
+		data := p[LOG_STORE_HEADER : LOG_STORE_HEADER+size]
+
+		if logPageCRC(p, data) != binary.LittleEndian.Uint32(p[16:]) {
+			continue
+		}
+
+		pages = append(pages, logPage{index: i, seq: seq, data: data})
+	}
+
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].seq < pages[j].seq
+	})
+
+	return
+}
+
+// Write implements io.Writer, output is only buffered as card accesses
+// might themselves be logged.
+func (s *logStore) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	n := len(p)
+
+	if free := LOG_STORE_PENDING - len(s.pending); n > free {
+		s.dropped += uint64(n - free)
+		n = free
+	}
+
+	s.pending = append(s.pending, p[:n]...)
+
+	if len(s.pending) >= LOG_STORE_PAGE-LOG_STORE_HEADER {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+func (s *logStore) writePage() (err error) {
+	page := make([]byte, LOG_STORE_PAGE)
+
+	copy(page, LOG_STORE_MAGIC)
+	binary.LittleEndian.PutUint64(page[4:], s.seq)
+	binary.LittleEndian.PutUint32(page[12:], uint32(len(s.data)))
+	copy(page[LOG_STORE_HEADER:], s.data)
+	binary.LittleEndian.PutUint32(page[16:], logPageCRC(page, s.data))
+
+	_, err = s.r.WriteAt(page, int64(s.page*LOG_STORE_PAGE))
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.written += 1
+
+	if err != nil {
+		s.errors += 1
+		s.lastErr = err
+	}
+
+	return
+}
+
+// Sync writes pending output to full pages, the partially filled page is also
+// written when partial is true.
+func (s *logStore) Sync(partial bool) (err error) {
+	s.io.Lock()
+	defer s.io.Unlock()
+
+	s.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.Unlock()
+
+	for len(pending) > 0 {
+		n := LOG_STORE_PAGE - LOG_STORE_HEADER - len(s.data)
+
+		if n > len(pending) {
+			n = len(pending)
+		}
+
+		s.data = append(s.data, pending[:n]...)
+		s.dirty = true
+		pending = pending[n:]
+
+		if len(s.data) < LOG_STORE_PAGE-LOG_STORE_HEADER {
+			break
+		}
+
+		// full pages are written once and never rewritten
+		if e := s.writePage(); e != nil {
+			err = e
+		}
+
+		s.page = (s.page + 1) % s.pages
+		s.seq += 1
+		s.data = s.data[:0]
+		s.dirty = false
+	}
+
+	if partial && s.dirty {
+		if err = s.writePage(); err == nil {
+			s.dirty = false
+		}
+	}
+
+	return
+}
+
+// start flushes full pages as they fill, and the partially filled one at
+// each interval.
+func (s *logStore) start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-s.flush:
+				s.Sync(false)
+			case <-ticker.C:
+				s.Sync(true)
+			}
+		}
+	}()
+}
+
+// Dump writes the stored log, oldest output first, flushing pending output
+// beforehand.
+func (s *logStore) Dump(w io.Writer) (err error) {
+	if err = s.Sync(true); err != nil {
+		return
+	}
+
+	s.io.Lock()
+	defer s.io.Unlock()
+
+	pages, err := s.read()
+
+	if err != nil {
+		return
+	}
+
+	for _, p := range pages {
+		if _, err = w.Write(p.data); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Clear erases the stored log.
+func (s *logStore) Clear() (err error) {
+	s.io.Lock()
+	defer s.io.Unlock()
+
+	if err = s.r.Erase(); err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = nil
+	s.page = 0
+	s.seq = 1
+	s.data = s.data[:0]
+	s.dirty = false
+
+	return
+}
+
+func (s *logStore) String() string {
+	s.io.Lock()
+	page, seq, size := s.page, s.seq, len(s.data)
+	s.io.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	res := fmt.Sprintf("%d pages of %d bytes, current: %d (seq %d, %d bytes), pending: %d bytes, dropped: %d bytes, written: %d pages, errors: %d",
+		s.pages, LOG_STORE_PAGE, page, seq, size, len(s.pending), s.dropped, s.written, s.errors)
+
+	if s.lastErr != nil {
+		res += fmt.Sprintf(" (%v)", s.lastErr)
+	}
+
+	return res
+}
+
+// startLogStore opens the log store on the `log` storage region.
+func startLogStore() (s *logStore, err error) {
+	r, err := openStorage("log")
+
+	if err != nil {
+		return
+	}
+
+	if s, err = openLogStore(r); err != nil {
+		return
+	}
+
+	s.start(time.Duration(conf.Int("log_store_interval", LOG_STORE_INTERVAL)) * time.Second)
+
+	return
+}
+
+func logStoreCommand(op string) (res string) {
+	if LogStore == nil {
+		return "log store not enabled"
+	}
+
+	switch op {
+	case "dump":
+		buf := new(bytes.Buffer)
+
+		if err := LogStore.Dump(buf); err != nil {
+			return err.Error()
+		}
+
+		return strings.TrimSuffix(buf.String(), "\n")
+	case "clear":
+		if err := LogStore.Clear(); err != nil {
+			return err.Error()
+		}
+
+		return "log store cleared"
+	default:
+		return LogStore.String()
+	}
+}
+
+func logStoreHandler(w http.ResponseWriter, r *http.Request) {
+	if LogStore == nil {
+		http.Error(w, "log store not enabled", http.StatusNotFound)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := LogStore.Dump(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// TestLogStore fills a log store on a RAM backed block device beyond its
+// size, verifying that, once reopened, the most recent output is retained in
+// order and that torn pages are skipped.
+func TestLogStore() (err error) {
+	card := newRAMCard(LOG_STORE_TEST_PAGES * LOG_STORE_PAGE / 512)
+	r := &cardRegion{card: card, size: LOG_STORE_TEST_PAGES * LOG_STORE_PAGE}
+
+	s, err := openLogStore(r)
+
+	if err != nil {
+		return
+	}
+
+	lines := 2 * LOG_STORE_TEST_PAGES * LOG_STORE_PAGE / 32
+
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(s, "logstore: test line %10d\n", i)
+
+		if i%100 == 0 {
+			if err = s.Sync(false); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = s.Sync(true); err != nil {
+		return
+	}
+
+	verify := func(s *logStore) (first int, last int, err error) {
+		buf := new(bytes.Buffer)
+
+		if err = s.Dump(buf); err != nil {
+			return
+		}
+
+		first = -1
+
+		// the oldest page may start with a partial line
+		for _, l := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			var n int
+
+			if _, e := fmt.Sscanf(l, "logstore: test line %d", &n); e != nil {
+				continue
+			}
+
+			if first >= 0 && n != last+1 {
+				return 0, 0, fmt.Errorf("line %d follows line %d", n, last)
+			}
+
+			if first < 0 {
+				first = n
+			}
+
+			last = n
+		}
+
+		return
+	}
+
+	if s, err = openLogStore(r); err != nil {
+		return
+	}
+
+	first, last, err := verify(s)
+
+	switch {
+	case err != nil:
+		return
+	case last != lines-1:
+		return fmt.Errorf("last line %d, expected %d", last, lines-1)
+	case first == 0:
+		return errors.New("oldest output not overwritten")
+	}
+
+	logstoreLog.Infof("%d pages, retained lines %d-%d after reopen", s.pages, first, last)
+
+	// tear the oldest page
+	pages, err := s.read()
+
+	if err != nil {
+		return
+	}
+
+	if _, err = r.WriteAt([]byte{0xff}, int64(pages[0].index*LOG_STORE_PAGE+LOG_STORE_HEADER)); err != nil {
+		return
+	}
+
+	if s, err = openLogStore(r); err != nil {
+		return
+	}
+
+	torn, last, err := verify(s)
+
+	switch {
+	case err != nil:
+		return
+	case last != lines-1:
+		return fmt.Errorf("last line %d after torn page, expected %d", last, lines-1)
+	case torn <= first:
+		return errors.New("torn page not skipped")
+	}
+
+	logstoreLog.Warnf("torn page skipped, retained lines %d-%d", torn, last)
+
+	return
+}
@@ -0,0 +1,150 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+var measureLog = newLogger("measure")
+
+// defined in measure_arm.s
+func text_range() (start uint32, end uint32)
+
+// measurement represents a measurement log event.
+type measurement struct {
+	Component string `json:"component"`
+	Digest    string `json:"sha256"`
+}
+
+// pcr represents a software Platform Configuration Register, which can only
+// be extended as:
+//
+//	PCR = SHA-256(PCR || SHA-256(component))
+//
+// along with its measurement log, allowing a verifier to replay the events
+// and compare the result with the PCR value.
+type pcr struct {
+	sync.Mutex
+
+	value [sha256.Size]byte
+	log   []measurement
+}
+
+// PCR holds the boot measurements, it is reset at each boot.
+var PCR = &pcr{}
+
+// Extend measures a component into the PCR.
+func (p *pcr) Extend(component string, data []byte) {
+	digest := sha256.Sum256(data)
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.value = sha256.Sum256(append(p.value[:], digest[:]...))
+	p.log = append(p.log, measurement{component, hex.EncodeToString(digest[:])})
+
+	measureLog.Infof("%s %x", component, digest)
+}
+
+// Value returns the current PCR value and measurement log.
+func (p *pcr) Value() (value []byte, events []measurement) {
+	p.Lock()
+	defer p.Unlock()
+
+	value = append([]byte{}, p.value[:]...)
+	events = append([]measurement{}, p.log...)
+
+	return
+}
+
+// firmwareText returns the running firmware executable code.
+func firmwareText() []byte {
+	start, end := text_range()
+	return (*[1 << 30]byte)(unsafe.Pointer(uintptr(start)))[: end-start : end-start]
+}
+
+// configText returns the configuration settings in canonical form.
+func configText() []byte {
+	var buf bytes.Buffer
+	var keys []string
+
+	for k := range conf {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", k, conf[k])
+	}
+
+	return buf.Bytes()
+}
+
+// measureBoot extends the PCR with the firmware code, the configuration and
+// the Go modules linked in the firmware.
+func measureBoot() {
+	PCR.Extend("firmware", firmwareText())
+	PCR.Extend("config", configText())
+
+	info, ok := debug.ReadBuildInfo()
+
+	if !ok {
+		return
+	}
+
+	PCR.Extend("module:"+info.Main.Path, []byte(info.Main.Path+"@"+info.Main.Version+" "+info.Main.Sum))
+
+	for _, m := range info.Deps {
+		if m.Replace != nil {
+			m = m.Replace
+		}
+
+		PCR.Extend("module:"+m.Path, []byte(m.Path+"@"+m.Version+" "+m.Sum))
+	}
+}
+
+func pcrCommand() string {
+	var buf bytes.Buffer
+
+	value, events := PCR.Value()
+
+	for i, e := range events {
+		fmt.Fprintf(&buf, "%3d %s %s\n", i, e.Digest, e.Component)
+	}
+
+	fmt.Fprintf(&buf, "PCR: %x", value)
+
+	return buf.String()
+}
+
+// measurementsHandler serves the PCR value and measurement log.
+func measurementsHandler(w http.ResponseWriter, r *http.Request) {
+	value, events := PCR.Value()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(struct {
+		PCR    string        `json:"pcr"`
+		Events []measurement `json:"events"`
+	}{
+		PCR:    hex.EncodeToString(value),
+		Events: events,
+	})
+}
@@ -0,0 +1,17 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func text_range() (start uint32, end uint32)
+TEXT ·text_range(SB),$0-8
+	MOVW	$runtime·text(SB), R0
+	MOVW	R0, start+0(FP)
+	MOVW	$runtime·etext(SB), R0
+	MOVW	R0, end+4(FP)
+	RET
@@ -9,10 +9,11 @@
 package main
 
 import (
-	"log"
 	"runtime"
 )
 
+var allocLog = newLogger("alloc")
+
 func testAlloc(runs int, chunks int, chunkSize int) {
 	var memstats runtime.MemStats
 
@@ -29,7 +30,7 @@ func testAlloc(runs int, chunks int, chunkSize int) {
 	//debug.SetGCPercent(gcpercent)
 
 	for run := 1; run <= runs; run++ {
-		log.Printf("allocating %d * %d MiB chunks (%d/%d)", chunks, chunkSize/(1024*1024), run, runs)
+		allocLog.Infof("allocating %d * %d MiB chunks (%d/%d)", chunks, chunkSize/(1024*1024), run, runs)
 
 		buf := make([][]byte, chunks)
 
@@ -49,6 +50,6 @@ func testAlloc(runs int, chunks int, chunkSize int) {
 
 	runtime.ReadMemStats(&memstats)
 	totalAllocated := uint64(runs) * uint64(chunks) * uint64(chunkSize)
-	log.Printf("%d MiB allocated (Mallocs: %d Frees: %d HeapSys: %d NumGC:%d)",
+	allocLog.Infof("%d MiB allocated (Mallocs: %d Frees: %d HeapSys: %d NumGC:%d)",
 		totalAllocated/(1024*1024), memstats.Mallocs, memstats.Frees, memstats.HeapSys, memstats.NumGC)
 }
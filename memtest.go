@@ -0,0 +1,224 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	// default window size, allocated from the Go heap when no unused DDR
+	// window is configured
+	MEMTEST_SIZE = 16 * 1024 * 1024
+	// maximum number of reported bit errors
+	MEMTEST_MAX_ERRORS = 16
+)
+
+var memtestLog = newLogger("memtest")
+
+type memError struct {
+	addr     uint32
+	expected uint32
+	actual   uint32
+}
+
+// memTest runs memory test patterns over a window of 32-bit words.
+type memTest struct {
+	mem  []uint32
+	base uint32
+
+	errors []memError
+	count  int
+}
+
+func (t *memTest) check(i int, expected uint32) bool {
+	actual := t.mem[i]
+
+	if actual == expected {
+		return true
+	}
+
+	t.count += 1
+
+	if len(t.errors) < MEMTEST_MAX_ERRORS {
+		t.errors = append(t.errors, memError{t.base + uint32(i*4), expected, actual})
+	}
+
+	return false
+}
+
+// walking tests each data line, on the first word of the window, by walking
+// a single set bit (ones) and a single cleared bit (zeros).
+func (t *memTest) walking() {
+	for bit := uint(0); bit < 32; bit++ {
+		t.mem[0] = 1 << bit
+		t.check(0, 1<<bit)
+
+		t.mem[0] = ^uint32(1 << bit)
+		t.check(0, ^uint32(1<<bit))
+	}
+}
+
+// address tests each address line by writing a unique value at every power
+// of 2 word offset and verifying that no other location is affected.
+func (t *memTest) address() {
+	const pattern = 0xaaaaaaaa
+	const antipattern = 0x55555555
+
+	for off := 1; off < len(t.mem); off <<= 1 {
+		t.mem[off] = pattern
+	}
+
+	t.mem[0] = antipattern
+
+	for off := 1; off < len(t.mem); off <<= 1 {
+		t.check(off, pattern)
+	}
+
+	for test := 1; test < len(t.mem); test <<= 1 {
+		t.mem[test] = antipattern
+
+		for off := 1; off < len(t.mem); off <<= 1 {
+			if off != test {
+				t.check(off, pattern)
+			}
+		}
+
+		t.mem[test] = pattern
+	}
+}
+
+// marchC runs the March C- algorithm:
+//
+//	⇕(w0); ⇑(r0,w1); ⇑(r1,w0); ⇓(r0,w1); ⇓(r1,w0); ⇕(r0)
+func (t *memTest) marchC() {
+	const zero = 0
+	const one = 0xffffffff
+
+	n := len(t.mem)
+
+	for i := 0; i < n; i++ {
+		t.mem[i] = zero
+	}
+
+	for i := 0; i < n; i++ {
+		t.check(i, zero)
+		t.mem[i] = one
+	}
+
+	for i := 0; i < n; i++ {
+		t.check(i, one)
+		t.mem[i] = zero
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		t.check(i, zero)
+		t.mem[i] = one
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		t.check(i, one)
+		t.mem[i] = zero
+	}
+
+	for i := 0; i < n; i++ {
+		t.check(i, zero)
+	}
+}
+
+func (t *memTest) report() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%d bit errors", t.count)
+
+	for _, e := range t.errors {
+		fmt.Fprintf(&buf, "\n  %#08x: expected %#08x, read %#08x (xor %#08x)",
+			e.addr, e.expected, e.actual, e.expected^e.actual)
+	}
+
+	if t.count > len(t.errors) {
+		fmt.Fprintf(&buf, "\n  ...")
+	}
+
+	return buf.String()
+}
+
+// memtest runs walking ones/zeros, address line and March C- patterns over
+// the argument memory window, which must not be in use. A zero start address
+// selects a window allocated from the Go heap.
+func memtest(start uint32, size int) (t *memTest) {
+	t = &memTest{}
+
+	if start == 0 {
+		t.mem = make([]uint32, size/4)
+		t.base = uint32(uintptr(unsafe.Pointer(&t.mem[0])))
+	} else {
+		t.mem = (*[1 << 28]uint32)(unsafe.Pointer(uintptr(start)))[: size/4 : size/4]
+		t.base = start
+	}
+
+	t.walking()
+	t.address()
+	t.marchC()
+
+	return
+}
+
+// TestMemory runs memory test patterns over the DDR window selected with the
+// `memtest_start` and `memtest_size` configuration settings.
+func TestMemory() (err error) {
+	start := uint32(conf.Int("memtest_start", 0))
+	size := conf.Int("memtest_size", MEMTEST_SIZE)
+
+	if size < 4 || size > 1<<30 {
+		return fmt.Errorf("invalid memtest size %d", size)
+	}
+
+	begin := time.Now()
+	t := memtest(start, size)
+
+	memtestLog.Infof("%#08x-%#08x tested in %s", t.base, t.base+uint32(size)-1, time.Since(begin))
+
+	for _, line := range strings.Split(t.report(), "\n") {
+		memtestLog.Infof("%s", line)
+	}
+
+	if t.count != 0 {
+		return fmt.Errorf("%d bit errors", t.count)
+	}
+
+	return
+}
+
+func memtestCommand(arg1 string, arg2 string) (res string) {
+	start, err := strconv.ParseUint(arg1, 16, 32)
+
+	if err != nil {
+		return fmt.Sprintf("invalid address: %v", err)
+	}
+
+	size, err := strconv.ParseUint(arg2, 10, 32)
+
+	if err != nil {
+		return fmt.Sprintf("invalid size: %v", err)
+	}
+
+	if size < 4 || size > 1<<30 {
+		return "invalid size"
+	}
+
+	t := memtest(uint32(start), int(size))
+
+	return fmt.Sprintf("%#08x-%#08x: %s", t.base, t.base+uint32(size)-1, t.report())
+}
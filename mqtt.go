@@ -0,0 +1,331 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/f-secure-foundry/tamago-example/internal/mqtt"
+)
+
+// The MQTT agent demonstrates the IoT device pattern, it connects to the
+// `mqtt_broker` over TLS, authenticated with the SHA-256 fingerprint of its
+// certificate (`mqtt_pin`), and periodically publishes telemetry under the
+// `mqtt_topic` prefix:
+//
+//	<prefix>/status       online/offline (retained, offline is the last will)
+//	<prefix>/temperature  SoC die temperature (°C)
+//	<prefix>/heap         Go heap statistics (JSON)
+//	<prefix>/tests        boot test results summary (JSON)
+//
+// When `mqtt_commands` is set, messages received on `<prefix>/commands` are
+// executed as console commands, their output being published on
+// `<prefix>/commands/output`.
+const (
+	MQTT_KEEPALIVE   = 60 * time.Second
+	MQTT_TIMEOUT     = 10 * time.Second
+	MQTT_RETRY       = 5 * time.Second
+	MQTT_MAX_RETRY   = 5 * time.Minute
+	MQTT_MAX_COMMAND = 256
+)
+
+var mqttLog = newLogger("mqtt")
+
+var mqttAgent struct {
+	sync.Mutex
+
+	connected bool
+	published int
+	commands  int
+	failures  int
+	status    string
+}
+
+// mqttTopic returns the topic prefix, defaulting to the unique ID.
+func mqttTopic() string {
+	return conf.String("mqtt_topic", fmt.Sprintf("tamago/%x", target.UniqueID()))
+}
+
+// mqttBroker returns the configured broker network address.
+func mqttBroker() (addr tcpip.FullAddress, err error) {
+	broker := conf.String("mqtt_broker", "")
+	host, p, err := net.SplitHostPort(broker)
+
+	if err != nil {
+		return
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	ip := net.ParseIP(host)
+
+	if err != nil || ip == nil {
+		return addr, fmt.Errorf("invalid broker %s", broker)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return tcpip.FullAddress{Addr: tcpip.Address(ip), Port: uint16(port)}, nil
+}
+
+func mqttSetStatus(connected bool, status string) {
+	mqttAgent.Lock()
+	defer mqttAgent.Unlock()
+
+	mqttAgent.connected = connected
+	mqttAgent.status = fmt.Sprintf("%s at %s", status, Now().Format(time.RFC3339))
+
+	if !connected {
+		mqttAgent.failures += 1
+	}
+}
+
+// mqttTelemetry returns the periodic telemetry messages.
+func mqttTelemetry(prefix string) (msgs []*mqtt.Message) {
+	var m runtime.MemStats
+
+	if t, err := temperature(); err == nil {
+		msgs = append(msgs, &mqtt.Message{
+			Topic:   prefix + "/temperature",
+			Payload: []byte(fmt.Sprintf("%.1f", t)),
+		})
+	}
+
+	runtime.ReadMemStats(&m)
+
+	heap, _ := json.Marshal(map[string]uint64{
+		"alloc":   m.HeapAlloc,
+		"sys":     m.HeapSys,
+		"objects": m.HeapObjects,
+		"gc":      uint64(m.NumGC),
+	})
+
+	msgs = append(msgs, &mqtt.Message{Topic: prefix + "/heap", Payload: heap})
+
+	if r := lastReport; r != nil {
+		tests, _ := json.Marshal(map[string]interface{}{
+			"passed":   r.Passed,
+			"failed":   r.Failed,
+			"duration": r.Duration,
+		})
+
+		msgs = append(msgs, &mqtt.Message{Topic: prefix + "/tests", Payload: tests, Retain: true})
+	}
+
+	return
+}
+
+// mqttSession connects to the broker and runs the agent until the
+// connection fails.
+func mqttSession(s *stack.Stack, addr tcpip.FullAddress, verify func([][]byte, [][]*x509.Certificate) error, interval time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MQTT_TIMEOUT)
+	defer cancel()
+
+	conn, err := gonet.DialContextTCP(ctx, s, addr, networkProtocol(addr.Addr))
+
+	if err != nil {
+		return
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+		MinVersion:            tls.VersionTLS12,
+	})
+
+	defer tlsConn.Close()
+
+	tlsConn.SetDeadline(time.Now().Add(MQTT_TIMEOUT))
+
+	prefix := mqttTopic()
+
+	client, err := mqtt.Connect(tlsConn, &mqtt.Options{
+		ClientID:     fmt.Sprintf("tamago-%x", target.UniqueID()),
+		Username:     conf.String("mqtt_user", ""),
+		Password:     conf.String("mqtt_password", ""),
+		KeepAlive:    MQTT_KEEPALIVE,
+		CleanSession: true,
+		WillTopic:    prefix + "/status",
+		WillMessage:  []byte("offline"),
+		WillRetain:   true,
+	})
+
+	if err != nil {
+		return
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+
+	if err = client.Publish(prefix+"/status", []byte("online"), true); err != nil {
+		return
+	}
+
+	commands := conf.Bool("mqtt_commands", false)
+
+	if commands {
+		if err = client.Subscribe(prefix + "/commands"); err != nil {
+			return
+		}
+	}
+
+	mqttSetStatus(true, "connected to "+addr.Addr.String())
+	mqttLog.Infof("connected to %s:%d, publishing on %s/#", addr.Addr, addr.Port, prefix)
+
+	done := make(chan error, 1)
+
+	go func() {
+		for {
+			// the broker answers pings within the keep alive period
+			tlsConn.SetReadDeadline(time.Now().Add(MQTT_KEEPALIVE * 3 / 2))
+
+			m, err := client.Receive()
+
+			if err != nil {
+				done <- err
+				return
+			}
+
+			if !commands || m.Topic != prefix+"/commands" || m.Retain {
+				continue
+			}
+
+			cmd := string(m.Payload)
+
+			if len(cmd) > MQTT_MAX_COMMAND {
+				continue
+			}
+
+			mqttLog.Infof("executing command %q", cmd)
+
+			var res []byte
+
+			role, err := parseRole(conf.String("mqtt_role", "operator"))
+
+			if err == nil {
+				res, err = rpcConsole(cmd, role)
+			}
+
+			if err != nil {
+				res = []byte(err.Error())
+			}
+
+			mqttAgent.Lock()
+			mqttAgent.commands += 1
+			mqttAgent.Unlock()
+
+			if err = client.Publish(prefix+"/commands/output", res, false); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	publish := time.NewTicker(interval)
+	defer publish.Stop()
+
+	ping := time.NewTicker(MQTT_KEEPALIVE / 2)
+	defer ping.Stop()
+
+	for {
+		for _, m := range mqttTelemetry(prefix) {
+			if err = client.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+				return
+			}
+
+			mqttAgent.Lock()
+			mqttAgent.published += 1
+			mqttAgent.Unlock()
+		}
+
+	wait:
+		for {
+			select {
+			case err = <-done:
+				return
+			case <-ping.C:
+				if err = client.Ping(); err != nil {
+					return
+				}
+			case <-publish.C:
+				break wait
+			}
+		}
+	}
+}
+
+// startMQTT runs the MQTT agent, reconnecting with exponential backoff.
+func startMQTT(s *stack.Stack) {
+	addr, err := mqttBroker()
+
+	if err != nil {
+		mqttLog.Errorf("disabled, %v", err)
+		return
+	}
+
+	// the certificate is verified against the pinned fingerprint
+	verify, err := verifyPin(conf.String("mqtt_pin", ""))
+
+	if err != nil {
+		mqttLog.Errorf("disabled, invalid mqtt_pin")
+		return
+	}
+
+	interval := time.Duration(conf.Int("mqtt_interval", 60)) * time.Second
+
+	if interval <= 0 {
+		mqttLog.Errorf("disabled, invalid mqtt_interval")
+		return
+	}
+
+	retry := MQTT_RETRY
+
+	for {
+		start := time.Now()
+		err := mqttSession(s, addr, verify, interval)
+
+		mqttSetStatus(false, fmt.Sprintf("disconnected, %v", err))
+		mqttLog.Warnf("session error, %v", err)
+
+		if time.Since(start) > MQTT_MAX_RETRY {
+			retry = MQTT_RETRY
+		}
+
+		time.Sleep(retry)
+
+		if retry *= 2; retry > MQTT_MAX_RETRY {
+			retry = MQTT_MAX_RETRY
+		}
+	}
+}
+
+func mqttCommand() string {
+	if conf.String("mqtt_broker", "") == "" {
+		return "disabled (mqtt_broker not set)"
+	}
+
+	mqttAgent.Lock()
+	defer mqttAgent.Unlock()
+
+	return fmt.Sprintf("broker: %s, topic: %s/#, connected: %v, published: %d, commands: %d, failures: %d, last: %s",
+		conf.String("mqtt_broker", ""), mqttTopic(), mqttAgent.connected, mqttAgent.published, mqttAgent.commands, mqttAgent.failures, mqttAgent.status)
+}
@@ -0,0 +1,299 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// The Ethernet over USB MTU can be raised, on local links used for bulk
+// transfers, to reduce per-packet overhead. The maximum segment size is
+// advertised in the Ethernet Networking Functional Descriptor, hosts then
+// allow a matching MTU (e.g. `ip link set usb0 mtu 9000`).
+const (
+	// IPv6 minimum MTU
+	USB_MTU_MIN = 1280
+	// ECM frames must fit a single transfer descriptor (see usbdma.go)
+	ECM_MAX_SEGMENT = 16384
+	// NCM datagrams are limited by the Linux cdc_ncm driver
+	NCM_MAX_SEGMENT = 8192
+
+	// Ethernet Networking Functional Descriptor
+	CDC_ETHERNET_NETWORKING     = 0x0f
+	CDC_ETHERNET_SEGMENT_OFFSET = 8
+
+	// IPv4 and UDP headers
+	UDP_OVERHEAD = header.IPv4MinimumSize + header.UDPMinimumSize
+	// maximum UDP payload
+	UDP_MAX_PAYLOAD = 0xffff - UDP_OVERHEAD
+)
+
+var mtuLog = newLogger("mtu")
+
+// usbMTU returns the configured Ethernet over USB MTU, within the ECM or NCM
+// limits.
+func usbMTU(ncm bool) uint32 {
+	max := ECM_MAX_SEGMENT - header.EthernetMinimumSize
+
+	if ncm {
+		max = NCM_MAX_SEGMENT - header.EthernetMinimumSize
+	}
+
+	mtu := conf.Int("usb_mtu", MTU)
+
+	if mtu < USB_MTU_MIN || mtu > max {
+		mtuLog.Warnf("invalid usb_mtu %d (%d-%d), using %d", mtu, USB_MTU_MIN, max, MTU)
+		return MTU
+	}
+
+	return uint32(mtu)
+}
+
+// setMaxSegmentSize updates the maximum segment size, for the given MTU, in
+// the Ethernet Networking Functional Descriptor of a communication interface,
+// as the ethernet package always advertises the default one.
+func setMaxSegmentSize(iface *usb.InterfaceDescriptor, mtu uint32) {
+	for _, desc := range iface.ClassDescriptors {
+		if len(desc) < CDC_ETHERNET_SEGMENT_OFFSET+2 || desc[2] != CDC_ETHERNET_NETWORKING {
+			continue
+		}
+
+		binary.LittleEndian.PutUint16(desc[CDC_ETHERNET_SEGMENT_OFFSET:], uint16(mtu+header.EthernetMinimumSize))
+	}
+}
+
+// mtuLink forwards Ethernet frames, as forwardFrames does, dropping those
+// exceeding the destination MTU as a host interface would, while recording
+// IPv4 frame statistics.
+type mtuLink struct {
+	sync.Mutex
+
+	frames  int
+	max     int
+	dropped int
+}
+
+func (l *mtuLink) forward(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint) {
+	addr := src.LinkAddress()
+
+	for {
+		frame, valid := ethernetTx(ctx, src, addr)
+
+		if !valid {
+			return
+		}
+
+		l.Lock()
+
+		if header.Ethernet(frame).Type() == header.IPv4ProtocolNumber {
+			l.frames += 1
+
+			if len(frame) > l.max {
+				l.max = len(frame)
+			}
+		}
+
+		drop := len(frame) > int(dst.MTU())+header.EthernetMinimumSize
+
+		if drop {
+			l.dropped += 1
+		}
+
+		l.Unlock()
+
+		if !drop {
+			ethernetRx(dst, frame)
+		}
+	}
+}
+
+// reset returns, and clears, the recorded statistics.
+func (l *mtuLink) reset() (frames int, max int, dropped int) {
+	l.Lock()
+	defer l.Unlock()
+
+	frames, max, dropped = l.frames, l.max, l.dropped
+	l.frames, l.max, l.dropped = 0, 0, 0
+
+	return
+}
+
+// testUDPFragments echoes UDP datagrams of increasing size, verifying that
+// those fitting the MTU are carried in a single frame and larger ones are
+// fragmented, without exceeding the MTU, and reassembled intact.
+func testUDPFragments(device *stack.Stack, host *stack.Stack, addr tcpip.Address, link *mtuLink, mtu int) (err error) {
+	server, err := gonet.DialUDP(device, &tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, UDP_MAX_PAYLOAD)
+
+		for {
+			n, peer, err := server.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			server.WriteTo(buf[:n], peer)
+		}
+	}()
+
+	client, err := gonet.DialUDP(host, nil, &tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+	res := make([]byte, UDP_MAX_PAYLOAD)
+
+	// the first exchange resolves link addresses
+	for _, size := range []int{64, mtu - UDP_OVERHEAD, mtu - UDP_OVERHEAD + 1, 3 * mtu, UDP_MAX_PAYLOAD} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+
+		link.reset()
+
+		if _, err = client.Write(msg); err != nil {
+			return
+		}
+
+		n, err := client.Read(res)
+
+		if err != nil {
+			return fmt.Errorf("UDP echo (%d bytes), %v", size, err)
+		}
+
+		if !bytes.Equal(msg, res[:n]) {
+			return fmt.Errorf("UDP echo (%d bytes) data mismatch", size)
+		}
+
+		frames, max, dropped := link.reset()
+
+		switch {
+		case dropped > 0:
+			return fmt.Errorf("UDP echo (%d bytes), %d frames exceeding MTU", size, dropped)
+		case size <= mtu-UDP_OVERHEAD && frames != 2:
+			return fmt.Errorf("UDP echo (%d bytes) fragmented in %d frames", size, frames)
+		case size > mtu-UDP_OVERHEAD && frames <= 2:
+			return fmt.Errorf("UDP echo (%d bytes) not fragmented", size)
+		}
+
+		mtuLog.Infof("UDP echo %5d bytes in %3d frames (max %d bytes)", size, frames, max)
+	}
+
+	return
+}
+
+// TestMTU verifies, between loopback test stacks with the default, maximum
+// NCM and ECM and configured MTUs, UDP fragmentation and reassembly and that
+// TCP segments fill, without exceeding, the MTU. A host limited to the default
+// MTU is also tested against a device with the maximum one.
+func TestMTU() (err error) {
+	deviceAddr := tcpip.Address(net.ParseIP(NETLOOP_DEVICE_IP)).To4()
+	hostAddr := tcpip.Address(net.ParseIP(NETLOOP_HOST_IP)).To4()
+
+	ecm := uint32(ECM_MAX_SEGMENT - header.EthernetMinimumSize)
+	ncm := uint32(NCM_MAX_SEGMENT - header.EthernetMinimumSize)
+
+	cases := [][2]uint32{
+		{MTU, MTU},
+		{ncm, ncm},
+		{ecm, ecm},
+		{ecm, MTU},
+	}
+
+	if mtu := uint32(conf.Int("usb_mtu", MTU)); mtu != MTU && mtu != ncm && mtu != ecm {
+		cases = append(cases, [2]uint32{mtu, mtu})
+	}
+
+	for _, c := range cases {
+		if err = testMTU(deviceAddr, hostAddr, c[0], c[1]); err != nil {
+			return fmt.Errorf("device MTU %d, host MTU %d, %v", c[0], c[1], err)
+		}
+	}
+
+	return
+}
+
+func testMTU(deviceAddr tcpip.Address, hostAddr tcpip.Address, deviceMTU uint32, hostMTU uint32) (err error) {
+	link := &mtuLink{}
+
+	device, deviceLink := configureNetworkStack(deviceAddr, 1, deviceMTU)
+	host, hostLink := netloopHostStack(hostAddr, hostMTU)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go link.forward(ctx, deviceLink, hostLink)
+	go link.forward(ctx, hostLink, deviceLink)
+
+	defer device.Close()
+	defer host.Close()
+
+	mtuLog.Infof("device %d host %d", deviceMTU, hostMTU)
+
+	mtu := int(deviceMTU)
+
+	if hostMTU < deviceMTU {
+		mtu = int(hostMTU)
+	}
+
+	// without path MTU discovery UDP requires matching MTUs
+	if deviceMTU == hostMTU {
+		if err = testUDPFragments(device, host, deviceAddr, link, mtu); err != nil {
+			return
+		}
+	}
+
+	link.reset()
+
+	if err = testTCPEcho(device, host, deviceAddr); err != nil {
+		return
+	}
+
+	_, max, dropped := link.reset()
+
+	switch {
+	case dropped > 0:
+		return fmt.Errorf("TCP echo, %d frames exceeding MTU", dropped)
+	case max > mtu+header.EthernetMinimumSize:
+		return fmt.Errorf("TCP echo, %d bytes frame exceeds MTU", max)
+	case mtu > MTU && max <= MTU+header.EthernetMinimumSize:
+		return errors.New("TCP echo, segments do not exceed the default MTU")
+	}
+
+	mtuLog.Infof("TCP echo, max frame %d bytes", max)
+
+	return
+}
@@ -0,0 +1,221 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// The multicast example joins a group, echoes received datagrams to their
+// sender and periodically announces the device to the group.
+const (
+	MCAST_GROUP    = "239.255.0.1"
+	MCAST_INTERVAL = 10
+	MCAST_TTL      = 1
+
+	MCAST_TEST_PORT = 5007
+)
+
+var multicastLog = newLogger("multicast")
+
+// multicastStats tracks the multicast example counters.
+var multicastStats struct {
+	sync.Mutex
+
+	group         string
+	received      int
+	announcements int
+}
+
+// joinGroup returns a UDP connection bound to the argument port which is a
+// member of the multicast group on the NIC address.
+func joinGroup(s *stack.Stack, addr tcpip.Address, nic tcpip.NICID, group tcpip.Address, port uint16) (conn *gonet.UDPConn, err error) {
+	var wq waiter.Queue
+
+	ep, e := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if e != nil {
+		return nil, fmt.Errorf("endpoint error, %v", e)
+	}
+
+	if e = ep.Bind(tcpip.FullAddress{Port: port, NIC: nic}); e != nil {
+		ep.Close()
+		return nil, fmt.Errorf("bind error, %v", e)
+	}
+
+	if e = ep.SetSockOpt(tcpip.AddMembershipOption{NIC: nic, InterfaceAddr: addr, MulticastAddr: group}); e != nil {
+		ep.Close()
+		return nil, fmt.Errorf("membership error, %v", e)
+	}
+
+	if e = ep.SetSockOptInt(tcpip.MulticastTTLOption, MCAST_TTL); e != nil {
+		ep.Close()
+		return nil, fmt.Errorf("TTL error, %v", e)
+	}
+
+	// do not receive our own datagrams
+	if e = ep.SetSockOptBool(tcpip.MulticastLoopOption, false); e != nil {
+		ep.Close()
+		return nil, fmt.Errorf("loop error, %v", e)
+	}
+
+	return gonet.NewUDPConn(s, &wq, ep), nil
+}
+
+// announce sends an announcement to the group.
+func announce(conn *gonet.UDPConn, addr tcpip.Address, dst *net.UDPAddr) (err error) {
+	msg := fmt.Sprintf("tamago-example %s %s", addr, target.Name())
+
+	if _, err = conn.WriteTo([]byte(msg), dst); err != nil {
+		return
+	}
+
+	multicastStats.Lock()
+	multicastStats.announcements += 1
+	multicastStats.Unlock()
+
+	return
+}
+
+// serveMulticast echoes datagrams received on the connection and announces
+// the device to the group at each interval, until the connection is closed.
+func serveMulticast(conn *gonet.UDPConn, addr tcpip.Address, group tcpip.Address, port uint16, interval time.Duration) {
+	dst := &net.UDPAddr{IP: net.IP(group), Port: int(port)}
+
+	go func() {
+		for {
+			if err := announce(conn, addr, dst); err != nil {
+				return
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+
+	buf := make([]byte, MTU)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			return
+		}
+
+		multicastStats.Lock()
+		multicastStats.received += 1
+		multicastStats.Unlock()
+
+		conn.WriteTo(buf[:n], peer)
+	}
+}
+
+func startMulticast(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	group := net.ParseIP(conf.String("mcast_group", MCAST_GROUP)).To4()
+
+	if group == nil || !group.IsMulticast() {
+		multicastLog.Warnf("invalid group %s", conf.String("mcast_group", MCAST_GROUP))
+		return
+	}
+
+	conn, err := joinGroup(s, addr, nic, tcpip.Address(group), port)
+
+	if err != nil {
+		multicastLog.Errorf("%v", err)
+		return
+	}
+
+	multicastStats.Lock()
+	multicastStats.group = fmt.Sprintf("%s:%d", group, port)
+	multicastStats.Unlock()
+
+	multicastLog.Infof("starting multicast example on %s:%d (%s)", group, port, addr)
+
+	interval := time.Duration(conf.Int("mcast_interval", MCAST_INTERVAL)) * time.Second
+	serveMulticast(conn, addr, tcpip.Address(group), port, interval)
+}
+
+func multicastCommand() (res string) {
+	multicastStats.Lock()
+	defer multicastStats.Unlock()
+
+	if multicastStats.group == "" {
+		return "multicast example not started"
+	}
+
+	return fmt.Sprintf("group: %s received: %d announcements: %d",
+		multicastStats.group, multicastStats.received, multicastStats.announcements)
+}
+
+// testMulticast exchanges datagrams between the loopback test stacks over a
+// multicast group, both stacks are members and the device echoes the host
+// datagrams.
+func testMulticast(device *stack.Stack, host *stack.Stack, deviceAddr tcpip.Address, hostAddr tcpip.Address) (err error) {
+	group := tcpip.Address(net.ParseIP(MCAST_GROUP).To4())
+
+	server, err := joinGroup(device, deviceAddr, 1, group, MCAST_TEST_PORT)
+
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	client, err := joinGroup(host, hostAddr, 1, group, MCAST_TEST_PORT)
+
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+	go serveMulticast(server, deviceAddr, group, MCAST_TEST_PORT, NETLOOP_TIMEOUT)
+
+	msg := []byte("multicast echo")
+	dst := &net.UDPAddr{IP: net.IP(group), Port: MCAST_TEST_PORT}
+
+	if _, err = client.WriteTo(msg, dst); err != nil {
+		return
+	}
+
+	var announcement, echo bool
+	buf := make([]byte, MTU)
+
+	for !announcement || !echo {
+		n, _, err := client.ReadFrom(buf)
+
+		if err != nil {
+			return fmt.Errorf("multicast, %v", err)
+		}
+
+		switch {
+		case bytes.Equal(buf[:n], msg):
+			echo = true
+		case bytes.HasPrefix(buf[:n], []byte("tamago-example")):
+			announcement = true
+		default:
+			return errors.New("multicast data mismatch")
+		}
+	}
+
+	netloopLog.Infof("multicast announcement and echo on %s:%d", group, MCAST_TEST_PORT)
+
+	return
+}
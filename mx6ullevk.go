@@ -16,13 +16,103 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/f-secure-foundry/tamago/board/nxp/mx6ullevk"
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// ENET2 RMII pads, the MDIO bus (shared with ENET1 PHY at address 2) is on
+// GPIO1_IO06/GPIO1_IO07.
+const (
+	IOMUXC_SW_MUX_CTL_PAD_ENET2_RX_DATA0 = 0x020e00e4
+	IOMUXC_SW_MUX_CTL_PAD_ENET2_TX_CLK   = 0x020e00fc
+	IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO06     = 0x020e0074
+	IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO07     = 0x020e0078
+
+	IOMUXC_ENET2_REF_CLK2_SELECT_INPUT = 0x020e057c
+	IOMUXC_ENET2_MDIO_SELECT_INPUT     = 0x020e0580
+
+	ENET2_REF_CLK2_MODE = 4
+	ENET2_MDIO_MODE     = 1
+
+	// KSZ8081RNB PHY control 2 and operation mode strap override
+	KSZ8081_CTRL2     = 0x1f
+	KSZ8081_OMSO      = 0x16
+	KSZ8081_CTRL2_50  = 0x8190
+	KSZ8081_OMSO_RMII = 0x0202
 )
 
 func init() {
+	target = &imx6Board{
+		name: "MCIMX6ULL-EVK",
+	}
+
+	consoleUART = imx6.UART1
+
 	cards = append(cards, mx6ullevk.SD1)
 	cards = append(cards, mx6ullevk.SD2)
+	cardWidths = append(cardWidths, mx6ullevk.SD1_BUS_WIDTH, mx6ullevk.SD2_BUS_WIDTH)
+
+	// LCD backlight
+	pwmOutput.port = 1
+	pwmOutput.mux = IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO08
+	pwmOutput.mode = GPIO1_IO08_MODE_PWM1_OUT
+
+	ENET = &fec{
+		Index: 2,
+		PHY:   1,
+		Pads:  enetPads,
+		Fixup: enetFixup,
+	}
+}
+
+func enetPads() {
+	ctl := uint32((1 << imx6.SW_PAD_CTL_PUE) | (1 << imx6.SW_PAD_CTL_PKE) |
+		(imx6.SW_PAD_CTL_PUS_PULL_UP_100K << imx6.SW_PAD_CTL_PUS) |
+		(imx6.SW_PAD_CTL_SPEED_100MHZ << imx6.SW_PAD_CTL_SPEED) |
+		(imx6.SW_PAD_CTL_DSE_2_R0_6 << imx6.SW_PAD_CTL_DSE))
+
+	// RX_DATA0, RX_DATA1, RX_EN, TX_DATA0, TX_DATA1, TX_EN, TX_CLK, RX_ER
+	for i := uint32(0); i < 8; i++ {
+		mux := IOMUXC_SW_MUX_CTL_PAD_ENET2_RX_DATA0 + i*4
+
+		reg.Write(mux, 0)
+		reg.Write(mux+IOMUXC_SW_PAD_CTL_OFFSET, ctl)
+	}
+
+	// reference clock output, looped back as input
+	reg.Write(IOMUXC_SW_MUX_CTL_PAD_ENET2_TX_CLK, 1<<imx6.SW_MUX_CTL_SION|ENET2_REF_CLK2_MODE)
+	reg.Write(IOMUXC_ENET2_REF_CLK2_SELECT_INPUT, 2)
+
+	reg.Write(IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO06, ENET2_MDIO_MODE)
+	reg.Write(IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO06+IOMUXC_SW_PAD_CTL_OFFSET, ctl)
+	reg.Write(IOMUXC_ENET2_MDIO_SELECT_INPUT, 0)
+
+	reg.Write(IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO07, ENET2_MDIO_MODE)
+	reg.Write(IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO07+IOMUXC_SW_PAD_CTL_OFFSET, ctl)
+}
+
+func enetFixup(hw *fec) (err error) {
+	// 50 MHz reference clock input, RMII mode
+	if err = hw.PHYWrite(KSZ8081_CTRL2, KSZ8081_CTRL2_50); err != nil {
+		return
+	}
+
+	return hw.PHYWrite(KSZ8081_OMSO, KSZ8081_OMSO_RMII)
 }
 
 func bleConsole(term *terminal.Terminal) (err error) {
 	return errors.New("not supported")
 }
+
+func bleCommand(op string, arg string) (res string) {
+	return "not supported"
+}
+
+func usbcHost() bool {
+	return false
+}
+
+func usbcCommand() (res string) {
+	return "not supported"
+}
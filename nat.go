@@ -0,0 +1,459 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// IANA dynamic ports range
+	NAT_PORT_FIRST = 49152
+	NAT_PORT_LAST  = 65535
+
+	NAT_MAX_ENTRIES = 1024
+
+	// RFC 5382 and RFC 4787 minimum mapping timeouts
+	NAT_TCP_TIMEOUT     = 7440 * time.Second
+	NAT_TCP_FIN_TIMEOUT = 10 * time.Second
+	NAT_UDP_TIMEOUT     = 120 * time.Second
+	NAT_ICMP_TIMEOUT    = 60 * time.Second
+)
+
+type natKey struct {
+	proto      tcpip.TransportProtocolNumber
+	addr       tcpip.Address
+	port       uint16
+	remote     tcpip.Address
+	remotePort uint16
+}
+
+type natPort struct {
+	proto tcpip.TransportProtocolNumber
+	port  uint16
+}
+
+// natEntry represents a tracked connection.
+type natEntry struct {
+	natKey
+
+	mac     tcpip.LinkAddress
+	mapped  uint16
+	seen    time.Time
+	closing bool
+
+	packets uint64
+}
+
+func (e *natEntry) expired(now time.Time) bool {
+	timeout := NAT_ICMP_TIMEOUT
+
+	switch e.proto {
+	case header.TCPProtocolNumber:
+		timeout = NAT_TCP_TIMEOUT
+
+		if e.closing {
+			timeout = NAT_TCP_FIN_TIMEOUT
+		}
+	case header.UDPProtocolNumber:
+		timeout = NAT_UDP_TIMEOUT
+	}
+
+	return now.Sub(e.seen) > timeout
+}
+
+// natTable implements network address and port translation (masquerading)
+// of IPv4 traffic received on the wired Ethernet interface towards the
+// Ethernet over USB uplink, tracking connections to translate replies.
+//
+// Only TCP, UDP and ICMP echo traffic is translated, fragmented packets are
+// dropped.
+type natTable struct {
+	sync.Mutex
+
+	// downlink (wired Ethernet) transmission function and MAC address
+	Tx  func(frame []byte) error
+	MAC tcpip.LinkAddress
+	// Local returns whether an address belongs to the downlink interface
+	Local func(addr tcpip.Address) bool
+
+	// uplink (Ethernet over USB) link endpoint and address
+	uplink *channel.Endpoint
+	addr   tcpip.Address
+
+	out  map[natKey]*natEntry
+	in   map[natPort]*natEntry
+	next uint16
+
+	translated uint64
+	dropped    uint64
+}
+
+// NAT is the active network address translation table, if any.
+var NAT *natTable
+
+// SetUplink sets the link endpoint, and its address, used to forward
+// translated packets.
+func (n *natTable) SetUplink(link *channel.Endpoint, addr tcpip.Address) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.uplink = link
+	n.addr = addr
+}
+
+// natPorts returns the transport protocol ports, or ICMP echo identifier, of a
+// translatable packet.
+func natPorts(ip header.IPv4, echo header.ICMPv4Type) (src uint16, dst uint16, ok bool) {
+	payload := ip.Payload()
+
+	switch ip.TransportProtocol() {
+	case header.TCPProtocolNumber:
+		if len(payload) < header.TCPMinimumSize {
+			return
+		}
+
+		tcp := header.TCP(payload)
+		return tcp.SourcePort(), tcp.DestinationPort(), true
+	case header.UDPProtocolNumber:
+		if len(payload) < header.UDPMinimumSize {
+			return
+		}
+
+		udp := header.UDP(payload)
+		return udp.SourcePort(), udp.DestinationPort(), true
+	case header.ICMPv4ProtocolNumber:
+		if len(payload) < header.ICMPv4MinimumSize {
+			return
+		}
+
+		icmp := header.ICMPv4(payload)
+
+		if icmp.Type() != echo {
+			return
+		}
+
+		return icmp.Ident(), icmp.Ident(), true
+	}
+
+	return
+}
+
+// natRewrite updates a packet addresses and ports, decrements its TTL and
+// recomputes its checksums.
+func natRewrite(ip header.IPv4, src tcpip.Address, srcPort uint16, dst tcpip.Address, dstPort uint16) {
+	ip.SetSourceAddress(src)
+	ip.SetDestinationAddress(dst)
+	ip[8] -= 1
+
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	payload := ip.Payload()
+	proto := ip.TransportProtocol()
+
+	switch proto {
+	case header.TCPProtocolNumber:
+		tcp := header.TCP(payload)
+		tcp.SetSourcePort(srcPort)
+		tcp.SetDestinationPort(dstPort)
+		tcp.SetChecksum(0)
+
+		xsum := header.PseudoHeaderChecksum(proto, src, dst, uint16(len(tcp)))
+		tcp.SetChecksum(^header.Checksum(tcp, xsum))
+	case header.UDPProtocolNumber:
+		udp := header.UDP(payload)
+		udp.SetSourcePort(srcPort)
+		udp.SetDestinationPort(dstPort)
+
+		// the checksum is optional over IPv4
+		if udp.Checksum() == 0 {
+			return
+		}
+
+		udp.SetChecksum(0)
+
+		xsum := header.PseudoHeaderChecksum(proto, src, dst, uint16(len(udp)))
+
+		if xsum = ^header.Checksum(udp, xsum); xsum == 0 {
+			xsum = 0xffff
+		}
+
+		udp.SetChecksum(xsum)
+	case header.ICMPv4ProtocolNumber:
+		icmp := header.ICMPv4(payload)
+		icmp.SetIdent(srcPort)
+		icmp.SetChecksum(0)
+		icmp.SetChecksum(^header.Checksum(icmp, 0))
+	}
+}
+
+// allocate returns a free translated port, expired entries are removed
+// when the table is full.
+func (n *natTable) allocate(proto tcpip.TransportProtocolNumber, now time.Time) (port uint16, ok bool) {
+	if len(n.out) >= NAT_MAX_ENTRIES {
+		for key, e := range n.out {
+			if e.expired(now) {
+				delete(n.out, key)
+				delete(n.in, natPort{e.proto, e.mapped})
+			}
+		}
+
+		if len(n.out) >= NAT_MAX_ENTRIES {
+			return
+		}
+	}
+
+	for i := 0; i <= NAT_PORT_LAST-NAT_PORT_FIRST; i++ {
+		if n.next < NAT_PORT_FIRST {
+			n.next = NAT_PORT_FIRST
+		}
+
+		port = n.next
+		n.next += 1
+
+		e, used := n.in[natPort{proto, port}]
+
+		if !used {
+			return port, true
+		}
+
+		if e.expired(now) {
+			delete(n.out, e.natKey)
+			delete(n.in, natPort{proto, port})
+			return port, true
+		}
+	}
+
+	return
+}
+
+// Outbound processes an Ethernet frame received on the downlink interface,
+// returning true if it has been translated (or dropped) rather than
+// addressed to the device.
+func (n *natTable) Outbound(frame []byte) bool {
+	if len(frame) < header.EthernetMinimumSize+header.IPv4MinimumSize {
+		return false
+	}
+
+	eth := header.Ethernet(frame)
+
+	if eth.Type() != header.IPv4ProtocolNumber || eth.DestinationAddress() != n.MAC {
+		return false
+	}
+
+	ip := header.IPv4(frame[header.EthernetMinimumSize:])
+
+	if !ip.IsValid(len(ip)) {
+		return false
+	}
+
+	dst := ip.DestinationAddress()
+
+	if dst == header.IPv4Broadcast || header.IsV4MulticastAddress(dst) || n.Local(dst) {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.uplink == nil || ip.TTL() <= 1 || ip.More() || ip.FragmentOffset() != 0 || !Firewall.Allow(FILTER_FWD, ip) {
+		n.dropped += 1
+		return true
+	}
+
+	// strip any Ethernet padding
+	pkt := header.IPv4(append([]byte{}, ip[:ip.TotalLength()]...))
+	srcPort, dstPort, ok := natPorts(pkt, header.ICMPv4Echo)
+
+	if !ok {
+		n.dropped += 1
+		return true
+	}
+
+	now := time.Now()
+	key := natKey{
+		proto:      pkt.TransportProtocol(),
+		addr:       pkt.SourceAddress(),
+		port:       srcPort,
+		remote:     dst,
+		remotePort: dstPort,
+	}
+
+	e, found := n.out[key]
+
+	if found && e.expired(now) {
+		delete(n.out, key)
+		delete(n.in, natPort{e.proto, e.mapped})
+		found = false
+	}
+
+	if !found {
+		if n.out == nil {
+			n.out = make(map[natKey]*natEntry)
+			n.in = make(map[natPort]*natEntry)
+		}
+
+		port, ok := n.allocate(key.proto, now)
+
+		if !ok {
+			n.dropped += 1
+			return true
+		}
+
+		e = &natEntry{
+			natKey: key,
+			mac:    eth.SourceAddress(),
+			mapped: port,
+		}
+
+		n.out[key] = e
+		n.in[natPort{key.proto, port}] = e
+	}
+
+	e.seen = now
+	e.packets += 1
+
+	if key.proto == header.TCPProtocolNumber && header.TCP(pkt.Payload()).Flags()&(header.TCPFlagFin|header.TCPFlagRst) != 0 {
+		e.closing = true
+	}
+
+	natRewrite(pkt, n.addr, e.mapped, dst, dstPort)
+
+	n.uplink.WritePacket(&stack.Route{}, nil, ipv4.ProtocolNumber, &stack.PacketBuffer{
+		Data: buffer.View(pkt).ToVectorisedView(),
+	})
+
+	n.translated += 1
+
+	return true
+}
+
+// Inbound processes an IPv4 packet received on the argument link endpoint,
+// returning true if it has been translated as a reply to a tracked
+// connection.
+func (n *natTable) Inbound(link stack.LinkEndpoint, buf []byte) bool {
+	ip := header.IPv4(buf)
+
+	if len(buf) < header.IPv4MinimumSize || !ip.IsValid(len(buf)) {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if link != n.uplink || ip.DestinationAddress() != n.addr || ip.More() || ip.FragmentOffset() != 0 {
+		return false
+	}
+
+	srcPort, dstPort, ok := natPorts(ip, header.ICMPv4EchoReply)
+
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	e, found := n.in[natPort{ip.TransportProtocol(), dstPort}]
+
+	if !found || e.expired(now) || e.remote != ip.SourceAddress() {
+		return false
+	}
+
+	// echo replies carry the translated identifier in place of ports
+	if e.proto != header.ICMPv4ProtocolNumber && e.remotePort != srcPort {
+		return false
+	}
+
+	if ip.TTL() <= 1 {
+		n.dropped += 1
+		return true
+	}
+
+	pkt := header.IPv4(append([]byte{}, ip[:ip.TotalLength()]...))
+	natRewrite(pkt, e.remote, e.remotePort, e.addr, e.port)
+
+	if !Firewall.Allow(FILTER_FWD, pkt) {
+		n.dropped += 1
+		return true
+	}
+
+	e.seen = now
+	e.packets += 1
+
+	if e.proto == header.TCPProtocolNumber && header.TCP(pkt.Payload()).Flags()&(header.TCPFlagFin|header.TCPFlagRst) != 0 {
+		e.closing = true
+	}
+
+	frame := make([]byte, header.EthernetMinimumSize)
+
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: n.MAC,
+		DstAddr: e.mac,
+		Type:    header.IPv4ProtocolNumber,
+	})
+
+	if err := n.Tx(append(frame, pkt...)); err != nil {
+		n.dropped += 1
+		return true
+	}
+
+	n.translated += 1
+
+	return true
+}
+
+// Status returns the tracked connections and counters.
+func (n *natTable) Status() string {
+	var buf bytes.Buffer
+	var entries []string
+
+	n.Lock()
+	defer n.Unlock()
+
+	now := time.Now()
+
+	for _, e := range n.out {
+		if e.expired(now) {
+			continue
+		}
+
+		proto := "icmp"
+
+		switch e.proto {
+		case header.TCPProtocolNumber:
+			proto = "tcp"
+		case header.UDPProtocolNumber:
+			proto = "udp"
+		}
+
+		entries = append(entries, fmt.Sprintf("%-4s %15s:%-5d -> %15s:%-5d via %5d %6d packets %ds",
+			proto, e.addr, e.port, e.remote, e.remotePort, e.mapped, e.packets, int(now.Sub(e.seen).Seconds())))
+	}
+
+	sort.Strings(entries)
+
+	for _, s := range entries {
+		fmt.Fprintln(&buf, s)
+	}
+
+	fmt.Fprintf(&buf, "%d connections, %d packets translated, %d dropped", len(entries), n.translated, n.dropped)
+
+	return buf.String()
+}
@@ -0,0 +1,679 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb/ethernet"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+// CDC-NCM (Network Control Model) aggregates multiple Ethernet frames in each
+// USB transfer (NTB, Network Transfer Block), removing the per-frame transfer
+// overhead which limits ECM throughput. Only 16-bit NTBs without CRC are
+// supported (USB Communications Class Subclass Specification for Network
+// Control Model Devices, Revision 1.0).
+const (
+	NCM_NTH16_SIGNATURE = 0x484d434e // NCMH
+	NCM_NDP16_SIGNATURE = 0x304d434e // NCM0
+	NCM_NTH16_SIZE      = 12
+	NCM_NDP16_SIZE      = 8
+	NCM_DPE16_SIZE      = 4
+
+	// NTB sizes fit a single USB transfer descriptor, also they match
+	// the Linux driver defaults so that SET_NTB_INPUT_SIZE, whose data
+	// stage is not passed by the USB driver, is not issued.
+	NCM_NTB_MAX_SIZE = 16384
+	// datagrams per IN NTB (Linux cdc_ncm limit)
+	NCM_MAX_DATAGRAMS = 32
+	// datagram alignment
+	NCM_ALIGNMENT = 4
+
+	// class-specific requests (p18, Table 6-2)
+	NCM_GET_NTB_PARAMETERS = 0x80
+	NCM_GET_NTB_FORMAT     = 0x83
+	NCM_SET_NTB_FORMAT     = 0x84
+	NCM_GET_NTB_INPUT_SIZE = 0x85
+
+	// notifications (p10, Table 6-3, CDC PSTN 1.2)
+	CDC_NETWORK_CONNECTION = 0x00
+	CDC_SPEED_CHANGE       = 0x2a
+	// USB 2.0 high speed
+	NCM_BITRATE = 480000000
+)
+
+var ncmLog = newLogger("ncm")
+
+// ncmStats holds NTB aggregation counters.
+type ncmStats struct {
+	sync.Mutex
+
+	rxNTBs   uint64
+	rxFrames uint64
+	txNTBs   uint64
+	txFrames uint64
+	errors   uint64
+}
+
+func (s *ncmStats) add(rx bool, frames int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if rx {
+		s.rxNTBs += 1
+		s.rxFrames += uint64(frames)
+	} else {
+		s.txNTBs += 1
+		s.txFrames += uint64(frames)
+	}
+}
+
+func (s *ncmStats) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	ratio := func(frames uint64, ntbs uint64) float64 {
+		if ntbs == 0 {
+			return 0
+		}
+
+		return float64(frames) / float64(ntbs)
+	}
+
+	return fmt.Sprintf("rx: %d frames in %d NTBs (%.2f/NTB) tx: %d frames in %d NTBs (%.2f/NTB) errors: %d",
+		s.rxFrames, s.rxNTBs, ratio(s.rxFrames, s.rxNTBs),
+		s.txFrames, s.txNTBs, ratio(s.txFrames, s.txNTBs),
+		s.errors)
+}
+
+func (s *ncmStats) error() {
+	s.Lock()
+	s.errors += 1
+	s.Unlock()
+}
+
+func ncmAlign(n int) int {
+	return (n + NCM_ALIGNMENT - 1) &^ (NCM_ALIGNMENT - 1)
+}
+
+// ncmSize returns the NTB size required for datagrams of the given sizes.
+func ncmSize(sizes []int) (size int) {
+	size = ncmAlign(NCM_NTH16_SIZE + NCM_NDP16_SIZE + (len(sizes)+1)*NCM_DPE16_SIZE)
+
+	for _, n := range sizes {
+		size = ncmAlign(size) + n
+	}
+
+	return
+}
+
+// ncmEncode builds a 16-bit NTB, with a single NDP following the header, in
+// a buffer which must fit it (see ncmSize). Each datagram is written by the
+// encode function in its slice of the buffer, the NTB length is returned.
+func ncmEncode(ntb []byte, sizes []int, seq uint16, encode func(i int, datagram []byte)) (length int) {
+	ndpLen := NCM_NDP16_SIZE + (len(sizes)+1)*NCM_DPE16_SIZE
+	length = ncmAlign(NCM_NTH16_SIZE + ndpLen)
+
+	// the buffer is reused, padding and terminator entry are cleared
+	for i := range ntb[:length] {
+		ntb[i] = 0
+	}
+
+	binary.LittleEndian.PutUint32(ntb[0:], NCM_NTH16_SIGNATURE)
+	binary.LittleEndian.PutUint16(ntb[4:], NCM_NTH16_SIZE)
+	binary.LittleEndian.PutUint16(ntb[6:], seq)
+	// wNdpIndex
+	binary.LittleEndian.PutUint16(ntb[10:], NCM_NTH16_SIZE)
+
+	binary.LittleEndian.PutUint32(ntb[NCM_NTH16_SIZE:], NCM_NDP16_SIGNATURE)
+	binary.LittleEndian.PutUint16(ntb[NCM_NTH16_SIZE+4:], uint16(ndpLen))
+
+	for i, size := range sizes {
+		off := ncmAlign(length)
+
+		for j := range ntb[length:off] {
+			ntb[length+j] = 0
+		}
+
+		encode(i, ntb[off:off+size])
+		length = off + size
+
+		dpe := NCM_NTH16_SIZE + NCM_NDP16_SIZE + i*NCM_DPE16_SIZE
+		binary.LittleEndian.PutUint16(ntb[dpe:], uint16(off))
+		binary.LittleEndian.PutUint16(ntb[dpe+2:], uint16(size))
+	}
+
+	// wBlockLength
+	binary.LittleEndian.PutUint16(ntb[8:], uint16(length))
+
+	return
+}
+
+// ncmQueue gathers outbound packets for the next NTB.
+type ncmQueue struct {
+	infos [NCM_MAX_DATAGRAMS]channel.PacketInfo
+	sizes [NCM_MAX_DATAGRAMS]int
+	n     int
+
+	// packet not fitting the previous NTB
+	pending channel.PacketInfo
+	held    bool
+
+	seq uint16
+}
+
+// fill queues, starting from any held packet, all packets available on a link
+// endpoint which fit an NTB of the given size, returning the number of
+// discarded oversized packets.
+func (q *ncmQueue) fill(link *channel.Endpoint, size int) (dropped int) {
+	for q.n < NCM_MAX_DATAGRAMS {
+		info := q.pending
+
+		if q.held {
+			q.pending = channel.PacketInfo{}
+			q.held = false
+		} else {
+			var valid bool
+
+			if info, valid = link.Read(); !valid {
+				return
+			}
+		}
+
+		q.sizes[q.n] = ethernetFrameSize(info)
+
+		if ncmSize(q.sizes[:q.n+1]) > size {
+			if q.n == 0 {
+				dropped += 1
+				continue
+			}
+
+			q.pending = info
+			q.held = true
+
+			return
+		}
+
+		q.infos[q.n] = info
+		q.n += 1
+	}
+
+	return
+}
+
+// encode builds an NTB with the queued packets, in a buffer of the size
+// passed to fill, returning its length. An empty destination address selects
+// the one of each packet route, any datagram function is invoked on each
+// encoded frame.
+func (q *ncmQueue) encode(ntb []byte, src tcpip.LinkAddress, dst tcpip.LinkAddress, fn func(frame []byte)) (length int) {
+	q.seq += 1
+
+	length = ncmEncode(ntb, q.sizes[:q.n], q.seq, func(i int, frame []byte) {
+		info := q.infos[i]
+		addr := dst
+
+		if addr == "" {
+			addr = info.Route.RemoteLinkAddress
+		}
+
+		ethernetEncode(frame, info, src, addr)
+
+		if fn != nil {
+			fn(frame)
+		}
+	})
+
+	// release packet references
+	for i := 0; i < q.n; i++ {
+		q.infos[i] = channel.PacketInfo{}
+	}
+
+	q.n = 0
+
+	return
+}
+
+// ncmBlockLength returns the total length of an NTB from its header.
+func ncmBlockLength(ntb []byte) (n int, err error) {
+	if len(ntb) < NCM_NTH16_SIZE {
+		return 0, errors.New("short NTB header")
+	}
+
+	if binary.LittleEndian.Uint32(ntb[0:]) != NCM_NTH16_SIGNATURE {
+		return 0, errors.New("invalid NTB signature")
+	}
+
+	n = int(binary.LittleEndian.Uint16(ntb[8:]))
+
+	if n < NCM_NTH16_SIZE || n > NCM_NTB_MAX_SIZE {
+		return 0, fmt.Errorf("invalid NTB length %d", n)
+	}
+
+	return
+}
+
+// ncmDecode parses a 16-bit NTB returning its datagrams, which share the
+// NTB buffer.
+func ncmDecode(ntb []byte) (frames [][]byte, err error) {
+	n, err := ncmBlockLength(ntb)
+
+	if err != nil {
+		return
+	}
+
+	if len(ntb) < n {
+		return nil, errors.New("truncated NTB")
+	}
+
+	ntb = ntb[:n]
+	index := int(binary.LittleEndian.Uint16(ntb[10:]))
+
+	// NDPs are chained, a limit guards against loops
+	for i := 0; index != 0 && i < NCM_MAX_DATAGRAMS; i++ {
+		if index+NCM_NDP16_SIZE > len(ntb) {
+			return nil, errors.New("invalid NDP index")
+		}
+
+		ndp := ntb[index:]
+
+		if binary.LittleEndian.Uint32(ndp[0:]) != NCM_NDP16_SIGNATURE {
+			return nil, errors.New("invalid NDP signature")
+		}
+
+		ndpLen := int(binary.LittleEndian.Uint16(ndp[4:]))
+
+		if ndpLen < NCM_NDP16_SIZE+NCM_DPE16_SIZE || index+ndpLen > len(ntb) {
+			return nil, errors.New("invalid NDP length")
+		}
+
+		for off := NCM_NDP16_SIZE; off+NCM_DPE16_SIZE <= ndpLen; off += NCM_DPE16_SIZE {
+			start := int(binary.LittleEndian.Uint16(ndp[off:]))
+			size := int(binary.LittleEndian.Uint16(ndp[off+2:]))
+
+			if start == 0 || size == 0 {
+				break
+			}
+
+			if start+size > len(ntb) {
+				return nil, errors.New("invalid datagram pointer")
+			}
+
+			frames = append(frames, ntb[start:start+size])
+		}
+
+		index = int(binary.LittleEndian.Uint16(ndp[6:]))
+	}
+
+	return
+}
+
+// ncmNIC implements the NCM function endpoints on a virtual Ethernet
+// instance, whose addresses and link endpoint are shared with ECM. Transfers
+// are performed on reserved DMA buffers (see usbdma.go).
+type ncmNIC struct {
+	eth  *ethernet.NIC
+	pool *dmaPool
+
+	// OUT transfer buffer
+	rx []byte
+	// OUT NTB assembly, when spanning multiple transfers
+	buf []byte
+
+	// IN transfer buffer
+	tx []byte
+	// IN packets
+	queue ncmQueue
+
+	// notifications to send on the next interrupt transfers
+	notify chan []byte
+
+	stats ncmStats
+}
+
+// NCM is the CDC-NCM function instance, when enabled.
+var NCM *ncmNIC
+
+// Tx implements the NCM bulk IN endpoint function, aggregating all queued
+// frames which fit in an NTB encoded in place in the transfer buffer.
+func (ncm *ncmNIC) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	// hold transmission on bus suspend (see usbpm.go)
+	if usbSuspended() {
+		return
+	}
+
+	if ncm.tx == nil {
+		ncm.tx = ncm.pool.Get()
+	}
+
+	USBStats.txError(lastErr)
+
+	for i := ncm.queue.fill(ncm.eth.Link, len(ncm.tx)); i > 0; i-- {
+		USBStats.txDrop()
+	}
+
+	if ncm.queue.n == 0 {
+		return
+	}
+
+	bootEnumerated()
+
+	ncm.stats.add(false, ncm.queue.n)
+	n := ncm.queue.encode(ncm.tx, tcpip.LinkAddress(ncm.eth.Device), tcpip.LinkAddress(ncm.eth.Host), func(frame []byte) {
+		Capture.Frame(frame)
+		USBStats.tx(len(frame))
+	})
+
+	return ncm.tx[:n], nil
+}
+
+// Rx implements the NCM bulk OUT endpoint function, NTBs are decoded in place
+// from the transfer buffer unless larger than a single transfer, in which
+// case they are assembled before processing.
+func (ncm *ncmNIC) Rx(out []byte, lastErr error) (_ []byte, err error) {
+	if ncm.rx == nil {
+		ncm.rx = ncm.pool.Get()
+	}
+
+	ntb := out
+
+	if len(ncm.buf) > 0 {
+		ncm.buf = append(ncm.buf, out...)
+		ntb = ncm.buf
+	}
+
+	if len(ntb) >= NCM_NTH16_SIZE {
+		n, err := ncmBlockLength(ntb)
+
+		if err != nil {
+			ncm.discard(err)
+			return ncm.rx, nil
+		}
+
+		if len(ntb) >= n {
+			ncm.receive(ntb)
+			return ncm.rx, nil
+		}
+	}
+
+	// the transfer buffer is about to be reused
+	if len(ncm.buf) == 0 {
+		ncm.buf = append([]byte{}, out...)
+	}
+
+	return ncm.rx, nil
+}
+
+func (ncm *ncmNIC) receive(ntb []byte) {
+	frames, err := ncmDecode(ntb)
+
+	if err != nil {
+		ncm.discard(err)
+		return
+	}
+
+	bootPacket()
+
+	for _, frame := range frames {
+		if len(frame) < header.EthernetMinimumSize {
+			USBStats.rxError()
+			continue
+		}
+
+		Capture.Frame(frame)
+		ethernetRx(ncm.eth.Link, frame)
+		USBStats.rx(len(frame))
+	}
+
+	ncm.stats.add(true, len(frames))
+	ncm.buf = nil
+}
+
+func (ncm *ncmNIC) discard(err error) {
+	ncm.stats.error()
+	USBStats.rxError()
+	ncmLog.Warnf("discarding NTB, %v", err)
+	ncm.buf = nil
+}
+
+// Control implements the NCM interrupt IN endpoint function, sending the
+// notifications queued when the host driver binds.
+func (ncm *ncmNIC) Control(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case in = <-ncm.notify:
+	default:
+	}
+
+	return
+}
+
+func ncmNotification(code byte, iface uint8, data []byte) []byte {
+	buf := []byte{0xa1, code, 0, 0, iface, 0, 0, 0}
+
+	if code == CDC_NETWORK_CONNECTION {
+		// connected
+		buf[2] = 1
+	}
+
+	binary.LittleEndian.PutUint16(buf[6:], uint16(len(data)))
+
+	return append(buf, data...)
+}
+
+// setup handles the NCM class-specific requests, the host driver binding is
+// detected by the NTB parameters request, which is followed by the link
+// state notifications required by the host to bring up the interface.
+func (ncm *ncmNIC) setup(setup *usb.SetupData) (in []byte, err error) {
+	switch setup.Request {
+	case NCM_GET_NTB_PARAMETERS:
+		in = make([]byte, 28)
+
+		binary.LittleEndian.PutUint16(in[0:], uint16(len(in)))
+		// bmNtbFormatsSupported: 16-bit NTB
+		binary.LittleEndian.PutUint16(in[2:], 1)
+		// dwNtbInMaxSize, wNdpInDivisor, wNdpInPayloadRemainder, wNdpInAlignment
+		binary.LittleEndian.PutUint32(in[4:], NCM_NTB_MAX_SIZE)
+		binary.LittleEndian.PutUint16(in[8:], NCM_ALIGNMENT)
+		binary.LittleEndian.PutUint16(in[12:], NCM_ALIGNMENT)
+		// dwNtbOutMaxSize, wNdpOutDivisor, wNdpOutPayloadRemainder, wNdpOutAlignment
+		binary.LittleEndian.PutUint32(in[16:], NCM_NTB_MAX_SIZE)
+		binary.LittleEndian.PutUint16(in[20:], NCM_ALIGNMENT)
+		binary.LittleEndian.PutUint16(in[24:], NCM_ALIGNMENT)
+
+		speed := make([]byte, 8)
+		binary.LittleEndian.PutUint32(speed[0:], NCM_BITRATE)
+		binary.LittleEndian.PutUint32(speed[4:], NCM_BITRATE)
+
+		iface := uint8(setup.Index)
+
+		// drain stale notifications
+		for len(ncm.notify) > 0 {
+			<-ncm.notify
+		}
+
+		ncm.notify <- ncmNotification(CDC_SPEED_CHANGE, iface, speed)
+		ncm.notify <- ncmNotification(CDC_NETWORK_CONNECTION, iface, nil)
+	case NCM_GET_NTB_INPUT_SIZE:
+		in = make([]byte, 4)
+		binary.LittleEndian.PutUint32(in, NCM_NTB_MAX_SIZE)
+	case NCM_GET_NTB_FORMAT:
+		// 16-bit NTB
+		in = []byte{0, 0}
+	case NCM_SET_NTB_FORMAT:
+		// only 16-bit NTBs are advertised
+	default:
+		return nil, fmt.Errorf("unsupported request code: %#x", setup.Request)
+	}
+
+	if int(setup.Length) < len(in) {
+		in = in[:setup.Length]
+	}
+
+	return
+}
+
+// addNCMInterfaces adds the NCM communication and data interfaces, replacing
+// ECM, to the USB device.
+func addNCMInterfaces(device *usb.Device, configurationIndex int, eth *ethernet.NIC) {
+	NCM = &ncmNIC{
+		eth:    eth,
+		pool:   newDMAPool(NCM_BUFFERS, NCM_NTB_MAX_SIZE),
+		notify: make(chan []byte, 2),
+	}
+
+	conf := device.Configurations[configurationIndex]
+
+	// communication interface
+	comm := &usb.InterfaceDescriptor{}
+	comm.SetDefaults()
+
+	comm.NumEndpoints = 1
+	comm.InterfaceClass = 2
+	comm.InterfaceSubClass = 0x0d
+
+	iInterface, _ := device.AddString(`CDC Network Control Model (NCM)`)
+	comm.Interface = iInterface
+
+	comm.IAD = &usb.InterfaceAssociationDescriptor{}
+	comm.IAD.SetDefaults()
+	comm.IAD.InterfaceCount = 2
+	comm.IAD.FunctionClass = comm.InterfaceClass
+	comm.IAD.FunctionSubClass = comm.InterfaceSubClass
+	comm.IAD.Function = iInterface
+
+	hdr := &usb.CDCHeaderDescriptor{}
+	hdr.SetDefaults()
+
+	comm.ClassDescriptors = append(comm.ClassDescriptors, hdr.Bytes())
+
+	union := &usb.CDCUnionDescriptor{}
+	union.SetDefaults()
+	union.MasterInterface = conf.NumInterfaces
+	union.SlaveInterface0 = conf.NumInterfaces + 1
+
+	comm.ClassDescriptors = append(comm.ClassDescriptors, union.Bytes())
+
+	networking := &usb.CDCEthernetDescriptor{}
+	networking.SetDefaults()
+	networking.MaxSegmentSize = uint16(eth.Link.MTU() + header.EthernetMinimumSize)
+
+	iMacAddress, _ := device.AddString(strings.ReplaceAll(eth.Host.String(), ":", ""))
+	networking.MacAddress = iMacAddress
+
+	comm.ClassDescriptors = append(comm.ClassDescriptors, networking.Bytes())
+
+	// NCM functional descriptor (p11, Table 5-2), no optional requests
+	comm.ClassDescriptors = append(comm.ClassDescriptors, []byte{
+		6,          // bFunctionLength
+		0x24,       // bDescriptorType: CS_INTERFACE
+		0x1a,       // bDescriptorSubtype: NCM
+		0x00, 0x01, // bcdNcmVersion: 1.00
+		0, // bmNetworkCapabilities
+	})
+
+	ep2IN := &usb.EndpointDescriptor{}
+	ep2IN.SetDefaults()
+	ep2IN.EndpointAddress = 0x82
+	ep2IN.Attributes = 3
+	ep2IN.MaxPacketSize = 16
+	ep2IN.Interval = 9
+	ep2IN.Function = NCM.Control
+
+	comm.Endpoints = append(comm.Endpoints, ep2IN)
+
+	conf.AddInterface(comm)
+	addInterfaceSetup(device, comm, NCM.setup)
+
+	// data interface, without endpoints in the default alternate setting
+	data := &usb.InterfaceDescriptor{}
+	data.SetDefaults()
+
+	data.InterfaceClass = 10
+	// NTB protocol
+	data.InterfaceProtocol = 1
+
+	iData, _ := device.AddString(`CDC Network Data`)
+	data.Interface = iData
+
+	conf.AddInterface(data)
+
+	active := &usb.InterfaceDescriptor{}
+	*active = *data
+
+	active.AlternateSetting = 1
+	active.NumEndpoints = 2
+
+	ep1IN := &usb.EndpointDescriptor{}
+	ep1IN.SetDefaults()
+	ep1IN.EndpointAddress = 0x81
+	ep1IN.Attributes = 2
+	ep1IN.Function = NCM.Tx
+
+	ep1OUT := &usb.EndpointDescriptor{}
+	ep1OUT.SetDefaults()
+	ep1OUT.EndpointAddress = 0x01
+	ep1OUT.Attributes = 2
+	ep1OUT.Function = NCM.Rx
+
+	active.Endpoints = append(active.Endpoints, ep1IN, ep1OUT)
+
+	conf.AddInterface(active)
+}
+
+// forwardNTBs moves Ethernet frames from a link endpoint to another, as the
+// NCM function does, aggregating all queued frames in NTBs, encoded in
+// reserved DMA buffers, which are then decoded.
+func forwardNTBs(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint, pool *dmaPool, stats *ncmStats) {
+	var q ncmQueue
+
+	addr := src.LinkAddress()
+
+	for {
+		if !q.held {
+			info, valid := src.ReadContext(ctx)
+
+			if !valid {
+				return
+			}
+
+			q.pending = info
+			q.held = true
+		}
+
+		ntb := pool.Get()
+		q.fill(src, len(ntb))
+
+		if q.n == 0 {
+			pool.Put(ntb)
+			continue
+		}
+
+		stats.add(false, q.n)
+		n := q.encode(ntb, addr, "", nil)
+
+		if frames, err := ncmDecode(ntb[:n]); err != nil {
+			stats.error()
+		} else {
+			for _, f := range frames {
+				ethernetRx(dst, f)
+			}
+		}
+
+		pool.Put(ntb)
+	}
+}
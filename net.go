@@ -9,8 +9,8 @@
 package main
 
 import (
-	"log"
 	"net"
+	"sync"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
@@ -19,53 +19,52 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
-const (
-	MTU       = 1500
+var netLog = newLogger("net")
+
+const MTU = 1500
+
+// default network settings, overridden by configuration (see config.go)
+var (
 	hostMAC   = "1a:55:89:a2:69:42"
 	deviceMAC = "1a:55:89:a2:69:41"
 	IP        = "10.0.0.1"
+
+	// wired Ethernet MAC address
+	ethMAC = "1a:55:89:a2:69:43"
 )
 
-func configureNetworkStack(addr tcpip.Address, nic tcpip.NICID) (s *stack.Stack, link *channel.Endpoint) {
-	var err error
+var webAssets sync.Once
 
-	s = stack.New(stack.Options{
+func configureNetworkStack(addr tcpip.Address, nic tcpip.NICID, mtu uint32) (s *stack.Stack, link *channel.Endpoint) {
+	s = newStack(stack.Options{
 		NetworkProtocols: []stack.NetworkProtocol{
 			ipv4.NewProtocol(),
 			arp.NewProtocol()},
 		TransportProtocols: []stack.TransportProtocol{
 			tcp.NewProtocol(),
+			udp.NewProtocol(),
 			icmp.NewProtocol4()},
 	})
 
-	linkAddr, err := tcpip.ParseMACAddress(deviceMAC)
-
-	if err != nil {
-		log.Fatal(err)
+	// TCP buffers, SACK and congestion control (see nettune.go)
+	if err := applyTCPTuning(s, tcpTuningConfig()); err != nil {
+		netLog.Warnf("invalid TCP settings, %v", err)
 	}
 
-	link = channel.New(256, MTU, linkAddr)
-	linkEP := stack.LinkEndpoint(link)
-
-	if err := s.CreateNIC(nic, linkEP); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := s.AddAddress(nic, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
-		log.Fatal(err)
-	}
+	link = addNIC(s, nic, deviceMAC, mtu)
 
 	if err := s.AddAddress(nic, ipv4.ProtocolNumber, addr); err != nil {
-		log.Fatal(err)
+		netLog.Fatalf("%v", err)
 	}
 
 	subnet, err := tcpip.NewSubnet("\x00\x00\x00\x00", "\x00\x00\x00\x00")
 
 	if err != nil {
-		log.Fatal(err)
+		netLog.Fatalf("%v", err)
 	}
 
 	s.SetRouteTable([]tcpip.Route{{
@@ -73,6 +72,35 @@ func configureNetworkStack(addr tcpip.Address, nic tcpip.NICID) (s *stack.Stack,
 		NIC:         nic,
 	}})
 
+	// IPv6 link-local and static addressing (see ipv6.go)
+	if err := configureIPv6(s, nic, conf.String("ipv6_address", "")); err != nil {
+		ipv6Log.Errorf("%v", err)
+	}
+
+	return
+}
+
+// addNIC creates a NIC, with the argument MAC address and MTU, backed by a
+// channel link endpoint.
+func addNIC(s *stack.Stack, nic tcpip.NICID, mac string, mtu uint32) (link *channel.Endpoint) {
+	linkAddr, err := tcpip.ParseMACAddress(mac)
+
+	if err != nil {
+		netLog.Fatalf("%v", err)
+	}
+
+	link = channel.New(256, mtu, linkAddr)
+	// apply the packet filter (see filter.go)
+	linkEP := newFilterEndpoint(link)
+
+	if err := s.CreateNIC(nic, linkEP); err != nil {
+		netLog.Fatalf("%v", err)
+	}
+
+	if err := s.AddAddress(nic, arp.ProtocolNumber, arp.ProtocolAddress); err != nil {
+		netLog.Fatalf("%v", err)
+	}
+
 	return
 }
 
@@ -83,39 +111,158 @@ func startICMPEndpoint(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpi
 	ep, err := s.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
 
 	if err != nil {
-		log.Fatalf("endpoint error (icmp): %v", err)
+		netLog.Fatalf("endpoint error (icmp): %v", err)
 	}
 
 	if err := ep.Bind(fullAddr); err != nil {
-		log.Fatal("bind error (icmp endpoint): ", err)
+		netLog.Fatalf("bind error (icmp endpoint), %v", err)
 	}
 }
 
-// StartNetworking starts SSH and HTTP services.
-func StartNetworking() (l *channel.Endpoint) {
+// StartNetworking starts SSH and HTTP services, on a link with the argument
+// MTU.
+func StartNetworking(mtu uint32) (l *channel.Endpoint) {
 	addr := tcpip.Address(net.ParseIP(IP)).To4()
-	s, l := configureNetworkStack(addr, 1)
+	s, l := configureNetworkStack(addr, 1, mtu)
+
+	if NAT != nil {
+		// Ethernet over USB is the translated traffic uplink
+		NAT.SetUplink(l, addr)
+	}
 
+	startServices(s, addr, 1)
+
+	// WireGuard tunnel (see wireguard.go)
+	if conf.String("wg_private_key", "") != "" {
+		go func() {
+			startWireGuard(s, addr, 1)
+		}()
+	}
+
+	return
+}
+
+// startServices starts the network services on the argument NIC address.
+func startServices(s *stack.Stack, addr tcpip.Address, nic tcpip.NICID) {
 	// handle pings
-	startICMPEndpoint(s, addr, 0, 1)
+	startICMPEndpoint(s, addr, 0, nic)
 
 	// create index.html
-	setupStaticWebAssets()
+	webAssets.Do(setupStaticWebAssets)
+
+	// audit log (see audit.go)
+	if err := Audit.Init(); err != nil {
+		auditLog.Warnf("unavailable, %v", err)
+	}
+
+	// credentials, provisioned on first boot (see auth.go)
+	if authEnabled() {
+		if err := Auth.Init(); err != nil {
+			authLog.Errorf("credentials unavailable, %v", err)
+		}
+	}
 
 	// HTTP web server (see web_server.go)
 	go func() {
-		startWebServer(s, addr, 80, 1, false)
+		startWebServer(s, addr, 80, nic, false)
 	}()
 
 	// HTTPS web server (see web_server.go)
 	go func() {
-		startWebServer(s, addr, 443, 1, true)
+		startWebServer(s, addr, 443, nic, true)
 	}()
 
 	// SSH server (see ssh_server.go)
 	go func() {
-		startSSHServer(s, addr, 22, 1)
+		startSSHServer(s, addr, 22, nic)
 	}()
 
-	return
+	// console fallback (see telnet.go)
+	if port := conf.Int("telnet_port", 0); port > 0 {
+		go func() {
+			startTelnetServer(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// Noise console (see noise.go)
+	if port := conf.Int("noise_port", 0); port > 0 {
+		go func() {
+			startNoiseServer(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// TLS reverse proxy (see proxy.go)
+	if upstream := conf.String("proxy_upstream", ""); upstream != "" {
+		go func() {
+			startProxy(s, addr, uint16(conf.Int("proxy_port", 8443)), nic, upstream)
+		}()
+	}
+
+	// HSM signing service (see hsm.go)
+	if port := conf.Int("hsm_port", 0); port > 0 {
+		go func() {
+			startHSM(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// certificate authority (see ca.go)
+	if port := conf.Int("ca_port", 0); port > 0 {
+		go func() {
+			startCA(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// frame capture streaming server (see pcap.go)
+	if port := conf.Int("pcap_port", 0); port > 0 {
+		go func() {
+			startPcapServer(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// execution trace streaming server (see exectrace.go)
+	if port := conf.Int("trace_port", 0); port > 0 {
+		go func() {
+			startTraceServer(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// CoAP server (see coap.go)
+	if port := conf.Int("coap_port", 0); port > 0 {
+		go func() {
+			startCoAPServer(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// MQTT telemetry agent (see mqtt.go)
+	if conf.String("mqtt_broker", "") != "" {
+		go func() {
+			startMQTT(s)
+		}()
+	}
+
+	// SNTP server (see sntp.go)
+	if conf.Bool("sntp", false) {
+		go func() {
+			startSNTPServer(s, addr, nic)
+		}()
+	}
+
+	// multicast example (see multicast.go)
+	if port := conf.Int("mcast_port", 0); port > 0 {
+		go func() {
+			startMulticast(s, addr, uint16(port), nic)
+		}()
+	}
+
+	// test results uploads (see upload.go)
+	if conf.String("upload_url", "") != "" {
+		Uploader.addStack(s)
+	}
+
+	// ADC streaming server (see adc.go)
+	if port := conf.Int("adc_port", 0); port > 0 {
+		go func() {
+			startADCServer(s, addr, uint16(port), nic)
+		}()
+	}
 }
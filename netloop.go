@@ -0,0 +1,280 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// The loopback network test connects the device network stack to a second,
+// host, stack within the firmware, exchanging Ethernet frames in memory, so
+// that networking can be exercised on emulated runs.
+const (
+	NETLOOP_DEVICE_IP = "10.0.9.1"
+	NETLOOP_HOST_IP   = "10.0.9.2"
+	NETLOOP_ECHO_PORT = 7
+	NETLOOP_HTTP_PORT = 80
+
+	NETLOOP_TCP_SIZE      = 1024 * 1024
+	NETLOOP_UDP_DATAGRAMS = 16
+	NETLOOP_TIMEOUT       = 10 * time.Second
+)
+
+var netloopLog = newLogger("netloop")
+
+// forwardFrames moves Ethernet frames from a link endpoint to another until
+// the context is done.
+func forwardFrames(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint) {
+	addr := src.LinkAddress()
+
+	for {
+		frame, valid := ethernetTx(ctx, src, addr)
+
+		if !valid {
+			return
+		}
+
+		ethernetRx(dst, frame)
+	}
+}
+
+func netloopHostStack(addr tcpip.Address, mtu uint32) (s *stack.Stack, link *channel.Endpoint) {
+	s = stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{
+			ipv4.NewProtocol(),
+			arp.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{
+			tcp.NewProtocol(),
+			udp.NewProtocol()},
+	})
+
+	link = addNIC(s, 1, hostMAC, mtu)
+
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		netloopLog.Fatalf("%v", err)
+	}
+
+	subnet, err := tcpip.NewSubnet("\x00\x00\x00\x00", "\x00\x00\x00\x00")
+
+	if err != nil {
+		netloopLog.Fatalf("%v", err)
+	}
+
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: subnet,
+		NIC:         1,
+	}})
+
+	return
+}
+
+func testTCPEcho(device *stack.Stack, host *stack.Stack, addr tcpip.Address) (err error) {
+	listener, err := gonet.ListenTCP(device, tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	go func() {
+		c, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		io.Copy(c, c)
+	}()
+
+	conn, err := gonet.DialTCP(host, tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+	buf := make([]byte, NETLOOP_TCP_SIZE)
+	rand.Read(buf)
+
+	start := time.Now()
+
+	go conn.Write(buf)
+
+	echo := make([]byte, len(buf))
+
+	if _, err = io.ReadFull(conn, echo); err != nil {
+		return fmt.Errorf("TCP echo, %v", err)
+	}
+
+	if !bytes.Equal(buf, echo) {
+		return errors.New("TCP echo data mismatch")
+	}
+
+	netloopLog.Infof("TCP echo %d KiB in %s", len(buf)/1024, time.Since(start))
+
+	return
+}
+
+func testUDPEcho(device *stack.Stack, host *stack.Stack, addr tcpip.Address) (err error) {
+	server, err := gonet.DialUDP(device, &tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, MTU)
+
+		for {
+			n, peer, err := server.ReadFrom(buf)
+
+			if err != nil {
+				return
+			}
+
+			server.WriteTo(buf[:n], peer)
+		}
+	}()
+
+	client, err := gonet.DialUDP(host, nil, &tcpip.FullAddress{Addr: addr, Port: NETLOOP_ECHO_PORT, NIC: 1}, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+	msg := make([]byte, 512)
+	res := make([]byte, MTU)
+
+	for i := 0; i < NETLOOP_UDP_DATAGRAMS; i++ {
+		rand.Read(msg)
+
+		if _, err = client.Write(msg); err != nil {
+			return
+		}
+
+		n, err := client.Read(res)
+
+		if err != nil {
+			return fmt.Errorf("UDP echo, %v", err)
+		}
+
+		if !bytes.Equal(msg, res[:n]) {
+			return errors.New("UDP echo data mismatch")
+		}
+	}
+
+	netloopLog.Infof("UDP echo %d datagrams", NETLOOP_UDP_DATAGRAMS)
+
+	return
+}
+
+func testHTTP(device *stack.Stack, host *stack.Stack, addr tcpip.Address) (err error) {
+	listener, err := gonet.ListenTCP(device, tcpip.FullAddress{Addr: addr, Port: NETLOOP_HTTP_PORT, NIC: 1}, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	webAssets.Do(setupStaticWebAssets)
+
+	srv := &http.Server{}
+	defer srv.Close()
+
+	go srv.Serve(listener)
+
+	client := &http.Client{
+		Timeout: NETLOOP_TIMEOUT,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return gonet.DialContextTCP(ctx, host, tcpip.FullAddress{Addr: addr, Port: NETLOOP_HTTP_PORT, NIC: 1}, ipv4.ProtocolNumber)
+			},
+		},
+	}
+
+	for _, path := range []string{"/", "/measurements"} {
+		res, err := client.Get(fmt.Sprintf("http://%s%s", addr, path))
+
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP GET %s: %s", path, res.Status)
+		}
+
+		netloopLog.Infof("HTTP GET %s: %s (%d bytes)", path, res.Status, len(body))
+	}
+
+	return
+}
+
+// TestNetworkLoopback runs TCP, UDP, multicast and HTTP exchanges between
+// the device and host stacks.
+func TestNetworkLoopback() (err error) {
+	deviceAddr := tcpip.Address(net.ParseIP(NETLOOP_DEVICE_IP)).To4()
+	hostAddr := tcpip.Address(net.ParseIP(NETLOOP_HOST_IP)).To4()
+
+	device, deviceLink := configureNetworkStack(deviceAddr, 1, MTU)
+	host, hostLink := netloopHostStack(hostAddr, MTU)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go forwardFrames(ctx, deviceLink, hostLink)
+	go forwardFrames(ctx, hostLink, deviceLink)
+
+	defer device.Close()
+	defer host.Close()
+
+	if err = testTCPEcho(device, host, deviceAddr); err != nil {
+		return
+	}
+
+	if err = testUDPEcho(device, host, deviceAddr); err != nil {
+		return
+	}
+
+	if err = testMulticast(device, host, deviceAddr, hostAddr); err != nil {
+		return
+	}
+
+	return testHTTP(device, host, deviceAddr)
+}
@@ -0,0 +1,228 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// The gVisor TCP defaults (1 MiB buffers, no SACK, reno) are tuned for hosts
+// rather than for a single Ethernet over USB link with a small transmit
+// queue, therefore they can be overridden by configuration (see config.go).
+const (
+	TCP_BUFFER_MIN     = 4096
+	TCP_BUFFER_DEFAULT = 1024 * 1024
+
+	TCPTUNE_PORT = 5001
+	TCPTUNE_SIZE = 4 * 1024 * 1024
+)
+
+var tcptuneLog = newLogger("tcptune")
+
+// tcpTuning represents the TCP protocol options applied to a network stack.
+type tcpTuning struct {
+	SendBuffer    int
+	ReceiveBuffer int
+	SACK          bool
+	// congestion control algorithm (reno or cubic)
+	CongestionControl string
+	// receive buffer auto-tuning
+	ModerateReceiveBuffer bool
+}
+
+func (t tcpTuning) String() string {
+	return fmt.Sprintf("%s sack:%v snd:%d rcv:%d", t.CongestionControl, t.SACK, t.SendBuffer, t.ReceiveBuffer)
+}
+
+// tcpTuningConfig returns the configured TCP tuning.
+func tcpTuningConfig() tcpTuning {
+	return tcpTuning{
+		SendBuffer:            conf.Int("tcp_send_buffer", TCP_BUFFER_DEFAULT),
+		ReceiveBuffer:         conf.Int("tcp_receive_buffer", TCP_BUFFER_DEFAULT),
+		SACK:                  conf.Bool("tcp_sack", false),
+		CongestionControl:     conf.String("tcp_congestion", "reno"),
+		ModerateReceiveBuffer: conf.Bool("tcp_moderate_rcvbuf", false),
+	}
+}
+
+// applyTCPTuning sets the TCP protocol options of a network stack, buffer
+// sizes are used as default and maximum for new endpoints.
+func applyTCPTuning(s *stack.Stack, t tcpTuning) error {
+	for _, opt := range []interface{}{
+		tcp.SendBufferSizeOption{Min: TCP_BUFFER_MIN, Default: t.SendBuffer, Max: t.SendBuffer},
+		tcp.ReceiveBufferSizeOption{Min: TCP_BUFFER_MIN, Default: t.ReceiveBuffer, Max: t.ReceiveBuffer},
+		tcp.SACKEnabled(t.SACK),
+		tcpip.CongestionControlOption(t.CongestionControl),
+		tcpip.ModerateReceiveBufferOption(t.ModerateReceiveBuffer),
+	} {
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			return fmt.Errorf("TCP option %T (%v), %v", opt, opt, err)
+		}
+	}
+
+	return nil
+}
+
+// tcpThroughput measures a one way TCP transfer from the host to the device
+// stack.
+func tcpThroughput(device *stack.Stack, host *stack.Stack, addr tcpip.Address) (rate float64, err error) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: TCPTUNE_PORT, NIC: 1}
+	listener, err := gonet.ListenTCP(device, fullAddr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	received := make(chan int64, 1)
+
+	go func() {
+		c, err := listener.Accept()
+
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer c.Close()
+
+		n, _ := io.Copy(ioutil.Discard, c)
+		received <- n
+	}()
+
+	conn, err := gonet.DialTCP(host, fullAddr, ipv4.ProtocolNumber)
+
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(NETLOOP_TIMEOUT))
+
+	buf := make([]byte, 64*1024)
+	start := time.Now()
+
+	for sent := 0; sent < TCPTUNE_SIZE; sent += len(buf) {
+		if _, err = conn.Write(buf); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	conn.Close()
+
+	if n := <-received; n != TCPTUNE_SIZE {
+		return 0, fmt.Errorf("short transfer (%d/%d bytes)", n, TCPTUNE_SIZE)
+	}
+
+	return float64(TCPTUNE_SIZE) / time.Since(start).Seconds(), nil
+}
+
+// tcpLoopback measures the TCP throughput between loopback test stacks, with
+// the given tuning, frames are moved between stacks by the forward function.
+func tcpLoopback(t tcpTuning, forward func(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint)) (rate float64, err error) {
+	deviceAddr := tcpip.Address(net.ParseIP(NETLOOP_DEVICE_IP)).To4()
+	hostAddr := tcpip.Address(net.ParseIP(NETLOOP_HOST_IP)).To4()
+
+	device, deviceLink := configureNetworkStack(deviceAddr, 1, MTU)
+	host, hostLink := netloopHostStack(hostAddr, MTU)
+
+	var wg sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// forwarders are waited for as they might hold caller resources
+	defer func() {
+		cancel()
+		wg.Wait()
+		device.Close()
+		host.Close()
+	}()
+
+	for _, links := range [][2]*channel.Endpoint{{deviceLink, hostLink}, {hostLink, deviceLink}} {
+		wg.Add(1)
+
+		go func(src *channel.Endpoint, dst *channel.Endpoint) {
+			defer wg.Done()
+			forward(ctx, src, dst)
+		}(links[0], links[1])
+	}
+
+	if err = applyTCPTuning(device, t); err != nil {
+		return
+	}
+
+	if err = applyTCPTuning(host, t); err != nil {
+		return
+	}
+
+	return tcpThroughput(device, host, deviceAddr)
+}
+
+// TestTCPTuning reports the TCP throughput, between the loopback test
+// stacks, for each congestion control algorithm with and without SACK using
+// the configured buffer sizes, followed by the comparison of frames
+// forwarded one per transfer (ECM) or aggregated in NTBs (NCM).
+func TestTCPTuning() (err error) {
+	var rate float64
+
+	configured := tcpTuningConfig()
+
+	for _, cc := range []string{"reno", "cubic"} {
+		for _, sack := range []bool{false, true} {
+			t := configured
+			t.CongestionControl = cc
+			t.SACK = sack
+
+			if rate, err = tcpLoopback(t, forwardFrames); err != nil {
+				return fmt.Errorf("%s, %v", t, err)
+			}
+
+			tcptuneLog.Infof("%-40s %.2f MB/s", t, rate/(1000*1000))
+		}
+	}
+
+	if rate, err = tcpLoopback(configured, forwardFrames); err != nil {
+		return fmt.Errorf("ecm, %v", err)
+	}
+
+	tcptuneLog.Infof("%-40s %.2f MB/s (1.00 frames/transfer)", "ecm framing", rate/(1000*1000))
+
+	stats := &ncmStats{}
+
+	pool := newDMAPool(NCM_BUFFERS, NCM_NTB_MAX_SIZE)
+	defer pool.Release()
+
+	ncm := func(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint) {
+		forwardNTBs(ctx, src, dst, pool, stats)
+	}
+
+	if rate, err = tcpLoopback(configured, ncm); err != nil {
+		return fmt.Errorf("ncm, %v", err)
+	}
+
+	stats.Lock()
+	frames := float64(stats.txFrames) / float64(stats.txNTBs)
+	stats.Unlock()
+
+	tcptuneLog.Infof("%-40s %.2f MB/s (%.2f frames/transfer)", "ncm framing", rate/(1000*1000), frames)
+
+	return
+}
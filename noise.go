@@ -0,0 +1,287 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/f-secure-foundry/tamago-example/internal/noise"
+)
+
+// The Noise console is a lightweight alternative to SSH and TLS, it serves
+// the console over a Noise_XX_25519_ChaChaPoly_SHA256 channel (see
+// internal/noise) where both parties are authenticated by static Curve25519
+// keys.
+//
+// The device static key is derived from the key tree, and bound to the device
+// identity by including, in the handshake payload, the device certificate and
+// its signature over the static key (see identity.go), so that clients can
+// authenticate the device against the manufacturer CA rather than pinning
+// its key. Clients are authorized by listing their static public keys in
+// `noise_peers`.
+const (
+	NOISE_PROLOGUE = "tamago-example noise console v1"
+	NOISE_TIMEOUT  = 10 * time.Second
+)
+
+var noiseLog = newLogger("noise")
+
+// noiseStatic returns the device Noise static key pair.
+func noiseStatic() (*noise.KeyPair, error) {
+	key, err := appKey(KEY_ATTESTATION+"/noise", noise.KeySize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return noise.NewKeyPair(key)
+}
+
+// noisePayload returns the handshake payload binding the static key to the
+// device identity, which is empty if no certificate is installed.
+func noisePayload(static *noise.KeyPair) (payload []byte, err error) {
+	cert, err := loadIdentityCertificate()
+
+	if err != nil {
+		return nil, nil
+	}
+
+	key, err := identityKey()
+
+	if err != nil {
+		return
+	}
+
+	return noise.BindIdentity(key, cert.Raw, static.Public)
+}
+
+// noisePeers returns the authorized client static keys.
+func noisePeers() (peers [][]byte, err error) {
+	for _, p := range strings.Split(conf.String("noise_peers", ""), ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		key, err := hex.DecodeString(p)
+
+		if err != nil || len(key) != noise.KeySize {
+			return nil, fmt.Errorf("invalid peer key %q", p)
+		}
+
+		peers = append(peers, key)
+	}
+
+	return
+}
+
+func authorizeNoisePeer(peers [][]byte) func([]byte, []byte) error {
+	return func(static []byte, _ []byte) error {
+		for _, key := range peers {
+			if bytes.Equal(key, static) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("unauthorized peer %x", static)
+	}
+}
+
+func startNoiseServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	static, err := noiseStatic()
+
+	if err != nil {
+		noiseLog.Warnf("cannot derive static key, %v", err)
+		return
+	}
+
+	payload, err := noisePayload(static)
+
+	if err != nil {
+		noiseLog.Warnf("cannot bind static key to identity, %v", err)
+		return
+	}
+
+	peers, err := noisePeers()
+
+	if err != nil {
+		noiseLog.Warnf("%v", err)
+		return
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		noiseLog.Fatalf("listener error, %v", err)
+	}
+
+	noiseLog.Infof("starting noise server at %s:%d (static key %x, %d authorized peers)", addr.String(), port, static.Public, len(peers))
+
+	config := &noise.Config{
+		Static:     static,
+		Prologue:   []byte(NOISE_PROLOGUE),
+		Payload:    payload,
+		VerifyPeer: authorizeNoisePeer(peers),
+	}
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			noiseLog.Errorf("error accepting connection, %v", err)
+			continue
+		}
+
+		go handleNoiseConnection(conn, config)
+	}
+}
+
+func handleNoiseConnection(conn net.Conn, config *noise.Config) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(NOISE_TIMEOUT))
+
+	c, err := noise.Server(conn, config)
+
+	if err != nil {
+		noiseLog.Errorf("noise handshake error from %s, %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	noiseLog.Infof("new noise connection from %s (peer %s)", conn.RemoteAddr(), noise.Fingerprint(c.RemoteStatic()))
+
+	term := terminal.NewTerminal(c, "")
+	term.SetPrompt(string(term.Escape.Red) + "> " + string(term.Escape.Reset))
+
+	// peers are individually authorized (see noise_peers)
+	console(term, ROLE_ADMIN)
+
+	noiseLog.Infof("closing noise connection")
+}
+
+// noiseSelfTest performs a handshake, between a client and the device
+// server, over an in-memory connection and verifies the transport channel.
+func noiseSelfTest(static *noise.KeyPair, payload []byte) (d time.Duration, err error) {
+	client, err := noise.GenerateKeyPair()
+
+	if err != nil {
+		return
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan error, 1)
+	msg := []byte(banner)
+
+	go func() {
+		c, err := noise.Server(b, &noise.Config{
+			Static:     static,
+			Prologue:   []byte(NOISE_PROLOGUE),
+			Payload:    payload,
+			VerifyPeer: authorizeNoisePeer([][]byte{client.Public}),
+		})
+
+		if err == nil {
+			_, err = c.Write(msg)
+		}
+
+		done <- err
+	}()
+
+	start := time.Now()
+
+	c, err := noise.Client(a, &noise.Config{
+		Static:   client,
+		Prologue: []byte(NOISE_PROLOGUE),
+	})
+
+	if err != nil {
+		return
+	}
+
+	d = time.Since(start)
+
+	if !bytes.Equal(c.RemoteStatic(), static.Public) {
+		return d, errors.New("remote static key mismatch")
+	}
+
+	buf := make([]byte, len(msg))
+
+	if _, err = c.Read(buf); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf, msg) {
+		return d, errors.New("transport data mismatch")
+	}
+
+	return d, <-done
+}
+
+func noiseCommand() string {
+	var buf strings.Builder
+
+	static, err := noiseStatic()
+
+	if err != nil {
+		return err.Error()
+	}
+
+	payload, err := noisePayload(static)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	fmt.Fprintf(&buf, "protocol:   %s\n", noise.Protocol)
+	fmt.Fprintf(&buf, "static key: %x\n", static.Public)
+
+	if len(payload) > 0 {
+		cert, err := noise.VerifyIdentity(payload, static.Public, nil)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		fmt.Fprintf(&buf, "identity:   %s\n", cert.Subject)
+	} else {
+		fmt.Fprintf(&buf, "identity:   none (no device certificate)\n")
+	}
+
+	if peers, err := noisePeers(); err != nil {
+		fmt.Fprintf(&buf, "peers:      %v\n", err)
+	} else {
+		fmt.Fprintf(&buf, "peers:      %d authorized\n", len(peers))
+	}
+
+	d, err := noiseSelfTest(static, payload)
+
+	if err != nil {
+		fmt.Fprintf(&buf, "self test:  %v", err)
+	} else {
+		fmt.Fprintf(&buf, "self test:  ok (handshake %s)", d.Round(time.Microsecond))
+	}
+
+	return buf.String()
+}
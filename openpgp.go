@@ -0,0 +1,707 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// ISO 7816-4 instructions used by the OpenPGP card application (Functional
+// Specification of the OpenPGP application on ISO Smart Card Operating
+// Systems, version 3.4).
+const (
+	ISO7816_SELECT                = 0xa4
+	ISO7816_VERIFY                = 0x20
+	ISO7816_CHANGE_REFERENCE      = 0x24
+	ISO7816_GET_DATA              = 0xca
+	ISO7816_PUT_DATA              = 0xda
+	ISO7816_GENERATE_KEY          = 0x47
+	ISO7816_PSO                   = 0x2a
+	ISO7816_INTERNAL_AUTHENTICATE = 0x88
+
+	SW_OK                       = 0x9000
+	SW_WRONG_LENGTH             = 0x6700
+	SW_SECURITY_NOT_SATISFIED   = 0x6982
+	SW_PIN_BLOCKED              = 0x6983
+	SW_CONDITIONS_NOT_SATISFIED = 0x6985
+	SW_WRONG_DATA               = 0x6a80
+	SW_FILE_NOT_FOUND           = 0x6a82
+	SW_REFERENCE_NOT_FOUND      = 0x6a88
+	SW_WRONG_P1P2               = 0x6b00
+	SW_INS_NOT_SUPPORTED        = 0x6d00
+	SW_UNKNOWN                  = 0x6f00
+
+	OPENPGP_PIN_RETRIES = 3
+	OPENPGP_MAX_DATA    = 254
+)
+
+var openpgpLog = newLogger("openpgp")
+
+// OpenPGP key slots
+const (
+	OPENPGP_KEY_SIG = iota
+	OPENPGP_KEY_DEC
+	OPENPGP_KEY_AUT
+)
+
+var (
+	openPGPRID = []byte{0xd2, 0x76, 0x00, 0x01, 0x24, 0x01}
+
+	// ECDSA/ECDH algorithm attributes with NIST P-256 OID
+	openPGPAlgECDSA = []byte{0x13, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+	openPGPAlgECDH  = []byte{0x12, 0x2a, 0x86, 0x48, 0xce, 0x3d, 0x03, 0x01, 0x07}
+
+	// control reference templates for key generation
+	openPGPKeyCRT = map[byte]int{
+		0xb6: OPENPGP_KEY_SIG,
+		0xb8: OPENPGP_KEY_DEC,
+		0xa4: OPENPGP_KEY_AUT,
+	}
+)
+
+// openPGPState represents the card persistent data, kept in the storage area
+// as a DCP sealed blob (see secrets.go) which binds the keys to the device.
+type openPGPState struct {
+	PW1        []byte
+	PW3        []byte
+	PW1Retries int
+	PW3Retries int
+
+	Name  []byte
+	Login []byte
+	Lang  []byte
+	Sex   []byte
+	URL   []byte
+
+	// P-256 private scalars
+	Keys [3][]byte
+	// key fingerprints and generation dates, set by the host
+	Fingerprints   [3][]byte
+	CAFingerprints [3][]byte
+	Dates          [3][]byte
+
+	Signatures uint32
+}
+
+// openPGPCard implements a minimal OpenPGP card application supporting NIST
+// P-256 keys generated on the card, without key import or secure messaging.
+type openPGPCard struct {
+	sync.Mutex
+
+	state openPGPState
+	aid   []byte
+
+	// security status
+	pw1Sign  bool
+	pw1Other bool
+	pw3      bool
+
+	// command chaining
+	chain []byte
+}
+
+func tlv(tag uint16, val []byte) (buf []byte) {
+	if tag > 0xff {
+		buf = append(buf, byte(tag>>8))
+	}
+
+	buf = append(buf, byte(tag))
+
+	switch n := len(val); {
+	case n < 0x80:
+		buf = append(buf, byte(n))
+	case n <= 0xff:
+		buf = append(buf, 0x81, byte(n))
+	default:
+		buf = append(buf, 0x82, byte(n>>8), byte(n))
+	}
+
+	return append(buf, val...)
+}
+
+// findTLV returns the value of a BER-TLV object, searched at the top level of
+// the argument buffer.
+func findTLV(buf []byte, tag uint16) ([]byte, bool) {
+	for len(buf) > 0 {
+		t := uint16(buf[0])
+		buf = buf[1:]
+
+		// two bytes tag
+		if t&0x1f == 0x1f && len(buf) > 0 {
+			t = t<<8 | uint16(buf[0])
+			buf = buf[1:]
+		}
+
+		if len(buf) < 1 {
+			break
+		}
+
+		n := int(buf[0])
+		buf = buf[1:]
+
+		switch n {
+		case 0x81:
+			if len(buf) < 1 {
+				return nil, false
+			}
+
+			n = int(buf[0])
+			buf = buf[1:]
+		case 0x82:
+			if len(buf) < 2 {
+				return nil, false
+			}
+
+			n = int(binary.BigEndian.Uint16(buf))
+			buf = buf[2:]
+		}
+
+		if len(buf) < n {
+			break
+		}
+
+		if t == tag {
+			return buf[:n], true
+		}
+
+		buf = buf[n:]
+	}
+
+	return nil, false
+}
+
+func newOpenPGPCard() (card *openPGPCard, err error) {
+	card = &openPGPCard{}
+
+	payload, err := loadSealed("openpgp", func() ([]byte, error) {
+		s := &openPGPState{
+			PW1:        []byte(conf.String("openpgp_pin", "123456")),
+			PW3:        []byte(conf.String("openpgp_admin", "12345678")),
+			PW1Retries: OPENPGP_PIN_RETRIES,
+			PW3Retries: OPENPGP_PIN_RETRIES,
+		}
+
+		return json.Marshal(s)
+	})
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(payload, &card.state); err != nil {
+		return
+	}
+
+	uid := imx6.UniqueID()
+
+	// version 3.4, manufacturer 0xfffe (test cards), serial number
+	card.aid = append([]byte{}, openPGPRID...)
+	card.aid = append(card.aid, 0x03, 0x04, 0xff, 0xfe)
+	card.aid = append(card.aid, uid[4:8]...)
+	card.aid = append(card.aid, 0x00, 0x00)
+
+	openpgpLog.Infof("card serial %x", uid[4:8])
+
+	return
+}
+
+func (c *openPGPCard) save() error {
+	payload, err := json.Marshal(c.state)
+
+	if err != nil {
+		return err
+	}
+
+	return storeSealed("openpgp", payload)
+}
+
+func (c *openPGPCard) key(n int) (priv *ecdsa.PrivateKey, err error) {
+	d := c.state.Keys[n]
+
+	if len(d) == 0 {
+		return nil, errors.New("missing key")
+	}
+
+	priv = &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	priv.PublicKey.Curve = elliptic.P256()
+	priv.PublicKey.X, priv.PublicKey.Y = priv.PublicKey.Curve.ScalarBaseMult(d)
+
+	return
+}
+
+// openPGPFields concatenates fixed size data objects, zero filled when unset.
+func openPGPFields(fields [3][]byte, size int) (buf []byte) {
+	for _, f := range fields {
+		if len(f) != size {
+			f = make([]byte, size)
+		}
+
+		buf = append(buf, f...)
+	}
+
+	return
+}
+
+func (c *openPGPCard) pwStatus() []byte {
+	// PW1 valid for multiple signatures, maximum PIN lengths, retries
+	return []byte{0x01, 0x7f, 0x7f, 0x7f, byte(c.state.PW1Retries), 0x00, byte(c.state.PW3Retries)}
+}
+
+func (c *openPGPCard) getData(tag uint16) ([]byte, bool) {
+	switch tag {
+	case 0x004f:
+		return c.aid, true
+	case 0x005e:
+		return c.state.Login, true
+	case 0x5f50:
+		return c.state.URL, true
+	case 0x5f52:
+		return ccidATR[10:20], true
+	case 0x0065:
+		var buf []byte
+		buf = append(buf, tlv(0x5b, c.state.Name)...)
+		buf = append(buf, tlv(0x5f2d, c.state.Lang)...)
+		buf = append(buf, tlv(0x5f35, c.state.Sex)...)
+		return buf, true
+	case 0x006e:
+		var ddo []byte
+
+		for _, t := range []uint16{0xc0, 0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6, 0xcd} {
+			v, _ := c.getData(t)
+			ddo = append(ddo, tlv(t, v)...)
+		}
+
+		var buf []byte
+		buf = append(buf, tlv(0x4f, c.aid)...)
+		buf = append(buf, tlv(0x5f52, ccidATR[10:20])...)
+		buf = append(buf, tlv(0x73, ddo)...)
+		return buf, true
+	case 0x007a:
+		counter := make([]byte, 4)
+		binary.BigEndian.PutUint32(counter, c.state.Signatures)
+		return tlv(0x93, counter[1:]), true
+	case 0x00c0:
+		// no optional features, maximum special DO length 255
+		return []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00}, true
+	case 0x00c1, 0x00c3:
+		return openPGPAlgECDSA, true
+	case 0x00c2:
+		return openPGPAlgECDH, true
+	case 0x00c4:
+		return c.pwStatus(), true
+	case 0x00c5:
+		return openPGPFields(c.state.Fingerprints, 20), true
+	case 0x00c6:
+		return openPGPFields(c.state.CAFingerprints, 20), true
+	case 0x00cd:
+		return openPGPFields(c.state.Dates, 4), true
+	}
+
+	return nil, false
+}
+
+func (c *openPGPCard) putData(tag uint16, data []byte) uint16 {
+	if !c.pw3 {
+		return SW_SECURITY_NOT_SATISFIED
+	}
+
+	if len(data) > OPENPGP_MAX_DATA {
+		return SW_WRONG_LENGTH
+	}
+
+	s := &c.state
+	val := append([]byte{}, data...)
+
+	switch {
+	case tag == 0x005b:
+		s.Name = val
+	case tag == 0x005e:
+		s.Login = val
+	case tag == 0x5f2d:
+		s.Lang = val
+	case tag == 0x5f35:
+		s.Sex = val
+	case tag == 0x5f50:
+		s.URL = val
+	case tag >= 0x00c7 && tag <= 0x00c9:
+		if len(val) != 20 {
+			return SW_WRONG_LENGTH
+		}
+
+		s.Fingerprints[tag-0xc7] = val
+	case tag >= 0x00ca && tag <= 0x00cc:
+		if len(val) != 20 {
+			return SW_WRONG_LENGTH
+		}
+
+		s.CAFingerprints[tag-0xca] = val
+	case tag >= 0x00ce && tag <= 0x00d0:
+		if len(val) != 4 {
+			return SW_WRONG_LENGTH
+		}
+
+		s.Dates[tag-0xce] = val
+	case tag == 0x00c1 || tag == 0x00c3:
+		// only the current algorithm is supported
+		if !bytes.Equal(val, openPGPAlgECDSA) {
+			return SW_WRONG_DATA
+		}
+
+		return SW_OK
+	case tag == 0x00c2:
+		if !bytes.Equal(val, openPGPAlgECDH) {
+			return SW_WRONG_DATA
+		}
+
+		return SW_OK
+	case tag == 0x00c4:
+		// PW1 status is fixed
+		return SW_OK
+	default:
+		return SW_REFERENCE_NOT_FOUND
+	}
+
+	if c.save() != nil {
+		return SW_UNKNOWN
+	}
+
+	return SW_OK
+}
+
+func (c *openPGPCard) verify(p2 byte, pin []byte) uint16 {
+	var ref []byte
+	var retries *int
+	var status *bool
+
+	switch p2 {
+	case 0x81:
+		ref, retries, status = c.state.PW1, &c.state.PW1Retries, &c.pw1Sign
+	case 0x82:
+		ref, retries, status = c.state.PW1, &c.state.PW1Retries, &c.pw1Other
+	case 0x83:
+		ref, retries, status = c.state.PW3, &c.state.PW3Retries, &c.pw3
+	default:
+		return SW_WRONG_P1P2
+	}
+
+	// status query
+	if len(pin) == 0 {
+		if *status {
+			return SW_OK
+		}
+
+		return 0x63c0 | uint16(*retries)
+	}
+
+	if *retries == 0 {
+		return SW_PIN_BLOCKED
+	}
+
+	if subtle.ConstantTimeCompare(pin, ref) != 1 {
+		*status = false
+		*retries -= 1
+		c.save()
+
+		return 0x63c0 | uint16(*retries)
+	}
+
+	if *retries != OPENPGP_PIN_RETRIES {
+		*retries = OPENPGP_PIN_RETRIES
+		c.save()
+	}
+
+	*status = true
+
+	return SW_OK
+}
+
+func (c *openPGPCard) changePIN(p2 byte, data []byte) uint16 {
+	var ref *[]byte
+	var min int
+
+	switch p2 {
+	case 0x81:
+		ref, min = &c.state.PW1, 6
+	case 0x83:
+		ref, min = &c.state.PW3, 8
+	default:
+		return SW_WRONG_P1P2
+	}
+
+	n := len(*ref)
+
+	if len(data) < n+min {
+		return SW_WRONG_LENGTH
+	}
+
+	if sw := c.verify(p2, data[:n]); sw != SW_OK {
+		return sw
+	}
+
+	*ref = append([]byte{}, data[n:]...)
+
+	if c.save() != nil {
+		return SW_UNKNOWN
+	}
+
+	return SW_OK
+}
+
+func (c *openPGPCard) publicKey(n int) ([]byte, uint16) {
+	priv, err := c.key(n)
+
+	if err != nil {
+		return nil, SW_REFERENCE_NOT_FOUND
+	}
+
+	point := elliptic.Marshal(priv.Curve, priv.X, priv.Y)
+
+	return tlv(0x7f49, tlv(0x86, point)), SW_OK
+}
+
+func (c *openPGPCard) generate(p1 byte, data []byte) ([]byte, uint16) {
+	if len(data) < 1 {
+		return nil, SW_WRONG_DATA
+	}
+
+	n, ok := openPGPKeyCRT[data[0]]
+
+	if !ok {
+		return nil, SW_WRONG_DATA
+	}
+
+	switch p1 {
+	case 0x80:
+		if !c.pw3 {
+			return nil, SW_SECURITY_NOT_SATISFIED
+		}
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		if err != nil {
+			return nil, SW_UNKNOWN
+		}
+
+		d := make([]byte, 32)
+		priv.D.FillBytes(d)
+
+		c.state.Keys[n] = d
+		c.state.Fingerprints[n] = nil
+		c.state.Dates[n] = nil
+
+		if n == OPENPGP_KEY_SIG {
+			c.state.Signatures = 0
+		}
+
+		if c.save() != nil {
+			return nil, SW_UNKNOWN
+		}
+
+		openpgpLog.Infof("generated key %d", n)
+	case 0x81:
+	default:
+		return nil, SW_WRONG_P1P2
+	}
+
+	return c.publicKey(n)
+}
+
+func (c *openPGPCard) sign(n int, digest []byte) ([]byte, uint16) {
+	priv, err := c.key(n)
+
+	if err != nil {
+		return nil, SW_REFERENCE_NOT_FOUND
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+
+	if err != nil {
+		return nil, SW_UNKNOWN
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[0:32])
+	s.FillBytes(sig[32:64])
+
+	return sig, SW_OK
+}
+
+func (c *openPGPCard) decipher(data []byte) ([]byte, uint16) {
+	priv, err := c.key(OPENPGP_KEY_DEC)
+
+	if err != nil {
+		return nil, SW_REFERENCE_NOT_FOUND
+	}
+
+	// A6 { 7F49 { 86 <ephemeral public key> } }
+	tmpl, ok1 := findTLV(data, 0xa6)
+	pub, ok2 := findTLV(tmpl, 0x7f49)
+	point, ok3 := findTLV(pub, 0x86)
+
+	if !ok1 || !ok2 || !ok3 {
+		return nil, SW_WRONG_DATA
+	}
+
+	x, y := elliptic.Unmarshal(priv.Curve, point)
+
+	if x == nil {
+		return nil, SW_WRONG_DATA
+	}
+
+	sx, sy := priv.Curve.ScalarMult(x, y, priv.D.Bytes())
+
+	// the shared point is returned in uncompressed format
+	return elliptic.Marshal(priv.Curve, sx, sy), SW_OK
+}
+
+func (c *openPGPCard) process(ins byte, p1 byte, p2 byte, data []byte) ([]byte, uint16) {
+	switch ins {
+	case ISO7816_SELECT:
+		if p1 != 0x04 || !bytes.HasPrefix(data, openPGPRID) {
+			return nil, SW_FILE_NOT_FOUND
+		}
+
+		c.pw1Sign = false
+		c.pw1Other = false
+		c.pw3 = false
+
+		return nil, SW_OK
+	case ISO7816_GET_DATA:
+		if res, ok := c.getData(uint16(p1)<<8 | uint16(p2)); ok {
+			return res, SW_OK
+		}
+
+		return nil, SW_REFERENCE_NOT_FOUND
+	case ISO7816_PUT_DATA:
+		return nil, c.putData(uint16(p1)<<8|uint16(p2), data)
+	case ISO7816_VERIFY:
+		return nil, c.verify(p2, data)
+	case ISO7816_CHANGE_REFERENCE:
+		return nil, c.changePIN(p2, data)
+	case ISO7816_GENERATE_KEY:
+		return c.generate(p1, data)
+	case ISO7816_PSO:
+		switch uint16(p1)<<8 | uint16(p2) {
+		case 0x9e9a:
+			// compute digital signature
+			if !c.pw1Sign {
+				return nil, SW_SECURITY_NOT_SATISFIED
+			}
+
+			sig, sw := c.sign(OPENPGP_KEY_SIG, data)
+
+			if sw == SW_OK {
+				c.state.Signatures += 1
+				c.save()
+			}
+
+			return sig, sw
+		case 0x8086:
+			if !c.pw1Other {
+				return nil, SW_SECURITY_NOT_SATISFIED
+			}
+
+			return c.decipher(data)
+		}
+
+		return nil, SW_WRONG_P1P2
+	case ISO7816_INTERNAL_AUTHENTICATE:
+		if !c.pw1Other {
+			return nil, SW_SECURITY_NOT_SATISFIED
+		}
+
+		return c.sign(OPENPGP_KEY_AUT, data)
+	}
+
+	return nil, SW_INS_NOT_SUPPORTED
+}
+
+// parseAPDU splits a command APDU, in short or extended length format, in its
+// header and data fields.
+func parseAPDU(capdu []byte) (hdr []byte, data []byte, err error) {
+	if len(capdu) < 4 {
+		return nil, nil, errors.New("invalid APDU")
+	}
+
+	hdr = capdu[0:4]
+	body := capdu[4:]
+
+	switch {
+	case len(body) <= 1:
+		// no data, optional short Le
+	case body[0] == 0 && len(body) >= 3:
+		// extended length
+		lc := int(binary.BigEndian.Uint16(body[1:3]))
+
+		if len(body) == 3 {
+			// extended Le only
+			break
+		}
+
+		if len(body) < 3+lc {
+			return nil, nil, errors.New("invalid APDU length")
+		}
+
+		data = body[3 : 3+lc]
+	default:
+		lc := int(body[0])
+
+		if len(body) < 1+lc {
+			return nil, nil, errors.New("invalid APDU length")
+		}
+
+		data = body[1 : 1+lc]
+	}
+
+	return
+}
+
+// Handle processes a command APDU and returns the response APDU.
+func (c *openPGPCard) Handle(capdu []byte) (rapdu []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	hdr, data, err := parseAPDU(capdu)
+
+	if err != nil {
+		return []byte{SW_WRONG_LENGTH >> 8, SW_WRONG_LENGTH & 0xff}
+	}
+
+	// command chaining
+	if hdr[0]&0x10 != 0 {
+		if len(c.chain)+len(data) > CCID_MAX_MESSAGE {
+			c.chain = nil
+			return []byte{SW_WRONG_LENGTH >> 8, SW_WRONG_LENGTH & 0xff}
+		}
+
+		c.chain = append(c.chain, data...)
+
+		return []byte{SW_OK >> 8, SW_OK & 0xff}
+	}
+
+	if c.chain != nil {
+		data = append(c.chain, data...)
+		c.chain = nil
+	}
+
+	res, sw := c.process(hdr[1], hdr[2], hdr[3], data)
+
+	return append(res, byte(sw>>8), byte(sw))
+}
@@ -0,0 +1,337 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Ethernet over USB frames can be captured in the libpcap file format,
+// streamed to TCP clients or written on a raw memory card area.
+const (
+	PCAP_MAGIC    = 0xa1b2c3d4
+	PCAP_SNAPLEN  = 65535
+	PCAP_ETHERNET = 1
+
+	PCAP_QUEUE = 256
+	// card writes are buffered in chunks of this size
+	PCAP_CARD_CHUNK = 64 * 1024
+)
+
+var pcapLog = newLogger("pcap")
+
+// pcapSink represents a capture destination.
+type pcapSink struct {
+	records chan []byte
+}
+
+// frameCapture dispatches captured frames to all active sinks.
+type frameCapture struct {
+	sync.Mutex
+
+	sinks map[*pcapSink]bool
+	// TCP port excluded from capture, to avoid capturing the capture
+	// stream itself
+	port uint16
+
+	frames  uint64
+	dropped uint64
+}
+
+// Capture is the Ethernet over USB frame capture.
+var Capture = &frameCapture{sinks: make(map[*pcapSink]bool)}
+
+// pcapCard is the active card capture, if any.
+var pcapCard struct {
+	sync.Mutex
+
+	sink   *pcapSink
+	done   chan bool
+	region *cardRegion
+	size   int64
+}
+
+func pcapHeader() []byte {
+	buf := make([]byte, 24)
+
+	binary.LittleEndian.PutUint32(buf[0:], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(buf[4:], 2)
+	binary.LittleEndian.PutUint16(buf[6:], 4)
+	binary.LittleEndian.PutUint32(buf[16:], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(buf[20:], PCAP_ETHERNET)
+
+	return buf
+}
+
+func pcapRecord(frame []byte, t time.Time) []byte {
+	buf := make([]byte, 16+len(frame))
+
+	binary.LittleEndian.PutUint32(buf[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(frame)))
+	copy(buf[16:], frame)
+
+	return buf
+}
+
+// excluded returns whether a frame belongs to a TCP connection on the
+// excluded port.
+func (c *frameCapture) excluded(frame []byte) bool {
+	if c.port == 0 || len(frame) < header.EthernetMinimumSize {
+		return false
+	}
+
+	var tcp header.TCP
+
+	switch header.Ethernet(frame).Type() {
+	case header.IPv4ProtocolNumber:
+		ip := header.IPv4(frame[header.EthernetMinimumSize:])
+
+		if !ip.IsValid(len(ip)) || ip.Protocol() != uint8(header.TCPProtocolNumber) {
+			return false
+		}
+
+		tcp = ip.Payload()
+	case header.IPv6ProtocolNumber:
+		ip := header.IPv6(frame[header.EthernetMinimumSize:])
+
+		if !ip.IsValid(len(ip)) || ip.NextHeader() != uint8(header.TCPProtocolNumber) {
+			return false
+		}
+
+		tcp = ip.Payload()
+	default:
+		return false
+	}
+
+	if len(tcp) < header.TCPMinimumSize {
+		return false
+	}
+
+	return tcp.SourcePort() == c.port || tcp.DestinationPort() == c.port
+}
+
+// Frame submits a frame to all active sinks, frames are dropped for sinks
+// which are not keeping up.
+func (c *frameCapture) Frame(frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.sinks) == 0 || c.excluded(frame) {
+		return
+	}
+
+	c.frames += 1
+	record := pcapRecord(frame, Now())
+
+	for sink := range c.sinks {
+		select {
+		case sink.records <- record:
+		default:
+			c.dropped += 1
+		}
+	}
+}
+
+func (c *frameCapture) add() (sink *pcapSink) {
+	c.Lock()
+	defer c.Unlock()
+
+	sink = &pcapSink{records: make(chan []byte, PCAP_QUEUE)}
+	c.sinks[sink] = true
+
+	return
+}
+
+func (c *frameCapture) remove(sink *pcapSink) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.sinks, sink)
+	close(sink.records)
+}
+
+func startPcapServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		pcapLog.Fatalf("listener error, %v", err)
+	}
+
+	Capture.Lock()
+	Capture.port = port
+	Capture.Unlock()
+
+	pcapLog.Infof("starting pcap server at %s:%d", addr.String(), port)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			pcapLog.Errorf("error accepting connection, %v", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			sink := Capture.add()
+			defer Capture.remove(sink)
+
+			if _, err := conn.Write(pcapHeader()); err != nil {
+				return
+			}
+
+			for record := range sink.records {
+				if _, err := conn.Write(record); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// capture writes records on a card region until the sink is removed, records
+// are discarded once the region is full.
+func (c *frameCapture) capture(sink *pcapSink, r *cardRegion, done chan bool) {
+	buf := pcapHeader()
+	off := int64(0)
+
+	flush := func() (err error) {
+		if off+int64(len(buf)) > r.Size() {
+			return errors.New("capture area full")
+		}
+
+		if _, err = r.WriteAt(buf, off); err != nil {
+			return
+		}
+
+		off += int64(len(buf))
+		buf = nil
+
+		pcapCard.Lock()
+		pcapCard.size = off
+		pcapCard.Unlock()
+
+		return
+	}
+
+	defer func() {
+		done <- true
+	}()
+
+	for record := range sink.records {
+		if len(buf)+len(record) > PCAP_CARD_CHUNK {
+			if err := flush(); err != nil {
+				pcapLog.Errorf("card capture stopped, %v", err)
+
+				for range sink.records {
+				}
+
+				return
+			}
+		}
+
+		buf = append(buf, record...)
+	}
+
+	if len(buf) > 0 {
+		if err := flush(); err != nil {
+			pcapLog.Errorf("%v", err)
+		}
+	}
+}
+
+func pcapCommand(op string, args []string) (res string) {
+	pcapCard.Lock()
+	active := pcapCard.sink != nil
+	pcapCard.Unlock()
+
+	switch {
+	case op == "start" && len(args) == 3:
+		if active {
+			return "capture already active"
+		}
+
+		n, err := strconv.Atoi(args[0])
+
+		if err != nil {
+			return fmt.Sprintf("invalid card: %v", err)
+		}
+
+		offset, err := strconv.ParseInt(args[1], 16, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid offset: %v", err)
+		}
+
+		size, err := strconv.ParseInt(args[2], 10, 64)
+
+		if err != nil {
+			return fmt.Sprintf("invalid size: %v", err)
+		}
+
+		card, err := target.Card(n)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		pcapCard.Lock()
+		pcapCard.region = &cardRegion{card: card, offset: offset, size: size * 1024 * 1024}
+		pcapCard.sink = Capture.add()
+		pcapCard.done = make(chan bool)
+		pcapCard.size = 0
+		pcapCard.Unlock()
+
+		go Capture.capture(pcapCard.sink, pcapCard.region, pcapCard.done)
+
+		return fmt.Sprintf("capturing to card %d at %#x", n, offset)
+	case op == "stop" && len(args) == 0:
+		if !active {
+			return "no active capture"
+		}
+
+		pcapCard.Lock()
+		sink := pcapCard.sink
+		pcapCard.Unlock()
+
+		Capture.remove(sink)
+		<-pcapCard.done
+
+		pcapCard.Lock()
+		defer pcapCard.Unlock()
+
+		pcapCard.sink = nil
+
+		return fmt.Sprintf("%d bytes written at %#x", pcapCard.size, pcapCard.region.offset)
+	case op == "status" && len(args) == 0:
+		Capture.Lock()
+		defer Capture.Unlock()
+
+		return fmt.Sprintf("sinks: %d frames: %d dropped: %d card: %v", len(Capture.sinks), Capture.frames, Capture.dropped, active)
+	}
+
+	return "invalid arguments"
+}
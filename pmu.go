@@ -0,0 +1,100 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The Cortex-A7 Performance Monitor Unit cycle counter counts CPU clock
+// cycles, providing a far finer resolution than the runtime clock for short
+// benchmarks. The counter is 32 bits wide and wraps within seconds, wraps
+// are accounted for using the runtime clock, which also stands in for the
+// counter under emulation.
+
+// defined in pmu_arm.s
+func pmu_enable()
+func read_pmccntr() uint32
+
+var pmu struct {
+	sync.Once
+	enabled bool
+}
+
+// cycleCounter enables, on first use, the cycle counter and returns whether
+// it is available.
+func cycleCounter() bool {
+	pmu.Do(func() {
+		if !target.Native() {
+			return
+		}
+
+		pmu_enable()
+		pmu.enabled = true
+	})
+
+	return pmu.enabled
+}
+
+// cycleMark represents a benchmark starting point.
+type cycleMark struct {
+	cycles uint32
+	at     time.Time
+}
+
+func markCycles() (m cycleMark) {
+	if cycleCounter() {
+		m.cycles = read_pmccntr()
+	}
+
+	m.at = time.Now()
+
+	return
+}
+
+// Since returns the CPU cycles, and time, elapsed since the mark.
+func (m cycleMark) Since() (cycles uint64, elapsed time.Duration) {
+	var delta uint32
+
+	if cycleCounter() {
+		delta = read_pmccntr() - m.cycles
+	}
+
+	elapsed = time.Since(m.at)
+	estimate := elapsed.Seconds() * float64(target.Freq())
+
+	if !cycleCounter() {
+		return uint64(estimate), elapsed
+	}
+
+	// add the counter wraps which best match the runtime clock estimate
+	wraps := math.Round((estimate - float64(delta)) / (1 << 32))
+
+	if wraps < 0 {
+		wraps = 0
+	}
+
+	return uint64(wraps)*(1<<32) + uint64(delta), elapsed
+}
+
+// CyclesPerOp returns the average CPU cycles taken by the argument function
+// over the argument number of runs, along with the time taken by all runs.
+func CyclesPerOp(ops int, fn func()) (cycles float64, elapsed time.Duration) {
+	m := markCycles()
+
+	for i := 0; i < ops; i++ {
+		fn()
+	}
+
+	total, elapsed := m.Since()
+
+	return float64(total) / float64(ops), elapsed
+}
@@ -0,0 +1,28 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func pmu_enable()
+TEXT ·pmu_enable(SB),$0
+	// Performance Monitor Control Register, ARM Architecture Reference
+	// Manual ARMv7-A and ARMv7-R edition
+	MRC	15, 0, R0, C9, C12, 0
+	BIC	$0x8, R0	// count every cycle (PMCR.D)
+	ORR	$0x5, R0	// reset cycle counter (PMCR.C), enable (PMCR.E)
+	MCR	15, 0, R0, C9, C12, 0
+	MOVW	$0x80000000, R0
+	MCR	15, 0, R0, C9, C12, 1	// enable cycle counter (PMCNTENSET.C)
+	WORD	$0xf57ff06f	// isb sy
+	RET
+
+// func read_pmccntr() uint32
+TEXT ·read_pmccntr(SB),$0-4
+	MRC	15, 0, R0, C9, C13, 0
+	MOVW	R0, ret+0(FP)
+	RET
@@ -0,0 +1,280 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The power-on self-test (POST) is a fast subset of checks, suitable for
+// production units at each boot, separate from the benchmark-heavy example
+// tests. It is enabled with the `post` setting, replacing the boot tests, and
+// its results are reported as test results (see results.go) while the
+// `post_led` LED is turned on, on success, or kept blinking on failure.
+const (
+	POST_DEADLINE = 2 * time.Second
+
+	// RNG health tests (NIST SP 800-90B 4.4) on 8-bit samples, the cutoffs
+	// assume a conservative min-entropy of 4 bits per sample and a false
+	// positive probability of 2^-20.
+	POST_RNG_SAMPLES    = 4096
+	POST_RNG_REPETITION = 6
+	POST_RNG_WINDOW     = 512
+	POST_RNG_PROPORTION = 62
+
+	POST_LED_BLINK = 250 * time.Millisecond
+
+	// RNGB status
+	RNG_SR       = 0x0228400c
+	RNG_SR_ST_PF = 21
+	RNG_SR_ERR   = 16
+	RNG_SR_SDN   = 5
+
+	// On-Chip OTP Controller
+	OCOTP_CTRL       = 0x021bc000
+	OCOTP_CTRL_ERROR = 9
+	// SEC_CONFIG[1] fuse shadow register
+	OCOTP_CFG5        = 0x021bc460
+	CFG5_SEC_CONFIG_1 = 1
+)
+
+var postLog = newLogger("post")
+
+type postCheck struct {
+	name      string
+	supported bool
+	fn        func() (string, error)
+}
+
+func postChecks() []postCheck {
+	return []postCheck{
+		{"post_rng", true, postRNG},
+		{"post_kat", true, postKAT},
+		{"post_storage", target.Native(), postStorage},
+		{"post_fuses", imx6.Native, postFuses},
+	}
+}
+
+// postRNG verifies the RNGB status and applies the SP 800-90B repetition
+// count and adaptive proportion health tests to random output.
+func postRNG() (res string, err error) {
+	if target.DCP() {
+		switch {
+		case reg.Get(RNG_SR, RNG_SR_ERR, 1) != 0:
+			return "", errors.New("RNGB error")
+		case reg.Get(RNG_SR, RNG_SR_ST_PF, 1) != 0:
+			return "", errors.New("RNGB self-test failure")
+		case reg.Get(RNG_SR, RNG_SR_SDN, 1) != 1:
+			return "", errors.New("RNGB not seeded")
+		}
+
+		res = "RNGB ok, "
+	}
+
+	buf := make([]byte, POST_RNG_SAMPLES)
+
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	run := 1
+	maxRun := 1
+
+	for i := 1; i < len(buf); i++ {
+		if buf[i] != buf[i-1] {
+			run = 1
+			continue
+		}
+
+		if run += 1; run > maxRun {
+			maxRun = run
+		}
+
+		if run >= POST_RNG_REPETITION {
+			return "", fmt.Errorf("repetition count test failure (%#x repeated %d times)", buf[i], run)
+		}
+	}
+
+	maxCount := 0
+
+	for w := 0; w+POST_RNG_WINDOW <= len(buf); w += POST_RNG_WINDOW {
+		count := bytes.Count(buf[w+1:w+POST_RNG_WINDOW], buf[w:w+1]) + 1
+
+		if count > maxCount {
+			maxCount = count
+		}
+
+		if count >= POST_RNG_PROPORTION {
+			return "", fmt.Errorf("adaptive proportion test failure (%#x %d times in %d samples)", buf[w], count, POST_RNG_WINDOW)
+		}
+	}
+
+	return res + fmt.Sprintf("%d samples, max repetition %d, max proportion %d/%d", len(buf), maxRun, maxCount, POST_RNG_WINDOW), nil
+}
+
+// postKAT executes the known answer tests (see kat.go).
+func postKAT() (res string, err error) {
+	n, err := runKATs()
+	return fmt.Sprintf("%d known answer tests", n), err
+}
+
+// postStorage verifies that the storage card is present and readable.
+func postStorage() (res string, err error) {
+	card, err := storageCard()
+
+	if err != nil {
+		return
+	}
+
+	if _, err = card.Read(0, int64(card.BlockSize())); err != nil {
+		return
+	}
+
+	return fmt.Sprintf("card %d, %d MiB", conf.Int("storage_card", 0), int64(card.Blocks())*int64(card.BlockSize())/(1024*1024)), nil
+}
+
+// postFuses verifies the OTP controller state, the unique ID fuses and the
+// consistency of the security configuration with the SNVS state: closed
+// units are only ever booted by HAB with SNVS in trusted or secure state.
+func postFuses() (res string, err error) {
+	if reg.Get(OCOTP_CTRL, OCOTP_CTRL_ERROR, 1) != 0 {
+		return "", errors.New("OCOTP error")
+	}
+
+	id := imx6.UniqueID()
+
+	if bytes.Equal(id[:], make([]byte, len(id))) || bytes.Equal(id[:], bytes.Repeat([]byte{0xff}, len(id))) {
+		return "", fmt.Errorf("invalid unique ID %x", id)
+	}
+
+	closed := reg.Get(OCOTP_CFG5, CFG5_SEC_CONFIG_1, 1) == 1
+	snvs := imx6.DCP.SNVS()
+
+	switch {
+	case closed && !snvs:
+		return "", errors.New("closed security configuration without SNVS trusted state")
+	case !closed && conf.Bool("post_closed", false):
+		return "", errors.New("open security configuration")
+	}
+
+	state := "open"
+
+	if closed {
+		state = "closed"
+	}
+
+	return fmt.Sprintf("unique ID %x, security configuration %s, SNVS: %v", id, state, snvs), nil
+}
+
+// runPOST performs all supported POST checks, reporting their results and
+// signaling the outcome on the `post_led` LED.
+func runPOST() (results []testResult) {
+	start := time.Now()
+	failed := 0
+
+	for _, c := range postChecks() {
+		if !c.supported {
+			continue
+		}
+
+		t := time.Now()
+		res, err := c.fn()
+
+		results = append(results, testResult{name: c.name, err: err, duration: time.Since(t)})
+
+		if err != nil {
+			failed += 1
+			postLog.Errorf("%-12s FAIL %v", c.name, err)
+		} else {
+			postLog.Infof("%-12s PASS %s", c.name, res)
+		}
+	}
+
+	duration := time.Since(start)
+
+	if duration > POST_DEADLINE {
+		failed += 1
+		results = append(results, testResult{name: "post_deadline", err: fmt.Errorf("completed in %v", duration)})
+	}
+
+	postLog.Infof("%d checks, %d failed (%v)", len(results), failed, duration)
+
+	reportResults(results, duration)
+	setPOSTLED(failed == 0)
+
+	return
+}
+
+// postBlink stops the failure indication
+var postBlink struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// setPOSTLED turns the `post_led` LED on, when passed, or blinks it until
+// the next run.
+func setPOSTLED(passed bool) {
+	led := conf.String("post_led", "white")
+
+	postBlink.Lock()
+	defer postBlink.Unlock()
+
+	if postBlink.stop != nil {
+		close(postBlink.stop)
+		postBlink.stop = nil
+	}
+
+	if passed {
+		target.LED(led, true)
+		return
+	}
+
+	stop := make(chan struct{})
+	postBlink.stop = stop
+
+	go func() {
+		state := false
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(POST_LED_BLINK):
+				state = !state
+				target.LED(led, state)
+			}
+		}
+	}()
+}
+
+func postCommand() string {
+	var buf strings.Builder
+
+	for _, r := range runPOST() {
+		status := "PASS"
+
+		if r.err != nil {
+			status = "FAIL " + r.err.Error()
+		}
+
+		fmt.Fprintf(&buf, "%-16s %8.3fms %s\n", r.name, float64(r.duration.Microseconds())/1000, status)
+	}
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,256 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The SoC integrated Power Management Unit (anatop) LDO regulators are fed by
+// the board supplies, including USB VBUS on bus powered targets: their
+// brown-out detectors, which flag outputs falling below the target voltage
+// minus a programmable offset, are therefore the earliest indication of
+// marginal power (p891, 18.7 PMU Memory Map/Register Definition, IMX6ULLRM).
+const (
+	PMU_REG_1P1  = 0x020c8110
+	PMU_REG_3P0  = 0x020c8120
+	PMU_REG_2P5  = 0x020c8130
+	PMU_REG_CORE = 0x020c8140
+
+	REG_ENABLE_LINREG = 0
+	REG_ENABLE_BO     = 1
+	REG_BO_OFFSET     = 4
+	REG_OUTPUT_TRG    = 8
+	REG_BO_VDD        = 16
+	REG_OK_VDD        = 17
+
+	CORE_REG0_TARG = 0
+	CORE_REG2_TARG = 18
+	// target voltage values for power gated and bypassed regulators
+	CORE_TARG_OFF    = 0x00
+	CORE_TARG_BYPASS = 0x1f
+
+	USB_ANALOG_USB1_VBUS_DETECT_STAT = 0x020c81c0
+	VBUS_DETECT_STAT_VBUS_VALID      = 3
+
+	// voltage step for all regulators
+	PMU_STEP_MV = 25
+)
+
+// ldo represents a PMU LDO regulator with brown-out detection.
+type ldo struct {
+	name string
+	addr uint32
+	// output voltage at target value 0
+	base int
+}
+
+var powerLog = newLogger("power")
+
+var ldoRegulators = []ldo{
+	{"LDO_2P5", PMU_REG_2P5, 2100},
+	{"LDO_1P1", PMU_REG_1P1, 700},
+	{"LDO_3P0 (USB)", PMU_REG_3P0, 2625},
+}
+
+// powerRail represents a regulator reading.
+type powerRail struct {
+	name  string
+	mV    int
+	state string
+	// marginal power
+	warn bool
+}
+
+// powerMonitor tracks power warnings.
+var powerMonitor struct {
+	sync.Mutex
+
+	polling  bool
+	warnings map[string]int
+	active   map[string]bool
+}
+
+func coreRail(name string, targ uint32) (r powerRail) {
+	r.name = name
+
+	switch targ {
+	case CORE_TARG_OFF:
+		r.state = "power gated"
+	case CORE_TARG_BYPASS:
+		r.state = "bypass"
+	default:
+		r.mV = 700 + int(targ)*PMU_STEP_MV
+		r.state = "ok"
+	}
+
+	return
+}
+
+// readPower returns the PMU regulator target voltages and status, along with
+// the warnings for marginal power.
+func readPower() (rails []powerRail, warnings []string) {
+	for _, l := range ldoRegulators {
+		val := reg.Read(l.addr)
+
+		r := powerRail{
+			name: l.name,
+			mV:   l.base + int((val>>REG_OUTPUT_TRG)&0x1f)*PMU_STEP_MV,
+		}
+
+		switch {
+		case val&(1<<REG_ENABLE_LINREG) == 0:
+			r.state = "disabled"
+		case val&(1<<REG_BO_VDD) != 0:
+			r.state = "brown-out"
+			r.warn = true
+		case val&(1<<REG_OK_VDD) == 0:
+			r.state = "not regulating"
+			r.warn = true
+		default:
+			r.state = "ok"
+		}
+
+		if r.warn {
+			warnings = append(warnings, fmt.Sprintf("%s %s", r.name, r.state))
+		}
+
+		if val&(1<<REG_ENABLE_BO) != 0 {
+			offset := int((val>>REG_BO_OFFSET)&0b111) * PMU_STEP_MV
+			r.state += fmt.Sprintf(" (brown-out at -%d mV)", offset)
+		}
+
+		rails = append(rails, r)
+	}
+
+	core := reg.Read(PMU_REG_CORE)
+
+	rails = append(rails,
+		coreRail("LDO_ARM", (core>>CORE_REG0_TARG)&0x1f),
+		coreRail("LDO_SOC", (core>>CORE_REG2_TARG)&0x1f))
+
+	if conf.Bool("usb", true) && target.USB() && reg.Get(USB_ANALOG_USB1_VBUS_DETECT_STAT, VBUS_DETECT_STAT_VBUS_VALID, 1) == 0 {
+		warnings = append(warnings, "USB1 VBUS below valid threshold")
+	}
+
+	return
+}
+
+// checkPower logs warnings as they appear and clear.
+func checkPower() {
+	_, warnings := readPower()
+
+	powerMonitor.Lock()
+	defer powerMonitor.Unlock()
+
+	if powerMonitor.warnings == nil {
+		powerMonitor.warnings = make(map[string]int)
+	}
+
+	active := make(map[string]bool)
+
+	for _, w := range warnings {
+		active[w] = true
+
+		if !powerMonitor.active[w] {
+			powerMonitor.warnings[w] += 1
+			powerLog.Warnf("%s", w)
+		}
+	}
+
+	for w := range powerMonitor.active {
+		if !active[w] {
+			powerLog.Infof("%s cleared", w)
+		}
+	}
+
+	powerMonitor.active = active
+}
+
+// startPowerMonitor enables brown-out detection, logs the regulator status
+// and, when enabled, polls it for warnings.
+func startPowerMonitor() {
+	if !target.Native() {
+		return
+	}
+
+	for _, l := range ldoRegulators {
+		reg.Set(l.addr, REG_ENABLE_BO)
+	}
+
+	rails, _ := readPower()
+
+	for _, r := range rails {
+		powerLog.Infof("%-14s %4d mV %s", r.name, r.mV, r.state)
+	}
+
+	checkPower()
+
+	interval := conf.Int("power_poll_interval", 1000)
+
+	if interval <= 0 {
+		return
+	}
+
+	powerMonitor.Lock()
+	powerMonitor.polling = true
+	powerMonitor.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(interval) * time.Millisecond)
+			checkPower()
+		}
+	}()
+}
+
+func powerCommand() string {
+	var buf bytes.Buffer
+
+	if !target.Native() {
+		return "unsupported under emulation"
+	}
+
+	rails, warnings := readPower()
+
+	for _, r := range rails {
+		fmt.Fprintf(&buf, "%-14s %4d mV %s\n", r.name, r.mV, r.state)
+	}
+
+	for _, w := range warnings {
+		fmt.Fprintf(&buf, "WARNING: %s\n", w)
+	}
+
+	powerMonitor.Lock()
+	defer powerMonitor.Unlock()
+
+	if !powerMonitor.polling {
+		buf.WriteString("polling disabled\n")
+	}
+
+	var seen []string
+
+	for w := range powerMonitor.warnings {
+		seen = append(seen, w)
+	}
+
+	sort.Strings(seen)
+
+	for _, w := range seen {
+		fmt.Fprintf(&buf, "%s: %d times\n", w, powerMonitor.warnings[w])
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,259 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/f-secure-foundry/tamago-example/internal/mldsa"
+	"github.com/f-secure-foundry/tamago-example/internal/mlkem"
+)
+
+// The post-quantum benchmark answers whether the target can perform PQC
+// handshakes by timing ML-KEM-768 (FIPS 203) and ML-DSA-65 (FIPS 204), from
+// the pure Go internal/mlkem and internal/mldsa packages, against the X25519
+// and ECDSA P-256 operations they would replace.
+
+var pqLog = newLogger("pq")
+
+// pqOp represents a benchmarked operation.
+type pqOp struct {
+	name string
+	fn   func() error
+}
+
+// pqStats holds the measurements of a benchmarked operation.
+type pqStats struct {
+	min   time.Duration
+	avg   time.Duration
+	max   time.Duration
+	alloc uint64
+	stack uint64
+}
+
+// measurePQ executes the operation on a dedicated goroutine, so that its
+// stack growth can be measured, returning latency and memory statistics.
+func measurePQ(op pqOp, iterations int) (s pqStats, err error) {
+	var m0, m1 runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&m0)
+
+	done := make(chan error)
+
+	go func() {
+		var total time.Duration
+
+		for i := 0; i < iterations; i++ {
+			start := time.Now()
+
+			if err := op.fn(); err != nil {
+				done <- err
+				return
+			}
+
+			d := time.Since(start)
+			total += d
+
+			if s.min == 0 || d < s.min {
+				s.min = d
+			}
+
+			if d > s.max {
+				s.max = d
+			}
+		}
+
+		s.avg = total / time.Duration(iterations)
+		runtime.ReadMemStats(&m1)
+
+		done <- nil
+	}()
+
+	if err = <-done; err != nil {
+		return
+	}
+
+	s.alloc = (m1.TotalAlloc - m0.TotalAlloc) / uint64(iterations)
+
+	if m1.StackInuse > m0.StackInuse {
+		s.stack = m1.StackInuse - m0.StackInuse
+	}
+
+	return
+}
+
+func pqOps() (ops []pqOp, err error) {
+	dk, err := mlkem.GenerateKey()
+
+	if err != nil {
+		return
+	}
+
+	ek := dk.EncapsulationKey()
+	key, ct, err := ek.Encapsulate()
+
+	if err != nil {
+		return
+	}
+
+	sk, err := mldsa.GenerateKey()
+
+	if err != nil {
+		return
+	}
+
+	msg := sha256.Sum256([]byte(banner))
+	sig, err := sk.Sign(msg[:], nil)
+
+	if err != nil {
+		return
+	}
+
+	scalar := make([]byte, curve25519.ScalarSize)
+	rand.Read(scalar)
+
+	peer, err := curve25519.X25519(scalar, curve25519.Basepoint)
+
+	if err != nil {
+		return
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, msg[:])
+
+	if err != nil {
+		return
+	}
+
+	ops = []pqOp{
+		{"ml-kem-768 keygen", func() (err error) {
+			_, err = mlkem.GenerateKey()
+			return
+		}},
+		{"ml-kem-768 encaps", func() (err error) {
+			_, _, err = ek.Encapsulate()
+			return
+		}},
+		{"ml-kem-768 decaps", func() error {
+			res, err := dk.Decapsulate(ct)
+
+			if err == nil && !bytes.Equal(res, key) {
+				err = errors.New("shared key mismatch")
+			}
+
+			return err
+		}},
+		{"ml-dsa-65 keygen", func() (err error) {
+			_, err = mldsa.GenerateKey()
+			return
+		}},
+		{"ml-dsa-65 sign", func() (err error) {
+			_, err = sk.Sign(msg[:], nil)
+			return
+		}},
+		{"ml-dsa-65 verify", func() error {
+			return mldsa.Verify(sk.PublicKey(), msg[:], nil, sig)
+		}},
+		{"x25519 keygen", func() (err error) {
+			_, err = curve25519.X25519(scalar, curve25519.Basepoint)
+			return
+		}},
+		{"x25519 shared", func() (err error) {
+			_, err = curve25519.X25519(scalar, peer)
+			return
+		}},
+		{"ecdsa-p256 sign", func() (err error) {
+			_, _, err = ecdsa.Sign(rand.Reader, ecKey, msg[:])
+			return
+		}},
+		{"ecdsa-p256 verify", func() error {
+			if !ecdsa.Verify(&ecKey.PublicKey, msg[:], r, s) {
+				return errors.New("invalid signature")
+			}
+
+			return nil
+		}},
+	}
+
+	return
+}
+
+// TestPQ benchmarks post-quantum key encapsulation and signatures, reporting
+// operation latency, memory footprint and the cryptographic cost of a
+// handshake compared with classical algorithms.
+func TestPQ() (err error) {
+	iterations := conf.Int("pq_iterations", 20)
+
+	if iterations <= 0 {
+		return fmt.Errorf("invalid iterations %d", iterations)
+	}
+
+	ops, err := pqOps()
+
+	if err != nil {
+		return
+	}
+
+	pqLog.Infof("%d iterations per operation", iterations)
+
+	stats := make(map[string]pqStats)
+
+	for _, op := range ops {
+		s, err := measurePQ(op, iterations)
+
+		if err != nil {
+			return fmt.Errorf("%s error, %v", op.name, err)
+		}
+
+		stats[op.name] = s
+
+		pqLog.Infof("%-18s min %10s avg %10s max %10s, %6d bytes allocated/op, stack +%d KiB",
+			op.name, s.min.Round(time.Microsecond), s.avg.Round(time.Microsecond), s.max.Round(time.Microsecond), s.alloc, s.stack/1024)
+	}
+
+	pqLog.Infof("ml-kem-768 encapsulation key %d, ciphertext %d, expanded keys %d bytes",
+		mlkem.EncapsulationKeySize, mlkem.CiphertextSize, unsafe.Sizeof(mlkem.DecapsulationKey{})+unsafe.Sizeof(mlkem.EncapsulationKey{}))
+	pqLog.Infof("ml-dsa-65 public key %d, signature %d, expanded private key %d bytes",
+		mldsa.PublicKeySize, mldsa.SignatureSize, unsafe.Sizeof(mldsa.PrivateKey{})+unsafe.Sizeof(mldsa.PublicKey{}))
+
+	sum := func(names ...string) (d time.Duration) {
+		for _, name := range names {
+			d += stats[name].avg
+		}
+
+		return
+	}
+
+	// key exchange on both peers, server signature and client verification
+	pq := sum("ml-kem-768 keygen", "ml-kem-768 encaps", "ml-kem-768 decaps", "ml-dsa-65 sign", "ml-dsa-65 verify")
+	classic := 2*sum("x25519 keygen", "x25519 shared") + sum("ecdsa-p256 sign", "ecdsa-p256 verify")
+
+	pqLog.Infof("handshake cryptography ml-kem-768/ml-dsa-65 %s (%d bytes on the wire), x25519/ecdsa-p256 %s (%.1fx)",
+		pq.Round(time.Microsecond), mlkem.EncapsulationKeySize+mlkem.CiphertextSize+mldsa.PublicKeySize+mldsa.SignatureSize,
+		classic.Round(time.Microsecond), float64(pq)/float64(classic))
+
+	return
+}
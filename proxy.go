@@ -0,0 +1,142 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+var proxyLog = newLogger("proxy")
+
+var sealedCert struct {
+	sync.Once
+
+	cert tls.Certificate
+	err  error
+}
+
+// sealedCertificate returns the TLS certificate for services terminating TLS
+// on the device, its private key is kept on the memory card as a DCP sealed
+// blob (see secrets.go) and generated on first use.
+func sealedCertificate(addr tcpip.Address) (tls.Certificate, error) {
+	sealedCert.Do(func() {
+		var sealed bool
+
+		payload, err := loadSealed("tls", func() ([]byte, error) {
+			TLSCert, TLSKey, err := generateTLSCerts(net.ParseIP(addr.String()))
+			sealed = true
+
+			return append(TLSCert, TLSKey...), err
+		})
+
+		if err != nil {
+			sealedCert.err = err
+			return
+		}
+
+		if sealed {
+			proxyLog.Infof("generated and sealed TLS key")
+		} else {
+			proxyLog.Infof("unsealed TLS key")
+		}
+
+		// the payload holds both the certificate and key PEM blocks
+		sealedCert.cert, sealedCert.err = tls.X509KeyPair(payload, payload)
+
+		for i := range payload {
+			payload[i] = 0
+		}
+	})
+
+	return sealedCert.cert, sealedCert.err
+}
+
+// startProxy terminates TLS connections and forwards the requests, in
+// plaintext HTTP, to the upstream server.
+func startProxy(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID, upstream string) {
+	host, p, err := net.SplitHostPort(upstream)
+
+	if err != nil {
+		proxyLog.Warnf("invalid upstream %s, %v", upstream, err)
+		return
+	}
+
+	upstreamPort, err := strconv.ParseUint(p, 10, 16)
+	upstreamAddr := net.ParseIP(host)
+
+	if ip4 := upstreamAddr.To4(); ip4 != nil {
+		upstreamAddr = ip4
+	}
+
+	if err != nil || upstreamAddr == nil {
+		proxyLog.Warnf("invalid upstream %s", upstream)
+		return
+	}
+
+	certificate, err := sealedCertificate(addr)
+
+	if err != nil {
+		proxyLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		proxyLog.Fatalf("listener error, %v", err)
+	}
+
+	target := &url.URL{
+		Scheme: "http",
+		Host:   upstream,
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	// upstream connections are established on the same network stack
+	proxy.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			raddr := tcpip.FullAddress{Addr: tcpip.Address(upstreamAddr), Port: uint16(upstreamPort)}
+			return gonet.DialContextTCP(ctx, s, raddr, networkProtocol(raddr.Addr))
+		},
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		proxyLog.Errorf("%s %s error, %v", r.Method, r.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", addr, port),
+		Handler: proxy,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	proxyLog.Infof("starting TLS reverse proxy at %s:%d to %s", addr, port, upstream)
+
+	err = srv.ServeTLS(listener, "", "")
+
+	proxyLog.Fatalf("server returned unexpectedly, %v", err)
+}
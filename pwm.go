@@ -0,0 +1,334 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Pulse Width Modulation registers
+// (Pulse Width Modulation (PWM), IMX6ULLRM).
+const (
+	PWM1_BASE = 0x02080000
+	PWM2_BASE = 0x02084000
+	PWM3_BASE = 0x02088000
+	PWM4_BASE = 0x0208c000
+
+	PWMx_PWMCR     = 0x00
+	PWMCR_STOPEN   = 25
+	PWMCR_DOZEN    = 24
+	PWMCR_WAITEN   = 23
+	PWMCR_DBGEN    = 22
+	PWMCR_POUTC    = 18
+	PWMCR_CLKSRC   = 16
+	PWMCR_PRESCALE = 4
+	PWMCR_SWR      = 3
+	PWMCR_EN       = 0
+
+	PWMx_PWMSR   = 0x04
+	PWMSR_FWE    = 6
+	PWMSR_CMP    = 5
+	PWMSR_ROV    = 4
+	PWMSR_FIFOAV = 0
+
+	PWMx_PWMSAR = 0x0c
+	PWMx_PWMPR  = 0x10
+	PWMx_PWMCNR = 0x14
+
+	// ipg_clk clock source
+	PWM_CLKSRC_IPG = 0b01
+	// ipg_clk frequency with the default clock tree configuration
+	PWM_IPG_FREQ = 66000000
+
+	PWM_FIFO_SIZE     = 4
+	PWM_MAX_PRESCALER = 4096
+	PWM_MAX_PERIOD    = 0xfffe
+
+	// PWM1-PWM4 clock gates are CCGR4 CG8-CG11
+	CCM_CCGR4 = 0x020c4078
+	CCGR4_CG8 = 16
+
+	// GPIO1_IO08 pad, ALT1 is PWM1_OUT
+	IOMUXC_SW_MUX_CTL_PAD_GPIO1_IO08 = 0x020e007c
+	GPIO1_IO08_MODE_PWM1_OUT         = 1
+)
+
+var pwmLog = newLogger("imx6_pwm")
+
+var pwmBases = map[int]uint32{
+	1: PWM1_BASE,
+	2: PWM2_BASE,
+	3: PWM3_BASE,
+	4: PWM4_BASE,
+}
+
+// pwmOutput describes the board LED driven by the PWM example, either through
+// a pad muxed to the PWM output or, when the LED pad lacks a PWM function, by
+// mirroring the PWM output state on the LED GPIO.
+var pwmOutput struct {
+	// PWM instance
+	port int
+
+	// pad mux control register and PWM output mode
+	mux  uint32
+	mode uint32
+
+	// LED name for mirroring
+	led string
+}
+
+// pwm represents a PWM controller, with the output set at counter rollover
+// and cleared at compare.
+type pwm struct {
+	sync.Mutex
+
+	base uint32
+	n    int
+
+	// counter period and current sample
+	period uint32
+	sample uint32
+
+	// output mirroring
+	exit chan bool
+	done chan bool
+}
+
+var pwmLED *pwm
+
+// Init resets the controller and starts it at the argument frequency, with a
+// 0% duty cycle.
+func (hw *pwm) Init(freq uint32) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if freq == 0 {
+		return errors.New("invalid frequency")
+	}
+
+	reg.SetN(CCM_CCGR4, CCGR4_CG8+(hw.n-1)*2, 0b11, 0b11)
+
+	reg.Write(hw.base+PWMx_PWMCR, 1<<PWMCR_SWR)
+
+	if !reg.WaitFor(100*time.Millisecond, hw.base+PWMx_PWMCR, PWMCR_SWR, 1, 0) {
+		return errors.New("reset timeout")
+	}
+
+	// period (in counts) = PWMPR + 2
+	counts := PWM_IPG_FREQ / freq
+	prescaler := counts/(PWM_MAX_PERIOD+2) + 1
+
+	if counts < 4 || prescaler > PWM_MAX_PRESCALER {
+		return fmt.Errorf("unsupported frequency %d Hz", freq)
+	}
+
+	hw.period = counts/prescaler - 2
+	hw.sample = 0
+
+	reg.Write(hw.base+PWMx_PWMPR, hw.period)
+	reg.Write(hw.base+PWMx_PWMSAR, 0)
+
+	reg.Write(hw.base+PWMx_PWMCR,
+		1<<PWMCR_WAITEN|1<<PWMCR_DBGEN|
+			PWM_CLKSRC_IPG<<PWMCR_CLKSRC|
+			(prescaler-1)<<PWMCR_PRESCALE)
+
+	reg.Set(hw.base+PWMx_PWMCR, PWMCR_EN)
+
+	return
+}
+
+// Duty sets the duty cycle, in percent, from the next period.
+func (hw *pwm) Duty(duty float64) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if duty < 0 || duty > 100 {
+		return errors.New("invalid duty cycle")
+	}
+
+	sample := uint32(float64(hw.period+2) * duty / 100)
+	timeout := time.Now().Add(100 * time.Millisecond)
+
+	// each sample is consumed at rollover, wait for room in the FIFO
+	for reg.Get(hw.base+PWMx_PWMSR, PWMSR_FIFOAV, 0b111) >= PWM_FIFO_SIZE {
+		if time.Now().After(timeout) {
+			return errors.New("FIFO timeout")
+		}
+
+		runtime.Gosched()
+	}
+
+	reg.Write(hw.base+PWMx_PWMSAR, sample)
+	hw.sample = sample
+
+	return
+}
+
+// Disable stops the controller.
+func (hw *pwm) Disable() {
+	hw.Lock()
+	defer hw.Unlock()
+
+	reg.Clear(hw.base+PWMx_PWMCR, PWMCR_EN)
+}
+
+// mirror drives the argument LED according to the PWM output state, which is
+// derived from the counter value as the PWM interrupt is not serviced.
+func (hw *pwm) mirror(led string) {
+	var on bool
+
+	defer func() {
+		target.LED(led, false)
+		hw.done <- true
+	}()
+
+	for {
+		select {
+		case <-hw.exit:
+			return
+		default:
+		}
+
+		state := reg.Read(hw.base+PWMx_PWMCNR) < hw.sample
+
+		if state != on {
+			target.LED(led, state)
+			on = state
+		}
+
+		runtime.Gosched()
+	}
+}
+
+// pwmStart initializes the board LED PWM output at the argument frequency.
+func pwmStart(freq uint32) (hw *pwm, err error) {
+	if pwmLED != nil {
+		if err = pwmLED.Init(freq); err != nil {
+			return
+		}
+
+		return pwmLED, nil
+	}
+
+	base, ok := pwmBases[pwmOutput.port]
+
+	if !ok {
+		return nil, errors.New("PWM output not available on this board")
+	}
+
+	hw = &pwm{
+		base: base,
+		n:    pwmOutput.port,
+	}
+
+	if err = hw.Init(freq); err != nil {
+		return nil, err
+	}
+
+	if pwmOutput.mux != 0 {
+		reg.SetN(pwmOutput.mux, 0, 0b1111, pwmOutput.mode)
+	} else if pwmOutput.led != "" {
+		hw.exit = make(chan bool)
+		hw.done = make(chan bool)
+
+		go hw.mirror(pwmOutput.led)
+	}
+
+	pwmLED = hw
+
+	return
+}
+
+func pwmStop() {
+	if pwmLED == nil {
+		return
+	}
+
+	if pwmLED.exit != nil {
+		pwmLED.exit <- true
+		<-pwmLED.done
+	}
+
+	pwmLED.Disable()
+	pwmLED = nil
+}
+
+// TestPWM fades the board LED in and out through the PWM controller.
+func TestPWM() (err error) {
+	freq := uint32(conf.Int("pwm_frequency", 1000))
+	fade := time.Duration(conf.Int("pwm_fade", 2000)) * time.Millisecond
+
+	hw, err := pwmStart(freq)
+
+	if err != nil {
+		return
+	}
+
+	defer pwmStop()
+
+	pwmLog.Infof("PWM%d @ %d Hz, period %d counts, fading over %s", hw.n, freq, hw.period+2, fade)
+
+	const steps = 100
+	step := fade / (2 * steps)
+
+	for i := 0; i <= 2*steps; i++ {
+		duty := i
+
+		if i > steps {
+			duty = 2*steps - i
+		}
+
+		if err = hw.Duty(float64(duty)); err != nil {
+			return
+		}
+
+		time.Sleep(step)
+	}
+
+	return
+}
+
+func pwmCommand(arg1 string, arg2 string) (res string) {
+	freq, err := strconv.ParseUint(arg1, 10, 32)
+
+	if err != nil {
+		return fmt.Sprintf("invalid frequency: %v", err)
+	}
+
+	duty, err := strconv.ParseFloat(arg2, 64)
+
+	if err != nil {
+		return fmt.Sprintf("invalid duty cycle: %v", err)
+	}
+
+	if freq == 0 {
+		pwmStop()
+		return
+	}
+
+	hw, err := pwmStart(uint32(freq))
+
+	if err != nil {
+		return err.Error()
+	}
+
+	if err = hw.Duty(duty); err != nil {
+		return err.Error()
+	}
+
+	return fmt.Sprintf("PWM%d @ %d Hz, %.1f%% duty cycle", hw.n, freq, duty)
+}
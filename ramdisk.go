@@ -0,0 +1,279 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/xts"
+)
+
+var ramdiskLog = newLogger("ramdisk")
+
+const RAMDISK_SECTOR_SIZE = 512
+
+// ramFile represents a RAM disk file as a list of allocated sectors.
+type ramFile struct {
+	sectors []uint64
+	size    int64
+}
+
+// ramDisk implements a flat, tmpfs-like, file store whose backing memory
+// only ever holds AES-XTS encrypted sectors, the sector number is used as
+// tweak.
+type ramDisk struct {
+	sync.Mutex
+
+	cipher *xts.Cipher
+	// encrypted backing memory
+	buf   []byte
+	free  []uint64
+	files map[string]*ramFile
+}
+
+// ramdiskKey returns an XTS-AES-128 key, derived from the key tree (see
+// keytree.go) with a random per-boot context, the key is bound to the SoC
+// unique OTPMK when available.
+func ramdiskKey() (key []byte, hw bool, err error) {
+	salt := make([]byte, aes.BlockSize)
+
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+
+	root, err := KeyTree()
+
+	if err != nil {
+		return
+	}
+
+	n, err := root.Node(KEY_STORAGE + "/ramdisk")
+
+	if err != nil {
+		return
+	}
+
+	return n.Key(salt, 2*aes.BlockSize), !n.Ephemeral(), nil
+}
+
+func newRAMDisk(size int) (d *ramDisk, err error) {
+	key, hw, err := ramdiskKey()
+
+	if err != nil {
+		return
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, key)
+
+	for i := range key {
+		key[i] = 0
+	}
+
+	if err != nil {
+		return
+	}
+
+	n := size / RAMDISK_SECTOR_SIZE
+
+	d = &ramDisk{
+		cipher: c,
+		buf:    make([]byte, n*RAMDISK_SECTOR_SIZE),
+		files:  make(map[string]*ramFile),
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		d.free = append(d.free, uint64(i))
+	}
+
+	ramdiskLog.Infof("%d KiB, AES-XTS key derived by DCP:%v", size/1024, hw)
+
+	return
+}
+
+func (d *ramDisk) sector(n uint64) []byte {
+	off := n * RAMDISK_SECTOR_SIZE
+	return d.buf[off : off+RAMDISK_SECTOR_SIZE]
+}
+
+// WriteFile creates or replaces a file.
+func (d *ramDisk) WriteFile(name string, data []byte) (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.remove(name)
+
+	count := (len(data) + RAMDISK_SECTOR_SIZE - 1) / RAMDISK_SECTOR_SIZE
+
+	if count > len(d.free) {
+		return errors.New("no space left")
+	}
+
+	f := &ramFile{size: int64(len(data))}
+	plain := make([]byte, RAMDISK_SECTOR_SIZE)
+
+	for i := 0; i < count; i++ {
+		n := d.free[len(d.free)-1]
+		d.free = d.free[:len(d.free)-1]
+
+		copy(plain, data[i*RAMDISK_SECTOR_SIZE:])
+
+		if len(data) < (i+1)*RAMDISK_SECTOR_SIZE {
+			for j := len(data) - i*RAMDISK_SECTOR_SIZE; j < RAMDISK_SECTOR_SIZE; j++ {
+				plain[j] = 0
+			}
+		}
+
+		d.cipher.Encrypt(d.sector(n), plain, n)
+		f.sectors = append(f.sectors, n)
+	}
+
+	d.files[name] = f
+
+	return
+}
+
+// ReadFile returns a file content.
+func (d *ramDisk) ReadFile(name string) (data []byte, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	f, ok := d.files[name]
+
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+
+	data = make([]byte, len(f.sectors)*RAMDISK_SECTOR_SIZE)
+
+	for i, n := range f.sectors {
+		d.cipher.Decrypt(data[i*RAMDISK_SECTOR_SIZE:(i+1)*RAMDISK_SECTOR_SIZE], d.sector(n), n)
+	}
+
+	return data[:f.size], nil
+}
+
+func (d *ramDisk) remove(name string) bool {
+	f, ok := d.files[name]
+
+	if !ok {
+		return false
+	}
+
+	for _, n := range f.sectors {
+		s := d.sector(n)
+
+		for i := range s {
+			s[i] = 0
+		}
+
+		d.free = append(d.free, n)
+	}
+
+	delete(d.files, name)
+
+	return true
+}
+
+// Remove deletes a file, clearing its sectors.
+func (d *ramDisk) Remove(name string) (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.remove(name) {
+		return fmt.Errorf("%s not found", name)
+	}
+
+	return
+}
+
+// TestRAMDisk uses an encrypted RAM disk as scratch space, verifying that
+// no plaintext is found in its backing memory, and measures its throughput.
+func TestRAMDisk() (err error) {
+	size := conf.Int("ramdisk_size", 4) * 1024 * 1024
+
+	d, err := newRAMDisk(size)
+
+	if err != nil {
+		return
+	}
+
+	path := "/scratch/tamago.txt"
+
+	if err = d.WriteFile(path, []byte(banner)); err != nil {
+		return
+	}
+
+	read, err := d.ReadFile(path)
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(read, []byte(banner)) {
+		return errors.New("ramdisk: comparison fail")
+	}
+
+	if bytes.Contains(d.buf, []byte(banner)) {
+		return errors.New("ramdisk: plaintext found in backing memory")
+	}
+
+	ramdiskLog.Infof("%s verified (%d bytes), no plaintext in backing memory", path, len(read))
+
+	if err = d.Remove(path); err != nil {
+		return
+	}
+
+	// use half of the disk to benchmark
+	buf := make([]byte, size/2)
+
+	if _, err = rand.Read(buf); err != nil {
+		return
+	}
+
+	start := time.Now()
+
+	if err = d.WriteFile("/scratch/bench", buf); err != nil {
+		return
+	}
+
+	writeTime := time.Since(start)
+	start = time.Now()
+
+	if read, err = d.ReadFile("/scratch/bench"); err != nil {
+		return
+	}
+
+	readTime := time.Since(start)
+
+	if !bytes.Equal(read, buf) {
+		return errors.New("ramdisk: benchmark data mismatch")
+	}
+
+	mib := float64(len(buf)) / (1024 * 1024)
+
+	ramdiskLog.Infof("write %.2f MiB/s, read %.2f MiB/s", mib/writeTime.Seconds(), mib/readTime.Seconds())
+
+	if err = d.Remove("/scratch/bench"); err != nil {
+		return
+	}
+
+	for _, b := range d.buf {
+		if b != 0 {
+			return errors.New("ramdisk: removed sectors not cleared")
+		}
+	}
+
+	return
+}
@@ -0,0 +1,131 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+)
+
+const (
+	// delay before quiescing, allowing the requesting session to receive
+	// its response
+	REBOOT_DELAY = 500 * time.Millisecond
+	// delay after USB detach, allowing the host to notice it
+	REBOOT_USB_DETACH = 100 * time.Millisecond
+)
+
+var rebootLog = newLogger("reboot")
+
+var rebooting sync.Once
+
+// quiesce stops activities writing on memory cards, flushing their data,
+// closes subsystems using them and detaches USB from the host, returning a
+// summary of the performed actions.
+func quiesce() (summary []string) {
+	pcapCard.Lock()
+	capturing := pcapCard.sink != nil
+	pcapCard.Unlock()
+
+	if capturing {
+		summary = append(summary, "pcap: "+pcapCommand("stop", nil))
+	}
+
+	if res, err := stopTrace(nil); err == nil {
+		summary = append(summary, "trace: "+res)
+	}
+
+	for i := range cards {
+		names, mounts := cardMounts(i)
+
+		for j, m := range mounts {
+			m.close()
+			summary = append(summary, fmt.Sprintf("card %d: %s closed", i, names[j]))
+		}
+	}
+
+	if target.Native() && conf.Bool("usb", true) && target.USB() {
+		usb.USB1.Stop()
+		time.Sleep(REBOOT_USB_DETACH)
+
+		summary = append(summary, "usb: detached")
+	}
+
+	return
+}
+
+// warmReset resets the SoC through the watchdog software reset, with the
+// System Reset Controller configured for a warm reset (unlike imx6.Reboot()).
+func warmReset() {
+	reg.Set(imx6.SRC_SCR, imx6.SCR_WARM_RESET_ENABLE)
+	// WDOG1_WCR is a 16-bit register, 32-bit access should be avoided
+	reg.Write16(imx6.WDOG1_WCR, 0)
+
+	// the reset is not immediate
+	for {
+		runtime.Gosched()
+	}
+}
+
+// Reboot quiesces USB and storage, logs a summary and performs a SoC warm
+// reset, it never returns.
+func Reboot() {
+	rebooting.Do(func() {
+		rebootLog.Infof("uptime %s, %d goroutines", time.Duration(time.Now().UnixNano()).Round(time.Millisecond), runtime.NumGoroutine())
+
+		auditf("reboot", "uptime %s", time.Duration(time.Now().UnixNano()).Round(time.Second))
+
+		for _, l := range quiesce() {
+			rebootLog.Infof("%s", l)
+		}
+
+		rebootLog.Infof("warm reset")
+
+		if LogStore != nil {
+			LogStore.Sync(true)
+		}
+
+		if Console != nil {
+			Console.Flush(CONSOLE_FLUSH_TIMEOUT)
+		}
+
+		warmReset()
+	})
+
+	// concurrent invocations wait for the reset
+	select {}
+}
+
+// scheduleReboot reboots after a delay, so that the requesting console or
+// HTTP session can be answered first.
+func scheduleReboot() {
+	go func() {
+		time.Sleep(REBOOT_DELAY)
+		Reboot()
+	}()
+}
+
+func rebootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "rebooting")
+
+	scheduleReboot()
+}
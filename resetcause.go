@@ -0,0 +1,94 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// SRC and WDOG reset status registers
+// (System Reset Controller and Watchdog Timer, IMX6ULLRM).
+const (
+	SRC_SRSR = 0x020d8008
+
+	SRSR_IPP_RESET_B      = 0
+	SRSR_CSU_RESET_B      = 2
+	SRSR_IPP_USER_RESET_B = 3
+	SRSR_WDOG_RST_B       = 4
+	SRSR_JTAG_RST_B       = 5
+	SRSR_JTAG_SW_RST      = 6
+	SRSR_WDOG3_RST_B      = 7
+	SRSR_TEMPSENSE_RST_B  = 8
+	SRSR_WARM_BOOT        = 16
+
+	// 16-bit register
+	WDOG1_WRSR = 0x020bc004
+	WRSR_SFTW  = 0
+	WRSR_TOUT  = 1
+)
+
+var srsrCauses = []struct {
+	pos  int
+	desc string
+}{
+	{SRSR_IPP_RESET_B, "POR"},
+	{SRSR_CSU_RESET_B, "CSU"},
+	{SRSR_IPP_USER_RESET_B, "user reset"},
+	{SRSR_WDOG_RST_B, "WDOG"},
+	{SRSR_JTAG_RST_B, "JTAG"},
+	{SRSR_JTAG_SW_RST, "JTAG software"},
+	{SRSR_WDOG3_RST_B, "WDOG3"},
+	{SRSR_TEMPSENSE_RST_B, "temperature sensor"},
+}
+
+// readResetCause decodes the SRC reset status register, clearing it so that
+// the next boot reports only its own cause.
+func readResetCause() (cause string, srsr uint32) {
+	var causes []string
+
+	srsr = reg.Read(SRC_SRSR)
+
+	for _, c := range srsrCauses {
+		if srsr&(1<<c.pos) == 0 {
+			continue
+		}
+
+		desc := c.desc
+
+		// the watchdog distinguishes software requested resets (e.g.
+		// reboot command) from timeouts
+		if c.pos == SRSR_WDOG_RST_B {
+			wrsr := reg.Read16(WDOG1_WRSR)
+
+			switch {
+			case wrsr&(1<<WRSR_SFTW) != 0:
+				desc += " software"
+			case wrsr&(1<<WRSR_TOUT) != 0:
+				desc += " timeout"
+			}
+		}
+
+		causes = append(causes, desc)
+	}
+
+	if len(causes) == 0 {
+		causes = append(causes, "unknown")
+	}
+
+	if srsr&(1<<SRSR_WARM_BOOT) != 0 {
+		causes = append(causes, "warm")
+	}
+
+	// status bits are write 1 to clear
+	reg.Write(SRC_SRSR, srsr)
+
+	return strings.Join(causes, ", "), srsr
+}
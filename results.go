@@ -0,0 +1,209 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Test results are emitted on the serial console, regardless of the
+// `verbose` setting, between the following markers so that lab automation
+// can extract them from the console output.
+const (
+	RESULTS_BEGIN = "-----BEGIN TEST RESULTS-----"
+	RESULTS_END   = "-----END TEST RESULTS-----"
+
+	RESULTS_SUITE = "tamago-example"
+)
+
+type resultEntry struct {
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// resultReport represents the JSON results document.
+type resultReport struct {
+	Banner   string        `json:"banner"`
+	Revision string        `json:"revision"`
+	Build    string        `json:"build"`
+	Native   bool          `json:"native"`
+	Duration float64       `json:"duration"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Results  []resultEntry `json:"results"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// junitReport represents the JUnit XML results document.
+type junitReport struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+func newResultReport(results []testResult, duration time.Duration) (r *resultReport) {
+	r = &resultReport{
+		Banner:   banner,
+		Revision: Revision,
+		Build:    Build,
+		Native:   imx6.Native,
+		Duration: duration.Seconds(),
+	}
+
+	for _, res := range results {
+		e := resultEntry{
+			Name:     res.name,
+			Passed:   res.err == nil,
+			Duration: res.duration.Seconds(),
+		}
+
+		if res.err != nil {
+			e.Error = res.err.Error()
+			r.Failed += 1
+		} else {
+			r.Passed += 1
+		}
+
+		r.Results = append(r.Results, e)
+	}
+
+	return
+}
+
+// JUnit converts the report to JUnit XML.
+func (r *resultReport) JUnit() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:     RESULTS_SUITE,
+		Tests:    len(r.Results),
+		Failures: r.Failed,
+		Time:     fmt.Sprintf("%.3f", r.Duration),
+	}
+
+	for _, e := range r.Results {
+		tc := junitTestCase{
+			Name:      e.Name,
+			ClassName: RESULTS_SUITE,
+			Time:      fmt.Sprintf("%.3f", e.Duration),
+		}
+
+		if !e.Passed {
+			tc.Failure = &junitFailure{Message: e.Error}
+		}
+
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	buf, err := xml.MarshalIndent(junitReport{Suites: []junitTestSuite{suite}}, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), buf...), nil
+}
+
+// Marshal encodes the report in the format selected by the `results_format`
+// configuration setting.
+func (r *resultReport) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(r, "", "  ")
+	case "junit":
+		return r.JUnit()
+	default:
+		return nil, fmt.Errorf("invalid results format %s", format)
+	}
+}
+
+var resultsLog = newLogger("results")
+
+// lastReport holds the results of the most recent boot test run.
+var lastReport *resultReport
+
+// storeResults writes the results document on the `results` storage region,
+// the remainder of the region is cleared so that the document can be read
+// back as a NUL terminated string.
+func storeResults(buf []byte) (err error) {
+	r, err := openStorage("results")
+
+	if err != nil {
+		return
+	}
+
+	if int64(len(buf)) >= r.Size() {
+		return fmt.Errorf("results exceed storage region (%d bytes)", len(buf))
+	}
+
+	data := make([]byte, r.Size())
+	copy(data, buf)
+
+	_, err = r.WriteAt(data, 0)
+
+	return
+}
+
+// reportResults emits the test results on the serial console and, when
+// enabled, on the memory card and to the upload endpoint.
+func reportResults(results []testResult, duration time.Duration) {
+	lastReport = newResultReport(results, duration)
+
+	// central collection (see upload.go)
+	if conf.String("upload_url", "") != "" {
+		Uploader.queue()
+	}
+
+	format := conf.String("results_format", "json")
+
+	if format == "" {
+		return
+	}
+
+	buf, err := lastReport.Marshal(format)
+
+	if err != nil {
+		resultsLog.Errorf("%v", err)
+		return
+	}
+
+	fmt.Fprintf(consoleOutput, "%s\n%s\n%s\n", RESULTS_BEGIN, buf, RESULTS_END)
+
+	if !conf.Bool("results_store", false) {
+		return
+	}
+
+	if err = storeResults(buf); err != nil {
+		resultsLog.Errorf("could not store results, %v", err)
+	} else {
+		resultsLog.Infof("stored %d bytes", len(buf))
+	}
+}
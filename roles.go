@@ -0,0 +1,147 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Console commands and web routes are authorized according to the role of
+// the authenticated user (see auth.go), each role including the privileges
+// of the preceding ones. The role required by a console command is the one of
+// its entry in the command table (see ssh_server.go), whose patterns must
+// match the entire command line:
+//
+//	viewer    status and read-only commands
+//	operator  test execution, benchmarks and peripheral control
+//	admin     memory and raw card access, in-memory filesystem writes, key
+//	          management and usage, security settings, user management and
+//	          reboot
+//
+// Channels requiring physical access (serial console, BLE, USB RPC) and
+// Noise peers, which are individually authorized, are granted the admin role,
+// as are all channels when `auth` is disabled. Commands received over MQTT
+// are granted the `mqtt_role` role.
+
+type authRole int
+
+const (
+	ROLE_VIEWER authRole = iota + 1
+	ROLE_OPERATOR
+	ROLE_ADMIN
+)
+
+var authRoles = map[string]authRole{
+	"viewer":   ROLE_VIEWER,
+	"operator": ROLE_OPERATOR,
+	"admin":    ROLE_ADMIN,
+}
+
+func (r authRole) String() string {
+	for name, role := range authRoles {
+		if role == r {
+			return name
+		}
+	}
+
+	return "none"
+}
+
+func parseRole(s string) (role authRole, err error) {
+	role, ok := authRoles[s]
+
+	if !ok {
+		return 0, fmt.Errorf("invalid role %s", s)
+	}
+
+	return
+}
+
+// authorize returns whether a role allows a console command requiring the
+// argument role, informing the user otherwise.
+func authorize(term *terminal.Terminal, role authRole, required authRole, cmd string) bool {
+	if role < required {
+		// arguments are omitted as they might include secrets
+		name := strings.SplitN(strings.TrimSpace(cmd), " ", 2)[0]
+
+		fmt.Fprintf(term, "permission denied, %s role required\n", required)
+		auditf("auth.denied", "%q with %s role", name, role)
+
+		return false
+	}
+
+	return true
+}
+
+// webRole returns the minimum role required by a web request.
+func webRole(r *http.Request) authRole {
+	path := r.URL.Path
+
+	switch {
+	case path == "/reboot", path == "/api/audit", path == "/api/firmware", strings.HasPrefix(path, "/provision/"), strings.HasPrefix(path, "/trace/"):
+		return ROLE_ADMIN
+	case strings.HasPrefix(path, "/debug/pprof"):
+		return ROLE_OPERATOR
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ROLE_VIEWER
+	default:
+		return ROLE_OPERATOR
+	}
+}
+
+// TestRoles verifies the role required by console commands, including
+// malformed variants of privileged ones which must never be authorized with a
+// lesser role.
+func TestRoles() (err error) {
+	roles := map[string]authRole{
+		"help":              ROLE_VIEWER,
+		"date":              ROLE_VIEWER,
+		"btc xpub":          ROLE_VIEWER,
+		"fault 1":           ROLE_VIEWER,
+		"snvs status":       ROLE_OPERATOR,
+		"example .* btc":    ROLE_OPERATOR,
+		"mw 80000000 1":     ROLE_ADMIN,
+		"mw80000000 1":      ROLE_ADMIN,
+		"md0 10":            ROLE_ADMIN,
+		"snvs violate":      ROLE_ADMIN,
+		"btc psbt X":        ROLE_ADMIN,
+		"date 1600000000":   ROLE_ADMIN,
+		"fault 1 write":     ROLE_ADMIN,
+		"auth role a admin": ROLE_ADMIN,
+		"ext4 cp 0 2 /a /b": ROLE_ADMIN,
+		"blob get 00 /a":    ROLE_ADMIN,
+		" mw 80000000 1":    0,
+		"x mw 80000000 1":   0,
+		" snvs violate":     0,
+		"snvs violate ":     0,
+		" btc psbt X":       0,
+		"help mw 0 1":       0,
+		"date 1 mw 0 1":     0,
+	}
+
+	for cmd, required := range roles {
+		var role authRole
+
+		if c, _ := findCommand(cmd); c != nil {
+			role = c.role
+		}
+
+		if role != required {
+			return fmt.Errorf("%q requires %s role, expected %s", cmd, role, required)
+		}
+	}
+
+	authLog.Infof("verified %d command roles", len(roles))
+
+	return
+}
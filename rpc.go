@@ -0,0 +1,211 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+
+	"github.com/f-secure-foundry/tamago-example/internal/usbrpc"
+)
+
+// The RPC interface is a vendor-class USB interface, with a pair of bulk
+// endpoints, carrying length-prefixed protocol buffers requests and responses
+// (see internal/usbrpc) as an alternative control channel for hosts where
+// configuring Ethernet over USB is impractical. It requires no class driver
+// and can be accessed with usbfs on Linux or, on Windows, WinUSB/libusb once
+// the interface is bound to it (e.g. with Zadig).
+//
+// The following methods are supported:
+//
+//	console  <command>                console command output (see ssh_server.go)
+//	tests                             test list and selection status (JSON)
+//	run      [<include> [<exclude>]]  run tests, returns results (JSON)
+//	results                           boot test run results (JSON)
+//	log                               recent log output
+//
+// (see api.go for the equivalent HTTP routes).
+
+var rpcLog = newLogger("rpc")
+
+// rpcServer implements the RPC interface endpoint functions.
+type rpcServer struct {
+	// OUT frame assembly
+	buf []byte
+
+	// IN frames queue
+	out chan []byte
+}
+
+// RPC is the RPC interface instance exposed over USB.
+var RPC *rpcServer
+
+// rpcConsole executes a console command, on a terminal without escape
+// codes, for the argument role (see roles.go), returning its output.
+func rpcConsole(cmd string, role authRole) (res []byte, err error) {
+	var buf bytes.Buffer
+
+	term := terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), &buf}, "")
+
+	term.Escape = &terminal.EscapeCodes{}
+
+	if err = handleCommand(term, role, cmd); err != nil && err != io.EOF {
+		return
+	}
+
+	return bytes.ReplaceAll(buf.Bytes(), []byte("\r"), nil), nil
+}
+
+func rpcDispatch(method string, payload []byte) (res []byte, err error) {
+	switch method {
+	case "console":
+		return rpcConsole(strings.TrimSpace(string(payload)), ROLE_ADMIN)
+	case "tests":
+		return json.MarshalIndent(testList(), "", "  ")
+	case "run":
+		var exclude string
+
+		args := strings.Fields(string(payload))
+
+		if len(args) == 0 {
+			args = append(args, ".")
+		}
+
+		if len(args) > 1 {
+			exclude = args[1]
+		}
+
+		report, err := runTestList(args[0], exclude)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return json.MarshalIndent(report, "", "  ")
+	case "results":
+		if lastReport == nil {
+			return nil, errors.New("no test results available")
+		}
+
+		return json.MarshalIndent(lastReport, "", "  ")
+	case "log":
+		return logHistory.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unknown method %q", method)
+}
+
+func (s *rpcServer) handle(msg []byte) {
+	req := &usbrpc.Request{}
+	res := &usbrpc.Response{}
+
+	if err := req.Unmarshal(msg); err != nil {
+		res.Error = err.Error()
+	} else {
+		var err error
+
+		res.ID = req.ID
+
+		if res.Payload, err = rpcDispatch(req.Method, req.Payload); err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	s.out <- usbrpc.Frame(res.Marshal())
+}
+
+// Rx implements the RPC bulk OUT endpoint function, requests larger than a
+// single transfer are assembled before processing.
+func (s *rpcServer) Rx(buf []byte, lastErr error) (res []byte, err error) {
+	s.buf = append(s.buf, buf...)
+
+	if len(s.buf) < usbrpc.HeaderSize {
+		return
+	}
+
+	size, err := usbrpc.FrameSize(s.buf)
+
+	if err != nil {
+		rpcLog.Infof("discarding frame, %v", err)
+		s.buf = nil
+		return nil, nil
+	}
+
+	if len(s.buf) < size {
+		return
+	}
+
+	msg := s.buf[usbrpc.HeaderSize:size]
+	s.buf = nil
+
+	s.handle(msg)
+
+	return
+}
+
+// Tx implements the RPC bulk IN endpoint function.
+func (s *rpcServer) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case in = <-s.out:
+	default:
+	}
+
+	return
+}
+
+// addRPCInterface adds the RPC vendor-class interface to the USB device next
+// to Ethernet over USB.
+func addRPCInterface(device *usb.Device, configurationIndex int) {
+	RPC = &rpcServer{
+		out: make(chan []byte, 1),
+	}
+
+	iface := &usb.InterfaceDescriptor{}
+	iface.SetDefaults()
+
+	iface.NumEndpoints = 2
+	// Vendor Specific Class
+	iface.InterfaceClass = 0xff
+
+	iInterface, _ := device.AddString(`TamaGo RPC`)
+	iface.Interface = iInterface
+
+	iface.IAD = &usb.InterfaceAssociationDescriptor{}
+	iface.IAD.SetDefaults()
+	iface.IAD.InterfaceCount = 1
+	iface.IAD.FunctionClass = iface.InterfaceClass
+	iface.IAD.Function = iInterface
+
+	ep5IN := &usb.EndpointDescriptor{}
+	ep5IN.SetDefaults()
+	ep5IN.EndpointAddress = usbrpc.EndpointIN
+	ep5IN.Attributes = 2
+	ep5IN.Function = RPC.Tx
+
+	ep5OUT := &usb.EndpointDescriptor{}
+	ep5OUT.SetDefaults()
+	ep5OUT.EndpointAddress = usbrpc.EndpointOUT
+	ep5OUT.Attributes = 2
+	ep5OUT.Function = RPC.Rx
+
+	iface.Endpoints = append(iface.Endpoints, ep5IN, ep5OUT)
+
+	device.Configurations[configurationIndex].AddInterface(iface)
+}
@@ -0,0 +1,115 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var rsaLog = newLogger("rsa")
+
+// interval for key generation progress reports
+const RSA_PROGRESS_INTERVAL = 10 * time.Second
+
+func rsaGenerateKey(bits int) (priv *rsa.PrivateKey, err error) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(RSA_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+
+	start := time.Now()
+
+	go func() {
+		priv, err = rsa.GenerateKey(rand.Reader, bits)
+		close(done)
+	}()
+
+	// prime search duration is not predictable, report that we are
+	// still alive
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rsaLog.Infof("RSA-%d key generation in progress (%s elapsed)", bits, time.Since(start).Round(time.Second))
+		}
+	}
+}
+
+func testRSA(bits int, runs int) (err error) {
+	rsaLog.Infof("RSA-%d key generation ... ", bits)
+
+	start := time.Now()
+	priv, err := rsaGenerateKey(bits)
+
+	if err != nil {
+		return fmt.Errorf("rsa%d: error generating key: %v", bits, err)
+	}
+
+	rsaLog.Infof("RSA-%d key generation took %s", bits, time.Since(start))
+
+	hashed := sha256.Sum256([]byte("testing"))
+	var sig []byte
+
+	start = time.Now()
+
+	for i := 0; i < runs; i++ {
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hashed[:]); err != nil {
+			return fmt.Errorf("rsa%d: error signing: %v", bits, err)
+		}
+	}
+
+	rsaLog.Infof("RSA-%d sign took %s (%d runs)", bits, time.Since(start)/time.Duration(runs), runs)
+
+	start = time.Now()
+
+	for i := 0; i < runs; i++ {
+		if err = rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+			return fmt.Errorf("rsa%d: verify failed: %v", bits, err)
+		}
+	}
+
+	rsaLog.Infof("RSA-%d verify took %s (%d runs)", bits, time.Since(start)/time.Duration(runs), runs)
+
+	hashed[0] ^= 0xff
+
+	if rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, hashed[:], sig) == nil {
+		return fmt.Errorf("rsa%d: verify always works!", bits)
+	}
+
+	return
+}
+
+// TestRSA times RSA key generation, PKCS #1 v1.5 signing and verification.
+func TestRSA() (err error) {
+	runs := conf.Int("rsa_runs", 10)
+
+	if runs <= 0 {
+		return fmt.Errorf("invalid number of runs %d", runs)
+	}
+
+	for _, s := range conf.List("rsa_sizes", []string{"2048", "4096"}) {
+		bits, err := strconv.Atoi(s)
+
+		if err != nil || bits < 1024 {
+			return fmt.Errorf("invalid key size %s", s)
+		}
+
+		if err = testRSA(bits, runs); err != nil {
+			return err
+		}
+	}
+
+	return
+}
@@ -0,0 +1,118 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The SNVS Secure Real Time Counter (SRTC) is a 47-bit counter, clocked at
+// 32768 Hz, in the low power domain, it retains the wall clock time across
+// resets and, when a backup supply is present on VDD_SNVS_IN, power cycles
+// (Secure Real Time Counter (SRTC), IMX6ULLRM).
+const (
+	SNVS_LPCR     = SNVS_BASE + 0x38
+	LPCR_SRTC_ENV = 0
+
+	SNVS_LPSRTCMR = SNVS_BASE + 0x50
+	SNVS_LPSRTCLR = SNVS_BASE + 0x54
+
+	SRTC_SHIFT   = 15
+	SRTC_TIMEOUT = 100 * time.Millisecond
+)
+
+// SRTC values before this time are considered unset.
+var rtcEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func srtcEnable(enable bool) error {
+	var val uint32
+
+	if enable {
+		reg.Set(SNVS_LPCR, LPCR_SRTC_ENV)
+		val = 1
+	} else {
+		reg.Clear(SNVS_LPCR, LPCR_SRTC_ENV)
+	}
+
+	if !reg.WaitFor(SRTC_TIMEOUT, SNVS_LPCR, LPCR_SRTC_ENV, 1, val) {
+		return errors.New("SRTC enable timeout")
+	}
+
+	return nil
+}
+
+func srtcRead() uint64 {
+	var prev uint64
+
+	// the counter is read until two consecutive values match, as its
+	// registers are not latched
+	for {
+		msb := uint64(reg.Read(SNVS_LPSRTCMR) & 0x7fff)
+		lsb := uint64(reg.Read(SNVS_LPSRTCLR))
+		val := msb<<32 | lsb
+
+		if val == prev {
+			return val
+		}
+
+		prev = val
+	}
+}
+
+// rtcRead returns the wall clock time held by the SRTC, if set.
+func rtcRead() (t time.Time, valid bool) {
+	if !imx6.Native || reg.Get(SNVS_LPCR, LPCR_SRTC_ENV, 1) == 0 {
+		return
+	}
+
+	val := srtcRead()
+	t = time.Unix(int64(val>>SRTC_SHIFT), int64(val&(1<<SRTC_SHIFT-1))*1e9>>SRTC_SHIFT)
+
+	return t, t.After(rtcEpoch)
+}
+
+// rtcWrite sets the SRTC to the argument wall clock time.
+func rtcWrite(t time.Time) (err error) {
+	if !imx6.Native {
+		return errors.New("unsupported under emulation")
+	}
+
+	if err = srtcEnable(false); err != nil {
+		return
+	}
+
+	val := uint64(t.Unix())<<SRTC_SHIFT | uint64(t.Nanosecond())<<SRTC_SHIFT/1e9
+
+	reg.Write(SNVS_LPSRTCLR, uint32(val))
+	reg.Write(SNVS_LPSRTCMR, uint32(val>>32)&0x7fff)
+
+	return srtcEnable(true)
+}
+
+// loadRTC sets the wall clock time from the SRTC, when set.
+func loadRTC() {
+	t, valid := rtcRead()
+
+	if !valid {
+		return
+	}
+
+	clock.Lock()
+	clock.offset = t.Sub(time.Now())
+	clock.set = true
+	clock.updated = t
+	clock.Unlock()
+
+	clockLog.Infof("wall clock set from SRTC: %s", t.UTC().Format(time.RFC3339))
+}
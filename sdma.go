@@ -0,0 +1,269 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/f-secure-foundry/tamago/dma"
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Smart Direct Memory Access Controller registers
+// (Smart Direct Memory Access Controller (SDMA), IMX6ULLRM).
+const (
+	SDMA_BASE = 0x020ec000
+
+	SDMA_MC0PTR    = SDMA_BASE + 0x000
+	SDMA_INTR      = SDMA_BASE + 0x004
+	SDMA_STOP_STAT = SDMA_BASE + 0x008
+	SDMA_HSTART    = SDMA_BASE + 0x00c
+	SDMA_EVTOVR    = SDMA_BASE + 0x010
+	SDMA_DSPOVR    = SDMA_BASE + 0x014
+	SDMA_HOSTOVR   = SDMA_BASE + 0x018
+
+	SDMA_CONFIG = SDMA_BASE + 0x038
+	CONFIG_CSM  = 0
+
+	SDMA_CHN0ADDR = SDMA_BASE + 0x050
+	SDMA_CHNPRI   = SDMA_BASE + 0x100
+
+	CCM_CCGR5 = 0x020c407c
+	CCGR5_CG3 = 6
+
+	SDMA_CHANNELS = 32
+	// channel used for memory-to-memory transfers
+	SDMA_MEMCPY_CHANNEL = 1
+
+	// Channel 0 boot script address, with the scratch memory size bit set
+	// to allow 32 words channel contexts.
+	SDMA_CHN0_BOOT = 0x4050
+	// ROM memory-to-memory (ap_2_ap) script address
+	SDMA_AP_2_AP = 642
+
+	SDMA_CONTEXT_WORDS = 32
+	SDMA_CONTEXT_RAM   = 2048
+
+	// channel 0 command to load data memory (channel contexts)
+	C0_SETDM = 0x01
+
+	BD_DONE = 0x01
+	BD_WRAP = 0x02
+	BD_CONT = 0x04
+	BD_INTR = 0x08
+	BD_RROR = 0x10
+	BD_LAST = 0x20
+	BD_EXTD = 0x80
+
+	BD_SIZE      = 12
+	BD_MAX_COUNT = 0xfffc
+	CCB_SIZE     = 16
+)
+
+var sdmaLog = newLogger("imx6_sdma")
+
+// bufferDescriptor represents an SDMA buffer descriptor.
+type bufferDescriptor struct {
+	Count   uint16
+	Status  uint8
+	Command uint8
+	Addr    uint32
+	ExtAddr uint32
+}
+
+var sdma struct {
+	sync.Mutex
+
+	// channel control blocks
+	ccb    uint32
+	ccbBuf []byte
+}
+
+func sdmaInit() {
+	if sdma.ccb != 0 {
+		return
+	}
+
+	reg.SetN(CCM_CCGR5, CCGR5_CG3, 0b11, 0b11)
+
+	reg.Write(SDMA_MC0PTR, 0)
+
+	for i := 0; i < SDMA_CHANNELS; i++ {
+		reg.Write(SDMA_CHNPRI+uint32(i*4), 0)
+	}
+
+	sdma.ccb, sdma.ccbBuf = dma.Reserve(SDMA_CHANNELS*CCB_SIZE, 4)
+	copy(sdma.ccbBuf, make([]byte, len(sdma.ccbBuf)))
+
+	reg.Write(SDMA_CHN0ADDR, SDMA_CHN0_BOOT)
+	// dynamic context switching
+	reg.SetN(SDMA_CONFIG, CONFIG_CSM, 0b11, 0b11)
+
+	reg.Write(SDMA_MC0PTR, sdma.ccb)
+	reg.Write(SDMA_CHNPRI, 7)
+}
+
+// sdmaRun starts a channel with the argument buffer descriptors and polls its
+// interrupt status for completion.
+//
+// The SDMA interrupt line is not serviced, as interrupt handling is not
+// available, therefore completion is signalled by the channel interrupt
+// status bit (set by descriptors with BD_INTR) rather than a handler.
+func sdmaRun(ch int, bds []bufferDescriptor, timeout time.Duration) (err error) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, bds)
+
+	addr := dma.Alloc(buf.Bytes(), 4)
+	defer dma.Free(addr)
+
+	binary.LittleEndian.PutUint32(sdma.ccbBuf[ch*CCB_SIZE:], addr)
+	binary.LittleEndian.PutUint32(sdma.ccbBuf[ch*CCB_SIZE+4:], addr)
+
+	// clear any previous interrupt status
+	reg.Write(SDMA_INTR, 1<<ch)
+	reg.Write(SDMA_HSTART, 1<<ch)
+
+	if !reg.WaitFor(timeout, SDMA_INTR, ch, 1, 1) {
+		return errors.New("SDMA transfer timeout")
+	}
+
+	reg.Write(SDMA_INTR, 1<<ch)
+
+	dma.Read(addr, 0, buf.Bytes())
+
+	for i := range bds {
+		binary.Read(buf, binary.LittleEndian, &bds[i])
+
+		if bds[i].Status&BD_DONE != 0 || bds[i].Status&BD_RROR != 0 {
+			return errors.New("SDMA buffer descriptor error")
+		}
+	}
+
+	return
+}
+
+// sdmaLoadContext loads the channel context with the argument script
+// address through channel 0.
+func sdmaLoadContext(ch int, pc uint32) (err error) {
+	context := make([]byte, SDMA_CONTEXT_WORDS*4)
+	binary.LittleEndian.PutUint32(context, pc)
+
+	addr := dma.Alloc(context, 4)
+	defer dma.Free(addr)
+
+	bd := []bufferDescriptor{
+		{
+			Count:   SDMA_CONTEXT_WORDS,
+			Status:  BD_DONE | BD_WRAP | BD_INTR | BD_EXTD,
+			Command: C0_SETDM,
+			Addr:    addr,
+			ExtAddr: uint32(SDMA_CONTEXT_RAM + SDMA_CONTEXT_WORDS*ch),
+		},
+	}
+
+	return sdmaRun(0, bd, 100*time.Millisecond)
+}
+
+// sdmaCopy copies src to dst with a memory-to-memory SDMA transfer.
+func sdmaCopy(dst []byte, src []byte) (err error) {
+	sdma.Lock()
+	defer sdma.Unlock()
+
+	if len(src) == 0 || len(dst) < len(src) {
+		return errors.New("invalid buffers")
+	}
+
+	sdmaInit()
+
+	ch := SDMA_MEMCPY_CHANNEL
+
+	// the channel is driven by the host, not by peripheral events
+	reg.Set(SDMA_EVTOVR, ch)
+	reg.Clear(SDMA_HOSTOVR, ch)
+	reg.Set(SDMA_DSPOVR, ch)
+	reg.Write(SDMA_CHNPRI+uint32(ch*4), 4)
+
+	if err = sdmaLoadContext(ch, SDMA_AP_2_AP); err != nil {
+		return
+	}
+
+	srcAddr := uint32(uintptr(unsafe.Pointer(&src[0])))
+	dstAddr := uint32(uintptr(unsafe.Pointer(&dst[0])))
+
+	var bds []bufferDescriptor
+
+	for off := 0; off < len(src); off += BD_MAX_COUNT {
+		count := len(src) - off
+
+		if count > BD_MAX_COUNT {
+			count = BD_MAX_COUNT
+		}
+
+		bds = append(bds, bufferDescriptor{
+			Count:   uint16(count),
+			Status:  BD_DONE | BD_EXTD | BD_CONT,
+			Addr:    srcAddr + uint32(off),
+			ExtAddr: dstAddr + uint32(off),
+		})
+	}
+
+	last := &bds[len(bds)-1]
+	last.Status = BD_DONE | BD_EXTD | BD_WRAP | BD_INTR | BD_LAST
+
+	// The buffers are in cacheable memory, the source must be cleaned
+	// to memory and the destination invalidated both before and after
+	// the transfer, to discard any speculatively allocated line.
+	imx6.ARM.CacheFlushData()
+	defer imx6.ARM.CacheFlushData()
+
+	return sdmaRun(ch, bds, 10*time.Second)
+}
+
+// TestSDMA compares memory-to-memory SDMA transfers with CPU copies.
+func TestSDMA() (err error) {
+	size := conf.Int("sdma_size", 4*1024*1024)
+
+	src := make([]byte, size)
+	dst := make([]byte, size)
+
+	for i := range src {
+		src[i] = byte(i*7 + i>>8)
+	}
+
+	start := time.Now()
+	copy(dst, src)
+	elapsed := time.Since(start)
+
+	sdmaLog.Infof("CPU copy %d bytes in %s (%.2f MB/s)", size, elapsed, float64(size)/elapsed.Seconds()/1e6)
+
+	copy(dst, make([]byte, size))
+
+	start = time.Now()
+
+	if err = sdmaCopy(dst, src); err != nil {
+		return
+	}
+
+	elapsed = time.Since(start)
+
+	sdmaLog.Infof("DMA copy %d bytes in %s (%.2f MB/s)", size, elapsed, float64(size)/elapsed.Seconds()/1e6)
+
+	if !bytes.Equal(src, dst) {
+		return errors.New("SDMA copy mismatch")
+	}
+
+	return
+}
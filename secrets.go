@@ -0,0 +1,280 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Sealed blobs bind a payload to the device by encrypting it, with
+// AES-128-CBC, using a DCP key slot loaded with a key derived from the SoC
+// unique OTPMK, which is therefore never exposed to software. Authenticity is
+// ensured with an HMAC-SHA256, keyed with a second OTPMK derived key.
+//
+// Blob format:
+//
+//	magic (4) | payload length (4) | IV (16) | ciphertext (n) | HMAC (32)
+//
+// Payloads of blobs with the KEK magic are additionally wrapped with the SNVS
+// ZMK derived key (see kek.go).
+const (
+	BLOB_MAGIC       = "TGSB"
+	BLOB_MAGIC_KEK   = "TGSZ"
+	BLOB_HEADER_SIZE = 4 + 4 + aes.BlockSize
+	BLOB_KEY_SLOT    = 1
+	BLOB_MAX_PAYLOAD = 1 << 20
+
+	blobEncDiversifier = "sealed-blob-enc"
+	blobMACDiversifier = "sealed-blob-mac"
+)
+
+// errUnseal is returned by loadSealed when a stored blob cannot be unsealed.
+var errUnseal = errors.New("cannot unseal stored blob")
+
+func blobKeys() (macKey []byte, err error) {
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err = imx6.DCP.DeriveKey([]byte(blobEncDiversifier), iv, BLOB_KEY_SLOT); err != nil {
+		return
+	}
+
+	return imx6.DCP.DeriveKey([]byte(blobMACDiversifier), iv, -1)
+}
+
+// sealBlob encrypts and authenticates a payload with device unique keys.
+func sealBlob(payload []byte) (blob []byte, err error) {
+	magic := BLOB_MAGIC
+
+	if conf.Bool("zmk_kek", false) {
+		if payload, err = kekWrap(payload); err != nil {
+			return
+		}
+
+		magic = BLOB_MAGIC_KEK
+	}
+
+	if len(payload) > BLOB_MAX_PAYLOAD {
+		return nil, errors.New("payload too large")
+	}
+
+	macKey, err := blobKeys()
+
+	if err != nil {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err = rand.Read(iv); err != nil {
+		return
+	}
+
+	// PKCS#7 padding
+	padLen := aes.BlockSize - len(payload)%aes.BlockSize
+	buf := append([]byte{}, payload...)
+	buf = append(buf, bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+
+	// the DCP updates the IV in place
+	ivCopy := append([]byte{}, iv...)
+
+	if err = imx6.DCP.Encrypt(buf, BLOB_KEY_SLOT, ivCopy); err != nil {
+		return
+	}
+
+	blob = append(blob, []byte(magic)...)
+	blob = append(blob, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(blob[4:8], uint32(len(payload)))
+	blob = append(blob, iv...)
+	blob = append(blob, buf...)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(blob)
+
+	return mac.Sum(blob), nil
+}
+
+// isBlob returns whether a buffer starts with a sealed blob magic.
+func isBlob(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(BLOB_MAGIC)) || isKEKBlob(buf)
+}
+
+// blobSize returns the total size of a sealed blob from its header.
+func blobSize(hdr []byte) (size int, err error) {
+	if len(hdr) < BLOB_HEADER_SIZE || !isBlob(hdr) {
+		return 0, errors.New("invalid blob header")
+	}
+
+	n := int(binary.LittleEndian.Uint32(hdr[4:8]))
+
+	if n < 0 || n > BLOB_MAX_PAYLOAD {
+		return 0, errors.New("invalid blob payload length")
+	}
+
+	n += aes.BlockSize - n%aes.BlockSize
+
+	return BLOB_HEADER_SIZE + n + sha256.Size, nil
+}
+
+// unsealBlob authenticates and decrypts a blob sealed with sealBlob().
+func unsealBlob(blob []byte) (payload []byte, err error) {
+	size, err := blobSize(blob)
+
+	if err != nil {
+		return
+	}
+
+	if len(blob) < size {
+		return nil, errors.New("invalid blob size")
+	}
+
+	blob = blob[:size]
+
+	macKey, err := blobKeys()
+
+	if err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(blob[:size-sha256.Size])
+
+	if !hmac.Equal(mac.Sum(nil), blob[size-sha256.Size:]) {
+		return nil, errors.New("invalid blob HMAC")
+	}
+
+	n := int(binary.LittleEndian.Uint32(blob[4:8]))
+	iv := append([]byte{}, blob[8:BLOB_HEADER_SIZE]...)
+	buf := append([]byte{}, blob[BLOB_HEADER_SIZE:size-sha256.Size]...)
+
+	if err = imx6.DCP.Decrypt(buf, BLOB_KEY_SLOT, iv); err != nil {
+		return
+	}
+
+	if isKEKBlob(blob) {
+		return kekUnwrap(buf[:n])
+	}
+
+	return buf[:n], nil
+}
+
+// loadSealed returns the payload sealed in a storage region, when missing a
+// new one is obtained from the generate function and sealed for future use.
+//
+// A stored blob which cannot be unsealed (e.g. on storage corruption, device
+// or ZMK key change) is never replaced, as its secrets would be irrecoverably
+// lost, and an error is returned instead.
+func loadSealed(name string, generate func() ([]byte, error)) (payload []byte, err error) {
+	r, err := openStorage(name)
+
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, r.Size())
+
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return
+	}
+
+	if payload, err = unsealBlob(buf); err == nil {
+		return
+	}
+
+	if isBlob(buf) {
+		dcpLog.Errorf("%s region blob cannot be unsealed, %v", name, err)
+		return nil, fmt.Errorf("%s region, %w (%v)", name, errUnseal, err)
+	}
+
+	if payload, err = generate(); err != nil {
+		return
+	}
+
+	err = storeSealed(name, payload)
+
+	return
+}
+
+// storeSealed seals a payload in a storage region, replacing its content.
+func storeSealed(name string, payload []byte) (err error) {
+	r, err := openStorage(name)
+
+	if err != nil {
+		return
+	}
+
+	blob, err := sealBlob(payload)
+
+	if err != nil {
+		return
+	}
+
+	if int64(len(blob)) > r.Size() {
+		return errors.New("sealed blob exceeds storage region")
+	}
+
+	_, err = r.WriteAt(blob, 0)
+
+	return
+}
+
+// testSecrets unseals the blob stored on the previous boot, if any, and
+// replaces it with a new one, demonstrating the sealed storage pattern.
+func testSecrets() (err error) {
+	var boots uint32
+
+	r, err := openStorage("secrets")
+
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, r.Size())
+
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return
+	}
+
+	if payload, err := unsealBlob(buf); err != nil {
+		dcpLog.Infof("no sealed blob from previous boot (%v)", err)
+	} else if len(payload) >= 4 {
+		boots = binary.LittleEndian.Uint32(payload[0:4])
+		dcpLog.Infof("unsealed blob from previous boot (%d boots, %s)", boots, payload[4:])
+	}
+
+	payload := make([]byte, 4)
+	binary.LittleEndian.PutUint32(payload, boots+1)
+	payload = append(payload, []byte(banner)...)
+
+	blob, err := sealBlob(payload)
+
+	if err != nil {
+		return
+	}
+
+	if len(blob) > len(buf) {
+		return errors.New("sealed blob exceeds storage region")
+	}
+
+	if _, err = r.WriteAt(blob, 0); err != nil {
+		return
+	}
+
+	dcpLog.Infof("sealed %d bytes blob for next boot", len(blob))
+
+	return
+}
@@ -0,0 +1,192 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+var serialLog = newLogger("serial")
+
+// consoleUART is the board debug console UART, set by the board files
+// (e.g. usbarmory.go).
+var consoleUART *imx6.UART
+
+const serialHelp = `  rx       <path>                   # receive file with XMODEM
+  sx       <path>                   # send file with XMODEM-1K
+  rb       [<dir>]                  # receive files with YMODEM batch
+  sb       <path>                   # send file with YMODEM
+`
+
+var serialCommandPattern = regexp.MustCompile(`^(rx|sx|rb|sb)(?: (.*))?$`)
+
+// serialPort implements io.ReadWriter on the console UART, through the
+// buffered console when enabled (see console.go).
+type serialPort struct {
+	uart    *imx6.UART
+	console *uartConsole
+}
+
+func (p serialPort) read(buf []byte) int {
+	if p.console != nil {
+		return p.console.Read(buf)
+	}
+
+	return p.uart.Read(buf)
+}
+
+// Read blocks until at least one byte is received.
+func (p serialPort) Read(buf []byte) (n int, err error) {
+	for n == 0 {
+		if n = p.read(buf); n == 0 {
+			runtime.Gosched()
+		}
+	}
+
+	return
+}
+
+// Write implements io.Writer.
+func (p serialPort) Write(buf []byte) (n int, err error) {
+	if p.console != nil {
+		return p.console.Write(buf)
+	}
+
+	p.uart.Write(buf)
+	return len(buf), nil
+}
+
+// Rx returns the next received byte, waiting up to the argument timeout.
+func (p serialPort) Rx(timeout time.Duration) (c byte, err error) {
+	var b [1]byte
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if p.read(b[:]) == 1 {
+			return b[0], nil
+		}
+
+		runtime.Gosched()
+	}
+
+	return 0, errors.New("timeout")
+}
+
+// transfer runs an XMODEM/YMODEM transfer, suspending log output on the
+// console for its duration.
+func (p serialPort) transfer(op string, arg string) (res string) {
+	m := &modem{Writer: p, Rx: p.Rx}
+
+	w := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(w)
+
+	switch op {
+	case "rx":
+		data, err := m.XReceive()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		if err = ioutil.WriteFile(arg, data, 0600); err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("received %s (%d bytes)", arg, len(data))
+	case "rb":
+		if arg == "" {
+			arg = "/"
+		}
+
+		var count int
+
+		err := m.YReceive(func(name string, data []byte) error {
+			count += 1
+			return ioutil.WriteFile(filepath.Join(arg, filepath.Base(name)), data, 0600)
+		})
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("received %d file(s) in %s", count, arg)
+	case "sx", "sb":
+		data, err := ioutil.ReadFile(arg)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		if op == "sx" {
+			err = m.XSend(data)
+		} else {
+			err = m.YSend(filepath.Base(arg), data)
+		}
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("sent %s (%d bytes)", arg, len(data))
+	}
+
+	return
+}
+
+// startSerialConsole serves the console shell, with the addition of file
+// transfer commands, on the debug console UART.
+func startSerialConsole() {
+	if consoleUART == nil {
+		serialLog.Warnf("serial console not supported")
+		return
+	}
+
+	port := serialPort{uart: consoleUART, console: Console}
+	term := terminal.NewTerminal(port, "> ")
+
+	serialLog.Infof("starting serial console")
+
+	fmt.Fprintf(term, "%s\n", help+serialHelp)
+
+	for {
+		cmd, err := term.ReadLine()
+
+		if err == io.EOF {
+			continue
+		}
+
+		if err != nil {
+			serialLog.Errorf("readline error, %v", err)
+			continue
+		}
+
+		switch m := serialCommandPattern.FindStringSubmatch(cmd); {
+		case len(m) == 3:
+			fmt.Fprintln(term, port.transfer(m[1], m[2]))
+		case cmd == "ble":
+			fmt.Fprintln(term, "not available over the serial console")
+		default:
+			handleCommand(term, ROLE_ADMIN, cmd)
+		}
+	}
+}
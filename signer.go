@@ -0,0 +1,315 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Offline signer serial protocol, each frame is made of:
+//
+//	| SOF (1) | type (1) | length (2, BE) | payload | CRC-32 (4, BE) |
+//
+// with the IEEE CRC-32 computed over type, length and payload. Responses
+// carry the request type with the high bit set, or SIGNER_ERROR with a text
+// payload.
+const (
+	SIGNER_SOF         = 0xa5
+	SIGNER_HEADER_SIZE = 4
+	SIGNER_CRC_SIZE    = 4
+	SIGNER_MAX_PAYLOAD = 4096
+
+	SIGNER_PING       = 0x01
+	SIGNER_PUBLIC_KEY = 0x02
+	SIGNER_SIGN       = 0x03
+	SIGNER_COUNTER    = 0x04
+	SIGNER_GENERATE   = 0x05
+	SIGNER_RESPONSE   = 0x80
+	SIGNER_ERROR      = 0xff
+
+	SIGNER_IDLE_TIMEOUT = 1 * time.Second
+	SIGNER_BYTE_TIMEOUT = 100 * time.Millisecond
+)
+
+var signerLog = newLogger("signer")
+
+// serialSigner implements an offline signer appliance, receiving payloads
+// over a dedicated UART and signing them with the HSM keyring (see hsm.go).
+// Key usage counters are persisted, before any signature is released, as a
+// DCP sealed blob.
+type serialSigner struct {
+	sync.Mutex
+
+	uart     *secondaryUART
+	keyring  *hsmKeyring
+	counters map[string]uint64
+	// maximum number of signatures per key (0 for no limit)
+	maxUses uint64
+}
+
+func (s *serialSigner) loadCounters() (err error) {
+	payload, err := loadSealed("signer", func() ([]byte, error) {
+		return json.Marshal(map[string]uint64{})
+	})
+
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(payload, &s.counters)
+}
+
+// use increments and persists a key usage counter.
+func (s *serialSigner) use(label string) (n uint64, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	n = s.counters[label]
+
+	if s.maxUses > 0 && n >= s.maxUses {
+		return n, errors.New("key usage limit reached")
+	}
+
+	s.counters[label] = n + 1
+
+	payload, err := json.Marshal(s.counters)
+
+	if err == nil {
+		err = storeSealed("signer", payload)
+	}
+
+	if err != nil {
+		s.counters[label] = n
+		return
+	}
+
+	return n + 1, nil
+}
+
+func (s *serialSigner) counter(label string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.counters[label]
+}
+
+func (s *serialSigner) readFull(buf []byte) (err error) {
+	for i := range buf {
+		if buf[i], err = s.uart.read(SIGNER_BYTE_TIMEOUT); err != nil {
+			return fmt.Errorf("truncated frame, %v", err)
+		}
+	}
+
+	return
+}
+
+// readFrame waits for a start of frame and returns the frame type and
+// payload.
+func (s *serialSigner) readFrame() (t byte, payload []byte, err error) {
+	var c byte
+
+	for c != SIGNER_SOF {
+		if c, err = s.uart.read(SIGNER_IDLE_TIMEOUT); err != nil {
+			return
+		}
+	}
+
+	hdr := make([]byte, SIGNER_HEADER_SIZE-1)
+
+	if err = s.readFull(hdr); err != nil {
+		return
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[1:]))
+
+	if n > SIGNER_MAX_PAYLOAD {
+		return 0, nil, fmt.Errorf("frame too large (%d bytes)", n)
+	}
+
+	buf := make([]byte, n+SIGNER_CRC_SIZE)
+
+	if err = s.readFull(buf); err != nil {
+		return
+	}
+
+	crc := crc32.ChecksumIEEE(append(hdr, buf[:n]...))
+
+	if binary.BigEndian.Uint32(buf[n:]) != crc {
+		return 0, nil, errors.New("CRC mismatch")
+	}
+
+	return hdr[0], buf[:n], nil
+}
+
+func (s *serialSigner) writeFrame(t byte, payload []byte) error {
+	frame := make([]byte, SIGNER_HEADER_SIZE, SIGNER_HEADER_SIZE+len(payload)+SIGNER_CRC_SIZE)
+
+	frame[0] = SIGNER_SOF
+	frame[1] = t
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+
+	frame = append(frame, payload...)
+	frame = append(frame, make([]byte, SIGNER_CRC_SIZE)...)
+
+	binary.BigEndian.PutUint32(frame[len(frame)-SIGNER_CRC_SIZE:], crc32.ChecksumIEEE(frame[1:len(frame)-SIGNER_CRC_SIZE]))
+
+	return s.uart.write(frame, SIGNER_BYTE_TIMEOUT)
+}
+
+func signerLabel(payload []byte) (label string, rest []byte, err error) {
+	if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+		return "", nil, errors.New("invalid label")
+	}
+
+	label = string(payload[1 : 1+payload[0]])
+
+	if !hsmLabelPattern.MatchString(label) {
+		return "", nil, errors.New("invalid label")
+	}
+
+	return label, payload[1+payload[0]:], nil
+}
+
+// handle processes a request, all requests but SIGNER_PING carry a length
+// prefixed key label:
+//
+//	SIGNER_PING        -> empty
+//	SIGNER_PUBLIC_KEY  -> PKIX DER public key
+//	SIGNER_GENERATE    -> PKIX DER public key of the new P-256 key
+//	SIGNER_COUNTER     -> usage counter (8, BE)
+//	SIGNER_SIGN <data> -> usage counter (8, BE) | ASN.1 signature of SHA-256(data)
+func (s *serialSigner) handle(t byte, payload []byte) (res []byte, err error) {
+	if t == SIGNER_PING {
+		return
+	}
+
+	label, data, err := signerLabel(payload)
+
+	if err != nil {
+		return
+	}
+
+	switch t {
+	case SIGNER_PUBLIC_KEY:
+		return s.keyring.PublicKey(label)
+	case SIGNER_GENERATE:
+		if err = s.keyring.Generate(label); err != nil {
+			return
+		}
+
+		signerLog.Infof("generated key %s", label)
+
+		return s.keyring.PublicKey(label)
+	case SIGNER_COUNTER:
+		res = make([]byte, 8)
+		binary.BigEndian.PutUint64(res, s.counter(label))
+	case SIGNER_SIGN:
+		digest := sha256.Sum256(data)
+
+		if _, err = s.keyring.PublicKey(label); err != nil {
+			return
+		}
+
+		n, err := s.use(label)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := s.keyring.Sign(label, digest[:])
+
+		if err != nil {
+			return nil, err
+		}
+
+		signerLog.Infof("signed %d bytes (SHA-256 %x) with %s, use %d", len(data), digest, label, n)
+
+		res = make([]byte, 8, 8+len(sig))
+		binary.BigEndian.PutUint64(res, n)
+		res = append(res, sig...)
+	default:
+		err = fmt.Errorf("unsupported request %#x", t)
+	}
+
+	return
+}
+
+func (s *serialSigner) serve() {
+	for {
+		t, payload, err := s.readFrame()
+
+		if err == errUARTTimeout {
+			continue
+		}
+
+		if err != nil {
+			signerLog.Errorf("%v", err)
+			continue
+		}
+
+		res, err := s.handle(t, payload)
+
+		if err != nil {
+			t = SIGNER_ERROR
+			res = []byte(err.Error())
+		} else {
+			t |= SIGNER_RESPONSE
+		}
+
+		if err = s.writeFrame(t, res); err != nil {
+			signerLog.Errorf("%v", err)
+		}
+	}
+}
+
+// StartSigner starts the offline signer protocol on a secondary UART.
+func StartSigner(n int) (err error) {
+	base, ok := uartBases[n]
+
+	if !ok {
+		return fmt.Errorf("invalid UART%d", n)
+	}
+
+	imx6.DCP.Init()
+
+	if err = HSM.Init(); err != nil {
+		return
+	}
+
+	s := &serialSigner{
+		uart:    &secondaryUART{base: base},
+		keyring: HSM,
+		maxUses: uint64(conf.Int("signer_max_uses", 0)),
+	}
+
+	if err = s.loadCounters(); err != nil {
+		return
+	}
+
+	baudrate := conf.Int("signer_baudrate", 115200)
+
+	if err = s.uart.init(uint32(baudrate)); err != nil {
+		return
+	}
+
+	signerLog.Infof("listening on UART%d @ %d baud", n, baudrate)
+
+	go s.serve()
+
+	return
+}
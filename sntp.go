@@ -0,0 +1,115 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// The SNTP server answers client requests with the device wall clock time
+// (RFC 4330), so that hosts without network access can synchronize with it.
+const (
+	SNTP_PORT        = 123
+	SNTP_PACKET_SIZE = 48
+
+	SNTP_MODE_CLIENT = 3
+	SNTP_MODE_SERVER = 4
+
+	// leap indicator for an unsynchronized clock
+	SNTP_LI_ALARM = 3
+
+	SNTP_STRATUM       = 1
+	SNTP_STRATUM_UNSET = 16
+	// ~30 µs (2^-15 s, -15 as signed byte), the SRTC resolution
+	SNTP_PRECISION = 0xf1
+	SNTP_REFID     = "LOCL"
+
+	// seconds between the NTP (1900) and Unix (1970) epochs
+	NTP_EPOCH_OFFSET = 2208988800
+)
+
+var sntpLog = newLogger("sntp")
+
+func ntpTimestamp(buf []byte, t time.Time) {
+	sec := uint64(t.Unix() + NTP_EPOCH_OFFSET)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+
+	binary.BigEndian.PutUint64(buf, sec<<32|frac)
+}
+
+// sntpResponse returns the server response for a client request received at
+// the argument time.
+func sntpResponse(req []byte, rx time.Time) (res []byte) {
+	if len(req) < SNTP_PACKET_SIZE || req[0]&0b111 != SNTP_MODE_CLIENT {
+		return
+	}
+
+	version := (req[0] >> 3) & 0b111
+	res = make([]byte, SNTP_PACKET_SIZE)
+
+	if TimeSet() {
+		res[0] = version<<3 | SNTP_MODE_SERVER
+		res[1] = SNTP_STRATUM
+	} else {
+		res[0] = SNTP_LI_ALARM<<6 | version<<3 | SNTP_MODE_SERVER
+		res[1] = SNTP_STRATUM_UNSET
+	}
+
+	// poll interval
+	res[2] = req[2]
+	res[3] = SNTP_PRECISION
+
+	copy(res[12:16], SNTP_REFID)
+
+	// reference timestamp
+	if TimeSet() {
+		ntpTimestamp(res[16:24], LastSet())
+	}
+
+	// originate timestamp (client transmit timestamp)
+	copy(res[24:32], req[40:48])
+	// receive timestamp
+	ntpTimestamp(res[32:40], rx)
+	// transmit timestamp
+	ntpTimestamp(res[40:48], Now())
+
+	return
+}
+
+func startSNTPServer(s *stack.Stack, addr tcpip.Address, nic tcpip.NICID) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: SNTP_PORT, NIC: nic}
+	conn, err := gonet.DialUDP(s, &fullAddr, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		sntpLog.Fatalf("SNTP endpoint error, %v", err)
+	}
+
+	sntpLog.Infof("starting SNTP server at %s:%d", addr.String(), SNTP_PORT)
+
+	buf := make([]byte, MTU)
+
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			sntpLog.Errorf("SNTP read error, %v", err)
+			continue
+		}
+
+		if res := sntpResponse(buf[:n], Now()); res != nil {
+			conn.WriteTo(res, peer)
+		}
+	}
+}
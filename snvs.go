@@ -0,0 +1,244 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// SNVS registers
+// (SNVS Memory Map/Register Definition, IMX6ULLRM).
+const (
+	SNVS_BASE = 0x020cc000
+
+	SNVS_HPCOMR    = SNVS_BASE + 0x04
+	HPCOMR_NPSWA   = 31
+	HPCOMR_SW_LPSV = 10
+	HPCOMR_SW_SV   = 8
+
+	SNVS_HPSVCR = SNVS_BASE + 0x10
+
+	SNVS_HPSR             = SNVS_BASE + 0x14
+	HPSR_ZMK_ZERO         = 31
+	HPSR_OTPMK_ZERO       = 27
+	HPSR_SYS_SECURE_BOOT  = 15
+	HPSR_SYS_SECURITY_CFG = 12
+	HPSR_SSM_STATE        = 8
+
+	SNVS_HPSVSR    = SNVS_BASE + 0x18
+	HPSVSR_LPSV    = 31
+	HPSVSR_SW_LPSV = 15
+	HPSVSR_SW_FSV  = 14
+	HPSVSR_SW_SV   = 13
+
+	SNVS_LPMKCR           = SNVS_BASE + 0x3c
+	LPMKCR_ZMK_VAL        = 3
+	LPMKCR_ZMK_HWP        = 2
+	LPMKCR_MASTER_KEY_SEL = 0
+
+	SNVS_LPSVCR = SNVS_BASE + 0x40
+
+	SNVS_LPTDCR     = SNVS_BASE + 0x48
+	LPTDCR_ET1P     = 11
+	LPTDCR_ET1_EN   = 9
+	LPTDCR_MCR_EN   = 2
+	LPTDCR_SRTCR_EN = 1
+
+	SNVS_LPSR  = SNVS_BASE + 0x4c
+	LPSR_LPS   = 31
+	LPSR_ESVD  = 16
+	LPSR_ET1D  = 9
+	LPSR_MCR   = 2
+	LPSR_SRTCR = 1
+
+	SNVS_LPZMKR0 = SNVS_BASE + 0x6c
+	ZMK_SIZE     = 32
+)
+
+var snvsLog = newLogger("imx6_snvs")
+
+// SNVS Secure State Machine states
+// (Secure State Machine, IMX6ULLRM).
+var ssmStates = map[uint32]string{
+	0b0000: "init",
+	0b0001: "hard fail",
+	0b0011: "soft fail",
+	0b1000: "init intermediate",
+	0b1001: "check",
+	0b1011: "non-secure",
+	0b1101: "trusted",
+	0b1111: "secure",
+}
+
+// system security configuration (SYS_SECURITY_CFG)
+var securityConfigs = map[uint32]string{
+	0b000: "fab",
+	0b001: "open",
+	0b011: "closed",
+	0b111: "field return",
+}
+
+func snvsStatus() string {
+	var buf bytes.Buffer
+
+	ssm := reg.Get(SNVS_HPSR, HPSR_SSM_STATE, 0b1111)
+	cfg := reg.Get(SNVS_HPSR, HPSR_SYS_SECURITY_CFG, 0b111)
+
+	state, ok := ssmStates[ssm]
+
+	if !ok {
+		state = "unknown"
+	}
+
+	security, ok := securityConfigs[cfg]
+
+	if !ok {
+		security = "unknown"
+	}
+
+	fmt.Fprintf(&buf, "SSM state:       %s (%#b)\n", state, ssm)
+	fmt.Fprintf(&buf, "security config: %s, secure boot:%v\n", security, reg.Get(SNVS_HPSR, HPSR_SYS_SECURE_BOOT, 1) == 1)
+	fmt.Fprintf(&buf, "OTPMK zero:      %v\n", reg.Get(SNVS_HPSR, HPSR_OTPMK_ZERO, 1) == 1)
+	fmt.Fprintf(&buf, "ZMK zero:        %v, valid:%v\n", reg.Get(SNVS_HPSR, HPSR_ZMK_ZERO, 1) == 1, reg.Get(SNVS_LPMKCR, LPMKCR_ZMK_VAL, 1) == 1)
+	fmt.Fprintf(&buf, "HP violations:   %#08x\n", reg.Read(SNVS_HPSVSR))
+	fmt.Fprintf(&buf, "LP status:       %#08x (LP violation:%v tamper:%v)",
+		reg.Read(SNVS_LPSR),
+		reg.Get(SNVS_LPSR, LPSR_LPS, 1) == 1,
+		reg.Get(SNVS_LPSR, LPSR_ET1D, 1) == 1)
+
+	return buf.String()
+}
+
+// configureTamper enables the SNVS security violation sources and tamper
+// detectors. All HP security violation inputs are configured as non-fatal
+// and forwarded as LP security violations, which zeroize the ZMK.
+func configureTamper(external bool) {
+	// non-fatal security violations on all inputs
+	reg.Write(SNVS_HPSVCR, 0)
+	// forward all security violation inputs to the LP domain
+	reg.SetN(SNVS_LPSVCR, 0, 0b111111, 0b111111)
+
+	// SRTC and monotonic counter rollover detection
+	reg.Set(SNVS_LPTDCR, LPTDCR_SRTCR_EN)
+	reg.Set(SNVS_LPTDCR, LPTDCR_MCR_EN)
+
+	if external {
+		// external tamper 1, active low
+		reg.Clear(SNVS_LPTDCR, LPTDCR_ET1P)
+		reg.Set(SNVS_LPTDCR, LPTDCR_ET1_EN)
+	}
+}
+
+// zmkRead returns the Zeroizable Master Key register content.
+func zmkRead() (zmk []byte) {
+	zmk = make([]byte, ZMK_SIZE)
+
+	for i := 0; i < ZMK_SIZE; i += 4 {
+		binary.LittleEndian.PutUint32(zmk[i:], reg.Read(SNVS_LPZMKR0+uint32(i)))
+	}
+
+	return
+}
+
+// zmkProgram software programs the Zeroizable Master Key, which is
+// automatically cleared by hardware on LP security violations.
+func zmkProgram(key []byte) (err error) {
+	if len(key) != ZMK_SIZE {
+		return errors.New("invalid key size")
+	}
+
+	reg.Clear(SNVS_LPMKCR, LPMKCR_ZMK_HWP)
+
+	for i := 0; i < ZMK_SIZE; i += 4 {
+		reg.Write(SNVS_LPZMKR0+uint32(i), binary.LittleEndian.Uint32(key[i:]))
+	}
+
+	reg.Set(SNVS_LPMKCR, LPMKCR_ZMK_VAL)
+
+	if !bytes.Equal(zmkRead(), key) {
+		return errors.New("ZMK readback mismatch (locked?)")
+	}
+
+	return
+}
+
+// snvsViolation triggers a software LP security violation, causing ZMK
+// zeroization.
+func snvsViolation() {
+	reg.Set(SNVS_HPCOMR, HPCOMR_SW_LPSV)
+}
+
+// TestSNVS reports the SNVS security state and demonstrates ZMK
+// zeroization on security violations.
+func TestSNVS() (err error) {
+	configureTamper(conf.Bool("snvs_tamper", false))
+
+	for _, line := range strings.Split(snvsStatus(), "\n") {
+		snvsLog.Infof("%s", line)
+	}
+
+	// the ZMK is preserved across resets, as it might be in use as key
+	// encryption key (see kek.go)
+	if zmkValid() {
+		snvsLog.Infof("ZMK preserved, use the `snvs violate` command to trigger zeroization")
+		return
+	}
+
+	key := make([]byte, ZMK_SIZE)
+
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	if err = zmkProgram(key); err != nil {
+		return
+	}
+
+	snvsLog.Infof("programmed ZMK, use the `snvs violate` command to trigger zeroization")
+
+	return
+}
+
+// zmkStatus returns the ZMK state along with a fingerprint, the first 8 bytes
+// of its SHA-256, as the key itself must never be disclosed.
+func zmkStatus() string {
+	if !zmkValid() {
+		return "ZMK: not valid\n"
+	}
+
+	sum := sha256.Sum256(zmkRead())
+
+	return fmt.Sprintf("ZMK: valid, fingerprint %x\n", sum[:8])
+}
+
+func snvsCommand(op string) (res string) {
+	if !imx6.Native {
+		return "unsupported under emulation"
+	}
+
+	switch op {
+	case "violate":
+		snvsViolation()
+		res = "software LP security violation triggered\n" + zmkStatus()
+	case "zmk":
+		res = zmkStatus()
+	}
+
+	return res + snvsStatus()
+}
@@ -0,0 +1,146 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+var soakLog = newLogger("soak")
+
+// soakStats tracks stability metrics across soak iterations.
+type soakStats struct {
+	iterations int
+	runs       int
+	failures   map[string]int
+
+	// longest stop-the-world GC pause
+	maxPause time.Duration
+	// heap high-water mark
+	maxHeap uint64
+	// memory obtained from the runtime high-water mark
+	maxSys uint64
+
+	numGC uint32
+}
+
+func (s *soakStats) sample() {
+	var m runtime.MemStats
+
+	runtime.ReadMemStats(&m)
+
+	if m.HeapAlloc > s.maxHeap {
+		s.maxHeap = m.HeapAlloc
+	}
+
+	if m.Sys > s.maxSys {
+		s.maxSys = m.Sys
+	}
+
+	// PauseNs is a circular buffer of the most recent 256 pauses, where
+	// the pause for GC cycle n is at [(n+255)%256].
+	first := s.numGC + 1
+
+	if m.NumGC > 256 && first < m.NumGC-255 {
+		first = m.NumGC - 255
+	}
+
+	for n := first; n <= m.NumGC; n++ {
+		if pause := time.Duration(m.PauseNs[(n+255)%256]); pause > s.maxPause {
+			s.maxPause = pause
+		}
+	}
+
+	s.numGC = m.NumGC
+}
+
+func (s *soakStats) report(elapsed time.Duration) {
+	var names []string
+	var total int
+
+	for name, n := range s.failures {
+		names = append(names, name)
+		total += n
+	}
+
+	sort.Strings(names)
+
+	soakLog.Infof("-- soak summary ------------------------------------------------------")
+	soakLog.Infof("iterations: %d (%d test runs in %s)", s.iterations, s.runs, elapsed)
+	soakLog.Infof("failures:   %d", total)
+
+	for _, name := range names {
+		soakLog.Infof("  %-16s %d", name, s.failures[name])
+	}
+
+	soakLog.Infof("GC cycles:  %d (max pause %s)", s.numGC, s.maxPause)
+	soakLog.Infof("heap max:   %d KiB", s.maxHeap/1024)
+	soakLog.Infof("sys max:    %d KiB", s.maxSys/1024)
+	soakLog.Infof("----------------------------------------------------------------------")
+}
+
+// soak repeatedly runs the selected example tests until either the argument
+// number of iterations or duration is reached (a zero value disables the
+// respective limit, a single iteration is run when both are zero), a summary
+// report is printed at the end.
+func soak(init bool, iterations int, duration time.Duration) {
+	stats := &soakStats{
+		failures: make(map[string]int),
+	}
+
+	if iterations <= 0 && duration <= 0 {
+		iterations = 1
+	}
+
+	start := time.Now()
+	done := make(chan bool)
+
+	// sample memory statistics in the background to catch peaks occurring
+	// within test runs
+	go func() {
+		t := time.NewTicker(1 * time.Second)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				stats.sample()
+			}
+		}
+	}()
+
+	for {
+		if iterations > 0 && stats.iterations >= iterations {
+			break
+		}
+
+		if duration > 0 && time.Since(start) >= duration {
+			break
+		}
+
+		stats.iterations += 1
+		soakLog.Infof("-- soak iteration %d (%s elapsed)", stats.iterations, time.Since(start))
+
+		for _, res := range runTests(exampleTests(init), selection) {
+			stats.runs += 1
+
+			if res.err != nil {
+				stats.failures[res.name] += 1
+			}
+		}
+	}
+
+	done <- true
+	stats.sample()
+	stats.report(time.Since(start))
+}
@@ -0,0 +1,297 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usdhc"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The uSDHC driver selects, at detection, the highest speed mode supported by
+// the card and board. Cards which fail to operate in such mode are detected
+// again without 1.8V signaling (therefore without SD UHS-I and eMMC HS200
+// modes) and then, as a last resort, on a 1-bit data bus.
+const (
+	// uSDHC base clock (PFD2 divided by 2)
+	USDHC_BASE_CLOCK = 198000000
+
+	// negotiation verification read size
+	SPEED_VERIFY_SIZE = 64 * 1024
+	// speed mode test read size
+	SPEED_TEST_SIZE = 4 * 1024 * 1024
+)
+
+var speedmodesLog = newLogger("speedmodes")
+
+// cardBus holds the board bus configuration of a memory card slot and the
+// currently applied fallback.
+type cardBus struct {
+	width      int
+	lowVoltage func() bool
+	fallback   int
+}
+
+// cardWidths holds the board data bus width of memory card slots, set by the
+// board files along with cards.
+var cardWidths []int
+
+var cardBuses = struct {
+	sync.Mutex
+	m map[*usdhc.USDHC]*cardBus
+}{m: make(map[*usdhc.USDHC]*cardBus)}
+
+var speedFallbacks = []string{"none", "no 1.8V signaling", "1-bit bus"}
+
+func busOf(card *usdhc.USDHC) *cardBus {
+	cardBuses.Lock()
+	defer cardBuses.Unlock()
+
+	if b, ok := cardBuses.m[card]; ok {
+		return b
+	}
+
+	b := &cardBus{width: 4, lowVoltage: card.LowVoltage}
+
+	for i, c := range cards {
+		if c == card && i < len(cardWidths) {
+			b.width = cardWidths[i]
+		}
+	}
+
+	cardBuses.m[card] = b
+
+	return b
+}
+
+// limitCard restricts the card bus according to the argument fallback, the
+// lowVoltage function replaces the board one when not nil.
+func limitCard(card *usdhc.USDHC, fallback int, lowVoltage func() bool) {
+	b := busOf(card)
+	b.fallback = fallback
+
+	if lowVoltage == nil {
+		lowVoltage = b.lowVoltage
+	}
+
+	switch fallback {
+	case 0:
+		card.LowVoltage = lowVoltage
+		card.Init(b.width)
+	case 1:
+		card.LowVoltage = nil
+		card.Init(b.width)
+	default:
+		card.LowVoltage = nil
+		card.Init(1)
+	}
+}
+
+// negotiateCard detects a card in the highest speed mode in which it can be
+// read, starting from the argument fallback.
+func negotiateCard(card *usdhc.USDHC, fallback int, lowVoltage func() bool) (err error) {
+	for i := fallback; i < len(speedFallbacks); i++ {
+		limitCard(card, i, lowVoltage)
+
+		if err = card.Detect(); err == nil {
+			_, err = card.Read(0, SPEED_VERIFY_SIZE)
+		}
+
+		if err == nil {
+			if i > fallback {
+				usdhcLog.Infof("%s with fallback (%s)", cardMode(card), speedFallbacks[i])
+			}
+
+			return
+		}
+
+		// no card identified, there is nothing to fall back from
+		if info := card.Info(); !info.SD && !info.MMC {
+			return
+		}
+
+		usdhcLog.Errorf("%s failed, %v", cardMode(card), err)
+	}
+
+	return
+}
+
+// cardMode returns the negotiated speed mode and card clock.
+func cardMode(card *usdhc.USDHC) string {
+	var mode string
+
+	info := card.Info()
+
+	switch {
+	case info.SD && info.Rate == usdhc.SDR104_MBPS:
+		mode = "SD SDR104"
+	case info.SD && info.Rate == usdhc.SDR50_MBPS:
+		mode = "SD SDR50"
+	case info.SD && info.HS:
+		mode = "SD High Speed"
+	case info.SD:
+		mode = "SD Default Speed"
+	case info.MMC && info.Rate == usdhc.HS200_MBPS && info.HS:
+		mode = "eMMC HS200"
+	case info.MMC && info.DDR:
+		mode = "eMMC DDR52"
+	case info.MMC && info.HS:
+		mode = "eMMC High Speed"
+	case info.MMC:
+		mode = "eMMC legacy"
+	default:
+		return "no card"
+	}
+
+	return fmt.Sprintf("%s %.1f MHz", mode, float64(cardClock(card, info.DDR))/1e6)
+}
+
+// cardClock returns the card clock frequency, as configured on the
+// controller.
+func cardClock(card *usdhc.USDHC, ddr bool) int {
+	base := uint32(usdhc.USDHC1_BASE)
+
+	if card == usdhc.USDHC2 {
+		base = usdhc.USDHC2_BASE
+	}
+
+	dvs := int(reg.Get(base+usdhc.USDHCx_SYS_CTRL, usdhc.SYS_CTRL_DVS, 0xf)) + 1
+	sdclkfs := int(reg.Get(base+usdhc.USDHCx_SYS_CTRL, usdhc.SYS_CTRL_SDCLKFS, 0xff))
+
+	// p4038, SDCLKFS[7:0], IMX6ULLRM
+	prescaler := 1
+
+	if sdclkfs != 0 {
+		prescaler = 2 * sdclkfs
+	}
+
+	if ddr {
+		prescaler *= 2
+	}
+
+	return USDHC_BASE_CLOCK / (prescaler * dvs)
+}
+
+// readSpeed reads the beginning of a card, returning its hash and the
+// achieved throughput.
+func readSpeed(card *usdhc.USDHC) (sum []byte, mbps float64, err error) {
+	h := sha256.New()
+	start := time.Now()
+
+	for off := int64(0); off < SPEED_TEST_SIZE; off += CARD_HASH_READ_SIZE {
+		buf, err := card.Read(off, CARD_HASH_READ_SIZE)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		h.Write(buf)
+	}
+
+	return h.Sum(nil), float64(SPEED_TEST_SIZE) / 1e6 / time.Since(start).Seconds(), nil
+}
+
+// testSpeedModes negotiates the highest speed mode of a card and verifies
+// that each fallback, as well as a simulated low voltage switching failure,
+// results in identical data being read.
+func testSpeedModes(n int, card *usdhc.USDHC) (err error) {
+	// always leave the card in its highest speed mode
+	defer negotiateCard(card, 0, nil)
+
+	if err = negotiateCard(card, 0, nil); err != nil {
+		speedmodesLog.Warnf("card %d skipped, %v", n, err)
+		return nil
+	}
+
+	ref, mbps, err := readSpeed(card)
+
+	if err != nil {
+		return
+	}
+
+	rate := card.Info().Rate
+	speedmodesLog.Infof("card %d %s (%.2f MB/s)", n, cardMode(card), mbps)
+
+	for i := 1; i < len(speedFallbacks); i++ {
+		limitCard(card, i, nil)
+
+		if err = card.Detect(); err != nil {
+			return fmt.Errorf("card %d detection with %s, %v", n, speedFallbacks[i], err)
+		}
+
+		sum, mbps, err := readSpeed(card)
+
+		if err != nil {
+			return fmt.Errorf("card %d read with %s, %v", n, speedFallbacks[i], err)
+		}
+
+		if !bytes.Equal(sum, ref) {
+			return fmt.Errorf("card %d data mismatch with %s", n, speedFallbacks[i])
+		}
+
+		if r := card.Info().Rate; r > rate {
+			return fmt.Errorf("card %d rate increased with %s (%d > %d MB/s)", n, speedFallbacks[i], r, rate)
+		}
+
+		speedmodesLog.Infof("card %d %s with %s (%.2f MB/s)", n, cardMode(card), speedFallbacks[i], mbps)
+	}
+
+	if busOf(card).lowVoltage == nil {
+		return
+	}
+
+	// simulate a board failing to switch to 1.8V signaling
+	if err = negotiateCard(card, 0, func() bool { return false }); err != nil {
+		return fmt.Errorf("card %d no fallback on low voltage failure, %v", n, err)
+	}
+
+	info := card.Info()
+
+	if info.Rate == usdhc.SDR50_MBPS || info.Rate == usdhc.SDR104_MBPS || (info.MMC && info.Rate == usdhc.HS200_MBPS) {
+		return fmt.Errorf("card %d %s despite low voltage failure", n, cardMode(card))
+	}
+
+	sum, _, err := readSpeed(card)
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(sum, ref) {
+		return fmt.Errorf("card %d data mismatch after low voltage failure", n)
+	}
+
+	speedmodesLog.Infof("card %d %s after low voltage failure (%s)", n, cardMode(card), speedFallbacks[busOf(card).fallback])
+
+	return
+}
+
+// TestSpeedModes reports the speed mode negotiated by each memory card and
+// verifies fallback to lower speed modes.
+func TestSpeedModes() (err error) {
+	if len(cards) == 0 {
+		return errors.New("no cards available")
+	}
+
+	for i, card := range cards {
+		if e := testSpeedModes(i, card); e != nil {
+			speedmodesLog.Errorf("%v", e)
+			err = e
+		}
+	}
+
+	return
+}
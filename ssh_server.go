@@ -15,51 +15,361 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"regexp"
 	"runtime/debug"
 	"runtime/pprof"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 
-	"github.com/f-secure-foundry/tamago/soc/imx6"
-
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
-	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+var sshLog = newLogger("ssh")
+
 const help = `
   help                              # this help
   exit, quit                        # close session
-  example                           # launch example test code
+  example [<include> [<exclude>]]   # launch example test code
+  tests                             # list example tests
+  post                              # power-on self-test (RNG, KATs, storage, fuses)
+  kat                               # crypto known answer tests
+  soak     <iterations> <sec>       # repeat example tests (0: no limit, both 0: once)
+  stress   <sec>                    # combined crypto, card and network stress
   rand                              # gather 32 bytes from TRNG via crypto/rand
-  reboot                            # reset watchdog timer
+  reboot                            # quiesce USB and storage, warm reset
   stack                             # stack trace of current goroutine
   stackall                          # stack trace of all goroutines
   ble                               # enter BLE serial console
+  ble      version                  # BLE module version and address
+  ble      advertise [<name>]       # BLE advertising as connectable
+  ble      bridge [<name>]          # serve console over BLE (until reset)
+  usbc                              # USB-C attach state, orientation and role
+  power                             # regulators, brown-out and VBUS status
+  usb                               # USB suspend state, link counters
+  usb      wakeup                   # signal remote wakeup to suspended host
+  console                           # debug UART buffer counters
+  logstore                          # persistent log state
+  logstore (dump|clear)             # print or erase persistent log
+  upload                            # test results upload state
+  upload   now                      # upload most recent test results
+  mcast                             # multicast example counters
+  pcap     start <n> <off> <MiB>    # capture USB frames to card (hex offset)
+  pcap     (stop|status)            # stop card capture, capture counters
+  trace    start <n> <off> <MiB>    # Go execution trace to card (hex offset)
+  trace    (stop|status)            # stop execution trace, trace state
   mmc read <n> <hex offset> <size>  # internal MMC/SD card read
+  mmc hash <n> [<p>] [blake2b]      # hash card or partition (p: partition)
+  mmc stress <sec>                  # concurrent card stress (see card_stress_*)
+  mmc status                        # card presence and hotplug events
+  fault    <n>                      # card fault injection state
+  fault    <n> <op> <f> <blk> <cnt> # inject card fault (op: read|write)
+  fault    <n> clear                # remove card faults
+  ext4     ls <n> <p> <path>        # list ext4 directory (p: partition, 0 for none)
+  ext4     cat <n> <p> <path>       # print ext4 file
+  ext4     sha256 <n> <p> <path>    # ext4 file SHA-256
+  ext4     cp <n> <p> <path> <dst>  # extract ext4 file to memory
+  archive  pack <n> <off> <MiB>     # pack test results to card (hex offset)
+  archive  unpack <n> <off> [<dir>] # extract card archive to memory
+  kv       bench <n> <off> <MiB>    # key-value store benchmark (destroys data)
+  blob     open <n> <off> <MiB>     # open or create blob store (hex offset)
+  blob     (status|gc)              # blob store usage, release unused chunks
+  blob     put <path>               # store file, returns its SHA-256
+  blob     get <hash> <path>        # retrieve blob to file
+  blob     rm <hash>                # remove blob
   md       <hex offset> <size>      # memory display (use with caution)
   mw       <hex offset> <hex value> # memory write   (use with caution)
+  memtest  <hex offset> <size>      # memory test    (use with caution, 0 for heap)
+  heap                              # heap usage and live objects by size class
+  heap     dump <n> <off> <MiB>     # heap dump archive to card (hex offset)
+  iomux                             # IOMUX pad configuration
+  csu                               # CSU access policy matrix
   led      (white|blue) (on|off)    # LED control
+  pwm      <hz> <duty %>            # LED PWM output (0 Hz to disable)
+  bridge                            # bridge port counters and addresses
+  filter                            # packet filter rules and counters
+  filter   add <rule>               # append packet filter rule
+  filter   del <n>                  # delete packet filter rule
+  filter   policy (allow|drop)      # packet filter default policy
+  nat                               # NAT connection tracking table
   dcp      <size> <sec>             # benchmark hardware encryption
+  snvs     (status|zmk|violate)     # SNVS state, ZMK fingerprint, violation
+  fde      format <n> <off> <MiB>   # create encrypted volume (hex offset)
+  fde      open <n> <off>           # open encrypted volume (hex offset)
+  fde      close                    # close encrypted volume
+  fde      bench <MiB>              # benchmark volume (destroys data)
+  pcr                               # boot measurements and PCR value
+  boot                              # boot time breakdown
+  date     [<unix seconds>]         # show or set wall clock time
+  totp     [secret] <service>       # TOTP code or enrollment URI
+  keytree                           # key hierarchy root and branch fingerprints
+  noise                             # Noise static key, identity binding and self test
+  mqtt                              # MQTT agent status
+  coap                              # CoAP server status and observers
+  auth                              # users and web sessions
+  auth     passwd <user> [<pw>]     # create user or change password
+  auth     del <user>               # remove user
+  auth     role <user> <role>       # set user role (viewer|operator|admin)
+  auth     key <user> <key|clear>   # add SSH public key, or remove all
+  auth     token <user> [clear]     # new API token, or remove it
+  auth     revoke [<user>]          # end web sessions (all when no user)
+  audit    [verify|dump]            # audit log state, verification or content
+  firmware                          # update key, running and staged versions
+  firmware verify <image> <sig>     # verify firmware image signature
+  btc      xpub                     # wallet account extended public key
+  btc      address <n>              # wallet receive address
+  btc      psbt <base64>            # sign PSBT, returns signed transaction
+  provision start [<cn>]            # enter provisioning mode, device key CSR
+  provision install <base64>        # install device certificate (DER)
+  provision status                  # device key and certificate
 `
 
 const MD_LIMIT = 102400
 
-var LED func(string, bool) error
+// shellCommand represents a console command, authorized by the role
+// required for its matching pattern rather than by the raw command line.
+type shellCommand struct {
+	pattern *regexp.Regexp
+	role    authRole
+	fn      func(term *terminal.Terminal, arg []string) string
+}
+
+var shellCommands []*shellCommand
+
+// addCommand registers a console command, the pattern must match the entire
+// command line.
+func addCommand(role authRole, pattern string, fn func(term *terminal.Terminal, arg []string) string) {
+	shellCommands = append(shellCommands, &shellCommand{
+		pattern: regexp.MustCompile(`^(?:` + pattern + `)$`),
+		role:    role,
+		fn:      fn,
+	})
+}
+
+// findCommand returns the console command matching a command line, along
+// with its submatches.
+func findCommand(cmd string) (*shellCommand, []string) {
+	for _, c := range shellCommands {
+		if m := c.pattern.FindStringSubmatch(cmd); m != nil {
+			return c, m
+		}
+	}
+
+	return nil, nil
+}
+
+func init() {
+	// status and read-only commands
+	addCommand(ROLE_VIEWER, `help`, func(term *terminal.Terminal, _ []string) string {
+		return string(term.Escape.Cyan) + help + string(term.Escape.Reset)
+	})
+	addCommand(ROLE_VIEWER, `tests`, func(_ *terminal.Terminal, _ []string) string { return testsCommand() })
+	addCommand(ROLE_VIEWER, `iomux`, func(_ *terminal.Terminal, _ []string) string { return iomuxDump() })
+	addCommand(ROLE_VIEWER, `csu`, func(_ *terminal.Terminal, _ []string) string { return csuDump() })
+	addCommand(ROLE_VIEWER, `filter`, func(_ *terminal.Terminal, _ []string) string { return Firewall.Status() })
+	addCommand(ROLE_VIEWER, `nat`, func(_ *terminal.Terminal, _ []string) string {
+		if NAT == nil {
+			return "NAT mode not enabled"
+		}
+
+		return NAT.Status()
+	})
+	addCommand(ROLE_VIEWER, `bridge`, func(_ *terminal.Terminal, _ []string) string {
+		if Bridge == nil {
+			return "bridge mode not enabled"
+		}
+
+		return Bridge.Status()
+	})
+	addCommand(ROLE_VIEWER, `heap`, func(_ *terminal.Terminal, _ []string) string { return heapCommand(nil) })
+	addCommand(ROLE_VIEWER, `boot`, func(_ *terminal.Terminal, _ []string) string { return bootTraceCommand() })
+	addCommand(ROLE_VIEWER, `pcr`, func(_ *terminal.Terminal, _ []string) string { return pcrCommand() })
+	addCommand(ROLE_VIEWER, `keytree`, func(_ *terminal.Terminal, _ []string) string { return keyTreeCommand() })
+	addCommand(ROLE_VIEWER, `noise`, func(_ *terminal.Terminal, _ []string) string { return noiseCommand() })
+	addCommand(ROLE_VIEWER, `mqtt`, func(_ *terminal.Terminal, _ []string) string { return mqttCommand() })
+	addCommand(ROLE_VIEWER, `coap`, func(_ *terminal.Terminal, _ []string) string { return coapCommand() })
+	addCommand(ROLE_VIEWER, `auth`, func(_ *terminal.Terminal, _ []string) string { return Auth.String() })
+	addCommand(ROLE_VIEWER, `firmware`, func(_ *terminal.Terminal, _ []string) string { return firmwareCommand("", "") })
+	addCommand(ROLE_VIEWER, `audit( verify)?`, func(_ *terminal.Terminal, m []string) string {
+		return auditCommand(strings.TrimPrefix(m[0], "audit "))
+	})
+	addCommand(ROLE_VIEWER, `usbc`, func(_ *terminal.Terminal, _ []string) string { return usbcCommand() })
+	addCommand(ROLE_VIEWER, `mcast`, func(_ *terminal.Terminal, _ []string) string { return multicastCommand() })
+	addCommand(ROLE_VIEWER, `power`, func(_ *terminal.Terminal, _ []string) string { return powerCommand() })
+	addCommand(ROLE_VIEWER, `console`, func(_ *terminal.Terminal, _ []string) string { return consoleCommand() })
+	addCommand(ROLE_VIEWER, `upload`, func(_ *terminal.Terminal, _ []string) string { return uploadCommand("upload") })
+	addCommand(ROLE_VIEWER, `logstore`, func(_ *terminal.Terminal, _ []string) string { return logStoreCommand("logstore") })
+	addCommand(ROLE_VIEWER, `usb`, func(_ *terminal.Terminal, _ []string) string { return usbPowerCommand("usb") })
+	addCommand(ROLE_VIEWER, `stack`, func(_ *terminal.Terminal, _ []string) string { return string(debug.Stack()) })
+	addCommand(ROLE_VIEWER, `stackall`, func(_ *terminal.Terminal, _ []string) string {
+		buf := new(bytes.Buffer)
+		pprof.Lookup("goroutine").WriteTo(buf, 1)
+		return buf.String()
+	})
+	addCommand(ROLE_VIEWER, `date`, func(_ *terminal.Terminal, _ []string) string { return dateCommand("") })
+	addCommand(ROLE_VIEWER, `mmc status`, func(_ *terminal.Terminal, _ []string) string { return cardStatusCommand() })
+	addCommand(ROLE_VIEWER, `fault (\d+)`, func(_ *terminal.Terminal, m []string) string { return faultCommand(m[1], nil) })
+	addCommand(ROLE_VIEWER, `trace (status)`, func(_ *terminal.Terminal, m []string) string { return traceCommand(m[1], nil) })
+	addCommand(ROLE_VIEWER, `pcap (status)`, func(_ *terminal.Terminal, m []string) string { return pcapCommand(m[1], nil) })
+	addCommand(ROLE_VIEWER, `provision (status)`, func(_ *terminal.Terminal, m []string) string { return provisionCommand(m[1], "") })
+	addCommand(ROLE_VIEWER, `ble (version)`, func(_ *terminal.Terminal, m []string) string { return bleCommand(m[1], "") })
+	addCommand(ROLE_VIEWER, `btc (xpub)`, func(_ *terminal.Terminal, m []string) string { return walletCommand(m[1], "") })
+	addCommand(ROLE_VIEWER, `btc (address) ?([^ ]*)`, func(_ *terminal.Terminal, m []string) string { return walletCommand(m[1], m[2]) })
+
+	// test execution, benchmarks and peripheral control
+	addCommand(ROLE_OPERATOR, `example`, func(_ *terminal.Terminal, _ []string) string {
+		example(false)
+		return ""
+	})
+	addCommand(ROLE_OPERATOR, `example ([^ ]+) ?([^ ]*)`, func(_ *terminal.Terminal, m []string) string { return exampleCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `rand`, func(term *terminal.Terminal, _ []string) string {
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		return string(term.Escape.Cyan) + fmt.Sprintf("%x", buf) + string(term.Escape.Reset)
+	})
+	addCommand(ROLE_OPERATOR, `post`, func(_ *terminal.Terminal, _ []string) string { return postCommand() })
+	addCommand(ROLE_OPERATOR, `kat`, func(_ *terminal.Terminal, _ []string) string { return katCommand() })
+	addCommand(ROLE_OPERATOR, `upload (now)`, func(_ *terminal.Terminal, m []string) string { return uploadCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `logstore (dump)`, func(_ *terminal.Terminal, m []string) string { return logStoreCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `usb (wakeup)`, func(_ *terminal.Terminal, m []string) string { return usbPowerCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `soak (\d+) (\d+)`, func(_ *terminal.Terminal, m []string) string { return soakCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `snvs (status)`, func(_ *terminal.Terminal, m []string) string { return snvsCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `dcp (\d+) (\d+)`, func(_ *terminal.Terminal, m []string) string { return dcpCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `led (white|blue) (on|off)`, func(_ *terminal.Terminal, m []string) string { return ledCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `pwm (\d+) (\d+(?:\.\d+)?)`, func(_ *terminal.Terminal, m []string) string { return pwmCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `mmc hash (\d+) ?(\d*) ?(sha256|blake2b)?`, func(_ *terminal.Terminal, m []string) string {
+		return cardHashCommand(m[1], m[2], m[3])
+	})
+	addCommand(ROLE_OPERATOR, `mmc stress (\d+)`, func(_ *terminal.Terminal, m []string) string { return cardStressCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `stress (\d+)`, func(_ *terminal.Terminal, m []string) string { return kitchenSinkCommand(m[1]) })
+	addCommand(ROLE_OPERATOR, `ext4 (ls|cat|sha256) (\d+) (\d+) ([^ ]+)`, func(_ *terminal.Terminal, m []string) string {
+		return ext4Command(m[1], m[2], m[3], m[4], "")
+	})
+	addCommand(ROLE_OPERATOR, `blob (open|status|put|gc) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return blobCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_OPERATOR, `trace (stop)`, func(_ *terminal.Terminal, m []string) string { return traceCommand(m[1], nil) })
+	addCommand(ROLE_OPERATOR, `pcap (stop)`, func(_ *terminal.Terminal, m []string) string { return pcapCommand(m[1], nil) })
+	addCommand(ROLE_OPERATOR, `totp ([^ ]+)`, func(_ *terminal.Terminal, m []string) string { return totpCommand("", m[1]) })
+	addCommand(ROLE_OPERATOR, `ble (advertise) ?(.*)`, func(_ *terminal.Terminal, m []string) string { return bleCommand(m[1], m[2]) })
+	addCommand(ROLE_OPERATOR, `firmware verify ([^ ]+) ([^ ]+)`, func(_ *terminal.Terminal, m []string) string { return firmwareCommand(m[1], m[2]) })
+
+	// memory and raw card access, in-memory filesystem writes, key
+	// management and usage, security settings, user management and reboot
+	addCommand(ROLE_ADMIN, `reboot`, func(_ *terminal.Terminal, _ []string) string {
+		scheduleReboot()
+		return "rebooting"
+	})
+	addCommand(ROLE_ADMIN, `(md|mw) ?([[:xdigit:]]+) (\d+|[[:xdigit:]]+)`, func(_ *terminal.Terminal, m []string) string {
+		return memoryCommand(m[1], m[2], m[3])
+	})
+	addCommand(ROLE_ADMIN, `memtest ([[:xdigit:]]+) (\d+)`, func(_ *terminal.Terminal, m []string) string { return memtestCommand(m[1], m[2]) })
+	addCommand(ROLE_ADMIN, `mmc read (\d) ?([[:xdigit:]]+) (\d+|[[:xdigit:]]+)`, func(_ *terminal.Terminal, m []string) string {
+		return cardCommand(m[1], m[2], m[3])
+	})
+	addCommand(ROLE_ADMIN, `snvs (zmk|violate)`, func(_ *terminal.Terminal, m []string) string { return snvsCommand(m[1]) })
+	addCommand(ROLE_ADMIN, `logstore (clear)`, func(_ *terminal.Terminal, m []string) string { return logStoreCommand(m[1]) })
+	addCommand(ROLE_ADMIN, `audit (dump)`, func(_ *terminal.Terminal, m []string) string { return auditCommand(m[1]) })
+	addCommand(ROLE_ADMIN, `date (\d+)`, func(_ *terminal.Terminal, m []string) string { return dateCommand(m[1]) })
+	addCommand(ROLE_ADMIN, `filter (add|del|policy) (.+)`, func(_ *terminal.Terminal, m []string) string { return filterCommand(m[1], m[2]) })
+	addCommand(ROLE_ADMIN, `fault (\d+) (.+)`, func(_ *terminal.Terminal, m []string) string {
+		return faultCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `archive (pack|unpack) (.*)`, func(_ *terminal.Terminal, m []string) string {
+		return archiveCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `ext4 (cp) (\d+) (\d+) ([^ ]+) ([^ ]+)`, func(_ *terminal.Terminal, m []string) string {
+		return ext4Command(m[1], m[2], m[3], m[4], m[5])
+	})
+	addCommand(ROLE_ADMIN, `kv bench (\d+) ([[:xdigit:]]+) (\d+)`, func(_ *terminal.Terminal, m []string) string {
+		return kvCommand(m[1], m[2], m[3])
+	})
+	addCommand(ROLE_ADMIN, `blob (get|rm) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return blobCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `fde (format|open|close|bench) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return fdeCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `heap dump (.*)`, func(_ *terminal.Terminal, m []string) string { return heapCommand(strings.Fields(m[1])) })
+	addCommand(ROLE_ADMIN, `trace (start) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return traceCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `pcap (start) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return pcapCommand(m[1], strings.Fields(m[2]))
+	})
+	addCommand(ROLE_ADMIN, `provision (start|install) ?(.*)`, func(_ *terminal.Terminal, m []string) string {
+		return provisionCommand(m[1], m[2])
+	})
+	addCommand(ROLE_ADMIN, `totp (secret )([^ ]+)`, func(_ *terminal.Terminal, m []string) string { return totpCommand(m[1], m[2]) })
+	addCommand(ROLE_ADMIN, `btc (psbt) ([^ ]*)`, func(_ *terminal.Terminal, m []string) string { return walletCommand(m[1], m[2]) })
+	addCommand(ROLE_ADMIN, `ble (bridge) ?(.*)`, func(_ *terminal.Terminal, m []string) string { return bleCommand(m[1], m[2]) })
+	addCommand(ROLE_ADMIN, `auth (passwd|del|revoke|role|key|token) ?([^ ]*) ?(.*)`, func(term *terminal.Terminal, m []string) string {
+		return authCommand(term, m[1], m[2], m[3])
+	})
+}
+
+func exampleCommand(arg1 string, arg2 string) (res string) {
+	var exclude []string
+
+	if len(arg2) > 0 {
+		exclude = strings.Split(arg2, ",")
+	}
+
+	filter, err := newTestFilter(strings.Split(arg1, ","), exclude)
 
-var dcpCommandPattern = regexp.MustCompile(`dcp (\d+) (\d+).*`)
-var ledCommandPattern = regexp.MustCompile(`led (white|blue) (on|off).*`)
-var cardCommandPattern = regexp.MustCompile(`mmc read (\d) ?([[:xdigit:]]+) (\d+|[[:xdigit:]]+).*`)
-var memoryCommandPattern = regexp.MustCompile(`(md|mw) ?([[:xdigit:]]+) (\d+|[[:xdigit:]]+).*`)
+	if err != nil {
+		return err.Error()
+	}
+
+	runTests(exampleTests(false), filter)
+
+	return
+}
+
+func testsCommand() (res string) {
+	var buf bytes.Buffer
+
+	for _, t := range exampleTests(false) {
+		status := "selected"
+
+		if !t.supported {
+			status = "unsupported"
+		} else if !selection.selects(t) {
+			status = "skipped"
+		}
+
+		fmt.Fprintf(&buf, "%-16s %s\n", t.name, status)
+	}
+
+	return buf.String()
+}
+
+func soakCommand(arg1 string, arg2 string) (res string) {
+	iterations, err := strconv.Atoi(arg1)
+
+	if err != nil {
+		return fmt.Sprintf("invalid iterations: %v", err)
+	}
+
+	sec, err := strconv.Atoi(arg2)
+
+	if err != nil {
+		return fmt.Sprintf("invalid duration: %v", err)
+	}
+
+	soak(false, iterations, time.Duration(sec)*time.Second)
+
+	return
+}
 
 func dcpCommand(arg1 string, arg2 string) (res string) {
 	size, err := strconv.Atoi(arg1)
@@ -74,7 +384,7 @@ func dcpCommand(arg1 string, arg2 string) (res string) {
 		return fmt.Sprintf("invalid duration: %v", err)
 	}
 
-	log.Printf("Doing aes-128 cbc for %ds on %d blocks", sec, size)
+	sshLog.Infof("Doing aes-128 cbc for %ds on %d blocks", sec, size)
 
 	n, d, err := testDecryption(size, sec)
 
@@ -86,14 +396,8 @@ func dcpCommand(arg1 string, arg2 string) (res string) {
 }
 
 func ledCommand(name string, state string) (res string) {
-	if LED == nil {
-		return
-	}
-
-	if state == "on" {
-		LED(name, true)
-	} else {
-		LED(name, false)
+	if err := target.LED(name, state == "on"); err != nil {
+		return err.Error()
 	}
 
 	return
@@ -189,41 +493,20 @@ func memoryCommand(op string, arg1 string, arg2 string) (res string) {
 	return
 }
 
-func handleCommand(term *terminal.Terminal, cmd string) (err error) {
+func handleCommand(term *terminal.Terminal, role authRole, cmd string) (err error) {
 	var res string
 
-	switch cmd {
-	case "exit", "quit":
+	switch c, m := findCommand(cmd); {
+	case cmd == "exit" || cmd == "quit":
 		res = "logout"
 		err = io.EOF
-	case "example":
-		example(false)
-	case "help":
-		res = string(term.Escape.Cyan) + help + string(term.Escape.Reset)
-	case "rand":
-		buf := make([]byte, 32)
-		rand.Read(buf)
-		res = string(term.Escape.Cyan) + fmt.Sprintf("%x", buf) + string(term.Escape.Reset)
-	case "reboot":
-		imx6.Reboot()
-	case "stack":
-		res = string(debug.Stack())
-	case "stackall":
-		buf := new(bytes.Buffer)
-		pprof.Lookup("goroutine").WriteTo(buf, 1)
-		res = buf.String()
+	case c == nil:
+		res = "unknown command, type `help`"
+	case authorize(term, role, c.role, cmd):
+		// role based authorization (see roles.go)
+		res = c.fn(term, m)
 	default:
-		if m := dcpCommandPattern.FindStringSubmatch(cmd); len(m) == 3 {
-			res = dcpCommand(m[1], m[2])
-		} else if m := ledCommandPattern.FindStringSubmatch(cmd); len(m) == 3 {
-			res = ledCommand(m[1], m[2])
-		} else if m := cardCommandPattern.FindStringSubmatch(cmd); len(m) == 4 {
-			res = cardCommand(m[1], m[2], m[3])
-		} else if m := memoryCommandPattern.FindStringSubmatch(cmd); len(m) == 4 {
-			res = memoryCommand(m[1], m[2], m[3])
-		} else {
-			res = "unknown command, type `help`"
-		}
+		return
 	}
 
 	fmt.Fprintln(term, res)
@@ -231,7 +514,41 @@ func handleCommand(term *terminal.Terminal, cmd string) (err error) {
 	return
 }
 
-func handleChannel(newChannel ssh.NewChannel) {
+// console runs the interactive shell on a terminal until the session ends,
+// authorizing commands for the argument role.
+func console(term *terminal.Terminal, role authRole) {
+	w := log.Writer()
+	log.SetOutput(io.MultiWriter(w, term))
+	defer log.SetOutput(w)
+
+	fmt.Fprintf(term, "%s\n", banner)
+	fmt.Fprintf(term, "%s\n", string(term.Escape.Cyan)+help+string(term.Escape.Reset))
+
+	for {
+		cmd, err := term.ReadLine()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			sshLog.Errorf("readline error, %v", err)
+			continue
+		}
+
+		if cmd != "ble" {
+			err = handleCommand(term, role, cmd)
+		} else if authorize(term, role, ROLE_OPERATOR, cmd) {
+			err = bleConsole(term)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+}
+
+func handleChannel(newChannel ssh.NewChannel, role authRole) {
 	if t := newChannel.ChannelType(); t != "session" {
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 		return
@@ -240,7 +557,7 @@ func handleChannel(newChannel ssh.NewChannel) {
 	conn, requests, err := newChannel.Accept()
 
 	if err != nil {
-		log.Printf("error accepting channel, %v", err)
+		sshLog.Errorf("error accepting channel, %v", err)
 		return
 	}
 
@@ -250,36 +567,9 @@ func handleChannel(newChannel ssh.NewChannel) {
 	go func() {
 		defer conn.Close()
 
-		log.SetOutput(io.MultiWriter(os.Stdout, term))
-		defer log.SetOutput(os.Stdout)
-
-		fmt.Fprintf(term, "%s\n", banner)
-		fmt.Fprintf(term, "%s\n", string(term.Escape.Cyan)+help+string(term.Escape.Reset))
+		console(term, role)
 
-		for {
-			cmd, err := term.ReadLine()
-
-			if err == io.EOF {
-				break
-			}
-
-			if err != nil {
-				log.Printf("readline error: %v", err)
-				continue
-			}
-
-			if cmd == "ble" {
-				err = bleConsole(term)
-			} else {
-				err = handleCommand(term, cmd)
-			}
-
-			if err == io.EOF {
-				break
-			}
-		}
-
-		log.Printf("closing ssh connection")
+		sshLog.Infof("closing ssh connection")
 	}()
 
 	go func() {
@@ -295,44 +585,44 @@ func handleChannel(newChannel ssh.NewChannel) {
 			case "pty-req":
 				// p10, 6.2.  Requesting a Pseudo-Terminal, RFC4254
 				if reqSize < 4 {
-					log.Printf("malformed pty-req request")
+					sshLog.Warnf("malformed pty-req request")
 					continue
 				}
 
 				termVariableSize := int(req.Payload[3])
 
 				if reqSize < 4+termVariableSize+8 {
-					log.Printf("malformed pty-req request")
+					sshLog.Warnf("malformed pty-req request")
 					continue
 				}
 
 				w := binary.BigEndian.Uint32(req.Payload[4+termVariableSize:])
 				h := binary.BigEndian.Uint32(req.Payload[4+termVariableSize+4:])
 
-				log.Printf("resizing terminal (%s:%dx%d)", req.Type, w, h)
+				sshLog.Infof("resizing terminal (%s:%dx%d)", req.Type, w, h)
 				term.SetSize(int(w), int(h))
 
 				req.Reply(true, nil)
 			case "window-change":
 				// p10, 6.7.  Window Dimension Change Message, RFC4254
 				if reqSize < 8 {
-					log.Printf("malformed window-change request")
+					sshLog.Warnf("malformed window-change request")
 					continue
 				}
 
 				w := binary.BigEndian.Uint32(req.Payload)
 				h := binary.BigEndian.Uint32(req.Payload[4:])
 
-				log.Printf("resizing terminal (%s:%dx%d)", req.Type, w, h)
+				sshLog.Infof("resizing terminal (%s:%dx%d)", req.Type, w, h)
 				term.SetSize(int(w), int(h))
 			}
 		}
 	}()
 }
 
-func handleChannels(chans <-chan ssh.NewChannel) {
+func handleChannels(chans <-chan ssh.NewChannel, role authRole) {
 	for newChannel := range chans {
-		go handleChannel(newChannel)
+		go handleChannel(newChannel, role)
 	}
 }
 
@@ -340,29 +630,46 @@ func startSSHServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.N
 	var err error
 
 	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
-	listener, err := gonet.ListenTCP(s, fullAddr, ipv4.ProtocolNumber)
+	listener, err := listenTCP(s, fullAddr)
 
 	if err != nil {
-		log.Fatal("listener error: ", err)
+		sshLog.Fatalf("listener error, %v", err)
 	}
 
 	srv := &ssh.ServerConfig{
-		NoClientAuth: true,
+		NoClientAuth: !authEnabled(),
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if !Auth.Verify(c.User(), string(password)) {
+				authLog.Warnf("failed ssh login for %q from %s", c.User(), c.RemoteAddr())
+				auditf("auth.failure", "ssh %q from %s", c.User(), c.RemoteAddr())
+				return nil, errors.New("invalid credentials")
+			}
+
+			return &ssh.Permissions{Extensions: map[string]string{"user": c.User()}}, nil
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// keys are only valid for the user they are authorized for
+			if user, ok := Auth.VerifyKey(key); ok && user == c.User() {
+				return &ssh.Permissions{Extensions: map[string]string{"user": user}}, nil
+			}
+
+			return nil, errors.New("unauthorized key")
+		},
 	}
 
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 
 	if err != nil {
-		log.Fatal("ECDSA key error: ", err)
+		sshLog.Fatalf("ECDSA key error, %v", err)
 	}
 
 	signer, err := ssh.NewSignerFromKey(key)
 
 	if err != nil {
-		log.Fatal("key conversion error: ", err)
+		sshLog.Fatalf("key conversion error, %v", err)
 	}
 
-	log.Printf("starting ssh server (%s) at %s:%d", ssh.FingerprintSHA256(signer.PublicKey()), addr.String(), port)
+	sshLog.Infof("starting ssh server (%s) at %s:%d", ssh.FingerprintSHA256(signer.PublicKey()), addr.String(), port)
 
 	srv.AddHostKey(signer)
 
@@ -370,20 +677,28 @@ func startSSHServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.N
 		conn, err := listener.Accept()
 
 		if err != nil {
-			log.Printf("error accepting connection, %v", err)
+			sshLog.Errorf("error accepting connection, %v", err)
 			continue
 		}
 
 		sshConn, chans, reqs, err := ssh.NewServerConn(conn, srv)
 
 		if err != nil {
-			log.Printf("error accepting handshake, %v", err)
+			sshLog.Errorf("error accepting handshake, %v", err)
 			continue
 		}
 
-		log.Printf("new ssh connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
+		sshLog.Infof("new ssh connection from %s (%s, user %q)", sshConn.RemoteAddr(), sshConn.ClientVersion(), sshConn.User())
+
+		role := ROLE_ADMIN
+
+		if authEnabled() {
+			role = Auth.Role(sshConn.Permissions.Extensions["user"])
+		}
+
+		sshLog.Infof("ssh session role %s", role)
 
 		go ssh.DiscardRequests(reqs)
-		go handleChannels(chans)
+		go handleChannels(chans, role)
 	}
 }
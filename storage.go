@@ -0,0 +1,321 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"sync"
+
+	"github.com/f-secure-foundry/tamago-example/internal/board"
+)
+
+// Persistent example data is kept, outside of any filesystem, in a raw
+// storage area of a memory card which is divided in fixed regions. The area
+// must not overlap with partitions in use, by default it lies right after the
+// configuration (see config.go) and before the typical first partition start
+// (5 MiB).
+const (
+	STORAGE_OFFSET = CONFIG_OFFSET + CONFIG_MAX_SIZE
+	STORAGE_SIZE   = 0x100000 - CONFIG_MAX_SIZE
+
+	BLOCKDEV_TEST_BLOCKS     = 16384
+	BLOCKDEV_TEST_WRITES     = 256
+	BLOCKDEV_TEST_MAX_ACCESS = 8192
+)
+
+var blockdevLog = newLogger("blockdev")
+
+// storageLayout defines the storage area regions, offsets are relative to the
+// storage area start.
+var storageLayout = map[string]struct {
+	offset int64
+	size   int64
+}{
+	"secrets": {0, 4096},
+	"tls":     {4096, 4096},
+	"hsm":     {8192, 8192},
+	"openpgp": {16384, 4096},
+	"btc":     {20480, 4096},
+	"signer":  {24576, 4096},
+	"ca":      {28672, 4096},
+	"ca_log":  {32768, 131072},
+	"attest":  {163840, 4096},
+	"results": {167936, 65536},
+	"devkey":  {233472, 4096},
+	"devcert": {237568, 4096},
+	"log":     {262144, 524288},
+	"auth":    {786432, 4096},
+	"audit":   {790528, 131072},
+}
+
+// ramCard implements a RAM backed block device, standing in for memory cards
+// on emulated runs.
+type ramCard struct {
+	sync.Mutex
+
+	blockSize int
+	buf       []byte
+}
+
+func newRAMCard(blocks int) *ramCard {
+	return &ramCard{
+		blockSize: 512,
+		buf:       make([]byte, blocks*512),
+	}
+}
+
+// BlockSize returns the device block size.
+func (c *ramCard) BlockSize() int {
+	return c.blockSize
+}
+
+// Blocks returns the device size in blocks.
+func (c *ramCard) Blocks() int {
+	return len(c.buf) / c.blockSize
+}
+
+// Read returns data from the device, accesses are not required to be aligned.
+func (c *ramCard) Read(offset int64, size int64) (buf []byte, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if offset < 0 || offset+size > int64(len(c.buf)) {
+		return nil, errors.New("read exceeds device size")
+	}
+
+	return append([]byte{}, c.buf[offset:offset+size]...), nil
+}
+
+// Write transfers data to the device, enforcing memory card alignment
+// requirements.
+func (c *ramCard) Write(offset int64, buf []byte) (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	blockSize := int64(c.blockSize)
+
+	if offset%blockSize != 0 || int64(len(buf))%blockSize != 0 {
+		return fmt.Errorf("write must be %d bytes aligned", blockSize)
+	}
+
+	if offset < 0 || offset+int64(len(buf)) > int64(len(c.buf)) {
+		return errors.New("write exceeds device size")
+	}
+
+	copy(c.buf[offset:], buf)
+
+	return
+}
+
+// cardRegion represents a raw memory card region, implementing io.ReaderAt
+// and io.WriterAt with support for accesses not aligned to card blocks.
+type cardRegion struct {
+	card   board.BlockDevice
+	offset int64
+	size   int64
+}
+
+// storageCard returns the card holding the storage area, selected by the
+// `storage_card` configuration setting.
+func storageCard() (card board.BlockDevice, err error) {
+	if !target.Native() {
+		return nil, errors.New("storage unavailable on emulated runs")
+	}
+
+	return target.Card(conf.Int("storage_card", 0))
+}
+
+// openStorage returns the named region of the storage area.
+func openStorage(name string) (r *cardRegion, err error) {
+	layout, ok := storageLayout[name]
+
+	if !ok {
+		return nil, fmt.Errorf("invalid storage region %s", name)
+	}
+
+	offset := int64(conf.Int("storage_offset", STORAGE_OFFSET))
+	size := int64(conf.Int("storage_size", STORAGE_SIZE))
+
+	if layout.offset+layout.size > size {
+		return nil, fmt.Errorf("storage region %s exceeds storage area", name)
+	}
+
+	card, err := storageCard()
+
+	if err != nil {
+		return
+	}
+
+	r = &cardRegion{
+		card:   card,
+		offset: offset + layout.offset,
+		size:   layout.size,
+	}
+
+	return
+}
+
+// Size returns the region size.
+func (r *cardRegion) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *cardRegion) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= r.size {
+		return 0, io.EOF
+	}
+
+	size := int64(len(p))
+
+	if off+size > r.size {
+		size = r.size - off
+		err = io.EOF
+	}
+
+	buf, e := r.card.Read(r.offset+off, size)
+
+	if e != nil {
+		return 0, e
+	}
+
+	n = copy(p, buf)
+
+	if int64(n) < size {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+// WriteAt implements io.WriterAt, partially written blocks are read before
+// being updated.
+func (r *cardRegion) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > r.size {
+		return 0, errors.New("write exceeds region size")
+	}
+
+	blockSize := int64(r.card.BlockSize())
+
+	if blockSize == 0 {
+		return 0, errors.New("card not detected")
+	}
+
+	start := r.offset + off
+	end := start + int64(len(p))
+
+	alignedStart := start - start%blockSize
+	alignedEnd := end
+
+	if end%blockSize != 0 {
+		alignedEnd += blockSize - end%blockSize
+	}
+
+	var buf []byte
+
+	if alignedStart == start && alignedEnd == end {
+		buf = p
+	} else {
+		if buf, err = r.card.Read(alignedStart, alignedEnd-alignedStart); err != nil {
+			return
+		}
+
+		copy(buf[start-alignedStart:], p)
+	}
+
+	if err = r.card.Write(alignedStart, buf); err != nil {
+		return
+	}
+
+	return len(p), nil
+}
+
+// Erase clears the region content.
+func (r *cardRegion) Erase() (err error) {
+	_, err = r.WriteAt(make([]byte, r.size), 0)
+	return
+}
+
+// TestBlockDevice exercises unaligned region accesses, and the encrypted
+// volume layer (see fde.go), on a RAM backed block device, allowing storage
+// code coverage on emulated runs.
+func TestBlockDevice() (err error) {
+	card := newRAMCard(BLOCKDEV_TEST_BLOCKS)
+
+	// deliberately unaligned region
+	r := &cardRegion{card: card, offset: 1000, size: 1024 * 1024}
+	ref := make([]byte, r.size)
+
+	for i := 0; i < BLOCKDEV_TEST_WRITES; i++ {
+		off := mathrand.Int63n(r.size - BLOCKDEV_TEST_MAX_ACCESS)
+		buf := make([]byte, 1+mathrand.Intn(BLOCKDEV_TEST_MAX_ACCESS))
+		rand.Read(buf)
+
+		if _, err = r.WriteAt(buf, off); err != nil {
+			return fmt.Errorf("write at %#x: %v", off, err)
+		}
+
+		copy(ref[off:], buf)
+	}
+
+	buf := make([]byte, r.size)
+
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return
+	}
+
+	if !bytes.Equal(buf, ref) {
+		return errors.New("region data mismatch")
+	}
+
+	blockdevLog.Infof("%d unaligned writes verified", BLOCKDEV_TEST_WRITES)
+
+	key := make([]byte, FDE_KEY_SIZE)
+	rand.Read(key)
+
+	v, err := newCryptVolume(key, &cardRegion{card: card, offset: 2 * 1024 * 1024, size: 4 * 1024 * 1024})
+
+	if err != nil {
+		return
+	}
+
+	plain := make([]byte, 64*FDE_SECTOR_SIZE)
+	rand.Read(plain)
+
+	for _, off := range []int64{0, 7 * FDE_SECTOR_SIZE, v.Size() - int64(len(plain))} {
+		if _, err = v.WriteAt(plain, off); err != nil {
+			return
+		}
+
+		if _, err = v.ReadAt(buf[:len(plain)], off); err != nil {
+			return
+		}
+
+		if !bytes.Equal(buf[:len(plain)], plain) {
+			return fmt.Errorf("volume data mismatch at %#x", off)
+		}
+
+		if _, err = v.data.ReadAt(buf[:len(plain)], off); err != nil {
+			return
+		}
+
+		if bytes.Contains(buf[:len(plain)], plain[:FDE_SECTOR_SIZE]) {
+			return fmt.Errorf("plaintext found on device at %#x", off)
+		}
+	}
+
+	blockdevLog.Infof("encrypted volume verified (%d sectors)", v.Size()/FDE_SECTOR_SIZE)
+
+	return
+}
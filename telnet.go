@@ -0,0 +1,197 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Telnet commands and options (RFC 854, RFC 857, RFC 858, RFC 1073).
+const (
+	TELNET_SE   = 240
+	TELNET_SB   = 250
+	TELNET_WILL = 251
+	TELNET_WONT = 252
+	TELNET_DO   = 253
+	TELNET_DONT = 254
+	TELNET_IAC  = 255
+
+	TELNET_ECHO = 1
+	TELNET_SGA  = 3
+	TELNET_NAWS = 31
+)
+
+var telnetLog = newLogger("telnet")
+
+// telnetConn implements io.ReadWriter on a telnet connection, handling the
+// protocol commands.
+type telnetConn struct {
+	net.Conn
+
+	term *terminal.Terminal
+	// pending command bytes
+	cmd []byte
+}
+
+// negotiate requests character at a time mode, with server side echo, and
+// window size reports.
+func (c *telnetConn) negotiate() (err error) {
+	_, err = c.Conn.Write([]byte{
+		TELNET_IAC, TELNET_WILL, TELNET_ECHO,
+		TELNET_IAC, TELNET_WILL, TELNET_SGA,
+		TELNET_IAC, TELNET_DO, TELNET_NAWS,
+	})
+
+	return
+}
+
+// command handles a complete telnet command, returning false if more bytes
+// are required.
+func (c *telnetConn) command() bool {
+	cmd := c.cmd
+
+	if len(cmd) < 2 {
+		return false
+	}
+
+	switch cmd[1] {
+	case TELNET_IAC:
+		// escaped data byte, handled by the caller
+		return true
+	case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+		return len(cmd) >= 3
+	case TELNET_SB:
+		if !bytes.HasSuffix(cmd, []byte{TELNET_IAC, TELNET_SE}) {
+			return false
+		}
+
+		if len(cmd) >= 9 && cmd[2] == TELNET_NAWS && c.term != nil {
+			w := binary.BigEndian.Uint16(cmd[3:])
+			h := binary.BigEndian.Uint16(cmd[5:])
+			c.term.SetSize(int(w), int(h))
+		}
+
+		return true
+	default:
+		return true
+	}
+}
+
+// Read implements io.Reader, command sequences are removed from the data.
+func (c *telnetConn) Read(p []byte) (n int, err error) {
+	buf := make([]byte, len(p))
+
+	for n == 0 {
+		var r int
+
+		if r, err = c.Conn.Read(buf); err != nil {
+			return
+		}
+
+		for _, b := range buf[:r] {
+			switch {
+			case len(c.cmd) > 0:
+				c.cmd = append(c.cmd, b)
+
+				if !c.command() {
+					continue
+				}
+
+				if c.cmd[1] == TELNET_IAC {
+					p[n] = TELNET_IAC
+					n++
+				}
+
+				c.cmd = nil
+			case b == TELNET_IAC:
+				c.cmd = []byte{b}
+			default:
+				p[n] = b
+				n++
+			}
+		}
+	}
+
+	return
+}
+
+// Write implements io.Writer, escaping data bytes matching IAC.
+func (c *telnetConn) Write(p []byte) (n int, err error) {
+	if _, err = c.Conn.Write(bytes.ReplaceAll(p, []byte{TELNET_IAC}, []byte{TELNET_IAC, TELNET_IAC})); err != nil {
+		return
+	}
+
+	return len(p), nil
+}
+
+func startTelnetServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID) {
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
+	listener, err := listenTCP(s, fullAddr)
+
+	if err != nil {
+		telnetLog.Fatalf("listener error, %v", err)
+	}
+
+	telnetLog.Infof("starting telnet server at %s:%d", addr.String(), port)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			telnetLog.Errorf("error accepting connection, %v", err)
+			continue
+		}
+
+		telnetLog.Infof("new telnet connection from %s", conn.RemoteAddr())
+
+		go func() {
+			defer conn.Close()
+
+			c := &telnetConn{Conn: conn}
+
+			if err := c.negotiate(); err != nil {
+				return
+			}
+
+			c.term = terminal.NewTerminal(c, "")
+
+			fmt.Fprintf(c.term, "warning: telnet sessions are not encrypted\n")
+
+			role := ROLE_ADMIN
+
+			// authentication (see auth.go)
+			if authEnabled() {
+				user, err := authConsole(c.term)
+
+				if err != nil {
+					authLog.Warnf("failed telnet login from %s, %v", conn.RemoteAddr(), err)
+					auditf("auth.failure", "telnet from %s", conn.RemoteAddr())
+					return
+				}
+
+				role = Auth.Role(user)
+				telnetLog.Infof("telnet login for %s (%s)", user, role)
+			}
+
+			c.term.SetPrompt(string(c.term.Escape.Red) + "> " + string(c.term.Escape.Reset))
+
+			console(c.term, role)
+
+			telnetLog.Infof("closing telnet connection")
+		}()
+	}
+}
@@ -0,0 +1,79 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// Temperature Monitor registers
+// (Temperature Monitor (TEMPMON), IMX6ULLRM).
+const (
+	TEMPMON_TEMPSENSE0     = 0x020c8180
+	TEMPMON_TEMPSENSE0_SET = 0x020c8184
+	TEMPMON_TEMPSENSE0_CLR = 0x020c8188
+	TEMPSENSE0_TEMP_CNT    = 8
+	TEMPSENSE0_FINISHED    = 2
+	TEMPSENSE0_MEASURE     = 1
+	TEMPSENSE0_POWER_DOWN  = 0
+
+	// factory calibration fuse shadow register
+	OCOTP_ANA1     = 0x021bc4e0
+	ANA1_ROOM_CNT  = 20
+	ANA1_HOT_CNT   = 8
+	ANA1_HOT_TEMP  = 0
+	TEMPMON_ROOM_C = 25
+
+	TEMPMON_TIMEOUT = 100 * time.Millisecond
+)
+
+var tempmon sync.Mutex
+
+// temperature returns the SoC die temperature in degrees Celsius, measured
+// by the on-chip sensor and converted with its factory calibration.
+func temperature() (t float64, err error) {
+	if !imx6.Native {
+		return 0, errors.New("unsupported under emulation")
+	}
+
+	tempmon.Lock()
+	defer tempmon.Unlock()
+
+	ana1 := reg.Read(OCOTP_ANA1)
+	room := float64((ana1 >> ANA1_ROOM_CNT) & 0xfff)
+	hot := float64((ana1 >> ANA1_HOT_CNT) & 0xfff)
+	hotTemp := float64(ana1 & 0xff)
+
+	if ana1 == 0 || room == hot {
+		return 0, errors.New("missing calibration")
+	}
+
+	// single measurement
+	reg.Write(TEMPMON_TEMPSENSE0_CLR, 1<<TEMPSENSE0_POWER_DOWN)
+	reg.Write(TEMPMON_TEMPSENSE0_SET, 1<<TEMPSENSE0_MEASURE)
+	defer reg.Write(TEMPMON_TEMPSENSE0_CLR, 1<<TEMPSENSE0_MEASURE)
+
+	if !reg.WaitFor(TEMPMON_TIMEOUT, TEMPMON_TEMPSENSE0, TEMPSENSE0_FINISHED, 1, 1) {
+		return 0, errors.New("measurement timeout")
+	}
+
+	count := float64(reg.Get(TEMPMON_TEMPSENSE0, TEMPSENSE0_TEMP_CNT, 0xfff))
+
+	// the count decreases linearly with temperature between the room
+	// and hot calibration points
+	t = hotTemp - (count-hot)*(hotTemp-TEMPMON_ROOM_C)/(room-hot)
+
+	return
+}
@@ -0,0 +1,584 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	mathrand "math/rand"
+	"regexp"
+	"time"
+)
+
+var testLog = newLogger("test")
+
+// exampleTest represents a named test procedure executed by example().
+type exampleTest struct {
+	name string
+	fn   func() error
+
+	// sequential tests are executed in order once all concurrent ones
+	// are completed
+	sequential bool
+	// supported is false when the test cannot run on the current target
+	supported bool
+	// benchmarks are long running and only executed when explicitly
+	// selected by an include pattern
+	benchmark bool
+}
+
+// testResult represents the outcome of an example test run.
+type testResult struct {
+	name     string
+	err      error
+	duration time.Duration
+}
+
+// testFilter selects tests by name, patterns are regular expressions which
+// must match the entire test name.
+type testFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func compilePatterns(patterns []string) (res []*regexp.Regexp, err error) {
+	for _, p := range patterns {
+		r, err := regexp.Compile("^(?:" + p + ")$")
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s, %v", p, err)
+		}
+
+		res = append(res, r)
+	}
+
+	return
+}
+
+// newTestFilter returns a filter which selects tests matching any include
+// pattern, or all tests if none is given, and none of the exclude patterns.
+func newTestFilter(include []string, exclude []string) (f *testFilter, err error) {
+	f = &testFilter{}
+
+	if f.include, err = compilePatterns(include); err != nil {
+		return
+	}
+
+	f.exclude, err = compilePatterns(exclude)
+
+	return
+}
+
+func (f *testFilter) match(name string) bool {
+	for _, r := range f.exclude {
+		if r.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, r := range f.include {
+		if r.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selects returns whether a test is run by the filter.
+func (f *testFilter) selects(t exampleTest) bool {
+	if !t.supported || t.benchmark && len(f.include) == 0 {
+		return false
+	}
+
+	return f.match(t.name)
+}
+
+// exampleTests returns all example tests, init must be true when tests are
+// executed before USB is started.
+func exampleTests(init bool) []exampleTest {
+	sleep := time.Duration(conf.Int("sleep", 100)) * time.Millisecond
+
+	return []exampleTest{
+		{
+			name:      "fs",
+			supported: true,
+			fn: func() (err error) {
+				testLog.Infof("-- fs ----------------------------------------------------------------")
+
+				if err = TestFile(); err != nil {
+					return
+				}
+
+				if err = TestDir(); err != nil {
+					return
+				}
+
+				return TestRAMDisk()
+			},
+		},
+		{
+			name:      "timer",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- timer -------------------------------------------------------------")
+
+				t := time.NewTimer(sleep)
+				testLog.Infof("waking up timer after %v", sleep)
+
+				start := time.Now()
+
+				for now := range t.C {
+					testLog.Infof("woke up at %d (%v)", now.Nanosecond(), now.Sub(start))
+					break
+				}
+
+				return nil
+			},
+		},
+		{
+			name:      "sleep",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- sleep -------------------------------------------------------------")
+
+				testLog.Infof("sleeping %s", sleep)
+				start := time.Now()
+				time.Sleep(sleep)
+				testLog.Infof("slept %s (%v)", sleep, time.Since(start))
+
+				return nil
+			},
+		},
+		{
+			name:      "rng",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- rng ---------------------------------------------------------------")
+
+				size := 32
+
+				for i := 0; i < 10; i++ {
+					rng := make([]byte, size)
+					rand.Read(rng)
+
+					if !deterministic {
+						testLog.Infof("%x", rng)
+					}
+				}
+
+				count := 1000
+				start := time.Now()
+
+				for i := 0; i < count; i++ {
+					rng := make([]byte, size)
+					rand.Read(rng)
+				}
+
+				testLog.Infof("retrieved %d random bytes in %s", size*count, time.Since(start))
+
+				if deterministic {
+					return nil
+				}
+
+				seed, err := rand.Int(rand.Reader, big.NewInt(int64(math.MaxInt64)))
+
+				if err != nil {
+					return err
+				}
+
+				mathrand.Seed(seed.Int64())
+
+				return nil
+			},
+		},
+		{
+			name:      "ecdsa",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- ecdsa -------------------------------------------------------------")
+				return TestSignAndVerify()
+			},
+		},
+		{
+			name:      "btc",
+			supported: true,
+			fn: func() (err error) {
+				testLog.Infof("-- btc ---------------------------------------------------------------")
+
+				if err = ExamplePayToAddrScript(); err != nil {
+					return
+				}
+
+				if err = ExampleExtractPkScriptAddrs(); err != nil {
+					return
+				}
+
+				if err = ExampleSignTxOutput(); err != nil {
+					return
+				}
+
+				return ExampleSignPSBT()
+			},
+		},
+		{
+			name:      "fp",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- fp ----------------------------------------------------------------")
+				return TestFP()
+			},
+		},
+		{
+			name:      "dcp",
+			supported: target.DCP(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 dcp ---------------------------------------------------------")
+				return TestDCP()
+			},
+		},
+		{
+			name:      "snvs",
+			supported: target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 snvs --------------------------------------------------------")
+				return TestSNVS()
+			},
+		},
+		{
+			name:      "uart",
+			supported: target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 uart --------------------------------------------------------")
+				return TestUART()
+			},
+		},
+		{
+			name:      "can",
+			supported: target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 flexcan -----------------------------------------------------")
+				return TestFlexCAN()
+			},
+		},
+		{
+			name:      "pwm",
+			supported: target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 pwm ---------------------------------------------------------")
+				return TestPWM()
+			},
+		},
+		{
+			name:      "adc",
+			supported: target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 adc ---------------------------------------------------------")
+				return TestADC()
+			},
+		},
+		{
+			name:       "alloc",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				runs := conf.Int("alloc_runs", 9)
+				chunksMax := 50
+				chunks := conf.Int("alloc_chunks", 0)
+
+				if chunks <= 0 {
+					chunks = mathrand.Intn(chunksMax) + 1
+				}
+
+				fillSize := conf.Int("alloc_size", 160*1024*1024)
+				chunkSize := fillSize / chunks
+
+				testLog.Infof("-- memory allocation (%d runs) ----------------------------------------", runs)
+				testAlloc(runs, chunks, chunkSize)
+
+				return nil
+			},
+		},
+		{
+			name:       "sdma",
+			sequential: true,
+			supported:  target.Native(),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 sdma --------------------------------------------------------")
+				return TestSDMA()
+			},
+		},
+		{
+			name:       "cache",
+			sequential: true,
+			supported:  target.Native(),
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- cache -------------------------------------------------------------")
+				return TestCache()
+			},
+		},
+		{
+			name:       "aead",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- aead --------------------------------------------------------------")
+				return TestAEAD()
+			},
+		},
+		{
+			name:       "rsa",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- rsa ---------------------------------------------------------------")
+				return TestRSA()
+			},
+		},
+		{
+			name:       "kdf",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- kdf ---------------------------------------------------------------")
+				return TestKDF()
+			},
+		},
+		{
+			name:       "trustzone",
+			sequential: true,
+			supported:  target.Native() && conf.Bool("trustzone", false),
+			fn: func() error {
+				testLog.Infof("-- i.mx6 trustzone ---------------------------------------------------")
+				return TestTrustZone()
+			},
+		},
+		{
+			name:       "memtest",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- memtest -----------------------------------------------------------")
+				return TestMemory()
+			},
+		},
+		{
+			name:       "usdhc",
+			sequential: true,
+			supported:  target.Native(),
+			fn: func() (err error) {
+				count := conf.Int("card_read_size", 10*1024*1024)
+				readSize := 0x7fff
+
+				if init {
+					// Pre-USB use the entire iRAM, accounting for required
+					// alignments which take additional space.
+					readSize = 0x20000 - 512
+				}
+
+				testLog.Infof("-- memory cards -------------------------------------------------------")
+
+				for _, card := range cards {
+					if e := TestUSDHC(card, count, readSize); e != nil {
+						err = e
+					}
+				}
+
+				return
+			},
+		},
+		{
+			name:       "blockdev",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- block device ------------------------------------------------------")
+				return TestBlockDevice()
+			},
+		},
+		{
+			name:       "netloop",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- network loopback --------------------------------------------------")
+				return TestNetworkLoopback()
+			},
+		},
+		{
+			name:       "tcptune",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- tcp tuning --------------------------------------------------------")
+				return TestTCPTuning()
+			},
+		},
+		{
+			name:       "archive",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- archive -----------------------------------------------------------")
+				return TestArchive()
+			},
+		},
+		{
+			name:       "kvstore",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- key-value store ---------------------------------------------------")
+				return TestKVStore()
+			},
+		},
+		{
+			name:       "blobstore",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- blob store --------------------------------------------------------")
+				return TestBlobStore()
+			},
+		},
+		{
+			name:       "faults",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- storage faults ----------------------------------------------------")
+				return TestStorageFaults()
+			},
+		},
+		{
+			name:       "cardstress",
+			sequential: true,
+			supported:  target.Native(),
+			fn: func() error {
+				testLog.Infof("-- memory card stress ------------------------------------------------")
+				return TestCardStress()
+			},
+		},
+		{
+			name:       "speedmodes",
+			sequential: true,
+			supported:  target.Native(),
+			fn: func() error {
+				testLog.Infof("-- memory card speed modes -------------------------------------------")
+				return TestSpeedModes()
+			},
+		},
+		{
+			name:       "irqlatency",
+			sequential: true,
+			supported:  target.Native(),
+			fn: func() error {
+				testLog.Infof("-- interrupt latency -------------------------------------------------")
+				return TestIRQLatency()
+			},
+		},
+		{
+			name:       "kitchensink",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- kitchen sink stress -----------------------------------------------")
+				return TestKitchenSink()
+			},
+		},
+		{
+			name:       "controlloop",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- control loop ------------------------------------------------------")
+				return TestControlLoop()
+			},
+		},
+		{
+			name:       "dmapath",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- usb dma data path -------------------------------------------------")
+				return TestDMAPath()
+			},
+		},
+		{
+			name:       "mtu",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- mtu ---------------------------------------------------------------")
+				return TestMTU()
+			},
+		},
+		{
+			name:      "roles",
+			supported: true,
+			fn: func() error {
+				testLog.Infof("-- roles -------------------------------------------------------------")
+				return TestRoles()
+			},
+		},
+		{
+			name:       "logstore",
+			sequential: true,
+			supported:  true,
+			fn: func() error {
+				testLog.Infof("-- log store ---------------------------------------------------------")
+				return TestLogStore()
+			},
+		},
+		{
+			name:       "consttime",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- constant time -----------------------------------------------------")
+				return TestConstantTime()
+			},
+		},
+		{
+			name:       "hash",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- hash --------------------------------------------------------------")
+				return TestHash()
+			},
+		},
+		{
+			name:       "pq",
+			sequential: true,
+			supported:  true,
+			benchmark:  true,
+			fn: func() error {
+				testLog.Infof("-- post-quantum ------------------------------------------------------")
+				return TestPQ()
+			},
+		},
+	}
+}
@@ -0,0 +1,160 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Time-based One-Time Password (RFC 6238) parameters, matching the defaults
+// of common authenticator applications.
+const (
+	TOTP_PERIOD      = 30 * time.Second
+	TOTP_DIGITS      = 6
+	TOTP_SECRET_SIZE = 20
+)
+
+var totpServicePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// totpSecret returns the secret of a service, derived from the key tree
+// (see keytree.go) so that secrets are never stored and are bound to the
+// hardware.
+func totpSecret(service string) ([]byte, error) {
+	if !totpServicePattern.MatchString(service) {
+		return nil, errors.New("invalid service name")
+	}
+
+	n, err := hardwareKeyNode(KEY_AUTH + "/totp")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return n.Key([]byte(service), TOTP_SECRET_SIZE), nil
+}
+
+// hotp computes an HMAC-based One-Time Password (RFC 4226).
+func hotp(secret []byte, counter uint64) uint32 {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	off := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+
+	mod := uint32(1)
+
+	for i := 0; i < TOTP_DIGITS; i++ {
+		mod *= 10
+	}
+
+	return code % mod
+}
+
+// totpCode returns the code of a service at the argument time, along with
+// its remaining validity.
+func totpCode(service string, t time.Time) (code string, left time.Duration, err error) {
+	secret, err := totpSecret(service)
+
+	if err != nil {
+		return
+	}
+
+	step := uint64(t.Unix()) / uint64(TOTP_PERIOD/time.Second)
+	left = TOTP_PERIOD - time.Duration(t.Unix()%int64(TOTP_PERIOD/time.Second))*time.Second
+
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, hotp(secret, step)), left, nil
+}
+
+// totpURI returns the key URI used to enroll a service in an authenticator
+// application.
+func totpURI(service string) (string, error) {
+	secret, err := totpSecret(service)
+
+	if err != nil {
+		return "", err
+	}
+
+	id := imx6.UniqueID()
+	label := fmt.Sprintf("TamaGo %X:%s", id, service)
+
+	v := url.Values{}
+	v.Set("secret", strings.TrimRight(base32.StdEncoding.EncodeToString(secret), "="))
+	v.Set("issuer", fmt.Sprintf("TamaGo %X", id))
+	v.Set("digits", fmt.Sprintf("%d", TOTP_DIGITS))
+	v.Set("period", fmt.Sprintf("%d", TOTP_PERIOD/time.Second))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", url.PathEscape(label), v.Encode()), nil
+}
+
+func totpCommand(op string, service string) (res string) {
+	if !imx6.Native {
+		return "unsupported under emulation"
+	}
+
+	if strings.TrimSpace(op) == "secret" {
+		uri, err := totpURI(service)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		auditf("key.export", "totp %s", service)
+
+		return uri
+	}
+
+	code, left, err := totpCode(service, Now())
+
+	if err != nil {
+		return err.Error()
+	}
+
+	res = fmt.Sprintf("%s (valid for %s)", code, left)
+
+	if !TimeSet() {
+		res += ", warning: device time not set, see `date`"
+	}
+
+	return
+}
+
+// totpHandler serves the current code of a service at /totp/<service>.
+func totpHandler(w http.ResponseWriter, r *http.Request) {
+	if !TimeSet() {
+		http.Error(w, "device time not set", http.StatusServiceUnavailable)
+		return
+	}
+
+	code, left, err := totpCode(strings.TrimPrefix(r.URL.Path, "/totp/"), Now())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "%s %d\n", code, left/time.Second)
+}
@@ -0,0 +1,230 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"unsafe"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// TrustZone Address Space Controller (TZC-380) registers
+// (TrustZone Address Space Controller (TZASC), IMX6ULLRM).
+const (
+	TZASC_BASE = 0x021d0000
+
+	TZASC_CONF     = TZASC_BASE + 0x000
+	TZASC_ACTION   = TZASC_BASE + 0x004
+	TZASC_STATUS   = TZASC_BASE + 0x010
+	TZASC_CLEAR    = TZASC_BASE + 0x014
+	TZASC_FAIL_LOW = TZASC_BASE + 0x020
+	TZASC_FAIL_CTL = TZASC_BASE + 0x028
+	FAIL_DIRECTION = 24
+	FAIL_NS        = 21
+
+	TZASC_REGION_LOW  = TZASC_BASE + 0x100
+	TZASC_REGION_ATTR = TZASC_BASE + 0x108
+	REGION_SP         = 28
+	REGION_SIZE       = 1
+	REGION_EN         = 0
+
+	// secure and non-secure read/write access
+	SP_ALL = 0b1111
+	// secure only read/write access
+	SP_SECURE = 0b1100
+
+	// TZASC bypass control, this bit is sticky until the next reset
+	IOMUXC_GPR_GPR9 = 0x020e4024
+	GPR9_TZASC1_BYP = 0
+)
+
+var tzLog = newLogger("imx6_tz")
+
+// Secure Monitor Call functions handled by the monitor stub.
+const (
+	SMC_QUERY = iota
+	SMC_NONSECURE
+	SMC_SECURE
+)
+
+const (
+	DRAM_START = 0x80000000
+	DRAM_SIZE  = 0x20000000
+
+	// secure memory carve-out, must be a power of 2 of at least 32 KiB
+	CARVEOUT_SIZE = 0x100000
+	// carve-out test pattern
+	CARVEOUT_MAGIC = 0x5ecc0de5
+)
+
+// defined in trustzone_arm.s
+func read_nsacr() uint32
+func write_mvbar(addr uint32)
+func monitor_handler()
+func smc(fn uint32) uint32
+
+var (
+	// monitor vector table, it must be 32 bytes aligned and therefore it
+	// is placed within a larger buffer
+	monitorVectors [16]uint32
+	// memory backing the secure carve-out, it must never be released as
+	// the non-secure world cannot access it
+	carveout []byte
+)
+
+// installMonitor sets the Monitor Vector Base Address to a table which
+// routes Secure Monitor Calls to monitor_handler(), all other monitor
+// exceptions spin forever.
+func installMonitor() {
+	addr := uint32(uintptr(unsafe.Pointer(&monitorVectors[0])))
+	off := (32 - addr%32) % 32 / 4
+	vectors := monitorVectors[off : off+9]
+
+	for i := range vectors {
+		// b .
+		vectors[i] = 0xeafffffe
+	}
+
+	// SMC vector: ldr pc, [pc, #16]
+	vectors[2] = 0xe59ff010
+	vectors[8] = uint32(reflect.ValueOf(monitor_handler).Pointer())
+
+	imx6.ARM.CacheFlushData()
+	imx6.ARM.CacheFlushInstruction()
+
+	write_mvbar(addr + off*4)
+}
+
+// tzascRegion configures a TZASC region, the start address must be aligned
+// to its size.
+func tzascRegion(n int, start uint32, size uint32, sp uint32) {
+	var bits uint32
+
+	for bits = 0; 1<<(bits+1) < size; bits++ {
+	}
+
+	reg.Write(TZASC_REGION_LOW+uint32(n*0x10), start)
+	reg.Write(TZASC_REGION_ATTR+uint32(n*0x10), sp<<REGION_SP|bits<<REGION_SIZE|1<<REGION_EN)
+}
+
+// configureTZASC grants non-secure access to all DRAM, except for a secure
+// carve-out, and enables the TZASC.
+func configureTZASC() (start uint32) {
+	carveout = make([]byte, 2*CARVEOUT_SIZE)
+
+	addr := uint32(uintptr(unsafe.Pointer(&carveout[0])))
+	start = addr + (CARVEOUT_SIZE-addr%CARVEOUT_SIZE)%CARVEOUT_SIZE
+
+	// raise an (unused) interrupt and return OKAY responses on failures,
+	// so that non-secure accesses read zero and writes are ignored
+	reg.Write(TZASC_ACTION, 0b10)
+	reg.Write(TZASC_CLEAR, 1)
+
+	// region 0 (secure only) is the default covering the entire address
+	// space, higher numbered regions take priority
+	tzascRegion(1, DRAM_START, DRAM_SIZE, SP_ALL)
+	tzascRegion(2, start, CARVEOUT_SIZE, SP_SECURE)
+
+	reg.Set(IOMUXC_GPR_GPR9, GPR9_TZASC1_BYP)
+
+	return
+}
+
+// configureCSU grants non-secure access to all peripherals, except those
+// whose CSL registers are listed in the `tz_secure_csl` configuration
+// setting, the previous configuration is returned.
+func configureCSU() (csl []uint32) {
+	secure := make(map[int]bool)
+
+	for _, n := range conf.List("tz_secure_csl", nil) {
+		if i, err := strconv.Atoi(n); err == nil && i >= 0 && i < CSU_SLAVES {
+			secure[i] = true
+		}
+	}
+
+	for i := 0; i < CSU_SLAVES; i++ {
+		csl = append(csl, reg.Read(CSU_CSL0+uint32(i*4)))
+
+		if secure[i] {
+			csuSet(i, CSL_SECURE)
+		} else {
+			csuSet(i, CSL_ALL)
+		}
+	}
+
+	return
+}
+
+func world() string {
+	if smc(SMC_QUERY)&1 == 1 {
+		return "non-secure"
+	}
+
+	return "secure"
+}
+
+// TestTrustZone carves out secure memory, switches to the non-secure world
+// and verifies that the carve-out is not accessible before returning to the
+// secure world through the monitor.
+func TestTrustZone() (err error) {
+	if !imx6.ARM.Secure() {
+		return errors.New("not running in secure world")
+	}
+
+	installMonitor()
+	tzLog.Infof("monitor installed, %s world", world())
+
+	csl := configureCSU()
+
+	defer func() {
+		for i, v := range csl {
+			reg.Write(CSU_CSL0+uint32(i*4), v)
+		}
+	}()
+
+	start := configureTZASC()
+	defer reg.Clear(TZASC_REGION_ATTR+0x20, REGION_EN)
+
+	tzLog.Infof("secure carve-out at %#x-%#x", start, start+CARVEOUT_SIZE-1)
+
+	reg.Write(start, CARVEOUT_MAGIC)
+
+	// Go code keeps running after the world switch, the monitor stub
+	// mirrors the secure MMU and vector configuration in the non-secure
+	// banked registers and grants access to the floating point unit.
+	smc(SMC_NONSECURE)
+	tzLog.Infof("switched to %s world", world())
+
+	val := reg.Read(start)
+	reg.Write(start, ^uint32(CARVEOUT_MAGIC))
+
+	tzLog.Infof("carve-out read %#x from non-secure world", val)
+
+	smc(SMC_SECURE)
+	tzLog.Infof("switched back to %s world (NSACR:%#x)", world(), read_nsacr())
+
+	if reg.Get(TZASC_STATUS, 0, 1) == 1 {
+		tzLog.Infof("TZASC failure at %#x (non-secure:%v write:%v)",
+			reg.Read(TZASC_FAIL_LOW),
+			reg.Get(TZASC_FAIL_CTL, FAIL_NS, 1) == 1,
+			reg.Get(TZASC_FAIL_CTL, FAIL_DIRECTION, 1) == 1)
+		reg.Write(TZASC_CLEAR, 1)
+	}
+
+	if val != 0 || reg.Read(start) != CARVEOUT_MAGIC {
+		return errors.New("secure carve-out accessed from non-secure world")
+	}
+
+	return
+}
@@ -0,0 +1,78 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+#include "textflag.h"
+
+// func read_nsacr() uint32
+TEXT ·read_nsacr(SB),$0-4
+	MRC	15, 0, R0, C1, C1, 2
+	MOVW	R0, ret+0(FP)
+	RET
+
+// func write_mvbar(addr uint32)
+TEXT ·write_mvbar(SB),$0-4
+	MOVW	addr+0(FP), R0
+	MCR	15, 0, R0, C12, C0, 1
+	WORD	$0xf57ff06f // isb sy
+	RET
+
+// The monitor handler is entered in Monitor mode, on Secure Monitor Calls
+// from either world, with the requested function in R0. R2-R7 are clobbered,
+// the SCR value at entry is returned in R0.
+//
+// func monitor_handler()
+TEXT ·monitor_handler(SB),NOSPLIT|NOFRAME,$0
+	MRC	15, 0, R2, C1, C1, 0		// read SCR
+	CMP	$1, R0
+	BEQ	nonsecure
+	CMP	$2, R0
+	BEQ	secure
+	MOVW	R2, R0
+	WORD	$0xe1b0f00e			// movs pc, lr
+secure:
+	MOVW	R2, R0
+	BIC	$1, R2				// clear SCR.NS
+	MCR	15, 0, R2, C1, C1, 0
+	WORD	$0xf57ff06f			// isb sy
+	WORD	$0xe1b0f00e			// movs pc, lr
+nonsecure:
+	MRC	15, 0, R3, C1, C1, 2		// read NSACR
+	ORR	$0xc00, R3			// non-secure access to CP10/CP11 (VFP)
+	MCR	15, 0, R3, C1, C1, 2
+	MRC	15, 0, R3, C1, C0, 0		// read secure SCTLR
+	MRC	15, 0, R4, C2, C0, 0		// read secure TTBR0
+	MRC	15, 0, R5, C2, C0, 2		// read secure TTBCR
+	MRC	15, 0, R6, C3, C0, 0		// read secure DACR
+	MRC	15, 0, R7, C12, C0, 0		// read secure VBAR
+	MOVW	R2, R0
+	ORR	$1, R2				// set SCR.NS
+	MCR	15, 0, R2, C1, C1, 0
+	WORD	$0xf57ff06f			// isb sy
+	MCR	15, 0, R5, C2, C0, 2		// write non-secure TTBCR
+	MCR	15, 0, R4, C2, C0, 0		// write non-secure TTBR0
+	MCR	15, 0, R6, C3, C0, 0		// write non-secure DACR
+	MCR	15, 0, R7, C12, C0, 0		// write non-secure VBAR
+	MCR	15, 0, R3, C1, C0, 0		// write non-secure SCTLR
+	WORD	$0xf57ff06f			// isb sy
+	WORD	$0xe1b0f00e			// movs pc, lr
+
+// Secure and Non-secure cache lines are tagged separately, therefore the data
+// cache is cleaned and invalidated before switching world, without any memory
+// access between maintenance and the SMC instruction.
+//
+// func smc(fn uint32) uint32
+TEXT ·smc(SB),NOSPLIT|NOFRAME,$0-8
+	MOVW	fn+0(FP), R6
+	MOVW	R14, R12
+	BL	·flush_data_cache(SB)
+	MOVW	R12, R14
+
+	MOVW	R6, R0
+	WORD	$0xe1600070			// smc #0
+	MOVW	R0, ret+4(FP)
+	RET
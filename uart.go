@@ -0,0 +1,260 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The imx6 package only exposes the UART instances used by the supported
+// boards, secondary ports are therefore driven directly for testing
+// (UART Memory Map/Register Definition, IMX6ULLRM).
+const (
+	UARTx_USR1 = 0x0094
+	USR1_RTSS  = 14
+	USR1_TRDY  = 13
+
+	UTS_LOOP = 12
+
+	UART_FIFO_SIZE = 32
+)
+
+var uartLog = newLogger("imx6_uart")
+
+var uartBases = map[int]uint32{
+	3: imx6.UART3_BASE,
+	4: imx6.UART4_BASE,
+	5: imx6.UART5_BASE,
+	6: imx6.UART6_BASE,
+	7: imx6.UART7_BASE,
+	8: imx6.UART8_BASE,
+}
+
+var errUARTTimeout = errors.New("receive timeout")
+
+var uartBaudrates = []uint32{115200, 460800, 921600, 2000000}
+
+// secondaryUART represents a UART controller not used by the board
+// packages.
+type secondaryUART struct {
+	base uint32
+	// internal TX to RX loopback
+	loopback bool
+}
+
+func (hw *secondaryUART) clock() uint32 {
+	var freq uint32 = imx6.VCO_FREQ
+
+	if reg.Get(imx6.CCM_CSCDR1, imx6.CSCDR1_UART_CLK_SEL, 1) == 1 {
+		freq = imx6.OSC_FREQ
+	}
+
+	podf := reg.Get(imx6.CCM_CSCDR1, imx6.CSCDR1_UART_CLK_PODF, 0b111111)
+
+	// static /6 divider
+	return freq / (podf + 1) / 6
+}
+
+// init configures the controller in RS-232 mode, 8N1, with the argument
+// baud rate.
+func (hw *secondaryUART) init(baudrate uint32) (err error) {
+	reg.Write(hw.base+imx6.UARTx_UCR1, 0)
+	reg.Write(hw.base+imx6.UARTx_UCR2, 0)
+
+	if !reg.WaitFor(100*time.Millisecond, hw.base+imx6.UARTx_UCR2, imx6.UCR2_SRST, 1, 1) {
+		return errors.New("reset timeout")
+	}
+
+	reg.Write(hw.base+imx6.UARTx_UCR3, 1<<imx6.UCR3_DSR|1<<imx6.UCR3_DCD|1<<imx6.UCR3_RI|1<<imx6.UCR3_ADNIMP|1<<imx6.UCR3_RXDMUXSEL)
+
+	// reference clock divided by 2, TX FIFO threshold 2, RX FIFO
+	// threshold 1
+	reg.Write(hw.base+imx6.UARTx_UFCR, 0b100<<imx6.UFCR_RFDIV|2<<imx6.UFCR_TXTL|1<<imx6.UFCR_RXTL)
+
+	//              ref_clk
+	// baudrate = -----------   (with UBIR = 15)
+	//             UBMR + 1
+	ref := hw.clock() / 2
+	ubmr := ref/baudrate - 1
+
+	if ubmr < 15 {
+		return fmt.Errorf("unsupported baud rate %d (reference clock %d Hz)", baudrate, ref)
+	}
+
+	reg.Write(hw.base+imx6.UARTx_UBIR, 15)
+	reg.Write(hw.base+imx6.UARTx_UBMR, ubmr)
+
+	// manual CTS control, transmitter ignores RTS
+	reg.Write(hw.base+imx6.UARTx_UCR2, 1<<imx6.UCR2_IRTS|1<<imx6.UCR2_WS|1<<imx6.UCR2_TXEN|1<<imx6.UCR2_RXEN|1<<imx6.UCR2_SRST)
+
+	if hw.loopback {
+		reg.Set(hw.base+imx6.UARTx_UTS, UTS_LOOP)
+	} else {
+		reg.Clear(hw.base+imx6.UARTx_UTS, UTS_LOOP)
+	}
+
+	reg.Set(hw.base+imx6.UARTx_UCR1, imx6.UCR1_UARTEN)
+
+	return
+}
+
+func (hw *secondaryUART) disable() {
+	reg.Clear(hw.base+imx6.UARTx_UTS, UTS_LOOP)
+	reg.Write(hw.base+imx6.UARTx_UCR1, 0)
+}
+
+// transfer transmits a buffer, in FIFO sized chunks, and returns the
+// received data.
+func (hw *secondaryUART) transfer(buf []byte, timeout time.Duration) (rx []byte, err error) {
+	for off := 0; off < len(buf); off += UART_FIFO_SIZE / 2 {
+		end := off + UART_FIFO_SIZE/2
+
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		for _, c := range buf[off:end] {
+			reg.Write(hw.base+imx6.UARTx_UTXD, uint32(c))
+		}
+
+		for len(rx) < end {
+			if !reg.WaitFor(timeout, hw.base+imx6.UARTx_USR2, imx6.USR2_RDR, 1, 1) {
+				return rx, fmt.Errorf("receive timeout after %d bytes", len(rx))
+			}
+
+			urxd := reg.Read(hw.base + imx6.UARTx_URXD)
+
+			if (urxd>>imx6.URXD_PRERR)&0b11111 != 0 {
+				return rx, fmt.Errorf("receive error (URXD:%#x)", urxd)
+			}
+
+			rx = append(rx, byte(urxd))
+		}
+	}
+
+	return
+}
+
+// write transmits a buffer, waiting for TX FIFO space as needed.
+func (hw *secondaryUART) write(buf []byte, timeout time.Duration) (err error) {
+	for _, c := range buf {
+		if !reg.WaitFor(timeout, hw.base+UARTx_USR1, USR1_TRDY, 1, 1) {
+			return errors.New("transmit timeout")
+		}
+
+		reg.Write(hw.base+imx6.UARTx_UTXD, uint32(c))
+	}
+
+	return
+}
+
+// read returns a single received byte.
+func (hw *secondaryUART) read(timeout time.Duration) (c byte, err error) {
+	if !reg.WaitFor(timeout, hw.base+imx6.UARTx_USR2, imx6.USR2_RDR, 1, 1) {
+		return 0, errUARTTimeout
+	}
+
+	urxd := reg.Read(hw.base + imx6.UARTx_URXD)
+
+	if (urxd>>imx6.URXD_PRERR)&0b11111 != 0 {
+		return 0, fmt.Errorf("receive error (URXD:%#x)", urxd)
+	}
+
+	return byte(urxd), nil
+}
+
+// flow verifies that the CTS output is reflected on the RTS input, this
+// requires an external CTS_B to RTS_B jumper.
+func (hw *secondaryUART) flow() (err error) {
+	ucr2 := hw.base + imx6.UARTx_UCR2
+	usr1 := hw.base + UARTx_USR1
+
+	for _, assert := range []bool{true, false, true} {
+		if assert {
+			reg.Set(ucr2, imx6.UCR2_CTS)
+		} else {
+			reg.Clear(ucr2, imx6.UCR2_CTS)
+		}
+
+		time.Sleep(1 * time.Millisecond)
+
+		if rtss := reg.Get(usr1, USR1_RTSS, 1) == 1; rtss != assert {
+			return fmt.Errorf("RTS status %v does not follow CTS %v", rtss, assert)
+		}
+	}
+
+	return
+}
+
+// TestUART validates a secondary UART at increasing baud rates, either with
+// internal loopback or with an external TX/RX and RTS/CTS jumper.
+func TestUART() (err error) {
+	n := conf.Int("uart_port", 3)
+	base, ok := uartBases[n]
+
+	if !ok {
+		return fmt.Errorf("invalid UART%d", n)
+	}
+
+	hw := &secondaryUART{
+		base:     base,
+		loopback: !conf.Bool("uart_external", false),
+	}
+
+	defer hw.disable()
+
+	var rx []byte
+	buf := make([]byte, 256)
+
+	for _, baudrate := range uartBaudrates {
+		if err = hw.init(baudrate); err != nil {
+			return
+		}
+
+		if _, err = rand.Read(buf); err != nil {
+			return
+		}
+
+		// allow 10 times the theoretical duration of a FIFO chunk
+		timeout := time.Duration(10*UART_FIFO_SIZE*10) * time.Second / time.Duration(baudrate)
+
+		start := time.Now()
+
+		if rx, err = hw.transfer(buf, timeout); err != nil {
+			return fmt.Errorf("UART%d @ %d: %v", n, baudrate, err)
+		}
+
+		if !bytes.Equal(buf, rx) {
+			return fmt.Errorf("UART%d @ %d: data mismatch", n, baudrate)
+		}
+
+		uartLog.Infof("UART%d @ %d baud, %d bytes verified in %s (loopback:%v)",
+			n, baudrate, len(buf), time.Since(start), hw.loopback)
+	}
+
+	if hw.loopback {
+		return
+	}
+
+	if err = hw.flow(); err != nil {
+		return fmt.Errorf("UART%d: %v", n, err)
+	}
+
+	uartLog.Infof("UART%d RTS/CTS verified", n)
+
+	return
+}
@@ -0,0 +1,344 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Test results can be collected centrally, e.g. on board farms, by uploading
+// them to the HTTP(S) endpoint set with `upload_url` after each run, as soon as
+// a network interface with a route to it is up.
+//
+// Each upload is a gzip compressed tar archive (see archive.go), named after
+// the device unique ID and upload time, holding the results, the log history
+// and, when `upload_profiles` is set, the heap dump files (see heapdump.go).
+// As there is no DNS resolver the endpoint host must be an IP address, HTTPS
+// endpoints are authenticated by the SHA-256 fingerprint of their certificate
+// (`upload_pin`) as no root certificates are available.
+const (
+	UPLOAD_TIMEOUT  = 30 * time.Second
+	UPLOAD_RETRY    = 10 * time.Second
+	UPLOAD_ATTEMPTS = 5
+)
+
+var uploadLog = newLogger("upload")
+
+// resultUploader uploads test results on any of the available network
+// stacks.
+type resultUploader struct {
+	sync.Mutex
+
+	once   sync.Once
+	notify chan struct{}
+
+	stacks  []*stack.Stack
+	pending bool
+
+	uploaded uint64
+	failed   uint64
+	status   string
+}
+
+// Uploader is the test results uploader.
+var Uploader = &resultUploader{notify: make(chan struct{}, 1)}
+
+func (u *resultUploader) signal() {
+	select {
+	case u.notify <- struct{}{}:
+	default:
+	}
+}
+
+// addStack makes a network stack available for uploads.
+func (u *resultUploader) addStack(s *stack.Stack) {
+	u.Lock()
+	u.stacks = append(u.stacks, s)
+	u.Unlock()
+
+	u.once.Do(func() {
+		go u.run()
+	})
+
+	u.signal()
+}
+
+// queue requests the upload of the most recent results.
+func (u *resultUploader) queue() {
+	u.Lock()
+	u.pending = true
+	u.Unlock()
+
+	u.signal()
+}
+
+func (u *resultUploader) run() {
+	for range u.notify {
+		u.Lock()
+		pending := u.pending && len(u.stacks) > 0
+		stacks := append([]*stack.Stack{}, u.stacks...)
+		u.pending = false
+		u.Unlock()
+
+		if !pending {
+			continue
+		}
+
+		var err error
+		var size int
+
+		for attempt := 1; attempt <= UPLOAD_ATTEMPTS; attempt++ {
+			if size, err = upload(stacks); err == nil {
+				break
+			}
+
+			uploadLog.Warnf("attempt %d/%d failed, %v", attempt, UPLOAD_ATTEMPTS, err)
+
+			if attempt < UPLOAD_ATTEMPTS {
+				time.Sleep(UPLOAD_RETRY)
+			}
+		}
+
+		u.Lock()
+
+		if err != nil {
+			u.failed += 1
+			u.status = fmt.Sprintf("failed at %s, %v", Now().Format(time.RFC3339), err)
+			uploadLog.Errorf("results not uploaded, %v", err)
+		} else {
+			u.uploaded += 1
+			u.status = fmt.Sprintf("uploaded %d bytes at %s", size, Now().Format(time.RFC3339))
+			uploadLog.Infof("results uploaded (%d bytes)", size)
+		}
+
+		u.Unlock()
+	}
+}
+
+func (u *resultUploader) String() string {
+	u.Lock()
+	defer u.Unlock()
+
+	status := u.status
+
+	if status == "" {
+		status = "none"
+	}
+
+	return fmt.Sprintf("endpoint: %s, interfaces: %d, uploaded: %d, failed: %d, last: %s",
+		conf.String("upload_url", ""), len(u.stacks), u.uploaded, u.failed, status)
+}
+
+// uploadEndpoint returns the configured endpoint and its network address.
+func uploadEndpoint() (endpoint *url.URL, addr tcpip.FullAddress, err error) {
+	if endpoint, err = url.Parse(conf.String("upload_url", "")); err != nil {
+		return
+	}
+
+	port := 80
+
+	switch endpoint.Scheme {
+	case "http":
+	case "https":
+		port = 443
+	default:
+		return nil, addr, fmt.Errorf("unsupported scheme %s", endpoint.Scheme)
+	}
+
+	if p := endpoint.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, addr, fmt.Errorf("invalid port %s", p)
+		}
+	}
+
+	ip := net.ParseIP(endpoint.Hostname())
+
+	if ip == nil {
+		return nil, addr, fmt.Errorf("endpoint host %s is not an IP address", endpoint.Hostname())
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	addr = tcpip.FullAddress{Addr: tcpip.Address(ip), Port: uint16(port)}
+
+	return
+}
+
+// verifyPin returns a certificate verification function matching the leaf
+// certificate SHA-256 fingerprint against the argument one.
+func verifyPin(pin string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, errors.New("invalid upload_pin")
+	}
+
+	return func(certs [][]byte, _ [][]*x509.Certificate) error {
+		if len(certs) == 0 {
+			return errors.New("missing certificate")
+		}
+
+		if sum := sha256.Sum256(certs[0]); !bytes.Equal(sum[:], fingerprint) {
+			return fmt.Errorf("certificate fingerprint mismatch (%x)", sum)
+		}
+
+		return nil
+	}, nil
+}
+
+// uploadArchive returns the results archive.
+func uploadArchive() (buf *bytes.Buffer, err error) {
+	files, err := resultFiles()
+
+	if err != nil {
+		return
+	}
+
+	history := logHistory.Bytes()
+	files = append(files, archiveFile{name: "log.txt", size: int64(len(history)), data: bytes.NewReader(history)})
+
+	if conf.Bool("upload_profiles", false) {
+		heap, err := heapFiles(takeHeapSnapshot())
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, heap...)
+	}
+
+	buf = new(bytes.Buffer)
+	name := fmt.Sprintf("%x-%s", target.UniqueID(), archiveName(Now()))
+
+	err = writeArchive(buf, name, files)
+
+	return
+}
+
+// upload sends the results archive through the first network stack with a
+// route to the endpoint, returning the archive size.
+func upload(stacks []*stack.Stack) (size int, err error) {
+	endpoint, addr, err := uploadEndpoint()
+
+	if err != nil {
+		return
+	}
+
+	var s *stack.Stack
+
+	for _, candidate := range stacks {
+		if r, e := candidate.FindRoute(0, "", addr.Addr, networkProtocol(addr.Addr), false); e == nil {
+			r.Release()
+			s = candidate
+			break
+		}
+	}
+
+	if s == nil {
+		return 0, fmt.Errorf("no route to %s", addr.Addr)
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return gonet.DialContextTCP(ctx, s, addr, networkProtocol(addr.Addr))
+		},
+	}
+
+	if endpoint.Scheme == "https" {
+		verify, err := verifyPin(conf.String("upload_pin", ""))
+
+		if err != nil {
+			return 0, err
+		}
+
+		// the certificate is verified against the pinned fingerprint
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verify,
+			MinVersion:            tls.VersionTLS12,
+		}
+	}
+
+	buf, err := uploadArchive()
+
+	if err != nil {
+		return
+	}
+
+	size = buf.Len()
+
+	req, err := http.NewRequest(conf.String("upload_method", http.MethodPost), endpoint.String(), buf)
+
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Device-ID", hex.EncodeToString(target.UniqueID()))
+
+	if token := conf.String("upload_token", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   UPLOAD_TIMEOUT,
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return 0, fmt.Errorf("endpoint returned %s", res.Status)
+	}
+
+	return
+}
+
+func uploadCommand(op string) string {
+	if conf.String("upload_url", "") == "" {
+		return "uploads not enabled"
+	}
+
+	if op == "now" {
+		if lastReport == nil {
+			return "no test results available"
+		}
+
+		Uploader.queue()
+
+		return "upload queued"
+	}
+
+	return Uploader.String()
+}
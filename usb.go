@@ -9,9 +9,11 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"net"
+	"time"
 
+	"github.com/f-secure-foundry/tamago/soc/imx6"
 	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
 	"github.com/f-secure-foundry/tamago/soc/imx6/usb/ethernet"
 )
@@ -47,6 +49,7 @@ func configureDevice(device *usb.Device) {
 
 	conf := &usb.ConfigurationDescriptor{}
 	conf.SetDefaults()
+	conf.Attributes |= CONFIGURATION_REMOTE_WAKEUP
 
 	device.AddConfiguration(conf)
 
@@ -56,43 +59,135 @@ func configureDevice(device *usb.Device) {
 	device.Qualifier.NumConfigurations = uint8(len(device.Configurations))
 }
 
+var usbLog = newLogger("usb")
+
+// interfaceSetup holds class-specific setup request handlers, by interface
+// number, for functions added next to Ethernet over USB.
+var interfaceSetup = make(map[uint8]usb.SetupFunction)
+
+func classSetup(setup *usb.SetupData) (in []byte, err error) {
+	if usbPowerSetup(setup) {
+		return
+	}
+
+	if fn, ok := interfaceSetup[uint8(setup.Index)]; ok {
+		return fn(setup)
+	}
+
+	return nil, fmt.Errorf("unsupported request code: %#x", setup.Request)
+}
+
+// addInterfaceSetup registers the class-specific setup request handler of an
+// interface.
+func addInterfaceSetup(device *usb.Device, iface *usb.InterfaceDescriptor, fn usb.SetupFunction) {
+	interfaceSetup[iface.InterfaceNumber] = fn
+	device.Setup = classSetup
+}
+
 func StartUSB() {
+	ncm := conf.String("usb_ethernet", "ecm") == "ncm"
+
+	// Start basic networking and SSH HTTP services.
+	link := StartNetworking(usbMTU(ncm))
+
+	startUSBEthernet(&ethernet.NIC{Link: link}, ncm)
+}
+
+// startUSBEthernet configures Ethernet over USB endpoints (ECM or NCM
+// protocol, only supported on Linux hosts) and starts the USB device.
+//
+// RNDIS, required for driverless Windows support, cannot be offered as its
+// SEND_ENCAPSULATED_COMMAND and GET_ENCAPSULATED_RESPONSE class requests share
+// request codes with standard GET_STATUS and CLEAR_FEATURE ones, which the USB
+// driver handles without checking the request type, and the driver does not
+// pass control OUT data stages to class handlers.
+func startUSBEthernet(eth *ethernet.NIC, ncm bool) {
 	device := &usb.Device{}
 	configureDevice(device)
 
 	hostAddress, err := net.ParseMAC(hostMAC)
 
 	if err != nil {
-		log.Fatal(err)
+		usbLog.Fatalf("%v", err)
 	}
 
 	deviceAddress, err := net.ParseMAC(deviceMAC)
 
 	if err != nil {
-		log.Fatal(err)
+		usbLog.Fatalf("%v", err)
 	}
 
-	// Start basic networking and SSH HTTP services.
-	link := StartNetworking()
-
-	// Configure Ethernet over USB endpoints
-	// (ECM protocol, only supported on Linux hosts).
-	eth := ethernet.NIC{
-		Host:   hostAddress,
-		Device: deviceAddress,
-		Link:   link,
+	eth.Host = hostAddress
+	eth.Device = deviceAddress
+
+	if ncm {
+		// CDC-NCM (see ncm.go)
+		addNCMInterfaces(device, 0, eth)
+	} else {
+		addECMInterfaces(device, 0, eth)
 	}
 
-	err = eth.Init(device, 0)
+	// FIDO2 authenticator (see fido.go), requires the DCP for credential
+	// sealing
+	if conf.Bool("fido", false) && imx6.Family == imx6.IMX6ULL {
+		addFIDOInterface(device, 0)
+	}
 
-	if err != nil {
-		log.Fatal(err)
+	// OpenPGP smart card (see ccid.go)
+	if conf.Bool("openpgp", false) && imx6.Family == imx6.IMX6ULL {
+		addCCIDInterface(device, 0)
 	}
 
+	// vendor-class RPC interface (see rpc.go)
+	if conf.Bool("usb_rpc", false) {
+		addRPCInterface(device, 0)
+	}
+
+	// interface association descriptors must reference interface
+	// numbers, which differ from the descriptor indices assigned by the
+	// driver once alternate settings are present
+	for _, iface := range device.Configurations[0].Interfaces {
+		if iface.IAD != nil {
+			iface.IAD.FirstInterface = iface.InterfaceNumber
+		}
+	}
+
+	device.Setup = classSetup
+
 	usb.USB1.Init()
 	usb.USB1.DeviceMode()
 	usb.USB1.Reset()
 
+	go monitorUSBPower(eth, conf.Bool("usb_wakeup", false))
+
+	// link counters (see usbstats.go)
+	if interval := conf.Int("usb_stats_interval", 0); interval > 0 {
+		go logUSBStats(time.Duration(interval) * time.Second)
+	}
+
+	bootMark("usb start")
+
 	// never returns
 	usb.USB1.Start(device)
 }
+
+// addECMInterfaces adds the Ethernet over USB interfaces (ECM protocol) to
+// the USB device.
+func addECMInterfaces(device *usb.Device, configurationIndex int, eth *ethernet.NIC) {
+	ECM = &ecmNIC{
+		eth:  eth,
+		pool: newDMAPool(ECM_BUFFERS, ecmBufferSize(eth.Link.MTU())),
+	}
+
+	// hold transmission on bus suspend (see usbpm.go)
+	eth.Tx = usbPowerTx(ECM.Tx)
+	eth.Rx = ECM.Rx
+
+	if err := eth.Init(device, configurationIndex); err != nil {
+		usbLog.Fatalf("%v", err)
+	}
+
+	// the communication interface precedes the data one (see mtu.go)
+	conf := device.Configurations[configurationIndex]
+	setMaxSegmentSize(conf.Interfaces[len(conf.Interfaces)-2], eth.Link.MTU())
+}
@@ -13,7 +13,6 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
 	"runtime"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -25,28 +24,39 @@ import (
 const CR = 0x0d
 
 func init() {
-	LED = usbarmory.LED
+	target = &imx6Board{
+		name: "USB armory Mk II",
+		led:  usbarmory.LED,
+	}
+
+	// LED pads have no PWM function, the output is mirrored on the white
+	// LED GPIO
+	pwmOutput.port = 1
+	pwmOutput.led = "white"
+
+	consoleUART = imx6.UART2
 
 	cards = append(cards, usbarmory.SD)
 	cards = append(cards, usbarmory.MMC)
+	cardWidths = append(cardWidths, usbarmory.SD_BUS_WIDTH, usbarmory.MMC_BUS_WIDTH)
 
 	if imx6.Native && (imx6.Family == imx6.IMX6UL || imx6.Family == imx6.IMX6ULL) {
-		log.Println("-- i.mx6 ble ---------------------------------------------------------")
+		bleLog.Infof("-- i.mx6 ble ---------------------------------------------------------")
 		usbarmory.BLE.Init()
-		log.Println("ANNA-B112 BLE module initialized")
+		bleLog.Infof("ANNA-B112 module initialized")
 	}
 }
 
 func bleConsole(term *terminal.Terminal) (err error) {
-	log.Printf("switching to BLE console, type `quit` to exit")
+	bleLog.Infof("switching to BLE console, type `quit` to exit")
 
 	if usbarmory.BLE.UART == nil {
-		log.Printf("BLE module is not initialized")
+		bleLog.Warnf("BLE module is not initialized")
 		return io.EOF
 	}
 
 	defer func() {
-		log.Printf("resetting BLE module")
+		bleLog.Infof("resetting BLE module")
 		usbarmory.BLE.Reset()
 	}()
 
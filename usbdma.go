@@ -0,0 +1,349 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/dma"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb/ethernet"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+// The USB driver performs transfers on DMA buffers allocated, and copied to
+// and from, for each transfer unless endpoint functions pass buffers reserved
+// in the DMA region (see dma.Reserve), which are used in place.
+//
+// Ethernet over USB endpoints therefore receive into, and encode outbound
+// packets directly in, reserved buffers taken from a pool, leaving a single
+// copy per frame: inbound frames are copied into the network stack, which
+// retains them beyond transfer completion, outbound packets are gathered from
+// the network stack views.
+const (
+	// DMA region (iRAM) page alignment, as required by transfer descriptors
+	USB_DMA_ALIGN = 4096
+
+	// high speed bulk endpoint maximum packet size
+	USB_PACKET_SIZE = 512
+	// ECM reserved buffers (one per data endpoint)
+	ECM_BUFFERS = 2
+
+	// NCM reserved buffers (one per data endpoint)
+	NCM_BUFFERS = 2
+
+	// USB driver default OUT transfer buffer size, emulated by TestDMAPath
+	USB_DRIVER_BUFFER = 20 * 1024
+)
+
+var dmapathLog = newLogger("dmapath")
+
+// dmaPool is a pool of equally sized buffers reserved in the DMA region.
+type dmaPool struct {
+	sync.Mutex
+
+	addr uint32
+	size int
+	free [][]byte
+
+	gets   uint64
+	misses uint64
+}
+
+// newDMAPool reserves a single DMA region split in count buffers.
+func newDMAPool(count int, size int) (p *dmaPool) {
+	p = &dmaPool{size: size}
+
+	addr, buf := dma.Reserve(count*size, USB_DMA_ALIGN)
+	p.addr = addr
+
+	for i := 0; i < count; i++ {
+		p.free = append(p.free, buf[i*size:(i+1)*size:(i+1)*size])
+	}
+
+	return
+}
+
+// Get returns a reserved buffer, when all of them are in use a buffer is
+// allocated on the heap and the driver falls back to copying.
+func (p *dmaPool) Get() (buf []byte) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.gets += 1
+
+	if n := len(p.free); n > 0 {
+		buf = p.free[n-1]
+		p.free = p.free[:n-1]
+		return
+	}
+
+	p.misses += 1
+
+	return make([]byte, p.size)
+}
+
+// Put returns a buffer to the pool, heap allocated ones are discarded.
+func (p *dmaPool) Put(buf []byte) {
+	buf = buf[:cap(buf)]
+
+	if len(buf) != p.size {
+		return
+	}
+
+	if res, _ := dma.Reserved(buf); !res {
+		return
+	}
+
+	p.Lock()
+	p.free = append(p.free, buf)
+	p.Unlock()
+}
+
+// Release frees the pool DMA region, its buffers must no longer be in use.
+func (p *dmaPool) Release() {
+	p.Lock()
+	defer p.Unlock()
+
+	dma.Release(p.addr)
+	p.free = nil
+}
+
+func (p *dmaPool) String() string {
+	p.Lock()
+	defer p.Unlock()
+
+	return fmt.Sprintf("%d bytes buffers, gets: %d misses: %d free: %d", p.size, p.gets, p.misses, len(p.free))
+}
+
+// ecmBufferSize returns the ECM transfer buffer size for a given MTU, the
+// first multiple of the bulk packet size larger than the maximum frame so that
+// each OUT transfer completes on the short packet terminating the frame.
+func ecmBufferSize(mtu uint32) int {
+	return (int(mtu)+header.EthernetMinimumSize)/USB_PACKET_SIZE*USB_PACKET_SIZE + USB_PACKET_SIZE
+}
+
+// ecmNIC implements the ECM data endpoints on reserved DMA buffers, replacing
+// the ethernet.NIC ones which copy each frame in multiple heap buffers.
+type ecmNIC struct {
+	eth  *ethernet.NIC
+	pool *dmaPool
+
+	rx []byte
+	tx []byte
+
+	// oversized frame being discarded
+	discard bool
+}
+
+// ECM is the CDC-ECM function instance, when enabled.
+var ECM *ecmNIC
+
+// Rx implements the ECM bulk OUT endpoint function, each transfer holds a
+// frame which is passed to the network stack before the buffer is reused for
+// the next one.
+func (ecm *ecmNIC) Rx(out []byte, lastErr error) (_ []byte, err error) {
+	if ecm.rx == nil {
+		ecm.rx = ecm.pool.Get()
+	}
+
+	switch {
+	case len(out) == len(ecm.rx):
+		// frames never fill the buffer, the remainder follows
+		if !ecm.discard {
+			USBStats.rxDrop()
+		}
+
+		ecm.discard = true
+	case ecm.discard:
+		ecm.discard = false
+	case len(out) < header.EthernetMinimumSize:
+		USBStats.rxError()
+	default:
+		bootPacket()
+		Capture.Frame(out)
+		ethernetRx(ecm.eth.Link, out)
+		USBStats.rx(len(out))
+	}
+
+	return ecm.rx, nil
+}
+
+// Tx implements the ECM bulk IN endpoint function, encoding the next queued
+// packet in the transfer buffer which is reused once the transfer completes.
+func (ecm *ecmNIC) Tx(_ []byte, lastErr error) (in []byte, err error) {
+	if ecm.tx == nil {
+		ecm.tx = ecm.pool.Get()
+	}
+
+	USBStats.txError(lastErr)
+
+	info, valid := ecm.eth.Link.Read()
+
+	if !valid {
+		return
+	}
+
+	if ethernetFrameSize(info) > len(ecm.tx) {
+		USBStats.txDrop()
+		return
+	}
+
+	n := ethernetEncode(ecm.tx, info, tcpip.LinkAddress(ecm.eth.Device), tcpip.LinkAddress(ecm.eth.Host))
+
+	bootEnumerated()
+	Capture.Frame(ecm.tx[:n])
+	USBStats.tx(n)
+
+	return ecm.tx[:n], nil
+}
+
+// forwardStats holds TestDMAPath frame forwarding counters.
+type forwardStats struct {
+	sync.Mutex
+
+	frames uint64
+	total  time.Duration
+	max    time.Duration
+}
+
+func (s *forwardStats) add(d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.frames += 1
+	s.total += d
+
+	if d > s.max {
+		s.max = d
+	}
+}
+
+// forwardHeap moves Ethernet frames from a link endpoint to another
+// emulating the USB driver handling of heap buffers: each frame is allocated,
+// copied to and from a DMA allocation and received in a default size buffer.
+func forwardHeap(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint, stats *forwardStats) {
+	addr := src.LinkAddress()
+
+	for {
+		info, valid := src.ReadContext(ctx)
+
+		if !valid {
+			return
+		}
+
+		start := time.Now()
+
+		frame := ethernetFrame(info, addr)
+		buf := make([]byte, USB_DRIVER_BUFFER)
+
+		pages := dma.Alloc(frame, USB_DMA_ALIGN)
+		dma.Read(pages, 0, buf[:len(frame)])
+		dma.Free(pages)
+
+		ethernetRx(dst, buf[:len(frame)])
+		stats.add(time.Since(start))
+	}
+}
+
+// forwardDMA moves Ethernet frames from a link endpoint to another encoding
+// them in place in a reserved DMA buffer, as the ECM endpoint functions do.
+func forwardDMA(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint, pool *dmaPool, stats *forwardStats) {
+	addr := src.LinkAddress()
+
+	for {
+		info, valid := src.ReadContext(ctx)
+
+		if !valid {
+			return
+		}
+
+		start := time.Now()
+
+		buf := pool.Get()
+		n := ethernetEncode(buf, info, addr, info.Route.RemoteLinkAddress)
+		ethernetRx(dst, buf[:n])
+		pool.Put(buf)
+
+		stats.add(time.Since(start))
+	}
+}
+
+// TestDMAPath compares, over the loopback test stacks, the TCP throughput,
+// heap allocations, garbage collection and frame forwarding latency of the
+// previous heap buffers data path against the reserved DMA buffers one.
+func TestDMAPath() (err error) {
+	var m runtime.MemStats
+
+	pool := newDMAPool(ECM_BUFFERS, ecmBufferSize(MTU))
+	defer pool.Release()
+
+	paths := []struct {
+		name    string
+		forward func(context.Context, *channel.Endpoint, *channel.Endpoint, *forwardStats)
+	}{
+		{"heap buffers", forwardHeap},
+		{"reserved DMA buffers", func(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint, stats *forwardStats) {
+			forwardDMA(ctx, src, dst, pool, stats)
+		}},
+	}
+
+	for _, p := range paths {
+		stats := &forwardStats{}
+
+		forward := func(ctx context.Context, src *channel.Endpoint, dst *channel.Endpoint) {
+			p.forward(ctx, src, dst, stats)
+		}
+
+		// start from a collected heap to measure only this run
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+
+		mallocs := m.Mallocs
+		bytes := m.TotalAlloc
+		gc := m.NumGC
+		pause := m.PauseTotalNs
+
+		rate, err := tcpLoopback(tcpTuningConfig(), forward)
+
+		if err != nil {
+			return fmt.Errorf("%s, %v", p.name, err)
+		}
+
+		runtime.ReadMemStats(&m)
+
+		stats.Lock()
+		frames := stats.frames
+		total := stats.total
+		max := stats.max
+		stats.Unlock()
+
+		if frames == 0 {
+			return fmt.Errorf("%s, no frames forwarded", p.name)
+		}
+
+		avg := total / time.Duration(frames)
+
+		dmapathLog.Infof("%-20s %.2f MB/s, %d frames, %.1f allocs (%d bytes)/frame, GC: %d cycles %v pause, latency: avg %v max %v",
+			p.name, rate/(1000*1000), frames,
+			float64(m.Mallocs-mallocs)/float64(frames), (m.TotalAlloc-bytes)/frames,
+			m.NumGC-gc, time.Duration(m.PauseTotalNs-pause).Round(time.Microsecond),
+			avg, max.Round(time.Microsecond))
+	}
+
+	dmapathLog.Infof("pool %s", pool)
+
+	return
+}
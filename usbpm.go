@@ -0,0 +1,161 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb"
+	"github.com/f-secure-foundry/tamago/soc/imx6/usb/ethernet"
+
+	"github.com/f-secure-foundry/tamago-example/internal/reg"
+)
+
+// The tamago USB driver does not handle bus suspend and resume, the port
+// state is therefore polled to pause Ethernet over USB transmission while the
+// host sleeps and, when allowed by the host, signal remote wakeup on pending
+// traffic (p3814, 56.6.31 Port Status & Control (USB_nPORTSC1), IMX6ULLRM).
+const (
+	PORTSC_SUSP = 7
+	PORTSC_FPR  = 6
+
+	// bmAttributes remote wakeup support
+	CONFIGURATION_REMOTE_WAKEUP = 0x20
+
+	USB_PM_POLL = 10 * time.Millisecond
+)
+
+// usbPower tracks the USB device power state.
+var usbPower struct {
+	sync.Mutex
+
+	suspended bool
+	// remote wakeup enabled by the host
+	remoteWakeup bool
+
+	suspends int
+	resumes  int
+	wakeups  int
+}
+
+func usbSuspended() bool {
+	usbPower.Lock()
+	defer usbPower.Unlock()
+
+	return usbPower.suspended
+}
+
+// usbPowerSetup handles the standard SET_FEATURE request for remote wakeup,
+// which is not handled by the tamago driver.
+func usbPowerSetup(setup *usb.SetupData) bool {
+	if setup.RequestType != 0 || setup.Request != usb.SET_FEATURE || setup.Value>>8 != usb.DEVICE_REMOTE_WAKEUP {
+		return false
+	}
+
+	usbPower.Lock()
+	usbPower.remoteWakeup = true
+	usbPower.Unlock()
+
+	usbLog.Infof("remote wakeup enabled by host")
+
+	return true
+}
+
+// usbWakeup signals resume to a suspended host.
+func usbWakeup() (err error) {
+	usbPower.Lock()
+	defer usbPower.Unlock()
+
+	if !usbPower.suspended {
+		return fmt.Errorf("bus not suspended")
+	}
+
+	if !usbPower.remoteWakeup {
+		return fmt.Errorf("remote wakeup not enabled by host")
+	}
+
+	reg.Set(usb.USB_UOG1_PORTSC1, PORTSC_FPR)
+	usbPower.wakeups += 1
+
+	usbLog.Infof("remote wakeup signaled")
+
+	return
+}
+
+// monitorUSBPower tracks bus suspend and resume, when autoWakeup is true
+// remote wakeup is signaled as soon as transmission is pending.
+func monitorUSBPower(eth *ethernet.NIC, autoWakeup bool) {
+	for {
+		time.Sleep(USB_PM_POLL)
+
+		suspended := reg.Get(usb.USB_UOG1_PORTSC1, PORTSC_SUSP, 1) == 1
+
+		usbPower.Lock()
+
+		if suspended != usbPower.suspended {
+			usbPower.suspended = suspended
+
+			if suspended {
+				usbPower.suspends += 1
+				usbLog.Infof("bus suspended, pausing transmission")
+			} else {
+				usbPower.resumes += 1
+				usbLog.Infof("bus resumed (%d frames queued)", eth.Link.NumQueued())
+			}
+		}
+
+		usbPower.Unlock()
+
+		if suspended && autoWakeup && eth.Link.NumQueued() > 0 {
+			usbWakeup()
+		}
+	}
+}
+
+// usbPowerTx wraps the Ethernet over USB transmit function to hold frames
+// while the bus is suspended.
+func usbPowerTx(tx usb.EndpointFunction) usb.EndpointFunction {
+	return func(buf []byte, lastErr error) ([]byte, error) {
+		if usbSuspended() {
+			return nil, nil
+		}
+
+		return tx(buf, lastErr)
+	}
+}
+
+func usbPowerCommand(op string) (res string) {
+	if op == "wakeup" {
+		if err := usbWakeup(); err != nil {
+			return err.Error()
+		}
+
+		return
+	}
+
+	usbPower.Lock()
+	defer usbPower.Unlock()
+
+	state := "active"
+
+	if usbPower.suspended {
+		state = "suspended"
+	}
+
+	res = fmt.Sprintf("state: %s, remote wakeup: %v\nsuspends: %d resumes: %d wakeups: %d\n%s",
+		state, usbPower.remoteWakeup, usbPower.suspends, usbPower.resumes, usbPower.wakeups, USBStats)
+
+	if NCM != nil {
+		res += fmt.Sprintf("\nncm: %s", &NCM.stats)
+	}
+
+	return
+}
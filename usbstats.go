@@ -0,0 +1,158 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Ethernet over USB link counters are updated by the ECM and NCM endpoint
+// functions, OUT transfer errors are not reported to them and only logged by
+// the USB driver.
+//
+// The counters are shown by the console `usb` command, exported on /metrics
+// in Prometheus text format and, when `usb_stats_interval` is set, logged
+// periodically along with the rates since the previous log line.
+
+// usbNetCounters holds Ethernet over USB link counters.
+type usbNetCounters struct {
+	rxPackets uint64
+	rxBytes   uint64
+	// frames discarded as oversized
+	rxDropped uint64
+	// malformed frames or NTBs
+	rxErrors uint64
+
+	txPackets uint64
+	txBytes   uint64
+	// packets discarded as oversized
+	txDropped uint64
+	// IN transfer errors
+	txErrors uint64
+}
+
+// usbNetStats holds Ethernet over USB link counters updated concurrently.
+type usbNetStats struct {
+	sync.Mutex
+	usbNetCounters
+}
+
+// USBStats holds the Ethernet over USB link counters.
+var USBStats = &usbNetStats{}
+
+func (s *usbNetStats) rx(n int) {
+	s.Lock()
+	s.rxPackets += 1
+	s.rxBytes += uint64(n)
+	s.Unlock()
+}
+
+func (s *usbNetStats) tx(n int) {
+	s.Lock()
+	s.txPackets += 1
+	s.txBytes += uint64(n)
+	s.Unlock()
+}
+
+func (s *usbNetStats) rxDrop() {
+	s.Lock()
+	s.rxDropped += 1
+	s.Unlock()
+}
+
+func (s *usbNetStats) txDrop() {
+	s.Lock()
+	s.txDropped += 1
+	s.Unlock()
+}
+
+func (s *usbNetStats) rxError() {
+	s.Lock()
+	s.rxErrors += 1
+	s.Unlock()
+}
+
+// txError records the error, if any, of the previous IN transfer.
+func (s *usbNetStats) txError(lastErr error) {
+	if lastErr == nil {
+		return
+	}
+
+	s.Lock()
+	s.txErrors += 1
+	s.Unlock()
+}
+
+// snapshot returns a copy of the counters.
+func (s *usbNetStats) snapshot() usbNetCounters {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.usbNetCounters
+}
+
+func (s *usbNetStats) String() string {
+	c := s.snapshot()
+
+	return fmt.Sprintf("rx: %d packets %d bytes dropped: %d errors: %d\ntx: %d packets %d bytes dropped: %d errors: %d",
+		c.rxPackets, c.rxBytes, c.rxDropped, c.rxErrors,
+		c.txPackets, c.txBytes, c.txDropped, c.txErrors)
+}
+
+// logUSBStats periodically logs the link counters and rates.
+func logUSBStats(interval time.Duration) {
+	prev := USBStats.snapshot()
+	last := time.Now()
+
+	for range time.NewTicker(interval).C {
+		c := USBStats.snapshot()
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+
+		usbLog.Infof("rx %d pkts (%.1f pkt/s, %.1f KB/s) drop %d err %d, tx %d pkts (%.1f pkt/s, %.1f KB/s) drop %d err %d",
+			c.rxPackets, float64(c.rxPackets-prev.rxPackets)/elapsed, float64(c.rxBytes-prev.rxBytes)/elapsed/1000, c.rxDropped, c.rxErrors,
+			c.txPackets, float64(c.txPackets-prev.txPackets)/elapsed, float64(c.txBytes-prev.txBytes)/elapsed/1000, c.txDropped, c.txErrors)
+
+		prev = c
+		last = now
+	}
+}
+
+// metricsHandler exports the link counters in Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	c := USBStats.snapshot()
+
+	metrics := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"usb_rx_packets_total", "Ethernet over USB received frames.", c.rxPackets},
+		{"usb_rx_bytes_total", "Ethernet over USB received bytes.", c.rxBytes},
+		{"usb_rx_dropped_total", "Ethernet over USB received frames dropped as oversized.", c.rxDropped},
+		{"usb_rx_errors_total", "Ethernet over USB malformed received frames or NTBs.", c.rxErrors},
+		{"usb_tx_packets_total", "Ethernet over USB transmitted frames.", c.txPackets},
+		{"usb_tx_bytes_total", "Ethernet over USB transmitted bytes.", c.txBytes},
+		{"usb_tx_dropped_total", "Ethernet over USB transmit frames dropped as oversized.", c.txDropped},
+		{"usb_tx_errors_total", "Ethernet over USB IN transfer errors.", c.txErrors},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,590 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/hdkeychain"
+
+	"github.com/f-secure-foundry/tamago/soc/imx6"
+)
+
+// Partially Signed Bitcoin Transaction (BIP174) key types
+const (
+	PSBT_MAGIC = "psbt\xff"
+
+	PSBT_GLOBAL_UNSIGNED_TX = 0x00
+
+	PSBT_IN_NON_WITNESS_UTXO = 0x00
+	PSBT_IN_WITNESS_UTXO     = 0x01
+	PSBT_IN_SIGHASH_TYPE     = 0x03
+	PSBT_IN_BIP32_DERIVATION = 0x06
+
+	PSBT_MAX_SIZE = 64 * 1024
+)
+
+// hdWallet represents a BIP32 hierarchical deterministic wallet, only
+// single key native SegWit (BIP84) and legacy P2PKH inputs are supported.
+type hdWallet struct {
+	master      *hdkeychain.ExtendedKey
+	fingerprint []byte
+	params      *chaincfg.Params
+}
+
+// psbtInput represents the PSBT input fields relevant for signing.
+type psbtInput struct {
+	nonWitnessUtxo *wire.MsgTx
+	witnessUtxo    *wire.TxOut
+	sigHashType    txscript.SigHashType
+	// BIP32 derivation paths by compressed public key
+	derivations map[string][]uint32
+}
+
+var btcLog = newLogger("btc")
+
+var wallet struct {
+	sync.Once
+
+	w   *hdWallet
+	err error
+}
+
+func btcParams() (*chaincfg.Params, error) {
+	switch network := conf.String("btc_network", "testnet3"); network {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	default:
+		return nil, fmt.Errorf("invalid network %s", network)
+	}
+}
+
+func newHDWallet(seed []byte, params *chaincfg.Params) (w *hdWallet, err error) {
+	master, err := hdkeychain.NewMaster(seed, params)
+
+	if err != nil {
+		return
+	}
+
+	pub, err := master.ECPubKey()
+
+	if err != nil {
+		return
+	}
+
+	w = &hdWallet{
+		master:      master,
+		fingerprint: btcutil.Hash160(pub.SerializeCompressed())[0:4],
+		params:      params,
+	}
+
+	return
+}
+
+// btcWallet returns the device wallet, its seed is kept on the memory card
+// as a DCP sealed blob (see secrets.go) and generated on first use.
+func btcWallet() (*hdWallet, error) {
+	wallet.Do(func() {
+		params, err := btcParams()
+
+		if err != nil {
+			wallet.err = err
+			return
+		}
+
+		imx6.DCP.Init()
+
+		seed, err := loadSealed("btc", func() ([]byte, error) {
+			btcLog.Infof("generating wallet seed")
+			return hdkeychain.GenerateSeed(hdkeychain.RecommendedSeedLen)
+		})
+
+		if err != nil {
+			wallet.err = err
+			return
+		}
+
+		wallet.w, wallet.err = newHDWallet(seed, params)
+
+		for i := range seed {
+			seed[i] = 0
+		}
+	})
+
+	return wallet.w, wallet.err
+}
+
+// accountPath returns the BIP84 first account derivation path.
+func (w *hdWallet) accountPath() []uint32 {
+	return []uint32{
+		hdkeychain.HardenedKeyStart + 84,
+		hdkeychain.HardenedKeyStart + w.params.HDCoinType,
+		hdkeychain.HardenedKeyStart + 0,
+	}
+}
+
+func (w *hdWallet) derive(path []uint32) (k *hdkeychain.ExtendedKey, err error) {
+	k = w.master
+
+	for _, i := range path {
+		if k, err = k.Child(i); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Address returns the native SegWit receive address with the argument index.
+func (w *hdWallet) Address(n uint32) (addr btcutil.Address, err error) {
+	k, err := w.derive(append(w.accountPath(), 0, n))
+
+	if err != nil {
+		return
+	}
+
+	pub, err := k.ECPubKey()
+
+	if err != nil {
+		return
+	}
+
+	return btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub.SerializeCompressed()), w.params)
+}
+
+// AccountKey returns the BIP84 first account extended public key.
+func (w *hdWallet) AccountKey() (string, error) {
+	k, err := w.derive(w.accountPath())
+
+	if err != nil {
+		return "", err
+	}
+
+	if k, err = k.Neuter(); err != nil {
+		return "", err
+	}
+
+	return k.String(), nil
+}
+
+func readCompactSize(r io.Reader) (uint64, error) {
+	return wire.ReadVarInt(r, 0)
+}
+
+func readPSBTPair(r *bytes.Reader) (key []byte, val []byte, err error) {
+	n, err := readCompactSize(r)
+
+	if err != nil || n == 0 {
+		return
+	}
+
+	if n > uint64(r.Len()) {
+		return nil, nil, errors.New("invalid key length")
+	}
+
+	key = make([]byte, n)
+	r.Read(key)
+
+	if n, err = readCompactSize(r); err != nil {
+		return
+	}
+
+	if n > uint64(r.Len()) {
+		return nil, nil, errors.New("invalid value length")
+	}
+
+	val = make([]byte, n)
+	r.Read(val)
+
+	return
+}
+
+// parsePSBT parses the unsigned transaction and input fields of a PSBT.
+func parsePSBT(buf []byte) (tx *wire.MsgTx, inputs []*psbtInput, err error) {
+	if !bytes.HasPrefix(buf, []byte(PSBT_MAGIC)) {
+		return nil, nil, errors.New("invalid PSBT magic")
+	}
+
+	r := bytes.NewReader(buf[len(PSBT_MAGIC):])
+
+	for {
+		key, val, err := readPSBTPair(r)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key == nil {
+			break
+		}
+
+		if len(key) == 1 && key[0] == PSBT_GLOBAL_UNSIGNED_TX {
+			tx = &wire.MsgTx{}
+
+			if err = tx.DeserializeNoWitness(bytes.NewReader(val)); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if tx == nil {
+		return nil, nil, errors.New("missing unsigned transaction")
+	}
+
+	for range tx.TxIn {
+		in := &psbtInput{
+			sigHashType: txscript.SigHashAll,
+			derivations: make(map[string][]uint32),
+		}
+
+		for {
+			key, val, err := readPSBTPair(r)
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if key == nil {
+				break
+			}
+
+			switch key[0] {
+			case PSBT_IN_NON_WITNESS_UTXO:
+				in.nonWitnessUtxo = &wire.MsgTx{}
+
+				if err = in.nonWitnessUtxo.Deserialize(bytes.NewReader(val)); err != nil {
+					return nil, nil, err
+				}
+			case PSBT_IN_WITNESS_UTXO:
+				if len(val) < 9 {
+					return nil, nil, errors.New("invalid witness UTXO")
+				}
+
+				vr := bytes.NewReader(val[8:])
+				script, err := wire.ReadVarBytes(vr, 0, uint32(len(val)), "pkScript")
+
+				if err != nil {
+					return nil, nil, err
+				}
+
+				in.witnessUtxo = wire.NewTxOut(int64(binary.LittleEndian.Uint64(val[0:8])), script)
+			case PSBT_IN_SIGHASH_TYPE:
+				if len(val) != 4 {
+					return nil, nil, errors.New("invalid sighash type")
+				}
+
+				in.sigHashType = txscript.SigHashType(binary.LittleEndian.Uint32(val))
+			case PSBT_IN_BIP32_DERIVATION:
+				if len(key) != 1+33 || len(val) < 4 || len(val)%4 != 0 {
+					return nil, nil, errors.New("invalid BIP32 derivation")
+				}
+
+				// master key fingerprint followed by the path
+				var path []uint32
+
+				for i := 4; i < len(val); i += 4 {
+					path = append(path, binary.LittleEndian.Uint32(val[i:]))
+				}
+
+				in.derivations[string(val[0:4])+string(key[1:])] = path
+			}
+		}
+
+		inputs = append(inputs, in)
+	}
+
+	// output fields are not needed for signing
+
+	return
+}
+
+// key returns the private key of a PSBT input, when derived from the wallet
+// master key.
+func (w *hdWallet) key(in *psbtInput) (*btcec.PrivateKey, error) {
+	for id, path := range in.derivations {
+		if id[0:4] != string(w.fingerprint) {
+			continue
+		}
+
+		k, err := w.derive(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		priv, err := k.ECPrivKey()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(priv.PubKey().SerializeCompressed(), []byte(id[4:])) {
+			return nil, errors.New("derived key mismatch")
+		}
+
+		return priv, nil
+	}
+
+	return nil, errors.New("no key derivation for this wallet")
+}
+
+// SignPSBT signs and finalizes all inputs of a PSBT, returning the signed
+// transaction.
+func (w *hdWallet) SignPSBT(buf []byte) (tx *wire.MsgTx, err error) {
+	if len(buf) > PSBT_MAX_SIZE {
+		return nil, errors.New("PSBT too large")
+	}
+
+	tx, inputs, err := parsePSBT(buf)
+
+	if err != nil {
+		return
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx)
+
+	var total int64
+
+	for i, in := range inputs {
+		var prevOut *wire.TxOut
+
+		if in.sigHashType != txscript.SigHashAll {
+			return nil, fmt.Errorf("input %d: unsupported sighash type %#x", i, in.sigHashType)
+		}
+
+		priv, err := w.key(in)
+
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %v", i, err)
+		}
+
+		outpoint := tx.TxIn[i].PreviousOutPoint
+
+		switch {
+		case in.witnessUtxo != nil:
+			prevOut = in.witnessUtxo
+		case in.nonWitnessUtxo != nil:
+			if in.nonWitnessUtxo.TxHash() != outpoint.Hash || int(outpoint.Index) >= len(in.nonWitnessUtxo.TxOut) {
+				return nil, fmt.Errorf("input %d: UTXO mismatch", i)
+			}
+
+			prevOut = in.nonWitnessUtxo.TxOut[outpoint.Index]
+		default:
+			return nil, fmt.Errorf("input %d: missing UTXO", i)
+		}
+
+		switch {
+		case txscript.IsPayToWitnessPubKeyHash(prevOut.PkScript):
+			tx.TxIn[i].Witness, err = txscript.WitnessSignature(tx, sigHashes, i, prevOut.Value, prevOut.PkScript, in.sigHashType, priv, true)
+		case txscript.GetScriptClass(prevOut.PkScript) == txscript.PubKeyHashTy:
+			tx.TxIn[i].SignatureScript, err = txscript.SignatureScript(tx, i, prevOut.PkScript, in.sigHashType, priv, true)
+		default:
+			err = errors.New("unsupported script type")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %v", i, err)
+		}
+
+		total += prevOut.Value
+	}
+
+	for i, out := range tx.TxOut {
+		_, addrs, _, _ := txscript.ExtractPkScriptAddrs(out.PkScript, w.params)
+		btcLog.Infof("output %d: %s to %v", i, btcutil.Amount(out.Value), addrs)
+		total -= out.Value
+	}
+
+	btcLog.Infof("fee %s", btcutil.Amount(total))
+
+	auditf("key.sign", "btc transaction %s, %d inputs, fee %s", tx.TxHash(), len(tx.TxIn), btcutil.Amount(total))
+
+	return
+}
+
+func walletCommand(op string, arg string) (res string) {
+	w, err := btcWallet()
+
+	if err != nil {
+		return err.Error()
+	}
+
+	switch op {
+	case "xpub":
+		xpub, err := w.AccountKey()
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return fmt.Sprintf("[%x/84'/%d'/0'] %s", w.fingerprint, w.params.HDCoinType, xpub)
+	case "address":
+		n, err := strconv.ParseUint(arg, 10, 31)
+
+		if err != nil {
+			return fmt.Sprintf("invalid index: %v", err)
+		}
+
+		addr, err := w.Address(uint32(n))
+
+		if err != nil {
+			return err.Error()
+		}
+
+		return addr.EncodeAddress()
+	case "psbt":
+		buf, err := base64.StdEncoding.DecodeString(arg)
+
+		if err != nil {
+			return fmt.Sprintf("invalid PSBT encoding: %v", err)
+		}
+
+		tx, err := w.SignPSBT(buf)
+
+		if err != nil {
+			return err.Error()
+		}
+
+		var signed bytes.Buffer
+
+		if err = tx.Serialize(&signed); err != nil {
+			return err.Error()
+		}
+
+		return hex.EncodeToString(signed.Bytes())
+	}
+
+	return
+}
+
+func writePSBTPair(buf *bytes.Buffer, key []byte, val []byte) {
+	wire.WriteVarBytes(buf, 0, key)
+	wire.WriteVarBytes(buf, 0, val)
+}
+
+// This example demonstrates deriving a native SegWit address from a BIP32
+// wallet and signing a PSBT spending from it.
+func ExampleSignPSBT() (err error) {
+	seed, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+	if err != nil {
+		return
+	}
+
+	w, err := newHDWallet(seed, &chaincfg.TestNet3Params)
+
+	if err != nil {
+		return
+	}
+
+	path := append(w.accountPath(), 0, 0)
+	k, err := w.derive(path)
+
+	if err != nil {
+		return
+	}
+
+	pub, err := k.ECPubKey()
+
+	if err != nil {
+		return
+	}
+
+	addr, err := w.Address(0)
+
+	if err != nil {
+		return
+	}
+
+	btcLog.Infof("BIP84 address: %s", addr.EncodeAddress())
+
+	pkScript, err := txscript.PayToAddrScript(addr)
+
+	if err != nil {
+		return
+	}
+
+	// spend a fake 1 BTC output paying to the wallet address
+	prevOut := wire.NewTxOut(100000000, pkScript)
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(99990000, pkScript))
+
+	var unsigned bytes.Buffer
+
+	if err = tx.SerializeNoWitness(&unsigned); err != nil {
+		return
+	}
+
+	var utxo bytes.Buffer
+
+	if err = wire.WriteTxOut(&utxo, 0, 0, prevOut); err != nil {
+		return
+	}
+
+	derivation := append([]byte{}, w.fingerprint...)
+
+	for _, i := range path {
+		derivation = append(derivation, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+	}
+
+	psbt := bytes.NewBufferString(PSBT_MAGIC)
+
+	// global map
+	writePSBTPair(psbt, []byte{PSBT_GLOBAL_UNSIGNED_TX}, unsigned.Bytes())
+	psbt.WriteByte(0)
+
+	// input map
+	writePSBTPair(psbt, []byte{PSBT_IN_WITNESS_UTXO}, utxo.Bytes())
+	writePSBTPair(psbt, append([]byte{PSBT_IN_BIP32_DERIVATION}, pub.SerializeCompressed()...), derivation)
+	psbt.WriteByte(0)
+
+	// output map
+	psbt.WriteByte(0)
+
+	signed, err := w.SignPSBT(psbt.Bytes())
+
+	if err != nil {
+		return
+	}
+
+	flags := txscript.StandardVerifyFlags
+	vm, err := txscript.NewEngine(pkScript, signed, 0, flags, nil, nil, prevOut.Value)
+
+	if err != nil {
+		return
+	}
+
+	if err = vm.Execute(); err != nil {
+		return
+	}
+
+	btcLog.Infof("PSBT signed and verified (txid %s)", signed.TxHash())
+
+	return
+}
@@ -20,7 +20,6 @@ import (
 	"encoding/pem"
 	"fmt"
 	"html"
-	"log"
 	"math/big"
 	"net"
 	"net/http"
@@ -28,18 +27,22 @@ import (
 	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
-	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
 
+// Static web assets are generated in, and only served from, WEB_ROOT rather
+// than the whole in-memory filesystem.
+const WEB_ROOT = "/www"
+
+var webLog = newLogger("web")
+
 func generateTLSCerts(address net.IP) ([]byte, []byte, error) {
 	TLSCert := new(bytes.Buffer)
 	TLSKey := new(bytes.Buffer)
 
 	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<63-1))
 
-	log.Printf("generating TLS keypair IP: %s, Serial: %X", IP, serial)
+	webLog.Infof("generating TLS keypair IP: %s, Serial: %X", IP, serial)
 
 	validFrom, _ := time.Parse(time.RFC3339, "1981-01-07T00:00:00Z")
 	validUntil, _ := time.Parse(time.RFC3339, "2022-01-07T00:00:00Z")
@@ -84,13 +87,26 @@ func generateTLSCerts(address net.IP) ([]byte, []byte, error) {
 	h := sha256.New()
 	h.Write(cert)
 
-	log.Printf("SHA-256 fingerprint: % X", h.Sum(nil))
+	webLog.Infof("SHA-256 fingerprint: % X", h.Sum(nil))
 
 	return TLSCert.Bytes(), TLSKey.Bytes(), nil
 }
 
+// nosniff prevents browsers from interpreting responses as a different
+// content type than the declared one.
+func nosniff(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.ServeHTTP(w, r)
+	})
+}
+
 func setupStaticWebAssets() {
-	file, err := os.OpenFile("/index.html", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err := os.MkdirAll(WEB_ROOT, 0700); err != nil {
+		panic(err)
+	}
+
+	file, err := os.OpenFile(WEB_ROOT+"/index.html", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 
 	if err != nil {
 		panic(err)
@@ -99,43 +115,67 @@ func setupStaticWebAssets() {
 
 	file.WriteString("<html><body>")
 	file.WriteString(fmt.Sprintf("<p>%s</p><ul>", html.EscapeString(banner)))
-	file.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, "/dir", "/dir"))
 	file.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, "/debug/charts", "/debug/charts"))
 	file.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, "/debug/pprof", "/debug/pprof"))
+
+	if authEnabled() {
+		file.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, "/logout", "/logout"))
+	}
+
 	file.WriteString("</ul></body></html>")
 
-	staticHandler := http.FileServer(http.Dir("/"))
-	http.Handle("/", http.StripPrefix("/", staticHandler))
+	http.HandleFunc("/measurements", measurementsHandler)
+	http.HandleFunc("/attest", attestHandler)
+	http.HandleFunc("/trace/", traceHandler)
+	http.HandleFunc("/reboot", rebootHandler)
+	http.HandleFunc("/provision/", provisionHandler)
+	http.HandleFunc("/api/", apiHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+
+	if conf.Bool("totp_http", false) {
+		http.HandleFunc("/totp/", totpHandler)
+	}
+
+	if conf.Bool("files", false) {
+		http.HandleFunc(FILES_PREFIX+"/", filesHandler)
+	}
+
+	staticHandler := http.FileServer(http.Dir(WEB_ROOT))
+	http.Handle("/", nosniff(staticHandler))
 }
 
 func startWebServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.NICID, https bool) {
 	var err error
 
 	fullAddr := tcpip.FullAddress{Addr: addr, Port: port, NIC: nic}
-	listener, err := gonet.ListenTCP(s, fullAddr, ipv4.ProtocolNumber)
+	listener, err := listenTCP(s, fullAddr)
 
 	if err != nil {
-		log.Fatal("listener error: ", err)
+		webLog.Fatalf("listener error, %v", err)
 	}
 
 	srv := &http.Server{
 		Addr: addr.String() + ":" + fmt.Sprintf("%d", port),
 	}
 
+	// authentication (see auth.go)
+	if authEnabled() {
+		srv.Handler = authHandler(http.DefaultServeMux)
+	}
+
 	if https {
 		TLSCert, TLSKey, err := generateTLSCerts(net.ParseIP(addr.String()))
 
 		if err != nil {
-			log.Fatal("TLS cert|key error: ", err)
+			webLog.Fatalf("TLS cert|key error, %v", err)
 		}
 
-		log.Printf("generated TLS certificate:\n%s", TLSCert)
-		log.Printf("generated TLS key:\n%s", TLSKey)
+		webLog.Infof("generated TLS certificate:\n%s", TLSCert)
 
 		certificate, err := tls.X509KeyPair(TLSCert, TLSKey)
 
 		if err != nil {
-			log.Fatal("X509KeyPair error: ", err)
+			webLog.Fatalf("X509KeyPair error, %v", err)
 		}
 
 		srv.TLSConfig = &tls.Config{
@@ -143,7 +183,7 @@ func startWebServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.N
 		}
 	}
 
-	log.Printf("starting web server at %s:%d", addr.String(), port)
+	webLog.Infof("starting web server at %s:%d", addr.String(), port)
 
 	if https {
 		err = srv.ServeTLS(listener, "", "")
@@ -151,5 +191,5 @@ func startWebServer(s *stack.Stack, addr tcpip.Address, port uint16, nic tcpip.N
 		err = srv.Serve(listener)
 	}
 
-	log.Fatal("server returned unexpectedly ", err)
+	webLog.Fatalf("server returned unexpectedly, %v", err)
 }
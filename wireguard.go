@@ -0,0 +1,598 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// WireGuard protocol (https://www.wireguard.com/protocol/), responder side
+// with a single peer.
+//
+// The wireguard-go implementation requires operating system TUN devices and
+// UDP sockets, therefore the protocol is implemented here directly on
+// netstack.
+const (
+	WG_CONSTRUCTION = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	WG_IDENTIFIER   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	WG_LABEL_MAC1   = "mac1----"
+
+	WG_HANDSHAKE_INITIATION = 1
+	WG_HANDSHAKE_RESPONSE   = 2
+	WG_TRANSPORT_DATA       = 4
+
+	WG_INITIATION_SIZE = 148
+	WG_RESPONSE_SIZE   = 92
+	WG_TRANSPORT_SIZE  = 16
+
+	WG_KEY_SIZE = 32
+	WG_TAG_SIZE = 16
+	WG_MTU      = 1420
+
+	WG_REJECT_AFTER_TIME = 180 * time.Second
+	WG_REPLAY_WINDOW     = 64
+)
+
+var wireguardLog = newLogger("wireguard")
+
+// wgConfig represents the tunnel configuration.
+type wgConfig struct {
+	PrivateKey   []byte
+	PublicKey    []byte
+	PeerKey      []byte
+	PresharedKey []byte
+
+	Port       uint16
+	Addr       tcpip.AddressWithPrefix
+	AllowedIPs []*net.IPNet
+}
+
+// wgSession represents the transport keys derived from a handshake.
+type wgSession struct {
+	local  uint32
+	remote uint32
+
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter uint64
+
+	// replay protection
+	last   uint64
+	window uint64
+
+	created time.Time
+}
+
+// wgTunnel represents a WireGuard tunnel endpoint.
+type wgTunnel struct {
+	sync.Mutex
+
+	conf *wgConfig
+	conn *gonet.UDPConn
+	link *channel.Endpoint
+
+	// peer endpoint, as learned from authenticated packets
+	endpoint  *net.UDPAddr
+	session   *wgSession
+	timestamp []byte
+}
+
+func wgHash(data ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+func wgMAC(key []byte, data []byte) []byte {
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+func wgHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+
+	for _, d := range data {
+		mac.Write(d)
+	}
+
+	return mac.Sum(nil)
+}
+
+// wgKDF derives n keys from the chaining key and input.
+func wgKDF(n int, key []byte, input []byte) (out [][]byte) {
+	prk := wgHMAC(key, input)
+	t := []byte{}
+
+	for i := 1; i <= n; i++ {
+		t = wgHMAC(prk, t, []byte{byte(i)})
+		out = append(out, t)
+	}
+
+	return
+}
+
+func wgAEAD(key []byte, counter uint64, src []byte, ad []byte, seal bool) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+
+	if seal {
+		return aead.Seal(nil, nonce, src, ad), nil
+	}
+
+	return aead.Open(nil, nonce, src, ad)
+}
+
+func wgKey(name string, s string) (key []byte, err error) {
+	if key, err = base64.StdEncoding.DecodeString(s); err != nil || len(key) != WG_KEY_SIZE {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+
+	return
+}
+
+func wgConfigure() (c *wgConfig, err error) {
+	c = &wgConfig{
+		Port: uint16(conf.Int("wg_port", 51820)),
+	}
+
+	if c.PrivateKey, err = wgKey("wg_private_key", conf.String("wg_private_key", "")); err != nil {
+		return
+	}
+
+	if c.PublicKey, err = curve25519.X25519(c.PrivateKey, curve25519.Basepoint); err != nil {
+		return
+	}
+
+	if c.PeerKey, err = wgKey("wg_peer", conf.String("wg_peer", "")); err != nil {
+		return
+	}
+
+	c.PresharedKey = make([]byte, WG_KEY_SIZE)
+
+	if psk := conf.String("wg_psk", ""); psk != "" {
+		if c.PresharedKey, err = wgKey("wg_psk", psk); err != nil {
+			return
+		}
+	}
+
+	ip, ipnet, err := net.ParseCIDR(conf.String("wg_ip", "10.0.1.1/24"))
+
+	if err != nil || ip.To4() == nil {
+		return nil, errors.New("invalid wg_ip")
+	}
+
+	ones, _ := ipnet.Mask.Size()
+	c.Addr = tcpip.AddressWithPrefix{Address: tcpip.Address(ip.To4()), PrefixLen: ones}
+
+	for _, s := range conf.List("wg_allowed_ips", []string{ipnet.String()}) {
+		_, allowed, err := net.ParseCIDR(s)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed IP %s", s)
+		}
+
+		c.AllowedIPs = append(c.AllowedIPs, allowed)
+	}
+
+	return
+}
+
+// handshake processes a handshake initiation, returning the response.
+func (t *wgTunnel) handshake(msg []byte) (res []byte, err error) {
+	c := t.conf
+
+	if !hmac.Equal(msg[116:132], wgMAC(wgHash([]byte(WG_LABEL_MAC1), c.PublicKey), msg[0:116])) {
+		return nil, errors.New("invalid mac1")
+	}
+
+	sender := binary.LittleEndian.Uint32(msg[4:8])
+	ephemeral := msg[8:40]
+	encryptedStatic := msg[40:88]
+	encryptedTimestamp := msg[88:116]
+
+	ck := wgHash([]byte(WG_CONSTRUCTION))
+	h := wgHash(ck, []byte(WG_IDENTIFIER))
+	h = wgHash(h, c.PublicKey)
+
+	ck = wgKDF(1, ck, ephemeral)[0]
+	h = wgHash(h, ephemeral)
+
+	dh, err := curve25519.X25519(c.PrivateKey, ephemeral)
+
+	if err != nil {
+		return
+	}
+
+	k := wgKDF(2, ck, dh)
+	ck = k[0]
+
+	static, err := wgAEAD(k[1], 0, encryptedStatic, h, false)
+
+	if err != nil {
+		return nil, errors.New("invalid static key")
+	}
+
+	if subtle.ConstantTimeCompare(static, c.PeerKey) != 1 {
+		return nil, errors.New("unknown peer")
+	}
+
+	h = wgHash(h, encryptedStatic)
+
+	if dh, err = curve25519.X25519(c.PrivateKey, static); err != nil {
+		return
+	}
+
+	k = wgKDF(2, ck, dh)
+	ck = k[0]
+
+	timestamp, err := wgAEAD(k[1], 0, encryptedTimestamp, h, false)
+
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+
+	// TAI64N timestamps must be strictly increasing to prevent replays
+	if t.timestamp != nil && bytes.Compare(timestamp, t.timestamp) <= 0 {
+		return nil, errors.New("replayed initiation")
+	}
+
+	h = wgHash(h, encryptedTimestamp)
+
+	// response
+	priv := make([]byte, WG_KEY_SIZE)
+
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+
+	if err != nil {
+		return
+	}
+
+	ck = wgKDF(1, ck, pub)[0]
+	h = wgHash(h, pub)
+
+	if dh, err = curve25519.X25519(priv, ephemeral); err != nil {
+		return
+	}
+
+	ck = wgKDF(1, ck, dh)[0]
+
+	if dh, err = curve25519.X25519(priv, static); err != nil {
+		return
+	}
+
+	ck = wgKDF(1, ck, dh)[0]
+
+	k = wgKDF(3, ck, c.PresharedKey)
+	ck = k[0]
+	h = wgHash(h, k[1])
+
+	empty, err := wgAEAD(k[2], 0, nil, h, true)
+
+	if err != nil {
+		return
+	}
+
+	local := make([]byte, 4)
+	rand.Read(local)
+
+	res = make([]byte, WG_RESPONSE_SIZE)
+	res[0] = WG_HANDSHAKE_RESPONSE
+	copy(res[4:8], local)
+	binary.LittleEndian.PutUint32(res[8:12], sender)
+	copy(res[12:44], pub)
+	copy(res[44:60], empty)
+	copy(res[60:76], wgMAC(wgHash([]byte(WG_LABEL_MAC1), static), res[0:60]))
+
+	// transport keys, the initiator sends with the first one
+	k = wgKDF(2, ck, nil)
+
+	recv, _ := chacha20poly1305.New(k[0])
+	send, _ := chacha20poly1305.New(k[1])
+
+	t.session = &wgSession{
+		local:   binary.LittleEndian.Uint32(local),
+		remote:  sender,
+		send:    send,
+		recv:    recv,
+		created: time.Now(),
+	}
+
+	t.timestamp = timestamp
+
+	return
+}
+
+// replay returns whether a counter was already received, otherwise the
+// sliding window is updated.
+func (s *wgSession) replay(counter uint64) bool {
+	switch {
+	case counter > s.last:
+		shift := counter - s.last
+
+		if shift >= WG_REPLAY_WINDOW {
+			s.window = 0
+		} else {
+			s.window <<= shift
+		}
+
+		s.window |= 1
+		s.last = counter
+	case s.last-counter >= WG_REPLAY_WINDOW:
+		return true
+	default:
+		bit := uint64(1) << (s.last - counter)
+
+		if s.window&bit != 0 {
+			return true
+		}
+
+		s.window |= bit
+	}
+
+	return false
+}
+
+// receive processes a transport data message, returning the decrypted
+// packet.
+func (t *wgTunnel) receive(msg []byte) (pkt []byte, err error) {
+	s := t.session
+
+	if s == nil || binary.LittleEndian.Uint32(msg[4:8]) != s.local {
+		return nil, errors.New("unknown session")
+	}
+
+	if time.Since(s.created) > WG_REJECT_AFTER_TIME {
+		return nil, errors.New("expired session")
+	}
+
+	counter := binary.LittleEndian.Uint64(msg[8:16])
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+
+	if pkt, err = s.recv.Open(nil, nonce, msg[16:], nil); err != nil {
+		return
+	}
+
+	if s.replay(counter) {
+		return nil, errors.New("replayed packet")
+	}
+
+	return
+}
+
+// send encrypts and transmits a packet to the peer.
+func (t *wgTunnel) send(pkt []byte) (err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	s := t.session
+
+	if s == nil || t.endpoint == nil || time.Since(s.created) > WG_REJECT_AFTER_TIME {
+		return errors.New("no session")
+	}
+
+	// pad to a 16 bytes multiple
+	if r := len(pkt) % 16; r != 0 {
+		pkt = append(pkt, make([]byte, 16-r)...)
+	}
+
+	msg := make([]byte, WG_TRANSPORT_SIZE)
+	msg[0] = WG_TRANSPORT_DATA
+	binary.LittleEndian.PutUint32(msg[4:8], s.remote)
+	binary.LittleEndian.PutUint64(msg[8:16], s.counter)
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], s.counter)
+
+	msg = s.send.Seal(msg, nonce, pkt, nil)
+	s.counter += 1
+
+	_, err = t.conn.WriteTo(msg, t.endpoint)
+
+	return
+}
+
+func (t *wgTunnel) allowed(pkt []byte) bool {
+	ip := header.IPv4(pkt)
+
+	if len(pkt) < header.IPv4MinimumSize || !ip.IsValid(len(pkt)) {
+		return false
+	}
+
+	src := net.IP(ip.SourceAddress())
+
+	for _, n := range t.conf.AllowedIPs {
+		if n.Contains(src) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *wgTunnel) handle(msg []byte, addr *net.UDPAddr) {
+	t.Lock()
+	defer t.Unlock()
+
+	switch {
+	case len(msg) == WG_INITIATION_SIZE && msg[0] == WG_HANDSHAKE_INITIATION:
+		res, err := t.handshake(msg)
+
+		if err != nil {
+			wireguardLog.Warnf("handshake from %s rejected, %v", addr, err)
+			return
+		}
+
+		t.endpoint = addr
+		t.conn.WriteTo(res, addr)
+
+		wireguardLog.Infof("handshake completed with %s", addr)
+	case len(msg) >= WG_TRANSPORT_SIZE+WG_TAG_SIZE && msg[0] == WG_TRANSPORT_DATA:
+		pkt, err := t.receive(msg)
+
+		if err != nil {
+			return
+		}
+
+		// the endpoint follows the peer roaming
+		t.endpoint = addr
+
+		// keepalive
+		if len(pkt) == 0 {
+			return
+		}
+
+		if !t.allowed(pkt) {
+			return
+		}
+
+		// strip padding
+		pkt = pkt[:header.IPv4(pkt).TotalLength()]
+
+		t.link.InjectInbound(ipv4.ProtocolNumber, &stack.PacketBuffer{
+			Data: buffer.View(pkt).ToVectorisedView(),
+		})
+	}
+}
+
+// startWireGuard terminates a WireGuard tunnel on the argument stack, the
+// network services are started on the tunnel address.
+func startWireGuard(s *stack.Stack, addr tcpip.Address, nic tcpip.NICID) {
+	c, err := wgConfigure()
+
+	if err != nil {
+		wireguardLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	fullAddr := tcpip.FullAddress{Addr: addr, Port: c.Port, NIC: nic}
+	conn, err := gonet.DialUDP(s, &fullAddr, nil, ipv4.ProtocolNumber)
+
+	if err != nil {
+		wireguardLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	// tunnel network stack
+	ts := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocol{
+			ipv4.NewProtocol(),
+			arp.NewProtocol()},
+		TransportProtocols: []stack.TransportProtocol{
+			tcp.NewProtocol(),
+			icmp.NewProtocol4()},
+	})
+
+	link := channel.New(256, WG_MTU, "")
+
+	if err := ts.CreateNIC(1, newFilterEndpoint(link)); err != nil {
+		wireguardLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	protoAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: c.Addr,
+	}
+
+	if err := ts.AddProtocolAddress(1, protoAddr); err != nil {
+		wireguardLog.Warnf("disabled, %v", err)
+		return
+	}
+
+	subnet, _ := tcpip.NewSubnet("\x00\x00\x00\x00", "\x00\x00\x00\x00")
+
+	ts.SetRouteTable([]tcpip.Route{{
+		Destination: subnet,
+		NIC:         1,
+	}})
+
+	t := &wgTunnel{
+		conf: c,
+		conn: conn,
+		link: link,
+	}
+
+	go func() {
+		for {
+			info, valid := link.ReadContext(context.Background())
+
+			if !valid {
+				continue
+			}
+
+			pkt := append(info.Pkt.Header.View(), info.Pkt.Data.ToView()...)
+			t.send(pkt)
+		}
+	}()
+
+	wireguardLog.Infof("listening on %s:%d, public key %s, tunnel address %s", addr, c.Port, base64.StdEncoding.EncodeToString(c.PublicKey), c.Addr)
+
+	startServices(ts, c.Addr.Address, 1)
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			wireguardLog.Errorf("read error, %v", err)
+			continue
+		}
+
+		t.handle(append([]byte{}, buf[:n]...), from.(*net.UDPAddr))
+	}
+}
@@ -0,0 +1,382 @@
+// https://github.com/f-secure-foundry/tamago-example
+//
+// Copyright (c) F-Secure Corporation
+// https://foundry.f-secure.com
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XMODEM (CRC and 1K variants) and YMODEM batch transfers, which allow files
+// to be exchanged over a serial line with common terminal software
+// (e.g. lrzsz `sx`/`rx`/`sb`/`rb`).
+const (
+	XMODEM_SOH = 0x01
+	XMODEM_STX = 0x02
+	XMODEM_EOT = 0x04
+	XMODEM_ACK = 0x06
+	XMODEM_NAK = 0x15
+	XMODEM_CAN = 0x18
+	XMODEM_CRC = 'C'
+	XMODEM_SUB = 0x1a
+
+	XMODEM_BLOCK    = 128
+	XMODEM_BLOCK_1K = 1024
+
+	XMODEM_RETRIES = 10
+	// wait for the start of a block or a response
+	XMODEM_TIMEOUT = 10 * time.Second
+	// wait for each byte within a block
+	XMODEM_BYTE_TIMEOUT = 1 * time.Second
+
+	// maximum received file size, as files are held in memory
+	XMODEM_MAX_SIZE = 32 * 1024 * 1024
+)
+
+var errCancelled = errors.New("transfer cancelled")
+
+// modem represents a serial line used for XMODEM/YMODEM transfers.
+type modem struct {
+	io.Writer
+
+	// Rx returns the next received byte, waiting up to the argument
+	// timeout.
+	Rx func(timeout time.Duration) (byte, error)
+}
+
+func crc16(buf []byte) (crc uint16) {
+	for _, b := range buf {
+		crc ^= uint16(b) << 8
+
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return
+}
+
+func (m *modem) tx(c ...byte) {
+	m.Write(c)
+}
+
+// purge discards incoming bytes until the line is idle.
+func (m *modem) purge() {
+	for {
+		if _, err := m.Rx(XMODEM_BYTE_TIMEOUT); err != nil {
+			return
+		}
+	}
+}
+
+func (m *modem) cancel() {
+	m.tx(XMODEM_CAN, XMODEM_CAN, XMODEM_CAN)
+}
+
+// readBlock receives a CRC block, eot is returned on end of transmission.
+func (m *modem) readBlock() (seq byte, data []byte, eot bool, err error) {
+	c, err := m.Rx(XMODEM_TIMEOUT)
+
+	if err != nil {
+		return
+	}
+
+	var size int
+
+	switch c {
+	case XMODEM_SOH:
+		size = XMODEM_BLOCK
+	case XMODEM_STX:
+		size = XMODEM_BLOCK_1K
+	case XMODEM_EOT:
+		eot = true
+		return
+	case XMODEM_CAN:
+		err = errCancelled
+		return
+	default:
+		err = fmt.Errorf("invalid block header %#x", c)
+		return
+	}
+
+	buf := make([]byte, 2+size+2)
+
+	for i := range buf {
+		if buf[i], err = m.Rx(XMODEM_BYTE_TIMEOUT); err != nil {
+			return
+		}
+	}
+
+	if buf[0] != ^buf[1] {
+		err = errors.New("invalid block number")
+		return
+	}
+
+	data = buf[2 : 2+size]
+
+	if crc16(data) != uint16(buf[2+size])<<8|uint16(buf[3+size]) {
+		err = errors.New("CRC error")
+		return
+	}
+
+	return buf[0], data, false, nil
+}
+
+// receiveData receives data blocks, starting from block 1, until the end of
+// transmission.
+func (m *modem) receiveData(buf *bytes.Buffer) (err error) {
+	expected := byte(1)
+	retries := 0
+
+	m.tx(XMODEM_CRC)
+
+	for {
+		seq, data, eot, err := m.readBlock()
+
+		switch {
+		case err == errCancelled:
+			return err
+		case err != nil:
+			if retries += 1; retries > XMODEM_RETRIES {
+				m.cancel()
+				return err
+			}
+
+			m.purge()
+
+			if expected == 1 && buf.Len() == 0 {
+				m.tx(XMODEM_CRC)
+			} else {
+				m.tx(XMODEM_NAK)
+			}
+		case eot:
+			m.tx(XMODEM_ACK)
+			return nil
+		case seq == expected-1:
+			// retransmission of an acknowledged block
+			m.tx(XMODEM_ACK)
+		case seq == expected:
+			if buf.Len()+len(data) > XMODEM_MAX_SIZE {
+				m.cancel()
+				return errors.New("file too large")
+			}
+
+			buf.Write(data)
+			m.tx(XMODEM_ACK)
+
+			expected += 1
+			retries = 0
+		default:
+			m.cancel()
+			return errors.New("block sequence error")
+		}
+	}
+}
+
+// XReceive receives a file with XMODEM, padding at the end of the last block
+// is removed.
+func (m *modem) XReceive() (data []byte, err error) {
+	var buf bytes.Buffer
+
+	if err = m.receiveData(&buf); err != nil {
+		return
+	}
+
+	return bytes.TrimRight(buf.Bytes(), string(rune(XMODEM_SUB))), nil
+}
+
+// YReceive receives a YMODEM batch, invoking the argument function for each
+// file.
+func (m *modem) YReceive(file func(name string, data []byte) error) (err error) {
+	for {
+		var data []byte
+
+		for retries := 0; ; retries++ {
+			if retries > XMODEM_RETRIES {
+				m.cancel()
+				return errors.New("no header block")
+			}
+
+			m.tx(XMODEM_CRC)
+
+			var seq byte
+
+			if seq, data, _, err = m.readBlock(); err == errCancelled {
+				return
+			}
+
+			if err == nil && seq == 0 {
+				break
+			}
+
+			m.purge()
+		}
+
+		m.tx(XMODEM_ACK)
+
+		header := bytes.SplitN(data, []byte{0}, 2)
+		name := string(header[0])
+
+		// an empty file name ends the batch
+		if name == "" {
+			return nil
+		}
+
+		size := -1
+
+		if len(header) == 2 {
+			if fields := strings.Fields(string(bytes.TrimRight(header[1], "\x00"))); len(fields) > 0 {
+				size, _ = strconv.Atoi(fields[0])
+			}
+		}
+
+		var buf bytes.Buffer
+
+		if err = m.receiveData(&buf); err != nil {
+			return
+		}
+
+		if size >= 0 && size <= buf.Len() {
+			buf.Truncate(size)
+		}
+
+		if err = file(name, buf.Bytes()); err != nil {
+			m.cancel()
+			return
+		}
+	}
+}
+
+// wait waits for one of the argument responses.
+func (m *modem) wait(responses ...byte) (c byte, err error) {
+	for {
+		if c, err = m.Rx(XMODEM_TIMEOUT); err != nil {
+			return
+		}
+
+		if c == XMODEM_CAN {
+			return c, errCancelled
+		}
+
+		if bytes.IndexByte(responses, c) >= 0 {
+			return
+		}
+	}
+}
+
+// sendBlock sends a CRC block, padded with the argument byte.
+func (m *modem) sendBlock(seq byte, data []byte, size int, pad byte) (err error) {
+	block := make([]byte, 3+size+2)
+
+	if size == XMODEM_BLOCK {
+		block[0] = XMODEM_SOH
+	} else {
+		block[0] = XMODEM_STX
+	}
+
+	block[1] = seq
+	block[2] = ^seq
+
+	payload := block[3 : 3+size]
+	copy(payload, data)
+
+	for i := len(data); i < size; i++ {
+		payload[i] = pad
+	}
+
+	crc := crc16(payload)
+	block[3+size] = byte(crc >> 8)
+	block[4+size] = byte(crc)
+
+	for retries := 0; retries <= XMODEM_RETRIES; retries++ {
+		m.Write(block)
+
+		if c, err := m.wait(XMODEM_ACK, XMODEM_NAK); err != nil {
+			return err
+		} else if c == XMODEM_ACK {
+			return nil
+		}
+	}
+
+	return errors.New("too many retries")
+}
+
+// sendData sends data in 1K blocks, starting from block 1, followed by the
+// end of transmission.
+func (m *modem) sendData(data []byte) (err error) {
+	seq := byte(1)
+
+	for off := 0; off < len(data); off += XMODEM_BLOCK_1K {
+		end := off + XMODEM_BLOCK_1K
+
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err = m.sendBlock(seq, data[off:end], XMODEM_BLOCK_1K, XMODEM_SUB); err != nil {
+			return
+		}
+
+		seq += 1
+	}
+
+	for retries := 0; retries <= XMODEM_RETRIES; retries++ {
+		m.tx(XMODEM_EOT)
+
+		if c, err := m.wait(XMODEM_ACK, XMODEM_NAK); err != nil {
+			return err
+		} else if c == XMODEM_ACK {
+			return nil
+		}
+	}
+
+	return errors.New("no EOT acknowledgment")
+}
+
+// XSend sends a file with XMODEM-1K, the receiver must request CRC mode.
+func (m *modem) XSend(data []byte) (err error) {
+	if _, err = m.wait(XMODEM_CRC); err != nil {
+		return
+	}
+
+	return m.sendData(data)
+}
+
+// YSend sends a single file YMODEM batch.
+func (m *modem) YSend(name string, data []byte) (err error) {
+	if _, err = m.wait(XMODEM_CRC); err != nil {
+		return
+	}
+
+	header := []byte(fmt.Sprintf("%s\x00%d", name, len(data)))
+
+	if err = m.sendBlock(0, header, XMODEM_BLOCK, 0); err != nil {
+		return
+	}
+
+	if err = m.XSend(data); err != nil {
+		return
+	}
+
+	// end of batch
+	if _, err = m.wait(XMODEM_CRC); err != nil {
+		return
+	}
+
+	return m.sendBlock(0, nil, XMODEM_BLOCK, 0)
+}